@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// apiRun is a run started through the API
+type apiRun struct {
+	ID       int        `json:"id"`
+	Command  string     `json:"command"` // sort or dedupe
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// apiMessage is a line of the /api/events stream: an event of a file, the
+// progress of the run every second, or a run starting or finishing
+type apiMessage struct {
+	Event    *sorter.Event  `json:"event,omitempty"`
+	Progress *sorter.Status `json:"progress,omitempty"`
+	Run      *apiRun        `json:"run,omitempty"`
+}
+
+// apiServer drives the sorter over HTTP for sorter serve. It does one
+// thing at a time that changes the directories, each under the run lock,
+// keeps the report of the last run and streams what the sorter does.
+type apiServer struct {
+	s      *sorter.Sorter
+	token  string
+	report *sorter.Report // Fed by the sorter's events, reset for every run
+
+	mu          sync.Mutex
+	busy        string // What is being done, empty when idle
+	runs        int
+	last        *apiRun
+	lastReport  []sorter.ReportRow
+	subscribers map[chan apiMessage]bool // Clients of /api/events and ProgressEvents
+	errors      []sorter.Event           // The last maxAPIErrors error events
+	done        sync.WaitGroup
+}
+
+// maxAPIErrors is how many error events /api/errors keeps
+const maxAPIErrors = 50
+
+func newAPIServer(report *sorter.Report) *apiServer {
+	return &apiServer{report: report, subscribers: make(map[chan apiMessage]bool)}
+}
+
+// runServe serves the API at -listen until Ctrl-C, then waits for the run
+// in progress to stop after its current file
+func runServe(s *sorter.Sorter) error {
+	token := os.ExpandEnv(apiToken)
+	if token == "" && !loopback(listenAddr) {
+		return &sorter.ConfigError{Err: errors.New("serve needs -api-token to listen beyond localhost")}
+	}
+	api.s, api.token = s, token
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: api.handler(), ReadHeaderTimeout: 10 * time.Second}
+	// gRPC clients speak HTTP/2 straight away, without TLS
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	slog.Info("Serving API", "url", "http://"+ln.Addr().String()+"/api/", "grpc", ln.Addr().String())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+	go watchConfig(s, stopRequested)
+
+	select {
+	case err := <-served:
+		return err
+	case <-stopRequested:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	api.done.Wait()
+	return nil
+}
+
+// loopback reports whether addr only listens on this machine
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (api *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", api.status)
+	mux.HandleFunc("POST /api/runs", api.startRun)
+	mux.HandleFunc("GET /api/runs/last", api.lastRun)
+	mux.HandleFunc("GET /api/runs/last/report", api.lastRunReport)
+	mux.HandleFunc("GET /api/events", api.events)
+	mux.HandleFunc("POST /api/verify", api.verify)
+	mux.HandleFunc("GET /api/errors", api.recentErrors)
+	mux.HandleFunc("GET /api/stats", api.stats)
+	mux.HandleFunc("GET /api/index", api.index)
+	mux.HandleFunc("GET /api/deleted", api.deleted)
+	mux.HandleFunc("POST /api/deleted/restore", api.restore)
+	mux.HandleFunc("POST /api/deleted/purge", api.purge)
+	mux.Handle("GET /", webHandler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPC(r) {
+			api.serveGRPC(w, r)
+			return
+		}
+		if err := api.checkOrigin(r); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		// The dashboard itself holds no data, it asks for the token
+		if api.token != "" && strings.HasPrefix(r.URL.Path, "/api/") && !api.authorized(r) {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether a request gives the token
+func (api *apiServer) authorized(r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(api.token)) == 1
+}
+
+// checkOrigin turns away what a web page could make a browser send: without
+// a token, requests whose Host isn't a name of this machine, as DNS
+// rebinding gives them; and changes asked for from another site, or in
+// anything but JSON or gRPC, which a page can send without the browser
+// asking the API first.
+func (api *apiServer) checkOrigin(r *http.Request) error {
+	if api.token == "" && !loopbackHost(r.Host) {
+		return fmt.Errorf("host %q is not this machine", r.Host)
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return nil
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return fmt.Errorf("requests from %s are not allowed", origin)
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" && !isGRPC(r) {
+		return errors.New("content type must be application/json")
+	}
+	return nil
+}
+
+// loopbackHost reports whether the Host header of a request names this
+// machine: localhost or a loopback address, with any port
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// writeResult answers with v, or with the error of an operation, which is
+// a conflict when another run holds the lock
+func writeResult(w http.ResponseWriter, v any, err error) {
+	var locked *sorter.LockedError
+	var partial *sorter.PartialError
+	switch {
+	case errors.As(err, &locked):
+		writeError(w, http.StatusConflict, err)
+	case errors.As(err, &partial):
+		writeJSON(w, http.StatusOK, map[string]any{"result": v, "error": err.Error()})
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// start claims the sorter for what, failing while it is busy with
+// something else, and takes the run lock. The returned function releases
+// both.
+func (api *apiServer) start(what string) (func(), error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.busy != "" {
+		return nil, fmt.Errorf("busy with %s", api.busy)
+	}
+	unlock := func() {}
+	if !engine.DryRun {
+		var err error
+		if unlock, err = api.s.Lock(); err != nil {
+			return nil, err
+		}
+	}
+	api.busy = what
+	return func() {
+		unlock()
+		api.mu.Lock()
+		api.busy = ""
+		api.mu.Unlock()
+	}, nil
+}
+
+func (api *apiServer) status(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"busy":     api.busy,
+		"status":   api.s.Status(),
+		"last_run": api.last,
+	})
+}
+
+// startRun starts a sort, or a dedupe with ?command=dedupe, in the
+// background, answering at once with the run to follow in /api/status
+func (api *apiServer) startRun(w http.ResponseWriter, r *http.Request) {
+	command := r.URL.Query().Get("command")
+	var run func() error
+	switch command {
+	case "", "sort":
+		command, run = "sort", api.s.Run
+	case "dedupe":
+		run = api.s.Dedupe
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("command %q must be sort or dedupe", command))
+		return
+	}
+	started, _, err := api.run(command, run)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, started)
+}
+
+// apiResult is a finished run and its report
+type apiResult struct {
+	run  apiRun
+	rows []sorter.ReportRow
+}
+
+// run starts command in the background, returning the run started and a
+// channel receiving it once finished
+func (api *apiServer) run(command string, run func() error) (apiRun, <-chan apiResult, error) {
+	release, err := api.start(command)
+	if err != nil {
+		return apiRun{}, nil, err
+	}
+
+	api.mu.Lock()
+	api.runs++
+	current := &apiRun{ID: api.runs, Command: command, Started: time.Now()}
+	api.last = current
+	started := *current
+	api.mu.Unlock()
+	api.publish(apiMessage{Run: &started})
+	if api.report != nil {
+		api.report.Reset()
+	}
+	done := make(chan apiResult, 1)
+	api.done.Add(1)
+	go func() {
+		defer api.done.Done()
+		defer release()
+		progressDone := make(chan struct{})
+		go api.publishProgress(progressDone)
+		err := run()
+		close(progressDone)
+		var rows []sorter.ReportRow
+		if api.report != nil {
+			rows = api.report.Rows()
+		}
+		api.mu.Lock()
+		finished := time.Now()
+		current.Finished = &finished
+		if err != nil {
+			current.Error = err.Error()
+		}
+		api.lastReport = rows
+		finishedRun := *current
+		api.mu.Unlock()
+		api.publish(apiMessage{Run: &finishedRun})
+		done <- apiResult{finishedRun, rows}
+	}()
+	return started, done, nil
+}
+
+func (api *apiServer) lastRun(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.last == nil {
+		writeError(w, http.StatusNotFound, errors.New("no run yet"))
+		return
+	}
+	writeJSON(w, http.StatusOK, api.last)
+}
+
+// lastRunReport answers with the decisions of the last finished run, as
+// -report writes them
+func (api *apiServer) lastRunReport(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	rows := api.lastReport
+	api.mu.Unlock()
+	if rows == nil {
+		rows = []sorter.ReportRow{}
+	}
+	writeJSON(w, http.StatusOK, rows)
+}
+
+func (api *apiServer) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := api.s.Stats()
+	writeResult(w, stats, err)
+}
+
+// index lists the files of the hash index, those under ?prefix= or with
+// ?hash=, up to ?limit= (default 1000)
+func (api *apiServer) index(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, hash := query.Get("prefix"), query.Get("hash")
+	limit := 1000
+	if text := query.Get("limit"); text != "" {
+		n, err := strconv.Atoi(text)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", text))
+			return
+		}
+		limit = n
+	}
+	files := []sorter.IndexedFile{}
+	err := api.s.Indexed(func(f sorter.IndexedFile) bool {
+		if strings.HasPrefix(f.Path, prefix) && (hash == "" || f.Hash == hash) {
+			files = append(files, f)
+		}
+		return len(files) < limit
+	})
+	writeResult(w, files, err)
+}
+
+func (api *apiServer) deleted(w http.ResponseWriter, r *http.Request) {
+	files, err := api.s.Deleted()
+	if files == nil {
+		files = []sorter.DeletedFile{}
+	}
+	writeResult(w, files, err)
+}
+
+// restore moves the files of {"paths": [...]} back to the inbox, or every
+// file with {"all": true}
+func (api *apiServer) restore(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Paths []string `json:"paths"`
+		All   bool     `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.All == (len(req.Paths) > 0) {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"paths": [...]} or {"all": true}`))
+		return
+	}
+	release, err := api.start("restore")
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	defer release()
+	if req.All {
+		err = api.s.RestoreAll()
+	} else {
+		err = api.s.Restore(req.Paths...)
+	}
+	writeResult(w, map[string]bool{"ok": err == nil}, err)
+}
+
+// purge permanently deletes the files kept for longer than
+// {"older_than": "30d"}
+func (api *apiServer) purge(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OlderThan *sorter.Duration `json:"older_than"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OlderThan == nil {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"older_than": "30d"}`))
+		return
+	}
+	release, err := api.start("purge")
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	defer release()
+	result, err := api.s.Purge(time.Duration(*req.OlderThan))
+	writeResult(w, result, err)
+}
+
+// record keeps the error events for /api/errors and streams every event
+func (api *apiServer) record(event sorter.Event) {
+	if event.Type == sorter.EventError {
+		api.mu.Lock()
+		api.errors = append(api.errors, event)
+		if len(api.errors) > maxAPIErrors {
+			api.errors = slices.Delete(api.errors, 0, len(api.errors)-maxAPIErrors)
+		}
+		api.mu.Unlock()
+	}
+	api.publish(apiMessage{Event: &event})
+}
+
+// publish sends m to the clients of /api/events and ProgressEvents. A
+// client too slow to keep up misses messages rather than holding up the
+// sorter.
+func (api *apiServer) publish(m apiMessage) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for ch := range api.subscribers {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving what is published until the
+// returned function is called
+func (api *apiServer) subscribe() (<-chan apiMessage, func()) {
+	ch := make(chan apiMessage, 256)
+	api.mu.Lock()
+	api.subscribers[ch] = true
+	api.mu.Unlock()
+	return ch, func() {
+		api.mu.Lock()
+		delete(api.subscribers, ch)
+		api.mu.Unlock()
+	}
+}
+
+// publishProgress publishes the status of the run every second until done
+// is closed
+func (api *apiServer) publishProgress(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			status := api.s.Status()
+			api.publish(apiMessage{Progress: &status})
+		}
+	}
+}
+
+// events streams the events of the runs, their progress and their start
+// and end as JSON lines, until the client goes away
+func (api *apiServer) events(w http.ResponseWriter, r *http.Request) {
+	ch, unsubscribe := api.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	for {
+		select {
+		case m := <-ch:
+			line, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		case <-stopRequested:
+			return
+		}
+	}
+}
+
+// verify re-hashes the indexed files and answers with those changed or
+// missing, as sorter verify lists them
+func (api *apiServer) verify(w http.ResponseWriter, r *http.Request) {
+	release, err := api.start("verify")
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	defer release()
+	result, err := api.s.Verify()
+	writeResult(w, result, err)
+}
+
+// recentErrors answers with the last files that failed, the oldest first
+func (api *apiServer) recentErrors(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	events := append([]sorter.Event{}, api.errors...)
+	api.mu.Unlock()
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		method  string
+		host    string
+		origin  string
+		ctype   string
+		allowed bool
+	}{
+		{"status from curl", "", "GET", "localhost:7878", "", "", true},
+		{"status on loopback address", "", "GET", "127.0.0.1:7878", "", "", true},
+		{"status on IPv6 loopback", "", "GET", "[::1]:7878", "", "", true},
+		{"rebound host", "", "GET", "evil.example:7878", "", "", false},
+		{"rebound host with token", "secret", "GET", "sorter.lan:7878", "", "", true},
+		{"purge from curl", "", "POST", "localhost:7878", "", "application/json", true},
+		{"purge from the dashboard", "", "POST", "localhost:7878", "http://localhost:7878", "application/json; charset=utf-8", true},
+		{"purge as text", "", "POST", "localhost:7878", "", "text/plain", false},
+		{"purge without content type", "", "POST", "localhost:7878", "", "", false},
+		{"purge as a form", "", "POST", "localhost:7878", "", "application/x-www-form-urlencoded", false},
+		{"purge from another site", "", "POST", "localhost:7878", "https://evil.example", "application/json", false},
+		{"purge from a sandboxed page", "", "POST", "localhost:7878", "null", "application/json", false},
+		{"purge from another site with token", "secret", "POST", "sorter.lan:7878", "https://evil.example", "application/json", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &apiServer{token: tt.token}
+			r := httptest.NewRequest(tt.method, "/api/deleted/purge", strings.NewReader(`{"older_than":"0s"}`))
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.ctype != "" {
+				r.Header.Set("Content-Type", tt.ctype)
+			}
+			err := api.checkOrigin(r)
+			if (err == nil) != tt.allowed {
+				t.Errorf("checkOrigin() = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestHandlerRefusesCrossSitePurge(t *testing.T) {
+	api := newAPIServer(nil)
+	r := httptest.NewRequest("POST", "http://localhost:7878/api/deleted/purge", strings.NewReader(`{"older_than":"0s"}`))
+	r.Header.Set("Origin", "https://evil.example")
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	api.handler().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// defaultChatTemplate announces what a pass filed and flags what it
+// couldn't classify or move
+const defaultChatTemplate = `{{with .Sorted}}Filed {{count (len .) "file"}}:
+{{range .}}• {{.Name}} → {{.Category}}
+{{end}}{{end}}{{with .Duplicates}}Removed {{count (len .) "duplicate"}}
+{{end}}{{with .Deleted}}Deleted {{count (len .) "file"}} by rules
+{{end}}{{with .Unclassified}}⚠ Couldn't classify {{count (len .) "file"}}:
+{{range .}}• {{.Name}}{{with .Category}} (in {{.}}){{end}}
+{{end}}{{end}}{{with .Failed}}⚠ {{count (len .) "file"}} failed:
+{{range .}}• {{.Name}}: {{.Error}}
+{{end}}{{end}}{{with .Err}}⚠ Sorting failed: {{.}}
+{{end}}`
+
+// chat is a chat notifications are posted to
+type chat struct {
+	kind     string // slack, discord or telegram
+	url      string
+	chatID   string // Telegram only
+	limit    int    // Longest message the chat takes, in characters
+	template *template.Template
+}
+
+// newChat checks a notifier of the config. Its webhook and token may name
+// environment variables, as $NAME, to keep secrets out of the config file.
+func newChat(config NotifierConfig, defaultTemplate string) (*chat, error) {
+	c := &chat{kind: config.Type}
+	webhook, token := os.ExpandEnv(config.Webhook), os.ExpandEnv(config.Token)
+	switch config.Type {
+	case "slack", "discord":
+		if webhook == "" {
+			return nil, fmt.Errorf("%s notifier needs a webhook", config.Type)
+		}
+		c.url, c.limit = webhook, 4000
+		if config.Type == "discord" {
+			c.limit = 2000
+		}
+	case "telegram":
+		if token == "" || config.ChatID == "" {
+			return nil, fmt.Errorf("telegram notifier needs a token and a chat_id")
+		}
+		c.url, c.chatID, c.limit = "https://api.telegram.org/bot"+token+"/sendMessage", config.ChatID, 4096
+	default:
+		return nil, fmt.Errorf("notifier type %q must be slack, discord or telegram", config.Type)
+	}
+
+	text := firstNonEmpty(config.Template, defaultTemplate, defaultChatTemplate)
+	tmpl, err := template.New(config.Type).Funcs(template.FuncMap{"count": count}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s notifier template: %w", config.Type, err)
+	}
+	c.template = tmpl
+	return c, nil
+}
+
+// send posts the message for b, unless the template made it empty
+func (c *chat) send(ctx context.Context, b batch) error {
+	var text strings.Builder
+	if err := c.template.Execute(&text, b); err != nil {
+		return err
+	}
+	message := strings.TrimSpace(text.String())
+	if message == "" {
+		return nil
+	}
+	if utf8.RuneCountInString(message) > c.limit {
+		message = string([]rune(message)[:c.limit-1]) + "…"
+	}
+
+	var body any
+	switch c.kind {
+	case "slack":
+		body = map[string]string{"text": message}
+	case "discord":
+		body = map[string]string{"content": message}
+	case "telegram":
+		body = map[string]string{"chat_id": c.chatID, "text": message}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The URL holds the secret, keep it out of the logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// command is a sorter subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(s *sorter.Sorter) error
+	locks   bool // Changes the directories, so it takes the run lock
+	args    bool // Takes file arguments after its flags
+}
+
+// Subcommands, in the order they are listed in the usage text. The first one
+// is the default when no command is given.
+var commands = []command{
+	{"sort", "Sort the inbox into the sorted directory and remove emptied folders", runSort, true, false},
+	{"index", "Index the sorted directory, record its file hashes and report what it holds", runIndex, false, false},
+	{"verify", "Re-hash sorted files and report those changed or missing since they were indexed", runVerify, false, false},
+	{"dedupe", "Move inbox duplicates to the delete directory without sorting anything else", runDedupe, true, false},
+	{"stats", "Show file counts and sizes for each directory and category", runStats, false, false},
+	{"clean-empty", "Remove empty folders from the inbox", runCleanEmpty, true, false},
+	{"undo", "Restore the inbox to how it was before the last run", runUndo, true, false},
+	{"purge", "Permanently delete files kept in the delete directory for longer than -older-than", runPurge, true, false},
+	{"restore", "Move files (or -all) from the delete directory back to where they were in the inbox", runRestore, true, true},
+	{"manifest", "Write sha256sum or SFV checksum manifests of the sorted directory", runManifest, false, false},
+	{"resort", "Move sorted files whose category changed since they were sorted", runResort, true, false},
+	{"merge", "Import another sorted directory, moving its duplicates to the delete directory", runMerge, true, true},
+	{"suggest", "Propose categories for the extensions that keep ending up in Misc (-write to add them)", runSuggest, false, false},
+	// Run by main before the sorter is set up, see runConfig and runCompletion
+	{"config", "Write starter config files (config init) or check them for mistakes (config validate)", nil, false, true},
+	{"completion", "Print a bash, zsh, fish or powershell completion script", nil, false, true},
+	{"serve", "Serve a JSON API at -listen to start runs, follow them and manage the delete folder", runServe, false, false},
+	{"install-service", "Write a systemd unit running sorter -watch with these flags (-system for a system-wide one)", runInstallService, false, false},
+	{"install-launchagent", "Write and load a launchd agent running sorter -watch, or every -interval, with these flags", runInstallLaunchAgent, false, false},
+	{"service", "Install, uninstall, start or stop a Windows service running sorter -watch with these flags", runService, false, true},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func runSort(s *sorter.Sorter) error {
+	if watchMode {
+		defer notifySystemd(s)()
+		go watchConfig(s, stopRequested)
+		if engine.Schedule != "" {
+			return s.RunOnSchedule(stopRequested)
+		}
+		return s.Watch(stopRequested)
+	}
+	return s.Run()
+}
+
+func runIndex(s *sorter.Sorter) error {
+	usage, err := s.Index()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sorted directory holds %d files (%s)\n", usage.Files, formatBytes(usage.Bytes))
+	return nil
+}
+
+func runVerify(s *sorter.Sorter) error {
+	result, err := s.Verify()
+	if result == nil {
+		return err
+	}
+	for _, list := range []struct {
+		label string
+		paths []string
+	}{{"CORRUPTED", result.Corrupted}, {"MODIFIED", result.Modified}, {"MISSING", result.Missing}} {
+		for _, path := range list.paths {
+			fmt.Printf("%-9s  %s\n", list.label, path)
+		}
+	}
+	fmt.Printf("Checked %d files: %d corrupted, %d modified, %d missing", result.Checked,
+		len(result.Corrupted), len(result.Modified), len(result.Missing))
+	if result.Unindexed > 0 {
+		fmt.Printf(" (%d files not indexed yet)", result.Unindexed)
+	}
+	fmt.Println()
+	if err == nil && !result.OK() {
+		err = &sorter.PartialError{Failed: len(result.Corrupted) + len(result.Modified) + len(result.Missing)}
+	}
+	return err
+}
+
+func runDedupe(s *sorter.Sorter) error {
+	switch within {
+	case "inbox":
+		return s.Dedupe()
+	case "sorted":
+	default:
+		return &sorter.ConfigError{Err: fmt.Errorf("invalid -within %q: must be inbox or sorted", within)}
+	}
+
+	sets, err := s.DedupeSorted(dupAction)
+	var wasted int64
+	for _, set := range sets {
+		fmt.Println(set.Keep)
+		for _, extra := range set.Extras {
+			fmt.Printf("  %s\n", extra)
+		}
+		wasted += set.Size * int64(len(set.Extras))
+	}
+	if len(sets) == 0 && err == nil {
+		fmt.Println("No duplicates in the sorted directory")
+	} else if len(sets) > 0 {
+		fmt.Printf("%d sets of duplicates, %s in extra copies\n", len(sets), formatBytes(wasted))
+	}
+	return err
+}
+
+func runStats(s *sorter.Sorter) error {
+	stats, err := s.Stats()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "\tFiles\tSize\t\n")
+	fmt.Fprintf(w, "Inbox\t%d\t%s\t\n", stats.Inbox.Files, formatBytes(stats.Inbox.Bytes))
+	fmt.Fprintf(w, "Sorted\t%d\t%s\t\n", stats.Sorted.Files, formatBytes(stats.Sorted.Bytes))
+	fmt.Fprintf(w, "Delete\t%d\t%s\t\n", stats.Delete.Files, formatBytes(stats.Delete.Bytes))
+	w.Flush()
+
+	if len(stats.Categories) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Category\tFiles\tSize\n")
+		for _, c := range stats.Categories {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", c.Category, c.Files, formatBytes(c.Bytes))
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func runCleanEmpty(s *sorter.Sorter) error {
+	return s.CleanEmpty()
+}
+
+func runUndo(s *sorter.Sorter) error {
+	if err := s.Undo(); err != nil {
+		return err
+	}
+	slog.Info("Undo completed successfully")
+	return nil
+}
+
+func runPurge(s *sorter.Sorter) error {
+	age := olderThan
+	if age == 0 {
+		age = time.Duration(engine.Retention)
+	}
+	if age == 0 {
+		return &sorter.ConfigError{Err: errors.New("purge needs -older-than (or a retention)")}
+	}
+	result, err := s.Purge(age)
+	if err != nil {
+		return err
+	}
+	verb := "Purged"
+	if engine.DryRun {
+		verb = "Would purge"
+	}
+	fmt.Printf("%s %d files, reclaiming %s\n", verb, result.Files, formatBytes(result.Bytes))
+	return nil
+}
+
+func runRestore(s *sorter.Sorter) error {
+	switch {
+	case restoreAll && len(cmdArgs) > 0:
+		return &sorter.ConfigError{Err: errors.New("restore takes either files or -all")}
+	case restoreAll:
+		return s.RestoreAll()
+	case len(cmdArgs) == 0:
+		return &sorter.ConfigError{Err: errors.New("restore needs files from the delete directory, or -all")}
+	}
+	return s.Restore(cmdArgs...)
+}
+
+func runManifest(s *sorter.Sorter) error {
+	if !perCategory {
+		if manifestOut == "" {
+			_, err := s.Manifest(os.Stdout, manifestFmt, "")
+			return err
+		}
+		usage, err := writeManifest(s, manifestOut, "")
+		if err == nil {
+			fmt.Printf("Wrote %s covering %d files (%s)\n", manifestOut, usage.Files, formatBytes(usage.Bytes))
+		}
+		return err
+	}
+
+	dir := firstNonEmpty(manifestOut, filepath.Join(engine.Base, "manifests"))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	categories, err := s.CategoryFolders()
+	if err != nil {
+		return err
+	}
+	var partial error
+	for _, category := range categories {
+		path := filepath.Join(dir, category+"."+manifestFmt)
+		usage, err := writeManifest(s, path, category)
+		var partialErr *sorter.PartialError
+		if errors.As(err, &partialErr) {
+			partial = err
+		} else if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s covering %d files (%s)\n", path, usage.Files, formatBytes(usage.Bytes))
+	}
+	return partial
+}
+
+// writeManifest writes the manifest of a category (or of the whole sorted
+// directory) to a file, through a temporary file. A manifest missing the
+// files that couldn't be read is still written.
+func writeManifest(s *sorter.Sorter, path, category string) (sorter.Usage, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return sorter.Usage{}, err
+	}
+	w := bufio.NewWriter(f)
+	usage, err := s.Manifest(w, manifestFmt, category)
+	var partialErr *sorter.PartialError
+	if err == nil || errors.As(err, &partialErr) {
+		if flushErr := w.Flush(); flushErr != nil {
+			err = flushErr
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && !errors.As(err, &partialErr) {
+		os.Remove(f.Name())
+		return usage, err
+	}
+	if renameErr := os.Rename(f.Name(), path); renameErr != nil {
+		return usage, renameErr
+	}
+	return usage, err
+}
+
+func runResort(s *sorter.Sorter) error {
+	result, err := s.Resort()
+	verb := "Moved"
+	if engine.DryRun {
+		verb = "Would move"
+	}
+	fmt.Printf("%s %d of %d sorted files to a new category\n", verb, result.Moved, result.Checked)
+	return err
+}
+
+func runMerge(s *sorter.Sorter) error {
+	if len(cmdArgs) != 1 {
+		return &sorter.ConfigError{Err: errors.New("merge needs the sorted directory to import")}
+	}
+	return s.Merge(cmdArgs[0])
+}
+
+// formatBytes renders a byte count in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func runSuggest(s *sorter.Sorter) error {
+	suggestions, err := s.Suggest()
+	if err != nil {
+		return err
+	}
+	if len(suggestions) == 0 {
+		fmt.Println("No unknown extensions seen")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Extension\tFiles\tCategory\tExamples\n")
+	for _, sg := range suggestions {
+		fmt.Fprintf(w, ".%s\t%d\t%s\t%s\n", sg.Ext, sg.Count, firstNonEmpty(sg.Category, "?"), strings.Join(sg.Examples, ", "))
+	}
+	w.Flush()
+	if !writeSuggest {
+		return nil
+	}
+	if _, err := os.Stat(extensionsCfg); errors.Is(err, fs.ErrNotExist) {
+		return &sorter.ConfigError{Err: errors.New("the built-in categories are in use, create an extensions.json to add to with sorter config init")}
+	}
+
+	p := newPrompter(os.Stdin, os.Stderr)
+	for _, sg := range suggestions {
+		if sg.Category == "" {
+			continue
+		}
+		ok, err := p.ask(fmt.Sprintf("Add .%s to %s in %s?", sg.Ext, sg.Category, extensionsCfg))
+		if errors.Is(err, sorter.ErrAborted) {
+			return nil
+		}
+		if !ok {
+			continue
+		}
+		if err := sorter.AddExtension(extensionsCfg, sg.Category, sg.Ext); err != nil {
+			return err
+		}
+		fmt.Printf("Added .%s to %s\n", sg.Ext, sg.Category)
+	}
+	return nil
+}
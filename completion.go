@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"sorter/pkg/sorter"
+)
+
+// Values offered for flags taking one of a few, and for -profile the
+// profiles of the config. Other flags taking a value complete file names.
+var flagValues = map[string][]string{
+	"output":     {"text", "ndjson", "tui"},
+	"log-level":  {"debug", "info", "warn", "error"},
+	"log-format": {"text", "json"},
+	"notify":     {notifyInfo, notifyError, notifyOff},
+	"within":     {"inbox", "sorted"},
+	"checksum":   sorter.ManifestFormats,
+	"action":     sorter.SortedDupActions,
+}
+
+// Arguments of the commands taking words rather than files
+var commandValues = map[string][]string{
+	"service":    {"install", "uninstall", "start", "stop"},
+	"completion": {"bash", "zsh", "fish", "powershell"},
+	"config":     {"init", "validate"},
+}
+
+// completionFlag is a flag as the completion scripts describe it
+type completionFlag struct {
+	name    string
+	usage   string
+	value   bool     // Takes a value
+	values  []string // The values it takes, when only a few
+	profile bool     // Takes a profile name
+}
+
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		cf := completionFlag{name: f.Name, usage: f.Usage, value: true, values: flagValues[f.Name], profile: f.Name == "profile"}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			cf.value = false
+		}
+		flags = append(flags, cf)
+	})
+	return flags
+}
+
+// runCompletion prints the completion script of a shell, or the profiles of
+// the config for the scripts to offer after -profile
+func runCompletion(*sorter.Sorter) error {
+	if len(cmdArgs) != 1 {
+		return errors.New("completion needs one of bash, zsh, fish or powershell")
+	}
+	switch cmdArgs[0] {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	case "powershell":
+		fmt.Print(powershellCompletion())
+	case "profiles":
+		if appConfigFile == "" {
+			return nil
+		}
+		config, err := loadAppConfig(appConfigFile)
+		if err != nil {
+			return err
+		}
+		for _, name := range slices.Sorted(maps.Keys(config.Profiles)) {
+			fmt.Println(name)
+		}
+	default:
+		return fmt.Errorf("completion needs one of bash, zsh, fish or powershell, not %q", cmdArgs[0])
+	}
+	return nil
+}
+
+func commandNames() []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+func bashCompletion() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for sorter, from sorter completion bash\n")
+	fmt.Fprintf(&b, "_sorter() {\n")
+	fmt.Fprintf(&b, "    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	fmt.Fprintf(&b, "    case ${prev#-} in\n")
+	var fileFlags, allFlags []string
+	for _, f := range completionFlags() {
+		allFlags = append(allFlags, "-"+f.name)
+		switch {
+		case f.profile:
+			fmt.Fprintf(&b, "    %s|-%[1]s) COMPREPLY=($(compgen -W \"$(sorter completion profiles 2>/dev/null)\" -- \"$cur\")); return ;;\n", f.name)
+		case f.values != nil:
+			fmt.Fprintf(&b, "    %s|-%[1]s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", f.name, strings.Join(f.values, " "))
+		case f.value:
+			fileFlags = append(fileFlags, f.name, "-"+f.name)
+		}
+	}
+	fmt.Fprintf(&b, "    %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(fileFlags, "|"))
+	fmt.Fprintf(&b, "    esac\n")
+	fmt.Fprintf(&b, "    if [[ $cur == -* ]]; then\n")
+	fmt.Fprintf(&b, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(allFlags, " "))
+	fmt.Fprintf(&b, "        return\n")
+	fmt.Fprintf(&b, "    fi\n")
+	fmt.Fprintf(&b, "    local word cmd\n")
+	fmt.Fprintf(&b, "    for word in \"${COMP_WORDS[@]:1:COMP_CWORD-1}\"; do\n")
+	fmt.Fprintf(&b, "        case $word in %s) cmd=$word; break ;; esac\n", strings.Join(commandNames(), "|"))
+	fmt.Fprintf(&b, "    done\n")
+	fmt.Fprintf(&b, "    case $cmd in\n")
+	fmt.Fprintf(&b, "    \"\") COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(commandNames(), " "))
+	for _, name := range slices.Sorted(maps.Keys(commandValues)) {
+		fmt.Fprintf(&b, "    %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", name, strings.Join(commandValues[name], " "))
+	}
+	fmt.Fprintf(&b, "    *) COMPREPLY=($(compgen -f -- \"$cur\")) ;;\n")
+	fmt.Fprintf(&b, "    esac\n")
+	fmt.Fprintf(&b, "}\n")
+	fmt.Fprintf(&b, "complete -o filenames -F _sorter sorter\n")
+	return b.String()
+}
+
+func zshCompletion() string {
+	// Descriptions go in single quotes, and in the brackets of _arguments
+	quote := func(s string) string { return strings.ReplaceAll(s, "'", `'\''`) }
+	spec := strings.NewReplacer(`[`, `\[`, `]`, `\]`, `:`, `\:`)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef sorter\n")
+	fmt.Fprintf(&b, "# zsh completion for sorter, from sorter completion zsh\n\n")
+	fmt.Fprintf(&b, "_sorter() {\n")
+	fmt.Fprintf(&b, "  local -a commands flags\n")
+	fmt.Fprintf(&b, "  commands=(\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "    '%s:%s'\n", cmd.name, quote(strings.ReplaceAll(cmd.summary, ":", `\:`)))
+	}
+	fmt.Fprintf(&b, "  )\n")
+	fmt.Fprintf(&b, "  flags=(\n")
+	for _, f := range completionFlags() {
+		desc := quote(spec.Replace(f.usage))
+		switch {
+		case f.profile:
+			fmt.Fprintf(&b, "    '*-%s[%s]:profile:{compadd -- ${(f)\"$(sorter completion profiles 2>/dev/null)\"}}'\n", f.name, desc)
+		case f.values != nil:
+			fmt.Fprintf(&b, "    '*-%s[%s]:%[1]s:(%s)'\n", f.name, desc, strings.Join(f.values, " "))
+		case f.value:
+			fmt.Fprintf(&b, "    '*-%s[%s]:%[1]s:_files'\n", f.name, desc)
+		default:
+			fmt.Fprintf(&b, "    '*-%s[%s]'\n", f.name, desc)
+		}
+	}
+	fmt.Fprintf(&b, "  )\n")
+	fmt.Fprintf(&b, "  _arguments -s $flags '*:argument:->args' && return\n")
+	fmt.Fprintf(&b, "  local word cmd\n")
+	fmt.Fprintf(&b, "  for word in ${words[2,CURRENT-1]}; do\n")
+	fmt.Fprintf(&b, "    if (( ${+commands[(r)$word:*]} )); then cmd=$word; break; fi\n")
+	fmt.Fprintf(&b, "  done\n")
+	fmt.Fprintf(&b, "  case $cmd in\n")
+	fmt.Fprintf(&b, "  '') _describe command commands ;;\n")
+	for _, name := range slices.Sorted(maps.Keys(commandValues)) {
+		fmt.Fprintf(&b, "  %s) compadd -- %s ;;\n", name, strings.Join(commandValues[name], " "))
+	}
+	fmt.Fprintf(&b, "  *) _files ;;\n")
+	fmt.Fprintf(&b, "  esac\n")
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "compdef _sorter sorter\n")
+	return b.String()
+}
+
+func fishCompletion() string {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	}
+	names := strings.Join(commandNames(), " ")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for sorter, from sorter completion fish\n")
+	fmt.Fprintf(&b, "complete -c sorter -f\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "complete -c sorter -n 'not __fish_seen_subcommand_from %s' -a %s -d %s\n", names, cmd.name, quote(cmd.summary))
+	}
+	for _, name := range slices.Sorted(maps.Keys(commandValues)) {
+		fmt.Fprintf(&b, "complete -c sorter -n '__fish_seen_subcommand_from %s' -a %s\n", name, quote(strings.Join(commandValues[name], " ")))
+	}
+	fmt.Fprintf(&b, "complete -c sorter -n '__fish_seen_subcommand_from restore merge' -F\n")
+	for _, f := range completionFlags() {
+		switch {
+		case f.profile:
+			fmt.Fprintf(&b, "complete -c sorter -o %s -x -a '(sorter completion profiles 2>/dev/null)' -d %s\n", f.name, quote(f.usage))
+		case f.values != nil:
+			fmt.Fprintf(&b, "complete -c sorter -o %s -x -a %s -d %s\n", f.name, quote(strings.Join(f.values, " ")), quote(f.usage))
+		case f.value:
+			fmt.Fprintf(&b, "complete -c sorter -o %s -r -F -d %s\n", f.name, quote(f.usage))
+		default:
+			fmt.Fprintf(&b, "complete -c sorter -o %s -d %s\n", f.name, quote(f.usage))
+		}
+	}
+	return b.String()
+}
+
+func powershellCompletion() string {
+	quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+	list := func(values []string) string {
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			quoted[i] = quote(v)
+		}
+		return "@(" + strings.Join(quoted, ", ") + ")"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# PowerShell completion for sorter, from sorter completion powershell\n")
+	fmt.Fprintf(&b, "Register-ArgumentCompleter -Native -CommandName sorter, sorter.exe -ScriptBlock {\n")
+	fmt.Fprintf(&b, "    param($wordToComplete, $commandAst, $cursorPosition)\n")
+	fmt.Fprintf(&b, "    $commands = [ordered]@{\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "        %s = %s\n", quote(cmd.name), quote(cmd.summary))
+	}
+	fmt.Fprintf(&b, "    }\n")
+	fmt.Fprintf(&b, "    $flags = [ordered]@{\n")
+	var valueFlags []string
+	for _, f := range completionFlags() {
+		fmt.Fprintf(&b, "        %s = %s\n", quote("-"+f.name), quote(f.usage))
+		if f.value {
+			valueFlags = append(valueFlags, "-"+f.name)
+		}
+	}
+	fmt.Fprintf(&b, "    }\n")
+	fmt.Fprintf(&b, "    $values = @{\n")
+	for _, f := range completionFlags() {
+		if f.values != nil {
+			fmt.Fprintf(&b, "        %s = %s\n", quote("-"+f.name), list(f.values))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(commandValues)) {
+		fmt.Fprintf(&b, "        %s = %s\n", quote(name), list(commandValues[name]))
+	}
+	fmt.Fprintf(&b, "    }\n")
+	fmt.Fprintf(&b, "    $valueFlags = %s\n\n", list(valueFlags))
+	fmt.Fprintf(&b, `    $words = @($commandAst.CommandElements | Where-Object { $_.Extent.EndOffset -lt $cursorPosition } | ForEach-Object { $_.ToString() })
+    $prev = if ($words.Count -gt 1) { $words[-1] } else { '' }
+    $prev = '-' + $prev.TrimStart('-')
+    $command = $words | Select-Object -Skip 1 | Where-Object { $commands.Contains($_) } | Select-Object -First 1
+
+    $candidates = if ($prev -eq '-profile') {
+        @(sorter completion profiles 2>$null)
+    } elseif ($values.Contains($prev)) {
+        $values[$prev]
+    } elseif ($valueFlags -contains $prev) {
+        return # Let PowerShell complete paths
+    } elseif ($wordToComplete -like '-*') {
+        $flags.Keys
+    } elseif (-not $command) {
+        $commands.Keys
+    } elseif ($values.Contains($command)) {
+        $values[$command]
+    } else {
+        return
+    }
+    $candidates | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        $tip = if ($flags.Contains($_)) { $flags[$_] } elseif ($commands.Contains($_)) { $commands[$_] } else { $_ }
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $tip)
+    }
+}
+`)
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"sorter/pkg/sorter"
+)
+
+// AppConfig is the top-level sorter.json / sorter.yaml / sorter.toml configuration.
+// Relative paths are resolved against the directory holding the config file.
+// The settings of the engine are those of sorter.Config, which the command
+// line layers over.
+type AppConfig struct {
+	sorter.Config
+
+	Extensions     string `json:"extensions,omitempty"`
+	DirExclusions  string `json:"dir_exclusions,omitempty"`
+	FileExclusions string `json:"file_exclusions,omitempty"`
+	Rules          string `json:"rules,omitempty"`           // Optional rules.json
+	RulesScript    string `json:"rules_script,omitempty"`    // Optional rules.star
+	ExtendDefaults bool   `json:"extend_defaults,omitempty"` // Extensions adds to the built-in categories
+
+	Notifiers      []NotifierConfig `json:"notifiers,omitempty"`       // Chats told of every sorting pass
+	NotifyTemplate string           `json:"notify_template,omitempty"` // Their message, a Go template
+
+	Hooks HooksConfig `json:"hooks,omitempty"` // Commands run around sorting passes
+
+	Listen      string `json:"listen,omitempty"`       // Address of the serve API
+	APIToken    string `json:"api_token,omitempty"`    // Its bearer token, may be $NAME
+	MetricsAddr string `json:"metrics_addr,omitempty"` // Prometheus endpoint in watch mode
+	DebugAddr   string `json:"debug_addr,omitempty"`   // pprof and status page in watch mode
+	Notify      string `json:"notify,omitempty"`       // Desktop notifications in watch mode
+	Output      string `json:"output,omitempty"`       // "text", "ndjson" or "tui"
+	Report      string `json:"report,omitempty"`       // Run report, .csv or .json
+	LogLevel    string `json:"log_level,omitempty"`
+	LogFile     string `json:"log_file,omitempty"`
+	LogFormat   string `json:"log_format,omitempty"`
+
+	// Profiles are selected with -profile. Each holds settings in the same
+	// form as the top level, which take their place.
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
+}
+
+// NotifierConfig is a chat told of every sorting pass: a Slack or Discord
+// incoming webhook, or a Telegram bot and chat. Template replaces
+// notify_template for it.
+type NotifierConfig struct {
+	Type     string `json:"type"`              // slack, discord or telegram
+	Webhook  string `json:"webhook,omitempty"` // Slack and Discord
+	Token    string `json:"token,omitempty"`   // Telegram bot token
+	ChatID   string `json:"chat_id,omitempty"` // Telegram chat
+	Template string `json:"template,omitempty"`
+}
+
+// Config file names checked in every config directory, in order
+var appConfigNames = []string{"sorter.json", "sorter.yaml", "sorter.yml", "sorter.toml"}
+
+// configDirs returns the per-user directories searched for configuration:
+// $XDG_CONFIG_HOME/sorter, then the platform default (~/.config/sorter,
+// ~/Library/Application Support/sorter or %APPDATA%\sorter)
+func configDirs() []string {
+	var dirs []string
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		dirs = append(dirs, filepath.Join(xdg, "sorter"))
+	}
+	if userDir, err := os.UserConfigDir(); err == nil {
+		dir := filepath.Join(userDir, "sorter")
+		if len(dirs) == 0 || dirs[0] != dir {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// findAppConfig returns the first sorter config file found in the config
+// directories, or an empty string if there is none
+func findAppConfig() string {
+	for _, dir := range configDirs() {
+		for _, name := range appConfigNames {
+			path := filepath.Join(dir, name)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// loadAppConfig reads a sorter config file; YAML is used for .yaml/.yml
+// files, TOML for .toml files and JSON for everything else
+func loadAppConfig(path string) (*AppConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var config AppConfig
+	if err := sorter.UnmarshalConfig(path, data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config format in %s: %w", path, err)
+	}
+
+	config.Dir = filepath.Dir(path)
+	return &config, nil
+}
+
+// applyProfile returns the config with the settings of the named profile in
+// place of the top-level ones. Relative paths in the profile are resolved
+// against the config file's directory too.
+func (c *AppConfig) applyProfile(name string) (*AppConfig, error) {
+	raw, ok := c.Profiles[name]
+	if !ok {
+		names := slices.Sorted(maps.Keys(c.Profiles))
+		if len(names) == 0 {
+			return nil, fmt.Errorf("unknown profile %q: the config defines no profiles", name)
+		}
+		return nil, fmt.Errorf("unknown profile %q: must be one of %s", name, strings.Join(names, ", "))
+	}
+	profile := *c
+	profile.Inboxes = slices.Clone(c.Inboxes) // Decoding reuses the slice
+	profile.Profiles = nil
+	if err := json.Unmarshal(raw, &profile); err != nil {
+		return nil, fmt.Errorf("invalid profile %q: %w", name, err)
+	}
+	return &profile, nil
+}
+
+// configFile returns the location of a supporting config file (extensions,
+// exclusions), name being its base name without extension. An explicit
+// reference in the app config wins, then the first of configCandidates
+// that exists, and finally name.json in the working directory.
+func (c *AppConfig) configFile(explicit, name string) string {
+	if explicit != "" {
+		return c.Resolve(explicit)
+	}
+	for _, path := range c.configCandidates(name, sorter.ConfigExts) {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return name + ".json"
+}
+
+// Extensions of a rules script
+var scriptExts = []string{".star"}
+
+// scriptFile returns the rules script of the config, or "" when it names
+// none and there is no rules.star where config files are looked for
+func (c *AppConfig) scriptFile() string {
+	if c.RulesScript != "" {
+		return c.Resolve(c.RulesScript)
+	}
+	for _, path := range c.configCandidates("rules", scriptExts) {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// configCandidates returns where a supporting config file is looked for: a
+// file of that name with one of exts (.json, .yaml, .yml or .toml for most)
+// next to the app config, in the config directories, then in the working
+// directory
+func (c *AppConfig) configCandidates(name string, exts []string) []string {
+	dirs := configDirs()
+	if c.Dir != "" {
+		dirs = append([]string{c.Dir}, dirs...)
+	}
+	var paths []string
+	for _, dir := range append(dirs, "") {
+		for _, ext := range exts {
+			paths = append(paths, filepath.Join(dir, name+ext))
+		}
+	}
+	return paths
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"sorter/pkg/sorter"
+)
+
+// Starter files written by config init: the general categories are those of
+// the extensions.json shipped with sorter, the others come from presets/.
+// The categories and exclusions also apply when there are no such files.
+//
+//go:embed extensions.json dir_exclusions.json file_exclusions.json presets
+var starterFiles embed.FS
+
+// Category presets config init offers, the first being the default
+var presets = []string{"general", "photography", "developer"}
+
+// runConfig runs the config subcommands. Like completion it runs before the
+// sorter is set up, which a broken config would stop.
+func runConfig(config *AppConfig) error {
+	if len(cmdArgs) == 0 {
+		return &sorter.ConfigError{Err: errors.New("config needs init or validate")}
+	}
+	switch cmdArgs[0] {
+	case "init":
+		err := initConfig(config, newPrompter(os.Stdin, os.Stderr))
+		if errors.Is(err, sorter.ErrAborted) {
+			return nil
+		}
+		return err
+	case "validate":
+		return validateConfig(config)
+	default:
+		return &sorter.ConfigError{Err: fmt.Errorf("config needs init or validate, not %q", cmdArgs[0])}
+	}
+}
+
+// validateConfig checks the category, exclusion and rules files and the
+// rules script the config refers to, printing every problem found with its
+// location
+func validateConfig(config *AppConfig) error {
+	var problems []sorter.Problem
+	checked := 0
+	check := func(file string, checkFile func(string) []sorter.Problem) {
+		problems = append(problems, checkFile(file)...)
+		checked++
+	}
+	// Missing files that the config doesn't name are replaced by the
+	// built-in ones, and rules are optional, as in loadSettings
+	checkFound := func(explicit, name string, checkFile func(string) []sorter.Problem) {
+		path := config.configFile(explicit, name)
+		if _, err := os.Stat(path); explicit != "" || err == nil {
+			check(path, checkFile)
+		}
+	}
+	checkFound(config.Extensions, "extensions", sorter.CheckCategoryConfig)
+	checkFound(config.DirExclusions, "dir_exclusions", sorter.CheckExclusions)
+	checkFound(config.FileExclusions, "file_exclusions", sorter.CheckExclusions)
+	for _, inbox := range engine.Inboxes {
+		if inbox.DirExclusions != "" {
+			check(inbox.DirExclusions, sorter.CheckExclusions)
+		}
+		if inbox.FileExclusions != "" {
+			check(inbox.FileExclusions, sorter.CheckExclusions)
+		}
+	}
+	checkFound(config.Rules, "rules", sorter.CheckRules)
+	if script := config.scriptFile(); script != "" {
+		check(script, sorter.CheckScript)
+	}
+	for _, module := range config.ClassifierModules {
+		check(config.Resolve(module), sorter.CheckClassifierModule)
+	}
+
+	errorCount := 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if !p.Warning {
+			errorCount++
+		}
+	}
+	if checked == 0 {
+		fmt.Println("No config files to check, the built-in categories and exclusions apply")
+		return nil
+	}
+	if len(problems) == 0 {
+		fmt.Printf("Checked %d files, no problems found\n", checked)
+		return nil
+	}
+	fmt.Printf("Checked %d files: %d errors, %d warnings\n", checked, errorCount, len(problems)-errorCount)
+	if errorCount > 0 {
+		return &sorter.ConfigError{Err: fmt.Errorf("%d errors in the config files", errorCount)}
+	}
+	return nil
+}
+
+// initConfig asks where the inbox is, which operating system the exclusions
+// are for and which categories to start from, then writes sorter.json with
+// the category and exclusion files it refers to. Existing files are only
+// replaced when confirmed; the answers default to the current config.
+func initConfig(config *AppConfig, p *prompter) error {
+	path := appConfigFile
+	if path == "" {
+		dirs := configDirs()
+		if len(dirs) == 0 {
+			return errors.New("no user config directory, give the config file to create with -config")
+		}
+		path = filepath.Join(dirs[0], "sorter.json")
+	} else if !strings.EqualFold(filepath.Ext(path), ".json") {
+		// The starter config is JSON, kept next to the YAML or TOML one
+		path = filepath.Join(filepath.Dir(path), "sorter.json")
+	}
+	dir := filepath.Dir(path)
+	fmt.Fprintf(p.out, "Creating starter config files in %s\n", dir)
+
+	home, _ := os.UserHomeDir()
+	defaultBase := firstNonEmpty(config.Resolve(config.Base), filepath.Join(home, "Sorted"))
+	if flagSet("base") {
+		defaultBase = engine.Base
+	}
+	defaultInbox := firstNonEmpty(config.Resolve(config.Inbox), filepath.Join(home, "Downloads"))
+	inbox, err := p.prompt("Inbox, the folder to sort", defaultInbox)
+	if err != nil {
+		return err
+	}
+	base, err := p.prompt("Base directory, holding the sorted and delete folders", defaultBase)
+	if err != nil {
+		return err
+	}
+	goos, err := p.choose("Operating system the exclusions are for", []string{"linux", "darwin", "windows", "all"}, runtime.GOOS)
+	if err != nil {
+		return err
+	}
+	preset, err := p.choose("Categories to start from", presets, presets[0])
+	if err != nil {
+		return err
+	}
+
+	categories := "extensions.json"
+	if preset != presets[0] {
+		categories = "presets/" + preset + ".json"
+	}
+	extensions, err := starterFiles.ReadFile(categories)
+	if err != nil {
+		return err
+	}
+	type file struct {
+		name string
+		data []byte
+	}
+	files := []file{{"extensions.json", extensions}}
+	for _, name := range []string{"dir_exclusions.json", "file_exclusions.json"} {
+		data, err := starterExclusions(name, goos)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{name, data})
+	}
+	app, err := json.MarshalIndent(AppConfig{
+		Config:         sorter.Config{Base: expandHome(base, home), Inbox: expandHome(inbox, home)},
+		Extensions:     "extensions.json",
+		DirExclusions:  "dir_exclusions.json",
+		FileExclusions: "file_exclusions.json",
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	files = append(files, file{filepath.Base(path), append(app, '\n')})
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		target := filepath.Join(dir, f.name)
+		if _, err := os.Stat(target); err == nil {
+			ok, err := p.ask(fmt.Sprintf("%s exists, replace it?", target))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Printf("Kept %s\n", target)
+				continue
+			}
+		}
+		if err := os.WriteFile(target, f.data, 0o644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", target)
+	}
+	fmt.Println("Try it with sorter -dry-run, and check later edits with sorter config validate")
+	return nil
+}
+
+// starterExclusions returns an exclusion file shipped with sorter, keeping
+// only the patterns of one operating system unless goos is "all"
+func starterExclusions(name, goos string) ([]byte, error) {
+	data, err := starterFiles.ReadFile(name)
+	if err != nil || goos == "all" {
+		return data, err
+	}
+	var config sorter.ExclusionConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	specific := map[string][]string{}
+	if patterns := config.OSSpecific[goos]; len(patterns) > 0 {
+		specific[goos] = patterns
+	}
+	config.OSSpecific = specific
+	data, err = json.MarshalIndent(config, "", "  ")
+	return append(data, '\n'), err
+}
+
+// expandHome makes a path starting with ~ absolute and cleans it
+func expandHome(path, home string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		path = filepath.Join(home, path[1:])
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// serveDebug serves pprof and a status page of s at addr in the
+// background, failing only when addr can't be listened on
+func serveDebug(addr string, s *sorter.Sorter) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		status := s.Status()
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeStatus(w, status, started)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("Serving debug pages", "url", "http://"+ln.Addr().String()+"/")
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			slog.Error("Debug server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// writeStatus writes the status page: what the sorter is doing, and how
+// the process is faring
+func writeStatus(w http.ResponseWriter, status sorter.Status, started time.Time) {
+	now := time.Now()
+	fmt.Fprintf(w, "sorter, up %s\n\n", now.Sub(started).Round(time.Second))
+	state := "waiting"
+	if status.Running {
+		state = "sorting"
+	}
+	fmt.Fprintf(w, "State:    %s, last activity %s ago\n", state, now.Sub(status.Active).Round(time.Second))
+	if status.Stage == "" {
+		fmt.Fprintf(w, "Stage:    none\n")
+	} else {
+		files := fmt.Sprint(status.Done)
+		if status.Total > 0 {
+			files += fmt.Sprintf("/%d", status.Total)
+		}
+		fmt.Fprintf(w, "Stage:    %s for %s, %s files, %s\n", status.Stage, now.Sub(status.Since).Round(time.Second), files, sorter.Size(status.Bytes))
+	}
+	if status.Current != "" {
+		fmt.Fprintf(w, "Current:  %s\n", status.Current)
+	}
+	for i, a := range status.Reading {
+		label := "Reading:"
+		if i > 0 {
+			label = ""
+		}
+		fmt.Fprintf(w, "%-9s %s for %s\n", label, a.Path, now.Sub(a.Since).Round(time.Second))
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "\nGoroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "Memory:     %s in use, %s from the OS, %d garbage collections\n", sorter.Size(mem.HeapAlloc), sorter.Size(mem.Sys), mem.NumGC)
+	fmt.Fprintf(w, "\nProfiles: /debug/pprof/   Goroutine dump: /debug/pprof/goroutine?debug=2   JSON: /?format=json\n")
+}
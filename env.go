@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// envPrefix starts the environment variables standing in for flags and
+// config settings, e.g. SORTER_INBOX for -inbox or SORTER_NOTIFY_TEMPLATE
+// for notify_template
+const envPrefix = "SORTER_"
+
+// envName returns the environment variable of a flag or config setting
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// envFlag reports whether a flag can be set from the environment. Flags of
+// a single command, whose usage starts with that command's name, can't: a
+// variable such as SORTER_ALL would change every restore run.
+func envFlag(f *flag.Flag) bool {
+	return f.Usage != "" && !unicode.IsLower(rune(f.Usage[0]))
+}
+
+// applyEnvFlags sets the flags not given on the command line from their
+// environment variables. They then take precedence over the config file
+// just as flags do.
+func applyEnvFlags() error {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || !envFlag(f) {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// applyEnv overrides the settings that have no flag of their own with their
+// environment variables. Strings are taken as they are, other settings as
+// JSON, such as SORTER_INBOXES='[{"dir": "/scans"}]', or as a bare size or
+// duration such as SORTER_RETENTION=30d.
+func (c *AppConfig) applyEnv() error {
+	return applyEnvFields(reflect.ValueOf(c).Elem())
+}
+
+// applyEnvFields applies the variables of the fields of v, and of the
+// structs it embeds, such as sorter.Config
+func applyEnvFields(v reflect.Value) error {
+	for i := range v.NumField() {
+		if v.Type().Field(i).Anonymous {
+			if err := applyEnvFields(v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		if f := flag.Lookup(strings.ReplaceAll(key, "_", "-")); f != nil && envFlag(f) {
+			continue // Set through the flag
+		}
+		name := envName(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			continue
+		}
+		if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			quoted, _ := json.Marshal(value)
+			if json.Unmarshal(quoted, field.Addr().Interface()) != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -1,5 +1,5 @@
 module sorter
 
-go 1.23
+go 1.24
 
-require github.com/cespare/xxhash/v2 v2.3.0 // indirect
+require github.com/cespare/xxhash/v2 v2.3.0
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// The gRPC service of sorter serve, proto/sorter.proto, answered on the
+// API's address over HTTP/2 without TLS. It is served by hand, like the
+// storages of the sorter speak their protocols, rather than with grpc-go
+// and generated code: unary and server-streaming calls are all it needs.
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcMaxMessage is the largest request accepted, as grpc-go defaults to
+const grpcMaxMessage = 4 << 20
+
+// grpcStatus is an error ending a call with a status other than OK
+type grpcStatus struct {
+	code int
+	msg  string
+}
+
+func (e *grpcStatus) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcStatus{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcMethod answers a call, given the encoded request, by sending the
+// encoded responses, one for unary calls
+type grpcMethod func(ctx context.Context, req []byte, send func([]byte) error) error
+
+func (api *apiServer) grpcMethods() map[string]grpcMethod {
+	return map[string]grpcMethod{
+		"/sorter.v1.Sorter/Sort": func(ctx context.Context, req []byte, send func([]byte) error) error {
+			return api.grpcRun(ctx, "sort", api.s.Run, send)
+		},
+		"/sorter.v1.Sorter/Dedupe": func(ctx context.Context, req []byte, send func([]byte) error) error {
+			return api.grpcRun(ctx, "dedupe", api.s.Dedupe, send)
+		},
+		"/sorter.v1.Sorter/Verify":         api.grpcVerify,
+		"/sorter.v1.Sorter/ProgressEvents": api.grpcProgressEvents,
+	}
+}
+
+// isGRPC reports whether r is a gRPC call
+func isGRPC(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == http.MethodPost && (mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+"))
+}
+
+// serveGRPC answers a gRPC call, with the checks and token of the HTTP API
+func (api *apiServer) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		writeError(w, http.StatusHTTPVersionNotSupported, errors.New("gRPC needs HTTP/2"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	send := func(msg []byte) error {
+		frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+		if _, err := w.Write(append(frame, msg...)); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	err := api.callGRPC(r, send)
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		var status *grpcStatus
+		if errors.As(err, &status) {
+			code = status.code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+	}
+}
+
+// callGRPC checks a call and runs its method
+func (api *apiServer) callGRPC(r *http.Request, send func([]byte) error) error {
+	if err := api.checkOrigin(r); err != nil {
+		return grpcErrorf(grpcPermissionDenied, "%v", err)
+	}
+	if api.token != "" && !api.authorized(r) {
+		return grpcErrorf(grpcUnauthenticated, "missing or wrong bearer token")
+	}
+	method, ok := api.grpcMethods()[r.URL.Path]
+	if !ok {
+		return grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+	if encoding := r.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+		return grpcErrorf(grpcUnimplemented, "compression %s is not supported", encoding)
+	}
+	ctx := r.Context()
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, err := parseGRPCTimeout(timeout)
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := checkProto(req); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "invalid request: %v", err)
+	}
+	return method(ctx, req, send)
+}
+
+// readGRPCMessage reads the one message of a request
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "request of %d bytes is larger than %d", size, grpcMaxMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated request message")
+	}
+	return msg, nil
+}
+
+// parseGRPCTimeout parses the grpc-timeout header, such as 100m or 30S
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	unit, ok := units[s[len(s)-1]]
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcPercentEncode encodes a grpc-message as the protocol wants it
+func grpcPercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcContextError is the status of a call whose context is done
+func grpcContextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return grpcErrorf(grpcDeadlineExceeded, "deadline exceeded")
+	}
+	return grpcErrorf(grpcCanceled, "canceled")
+}
+
+// grpcRun starts a sort or a dedupe and answers with it once finished
+func (api *apiServer) grpcRun(ctx context.Context, command string, run func() error, send func([]byte) error) error {
+	_, done, err := api.run(command, run)
+	if err != nil {
+		return grpcErrorf(grpcAborted, "%v", err)
+	}
+	select {
+	case result := <-done:
+		return send(encodeRunResult(result))
+	case <-ctx.Done():
+		return grpcContextError(ctx)
+	}
+}
+
+func (api *apiServer) grpcVerify(ctx context.Context, req []byte, send func([]byte) error) error {
+	release, err := api.start("verify")
+	if err != nil {
+		return grpcErrorf(grpcAborted, "%v", err)
+	}
+	defer release()
+	result, err := api.s.Verify()
+	var config *sorter.ConfigError
+	var partial *sorter.PartialError
+	switch {
+	case errors.As(err, &config):
+		return grpcErrorf(grpcFailedPrecondition, "%v", err)
+	case err != nil && !errors.As(err, &partial):
+		return err
+	}
+	return send(encodeVerifyResult(result))
+}
+
+func (api *apiServer) grpcProgressEvents(ctx context.Context, req []byte, send func([]byte) error) error {
+	ch, unsubscribe := api.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case m := <-ch:
+			if err := send(encodeProgressEvent(m)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return grpcContextError(ctx)
+		case <-stopRequested:
+			return grpcErrorf(grpcUnavailable, "sorter is shutting down")
+		}
+	}
+}
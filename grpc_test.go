@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"100m", 100 * time.Millisecond, true},
+		{"30S", 30 * time.Second, true},
+		{"1H", time.Hour, true},
+		{"99999999n", 99999999 * time.Nanosecond, true},
+		{"S", 0, false},
+		{"10x", 0, false},
+		{"-1S", 0, false},
+		{"123456789S", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseGRPCTimeout(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseGRPCTimeout(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckProto(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		ok   bool
+	}{
+		{"empty", nil, true},
+		{"varint", []byte{0x08, 0x96, 0x01}, true},
+		{"string", []byte{0x12, 0x02, 'h', 'i'}, true},
+		{"fixed", []byte{0x1d, 1, 2, 3, 4, 0x21, 1, 2, 3, 4, 5, 6, 7, 8}, true},
+		{"field zero", []byte{0x00, 0x01}, false},
+		{"truncated string", []byte{0x12, 0x05, 'h'}, false},
+		{"truncated varint", []byte{0x08, 0x96}, false},
+		{"group", []byte{0x0b, 0x0c}, false},
+	}
+	for _, tt := range tests {
+		if err := checkProto(tt.msg); (err == nil) != tt.ok {
+			t.Errorf("%s: checkProto() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestEncodeRun(t *testing.T) {
+	finished := time.Unix(1700000001, 5)
+	run := apiRun{ID: 2, Command: "sort", Started: time.Unix(1700000000, 0), Finished: &finished, Error: "x"}
+	want := []byte{
+		0x08, 2,
+		0x12, 4, 's', 'o', 'r', 't',
+		0x1a, 6, 0x08, 0x80, 0xe2, 0xcf, 0xaa, 0x06,
+		0x22, 8, 0x08, 0x81, 0xe2, 0xcf, 0xaa, 0x06, 0x10, 5,
+		0x2a, 1, 'x',
+	}
+	if got := encodeRun(&run); !bytes.Equal(got, want) {
+		t.Errorf("encodeRun() = % x, want % x", []byte(got), want)
+	}
+}
+
+func TestServeGRPC(t *testing.T) {
+	api := newAPIServer(nil)
+	api.token = "secret"
+	server := httptest.NewUnstartedServer(api.handler())
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+
+	tests := []struct {
+		name    string
+		path    string
+		token   string
+		status  string
+		message string
+	}{
+		{"no token", "/sorter.v1.Sorter/Verify", "", "16", "missing or wrong bearer token"},
+		{"unknown method", "/sorter.v1.Sorter/Nope", "secret", "12", "unknown method /sorter.v1.Sorter/Nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", server.URL+tt.path, bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/grpc")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+				t.Fatalf("answered %s %d, want HTTP/2 200", resp.Proto, resp.StatusCode)
+			}
+			if got := resp.Trailer.Get("Grpc-Status"); got != tt.status {
+				t.Errorf("grpc-status = %q, want %q", got, tt.status)
+			}
+			if got := resp.Trailer.Get("Grpc-Message"); got != tt.message {
+				t.Errorf("grpc-message = %q, want %q", got, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// The messages of proto/sorter.proto in the protobuf wire format, written
+// field by field. Fields holding their zero value are left out, as proto3
+// does.
+
+// protoMessage appends the fields of a message
+type protoMessage []byte
+
+func (m *protoMessage) tag(field, wireType int) {
+	*m = binary.AppendUvarint(*m, uint64(field)<<3|uint64(wireType))
+}
+
+func (m *protoMessage) int(field int, v int64) {
+	if v != 0 {
+		m.tag(field, 0)
+		*m = binary.AppendUvarint(*m, uint64(v))
+	}
+}
+
+func (m *protoMessage) bool(field int, v bool) {
+	if v {
+		m.int(field, 1)
+	}
+}
+
+func (m *protoMessage) bytes(field int, b []byte) {
+	m.tag(field, 2)
+	*m = binary.AppendUvarint(*m, uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+func (m *protoMessage) string(field int, s string) {
+	if s != "" {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// strings writes a repeated string field, empty strings included
+func (m *protoMessage) strings(field int, list []string) {
+	for _, s := range list {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// message writes a message field, even empty, as it is set
+func (m *protoMessage) message(field int, sub protoMessage) {
+	m.bytes(field, sub)
+}
+
+// time writes a google.protobuf.Timestamp, unless t is zero
+func (m *protoMessage) time(field int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var ts protoMessage
+	ts.int(1, t.Unix())
+	ts.int(2, int64(t.Nanosecond()))
+	m.message(field, ts)
+}
+
+// checkProto checks b is a well-formed message. Requests have no fields
+// yet, so those a newer client sends are skipped.
+func checkProto(b []byte) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key>>3 == 0 {
+			return errors.New("invalid field key")
+		}
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return errors.New("truncated field")
+			}
+			b = b[size:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errors.New("truncated field")
+			}
+			b = b[n+int(size):]
+		default:
+			return errors.New("unsupported wire type")
+		}
+	}
+	return nil
+}
+
+func encodeRun(run *apiRun) protoMessage {
+	var m protoMessage
+	m.int(1, int64(run.ID))
+	m.string(2, run.Command)
+	m.time(3, run.Started)
+	if run.Finished != nil {
+		m.time(4, *run.Finished)
+	}
+	m.string(5, run.Error)
+	return m
+}
+
+func encodeRunResult(result apiResult) protoMessage {
+	var m protoMessage
+	m.message(1, encodeRun(&result.run))
+	for _, row := range result.rows {
+		var r protoMessage
+		r.string(1, row.Source)
+		r.string(2, row.Action)
+		r.string(3, row.Destination)
+		r.string(4, row.Category)
+		r.string(5, row.Rule)
+		r.int(6, row.Size)
+		r.string(7, row.Hash)
+		r.string(8, row.DuplicateOf)
+		r.string(9, row.Reason)
+		r.string(10, row.Error)
+		r.bool(11, row.DryRun)
+		r.string(12, row.Scan)
+		r.string(13, row.Detail)
+		m.message(2, r)
+	}
+	return m
+}
+
+func encodeVerifyResult(result *sorter.VerifyResult) protoMessage {
+	var m protoMessage
+	if result == nil {
+		return m
+	}
+	m.int(1, int64(result.Checked))
+	m.strings(2, result.Corrupted)
+	m.strings(3, result.Modified)
+	m.strings(4, result.Missing)
+	m.int(5, int64(result.Unindexed))
+	return m
+}
+
+func encodeProgressEvent(msg apiMessage) protoMessage {
+	var m protoMessage
+	switch {
+	case msg.Event != nil:
+		event := msg.Event
+		var e protoMessage
+		e.time(1, event.Time)
+		e.string(2, event.Type)
+		e.string(3, event.Path)
+		e.int(4, event.Size)
+		e.string(5, event.Category)
+		e.string(6, event.Rule)
+		e.string(7, event.DuplicateOf)
+		e.string(8, event.Dest)
+		e.string(9, event.Reason)
+		e.string(10, event.Detail)
+		e.string(11, event.Error)
+		e.bool(12, event.DryRun)
+		e.string(13, event.Hash)
+		m.message(1, e)
+	case msg.Progress != nil:
+		status := msg.Progress
+		var p protoMessage
+		p.bool(1, status.Running)
+		p.time(2, status.Active)
+		p.string(3, status.Stage)
+		p.time(4, status.Since)
+		p.int(5, int64(status.Done))
+		p.int(6, int64(status.Total))
+		p.int(7, status.Bytes)
+		p.string(8, status.Current)
+		for _, activity := range status.Reading {
+			var a protoMessage
+			a.string(1, activity.Path)
+			a.time(2, activity.Since)
+			p.message(9, a)
+		}
+		m.message(2, p)
+	case msg.Run != nil:
+		m.message(3, encodeRun(msg.Run))
+	}
+	return m
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// HooksConfig holds the commands run around sorting passes. Each is a
+// program and its arguments, run without a shell; placeholders in the
+// arguments are replaced, see hooks.
+type HooksConfig struct {
+	BeforeRun []string `json:"before_run,omitempty"` // A failure skips the pass
+	AfterRun  []string `json:"after_run,omitempty"`
+	AfterMove []string `json:"after_move,omitempty"` // For every file moved into the sorted directory
+}
+
+// How long a hook may run before it is killed
+const hookTimeout = 10 * time.Minute
+
+// hooks runs the commands of a HooksConfig. It is fed by the sorter's
+// events, for the category of each file and the counts after_run gets, and
+// plugged into Options.BeforeRun and Options.RunFinished.
+//
+// after_move arguments may hold {src}, {dest}, {name} (base name of dest)
+// and {category}; after_run ones {status} (ok, partial, failed or
+// aborted), {sorted}, {duplicates}, {failed} and {error}.
+type hooks struct {
+	config HooksConfig
+
+	mu         sync.Mutex
+	categories map[string]string // Category of the files not moved yet
+	sorted     int
+	duplicates int
+	failed     int
+}
+
+func newHooks(config HooksConfig) (*hooks, error) {
+	for name, argv := range map[string][]string{"before_run": config.BeforeRun, "after_run": config.AfterRun, "after_move": config.AfterMove} {
+		if argv != nil && (len(argv) == 0 || argv[0] == "") {
+			return nil, fmt.Errorf("hook %s needs a program to run", name)
+		}
+	}
+	return &hooks{config: config, categories: make(map[string]string)}, nil
+}
+
+// beforeRun runs the before_run hook, whose failure skips the pass
+func (h *hooks) beforeRun() error {
+	if h.config.BeforeRun == nil {
+		return nil
+	}
+	if engine.DryRun {
+		slog.Info("Would run hook", "hook", "before_run", "args", h.config.BeforeRun)
+		return nil
+	}
+	if err := runHook("before_run", h.config.BeforeRun, nil); err != nil {
+		return fmt.Errorf("before_run hook: %w", err)
+	}
+	return nil
+}
+
+func (h *hooks) record(event sorter.Event) {
+	h.mu.Lock()
+	switch event.Type {
+	case sorter.EventCategory:
+		h.categories[event.Path] = event.Category
+	case sorter.EventMoved:
+		switch event.Reason {
+		case "sorted":
+			h.sorted++
+		case "duplicate":
+			h.duplicates++
+		}
+	case sorter.EventError:
+		h.failed++
+	}
+	category := h.categories[event.Path]
+	if event.Type == sorter.EventMoved || event.Type == sorter.EventSkipped {
+		delete(h.categories, event.Path)
+	}
+	h.mu.Unlock()
+
+	if event.Type != sorter.EventMoved || event.Reason != "sorted" || h.config.AfterMove == nil {
+		return
+	}
+	vars := map[string]string{
+		"src":      event.Path,
+		"dest":     event.Dest,
+		"name":     filepath.Base(event.Dest),
+		"category": filepath.ToSlash(category),
+	}
+	if engine.DryRun {
+		slog.Info("Would run hook", "hook", "after_move", "args", expandHook(h.config.AfterMove, vars))
+		return
+	}
+	if err := runHook("after_move", h.config.AfterMove, vars); err != nil {
+		slog.Warn("Hook failed", "hook", "after_move", "path", event.Dest, "err", err)
+	}
+}
+
+// runFinished runs the after_run hook with the outcome of the pass, and
+// starts counting the next one
+func (h *hooks) runFinished(err error) {
+	h.mu.Lock()
+	vars := map[string]string{
+		"status":     "ok",
+		"sorted":     strconv.Itoa(h.sorted),
+		"duplicates": strconv.Itoa(h.duplicates),
+		"failed":     strconv.Itoa(h.failed),
+		"error":      "",
+	}
+	h.sorted, h.duplicates, h.failed = 0, 0, 0
+	clear(h.categories)
+	h.mu.Unlock()
+
+	if h.config.AfterRun == nil {
+		return
+	}
+	var partial *sorter.PartialError
+	switch {
+	case errors.Is(err, sorter.ErrAborted):
+		vars["status"] = "aborted"
+	case errors.As(err, &partial):
+		vars["status"] = "partial"
+	case err != nil:
+		vars["status"], vars["error"] = "failed", err.Error()
+	}
+	if engine.DryRun {
+		slog.Info("Would run hook", "hook", "after_run", "args", expandHook(h.config.AfterRun, vars))
+		return
+	}
+	if err := runHook("after_run", h.config.AfterRun, vars); err != nil {
+		slog.Warn("Hook failed", "hook", "after_run", "err", err)
+	}
+}
+
+// runHook runs a hook with its placeholders replaced by vars. Its output
+// is logged at debug level, as stdout may carry the event stream.
+func runHook(name string, argv []string, vars map[string]string) error {
+	ctx := context.Background()
+	if stopNow != nil {
+		ctx = stopNow
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	args := expandHook(argv, vars)
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if err != nil {
+		if output != "" {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	slog.Debug("Hook ran", "hook", name, "args", args, "output", output)
+	return nil
+}
+
+// expandHook replaces the {name} placeholders of vars in the arguments of
+// a hook. Each argument stays one, whatever the values hold.
+func expandHook(argv []string, vars map[string]string) []string {
+	pairs := make([]string, 0, 2*len(vars))
+	for name, value := range vars {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	args := make([]string, len(argv))
+	for i, arg := range argv {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
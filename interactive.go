@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"sorter/pkg/sorter"
+)
+
+// prompter asks before every move when running with -interactive
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	all bool // "all" was answered, confirm the remaining moves
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{in: bufio.NewReader(in), out: out}
+}
+
+// confirm shows a proposed move and waits for y/n/a/q. The end of the input
+// counts as quit.
+func (p *prompter) confirm(src, dest, reason string) (bool, error) {
+	if p.all {
+		return true, nil
+	}
+
+	action := "Move"
+	switch reason {
+	case "duplicate":
+		action = "Delete duplicate"
+	case "rule":
+		action = "Delete (rule)"
+	}
+	for {
+		fmt.Fprintf(p.out, "%s %s\n  -> %s\n[y]es/[N]o/[a]ll/[q]uit: ", action, src, dest)
+		line, err := p.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(p.out)
+			return false, sorter.ErrAborted
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true, nil
+		case "", "n", "no":
+			return false, nil
+		case "a", "all":
+			p.all = true
+			return true, nil
+		case "q", "quit":
+			return false, sorter.ErrAborted
+		}
+	}
+}
+
+// ask asks a yes/no question, no being the default. The end of the input
+// counts as quit.
+func (p *prompter) ask(question string) (bool, error) {
+	for {
+		fmt.Fprintf(p.out, "%s [y]es/[N]o/[q]uit: ", question)
+		line, err := p.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(p.out)
+			return false, sorter.ErrAborted
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true, nil
+		case "", "n", "no":
+			return false, nil
+		case "q", "quit":
+			return false, sorter.ErrAborted
+		}
+	}
+}
+
+// prompt asks for a value, def being the answer to an empty line. The end
+// of the input counts as quit.
+func (p *prompter) prompt(question, def string) (string, error) {
+	fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(p.out)
+		return "", sorter.ErrAborted
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line, nil
+	}
+	return def, nil
+}
+
+// choose asks for one of choices until it gets one
+func (p *prompter) choose(question string, choices []string, def string) (string, error) {
+	for {
+		answer, err := p.prompt(fmt.Sprintf("%s (%s)", question, strings.Join(choices, ", ")), def)
+		if err != nil {
+			return "", err
+		}
+		for _, choice := range choices {
+			if strings.EqualFold(answer, choice) {
+				return choice, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Normtables writes pkg/sorter/normtables.go, the tables the Unicode
+// normalization of file names works from, out of the Unicode Character
+// Database. The go:generate line of pkg/sorter/norm.go runs it with the
+// version the tables are of:
+//
+//	go generate ./pkg/sorter
+//
+// It downloads UnicodeData.txt and CompositionExclusions.txt from
+// unicode.org, or reads them from the folder -ucd names.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// perLine is how many entries each line of a table holds
+const perLine = 4
+
+func main() {
+	version := flag.String("version", "14.0.0", "Unicode version of the tables")
+	ucd := flag.String("ucd", "", "Folder holding UnicodeData.txt and CompositionExclusions.txt, instead of downloading them")
+	output := flag.String("output", "normtables.go", "File to write")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("normtables: ")
+
+	chars, err := readUnicodeData(open(*ucd, *version, "UnicodeData.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	excluded, err := readExclusions(open(*ucd, *version, "CompositionExclusions.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := format.Source(generate(*version, chars, excluded))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*output, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// open returns a file of the database, from dir or else downloaded
+func open(dir, version, name string) io.Reader {
+	if dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return bytes.NewReader(data)
+	}
+	url := "https://www.unicode.org/Public/" + version + "/ucd/" + name
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("%s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return bytes.NewReader(data)
+}
+
+// char is what the tables need of a line of UnicodeData.txt
+type char struct {
+	r      rune
+	class  uint8
+	decomp []rune // Canonical decompositions only
+}
+
+func readUnicodeData(r io.Reader) ([]char, error) {
+	var chars []char
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), ";")
+		if len(fields) < 6 {
+			continue
+		}
+		code, err := strconv.ParseUint(fields[0], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("UnicodeData.txt:%d: %v", line, err)
+		}
+		class, err := strconv.ParseUint(fields[3], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("UnicodeData.txt:%d: %v", line, err)
+		}
+		c := char{r: rune(code), class: uint8(class)}
+		// Compatibility decompositions start with a <tag>
+		if fields[5] != "" && !strings.HasPrefix(fields[5], "<") {
+			for _, field := range strings.Fields(fields[5]) {
+				part, err := strconv.ParseUint(field, 16, 32)
+				if err != nil {
+					return nil, fmt.Errorf("UnicodeData.txt:%d: %v", line, err)
+				}
+				c.decomp = append(c.decomp, rune(part))
+			}
+		}
+		chars = append(chars, c)
+	}
+	return chars, scanner.Err()
+}
+
+func readExclusions(r io.Reader) (map[rune]bool, error) {
+	excluded := make(map[rune]bool)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		code, err := strconv.ParseUint(text, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("CompositionExclusions.txt:%d: %v", line, err)
+		}
+		excluded[rune(code)] = true
+	}
+	return excluded, scanner.Err()
+}
+
+func generate(version string, chars []char, excluded map[rune]bool) []byte {
+	classes := make(map[rune]uint8)
+	for _, c := range chars {
+		classes[c.r] = c.class
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated from the Unicode %s Character Database; DO NOT EDIT.\n\n", version)
+	b.WriteString("package sorter\n\n")
+
+	b.WriteString("// decompositions maps every character with a canonical decomposition,\n")
+	b.WriteString("// Hangul syllables aside, to its one-level decomposition\n")
+	b.WriteString("var decompositions = map[rune]string{\n")
+	var entries []string
+	for _, c := range chars {
+		if c.decomp == nil {
+			continue
+		}
+		var s strings.Builder
+		for _, r := range c.decomp {
+			if r > 0xFFFF {
+				fmt.Fprintf(&s, `\U%08X`, r)
+			} else {
+				fmt.Fprintf(&s, `\u%04X`, r)
+			}
+		}
+		entries = append(entries, fmt.Sprintf("0x%04X: \"%s\"", c.r, s.String()))
+	}
+	writeEntries(&b, entries)
+
+	// Full composition exclusions: those listed, singletons and
+	// decompositions starting with a non-starter or of one
+	b.WriteString("// compositions maps the pairs that canonically compose to the composed\n")
+	b.WriteString("// character, composition exclusions left out\n")
+	b.WriteString("var compositions = map[[2]rune]rune{\n")
+	type composition struct {
+		pair     [2]rune
+		composed rune
+	}
+	var compositions []composition
+	for _, c := range chars {
+		if len(c.decomp) != 2 || excluded[c.r] || c.class != 0 || classes[c.decomp[0]] != 0 {
+			continue
+		}
+		compositions = append(compositions, composition{[2]rune(c.decomp), c.r})
+	}
+	slices.SortFunc(compositions, func(a, b composition) int {
+		if a.pair[0] != b.pair[0] {
+			return int(a.pair[0] - b.pair[0])
+		}
+		return int(a.pair[1] - b.pair[1])
+	})
+	entries = entries[:0]
+	for _, c := range compositions {
+		entries = append(entries, fmt.Sprintf("{0x%04X, 0x%04X}: 0x%04X", c.pair[0], c.pair[1], c.composed))
+	}
+	writeEntries(&b, entries)
+
+	b.WriteString("// combiningClasses lists the canonical combining class of every\n")
+	b.WriteString("// non-starter, as ranges sorted by their first character\n")
+	b.WriteString("var combiningClasses = []combiningRange{\n")
+	entries = entries[:0]
+	for i := 0; i < len(chars); {
+		c := chars[i]
+		if c.class == 0 {
+			i++
+			continue
+		}
+		hi := c.r
+		for i++; i < len(chars) && chars[i].r == hi+1 && chars[i].class == c.class; i++ {
+			hi++
+		}
+		entries = append(entries, fmt.Sprintf("{0x%04X, 0x%04X, %d}", c.r, hi, c.class))
+	}
+	writeEntries(&b, entries)
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
+
+// writeEntries writes the entries of a table, perLine to a line, and ends it
+func writeEntries(b *bytes.Buffer, entries []string) {
+	for len(entries) > 0 {
+		n := min(perLine, len(entries))
+		b.WriteString("\t" + strings.Join(entries[:n], ", ") + ",\n")
+		entries = entries[n:]
+	}
+	b.WriteString("}\n\n")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"sorter/pkg/sorter"
+)
+
+// launchAgentLabel names the agent of the current profile, so several can
+// run side by side
+func launchAgentLabel() string {
+	return "io.github.anboris." + serviceName()
+}
+
+// runInstallLaunchAgent writes a LaunchAgent running the current command
+// line, in watch mode or every -interval, and loads it into the user's
+// session
+func runInstallLaunchAgent(s *sorter.Sorter) error {
+	if runtime.GOOS != "darwin" {
+		return errors.New("launch agents are for macOS")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	label := launchAgentLabel()
+	logPath := logFile
+	if logPath == "" {
+		logPath = filepath.Join(home, "Library", "Logs", serviceName()+".log")
+	}
+	plist, err := launchAgentPlist(label, logPath)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{filepath.Join(home, "Library", "LaunchAgents"), filepath.Dir(logPath)} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(home, "Library", "LaunchAgents", label+".plist")
+	if err := os.WriteFile(path, []byte(plist), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", path)
+
+	// Replace the agent if an earlier install loaded it; that fails when
+	// there is none
+	domain := "gui/" + strconv.Itoa(os.Getuid())
+	exec.Command("launchctl", "bootout", domain+"/"+label).Run()
+	if out, err := exec.Command("launchctl", "bootstrap", domain, path).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl bootstrap: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	fmt.Printf("Loaded %s, logging to %s. To remove it:\n", label, logPath)
+	fmt.Printf("  launchctl bootout %s/%s && rm %s\n", domain, label, path)
+	return nil
+}
+
+// launchAgentPlist returns the agent running sorter from the current
+// directory: a watcher kept alive, restarted when it fails, or a pass every
+// -interval
+func launchAgentPlist(label, logPath string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	var args []string
+	if agentInterval > 0 {
+		args = unattendedFlags("interval")
+	} else {
+		args = serviceFlags("interval")
+	}
+	args = append([]string{exe}, args...)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(&b, "<!DOCTYPE plist PUBLIC \"-//Apple//DTD PLIST 1.0//EN\" \"http://www.apple.com/DTDs/PropertyList-1.0.dtd\">\n")
+	fmt.Fprintf(&b, "<!-- Written by sorter install-launchagent -->\n")
+	fmt.Fprintf(&b, "<plist version=\"1.0\">\n<dict>\n")
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>%s</string>\n", plistEscape(label))
+	fmt.Fprintf(&b, "\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range args {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", plistEscape(arg))
+	}
+	fmt.Fprintf(&b, "\t</array>\n")
+	fmt.Fprintf(&b, "\t<key>WorkingDirectory</key>\n\t<string>%s</string>\n", plistEscape(wd))
+	fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t<string>%s</string>\n", plistEscape(logPath))
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", plistEscape(logPath))
+	fmt.Fprintf(&b, "\t<key>RunAtLoad</key>\n\t<true/>\n")
+	if agentInterval > 0 {
+		fmt.Fprintf(&b, "\t<key>StartInterval</key>\n\t<integer>%d</integer>\n", int(agentInterval.Seconds()))
+	} else {
+		// A watcher only exits on its own when it failed
+		fmt.Fprintf(&b, "\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+		fmt.Fprintf(&b, "\t<key>ThrottleInterval</key>\n\t<integer>30</integer>\n")
+		// Leave time to finish the file in progress and write the checkpoint
+		fmt.Fprintf(&b, "\t<key>ExitTimeOut</key>\n\t<integer>300</integer>\n")
+	}
+	fmt.Fprintf(&b, "\t<key>ProcessType</key>\n\t<string>Background</string>\n")
+	fmt.Fprintf(&b, "</dict>\n</plist>\n")
+	return b.String(), nil
+}
+
+func plistEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
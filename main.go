@@ -1,486 +1,624 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/cespare/xxhash/v2"
 	"io"
-	"io/fs"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
+
+	"sorter/pkg/sorter"
 )
 
-// Helper function to determine the base directory based on the operating system
-func getBaseDir() string {
-	switch runtime.GOOS {
-	case "windows":
-		return "C:/me/sort" // Base directory for Windows
-	case "darwin":
-		return "/Users/andrew/sort" // Base directory for macOS
-	default:
-		return "C:/me/sort" // Default to Linux or other OS
+// defaultBaseDir is the base directory when neither the command line nor
+// the config file gives one: sort in the home directory. Without a home
+// directory there is none, and -base is needed.
+func defaultBaseDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
 	}
+	return filepath.Join(home, "sort")
 }
 
-// Category configuration structures
-type CategoryConfig map[string]CategoryGroup
-
-type CategoryGroup struct {
-	Extensions    []string                 `json:"extensions,omitempty"`
-	Subcategories map[string]CategoryGroup `json:"subcategories,omitempty"`
-}
-
-type ExclusionConfig struct {
-	Common     []string            `json:"common"`
-	OSSpecific map[string][]string `json:"os_specific"`
-}
+// Settings of the engine: the defaults, overridden by the command line,
+// then filled in from the config file
+var engine = sorter.DefaultConfig(defaultBaseDir())
 
-// Directory paths
+// Options of the command itself, set from the command line
 var (
-	baseDir      = getBaseDir() // Dynamically set base directory
-	inboxDir     = baseDir + "/inbox"
-	sortedDir    = baseDir + "/sorted"
-	deleteDir    = baseDir + "/delete"
-	extensionMap = make(map[string]string)
-	configLoaded bool
-	configMutex  sync.Mutex
-	excludeDirs  []string
-	excludeFiles []string
+	profile       string                   // Profile of the config file in use
+	olderThan     time.Duration            // Age of the files the purge command deletes (default retention)
+	restoreAll    bool                     // restore: everything in the delete directory
+	writeSuggest  bool                     // suggest: offer to add each suggestion to the category config
+	extensionsCfg string                   // Category config in use, which suggest -write edits
+	appConfigFile string                   // sorter.json, .yaml or .toml in use, if any
+	reloadFiles   []string                 // Config files watch mode and serve reload on change
+	systemUnit    bool                     // install-service: a system unit rather than a user one
+	agentInterval time.Duration            // install-launchagent: sort this often rather than watching
+	listenAddr    = "localhost:7878"       // serve: where the API listens
+	apiToken      string                   // serve: bearer token the API asks for, may be $NAME
+	api           *apiServer               // serve: drives the sorter, and streams its events
+	within        = "inbox"                // dedupe: look for duplicates in the inbox or the sorted directory
+	dupAction     = sorter.SortedDupReport // dedupe -within sorted: what to do with the extra copies
+	manifestFmt   = sorter.ManifestSHA256  // manifest: checksum format
+	perCategory   bool                     // manifest: one per top-level folder of the sorted directory
+	manifestOut   string                   // manifest: file, or folder with -per-category, written to
+	stdoutBusy    bool                     // stdout carries the event stream, a manifest or a completion script, so logs go to stderr
+	cmdArgs       []string                 // File arguments of commands that take them
+	outputMode    = "text"                 // "ndjson" writes one JSON event per action to stdout, "tui" shows a dashboard
+	reportPath    string                   // Run report written at exit, CSV or JSON by extension
+	logLevel      = "info"
+	logFormat     = "text"
+	logFile       string // Logs go to stdout when empty
+	watchMode     bool
+	metricsAddr   string          // Serves Prometheus metrics in watch mode
+	debugAddr     string          // Serves pprof and a status page in watch mode
+	notifyLevel   = notifyOff     // Batches of watch mode summed up in desktop notifications
+	chats         []*chat         // Told of every sorting pass
+	commandHooks  *hooks          // Run around sorting passes, if any are configured
+	interactive   bool            // Ask before every move
+	stopRequested <-chan struct{} // Closed on SIGINT or SIGTERM during sort and dedupe
+	stopNow       context.Context // Cancelled on a second signal
 )
 
-func loadExclusionConfig() error {
-	// Load directory exclusions
-	dirExclPath := filepath.Join("dir_exclusions.json")
-	if err := loadExclusionFile(dirExclPath, &excludeDirs); err != nil {
-		return err
+// parseFlags applies the directory flags on top of the config file and the
+// OS-specific defaults, and returns the app config that was used along with
+// the command to run ("sort" when none is given)
+func parseFlags() (*AppConfig, command) {
+	configPath := flag.String("config", "", "Path to sorter.json/sorter.yaml/sorter.toml (default: search the user config directory)")
+	flag.StringVar(&profile, "profile", "", "Use the settings of this profile of the config file, e.g. photos")
+	flag.StringVar(&engine.Base, "base", engine.Base, "Base directory holding inbox, sorted and delete")
+	flag.Func("inbox", "Directory to sort files from (default <base>/inbox), or an sftp://[user@]host[:port]/path, s3://bucket/prefix or davs://user@host/path URL; repeat to sort several in one run", func(dir string) error {
+		if engine.Inbox == "" {
+			engine.Inbox = dir
+		} else {
+			engine.Inboxes = append(engine.Inboxes, sorter.InboxConfig{Dir: dir})
+		}
+		return nil
+	})
+	flag.StringVar(&engine.Sorted, "sorted", "", "Directory to move unique files into, local, sftp://, s3:// or davs:// (default <base>/sorted)")
+	flag.StringVar(&engine.Delete, "delete", "", "Directory to move duplicates into, local, sftp://, s3:// or davs:// (default <base>/delete)")
+	flag.BoolVar(&engine.DryRun, "dry-run", false, "Print what would be moved, renamed or removed without touching anything")
+	flag.BoolVar(&engine.SniffContent, "sniff", engine.SniffContent, "Classify files with a missing or unknown extension by their content")
+	flag.StringVar(&engine.MismatchCategory, "mismatch-category", engine.MismatchCategory, "Category for files whose content contradicts their extension; \"none\" disables the check")
+	flag.StringVar(&engine.EncryptedCategory, "encrypted-category", "", "Category for password-protected zip, rar and 7z archives; \""+sorter.LeaveInInbox+"\" leaves them in the inbox (default: sorted as other archives)")
+	flag.StringVar(&engine.ProjectCategory, "project-category", engine.ProjectCategory, "Category project folders (holding .git, go.mod, package.json and the like) are moved into whole; \""+sorter.LeaveInInbox+"\" leaves them in the inbox, \"none\" sorts their files")
+	flag.StringVar(&engine.Sidecars, "sidecars", engine.Sidecars, "Extensions of files moved along with the file of the same name, e.g. photo.xmp with photo.cr2; \"none\" sorts them on their own")
+	flag.BoolVar(&engine.RawPairs, "raw-pairs", false, "Keep the JPEG or HEIF a camera saved along with a RAW file with it, IMG_1234.JPG with IMG_1234.CR3, and only deduplicate the pair as a whole")
+	flag.StringVar(&engine.CorruptCategory, "corrupt-category", engine.CorruptCategory, "Category for truncated and damaged files; \"none\" disables the check")
+	flag.StringVar(&engine.UnknownCategory, "unknown-category", engine.UnknownCategory, "Category for files with an unknown extension, {EXT} being the extension; \""+sorter.LeaveInInbox+"\" leaves them in the inbox")
+	flag.StringVar(&engine.NoExtensionCategory, "no-extension-category", "", "Category for files without an extension, as -unknown-category (default -unknown-category)")
+	flag.StringVar(&engine.NameTemplate, "name-template", engine.NameTemplate, "Destination path of sorted files, relative to the sorted directory")
+	flag.StringVar(&engine.DeleteTemplate, "delete-template", engine.DeleteTemplate, "Name of files moved to the delete directory")
+	flag.StringVar(&engine.Collision, "collision", engine.Collision, "What to do when a destination is taken: "+strings.Join(sorter.CollisionPolicies, ", "))
+	flag.StringVar(&engine.Replacement, "replace-char", engine.Replacement, "Replaces the characters a file name can't contain, such as ? or |")
+	flag.StringVar(&engine.Normalization, "normalize", engine.Normalization, "Unicode normalization of sorted file names: "+strings.Join(sorter.Normalizations, ", "))
+	flag.StringVar(&engine.HashAlgorithm, "hash-algo", engine.HashAlgorithm, "Hash files are compared with: "+strings.Join(sorter.HashAlgorithms(), ", "))
+	flag.StringVar(&engine.Preserve, "preserve", engine.Preserve, "What a copy across filesystems keeps: all, none or a list of "+strings.Join(sorter.PreserveAttributes, ","))
+	flag.Func("min-size", "Leave inbox files smaller than this in the inbox, e.g. 1K (rules can still route them)", sizeFlag(&engine.MinSize))
+	flag.Func("max-size", "Leave inbox files larger than this in the inbox, e.g. 50GB (rules can still route them)", sizeFlag(&engine.MaxSize))
+	flag.Func("min-age", "Leave inbox files modified more recently than this in the inbox, e.g. 10m, so downloads in progress aren't moved", durationFlag((*time.Duration)(&engine.MinAge)))
+	flag.Func("stable-wait", "Wait this long, e.g. 2s, and leave inbox files that changed meanwhile or are open for writing in the inbox", durationFlag((*time.Duration)(&engine.StableWait)))
+	flag.Func("bwlimit", "Read at most this many bytes per second for hashing and copying, e.g. 10M, to leave a busy disk or NAS room for others", sizeFlag(&engine.BandwidthLimit))
+	flag.Float64Var(&engine.FilesPerSec, "files-per-sec", 0, "Handle at most this many files per second")
+	flag.BoolVar(&engine.TrustHashes, "trust-hashes", false, "Treat files with matching hashes as duplicates without comparing their bytes")
+	flag.BoolVar(&engine.Trash, "trash", false, "Send duplicates to the OS trash (Recycle Bin) instead of the delete directory")
+	flag.BoolVar(&engine.ExtractArchives, "extract-archives", false, "Unpack zip and tar archives from the inbox and sort their files, moving the archives to the extracted directory")
+	flag.StringVar(&engine.Extracted, "extracted", "", "Directory extracted archives are moved into, local, sftp://, s3:// or davs:// (default <base>/extracted)")
+	flag.Func("retention", "After each run, permanently delete files kept in the delete directory for longer than this, e.g. 30d", durationFlag((*time.Duration)(&engine.Retention)))
+	flag.Func("older-than", "purge: delete files kept in the delete directory for longer than this, e.g. 30d (default -retention)", durationFlag(&olderThan))
+	flag.BoolVar(&engine.SecureWipe, "secure-wipe", false, "Overwrite purged files with random data before removing them (not effective on SSDs and copy-on-write filesystems)")
+	flag.StringVar(&engine.S3Endpoint, "s3-endpoint", "", "Server of s3:// directories, e.g. http://minio:9000 (default $AWS_ENDPOINT_URL, or Amazon S3)")
+	flag.StringVar(&engine.SSHCommand, "ssh-command", "", "Command reaching the server of sftp:// directories, e.g. \"ssh -i ~/.ssh/nas\" (default \"ssh\")")
+	flag.BoolVar(&restoreAll, "all", false, "restore: move every file in the delete directory back")
+	flag.BoolVar(&writeSuggest, "write", false, "suggest: ask to add each suggested extension to extensions.json")
+	flag.StringVar(&manifestFmt, "checksum", manifestFmt, "manifest: checksum format, "+strings.Join(sorter.ManifestFormats, " or "))
+	flag.BoolVar(&perCategory, "per-category", false, "manifest: write one manifest per top-level folder of the sorted directory")
+	flag.StringVar(&manifestOut, "out", "", "manifest: file to write, or folder with -per-category (default stdout, or <base>/manifests)")
+	flag.StringVar(&within, "within", within, "dedupe: find duplicates in the inbox, or within the sorted directory itself (inbox or sorted)")
+	flag.StringVar(&dupAction, "action", dupAction, "dedupe -within sorted: "+strings.Join(sorter.SortedDupActions, ", ")+" the extra copies")
+	output := flag.String("output", "", "Output mode: text, ndjson for one JSON event per action on stdout, or tui for a full-screen dashboard (default "+outputMode+")")
+	flag.StringVar(&reportPath, "report", "", "Write every decision of the run to this CSV (or .json) file")
+	level := flag.String("log-level", "", "Minimum level logged: debug, info, warn or error (default "+logLevel+")")
+	format := flag.String("log-format", "", "Log format: text or json (default "+logFormat+")")
+	file := flag.String("log-file", "", "Append logs to this file instead of writing them to stdout")
+	flag.IntVar(&engine.Workers, "workers", engine.Workers, "Number of files hashed concurrently")
+	flag.BoolVar(&interactive, "interactive", false, "Ask before every move or duplicate deletion (y/n/a/q)")
+	flag.BoolVar(&watchMode, "watch", false, "Keep running and sort files as they arrive in the inbox")
+	flag.DurationVar(&engine.WatchDebounce, "debounce", engine.WatchDebounce, "Quiet period after inbox activity before sorting (watch mode)")
+	flag.DurationVar(&engine.WatchRescan, "rescan", engine.WatchRescan, "Interval between full inbox re-scans (watch mode)")
+	flag.StringVar(&engine.Schedule, "schedule", "", "Sort at the times of this crontab schedule, e.g. \"0 */2 * * *\", rather than as files arrive (watch mode)")
+	flag.Func("jitter", "Start scheduled runs up to this much later, at random, e.g. 5m (watch mode)", durationFlag((*time.Duration)(&engine.Jitter)))
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address in watch mode, e.g. :9184")
+	flag.StringVar(&debugAddr, "debug-addr", "", "Serve pprof profiles and a status page on this address in watch mode, e.g. localhost:6060")
+	flag.StringVar(&engine.OTLPEndpoint, "otlp-endpoint", "", "Send traces of runs to this OpenTelemetry collector over OTLP/HTTP, e.g. http://localhost:4318 (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.IntVar(&engine.TraceSample, "trace-sample", engine.TraceSample, "Give one inbox file in this many a trace span, 0 for none")
+	flag.DurationVar(&agentInterval, "interval", 0, "install-launchagent: sort this often, e.g. 1h, rather than watching the inbox")
+	flag.StringVar(&listenAddr, "listen", listenAddr, "serve: address the API listens on")
+	flag.StringVar(&apiToken, "api-token", "", "serve: bearer token the API asks for, or $NAME of a variable holding it; needed beyond localhost")
+	chdir := flag.String("chdir", "", "Change to this directory first, as services start elsewhere")
+	flag.BoolVar(&systemUnit, "system", false, "install-service: write a system unit, run as the user calling sudo, rather than a user unit")
+	notify := flag.String("notify", "", "Desktop notifications in watch mode: info after every batch that moved files, error only for failures, or off (default "+notifyLevel+")")
+	flag.Usage = usage
+	flag.Parse()
+
+	// Flags may also follow the command, e.g. "sorter undo -base ..."
+	cmd := commands[0]
+	if flag.NArg() > 0 {
+		name := flag.Arg(0)
+		if name == "help" {
+			flag.CommandLine.SetOutput(os.Stdout)
+			usage()
+			os.Exit(0)
+		}
+		found, ok := findCommand(name)
+		if !ok {
+			fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n\n", name)
+			usage()
+			os.Exit(2)
+		}
+		cmd = found
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if cmd.args {
+			cmdArgs = flag.Args()
+		} else if flag.NArg() > 0 {
+			usage()
+			os.Exit(2)
+		}
 	}
 
-	// Load file exclusions
-	fileExclPath := filepath.Join("file_exclusions.json")
-	return loadExclusionFile(fileExclPath, &excludeFiles)
-}
+	if err := applyEnvFlags(); err != nil {
+		fatal("Invalid environment", &sorter.ConfigError{Err: err})
+	}
 
-func loadExclusionFile(path string, target *[]string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("failed to open exclusion config: %w", err)
+	if *chdir != "" {
+		if err := os.Chdir(*chdir); err != nil {
+			fatal("Invalid flags", &sorter.ConfigError{Err: err})
+		}
 	}
-	defer file.Close()
 
-	var config ExclusionConfig
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return fmt.Errorf("invalid exclusion config format: %w", err)
+	config := &AppConfig{}
+	if *configPath == "" {
+		*configPath = findAppConfig()
+	}
+	appConfigFile = *configPath
+	if *configPath != "" {
+		loaded, err := loadAppConfig(*configPath)
+		if err != nil {
+			fatal("Failed to load config", &sorter.ConfigError{Err: err})
+		}
+		config = loaded
+	}
+	if profile != "" {
+		if filepath.Base(profile) != profile || !filepath.IsLocal(profile) {
+			fatal("Invalid profile", &sorter.ConfigError{Err: fmt.Errorf("invalid profile name %q", profile)})
+		}
+		if *configPath == "" {
+			fatal("Invalid profile", &sorter.ConfigError{Err: errors.New("-profile needs a config file defining profiles")})
+		}
+		selected, err := config.applyProfile(profile)
+		if err != nil {
+			fatal("Invalid profile", &sorter.ConfigError{Err: err})
+		}
+		config = selected
+	}
+	if err := config.applyEnv(); err != nil {
+		fatal("Invalid environment", &sorter.ConfigError{Err: err})
 	}
 
-	*target = append(config.Common, config.OSSpecific[runtime.GOOS]...)
-	return nil
-}
+	outputMode = firstNonEmpty(*output, config.Output, outputMode)
+	switch outputMode {
+	case "text", "ndjson":
+	case "tui":
+		// Only sorting runs have something to show, other commands print as usual
+		if cmd.name != "sort" && cmd.name != "dedupe" {
+			outputMode = "text"
+		} else if !isTerminal(os.Stdout) {
+			fatal("Invalid output mode", &sorter.ConfigError{Err: errors.New("tui output needs a terminal")})
+		}
+	default:
+		fatal("Invalid output mode", &sorter.ConfigError{Err: fmt.Errorf("%q must be text, ndjson or tui", outputMode)})
+	}
+	stdoutBusy = outputMode == "ndjson" || cmd.name == "manifest" && manifestOut == "" && !perCategory || cmd.name == "completion"
+	reportPath = firstNonEmpty(reportPath, config.Resolve(config.Report))
+	logLevel = firstNonEmpty(*level, config.LogLevel, logLevel)
+	logFormat = firstNonEmpty(*format, config.LogFormat, logFormat)
+	logFile = firstNonEmpty(*file, config.Resolve(config.LogFile), logFile)
+	if err := setupLogging(); err != nil {
+		fatal("Invalid logging configuration", &sorter.ConfigError{Err: err})
+	}
+	if *configPath != "" {
+		slog.Info("Using config", "path", *configPath)
+	}
 
-func init() {
-	if err := loadExtensionConfig(); err != nil {
-		log.Fatalf("Failed to load extension config: %v", err)
+	// The config file fills in what the command line left out, each setting
+	// given by the flag of its name but for a few
+	names := map[string]string{"inboxes": "inbox", "hash_algorithm": "hash-algo", "replacement": "replace-char", "normalization": "normalize"}
+	engine.Profile = profile
+	engine.Fill(config.Config, func(key string) bool {
+		return flagSet(cmp.Or(names[key], strings.ReplaceAll(key, "_", "-")))
+	})
+	if engine.Base == "" && cmd.name != "completion" && cmd.name != "config" {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("no home directory to sort in, set -base or \"base\" in the config")})
+	}
+	metricsAddr = firstNonEmpty(metricsAddr, config.MetricsAddr)
+	debugAddr = firstNonEmpty(debugAddr, config.DebugAddr)
+	if (flagSet("schedule") || flagSet("jitter")) && !watchMode {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("-schedule and -jitter need -watch")})
+	}
+	if !flagSet("listen") && config.Listen != "" {
+		listenAddr = config.Listen
+	}
+	apiToken = firstNonEmpty(apiToken, config.APIToken)
+	if flagSet("metrics-addr") && !watchMode {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("-metrics-addr needs -watch")})
+	}
+	if flagSet("debug-addr") && !watchMode {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("-debug-addr needs -watch")})
+	}
+	if agentInterval != 0 && (agentInterval < time.Minute || watchMode) {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("-interval must be at least 1m, and is instead of -watch")})
+	}
+	notifyLevel = firstNonEmpty(*notify, config.Notify, notifyLevel)
+	switch notifyLevel {
+	case notifyOff, notifyError, notifyInfo:
+	default:
+		fatal("Invalid flags", &sorter.ConfigError{Err: fmt.Errorf("-notify %q must be info, error or off", notifyLevel)})
+	}
+	if flagSet("notify") && notifyLevel != notifyOff && !watchMode {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("-notify needs -watch")})
+	}
+	for _, nc := range config.Notifiers {
+		c, err := newChat(nc, config.NotifyTemplate)
+		if err != nil {
+			fatal("Invalid config", &sorter.ConfigError{Err: err})
+		}
+		chats = append(chats, c)
+	}
+	if h := config.Hooks; h.BeforeRun != nil || h.AfterRun != nil || h.AfterMove != nil {
+		var err error
+		if commandHooks, err = newHooks(h); err != nil {
+			fatal("Invalid config", &sorter.ConfigError{Err: err})
+		}
+	}
+	if interactive && watchMode {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("-interactive cannot be combined with -watch")})
 	}
-	if err := loadExclusionConfig(); err != nil {
-		log.Fatalf("Failed to load exclusion config: %v", err)
+	if outputMode == "tui" && (interactive || watchMode) {
+		fatal("Invalid flags", &sorter.ConfigError{Err: errors.New("tui output cannot be combined with -interactive or -watch")})
 	}
+	return config, cmd
 }
 
-func loadExtensionConfig() error {
-	configPath := filepath.Join("extensions.json")
-
-	file, err := os.Open(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to open extension config: %w", err)
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [flags] [files]\n\nCommands:\n", os.Args[0])
+	width := 0
+	for _, cmd := range commands {
+		width = max(width, len(cmd.name))
 	}
-	defer file.Close()
-
-	var config CategoryConfig
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return fmt.Errorf("invalid extension config format: %w", err)
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-*s %s\n", width, cmd.name, cmd.summary)
 	}
-
-	configMutex.Lock()
-	defer configMutex.Unlock()
-	extensionMap = buildExtensionMap(config)
-	configLoaded = true
-
-	return nil
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nFlags and config settings can also be set through %s variables, e.g. %sINBOX.\n", envPrefix, envPrefix)
 }
 
-func buildExtensionMap(config CategoryConfig) map[string]string {
-	extMap := make(map[string]string)
-
-	for mainCategory, group := range config {
-		processCategoryGroup(mainCategory, group, extMap)
+// setupLogging installs the default logger according to the log flags
+func setupLogging() error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q", logLevel)
 	}
 
-	// Add special case for macOS attribute files
-	extMap["_"] = "System/Attribute_Files" // For ._ prefix files
-
-	return extMap
-}
-
-func processCategoryGroup(currentPath string, group CategoryGroup, extMap map[string]string) {
-	// Process current level extensions
-	for _, ext := range group.Extensions {
-		extMap[strings.ToLower(ext)] = currentPath
+	// Keep stdout free for the event stream in ndjson mode (or a manifest),
+	// and the screen for the dashboard in tui mode (which shows errors itself)
+	var out io.Writer = os.Stdout
+	switch {
+	case stdoutBusy:
+		out = os.Stderr
+	case outputMode == "tui":
+		out = io.Discard
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		out = f
 	}
 
-	// Process subcategories
-	for subName, subGroup := range group.Subcategories {
-		subPath := filepath.Join(currentPath, subName)
-		processCategoryGroup(subPath, subGroup, extMap)
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(out, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, opts)))
+	default:
+		return fmt.Errorf("invalid log format %q: must be text or json", logFormat)
 	}
+	return nil
 }
 
-// Helper function to calculate XXH64 hash of a file
-func fileHash(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+// Exit codes
+const (
+	exitOK      = 0
+	exitPartial = 1 // Some files could not be processed
+	exitConfig  = 2 // Invalid configuration or usage
+	exitLocked  = 3 // Another run holds the lock
+	exitFailed  = 4 // The run failed
+)
 
-	hash := xxhash.New()
-	_, err = io.Copy(hash, file)
-	if err != nil {
-		return "", err
+// exitCode maps an error returned by the sorter to an exit code
+func exitCode(err error) int {
+	var configErr *sorter.ConfigError
+	var partialErr *sorter.PartialError
+	var lockedErr *sorter.LockedError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &configErr):
+		return exitConfig
+	case errors.As(err, &lockedErr):
+		return exitLocked
+	case errors.As(err, &partialErr):
+		return exitPartial
 	}
-
-	return fmt.Sprintf("%x", hash.Sum64()), nil
+	return exitFailed
 }
 
-// Helper function to print progress
-func printProgress(current, total int) {
-	fmt.Printf("\rProcessing: %d/%d (%.0f%%)", current, total, float64(current)/float64(total)*100)
-	os.Stdout.Sync() // Force flush the output
+// fatal logs an error and exits with the matching exit code
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(exitCode(err))
 }
 
-// Function to collect hashes from sorted directory into a hash map
-func collectSortedHashes() (map[string]string, error) {
-	start := time.Now()
-	hashes := make(map[string]string)
-	var totalFiles int
-	var processedFiles int
-
-	defer func() {
-		duration := time.Since(start)
-		fmt.Printf(
-			"Processing completed in %v (%.1f files/sec)\n",
-			duration.Round(time.Second),
-			float64(totalFiles)/duration.Seconds(),
-		)
-	}()
-
-	// FIRST PASS: Count total files
-	err := filepath.Walk(sortedDir, func(filePath string, info fs.FileInfo, err error) error {
+// durationFlag parses a flag with sorter.ParseDuration, which knows days and weeks
+func durationFlag(d *time.Duration) func(string) error {
+	return func(value string) error {
+		parsed, err := sorter.ParseDuration(value)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			totalFiles++
-		}
+		*d = parsed
 		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
-	if totalFiles == 0 {
-		fmt.Println("No files found in sorted directory")
-		return hashes, nil
-	}
-
-	// Clear any previous output before starting progress
-	fmt.Print("\033[2K\r") // ANSI escape code to clear line
-	fmt.Printf("Indexing %d files in sorted directory...\n", totalFiles)
+}
 
-	// SECOND PASS: Walk through the sorted directory to collect file hashes
-	err = filepath.Walk(sortedDir, func(filePath string, info os.FileInfo, err error) error {
+func sizeFlag(s *sorter.Size) func(string) error {
+	return func(value string) error {
+		parsed, err := sorter.ParseSize(value)
 		if err != nil {
 			return err
 		}
+		*s = parsed
+		return nil
+	}
+}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-
-		processedFiles++
-		printProgress(processedFiles, totalFiles)
-
-		hash, err := fileHash(filePath)
-		if err != nil {
-			// Print error on new line to not break progress bar
-			fmt.Printf("\nError hashing file %s: %v\n", filePath, err)
-			printProgress(processedFiles, totalFiles) // Redraw progress bar
-			return nil
+// flagSet reports whether a flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		hashes[hash] = filePath
-		return nil
 	})
+	return set
+}
 
-	fmt.Println() // New line after progress bar
-	return hashes, err
+// firstNonEmpty returns the first non-empty string
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
 }
 
-// Function to check for duplicate files in inbox and move them accordingly
-func checkAndSortFiles() error {
-	// Collect file hashes from the sorted directory
-	sortedHashes, err := collectSortedHashes()
+// newSorter loads the category and exclusion configs and builds the engine
+// out of them and its settings.
+// Events are recorded into report and metrics, shown on dash and summed up
+// by notifier when they are non-nil, and streamed by the serve API.
+func newSorter(config *AppConfig, report *sorter.Report, dash *dashboard, metrics *sorter.Metrics, notifier *notifier) (*sorter.Sorter, error) {
+	extensionsCfg = config.configFile(config.Extensions, "extensions")
+	settings, files, err := loadSettings(config)
 	if err != nil {
-		return fmt.Errorf("Error collecting sorted file hashes: %v", err)
+		return nil, err
 	}
-
-	// Map to track processed hashes to avoid duplicates during the current run
-	processedHashes := make(map[string]bool)
-
-	// Walking through the inbox directory and its subdirectories
-	err = filepath.Walk(inboxDir, func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip directories or hidden files (e.g., .DS_Store)
-		if info.IsDir() {
-			dirName := info.Name()
-
-			// Check exclusion patterns first
-			for _, pattern := range excludeDirs {
-				matched, err := filepath.Match(pattern, dirName)
-				if err != nil {
-					fmt.Printf("Pattern error %q: %v\n", pattern, err)
-					continue
-				}
-				if matched {
-					fmt.Printf("Skipping excluded directory: %s\n", filePath)
-					return filepath.SkipDir
-				}
+	reloadFiles = files
+	opts, err := engine.Options(settings)
+	if err != nil {
+		return nil, err
+	}
+	opts.Stop = stopRequested
+	opts.Context = stopNow
+	opts.Logger = slog.Default()
+	opts.Metrics = metrics
+	if interactive {
+		opts.Confirm = newPrompter(os.Stdin, os.Stderr).confirm
+	}
+	var stream *json.Encoder
+	if stdoutBusy {
+		opts.Output = os.Stderr
+	}
+	if outputMode == "ndjson" {
+		stream = json.NewEncoder(os.Stdout)
+	}
+	if dash != nil {
+		opts.Output = io.Discard
+		opts.Confirm = dash.confirm
+	}
+	if commandHooks != nil {
+		opts.BeforeRun = commandHooks.beforeRun
+	}
+	if notifier != nil || commandHooks != nil {
+		opts.RunFinished = func(err error) {
+			if notifier != nil {
+				notifier.runFinished(err)
 			}
-
-			// Skip hidden directories (including .git)
-			if strings.HasPrefix(dirName, ".") {
-				fmt.Printf("Skipping hidden directory: %s\n", filePath)
-				return filepath.SkipDir
+			if commandHooks != nil {
+				commandHooks.runFinished(err)
 			}
-
-			// Important: Return here to prevent processing directories as files
-			return nil
 		}
-
-		fileName := info.Name()
-
-		// Skip hidden files and macOS extended attributes
-		if strings.HasPrefix(fileName, ".") {
-			if runtime.GOOS == "darwin" && strings.HasPrefix(fileName, "._") {
-				fmt.Printf("Skipping macOS extended attribute file: %s\n", filePath)
+	}
+	if stream != nil || report != nil || dash != nil || notifier != nil || commandHooks != nil || api != nil {
+		opts.Events = func(event sorter.Event) {
+			if stream != nil {
+				stream.Encode(event)
 			}
-			return nil
-		}
-
-		// Skip excluded file patterns
-		for _, pattern := range excludeFiles {
-			matched, err := filepath.Match(pattern, fileName)
-			if err != nil {
-				fmt.Printf("Pattern error %q: %v\n", pattern, err)
-				continue
+			if report != nil {
+				report.Record(event)
 			}
-			if matched {
-				fmt.Printf("Skipping excluded file: %s (matched pattern: %s)\n", filePath, pattern)
-				return nil
+			if dash != nil {
+				dash.record(event)
+			}
+			if notifier != nil {
+				notifier.record(event)
+			}
+			if commandHooks != nil {
+				commandHooks.record(event)
+			}
+			if api != nil {
+				api.record(event)
 			}
 		}
+	}
+	return sorter.New(opts)
+}
 
-		// Skip files that are empty
-		if info.Size() == 0 {
-			fmt.Printf("Skipping empty file: %s\n", filePath)
-			return nil
-		}
-
-		// Check for invalid or unsafe characters in file names to prevent issues on certain operating systems
-		if strings.ContainsAny(info.Name(), `<>:"/\|?*`) {
-			fmt.Printf("Skipping file with invalid characters: %s\n", filePath)
-			return nil
-		}
-
-		// Skip symbolic links to avoid processing unintended files or creating loops
-		if info.Mode()&os.ModeSymlink != 0 {
-			fmt.Printf("Skipping symbolic link: %s\n", filePath)
-			return nil
+func main() {
+	config, cmd := parseFlags()
+	// Completion works from any directory, without the sorter's configs
+	if cmd.name == "completion" {
+		if err := runCompletion(nil); err != nil {
+			fatal("completion failed", err)
 		}
-
-		// Log the file being processed
-		fmt.Printf("Processing file: %s\n", filePath)
-
-		// Calculate hash for the file in the inbox
-		hash, err := fileHash(filePath)
-		if err != nil {
-			fmt.Printf("Error hashing file %s: %v\n", filePath, err)
-			return nil
+		return
+	}
+	if cmd.name == "config" {
+		if err := runConfig(config); err != nil {
+			fatal("config failed", err)
 		}
-
-		// Check if the file has already been processed in this run
-		if processedHashes[hash] {
-			fmt.Printf("Duplicate detected within run: %s\n", filePath)
-			moveFileWithMetadata(filePath, deleteDir)
-			return nil
+		return
+	}
+	var report *sorter.Report
+	if reportPath != "" {
+		report = sorter.NewReport()
+	}
+	// Other commands are short and simply die on Ctrl-C
+	if serviceRun(cmd) {
+		// The service manager stops sort -watch rather than Ctrl-C
+		var err error
+		if stopRequested, stopNow, err = connectService(); err != nil {
+			fatal("Cannot run as a service", err)
 		}
-
-		// Check if file already exists in sorted directory using the hash map
-		if existingPath, found := sortedHashes[hash]; found {
-			// If a duplicate is found, move to delete folder with metadata
-			fmt.Printf("Duplicate found: %s already exists as %s\n", filePath, existingPath)
-			moveFileWithMetadata(filePath, deleteDir)
-		} else {
-			// If no duplicate, move to sorted folder and add hash to the map
-			fmt.Printf("File is unique, moving to sorted folder: %s\n", filePath)
-			moveFileBasedOnExtension(filePath)
-			sortedHashes[hash] = filePath
+		cmd = command{"sort", cmd.summary, runServiceWatch, true, false}
+	} else if cmd.name == "sort" || cmd.name == "dedupe" || cmd.name == "serve" {
+		stopRequested, stopNow = stopSignal()
+	}
+	if cmd.name == "serve" {
+		if report == nil {
+			report = sorter.NewReport()
 		}
-
-		// Mark the hash as processed for this run
-		processedHashes[hash] = true
-
-		return nil
-	})
-
-	return err
-}
-
-// Function to move file to the destination folder
-func moveFile(src, dest string) error {
-	fmt.Printf("Moving file: %s to folder: %s\n", src, dest)
-
-	err := os.MkdirAll(dest, os.ModePerm)
-	if err != nil {
-		return err
+		api = newAPIServer(report)
 	}
-
-	// Get the current file's base name and extension
-	ext := filepath.Ext(src)
-	baseName := strings.TrimSuffix(filepath.Base(src), ext)
-
-	// Check if the file already exists in the destination folder
-	destFilePath := filepath.Join(dest, filepath.Base(src))
-	if _, err := os.Stat(destFilePath); err == nil {
-		// File exists, create a new name using the hash (first 6 characters)
-		hash, err := fileHash(src)
-		if err != nil {
-			return err
+	var dash *dashboard
+	if outputMode == "tui" {
+		dash = newDashboard(os.Stdout)
+	}
+	var metrics *sorter.Metrics
+	if metricsAddr != "" && watchMode && cmd.name == "sort" {
+		metrics = sorter.NewMetrics()
+		if err := serveMetrics(metricsAddr, metrics); err != nil {
+			fatal("Cannot serve metrics", err)
 		}
-		hashPrefix := hash[:6] // First 6 characters of the hash
-		newName := fmt.Sprintf("%s_%s%s", baseName, hashPrefix, ext)
-		destFilePath = filepath.Join(dest, newName)
 	}
-
-	// Move the file to the destination
-	err = os.Rename(src, destFilePath)
-	if err != nil {
-		return err
+	var notifier *notifier
+	if (notifyLevel != notifyOff && watchMode || len(chats) > 0) && cmd.name == "sort" {
+		desktop := notifyLevel
+		if !watchMode {
+			desktop = notifyOff
+		}
+		notifier = newNotifier(desktop, chats)
 	}
-
-	fmt.Printf("File successfully moved to: %s\n", destFilePath)
-	return nil
-}
-
-// Function to move file to the delete folder with metadata (hash-based name)
-func moveFileWithMetadata(src, dest string) error {
-	fmt.Printf("Moving file to delete folder with metadata: %s\n", src)
-
-	err := os.MkdirAll(dest, os.ModePerm)
+	s, err := newSorter(config, report, dash, metrics, notifier)
 	if err != nil {
-		return err
+		fatal("Failed to initialize", err)
 	}
-
-	// Get the current file's base name and extension
-	ext := filepath.Ext(src)
-	baseName := strings.TrimSuffix(filepath.Base(src), ext)
-
-	// Calculate the hash for uniqueness
-	hash, err := fileHash(src)
-	if err != nil {
-		return err
+	if err := s.EnsureDirs(); err != nil {
+		fatal("Invalid directory configuration", err)
 	}
-	hashPrefix := hash[:6] // First 6 characters of the hash
-
-	// Append the hash to the file name
-	newName := fmt.Sprintf("%s_%s_processed_delete%s", baseName, hashPrefix, ext)
-	destFilePath := filepath.Join(dest, newName)
-
-	err = os.Rename(src, destFilePath)
-	if err != nil {
-		return err
+	if debugAddr != "" && watchMode && cmd.name == "sort" {
+		if err := serveDebug(debugAddr, s); err != nil {
+			fatal("Cannot serve debug pages", err)
+		}
 	}
 
-	fmt.Printf("File successfully moved to delete folder: %s\n", destFilePath)
-	return nil
-}
-
-// Updated file sorting logic
-func moveFileBasedOnExtension(filePath string) {
-	ext := strings.ToLower(filepath.Ext(filePath))
-	baseName := filepath.Base(filePath)
-
-	// Handle macOS extended attributes
-	if strings.HasPrefix(baseName, "._") && runtime.GOOS == "darwin" {
-		ext = "._*"
+	// Only commands that change the directories need to run alone. On a
+	// schedule, each run takes the lock itself, leaving room in between.
+	unlock := func() {}
+	if cmd.locks && !engine.DryRun && !(watchMode && engine.Schedule != "") {
+		if unlock, err = s.Lock(); err != nil {
+			fatal("Cannot start "+cmd.name, err)
+		}
 	}
 
-	ext = strings.TrimPrefix(ext, ".")
-	if ext == "" {
-		ext = "no_extension"
+	if dash != nil {
+		dash.run()
 	}
-
-	configMutex.Lock()
-	defer configMutex.Unlock()
-
-	var categoryPath string
-	if path, exists := extensionMap[ext]; exists {
-		categoryPath = path
-	} else {
-		// Create misc subcategory based on extension type
-		categoryPath = filepath.Join("Misc", strings.ToUpper(ext))
+	err = cmd.run(s)
+	if dash != nil {
+		dash.stop()
 	}
+	unlock()
 
-	destFolder := filepath.Join(sortedDir, categoryPath)
-	moveFile(filePath, destFolder)
-}
-
-// Function to scan and remove empty folders in the inbox directory after sorting
-func removeEmptyDirs(root string) error {
-	return filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("Skipping %s due to error: %v\n", path, err)
-			return nil
-		}
-		if path == root || !info.IsDir() {
-			return nil
-		}
-		entries, err := os.ReadDir(path)
-		if err != nil {
-			return nil // skip if we can't read
-		}
-		if len(entries) == 0 {
-			fmt.Printf("Removing empty folder: %s\n", path)
-			return os.Remove(path)
+	// The report is written even when the run failed, that's when it's most useful
+	if reportPath != "" {
+		if reportErr := report.WriteFile(reportPath); reportErr != nil {
+			slog.Error("Failed to write report", "path", reportPath, "err", reportErr)
+		} else {
+			slog.Info("Report written", "path", reportPath)
 		}
-		return nil
-	})
-}
-
-func main() {
-	err := checkAndSortFiles()
-	if err != nil {
-		fmt.Println("Error while sorting files:", err)
-	} else {
-		fmt.Println("File sorting completed successfully.")
 	}
-	err = removeEmptyDirs(inboxDir)
+	if errors.Is(err, sorter.ErrAborted) {
+		slog.Info("Stopped at user request")
+		return
+	}
 	if err != nil {
-		fmt.Printf("Error cleaning empty folders: %s", err)
+		fatal(cmd.name+" failed", err)
 	}
 }
+
+// stopSignal returns a channel that is closed on SIGINT or SIGTERM, and a
+// context cancelled on a second signal, which cuts short the hashing or
+// copy in progress. A third signal kills the process as usual.
+func stopSignal() (<-chan struct{}, context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	stop := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := <-signals
+		slog.Info("Stopping", "signal", sig)
+		close(stop)
+		sig = <-signals
+		signal.Stop(signals)
+		slog.Info("Stopping at once", "signal", sig)
+		cancel()
+	}()
+	return stop, ctx
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// serveMetrics serves m on /metrics at addr in the background, failing
+// only when addr can't be listened on
+func serveMetrics(addr string, m *sorter.Metrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("Serving metrics", "url", "http://"+ln.Addr().String()+"/metrics")
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			slog.Error("Metrics server stopped", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// Levels of -notify
+const (
+	notifyOff   = "off"
+	notifyError = "error" // Only batches where files failed
+	notifyInfo  = "info"  // Every batch that moved files, and failed ones
+)
+
+// batch is what one pass of the sorter did, as notifications tell it
+type batch struct {
+	Sorted       []batchFile // Filed into the sorted directory
+	Duplicates   []batchFile // Sent to the delete folder as duplicates
+	Deleted      []batchFile // Sent to the delete folder by a rule
+	Unclassified []batchFile // Sorted into the unknown extension fallbacks, or left in the inbox
+	Failed       []batchFile
+	Err          error // Set when the pass itself failed
+}
+
+type batchFile struct {
+	Path     string
+	Name     string // Base name of Path
+	Dest     string
+	Category string
+	Error    string
+}
+
+func (b *batch) empty() bool {
+	return len(b.Sorted)+len(b.Duplicates)+len(b.Deleted)+len(b.Unclassified)+len(b.Failed) == 0 && b.Err == nil
+}
+
+// notifier tells of each pass of the sorter: in a desktop notification
+// summing it up, when desktop is a level other than off, and in chats.
+// It is fed by the sorter's events and told of the end of each pass
+// through Options.RunFinished.
+type notifier struct {
+	desktop string
+	chats   []*chat
+
+	mu      sync.Mutex
+	current batch
+	pending map[string]batchFile // Files whose category is known, not moved yet
+}
+
+func newNotifier(desktop string, chats []*chat) *notifier {
+	return &notifier{desktop: desktop, chats: chats, pending: make(map[string]batchFile)}
+}
+
+func (n *notifier) record(event sorter.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	file := n.pending[event.Path]
+	file.Path, file.Name = event.Path, filepath.Base(event.Path)
+	switch event.Type {
+	case sorter.EventCategory:
+		file.Category = event.Category
+		n.pending[event.Path] = file
+		if event.Reason == "unknown-extension" {
+			n.current.Unclassified = append(n.current.Unclassified, file)
+		}
+	case sorter.EventMoved:
+		file.Dest = event.Dest
+		switch event.Reason {
+		case "sorted":
+			n.current.Sorted = append(n.current.Sorted, file)
+		case "duplicate":
+			n.current.Duplicates = append(n.current.Duplicates, file)
+		case "rule":
+			n.current.Deleted = append(n.current.Deleted, file)
+		}
+		delete(n.pending, event.Path)
+	case sorter.EventSkipped:
+		if event.Reason == "unknown-extension" {
+			n.current.Unclassified = append(n.current.Unclassified, file)
+		}
+		delete(n.pending, event.Path)
+	case sorter.EventError:
+		file.Error = event.Error
+		n.current.Failed = append(n.current.Failed, file)
+	}
+}
+
+// runFinished tells of the pass that just ended and starts recording the
+// next one
+func (n *notifier) runFinished(err error) {
+	n.mu.Lock()
+	b := n.current
+	n.current = batch{}
+	clear(n.pending)
+	n.mu.Unlock()
+
+	var partial *sorter.PartialError
+	if err != nil && !errors.Is(err, sorter.ErrAborted) && !errors.As(err, &partial) {
+		b.Err = err
+	}
+	if b.empty() {
+		return
+	}
+	if n.desktop != notifyOff {
+		n.notifyDesktop(b)
+	}
+	for _, c := range n.chats {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := c.send(ctx, b); err != nil {
+			slog.Warn("Failed to send chat notification", "type", c.kind, "err", err)
+		}
+		cancel()
+	}
+}
+
+// notifyDesktop sums up b in a desktop notification, if the level asks for it
+func (n *notifier) notifyDesktop(b batch) {
+	urgent := len(b.Failed) > 0 || b.Err != nil
+	moved := len(b.Sorted) + len(b.Duplicates) + len(b.Deleted)
+	if !urgent && (n.desktop != notifyInfo || moved == 0) {
+		return
+	}
+
+	var parts []string
+	if len(b.Sorted) > 0 {
+		parts = append(parts, count(len(b.Sorted), "file")+" sorted")
+	}
+	if len(b.Duplicates) > 0 {
+		parts = append(parts, count(len(b.Duplicates), "duplicate")+" removed")
+	}
+	if len(b.Deleted) > 0 {
+		parts = append(parts, count(len(b.Deleted), "file")+" deleted by rules")
+	}
+	if len(b.Failed) > 0 {
+		parts = append(parts, count(len(b.Failed), "file")+" failed")
+	}
+	if b.Err != nil {
+		parts = append(parts, "sorting failed: "+b.Err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := showNotification(ctx, "sorter", strings.Join(parts, ", "), urgent); err != nil {
+		slog.Warn("Failed to show desktop notification", "err", err)
+	}
+}
+
+// count formats n things, adding an s when there's more than one
+func count(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// showNotification posts to Notification Center through AppleScript. The
+// text reaches the script as arguments, so it needs no quoting.
+func showNotification(ctx context.Context, title, body string, urgent bool) error {
+	script := `on run argv
+	display notification (item 2 of argv) with title (item 1 of argv)
+end run`
+	if urgent {
+		script = `on run argv
+	display notification (item 2 of argv) with title (item 1 of argv) sound name "Basso"
+end run`
+	}
+	out, err := exec.CommandContext(ctx, "osascript", "-e", script, title, body).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("osascript: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// showNotification pops a notification through notify-send, which talks to
+// the freedesktop notification daemon of the session
+func showNotification(ctx context.Context, title, body string, urgent bool) error {
+	urgency := "normal"
+	if urgent {
+		urgency = "critical"
+	}
+	out, err := exec.CommandContext(ctx, "notify-send", "--app-name=sorter", "--urgency="+urgency, "--", title, body).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("notify-send: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
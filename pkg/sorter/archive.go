@@ -0,0 +1,112 @@
+package sorter
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// archiveEntry is a file or folder listed in an archive
+type archiveEntry struct {
+	name      string // Slash-separated path in the archive
+	size      int64  // Unpacked size
+	dir       bool
+	encrypted bool // Its content needs a password
+}
+
+// archiveListing is what an archive holds, read from its headers without
+// unpacking anything
+type archiveListing struct {
+	format  string // "zip", "rar" or "7z"
+	entries []archiveEntry
+
+	// The headers themselves are encrypted, so the entries are unknown
+	encryptedHeaders bool
+}
+
+// encrypted reports whether opening the archive takes a password
+func (l *archiveListing) encrypted() bool {
+	if l.encryptedHeaders {
+		return true
+	}
+	for _, entry := range l.entries {
+		if entry.encrypted {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveEncrypted returns the format of a zip, rar or 7z archive that takes
+// a password to open, or "" for other files. Only errors reading the file
+// are returned; archives too damaged to list aren't encrypted ones.
+func archiveEncrypted(path string) (format string, err error) {
+	listing, err := listArchive(path)
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &pathErr):
+		return "", err
+	case err != nil:
+		return "", nil
+	case listing.encrypted():
+		return listing.format, nil
+	}
+	return "", nil
+}
+
+// errNotArchive is returned by listArchive for files of other formats
+var errNotArchive = errors.New("not a zip, rar or 7z archive")
+
+// Listing an archive reads at most this much of its headers
+const archiveMaxHeader = 64 << 20
+
+// listArchive reads the entries of a zip, rar or 7z archive, recognized by
+// its content
+func listArchive(path string) (*archiveListing, error) {
+	file, err := storageAt(path).Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 8)
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return listZip(file, info.Size())
+	case bytes.HasPrefix(magic, []byte("Rar!\x1A\x07\x00")):
+		return listRar4(file)
+	case bytes.HasPrefix(magic, []byte("Rar!\x1A\x07\x01\x00")):
+		return listRar5(file)
+	case bytes.HasPrefix(magic, []byte("7z\xBC\xAF\x27\x1C")):
+		return list7z(file, info.Size())
+	}
+	return nil, errNotArchive
+}
+
+func listZip(file io.ReaderAt, size int64) (*archiveListing, error) {
+	r, err := zip.NewReader(file, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) { // Names are only listed
+		return nil, err
+	}
+	listing := &archiveListing{format: "zip"}
+	for _, f := range r.File {
+		listing.entries = append(listing.entries, archiveEntry{
+			name:      strings.TrimSuffix(f.Name, "/"),
+			size:      int64(f.UncompressedSize64),
+			dir:       strings.HasSuffix(f.Name, "/"),
+			encrypted: f.Flags&1 != 0,
+		})
+	}
+	return listing, nil
+}
@@ -0,0 +1,245 @@
+package sorter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// The 7z archives in testdata were written by bsdtar from a.txt ("hello\n"),
+// docs/b.txt, docs/zero.txt and the empty folder docs/empty; plain.7z is
+// LZMA-compressed, header included, and stored.7z keeps the data as it is.
+// Both list as:
+var testdata7z = []archiveEntry{
+	{name: "a.txt", size: 6},
+	{name: "docs/b.txt", size: 25},
+	{name: "docs/zero.txt"},
+	{name: "docs/empty", dir: true},
+	{name: "docs", dir: true},
+}
+
+func TestList7z(t *testing.T) {
+	for _, name := range []string{"plain.7z", "stored.7z"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		listing, err := list7z(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if listing.format != "7z" || listing.encryptedHeaders || !slices.Equal(listing.entries, testdata7z) {
+			t.Errorf("%s: listed %+v", name, listing)
+		}
+		// Cut short, it must fail rather than list part of it
+		if _, err := list7z(bytes.NewReader(data[:len(data)-20]), int64(len(data)-20)); err == nil {
+			t.Errorf("%s: truncated archive listed", name)
+		}
+	}
+}
+
+// testLines is the text of the .lzma files in testdata, written by Python's
+// lzma module, lines.txt.lzma with the defaults and lines-lp2.txt.lzma with
+// lc=0, lp=2, pb=0 and a 64 KiB dictionary
+func testLines() []byte {
+	var b bytes.Buffer
+	for i := range 200 {
+		fmt.Fprintf(&b, "line %d of a file that repeats itself, line %d\n", i%7, i%5)
+	}
+	return b.Bytes()
+}
+
+func TestLZMADecode(t *testing.T) {
+	want := testLines()
+	for _, name := range []string{"lines.txt.lzma", "lines-lp2.txt.lzma"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The .lzma header: the 5 property bytes 7z keeps, then the size
+		props, stream := data[:5], data[13:]
+		got, err := lzmaDecode(props, stream, len(want))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded %d bytes that differ from the text", name, len(got))
+		}
+		if _, err := lzmaDecode(props, stream[:len(stream)/2], len(want)); err == nil {
+			t.Errorf("%s: truncated stream decoded", name)
+		}
+	}
+	if _, err := lzmaDecode([]byte{225, 0, 0, 1, 0}, nil, 1); err == nil {
+		t.Error("invalid properties accepted")
+	}
+}
+
+// Helpers to put RAR archives together by hand, after the format notes
+// RARLAB publishes
+
+// rar4Block is a RAR 4 block: its CRC, type, flags and size, then body and
+// the data following the header
+func rar4Block(typ byte, flags uint16, body, data []byte) []byte {
+	head := []byte{typ}
+	head = binary.LittleEndian.AppendUint16(head, flags)
+	head = binary.LittleEndian.AppendUint16(head, uint16(7+len(body)))
+	head = append(head, body...)
+	b := binary.LittleEndian.AppendUint16(nil, uint16(crc32.ChecksumIEEE(head)))
+	return append(append(b, head...), data...)
+}
+
+// rar4File is the file header of a stored file, followed by its content
+func rar4File(name string, flags uint16, content []byte) []byte {
+	body := binary.LittleEndian.AppendUint32(nil, uint32(len(content))) // Packed size
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(content))) // Unpacked size
+	body = append(body, 2)                                              // Unix
+	body = binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE(content))
+	body = binary.LittleEndian.AppendUint32(body, 0x5A8E3100) // DOS time
+	body = append(body, 29, 0x30)                             // Version 2.9, stored
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(name)))
+	body = binary.LittleEndian.AppendUint32(body, 0o644)
+	if flags&0x0100 != 0 { // High 32 bits of the sizes
+		body = binary.LittleEndian.AppendUint32(body, 0)
+		body = binary.LittleEndian.AppendUint32(body, 1)
+	}
+	return rar4Block(0x74, 0x8000|flags, append(body, name...), content)
+}
+
+func rar4(mainFlags uint16, blocks ...[]byte) []byte {
+	b := []byte("Rar!\x1A\x07\x00")
+	b = append(b, rar4Block(0x73, mainFlags, make([]byte, 6), nil)...)
+	for _, block := range blocks {
+		b = append(b, block...)
+	}
+	return append(b, rar4Block(0x7B, 0x4000, nil, nil)...)
+}
+
+func rar5Vint(n uint64) []byte {
+	var b []byte
+	for ; n >= 0x80; n >>= 7 {
+		b = append(b, byte(n)|0x80)
+	}
+	return append(b, byte(n))
+}
+
+// rar5Header is a RAR 5 header of typ with fields, an extra area and data
+func rar5Header(typ uint64, fields, extra, data []byte) []byte {
+	var flags uint64
+	if len(extra) > 0 {
+		flags |= 0x01
+	}
+	if len(data) > 0 {
+		flags |= 0x02
+	}
+	head := append(rar5Vint(typ), rar5Vint(flags)...)
+	if len(extra) > 0 {
+		head = append(head, rar5Vint(uint64(len(extra)))...)
+	}
+	if len(data) > 0 {
+		head = append(head, rar5Vint(uint64(len(data)))...)
+	}
+	head = append(append(head, fields...), extra...)
+	head = append(rar5Vint(uint64(len(head))), head...)
+	b := binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(head))
+	return append(append(b, head...), data...)
+}
+
+// rar5File is the header of a stored file, followed by its content
+func rar5File(name string, dir bool, content, extra []byte) []byte {
+	var fileFlags uint64 = 0x02 | 0x04 // Modification time and CRC32
+	if dir {
+		fileFlags |= 0x01
+	}
+	fields := append(rar5Vint(fileFlags), rar5Vint(uint64(len(content)))...)
+	fields = append(fields, rar5Vint(0o644)...)
+	fields = binary.LittleEndian.AppendUint32(fields, 1700000000)
+	fields = binary.LittleEndian.AppendUint32(fields, crc32.ChecksumIEEE(content))
+	fields = append(fields, 0, 1) // Stored, Unix
+	fields = append(append(fields, rar5Vint(uint64(len(name)))...), name...)
+	return rar5Header(2, fields, extra, content)
+}
+
+// rar5Encryption is the extra record of an encrypted file: version, flags,
+// KDF count, salt and IV
+func rar5Encryption() []byte {
+	record := append([]byte{1, 0, 0, 15}, make([]byte, 32)...)
+	return append(rar5Vint(uint64(len(record))), record...)
+}
+
+func rar5(headers ...[]byte) []byte {
+	b := []byte("Rar!\x1A\x07\x01\x00")
+	b = append(b, rar5Header(1, []byte{0}, nil, nil)...)
+	for _, header := range headers {
+		b = append(b, header...)
+	}
+	return append(b, rar5Header(5, []byte{0}, nil, nil)...)
+}
+
+func TestListRar(t *testing.T) {
+	hello := []byte("hello\n")
+	tests := []struct {
+		name      string
+		archive   []byte
+		entries   []archiveEntry
+		encrypted bool // Headers encrypted
+	}{
+		{"rar4", rar4(0,
+			rar4File("a.txt", 0, hello),
+			rar4File("docs", 0x00E0, nil),
+			rar4File(`docs\b.txt`, 0, []byte("second")),
+		), []archiveEntry{{name: "a.txt", size: 6}, {name: "docs", dir: true}, {name: "docs/b.txt", size: 6}}, false},
+		{"rar4 unicode name and password", rar4(0,
+			rar4File("caf_.txt\x00\x01\x02", 0x0200|0x0004, hello),
+		), []archiveEntry{{name: "caf_.txt", size: 6, encrypted: true}}, false},
+		{"rar4 large file", rar4(0,
+			rar4File("big.iso", 0x0100, nil),
+		), []archiveEntry{{name: "big.iso", size: 1 << 32}}, false},
+		{"rar4 encrypted headers", rar4(0x0080), nil, true},
+		{"rar5", rar5(
+			rar5File("a.txt", false, hello, nil),
+			rar5File("docs", true, nil, nil),
+			rar5File("docs/secret.txt", false, hello, rar5Encryption()),
+		), []archiveEntry{{name: "a.txt", size: 6}, {name: "docs", dir: true}, {name: "docs/secret.txt", size: 6, encrypted: true}}, false},
+		{"rar5 encrypted headers", rar5(
+			rar5Header(4, append([]byte{0, 0, 15}, make([]byte, 16)...), nil, nil),
+			rar5File("a.txt", false, hello, nil),
+		), nil, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "test.rar")
+		if err := os.WriteFile(path, tt.archive, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		listing, err := listArchive(path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if listing.format != "rar" || listing.encryptedHeaders != tt.encrypted || !slices.Equal(listing.entries, tt.entries) {
+			t.Errorf("%s: listed %+v", tt.name, listing)
+		}
+	}
+}
+
+func TestListRarCorrupt(t *testing.T) {
+	for name, archive := range map[string][]byte{
+		"rar4 short header":   append([]byte("Rar!\x1A\x07\x00"), 0, 0, 0x74, 0, 0x80, 5, 0),
+		"rar4 name too long":  rar4(0, rar4Block(0x74, 0x8000, append(make([]byte, 19), 0xFF, 0xFF, 0, 0, 0, 0), nil)),
+		"rar5 header too big": append([]byte("Rar!\x1A\x07\x01\x00"), 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0x7F),
+		"rar5 cut in a field": rar5(rar5Header(2, []byte{0x80}, nil, nil)),
+	} {
+		path := filepath.Join(t.TempDir(), "test.rar")
+		if err := os.WriteFile(path, archive, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := listArchive(path); !errors.Is(err, errRarCorrupt) {
+			t.Errorf("%s: got %v, want %v", name, err, errRarCorrupt)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package sorter
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// accessTime returns when a file was last read
+func accessTime(info fs.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,319 @@
+package sorter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// AudioTags holds the song metadata used by audio layouts
+type AudioTags struct {
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Title       string
+	Year        string
+	Track       string
+	Genre       string
+}
+
+var errNoTags = errors.New("no audio tags")
+
+// readAudioTags reads ID3v2/ID3v1 (MP3), FLAC and Ogg Vorbis/Opus comments
+func readAudioTags(filePath string) (*AudioTags, error) {
+	file, err := storageAt(filePath).Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, errNoTags
+	}
+
+	tags := &AudioTags{}
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		err = readID3v2(file, header, tags)
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		err = readFLACComments(file, tags)
+	case bytes.HasPrefix(header, []byte("OggS")):
+		err = readOggComments(file, tags)
+	default:
+		err = errNoTags
+	}
+
+	// MP3s without (useful) ID3v2 tags may still carry ID3v1 at the end
+	if tags.Artist == "" && tags.Album == "" {
+		if v1Err := readID3v1(file, tags); v1Err == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// ID3v2 frame IDs (v2.3/v2.4 and their v2.2 equivalents)
+var id3Frames = map[string]func(*AudioTags, string){
+	"TPE1": func(t *AudioTags, v string) { t.Artist = v },
+	"TP1":  func(t *AudioTags, v string) { t.Artist = v },
+	"TPE2": func(t *AudioTags, v string) { t.AlbumArtist = v },
+	"TP2":  func(t *AudioTags, v string) { t.AlbumArtist = v },
+	"TALB": func(t *AudioTags, v string) { t.Album = v },
+	"TAL":  func(t *AudioTags, v string) { t.Album = v },
+	"TIT2": func(t *AudioTags, v string) { t.Title = v },
+	"TT2":  func(t *AudioTags, v string) { t.Title = v },
+	"TYER": func(t *AudioTags, v string) { t.Year = v },
+	"TYE":  func(t *AudioTags, v string) { t.Year = v },
+	"TDRC": func(t *AudioTags, v string) { t.Year = v },
+	"TRCK": func(t *AudioTags, v string) { t.Track = v },
+	"TRK":  func(t *AudioTags, v string) { t.Track = v },
+	"TCON": func(t *AudioTags, v string) { t.Genre = v },
+	"TCO":  func(t *AudioTags, v string) { t.Genre = v },
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+func readID3v2(file File, header []byte, tags *AudioTags) error {
+	version := header[3]
+	size := syncsafe(header[6:10])
+	if size <= 0 || size > 16<<20 {
+		return errNoTags
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return errNoTags
+	}
+
+	// Skip the extended header if there is one
+	if header[5]&0x40 != 0 && version >= 3 && len(data) >= 4 {
+		extSize := int(binary.BigEndian.Uint32(data))
+		if version == 4 {
+			extSize = syncsafe(data)
+		} else {
+			extSize += 4
+		}
+		if extSize > len(data) {
+			return errNoTags
+		}
+		data = data[extSize:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(data) >= headerLen && data[0] != 0 {
+		id := string(data[:idLen])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(data[4:8]))
+		default:
+			frameSize = syncsafe(data[4:8])
+		}
+		if frameSize <= 0 || headerLen+frameSize > len(data) {
+			break
+		}
+		if set, ok := id3Frames[id]; ok {
+			set(tags, decodeID3Text(data[headerLen:headerLen+frameSize]))
+		}
+		data = data[headerLen+frameSize:]
+	}
+	return nil
+}
+
+// decodeID3Text decodes a text frame: an encoding byte followed by the text
+func decodeID3Text(frame []byte) string {
+	if len(frame) < 2 {
+		return ""
+	}
+	text := frame[1:]
+	var s string
+	switch frame[0] {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		var order binary.ByteOrder = binary.BigEndian
+		if len(text) >= 2 && text[0] == 0xFF && text[1] == 0xFE {
+			order, text = binary.LittleEndian, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xFE && text[1] == 0xFF {
+			text = text[2:]
+		}
+		units := make([]uint16, 0, len(text)/2)
+		for i := 0; i+1 < len(text); i += 2 {
+			units = append(units, order.Uint16(text[i:]))
+		}
+		s = string(utf16.Decode(units))
+	case 3: // UTF-8
+		s = string(text)
+	default: // ISO-8859-1
+		s = latin1(text)
+	}
+	// Multiple values are NUL separated; the first one is enough
+	s, _, _ = strings.Cut(s, "\x00")
+	return strings.TrimSpace(s)
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func readID3v1(file File, tags *AudioTags) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() < 128 {
+		return errNoTags
+	}
+	tag := make([]byte, 128)
+	if _, err := file.ReadAt(tag, info.Size()-128); err != nil || !bytes.HasPrefix(tag, []byte("TAG")) {
+		return errNoTags
+	}
+	field := func(b []byte) string {
+		s, _, _ := strings.Cut(latin1(b), "\x00")
+		return strings.TrimSpace(s)
+	}
+	tags.Title = field(tag[3:33])
+	tags.Artist = field(tag[33:63])
+	tags.Album = field(tag[63:93])
+	tags.Year = field(tag[93:97])
+	return nil
+}
+
+func readFLACComments(file File, tags *AudioTags) error {
+	if _, err := file.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(file, header); err != nil {
+			return errNoTags
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		if blockType == 4 { // VORBIS_COMMENT
+			block := make([]byte, length)
+			if _, err := io.ReadFull(file, block); err != nil {
+				return errNoTags
+			}
+			return parseVorbisComments(block, tags)
+		}
+		if last {
+			return errNoTags
+		}
+		if _, err := file.Seek(length, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+// readOggComments reassembles the second packet of an Ogg stream, which
+// holds the Vorbis or Opus comment header
+func readOggComments(file File, tags *AudioTags) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var packet []byte
+	packets := 0
+	for pages := 0; pages < 64; pages++ {
+		header := make([]byte, 27)
+		if _, err := io.ReadFull(file, header); err != nil || string(header[:4]) != "OggS" {
+			return errNoTags
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(file, segments); err != nil {
+			return errNoTags
+		}
+		for _, size := range segments {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(file, data); err != nil {
+				return errNoTags
+			}
+			if packets == 1 {
+				packet = append(packet, data...)
+			}
+			if size < 255 { // A packet ends with a lacing value below 255
+				packets++
+				if packets == 2 {
+					switch {
+					case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+						return parseVorbisComments(packet[7:], tags)
+					case bytes.HasPrefix(packet, []byte("OpusTags")):
+						return parseVorbisComments(packet[8:], tags)
+					}
+					return errNoTags
+				}
+			}
+		}
+	}
+	return errNoTags
+}
+
+// parseVorbisComments parses a Vorbis comment block: vendor string, then a
+// list of KEY=value strings, all little-endian length prefixed
+func parseVorbisComments(block []byte, tags *AudioTags) error {
+	next := func() (string, bool) {
+		if len(block) < 4 {
+			return "", false
+		}
+		n := int(binary.LittleEndian.Uint32(block))
+		if n > len(block)-4 {
+			return "", false
+		}
+		s := string(block[4 : 4+n])
+		block = block[4+n:]
+		return s, true
+	}
+
+	if _, ok := next(); !ok { // Vendor
+		return errNoTags
+	}
+	if len(block) < 4 {
+		return errNoTags
+	}
+	count := int(binary.LittleEndian.Uint32(block))
+	block = block[4:]
+
+	for i := 0; i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			break
+		}
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(key) {
+		case "ARTIST":
+			tags.Artist = value
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			tags.AlbumArtist = value
+		case "ALBUM":
+			tags.Album = value
+		case "TITLE":
+			tags.Title = value
+		case "DATE", "YEAR":
+			tags.Year = value
+		case "TRACKNUMBER":
+			tags.Track = value
+		case "GENRE":
+			tags.Genre = value
+		}
+	}
+	return nil
+}
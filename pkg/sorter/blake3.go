@@ -0,0 +1,198 @@
+package sorter
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// BLAKE3 with its default 256-bit output and no key, as b3sum computes
+// it. The input is split into 1 KiB chunks, whose chaining values are
+// merged into a binary tree as chunks complete, keeping only the subtrees
+// still missing a sibling.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+// blake3Digest is a running BLAKE3 hash
+type blake3Digest struct {
+	cv       [8]uint32 // Chaining value of the chunk so far
+	chunk    uint64    // Index of the current chunk
+	block    [blake3BlockLen]byte
+	blockLen int
+	blocks   int         // Blocks of the current chunk compressed
+	stack    [][8]uint32 // Chaining values of the subtrees without a sibling yet
+}
+
+func newBLAKE3() hash.Hash {
+	d := new(blake3Digest)
+	d.Reset()
+	return d
+}
+
+func (d *blake3Digest) Reset() {
+	d.cv = blake3IV
+	d.chunk = 0
+	d.blockLen = 0
+	d.blocks = 0
+	d.stack = d.stack[:0]
+}
+
+func (d *blake3Digest) Size() int      { return 32 }
+func (d *blake3Digest) BlockSize() int { return blake3BlockLen }
+
+func (d *blake3Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full block is only compressed once more bytes follow, as the
+		// last block of a chunk is flagged
+		if d.blockLen == blake3BlockLen {
+			if d.blocks == blake3ChunkLen/blake3BlockLen-1 {
+				d.endChunk()
+			} else {
+				d.compressBlock()
+			}
+		}
+		k := copy(d.block[d.blockLen:], p)
+		d.blockLen += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (d *blake3Digest) startFlag() uint32 {
+	if d.blocks == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func (d *blake3Digest) compressBlock() {
+	out := blake3Compress(&d.cv, blake3Words(&d.block), d.chunk, blake3BlockLen, d.startFlag())
+	copy(d.cv[:], out[:8])
+	d.blocks++
+	d.blockLen = 0
+}
+
+// endChunk adds the full chunk to the tree, merging the subtrees it
+// completes, and starts the next one
+func (d *blake3Digest) endChunk() {
+	cv := d.chunkOutput().chainingValue()
+	d.chunk++
+	for total := d.chunk; total&1 == 0; total >>= 1 {
+		left := d.stack[len(d.stack)-1]
+		d.stack = d.stack[:len(d.stack)-1]
+		cv = blake3ParentOutput(&left, &cv).chainingValue()
+	}
+	d.stack = append(d.stack, cv)
+	d.cv = blake3IV
+	d.blocks = 0
+	d.blockLen = 0
+}
+
+func (d *blake3Digest) chunkOutput() blake3Output {
+	var block [blake3BlockLen]byte
+	copy(block[:], d.block[:d.blockLen])
+	return blake3Output{
+		cv:      d.cv,
+		block:   blake3Words(&block),
+		counter: d.chunk,
+		len:     uint32(d.blockLen),
+		flags:   d.startFlag() | blake3ChunkEnd,
+	}
+}
+
+func (d *blake3Digest) Sum(b []byte) []byte {
+	out := d.chunkOutput()
+	for i := len(d.stack) - 1; i >= 0; i-- {
+		cv := out.chainingValue()
+		out = blake3ParentOutput(&d.stack[i], &cv)
+	}
+	words := blake3Compress(&out.cv, out.block, out.counter, out.len, out.flags|blake3Root)
+	for _, w := range words[:8] {
+		b = binary.LittleEndian.AppendUint32(b, w)
+	}
+	return b
+}
+
+// blake3Output is a compression yet to run, which gives either a chaining
+// value or, flagged as the root, the hash
+type blake3Output struct {
+	cv      [8]uint32
+	block   [16]uint32
+	counter uint64
+	len     uint32
+	flags   uint32
+}
+
+func (o blake3Output) chainingValue() [8]uint32 {
+	out := blake3Compress(&o.cv, o.block, o.counter, o.len, o.flags)
+	return [8]uint32(out[:8])
+}
+
+func blake3ParentOutput(left, right *[8]uint32) blake3Output {
+	o := blake3Output{cv: blake3IV, len: blake3BlockLen, flags: blake3Parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+func blake3Words(block *[blake3BlockLen]byte) [16]uint32 {
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return m
+}
+
+func blake3Compress(cv *[8]uint32, m [16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	for round := range 7 {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		if round < 6 {
+			var permuted [16]uint32
+			for i, j := range blake3Permutation {
+				permuted[i] = m[j]
+			}
+			m = permuted
+		}
+	}
+	for i := range 8 {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
@@ -0,0 +1,199 @@
+package sorter
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hashFilter is a Bloom filter of the sorted files recorded by Index,
+// persisted next to the hash index. It holds two keys per file: one for
+// the file itself, by path, size and modification time, and one for its
+// size and partial hash. When every sorted file of an inbox file's size is
+// in the filter while its size and partial hash aren't, the inbox file is
+// unique without a single sorted file being read; anything else falls
+// back to hashing as usual. A false positive on a partial hash only costs
+// that fallback; one on a file, at the rate below, could let a duplicate
+// of that very file through as unique.
+type hashFilter struct {
+	algorithm string
+	k         uint32   // Bits set per key
+	bits      []uint64 // A multiple of 64 bits
+	changed   bool     // Keys added since it was loaded
+}
+
+// One false positive in a million keys, which takes 29 bits and 20 hashes
+// per key
+const (
+	filterBitsPerKey = 29
+	filterHashes     = 20
+)
+
+var filterMagic = []byte("SBF1")
+
+// newHashFilter returns a filter sized for files sorted files, with room to
+// grow as runs add theirs
+func newHashFilter(algorithm string, files int) *hashFilter {
+	words := (2*max(files, 1024)*2*filterBitsPerKey + 63) / 64
+	return &hashFilter{algorithm: algorithm, k: filterHashes, bits: make([]uint64, words)}
+}
+
+func (f *hashFilter) add(key string) {
+	n := uint64(len(f.bits)) * 64
+	h1, h2 := xxhash.Sum64String(key), xxhash.Sum64String("\x00"+key)|1
+	for i := range uint64(f.k) {
+		bit := (h1 + i*h2) % n
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.changed = true
+}
+
+func (f *hashFilter) has(key string) bool {
+	n := uint64(len(f.bits)) * 64
+	h1, h2 := xxhash.Sum64String(key), xxhash.Sum64String("\x00"+key)|1
+	for i := range uint64(f.k) {
+		bit := (h1 + i*h2) % n
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func fileFilterKey(key string, size int64, modTime time.Time) string {
+	return "file\x00" + key + "\x00" + strconv.FormatInt(size, 10) + "\x00" + strconv.FormatInt(modTime.UnixNano(), 10)
+}
+
+func hashFilterKey(size int64, partial string) string {
+	return "hash\x00" + strconv.FormatInt(size, 10) + "\x00" + partial
+}
+
+// addFile records a sorted file, keyed as in the hash index
+func (f *hashFilter) addFile(key string, size int64, modTime time.Time, partial string) {
+	f.add(hashFilterKey(size, partial))
+	f.add(fileFilterKey(key, size, modTime))
+}
+
+// filterFile is where the filter of Options.IndexFile is kept
+func (s *Sorter) filterFile() string {
+	return s.opts.IndexFile + ".bloom"
+}
+
+// loadHashFilter reads the filter written by the last Index, returning nil
+// when there's none or it was built with another hash algorithm
+func (s *Sorter) loadHashFilter() *hashFilter {
+	if s.opts.IndexFile == "" {
+		return nil
+	}
+	data, err := readFile(s.filterFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log.Warn("Failed to read hash filter, hashing as usual", "path", s.filterFile(), "err", err)
+		}
+		return nil
+	}
+	f, err := parseHashFilter(data)
+	if err != nil {
+		s.log.Warn("Invalid hash filter, hashing as usual", "path", s.filterFile(), "err", err)
+		return nil
+	}
+	if f.algorithm != s.opts.HashAlgorithm {
+		return nil
+	}
+	return f
+}
+
+var errBadFilter = errors.New("not a hash filter")
+
+func parseHashFilter(data []byte) (*hashFilter, error) {
+	if len(data) < len(filterMagic)+1 || string(data[:len(filterMagic)]) != string(filterMagic) {
+		return nil, errBadFilter
+	}
+	data = data[len(filterMagic):]
+	n := int(data[0])
+	if len(data) < 1+n+4 {
+		return nil, errBadFilter
+	}
+	f := &hashFilter{algorithm: string(data[1 : 1+n]), k: binary.LittleEndian.Uint32(data[1+n:])}
+	data = data[1+n+4:]
+	if len(data) == 0 || len(data)%8 != 0 || f.k == 0 || f.k > 64 {
+		return nil, errBadFilter
+	}
+	f.bits = make([]uint64, len(data)/8)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	return f, nil
+}
+
+// saveHashFilter writes the filter next to the hash index, as a header
+// followed by the bits in little-endian words
+func (s *Sorter) saveHashFilter(f *hashFilter) error {
+	if s.opts.DryRun {
+		return nil
+	}
+	data := make([]byte, 0, len(filterMagic)+1+len(f.algorithm)+4+8*len(f.bits))
+	data = append(data, filterMagic...)
+	data = append(data, byte(len(f.algorithm)))
+	data = append(data, f.algorithm...)
+	data = binary.LittleEndian.AppendUint32(data, f.k)
+	for _, word := range f.bits {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	if err := writeFile(s.filterFile(), data); err != nil {
+		return fmt.Errorf("saving hash filter: %w", err)
+	}
+	f.changed = false
+	return nil
+}
+
+// buildHashFilter returns a filter of every file of the hash index
+func (s *Sorter) buildHashFilter(ix *hashIndex) *hashFilter {
+	f := newHashFilter(ix.Algorithm, len(ix.Files))
+	for key, entry := range ix.Files {
+		f.addFile(key, entry.Size, entry.ModTime, cmp.Or(entry.Partial, entry.Hash))
+	}
+	return f
+}
+
+// sortedFilter is the filter as the duplicate index of a run uses it
+type sortedFilter struct {
+	*hashFilter
+	s *Sorter
+}
+
+// rulesOut reports whether none of the files of sameSize found in the
+// sorted directory can hold f's contents, f's partial hash being known.
+// Files of the run are left to the caller.
+func (sf *sortedFilter) rulesOut(f *indexedFile, sameSize []*indexedFile) bool {
+	if f.partial == "" || sf.has(hashFilterKey(f.size, f.partial)) {
+		return false
+	}
+	for _, other := range sameSize {
+		if !other.inRun && !sf.has(fileFilterKey(sf.s.indexKey(other.path), other.size, other.modTime)) {
+			return false
+		}
+	}
+	return true
+}
+
+// record adds a file just sorted into the sorted directory, so later runs
+// can rule it out too. Its partial hash is computed if need be; on failure
+// the file is simply left out.
+func (sf *sortedFilter) record(ix *dupIndex, f *indexedFile) {
+	partial, err := f.partialHash(ix)
+	if err != nil {
+		return
+	}
+	info, err := storageAt(f.movedTo).Stat(f.movedTo)
+	if err != nil {
+		return
+	}
+	sf.addFile(sf.s.indexKey(f.movedTo), info.Size(), info.ModTime(), partial)
+}
@@ -0,0 +1,309 @@
+package sorter
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config builds the Options of a front end such as the sorter command out
+// of its settings, which come in layers: the defaults of DefaultConfig,
+// the command line over them, then a config file filling in what the
+// command line left out (see Fill). Settings are kept as users write them:
+// directories may be left to default to folders of Base, "none" turns a
+// category off and lists are comma-separated. Config files embed it, hence
+// the JSON keys; the settings without one are only given on the command
+// line.
+type Config struct {
+	Base      string        `json:"base,omitempty"` // Holds the directories not given, and the run state
+	Inbox     string        `json:"inbox,omitempty"`
+	Sorted    string        `json:"sorted,omitempty"`
+	Delete    string        `json:"delete,omitempty"`
+	Extracted string        `json:"extracted,omitempty"` // Where extracted archives go
+	Inboxes   []InboxConfig `json:"inboxes,omitempty"`   // Sorted along with Inbox
+
+	ClassifierCommand []string `json:"classifier_command,omitempty"` // External classifier, see PluginRequest
+	ClassifierHead    Size     `json:"classifier_head,omitempty"`    // Bytes of each file it gets
+	ClassifierModules []string `json:"classifier_modules,omitempty"` // WebAssembly classifiers, asked first
+
+	Clamd           string `json:"clamd,omitempty"`            // clamd socket path or host:port, to scan inbox files
+	MalwareCategory string `json:"malware_category,omitempty"` // Where files clamd finds malware in go
+
+	Quarantine *QuarantinePolicy `json:"quarantine,omitempty"` // Holds back risky inbox files
+
+	EncryptedCategory string `json:"encrypted_category,omitempty"` // "leave" keeps encrypted archives in the inbox
+
+	Units           *UnitPolicy `json:"units,omitempty"`            // Inbox folders moved whole
+	ProjectCategory string      `json:"project_category,omitempty"` // "leave" keeps project folders in the inbox, "none" sorts their files
+
+	Sidecars string `json:"sidecars,omitempty"`  // Extensions moved with the file of the same name; "none" sorts them on their own
+	RawPairs bool   `json:"raw_pairs,omitempty"` // Keep the JPEGs of RAW files with them
+
+	ExtractArchives bool `json:"extract_archives,omitempty"` // Unpack inbox archives and sort their files
+
+	MismatchCategory    string   `json:"mismatch_category,omitempty"` // "none" disables mismatch detection
+	CorruptCategory     string   `json:"corrupt_category,omitempty"`  // "none" disables the integrity check
+	UnknownCategory     string   `json:"unknown_category,omitempty"`  // "leave" keeps such files in the inbox
+	NoExtensionCategory string   `json:"no_extension_category,omitempty"`
+	NameTemplate        string   `json:"name_template,omitempty"`
+	DeleteTemplate      string   `json:"delete_template,omitempty"`
+	Collision           string   `json:"collision,omitempty"`     // Collision policy
+	Replacement         string   `json:"replacement,omitempty"`   // For characters invalid in file names
+	Normalization       string   `json:"normalization,omitempty"` // Unicode form of sorted names
+	HashAlgorithm       string   `json:"hash_algorithm,omitempty"`
+	Preserve            string   `json:"preserve,omitempty"` // Metadata kept by cross-device copies
+	MinSize             Size     `json:"min_size,omitempty"` // Inbox files outside the limits stay there
+	MaxSize             Size     `json:"max_size,omitempty"`
+	MinAge              Duration `json:"min_age,omitempty"`     // Recently modified inbox files stay there
+	StableWait          Duration `json:"stable_wait,omitempty"` // As do files still changing
+	BandwidthLimit      Size     `json:"bwlimit,omitempty"`     // Throttles for scheduled runs
+	FilesPerSec         float64  `json:"files_per_sec,omitempty"`
+	TrustHashes         bool     `json:"trust_hashes,omitempty"` // Skip the byte comparison of duplicates
+	Trash               bool     `json:"trash,omitempty"`        // Duplicates go to the OS trash
+	Retention           Duration `json:"retention,omitempty"`    // Automatic purge of the delete directory
+	SecureWipe          bool     `json:"secure_wipe,omitempty"`  // Overwrite purged files
+	SSHCommand          string   `json:"ssh_command,omitempty"`  // For sftp:// directories
+	S3Endpoint          string   `json:"s3_endpoint,omitempty"`  // For s3:// directories
+	Schedule            string   `json:"schedule,omitempty"`     // Crontab times watch mode sorts at
+	Jitter              Duration `json:"jitter,omitempty"`
+	OTLPEndpoint        string   `json:"otlp_endpoint,omitempty"` // Collector of run traces (default $OTEL_EXPORTER_OTLP_ENDPOINT)
+	TraceSample         int      `json:"trace_sample,omitempty"`  // One file in this many traced
+
+	// Only given on the command line
+	DryRun        bool          `json:"-"`
+	SniffContent  bool          `json:"-"`
+	Workers       int           `json:"-"`
+	WatchDebounce time.Duration `json:"-"`
+	WatchRescan   time.Duration `json:"-"`
+
+	Profile string `json:"-"` // Profile of the config file in use, whose run state is kept apart
+	Dir     string `json:"-"` // Directory relative paths are taken from, the config file's
+}
+
+// InboxConfig is a further inbox. Its exclusion files replace the top-level
+// ones when set.
+type InboxConfig struct {
+	Dir            string `json:"dir"`
+	DirExclusions  string `json:"dir_exclusions,omitempty"`
+	FileExclusions string `json:"file_exclusions,omitempty"`
+}
+
+// DefaultConfig returns the settings a front end starts from, with base as
+// the base directory
+func DefaultConfig(base string) Config {
+	return Config{
+		Base:             base,
+		MismatchCategory: "Quarantine/Mismatched",
+		CorruptCategory:  DefaultCorruptCategory,
+		Sidecars:         strings.Join(DefaultSidecars, ","),
+		ProjectCategory:  DefaultProjectCategory,
+		UnknownCategory:  DefaultUnknownCategory,
+		NameTemplate:     DefaultNameTemplate,
+		DeleteTemplate:   DefaultDeleteTemplate,
+		Collision:        CollisionSuffixHash,
+		Replacement:      DefaultReplacement,
+		Normalization:    NormalizeNFC,
+		HashAlgorithm:    DefaultHashAlgorithm,
+		Preserve:         DefaultPreserve,
+		TraceSample:      100,
+		SniffContent:     true,
+		Workers:          runtime.NumCPU(),
+		WatchDebounce:    2 * time.Second,
+		WatchRescan:      10 * time.Minute,
+	}
+}
+
+// Fill takes the settings of file, a config file's, that the command line
+// didn't give, given telling by their JSON key which it did. Those file
+// leaves unset keep their value, and relative paths in file are taken from
+// file.Dir.
+func (c *Config) Fill(file Config, given func(key string) bool) {
+	file.resolvePaths()
+	dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(file)
+	for i := range src.NumField() {
+		key, _, _ := strings.Cut(src.Type().Field(i).Tag.Get("json"), ",")
+		if key == "" || key == "-" || given(key) || src.Field(i).IsZero() {
+			continue
+		}
+		dst.Field(i).Set(src.Field(i))
+	}
+}
+
+// Resolve makes a path from the config file absolute relative to its
+// directory. Remote URLs are kept as they are.
+func (c *Config) Resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) || strings.Contains(path, "://") {
+		return path
+	}
+	return filepath.Join(c.Dir, path)
+}
+
+// resolvePaths resolves the paths of the settings
+func (c *Config) resolvePaths() {
+	for _, path := range []*string{&c.Base, &c.Inbox, &c.Sorted, &c.Delete, &c.Extracted} {
+		*path = c.Resolve(*path)
+	}
+	c.Inboxes = slices.Clone(c.Inboxes)
+	for i, inbox := range c.Inboxes {
+		c.Inboxes[i] = InboxConfig{c.Resolve(inbox.Dir), c.Resolve(inbox.DirExclusions), c.Resolve(inbox.FileExclusions)}
+	}
+	c.ClassifierModules = slices.Clone(c.ClassifierModules)
+	for i, module := range c.ClassifierModules {
+		c.ClassifierModules[i] = c.Resolve(module)
+	}
+}
+
+// InboxDir returns the directory Options has sorted first
+func (c *Config) InboxDir() string { return c.dir(c.Inbox, "inbox") }
+
+// dir returns path when set, otherwise the named folder of Base
+func (c *Config) dir(path, name string) string {
+	if path == "" {
+		return filepath.Join(c.Base, name)
+	}
+	return cleanDir(path)
+}
+
+// cleanDir cleans a local directory path; remote URLs such as sftp://nas/srv
+// are left to mountDir
+func cleanDir(dir string) string {
+	if dir == "" || strings.Contains(dir, "://") {
+		return dir
+	}
+	return filepath.Clean(dir)
+}
+
+// Options builds the Options the settings describe, with settings read from
+// the category, exclusion and rules files. It loads the exclusion files of
+// the further inboxes and the classifier modules. The run state, journals,
+// lock and index among it, goes in the .sorter folder of Base, in a folder
+// of its own for a profile.
+func (c *Config) Options(settings Settings) (Options, error) {
+	if c.TraceSample < 0 {
+		return Options{}, &ConfigError{errors.New("trace sample must not be negative")}
+	}
+	state := filepath.Join(c.Base, ".sorter")
+	if c.Profile != "" {
+		state = filepath.Join(state, "profiles", c.Profile)
+	}
+	// "none" turns a check off, which Options spells as no category
+	none := func(value string) string {
+		if value == "none" {
+			return ""
+		}
+		return value
+	}
+	opts := Options{
+		InboxDir:            c.InboxDir(),
+		SortedDir:           c.dir(c.Sorted, "sorted"),
+		DeleteDir:           c.dir(c.Delete, "delete"),
+		JournalDir:          filepath.Join(state, "journal"),
+		CheckpointFile:      filepath.Join(state, "checkpoint.json"),
+		LockFile:            filepath.Join(state, "lock"),
+		IndexFile:           filepath.Join(state, "index.json"),
+		UnknownFile:         filepath.Join(state, "unknown.json"),
+		Categories:          settings.Categories,
+		ExcludeDirs:         settings.ExcludeDirs,
+		ExcludeFiles:        settings.ExcludeFiles,
+		MinSize:             c.MinSize,
+		MaxSize:             c.MaxSize,
+		MinAge:              time.Duration(c.MinAge),
+		StableWait:          time.Duration(c.StableWait),
+		BandwidthLimit:      c.BandwidthLimit,
+		FilesPerSecond:      c.FilesPerSec,
+		SSHCommand:          strings.Fields(c.SSHCommand),
+		S3Endpoint:          c.S3Endpoint,
+		Rules:               settings.Rules,
+		Script:              settings.Script,
+		Workers:             c.Workers,
+		DryRun:              c.DryRun,
+		SniffContent:        c.SniffContent,
+		MismatchCategory:    none(c.MismatchCategory),
+		CorruptCategory:     none(c.CorruptCategory),
+		EncryptedCategory:   c.EncryptedCategory,
+		Sidecars:            strings.FieldsFunc(none(c.Sidecars), func(r rune) bool { return r == ',' }),
+		RawPairs:            c.RawPairs,
+		ProjectCategory:     none(c.ProjectCategory),
+		ClamdAddress:        c.Clamd,
+		MalwareCategory:     c.MalwareCategory,
+		ClassifierCommand:   slices.Clone(c.ClassifierCommand),
+		ClassifierHead:      int(c.ClassifierHead),
+		UnknownCategory:     c.UnknownCategory,
+		NoExtensionCategory: c.NoExtensionCategory,
+		NameTemplate:        c.NameTemplate,
+		DeleteTemplate:      c.DeleteTemplate,
+		CollisionPolicy:     c.Collision,
+		Replacement:         c.Replacement,
+		Normalization:       c.Normalization,
+		HashAlgorithm:       c.HashAlgorithm,
+		TrustHashes:         c.TrustHashes,
+		Preserve:            c.Preserve,
+		Trash:               c.Trash,
+		ExtractArchives:     c.ExtractArchives,
+		StagingDir:          filepath.Join(state, "staging"),
+		ExtractedDir:        c.dir(c.Extracted, "extracted"),
+		Retention:           time.Duration(c.Retention),
+		SecureWipe:          c.SecureWipe,
+		WatchDebounce:       c.WatchDebounce,
+		WatchRescan:         c.WatchRescan,
+		ScheduleJitter:      time.Duration(c.Jitter),
+	}
+	for _, config := range c.Inboxes {
+		inbox := Inbox{Dir: cleanDir(config.Dir)}
+		var err error
+		if config.DirExclusions != "" {
+			if inbox.ExcludeDirs, err = LoadExclusions(config.DirExclusions); err != nil {
+				return Options{}, fmt.Errorf("failed to load exclusion config: %w", err)
+			}
+		}
+		if config.FileExclusions != "" {
+			if inbox.ExcludeFiles, err = LoadExclusions(config.FileExclusions); err != nil {
+				return Options{}, fmt.Errorf("failed to load exclusion config: %w", err)
+			}
+		}
+		opts.Inboxes = append(opts.Inboxes, inbox)
+	}
+	for _, path := range c.ClassifierModules {
+		module, err := LoadClassifierModule(path)
+		if err != nil {
+			return Options{}, fmt.Errorf("failed to load classifier module: %w", err)
+		}
+		opts.ClassifierModules = append(opts.ClassifierModules, module)
+	}
+	if q := c.Quarantine; q != nil {
+		opts.Quarantine = &QuarantinePolicy{
+			Category:          q.Category,
+			Executables:       q.Executables,
+			DoubleExtensions:  q.DoubleExtensions,
+			EncryptedArchives: q.EncryptedArchives,
+			Extensions:        slices.Clone(q.Extensions),
+		}
+	}
+	if u := c.Units; u != nil {
+		opts.Units = &UnitPolicy{
+			Category: u.Category,
+			TopLevel: u.TopLevel,
+			Patterns: slices.Clone(u.Patterns),
+			Markers:  slices.Clone(u.Markers),
+		}
+	}
+	if c.Schedule != "" {
+		schedule, err := ParseSchedule(c.Schedule)
+		if err != nil {
+			return Options{}, &ConfigError{err}
+		}
+		opts.Schedule = schedule
+	}
+	if endpoint := cmp.Or(c.OTLPEndpoint, os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")); endpoint != "" {
+		opts.Tracer = NewTracer(endpoint)
+		opts.Tracer.SampleEvery = c.TraceSample
+	}
+	return opts, nil
+}
@@ -0,0 +1,72 @@
+package sorter
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestConfigOptions(t *testing.T) {
+	base := filepath.FromSlash("/srv/sort")
+	dir := filepath.FromSlash("/etc/sorter")
+	tests := []struct {
+		name  string
+		flags func(*Config) // Settings given on the command line
+		file  Config
+		check func(Options) bool
+	}{
+		{"defaults", nil, Config{},
+			func(o Options) bool {
+				return o.InboxDir == filepath.Join(base, "inbox") && o.SortedDir == filepath.Join(base, "sorted") &&
+					o.LockFile == filepath.Join(base, ".sorter", "lock") && o.MismatchCategory == "Quarantine/Mismatched"
+			}},
+		{"file paths taken from its directory", nil, Config{Base: "data", Sorted: "/mnt/sorted", Inbox: "sftp://nas/in", Dir: dir},
+			func(o Options) bool {
+				return o.DeleteDir == filepath.Join(dir, "data", "delete") && o.SortedDir == filepath.FromSlash("/mnt/sorted") &&
+					o.InboxDir == "sftp://nas/in"
+			}},
+		{"flags win", func(c *Config) { c.Sorted, c.HashAlgorithm = "out", "sha256" }, Config{Sorted: "file", HashAlgorithm: "xxh3", Collision: "skip"},
+			func(o Options) bool {
+				return o.SortedDir == "out" && o.HashAlgorithm == "sha256" && o.CollisionPolicy == "skip"
+			}},
+		{"none turns checks off", nil, Config{MismatchCategory: "none", Sidecars: "none", ProjectCategory: "none"},
+			func(o Options) bool {
+				return o.MismatchCategory == "" && len(o.Sidecars) == 0 && o.ProjectCategory == ""
+			}},
+		{"sidecar list", func(c *Config) { c.Sidecars = "xmp,,srt" }, Config{},
+			func(o Options) bool { return slices.Equal(o.Sidecars, []string{"xmp", "srt"}) }},
+		{"profile state", func(c *Config) { c.Profile = "photos" }, Config{},
+			func(o Options) bool {
+				return o.JournalDir == filepath.Join(base, ".sorter", "profiles", "photos", "journal")
+			}},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig(base)
+		given := map[string]bool{}
+		if tt.flags != nil {
+			before := c
+			tt.flags(&c)
+			given["sorted"] = c.Sorted != before.Sorted
+			given["hash_algorithm"] = c.HashAlgorithm != before.HashAlgorithm
+		}
+		c.Fill(tt.file, func(key string) bool { return given[key] })
+		opts, err := c.Options(Settings{})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(opts) {
+			t.Errorf("%s: unexpected options %+v", tt.name, opts)
+		}
+	}
+}
+
+func TestConfigOptionsErrors(t *testing.T) {
+	for _, c := range []Config{{TraceSample: -1}, {Schedule: "every day"}} {
+		if _, err := c.Options(Settings{}); err == nil {
+			t.Errorf("Options of %+v succeeded", c)
+		} else if _, ok := err.(*ConfigError); !ok {
+			t.Errorf("Options of %+v: %v is not a ConfigError", c, err)
+		}
+	}
+}
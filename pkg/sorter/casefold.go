@@ -0,0 +1,56 @@
+package sorter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// caseInsensitive reports whether the filesystem holding dir ignores case in
+// names, as APFS and NTFS do by default. The nearest existing folder whose
+// name has letters is looked up with its case swapped; nothing is written.
+// Remote storages can't tell whether two names are the same file, so they
+// are taken as case-sensitive.
+func caseInsensitive(dir string) bool {
+	if isRemote(dir) {
+		return false
+	}
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		name := filepath.Base(dir)
+		swapped := strings.Map(swapCase, name)
+		info, err := os.Lstat(dir)
+		if err != nil || swapped == name {
+			dir = parent
+			continue
+		}
+		other, err := os.Lstat(filepath.Join(parent, swapped))
+		return err == nil && os.SameFile(info, other)
+	}
+}
+
+func swapCase(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
+
+// samePath reports whether a and b name the same path, ignoring case where
+// the sorted directory's filesystem does
+func (s *Sorter) samePath(a, b string) bool {
+	return a == b || s.foldCase() && strings.EqualFold(a, b)
+}
+
+// pathKey identifies a path in the dry-run bookkeeping, so planned moves to
+// names differing only in case collide like they would on disk
+func (s *Sorter) pathKey(path string) string {
+	if s.foldCase() {
+		return strings.ToLower(path)
+	}
+	return path
+}
@@ -0,0 +1,156 @@
+package sorter
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// checkpoint records how far an interrupted pass got: the inbox files it
+// already decided on and every hash it computed
+type checkpoint struct {
+	Sort      bool             `json:"sort"`                // Written by Sort rather than Dedupe
+	Algorithm string           `json:"algorithm,omitempty"` // Of the hashes, xxh64 when empty
+	Processed []string         `json:"processed"`
+	Hashes    []checkpointHash `json:"hashes"`
+}
+
+// checkpointHash is only reused while the file's size and mtime are unchanged
+type checkpointHash struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Partial string    `json:"partial"`
+	Full    string    `json:"full,omitempty"`
+}
+
+// stopped reports whether Options.Stop has been closed or Options.Context
+// is done
+func (s *Sorter) stopped() bool {
+	select {
+	case <-s.opts.Stop:
+		return true
+	case <-s.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// aborted is the error of a pass that stopped: ErrAborted, along with the
+// context's error when that is why
+func (s *Sorter) aborted() error {
+	return abortErr(s.ctx)
+}
+
+func abortErr(ctx context.Context) error {
+	if err := context.Cause(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrAborted, err)
+	}
+	return ErrAborted
+}
+
+// loadCheckpoint returns the checkpoint left by an interrupted pass of the
+// same command, or nil
+func (s *Sorter) loadCheckpoint(sortUnique bool) *checkpoint {
+	if s.opts.CheckpointFile == "" || s.opts.DryRun {
+		return nil
+	}
+	data, err := readFile(s.opts.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		s.log.Warn("Ignoring unreadable checkpoint", "path", s.opts.CheckpointFile, "err", err)
+		return nil
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		s.log.Warn("Ignoring invalid checkpoint", "path", s.opts.CheckpointFile, "err", err)
+		return nil
+	}
+	if cp.Sort != sortUnique {
+		s.log.Info("Ignoring checkpoint left by another command", "path", s.opts.CheckpointFile)
+		return nil
+	}
+	if cmp.Or(cp.Algorithm, DefaultHashAlgorithm) != s.opts.HashAlgorithm {
+		s.log.Info("Hash algorithm changed, hashing again", "checkpoint", cp.Algorithm, "algorithm", s.opts.HashAlgorithm)
+		cp.Hashes = nil
+	}
+	return &cp
+}
+
+// interrupt ends a pass stopped before candidates[next], saving a checkpoint
+func (s *Sorter) interrupt(sortUnique bool, previous *checkpoint, index *dupIndex, candidates []*indexedFile, next int) error {
+	s.log.Info("Stopping after the file in progress", "processed", next, "remaining", len(candidates)-next)
+	if s.opts.CheckpointFile == "" || s.opts.DryRun {
+		return s.aborted()
+	}
+
+	cp := &checkpoint{Sort: sortUnique, Algorithm: s.opts.HashAlgorithm}
+	if previous != nil {
+		cp.Processed = previous.Processed
+	}
+	for _, file := range candidates[:next] {
+		cp.Processed = append(cp.Processed, file.path)
+	}
+	seen := make(map[string]bool)
+	for _, file := range append(index.files(), candidates...) {
+		if file.partial == "" || seen[file.path] {
+			continue
+		}
+		seen[file.path] = true
+		cp.Hashes = append(cp.Hashes, checkpointHash{
+			Path:    file.path,
+			Size:    file.size,
+			ModTime: file.modTime,
+			Partial: file.partial,
+			Full:    file.full,
+		})
+	}
+
+	if err := s.saveCheckpoint(cp); err != nil {
+		s.log.Error("Failed to write checkpoint", "path", s.opts.CheckpointFile, "err", err)
+	} else {
+		s.log.Info("Checkpoint written", "path", s.opts.CheckpointFile, "processed", len(cp.Processed), "hashes", len(cp.Hashes))
+	}
+	return s.aborted()
+}
+
+// saveCheckpoint writes the checkpoint through a temporary file so a crash
+// never leaves half of one behind
+func (s *Sorter) saveCheckpoint(cp *checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.opts.CheckpointFile, data)
+}
+
+// clearCheckpoint removes the checkpoint once a pass has completed
+func (s *Sorter) clearCheckpoint() {
+	if s.opts.CheckpointFile == "" || s.opts.DryRun {
+		return
+	}
+	if err := storageAt(s.opts.CheckpointFile).Remove(s.opts.CheckpointFile); err != nil && !os.IsNotExist(err) {
+		s.log.Warn("Failed to remove checkpoint", "path", s.opts.CheckpointFile, "err", err)
+	}
+}
+
+// restoreHashes fills in the hashes of files unchanged since the checkpoint
+func (cp *checkpoint) restoreHashes(files []*indexedFile) {
+	known := make(map[string]checkpointHash, len(cp.Hashes))
+	for _, h := range cp.Hashes {
+		known[h.Path] = h
+	}
+	for _, file := range files {
+		h, ok := known[file.path]
+		if ok && h.Size == file.size && h.ModTime.Equal(file.modTime) {
+			file.partial = h.Partial
+			file.full = h.Full
+		}
+	}
+}
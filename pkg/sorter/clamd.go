@@ -0,0 +1,138 @@
+package sorter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultMalwareCategory receives the files clamd finds malware in
+const DefaultMalwareCategory = "Quarantine/Malware"
+
+// How long clamd may take to connect, and to scan a file
+const (
+	clamdDialTimeout = 10 * time.Second
+	clamdTimeout     = 5 * time.Minute
+)
+
+// clamd scans files with the ClamAV daemon, sending their content with
+// the INSTREAM command so the daemon needs no access to the inbox
+type clamd struct {
+	network, address string
+}
+
+// newClamd parses the address of clamd: a Unix socket, as a path or
+// unix:path, or a TCP host:port, optionally as tcp://host:port
+func newClamd(addr string) (*clamd, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return &clamd{"unix", strings.TrimPrefix(addr, "unix://")}, nil
+	case strings.HasPrefix(addr, "unix:"):
+		return &clamd{"unix", strings.TrimPrefix(addr, "unix:")}, nil
+	case strings.HasPrefix(addr, "/"):
+		return &clamd{"unix", addr}, nil
+	}
+	addr = strings.TrimPrefix(addr, "tcp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: want a socket path or host:port", addr)
+	}
+	return &clamd{"tcp", addr}, nil
+}
+
+// scan sends the content of a file to clamd, returning the name of the
+// malware found in it, or "" when it is clean
+func (c *clamd) scan(ctx context.Context, path string) (string, error) {
+	dialer := net.Dialer{Timeout: clamdDialTimeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	file, err := storageAt(path).Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// clamd stops reading a stream over its StreamMaxLength, answering with
+	// an error, so a failed write still leaves an answer to read
+	sendErr := c.send(conn, file)
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if sendErr != nil {
+			return "", sendErr
+		}
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	return parseClamdReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// send streams a file in chunks, each after its length, ending with an
+// empty one
+func (c *clamd) send(conn net.Conn, file io.Reader) error {
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	buf := make([]byte, 4+64<<10)
+	for {
+		n, err := file.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("clamd: %w", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write(make([]byte, 4)); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	return nil
+}
+
+// parseClamdReply reads the answer to INSTREAM: "stream: OK",
+// "stream: <name> FOUND" or "<message> ERROR"
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", errors.New("clamd: " + strings.TrimSuffix(reply, " ERROR"))
+	}
+	return "", fmt.Errorf("clamd: unexpected answer %q", reply)
+}
+
+// scanFile has clamd scan an inbox file, reporting the result, and returns
+// the name of the malware found in it, or ""
+func (s *Sorter) scanFile(path string) (string, error) {
+	malware, err := s.clamd.scan(s.ctx, path)
+	if err != nil {
+		return "", err
+	}
+	result := "clean"
+	if malware != "" {
+		result = malware
+	}
+	s.emit(Event{Type: EventScanned, Path: path, Reason: result})
+	return malware, nil
+}
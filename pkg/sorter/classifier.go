@@ -0,0 +1,349 @@
+package sorter
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// DefaultUnknownCategory is where files whose extension is missing or not
+// configured go, {EXT} standing for the upper-case extension (NO_EXTENSION
+// when there is none)
+const DefaultUnknownCategory = "Misc/{EXT}"
+
+// LeaveInInbox as a fallback category leaves files in the inbox
+const LeaveInInbox = "leave"
+
+// Classifier maps files to category paths (relative to the sorted
+// directory) based on their name patterns and extension, or on their
+// content when the extension is missing or unknown
+type Classifier struct {
+	namePatterns []namePattern
+	extensionMap map[string]string
+	compoundExts []string          // Extensions with several parts, such as tar.gz, longest first
+	aliases      map[string]string // Extension to the one it stands for
+	unknown      string            // Fallback category of unknown extensions, see Options.UnknownCategory
+	noExtension  string            // Fallback category of files without one
+	layouts      map[string]string // Category path to destination layout
+	videoRules   map[string][]VideoRule
+	byContent    map[string]string // Category path to the subfolder its archives go in, see CategoryGroup.ByContent
+	sniff        bool
+}
+
+// namePattern is a glob or regex that sends matching file names to a category
+type namePattern struct {
+	category string
+	glob     string // Lower case
+	regex    *regexp.Regexp
+}
+
+func (p namePattern) match(name string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(name)
+	}
+	matched, _ := filepath.Match(p.glob, strings.ToLower(name))
+	return matched
+}
+
+// NewClassifier builds a classifier from a category configuration. With
+// sniff set, files whose extension isn't in the config are classified by
+// their detected content type instead.
+func NewClassifier(config CategoryConfig, sniff bool) (*Classifier, error) {
+	c := &Classifier{
+		extensionMap: make(map[string]string),
+		aliases:      make(map[string]string),
+		unknown:      DefaultUnknownCategory,
+		noExtension:  DefaultUnknownCategory,
+		layouts:      make(map[string]string),
+		videoRules:   make(map[string][]VideoRule),
+		byContent:    make(map[string]string),
+		sniff:        sniff,
+	}
+	for mainCategory, group := range config {
+		if err := c.processCategoryGroup(mainCategory, group, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// When several patterns match, the most specific (deepest) category
+	// wins; ties go by category path so the outcome doesn't depend on map order
+	depth := func(category string) int { return strings.Count(category, string(filepath.Separator)) }
+	sort.SliceStable(c.namePatterns, func(i, j int) bool {
+		a, b := c.namePatterns[i].category, c.namePatterns[j].category
+		if depth(a) != depth(b) {
+			return depth(a) > depth(b)
+		}
+		return a < b
+	})
+	for category, rules := range c.videoRules {
+		for _, rule := range rules {
+			// Rule targets that aren't configured subcategories use the
+			// layout of the category holding the rule
+			target := filepath.Join(category, filepath.FromSlash(rule.Category))
+			if _, ok := c.layouts[target]; !ok && c.layouts[category] != "" {
+				c.layouts[target] = c.layouts[category]
+			}
+		}
+	}
+
+	for alias, ext := range c.aliases {
+		if _, ok := c.aliases[ext]; ok {
+			return nil, fmt.Errorf("extension alias %q stands for %q, which is an alias itself", alias, ext)
+		}
+		if category, ok := c.extensionMap[alias]; ok {
+			return nil, fmt.Errorf("extension %q is listed in %s and is an alias of %q", alias, category, ext)
+		}
+	}
+	sort.SliceStable(c.compoundExts, func(i, j int) bool { return len(c.compoundExts[i]) > len(c.compoundExts[j]) })
+
+	// Add special case for macOS attribute files
+	c.extensionMap["_"] = "System/Attribute_Files" // For ._ prefix files
+	return c, nil
+}
+
+func (c *Classifier) processCategoryGroup(currentPath string, group CategoryGroup, parentLayout string) error {
+	// Process current level extensions
+	for _, ext := range group.Extensions {
+		ext = normalizeExt(ext)
+		c.addCompound(ext)
+		c.extensionMap[ext] = currentPath
+	}
+	for alias, ext := range group.Aliases {
+		alias, ext = normalizeExt(alias), normalizeExt(ext)
+		if other, ok := c.aliases[alias]; ok && other != ext {
+			return fmt.Errorf("category %s: extension alias %q stands for both %q and %q", currentPath, alias, other, ext)
+		}
+		c.addCompound(alias)
+		c.aliases[alias] = ext
+	}
+
+	// Process current level name patterns
+	for _, glob := range group.Globs {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("category %s: invalid glob %q: %w", currentPath, glob, err)
+		}
+		c.namePatterns = append(c.namePatterns, namePattern{category: currentPath, glob: strings.ToLower(glob)})
+	}
+	for _, expr := range group.Regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("category %s: invalid regex: %w", currentPath, err)
+		}
+		c.namePatterns = append(c.namePatterns, namePattern{category: currentPath, regex: re})
+	}
+
+	// Subcategories inherit the layout unless they override it
+	layout := parentLayout
+	if group.Layout != "" {
+		layout = group.Layout
+	}
+	if layout != "" {
+		c.layouts[currentPath] = layout
+	}
+	if len(group.VideoRules) > 0 {
+		c.videoRules[currentPath] = group.VideoRules
+	}
+	if group.ByContent != "" {
+		if !filepath.IsLocal(filepath.FromSlash(group.ByContent)) {
+			return fmt.Errorf("category %s: invalid bycontent folder %q: must be a relative path", currentPath, group.ByContent)
+		}
+		c.byContent[currentPath] = filepath.FromSlash(group.ByContent)
+	}
+
+	// Process subcategories
+	for subName, subGroup := range group.Subcategories {
+		subPath := filepath.Join(currentPath, subName)
+		if err := c.processCategoryGroup(subPath, subGroup, layout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func normalizeExt(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// addCompound records ext if it has several parts
+func (c *Classifier) addCompound(ext string) {
+	if strings.Contains(ext, ".") && !slices.Contains(c.compoundExts, ext) {
+		c.compoundExts = append(c.compoundExts, ext)
+	}
+}
+
+// Layout returns the destination layout configured for a category, if any
+func (c *Classifier) Layout(category string) string {
+	return c.layouts[category]
+}
+
+// Ext returns the extension of a file name, including the dot. Configured
+// compound extensions such as .tar.gz are returned whole.
+func (c *Classifier) Ext(name string) string {
+	base := filepath.Base(name)
+	lower := strings.ToLower(base)
+	for _, ext := range c.compoundExts {
+		if len(lower) > len(ext)+1 && strings.HasSuffix(lower, "."+ext) {
+			return base[len(base)-len(ext)-1:]
+		}
+	}
+	return filepath.Ext(base)
+}
+
+// Classify returns the category path for a file, or LeaveInInbox when its
+// extension is unknown and the fallback says to leave it
+func (c *Classifier) Classify(filePath string) string {
+	category, _ := c.classify(filePath)
+	return category
+}
+
+// classify is Classify, also returning the extension of a file that fell
+// through to the unknown extension fallback
+func (c *Classifier) classify(filePath string) (category, unknownExt string) {
+	ext := strings.ToLower(c.Ext(filePath))
+	baseName := filepath.Base(filePath)
+
+	// Handle macOS extended attributes
+	if strings.HasPrefix(baseName, "._") && runtime.GOOS == "darwin" {
+		ext = "._*"
+	}
+
+	ext = strings.TrimPrefix(ext, ".")
+	if ext == "" {
+		ext = "no_extension"
+	}
+	if canonical, ok := c.aliases[ext]; ok {
+		ext = canonical
+	}
+
+	for _, pattern := range c.namePatterns {
+		if pattern.match(baseName) {
+			return c.route(pattern.category, filePath), ""
+		}
+	}
+
+	if path, exists := c.extensionMap[ext]; exists {
+		return c.route(path, filePath), ""
+	}
+
+	// The extension is missing or unknown, so look at the content instead
+	if c.sniff {
+		if _, sniffedExt, err := DetectType(filePath); err == nil && sniffedExt != "" {
+			if canonical, ok := c.aliases[sniffedExt]; ok {
+				sniffedExt = canonical
+			}
+			if path, exists := c.extensionMap[sniffedExt]; exists {
+				return c.route(path, filePath), ""
+			}
+		}
+	}
+
+	fallback := c.unknown
+	if ext == "no_extension" {
+		fallback = c.noExtension
+	} else {
+		unknownExt = ext
+	}
+	if fallback == LeaveInInbox {
+		return LeaveInInbox, unknownExt
+	}
+	return expandFallback(fallback, ext), unknownExt
+}
+
+// expandFallback fills the extension into a fallback category
+func expandFallback(category, ext string) string {
+	return filepath.FromSlash(strings.ReplaceAll(category, "{EXT}", strings.ToUpper(ext)))
+}
+
+// setFallbacks sets the categories of files with an unknown extension and
+// without one, checking that they stay inside the sorted directory
+func (c *Classifier) setFallbacks(unknown, noExtension string) error {
+	for _, category := range []string{unknown, noExtension} {
+		if category != LeaveInInbox && !filepath.IsLocal(expandFallback(category, "EXT")) {
+			return fmt.Errorf("invalid fallback category %q: must be a relative path", category)
+		}
+	}
+	c.unknown, c.noExtension = unknown, noExtension
+	return nil
+}
+
+// route applies the video rules and ByContent setting of a category to a
+// file in it
+func (c *Classifier) route(category, filePath string) string {
+	return c.routeArchive(c.routeVideo(category, filePath), filePath)
+}
+
+// routeVideo applies the video rules of a category, returning the
+// subcategory of the first matching rule or the category itself
+func (c *Classifier) routeVideo(category, filePath string) string {
+	rules := c.videoRules[category]
+	if len(rules) == 0 {
+		return category
+	}
+	info, err := readVideoInfo(filePath)
+	if err != nil {
+		return category
+	}
+	for _, rule := range rules {
+		if rule.matches(info) {
+			return filepath.Join(category, filepath.FromSlash(rule.Category))
+		}
+	}
+	return category
+}
+
+// routeArchive files an archive of a category with ByContent set under the
+// deepest category more than half of its files belong in, by their names.
+// Archives that can't be listed, have their names encrypted or hold mostly
+// other archives stay in the category.
+func (c *Classifier) routeArchive(category, filePath string) string {
+	sub := c.byContent[category]
+	if sub == "" {
+		return category
+	}
+	listing, err := listArchive(filePath)
+	if err != nil || listing.encryptedHeaders {
+		return category
+	}
+	counts := make(map[string]int) // Files in each category and the categories above it
+	files := 0
+	for _, entry := range listing.entries {
+		if entry.dir {
+			continue
+		}
+		files++
+		for parent := c.nameCategory(entry.name); parent != "" && parent != "."; parent = filepath.Dir(parent) {
+			counts[parent]++
+		}
+	}
+	best := ""
+	for parent, n := range counts {
+		if 2*n > files && len(parent) > len(best) {
+			best = parent
+		}
+	}
+	if best == "" || best == category || strings.HasPrefix(category, best+string(filepath.Separator)) {
+		return category
+	}
+	return filepath.Join(best, sub)
+}
+
+// nameCategory returns the category of a file by its name alone, from the
+// name patterns and extensions, or "" when neither match
+func (c *Classifier) nameCategory(name string) string {
+	base := path.Base(name)
+	for _, pattern := range c.namePatterns {
+		if pattern.match(base) {
+			return pattern.category
+		}
+	}
+	ext := normalizeExt(c.Ext(base))
+	if canonical, ok := c.aliases[ext]; ok {
+		ext = canonical
+	}
+	return c.extensionMap[ext]
+}
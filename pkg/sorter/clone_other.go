@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sorter
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is only supported on Linux; files are always copied elsewhere
+func cloneFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
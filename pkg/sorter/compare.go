@@ -0,0 +1,64 @@
+package sorter
+
+import (
+	"bytes"
+	"io"
+)
+
+// sameBytes confirms byte by byte that two files with matching hashes are
+// identical, unless Options.TrustHashes is set. Files that differ despite
+// their hashes, a hash collision, are logged.
+func (s *Sorter) sameBytes(a, b string) (bool, error) {
+	if s.opts.TrustHashes {
+		return true, nil
+	}
+	equal, err := s.filesEqual(a, b)
+	if err != nil {
+		return false, err
+	}
+	if !equal {
+		s.log.Warn("Hash collision, files with the same hash differ", "path", a, "other", b, "algorithm", s.opts.HashAlgorithm)
+	}
+	return equal, nil
+}
+
+// filesEqual compares the contents of two files. Like hashing, it stops
+// once the run is cancelled and keeps to Options.BandwidthLimit.
+func (s *Sorter) filesEqual(a, b string) (bool, error) {
+	fileA, err := storageAt(a).Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fileA.Close()
+	fileB, err := storageAt(b).Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fileB.Close()
+
+	size := 64 * 1024
+	if onNetwork(a, b) {
+		size = networkBufferSize
+	}
+	readerA, readerB := ctxReader{s.ctx, fileA}, ctxReader{s.ctx, fileB}
+	bufA := make([]byte, size)
+	bufB := make([]byte, size)
+	for {
+		nA, errA := io.ReadFull(readerA, bufA)
+		nB, errB := io.ReadFull(readerB, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		doneA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		doneB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !doneA {
+			return false, errA
+		}
+		if errB != nil && !doneB {
+			return false, errB
+		}
+		if doneA || doneB {
+			return doneA == doneB, nil
+		}
+	}
+}
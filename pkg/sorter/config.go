@@ -0,0 +1,340 @@
+package sorter
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Category configuration structures
+type CategoryConfig map[string]CategoryGroup
+
+type CategoryGroup struct {
+	Extensions    []string                 `json:"extensions,omitempty"`
+	Subcategories map[string]CategoryGroup `json:"subcategories,omitempty"`
+
+	// Globs (case-insensitive shell patterns) and Regexes match whole file
+	// names, e.g. "invoice*.pdf" or `^IMG_\d+`. They take precedence over
+	// extensions.
+	Globs   []string `json:"globs,omitempty"`
+	Regexes []string `json:"regexes,omitempty"`
+
+	// Layout places files in subfolders of the category, e.g. "{yyyy}/{mm}".
+	// Subcategories inherit it unless they set their own.
+	Layout string `json:"layout,omitempty"`
+
+	// VideoRules route video files of this category into subcategories by
+	// their container metadata. The first matching rule wins.
+	VideoRules []VideoRule `json:"videorules,omitempty"`
+
+	// ByContent files the zip, rar and 7z archives of this category by what
+	// they hold, in the ByContent subfolder (e.g. "Archives") of the deepest
+	// category most of their files belong in, such as Media/Images/Archives.
+	// Archives without such a majority stay in this category.
+	ByContent string `json:"bycontent,omitempty"`
+
+	// Aliases map extensions to the one they stand for, e.g. "jpeg" to
+	// "jpg", so both are classified (and fall back to Misc) as one. They
+	// apply to every category, wherever they are declared.
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+// VideoRule sends videos matching all of its conditions to Category, a path
+// relative to the category holding the rule (e.g. "Clips" or "4K"). Unset
+// conditions always match.
+type VideoRule struct {
+	Category    string   `json:"category"`
+	MinDuration Duration `json:"minduration,omitempty"`
+	MaxDuration Duration `json:"maxduration,omitempty"`
+	MinWidth    int      `json:"minwidth,omitempty"`
+	MinHeight   int      `json:"minheight,omitempty"`
+	MaxWidth    int      `json:"maxwidth,omitempty"`
+	MaxHeight   int      `json:"maxheight,omitempty"`
+	Codec       string   `json:"codec,omitempty"`
+}
+
+// matches reports whether a video satisfies the rule
+func (r VideoRule) matches(info *VideoInfo) bool {
+	switch {
+	case r.MinDuration != 0 && info.Duration < time.Duration(r.MinDuration):
+		return false
+	case r.MaxDuration != 0 && (info.Duration == 0 || info.Duration >= time.Duration(r.MaxDuration)):
+		return false
+	case r.MinWidth != 0 && info.Width < r.MinWidth:
+		return false
+	case r.MinHeight != 0 && info.Height < r.MinHeight:
+		return false
+	case r.MaxWidth != 0 && (info.Width == 0 || info.Width > r.MaxWidth):
+		return false
+	case r.MaxHeight != 0 && (info.Height == 0 || info.Height > r.MaxHeight):
+		return false
+	case r.Codec != "" && !strings.EqualFold(r.Codec, info.Codec):
+		return false
+	}
+	return true
+}
+
+// Duration is a time.Duration written as a string such as "30s", "1h30m"
+// or "30d" in config files
+type Duration time.Duration
+
+// Days and weeks, which time.ParseDuration doesn't know
+var longDurationUnit = regexp.MustCompile(`(\d+(?:\.\d+)?)([dw])`)
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ParseDuration is time.ParseDuration with additional "d" (day) and "w"
+// (week) units
+func ParseDuration(s string) (time.Duration, error) {
+	expanded := longDurationUnit.ReplaceAllStringFunc(s, func(m string) string {
+		n, _ := strconv.ParseFloat(m[:len(m)-1], 64)
+		hours := 24.0
+		if m[len(m)-1] == 'w' {
+			hours = 7 * 24
+		}
+		return strconv.FormatFloat(n*hours, 'f', -1, 64) + "h"
+	})
+	d, err := time.ParseDuration(expanded)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type ExclusionConfig struct {
+	Common     []string            `json:"common"`
+	OSSpecific map[string][]string `json:"os_specific"`
+}
+
+// ConfigExts are the extensions config files are looked up with, in order
+var ConfigExts = []string{".json", ".yaml", ".yml", ".toml"}
+
+// configFormat returns "yaml" or "toml" for files named so, and "json" for
+// everything else
+func configFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// parseConfig parses a YAML or TOML config into the values encoding/json
+// would produce, along with the line of every value by its JSON pointer
+func parseConfig(name string, data []byte) (any, map[string]int, error) {
+	if configFormat(name) == "toml" {
+		return parseTOML(data)
+	}
+	return parseYAML(data)
+}
+
+// UnmarshalConfig decodes a config file into v: as YAML or TOML when its
+// name ends in .yaml, .yml or .toml, and as JSON otherwise. YAML and TOML
+// are converted to JSON first, so the json struct tags apply to all three.
+func UnmarshalConfig(name string, data []byte, v any) error {
+	if configFormat(name) != "json" {
+		value, _, err := parseConfig(name, data)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// loadConfig reads and decodes a config file, what being its kind in errors
+func loadConfig(path, what string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return &ConfigError{fmt.Errorf("failed to open %s config: %w", what, err)}
+	}
+	if err := UnmarshalConfig(path, data, v); err != nil {
+		return &ConfigError{fmt.Errorf("invalid %s config format: %w", what, err)}
+	}
+	return nil
+}
+
+// LoadCategoryConfig reads an extensions.json (or .yaml, .toml) category
+// configuration
+func LoadCategoryConfig(path string) (CategoryConfig, error) {
+	var config CategoryConfig
+	if err := loadConfig(path, "extension", &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Extend returns c with the categories of other added to it. Categories of
+// the same name are merged, down to their subcategories; the layouts of
+// other win, and its video rules come first. An extension or alias listed
+// in other moves there from wherever c had it.
+func (c CategoryConfig) Extend(other CategoryConfig) CategoryConfig {
+	claimed := make(map[string]bool)
+	var claim func(group CategoryGroup)
+	claim = func(group CategoryGroup) {
+		for _, ext := range group.Extensions {
+			claimed[normalizeExt(ext)] = true
+		}
+		for alias := range group.Aliases {
+			claimed[normalizeExt(alias)] = true
+		}
+		for _, sub := range group.Subcategories {
+			claim(sub)
+		}
+	}
+	for _, group := range other {
+		claim(group)
+	}
+
+	extended := make(CategoryConfig, len(c)+len(other))
+	for name, group := range c {
+		extended[name] = group.without(claimed)
+	}
+	for name, group := range other {
+		extended[name] = extended[name].merge(group)
+	}
+	return extended
+}
+
+// without returns a copy of the group and its subcategories without the
+// extensions and aliases in exts
+func (g CategoryGroup) without(exts map[string]bool) CategoryGroup {
+	g.Extensions = slices.DeleteFunc(slices.Clone(g.Extensions), func(ext string) bool { return exts[normalizeExt(ext)] })
+	if g.Aliases != nil {
+		aliases := make(map[string]string, len(g.Aliases))
+		for alias, ext := range g.Aliases {
+			if !exts[normalizeExt(alias)] {
+				aliases[alias] = ext
+			}
+		}
+		g.Aliases = aliases
+	}
+	if g.Subcategories != nil {
+		subs := make(map[string]CategoryGroup, len(g.Subcategories))
+		for name, sub := range g.Subcategories {
+			subs[name] = sub.without(exts)
+		}
+		g.Subcategories = subs
+	}
+	return g
+}
+
+// merge returns g with the settings of other added, see Extend
+func (g CategoryGroup) merge(other CategoryGroup) CategoryGroup {
+	g.Extensions = append(slices.Clone(g.Extensions), other.Extensions...)
+	g.Globs = append(slices.Clone(g.Globs), other.Globs...)
+	g.Regexes = append(slices.Clone(g.Regexes), other.Regexes...)
+	if other.Layout != "" {
+		g.Layout = other.Layout
+	}
+	g.VideoRules = append(slices.Clone(other.VideoRules), g.VideoRules...)
+	if other.ByContent != "" {
+		g.ByContent = other.ByContent
+	}
+	if len(other.Aliases) > 0 {
+		aliases := maps.Clone(g.Aliases)
+		if aliases == nil {
+			aliases = make(map[string]string, len(other.Aliases))
+		}
+		maps.Copy(aliases, other.Aliases)
+		g.Aliases = aliases
+	}
+	if len(other.Subcategories) > 0 {
+		subs := maps.Clone(g.Subcategories)
+		if subs == nil {
+			subs = make(map[string]CategoryGroup, len(other.Subcategories))
+		}
+		for name, sub := range other.Subcategories {
+			subs[name] = subs[name].merge(sub)
+		}
+		g.Subcategories = subs
+	}
+	return g
+}
+
+// AddExtension adds an extension to a category of the extensions.json at
+// path, creating the category if needed. The file is rewritten through a
+// temporary file, with its keys in alphabetical order. YAML and TOML files,
+// whose comments would be lost, are left to be edited by hand.
+func AddExtension(path, category, ext string) error {
+	if configFormat(path) != "json" {
+		return fmt.Errorf("only JSON category configs can be edited, add .%s to %s in %s by hand", strings.TrimPrefix(ext, "."), category, path)
+	}
+	config, err := LoadCategoryConfig(path)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(filepath.ToSlash(category), "/")
+	if category == "" || slices.Contains(parts, "") {
+		return fmt.Errorf("invalid category %q", category)
+	}
+	config[parts[0]] = addExtension(config[parts[0]], parts[1:], strings.ToLower(strings.TrimPrefix(ext, ".")))
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// addExtension adds ext to the subcategory of group at path
+func addExtension(group CategoryGroup, path []string, ext string) CategoryGroup {
+	if len(path) == 0 {
+		if !slices.Contains(group.Extensions, ext) {
+			group.Extensions = append(group.Extensions, ext)
+		}
+		return group
+	}
+	if group.Subcategories == nil {
+		group.Subcategories = make(map[string]CategoryGroup)
+	}
+	group.Subcategories[path[0]] = addExtension(group.Subcategories[path[0]], path[1:], ext)
+	return group
+}
+
+// LoadExclusions reads an exclusion config and returns the common patterns
+// plus the ones specific to the current OS
+func LoadExclusions(path string) ([]string, error) {
+	var config ExclusionConfig
+	if err := loadConfig(path, "exclusion", &config); err != nil {
+		return nil, err
+	}
+	return config.Patterns(), nil
+}
+
+// Patterns returns the common patterns plus the ones specific to the
+// current OS
+func (c ExclusionConfig) Patterns() []string {
+	return append(slices.Clone(c.Common), c.OSSpecific[runtime.GOOS]...)
+}
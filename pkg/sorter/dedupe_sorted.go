@@ -0,0 +1,164 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// What DedupeSorted does with the extra copies it finds
+const (
+	SortedDupReport   = "report"   // Only report them
+	SortedDupHardlink = "hardlink" // Replace them with hard links to the kept copy
+	SortedDupDelete   = "delete"   // Move them to the delete folder
+)
+
+// SortedDupActions lists the valid DedupeSorted actions
+var SortedDupActions = []string{SortedDupReport, SortedDupHardlink, SortedDupDelete}
+
+// DuplicateSet is a group of identical files in the sorted directory
+type DuplicateSet struct {
+	Keep   string   // The copy left alone, the first by path
+	Extras []string // The other copies, minus those already hard links to Keep
+	Size   int64    // Size of each copy
+}
+
+// DedupeSorted finds files that are duplicated inside the sorted directory
+// itself, typically from before the sorter was used, and reports them,
+// hard links them to a single copy or moves the extra copies to the delete
+// folder depending on action. Copies that already are hard links of the kept
+// one are left out. A *PartialError is returned when some extras couldn't be
+// handled.
+func (s *Sorter) DedupeSorted(action string) ([]DuplicateSet, error) {
+	if !slices.Contains(SortedDupActions, action) {
+		return nil, &ConfigError{fmt.Errorf("invalid action %q: must be one of %s", action, strings.Join(SortedDupActions, ", "))}
+	}
+	if action == SortedDupDelete {
+		defer s.journal.close()
+	}
+
+	sizes, err := s.repeatedSortedSizes()
+	if err != nil {
+		return nil, fmt.Errorf("Error collecting sorted files: %w", err)
+	}
+	index, err := s.collectSortedFiles(sizes)
+	if err != nil {
+		return nil, fmt.Errorf("Error collecting sorted files: %w", err)
+	}
+	if err := s.reuseIndexedHashes(index.files()); err != nil {
+		s.log.Warn("Failed to read hash index, hashing as usual", "err", err)
+	}
+	s.failed = 0
+
+	var sets []DuplicateSet
+	for _, group := range index.duplicateSets(s.newProgress) {
+		set := DuplicateSet{Keep: group[0].path, Size: group[0].size}
+		keepInfo, err := storageAt(set.Keep).Stat(set.Keep)
+		if err != nil {
+			s.log.Error("Failed to read file", "path", set.Keep, "err", err)
+			s.emitError(set.Keep, err)
+			continue
+		}
+		for _, f := range group[1:] {
+			if info, err := storageAt(f.path).Stat(f.path); err == nil && os.SameFile(keepInfo, info) {
+				continue // Already takes no extra space
+			}
+			if same, err := s.sameBytes(f.path, set.Keep); err != nil || !same {
+				if err != nil {
+					s.log.Error("Failed to compare files", "path", f.path, "err", err)
+					s.emitError(f.path, err)
+				}
+				continue
+			}
+			set.Extras = append(set.Extras, f.path)
+		}
+		if len(set.Extras) == 0 {
+			continue
+		}
+		sets = append(sets, set)
+
+		for _, extra := range set.Extras {
+			s.log.Info("Duplicate found in sorted directory", "path", extra, "duplicate_of", set.Keep)
+			s.emit(Event{Type: EventDuplicate, Path: extra, Size: set.Size, DuplicateOf: set.Keep, Hash: group[0].full})
+
+			if action != SortedDupReport {
+				if err := s.pace(); err != nil {
+					return sets, err
+				}
+			}
+			switch action {
+			case SortedDupHardlink:
+				err = s.hardlink(extra, set.Keep)
+			case SortedDupDelete:
+				err = s.moveFileWithMetadata(extra, s.opts.DeleteDir, "duplicate", set.Keep)
+			}
+			if errors.Is(err, ErrAborted) {
+				return sets, err
+			}
+			if err != nil {
+				s.log.Error("Failed to handle duplicate", "path", extra, "action", action, "err", err)
+				s.emitError(extra, err)
+			}
+		}
+	}
+
+	if s.failed > 0 {
+		return sets, &PartialError{Failed: s.failed}
+	}
+	return sets, nil
+}
+
+// hardlink replaces dup with a hard link to keep. The link is made under a
+// temporary name first, so dup is never missing.
+func (s *Sorter) hardlink(dup, keep string) error {
+	if ok, err := s.confirm(dup, keep, "hardlink"); !ok {
+		return err
+	}
+	if s.opts.DryRun {
+		s.log.Info("Would hard link", "path", dup, "to", keep)
+		s.emit(Event{Type: EventMoved, Path: dup, Dest: keep, Reason: "hardlink"})
+		return nil
+	}
+	if isRemote(dup) {
+		return fmt.Errorf("can't hard link on a remote storage: %w", errors.ErrUnsupported)
+	}
+
+	tmp := filepath.Join(filepath.Dir(dup), ".sorter-link-"+filepath.Base(dup))
+	if err := os.Link(keep, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dup); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.log.Info("Replaced duplicate with a hard link", "path", dup, "to", keep)
+	s.emit(Event{Type: EventMoved, Path: dup, Dest: keep, Reason: "hardlink"})
+	return nil
+}
+
+// repeatedSortedSizes returns the sizes shared by several files of the
+// sorted directory, the only ones that can hold duplicates
+func (s *Sorter) repeatedSortedSizes() (map[int64]bool, error) {
+	var tally sizeTally
+	defer tally.close()
+	err := walk(s.opts.SortedDir, func(filePath string, info fs.FileInfo, err error) error {
+		if s.ctx.Err() != nil {
+			return s.aborted()
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return tally.add(info.Size())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tally.repeated()
+}
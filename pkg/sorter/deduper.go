@@ -0,0 +1,329 @@
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Only this many leading bytes are hashed before deciding whether a full
+// hash is worth computing
+const partialHashSize = 64 * 1024
+
+// indexedFile is a file known to the duplicate index. Hashes are computed
+// lazily, only once another file of the same size (and partial hash) shows up.
+type indexedFile struct {
+	path      string
+	size      int64
+	modTime   time.Time
+	inRun     bool           // Sorted during the current run rather than found in sorted
+	movedTo   string         // Where an inbox file was sorted to during the run
+	rule      *Rule          // Rule matching an inbox file, if any
+	sidecars  []*indexedFile // Files that go wherever an inbox file goes, see pairSidecars
+	companion bool           // A sidecar that is the JPEG of a RAW file
+	partial   string
+	full      string
+	err       error
+}
+
+// dupIndex finds duplicates by comparing sizes first, then the hash of the
+// first 64KB, and only then the hash of the whole file
+type dupIndex struct {
+	bySize  map[int64][]*indexedFile
+	hasher  Hasher
+	same    func(a, b string) (bool, error) // Confirms a hash match, if set
+	workers int                             // Concurrent hashing goroutines used by prepare
+	stop    <-chan struct{}                 // Closing it cuts prepare short
+	ctx     context.Context                 // Cancels hashing, prepare included
+	filter  *sortedFilter                   // Rules out sorted files without reading them, if set
+}
+
+func newDupIndex(ctx context.Context, hasher Hasher, workers int, stop <-chan struct{}) *dupIndex {
+	return &dupIndex{bySize: make(map[int64][]*indexedFile), hasher: hasher, workers: workers, stop: stop, ctx: ctx}
+}
+
+func (ix *dupIndex) add(f *indexedFile) {
+	ix.bySize[f.size] = append(ix.bySize[f.size], f)
+}
+
+// files returns every indexed file
+func (ix *dupIndex) files() []*indexedFile {
+	var files []*indexedFile
+	for _, group := range ix.bySize {
+		files = append(files, group...)
+	}
+	return files
+}
+
+// Helper function to calculate XXH64 hash of a file, for checks that don't
+// depend on Options.HashAlgorithm
+func fileHash(ctx context.Context, filePath string) (string, error) {
+	return hashFile(ctx, filePath, namedHasher{xxh64, "xxh64"}, -1)
+}
+
+// partialHash hashes the first 64KB of a file
+func (ix *dupIndex) partialHash(filePath string) (string, error) {
+	return hashFile(ix.ctx, filePath, ix.hasher, partialHashSize)
+}
+
+// fullHash hashes a whole file
+func (ix *dupIndex) fullHash(filePath string) (string, error) {
+	return hashFile(ix.ctx, filePath, ix.hasher, -1)
+}
+
+// location is where the file is now
+func (f *indexedFile) location() string {
+	if f.movedTo != "" {
+		return f.movedTo
+	}
+	return f.path
+}
+
+func (f *indexedFile) partialHash(ix *dupIndex) (string, error) {
+	if f.partial == "" && f.err == nil {
+		f.partial, f.err = ix.partialHash(f.location())
+		if f.size <= partialHashSize {
+			f.full = f.partial // The partial hash already covers the whole file
+		}
+	}
+	return f.partial, f.err
+}
+
+func (f *indexedFile) fullHash(ix *dupIndex) (string, error) {
+	if f.full == "" && f.err == nil {
+		f.full, f.err = ix.fullHash(f.location())
+	}
+	return f.full, f.err
+}
+
+// prepare hashes, on the worker pool, everything the upcoming find calls for
+// candidates will need: partial hashes for every file sharing its size with a
+// candidate, then full hashes where those partial hashes collide. Progress of
+// the full hashes, the slow part, is reported through newProgress. Files
+// whose hashes are already known (from a checkpoint) aren't hashed again.
+// With a filter, candidates are hashed first, and sorted files their
+// filter rules out for every candidate of their size are left alone.
+func (ix *dupIndex) prepare(candidates []*indexedFile, newProgress func(label string, total int, totalBytes int64) *progress) {
+	bySize := make(map[int64][]*indexedFile)
+	for _, c := range candidates {
+		bySize[c.size] = append(bySize[c.size], c)
+	}
+
+	if ix.filter != nil {
+		var unhashed []*indexedFile
+		for size, group := range bySize {
+			if len(ix.bySize[size]) > 0 {
+				for _, c := range group {
+					if c.partial == "" {
+						unhashed = append(unhashed, c)
+					}
+				}
+			}
+		}
+		ix.hashIndexed(unhashed, ix.partialHash, nil, func(f *indexedFile, hash string) {
+			f.partial = hash
+			if f.size <= partialHashSize {
+				f.full = hash
+			}
+		})
+	}
+
+	var needPartial []*indexedFile
+	for size, group := range bySize {
+		sorted := ix.bySize[size]
+		if ix.filter != nil {
+			ruledOut := true
+			for _, c := range group {
+				ruledOut = ruledOut && ix.filter.rulesOut(c, sorted)
+			}
+			if ruledOut {
+				sorted = slices.DeleteFunc(slices.Clone(sorted), func(f *indexedFile) bool { return !f.inRun })
+			}
+		}
+		group = append(group, sorted...)
+		if len(group) > 1 {
+			needPartial = append(needPartial, group...)
+		}
+	}
+	ix.hashGroups(needPartial, newProgress)
+}
+
+// hashGroups computes the partial hashes of files that share their size
+// with another one, then the full hashes where partial hashes collide
+func (ix *dupIndex) hashGroups(needPartial []*indexedFile, newProgress func(label string, total int, totalBytes int64) *progress) {
+	var unhashed []*indexedFile
+	for _, f := range needPartial {
+		if f.partial == "" {
+			unhashed = append(unhashed, f)
+		}
+	}
+	ix.hashIndexed(unhashed, ix.partialHash, nil, func(f *indexedFile, hash string) {
+		f.partial = hash
+		if f.size <= partialHashSize {
+			f.full = hash
+		}
+	})
+
+	byPartial := make(map[string][]*indexedFile)
+	for _, f := range needPartial {
+		if f.err == nil && f.partial != "" && f.size > partialHashSize {
+			key := fmt.Sprintf("%d/%s", f.size, f.partial)
+			byPartial[key] = append(byPartial[key], f)
+		}
+	}
+	var needFull []*indexedFile
+	var needFullBytes int64
+	for _, group := range byPartial {
+		if len(group) < 2 {
+			continue
+		}
+		for _, f := range group {
+			if f.full == "" {
+				needFull = append(needFull, f)
+				needFullBytes += f.size
+			}
+		}
+	}
+	if len(needFull) == 0 {
+		return
+	}
+	progress := newProgress("Hashing", len(needFull), needFullBytes)
+	ix.hashIndexed(needFull, ix.fullHash, progress, func(f *indexedFile, hash string) {
+		f.full = hash
+	})
+	progress.finish()
+}
+
+// duplicateSets returns the groups of indexed files with identical
+// contents, each sorted by path
+func (ix *dupIndex) duplicateSets(newProgress func(label string, total int, totalBytes int64) *progress) [][]*indexedFile {
+	var sameSize []*indexedFile
+	for _, group := range ix.bySize {
+		if len(group) > 1 {
+			sameSize = append(sameSize, group...)
+		}
+	}
+	ix.hashGroups(sameSize, newProgress)
+
+	byHash := make(map[string][]*indexedFile)
+	for _, f := range sameSize {
+		if f.err == nil && f.full != "" {
+			key := fmt.Sprintf("%d/%s", f.size, f.full)
+			byHash[key] = append(byHash[key], f)
+		}
+	}
+	var sets [][]*indexedFile
+	for _, group := range byHash {
+		if len(group) > 1 {
+			slices.SortFunc(group, func(a, b *indexedFile) int { return strings.Compare(a.path, b.path) })
+			sets = append(sets, group)
+		}
+	}
+	slices.SortFunc(sets, func(a, b []*indexedFile) int { return strings.Compare(a[0].path, b[0].path) })
+	return sets
+}
+
+// hashIndexed hashes files on the worker pool and stores the results,
+// reporting each file to progress (which may be nil). Files not started
+// when ix.stop is closed or ix.ctx is done are left unhashed.
+func (ix *dupIndex) hashIndexed(files []*indexedFile, hashFn func(string) (string, error), progress *progress, store func(*indexedFile, string)) {
+	byPath := make(map[string]*indexedFile, len(files))
+	for _, f := range files {
+		byPath[f.path] = f
+	}
+
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for filePath := range byPath {
+			select {
+			case paths <- filePath:
+			case <-ix.stop:
+				return
+			case <-ix.ctx.Done():
+				return
+			}
+		}
+	}()
+	hashFiles(ix.workers, paths, hashFn, func(filePath, hash string, err error) {
+		f := byPath[filePath]
+		progress.add(f.size)
+		if err != nil {
+			f.err = err
+			return
+		}
+		store(f, hash)
+	})
+}
+
+// hashFiles hashes (with hashFn) every path received on paths using a pool of workers.
+// report is called once per file; calls are serialized, so it may update
+// shared state and print progress without extra locking.
+func hashFiles(workers int, paths <-chan string, hashFn func(string) (string, error), report func(filePath, hash string, err error)) {
+	var wg sync.WaitGroup
+	var reportMutex sync.Mutex
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range paths {
+				hash, err := hashFn(filePath)
+
+				reportMutex.Lock()
+				report(filePath, hash, err)
+				reportMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// find returns an indexed file with the same contents as f, or nil
+func (ix *dupIndex) find(f *indexedFile) (*indexedFile, error) {
+	sameSize := ix.bySize[f.size]
+	if len(sameSize) == 0 {
+		return nil, nil // No file of this size, so it can't be a duplicate
+	}
+
+	partial, err := f.partialHash(ix)
+	if err != nil {
+		return nil, err
+	}
+	ruledOut := ix.filter != nil && ix.filter.rulesOut(f, sameSize)
+	for _, other := range sameSize {
+		if ruledOut && !other.inRun {
+			continue
+		}
+		// A file is never a duplicate of itself, whichever way it was found
+		if other == f || other.location() == f.location() {
+			continue
+		}
+		otherPartial, err := other.partialHash(ix)
+		if err != nil || otherPartial != partial {
+			continue
+		}
+
+		full, err := f.fullHash(ix)
+		if err != nil {
+			return nil, err
+		}
+		if otherFull, err := other.fullHash(ix); err != nil || otherFull != full {
+			continue
+		}
+		if ix.same != nil {
+			same, err := ix.same(f.location(), other.location())
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				continue
+			}
+		}
+		return other, nil
+	}
+	return nil, nil
+}
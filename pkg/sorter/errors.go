@@ -0,0 +1,32 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAborted is returned when a run is stopped before it finished, through
+// Options.Confirm or Options.Stop
+var ErrAborted = errors.New("run aborted")
+
+// ErrShareLost is returned when a network share or remote server holding
+// one of the working directories goes away in the middle of a pass
+var ErrShareLost = errors.New("network share unavailable")
+
+// ConfigError reports an invalid or unreadable configuration
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// PartialError reports a run that went through but failed to process some
+// of the files; the individual failures are logged
+type PartialError struct {
+	Failed int
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d files could not be processed", e.Failed)
+}
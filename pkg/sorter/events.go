@@ -0,0 +1,54 @@
+package sorter
+
+import "time"
+
+// Event types reported through Options.Events
+const (
+	EventFile      = "file"      // An inbox file is being processed
+	EventScanned   = "scanned"   // The file was scanned for malware; Reason is "clean" or the malware found
+	EventCategory  = "category"  // The category a unique file was sorted into; Reason unknown-extension for the fallbacks, or why it was quarantined
+	EventDuplicate = "duplicate" // The file duplicates DuplicateOf
+	EventMoved     = "moved"     // The file was moved to Dest
+	EventSkipped   = "skipped"   // The file was left where it is, see Reason
+	EventRemoved   = "removed"   // An empty inbox folder was removed, or a file purged
+	EventError     = "error"     // Processing the file failed
+)
+
+// Event describes one action taken during a run
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	DuplicateOf string    `json:"duplicate_of,omitempty"`
+	Hash        string    `json:"hash,omitempty"` // Content hash, in Options.HashAlgorithm, where the run computed one
+	Dest        string    `json:"dest,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Detail      string    `json:"detail,omitempty"` // What Reason is about, such as the damage of a corrupt file
+	Error       string    `json:"error,omitempty"`
+	DryRun      bool      `json:"dry_run,omitempty"`
+}
+
+// emit reports an event to the Events callback, Metrics and the trace
+// span of the file, if set
+func (s *Sorter) emit(event Event) {
+	if s.opts.Events == nil && s.opts.Metrics == nil && s.fileSpan == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.DryRun = s.opts.DryRun
+	s.opts.Metrics.record(event)
+	s.fileSpan.addEvent(event)
+	if s.opts.Events != nil {
+		s.opts.Events(event)
+	}
+}
+
+// emitError reports a file that could not be processed, counting it
+// towards the run's PartialError
+func (s *Sorter) emitError(path string, err error) {
+	s.failed++
+	s.emit(Event{Type: EventError, Path: path, Error: err.Error()})
+}
@@ -0,0 +1,143 @@
+package sorter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// EXIF tags needed to find when a photo was taken
+const (
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// How far into a JPEG to look for the APP1 (EXIF) segment
+const maxExifScan = 256 * 1024
+
+var errNoExif = errors.New("no EXIF date")
+
+// exifDate returns the EXIF DateTimeOriginal of a JPEG or TIFF-based image
+// (including most camera RAW formats such as CR2, NEF, ARW and DNG)
+func exifDate(filePath string) (time.Time, error) {
+	file, err := storageAt(filePath).Open(filePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return time.Time{}, errNoExif
+	}
+
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		tiff, err := jpegExifSegment(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return tiffDateTimeOriginal(bytes.NewReader(tiff))
+	case string(header) == "II*\x00" || string(header) == "MM\x00*":
+		return tiffDateTimeOriginal(file)
+	}
+	return time.Time{}, errNoExif
+}
+
+// jpegExifSegment walks the JPEG markers and returns the TIFF structure
+// embedded in the APP1 "Exif" segment
+func jpegExifSegment(file File) ([]byte, error) {
+	if _, err := file.Seek(2, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(io.LimitReader(file, maxExifScan))
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF {
+			return nil, errNoExif
+		}
+		// Start of scan or end of image: no metadata segments follow
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return nil, errNoExif
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil, errNoExif
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExif
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// tiffDateTimeOriginal reads DateTimeOriginal from the EXIF sub-IFD of a
+// TIFF structure starting at offset 0 of r
+func tiffDateTimeOriginal(r io.ReaderAt) (time.Time, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return time.Time{}, errNoExif
+	}
+
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}, errNoExif
+	}
+
+	exifIFD, _, ok := findIFDEntry(r, order, order.Uint32(header[4:]), tagExifIFD)
+	if !ok {
+		return time.Time{}, errNoExif
+	}
+	offset, count, ok := findIFDEntry(r, order, exifIFD, tagDateTimeOriginal)
+	if !ok || count < 19 || count > 64 {
+		return time.Time{}, errNoExif
+	}
+
+	value := make([]byte, count)
+	if _, err := r.ReadAt(value, int64(offset)); err != nil {
+		return time.Time{}, errNoExif
+	}
+	date, err := time.ParseInLocation("2006:01:02 15:04:05", strings.TrimRight(string(value[:19]), "\x00 "), time.Local)
+	if err != nil || date.Year() < 1900 {
+		return time.Time{}, errNoExif
+	}
+	return date, nil
+}
+
+// findIFDEntry looks up a tag in the IFD at offset and returns its value
+// field (the value itself, or its offset when it doesn't fit) and count
+func findIFDEntry(r io.ReaderAt, order binary.ByteOrder, offset uint32, tag uint16) (value uint32, count uint32, ok bool) {
+	countBytes := make([]byte, 2)
+	if _, err := r.ReadAt(countBytes, int64(offset)); err != nil {
+		return 0, 0, false
+	}
+	entries := int(order.Uint16(countBytes))
+	if entries > 1000 {
+		return 0, 0, false // Corrupt IFD
+	}
+
+	entry := make([]byte, 12)
+	for i := 0; i < entries; i++ {
+		if _, err := r.ReadAt(entry, int64(offset)+2+int64(i)*12); err != nil {
+			return 0, 0, false
+		}
+		if order.Uint16(entry[0:]) == tag {
+			return order.Uint32(entry[8:]), order.Uint32(entry[4:]), true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,347 @@
+package sorter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Unpacking one archive writes at most this much, so a zip bomb can't fill
+// the disk
+const extractMaxSize = 16 << 30
+
+var errExtractTooLarge = errors.New("archive unpacks to more than 16 GiB")
+
+// errExtractDeclined is returned by extractArchive when Options.Confirm
+// said no, which sorts the archive as it is
+var errExtractDeclined = errors.New("extraction declined")
+
+// Formats extractArchive unpacks
+const (
+	extractZip    = "zip"
+	extractTar    = "tar"
+	extractTarGz  = "tar.gz"
+	extractTarBz2 = "tar.bz2"
+)
+
+// extractArchives unpacks the archives among the inbox files into the
+// staging directory, moving each to the extracted directory, and returns
+// the files with the unpacked ones in place of their archive. Files the
+// staging directory already held, left by an earlier pass, are sorted as
+// they are.
+func (s *Sorter) extractArchives(candidates []*indexedFile) ([]*indexedFile, error) {
+	var files []*indexedFile
+	for _, file := range candidates {
+		if s.ctx.Err() != nil {
+			return nil, s.aborted()
+		}
+		if file.rule != nil || nested(file.path, s.opts.StagingDir) {
+			files = append(files, file)
+			continue
+		}
+		format, err := extractFormat(file.path)
+		if err != nil {
+			s.log.Warn("Failed to read archive, sorting it as it is", "path", file.path, "err", err)
+		}
+		if format == "" {
+			files = append(files, file)
+			continue
+		}
+		unpacked, err := s.extractArchive(file.path, format)
+		if errors.Is(err, ErrAborted) {
+			return nil, err
+		}
+		if errors.Is(err, errExtractDeclined) {
+			files = append(files, file)
+			continue
+		}
+		if err != nil {
+			s.log.Warn("Failed to extract archive, sorting it as it is", "path", file.path, "err", err)
+			files = append(files, file)
+			continue
+		}
+		files = append(files, unpacked...)
+	}
+	return files, nil
+}
+
+// extractFormat returns the format of an archive extractArchive can unpack,
+// or "" for other files and encrypted archives
+func extractFormat(path string) (string, error) {
+	f, err := storageAt(path).Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	var inner io.Reader
+	format := ""
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		listing, err := listArchive(path)
+		if err != nil || listing.encrypted() {
+			return "", nil
+		}
+		return extractZip, nil
+	case isTar(head):
+		return extractTar, nil
+	case bytes.HasPrefix(head, []byte{0x1F, 0x8B}):
+		format = extractTarGz
+	case bytes.HasPrefix(head, []byte("BZh")):
+		format = extractTarBz2
+	default:
+		return "", nil
+	}
+
+	// A compressed file is only an archive when it holds a tar
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if inner, err = decompressor(format, f); err != nil {
+		return "", nil
+	}
+	head = make([]byte, 512)
+	n, _ = io.ReadFull(inner, head)
+	if !isTar(head[:n]) {
+		return "", nil
+	}
+	return format, nil
+}
+
+// isTar reports whether a block is the header of a POSIX or GNU tar
+func isTar(head []byte) bool {
+	return len(head) >= 512 && bytes.HasPrefix(head[257:], []byte("ustar"))
+}
+
+// decompressor reads the tar inside a compressed archive
+func decompressor(format string, r io.Reader) (io.Reader, error) {
+	switch format {
+	case extractTarGz:
+		return gzip.NewReader(r)
+	case extractTarBz2:
+		return bzip2.NewReader(r), nil
+	}
+	return r, nil
+}
+
+// extractArchive unpacks an archive into a folder of its own in the
+// staging directory and moves it to the extracted directory, returning the
+// unpacked files that pass the inbox filters. Nothing is left behind when
+// it fails; in dry runs nothing is unpacked and no files are returned.
+func (s *Sorter) extractArchive(path, format string) ([]*indexedFile, error) {
+	name := filepath.Base(path)
+	stem := strings.TrimSuffix(name, s.classifier.Ext(name))
+	if stem == "" {
+		stem = name
+	}
+	dir := filepath.Join(s.opts.StagingDir, stem)
+	for i := 1; s.destExists(path, dir); i++ {
+		dir = filepath.Join(s.opts.StagingDir, fmt.Sprintf("%s_%d", stem, i))
+	}
+	dest := filepath.Join(s.opts.ExtractedDir, name)
+	for i := 1; s.destExists(path, dest); i++ {
+		ext := s.classifier.Ext(name)
+		dest = filepath.Join(s.opts.ExtractedDir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+
+	if ok, err := s.confirm(path, dest, "extracted"); !ok {
+		if err == nil {
+			err = errExtractDeclined
+		}
+		return nil, err
+	}
+	if s.opts.DryRun {
+		s.log.Info("Would extract archive", "path", path, "dir", dir)
+		s.planMove(path, dest, "extracted", "")
+		return nil, nil
+	}
+
+	s.log.Info("Extracting archive", "path", path, "dir", dir, "format", format)
+	x := &extraction{ctx: s.ctx.Err, st: storageAt(dir), root: dir, left: extractMaxSize}
+	if err := x.unpack(path, format); err != nil {
+		if cleanupErr := x.cleanup(); cleanupErr != nil {
+			s.log.Warn("Failed to remove partly extracted archive", "dir", dir, "err", cleanupErr)
+		}
+		if s.ctx.Err() != nil {
+			return nil, s.aborted()
+		}
+		return nil, err
+	}
+
+	if err := storageAt(dest).MkdirAll(s.opts.ExtractedDir); err != nil {
+		x.cleanup()
+		return nil, err
+	}
+	if err := s.renameFile(path, dest); err != nil {
+		x.cleanup()
+		return nil, err
+	}
+	s.journal.record(JournalEntry{Action: "move", Src: path, Dest: dest, Reason: "extracted"})
+	s.log.Info("Archive extracted", "path", path, "files", x.files, "dest", dest)
+	s.emit(Event{Type: EventMoved, Path: path, Dest: dest, Reason: "extracted"})
+
+	found, err := s.walkDir(Inbox{Dir: dir, ExcludeDirs: s.opts.ExcludeDirs, ExcludeFiles: s.opts.ExcludeFiles})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// extraction writes the files of an archive below root, keeping track of
+// them so a failed one can be removed
+type extraction struct {
+	ctx     func() error // Stops the extraction when it returns an error
+	st      FS
+	root    string
+	left    int64    // Bytes it may still write
+	created []string // Files and folders, parents first
+	files   int
+}
+
+// unpack writes every regular file of the archive. Entries whose names
+// would land outside root are skipped.
+func (x *extraction) unpack(path, format string) error {
+	f, err := storageAt(path).Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := x.mkdir(x.root); err != nil {
+		return err
+	}
+
+	if format == extractZip {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, err := zip.NewReader(f, info.Size())
+		if err != nil && !errors.Is(err, zip.ErrInsecurePath) { // Checked below
+			return err
+		}
+		for _, entry := range r.File {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			content, err := entry.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %w", entry.Name, err)
+			}
+			err = x.write(entry.Name, content, entry.Modified)
+			content.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r, err := decompressor(format, f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue // Folders are made for their files; links and devices are left out
+		}
+		if err := x.write(header.Name, tr, header.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// write creates the file name, slash-separated and relative to root, with
+// the content of r and modification time modTime
+func (x *extraction) write(name string, r io.Reader, modTime time.Time) error {
+	if err := x.ctx(); err != nil {
+		return err
+	}
+	rel := filepath.FromSlash(strings.TrimPrefix(name, "./"))
+	if !filepath.IsLocal(rel) {
+		return nil
+	}
+	target := filepath.Join(x.root, rel)
+	if err := x.mkdir(filepath.Dir(target)); err != nil {
+		return err
+	}
+	if _, err := x.st.Lstat(target); err == nil {
+		return nil // Listed twice, the first one wins
+	}
+	w, err := x.st.Create(target)
+	if err != nil {
+		return err
+	}
+	x.created = append(x.created, target)
+	n, err := io.Copy(w, io.LimitReader(r, x.left+1))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if x.left -= n; x.left < 0 {
+		return errExtractTooLarge
+	}
+	if ts, ok := x.st.(timeSetter); ok && !modTime.IsZero() {
+		ts.Chtimes(target, modTime, modTime)
+	}
+	x.files++
+	return nil
+}
+
+// mkdir creates dir and the folders above it up to root
+func (x *extraction) mkdir(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := x.st.Stat(d); err == nil {
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		missing = append(missing, d)
+		if d == x.root {
+			break
+		}
+	}
+	if err := x.st.MkdirAll(dir); err != nil {
+		return err
+	}
+	slices.Reverse(missing)
+	x.created = append(x.created, missing...)
+	return nil
+}
+
+// cleanup removes what the extraction created, deepest first
+func (x *extraction) cleanup() error {
+	var first error
+	for _, path := range slices.Backward(x.created) {
+		if err := x.st.Remove(path); err != nil && first == nil {
+			first = err
+		}
+	}
+	x.created = nil
+	return first
+}
@@ -0,0 +1,428 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is a filesystem directory trees can live on: the local one, a remote
+// server reached through a URL such as sftp://nas/srv/sorted, or one added
+// with Mount, such as a MemFS. Every FS holds the paths below the root it
+// is mounted at, and its methods are given those full paths, with the
+// platform's separators, as the engine uses them. Errors should match
+// fs.ErrNotExist, fs.ErrExist and fs.ErrPermission where they apply.
+//
+// An FS that also has Chtimes or Chmod methods, as os has, keeps the
+// modification times and permissions of the files copied to it.
+type FS interface {
+	Open(name string) (File, error)
+	Create(name string) (io.WriteCloser, error) // Truncates existing files
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error) // Sorted by name
+	MkdirAll(name string) error
+	Rename(oldname, newname string) error // Fails when newname exists, where the FS can tell
+	Remove(name string) error             // Files and empty folders
+}
+
+// File is an open file of an FS, as *os.File is of the local one
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// timeSetter is implemented by storages that can set modification times
+type timeSetter interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// modeSetter is implemented by storages that can set permission bits
+type modeSetter interface {
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// remoteHasher is implemented by storages that can hash a file where it
+// is, sparing the transfer. errNoRemoteHash means the caller should read
+// the file instead.
+type remoteHasher interface {
+	Hash(name, algorithm string) (string, error)
+}
+
+var errNoRemoteHash = errors.New("remote hashing not available")
+
+// atomicStorage is implemented by storages whose Create only makes the file
+// appear once it is closed, with the server checking every byte against a
+// checksum sent along. Copies are written to them directly and not read
+// back.
+type atomicStorage interface {
+	atomicCreate()
+}
+
+// aborter is implemented by the writers of atomic storages, to give up on
+// a file without it appearing
+type aborter interface {
+	abort()
+}
+
+// remoteFileInfo describes a file or folder of a storage other than the
+// local filesystem
+type remoteFileInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (i *remoteFileInfo) Name() string       { return i.name }
+func (i *remoteFileInfo) Size() int64        { return i.size }
+func (i *remoteFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *remoteFileInfo) ModTime() time.Time { return i.mtime }
+func (i *remoteFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *remoteFileInfo) Sys() any           { return nil }
+
+// localStorage is the local filesystem
+type localStorage struct{}
+
+func (localStorage) Open(name string) (File, error)             { return os.Open(name) }
+func (localStorage) Create(name string) (io.WriteCloser, error) { return os.Create(name) }
+func (localStorage) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (localStorage) Lstat(name string) (fs.FileInfo, error)     { return os.Lstat(name) }
+func (localStorage) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (localStorage) MkdirAll(name string) error                 { return os.MkdirAll(name, os.ModePerm) }
+func (localStorage) Remove(name string) error                   { return os.Remove(name) }
+
+// Rename refuses to replace newname, as os.Rename would, unless it is
+// oldname itself under another case on a case-insensitive filesystem
+func (localStorage) Rename(oldname, newname string) error {
+	if info, err := os.Lstat(newname); err == nil {
+		if old, err := os.Lstat(oldname); err != nil || !os.SameFile(info, old) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrExist}
+		}
+	}
+	return os.Rename(oldname, newname)
+}
+
+func (localStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+func (localStorage) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+
+var local FS = localStorage{}
+
+// Storages other than the local filesystem, by the root they are mounted at
+var (
+	mountsMu sync.RWMutex
+	mounts   = make(map[string]FS)
+)
+
+// Mount makes fsys hold root, an absolute path such as /mem, and everything
+// below it in place of the local filesystem, so directories of Options can
+// be placed on it. A storage already mounted at root is replaced.
+func Mount(root string, fsys FS) {
+	mountsMu.Lock()
+	defer mountsMu.Unlock()
+	mounts[filepath.Clean(filepath.FromSlash(root))] = fsys
+}
+
+// Unmount undoes Mount
+func Unmount(root string) {
+	mountsMu.Lock()
+	defer mountsMu.Unlock()
+	delete(mounts, filepath.Clean(filepath.FromSlash(root)))
+}
+
+// storageAt returns the storage holding path
+func storageAt(path string) FS {
+	mountsMu.RLock()
+	defer mountsMu.RUnlock()
+	for root, st := range mounts {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return st
+		}
+	}
+	return local
+}
+
+// isRemote reports whether path lies on a storage other than the local
+// filesystem, which rules out local-only features such as the trash
+func isRemote(path string) bool {
+	return storageAt(path) != local
+}
+
+// remotePath returns the path on the server of a path below a mount root
+func remotePath(root, name string) string {
+	p := filepath.ToSlash(strings.TrimPrefix(name, root))
+	if p == "" {
+		return "/"
+	}
+	return path.Clean(p)
+}
+
+// mountDir turns a directory option into a path of the engine: remote URLs
+// such as sftp://user@host/srv/sorted, s3://bucket/sorted or
+// davs://user@cloud/remote.php/dav/files/user/Inbox get their storage
+// mounted and become paths below its root, local paths are made long on
+// Windows. Paths below a root given to Mount are kept.
+func mountDir(dir string, opts Options) (string, error) {
+	scheme, rest, ok := strings.Cut(dir, "://")
+	if !ok {
+		if dir := filepath.Clean(filepath.FromSlash(dir)); isRemote(dir) {
+			return dir, nil
+		}
+		return longPath(dir), nil
+	}
+	var (
+		root string
+		st   FS
+		p    string
+		err  error
+	)
+	switch scheme {
+	case "sftp":
+		root, st, p, err = newSFTPStorage(rest, opts.SSHCommand)
+	case "s3":
+		root, st, p, err = newS3Storage(rest, opts.S3Endpoint)
+	case "dav", "davs":
+		root, st, p, err = newWebDAVStorage(scheme, rest)
+	default:
+		return "", fmt.Errorf("unsupported storage %q in %s", scheme, dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid remote directory %s: %w", dir, err)
+	}
+
+	mountsMu.Lock()
+	defer mountsMu.Unlock()
+	if _, ok := mounts[root]; !ok {
+		mounts[root] = st
+	}
+	return root + filepath.FromSlash(p), nil
+}
+
+// walk calls fn for root and everything below it like filepath.Walk,
+// on whichever storage holds root
+func walk(root string, fn filepath.WalkFunc) error {
+	st := storageAt(root)
+	if st == local {
+		return filepath.Walk(root, fn)
+	}
+	info, err := st.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkStorage(st, root, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkStorage(st FS, name string, info fs.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+	entries, err := st.ReadDir(name)
+	err1 := fn(name, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, entry := range entries {
+		child := filepath.Join(name, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			if err := fn(child, info, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := walkStorage(st, child, info, fn); err != nil {
+			if !info.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkDir is walk for fs.WalkDirFunc callbacks, as filepath.WalkDir
+func walkDir(root string, fn fs.WalkDirFunc) error {
+	if !isRemote(root) {
+		return filepath.WalkDir(root, fn)
+	}
+	return walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return fn(path, nil, err)
+		}
+		return fn(path, fs.FileInfoToDirEntry(info), nil)
+	})
+}
+
+// readFile is os.ReadFile on whichever storage holds name
+func readFile(name string) ([]byte, error) {
+	f, err := storageAt(name).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFile replaces name with data, creating the folder it goes in. Local
+// files are written through a temporary file renamed over them so a crash
+// never leaves half of one behind; other storages don't replace files by
+// renaming and get them written in place.
+func writeFile(name string, data []byte) error {
+	st := storageAt(name)
+	if err := st.MkdirAll(filepath.Dir(name)); err != nil {
+		return err
+	}
+	if st == local {
+		tmp := name + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, name)
+	}
+	w, err := st.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// glob returns the paths of the entries of dir whose names match pattern,
+// sorted, as filepath.Glob on whichever storage holds dir
+func glob(dir, pattern string) ([]string, error) {
+	entries, err := storageAt(dir).ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, entry := range entries {
+		if ok, err := filepath.Match(pattern, entry.Name()); err != nil {
+			return nil, err
+		} else if ok {
+			matches = append(matches, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return matches, nil
+}
+
+// renamePath moves a file within one storage
+func renamePath(oldname, newname string) error {
+	st := storageAt(oldname)
+	if storageAt(newname) != st {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errCrossStorage}
+	}
+	return st.Rename(oldname, newname)
+}
+
+// errCrossStorage is how renamePath reports files on different storages,
+// which isCrossDevice recognizes so they are copied instead
+var errCrossStorage = errors.New("source and destination are on different storages")
+
+// rangeFile is a file of an HTTP storage opened for reading. Reads stream
+// the file from the current offset, ReadAt requests the range it needs.
+type rangeFile struct {
+	name   string
+	info   *remoteFileInfo
+	get    func(off, end int64) (io.ReadCloser, error) // Content from off to end (exclusive)
+	offset int64
+	body   io.ReadCloser // Response from offset on
+}
+
+func (f *rangeFile) open(off, end int64) (io.ReadCloser, error) {
+	body, err := f.get(off, end)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return body, nil
+}
+
+func (f *rangeFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.open(f.offset, f.info.size)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF {
+		f.body.Close()
+		f.body = nil
+		if f.offset < f.info.size {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (f *rangeFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), f.info.size)
+	body, err := f.open(off, end)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *rangeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *rangeFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *rangeFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package sorter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// DefaultHashAlgorithm is the fast, non-cryptographic hash used unless
+// Options.HashAlgorithm says otherwise
+const DefaultHashAlgorithm = "xxh64"
+
+// Hasher creates the hash that file contents are compared with
+type Hasher interface {
+	New() hash.Hash
+}
+
+// HasherFunc adapts a hash constructor such as sha256.New to a Hasher
+type HasherFunc func() hash.Hash
+
+func (f HasherFunc) New() hash.Hash { return f() }
+
+var xxh64 = HasherFunc(func() hash.Hash { return xxhash.New() })
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[string]Hasher{
+		"xxh64":  xxh64,
+		"xxh3":   HasherFunc(func() hash.Hash { return newXXH3() }),
+		"sha256": HasherFunc(sha256.New),
+		"blake3": HasherFunc(newBLAKE3),
+	}
+)
+
+// RegisterHasher makes a hash algorithm available to Options.HashAlgorithm
+// under name, e.g. to use an algorithm from a third-party package. It
+// replaces any algorithm registered under the same name.
+func RegisterHasher(name string, h Hasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	hashers[name] = h
+}
+
+// HashAlgorithms lists the registered hash algorithms by name
+func HashAlgorithms() []string {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	return slices.Sorted(maps.Keys(hashers))
+}
+
+// lookupHasher returns the hasher registered under name, the default one
+// when name is empty
+func lookupHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = DefaultHashAlgorithm
+	}
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q: must be one of %s", name, strings.Join(slices.Sorted(maps.Keys(hashers)), ", "))
+	}
+	return namedHasher{h, name}, nil
+}
+
+// namedHasher is a registered hasher along with its name, by which remote
+// storages know what to hash with
+type namedHasher struct {
+	Hasher
+	name string
+}
+
+// hashFile hashes the first limit bytes of a file, or all of it when limit
+// is negative, and returns the digest in hex. It stops midway when ctx is
+// done. 64-bit hashes, XXH64 and XXH3, are written without leading zeros,
+// as XXH64 hashes always have been.
+//
+// Large files on remote storages are hashed by the server where it can.
+func hashFile(ctx context.Context, filePath string, hasher Hasher, limit int64) (string, error) {
+	defer trackRead(ctx, filePath)()
+	st := storageAt(filePath)
+	named, ok := hasher.(namedHasher)
+	if rh, remote := st.(remoteHasher); ok && remote && limit < 0 {
+		if info, err := st.Stat(filePath); err == nil && info.Size() >= remoteHashMin {
+			if digest, err := rh.Hash(filePath, named.name); err != errNoRemoteHash {
+				return digest, err
+			}
+		}
+	}
+
+	file, err := st.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+	h := hasher.New()
+	if _, err := copyBuffered(ctx, h, r, filePath); err != nil {
+		return "", err
+	}
+	if h64, ok := h.(hash.Hash64); ok {
+		return fmt.Sprintf("%x", h64.Sum64()), nil
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
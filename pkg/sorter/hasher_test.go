@@ -0,0 +1,53 @@
+package sorter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"testing"
+)
+
+func TestHashers(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		in        string
+		want      string
+	}{
+		{"xxh3", "", "2d06800538d394c2"},
+		{"xxh3", "a", "e6c632b61e964e1f"},
+		{"xxh3", "abcd", "6497a96f53a89890"},
+		{"xxh3", "hello world", "d447b1ea40e6988b"},
+		{"xxh3", strings.Repeat("0123456789", 20), "afadba07e1698882"},
+		{"xxh3", strings.Repeat("0123456789", 500), "4000d9d7d361ce12"},
+		{"blake3", "", "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{"blake3", "a", "17762fddd969a453925d65717ac3eea21320b66b54342fde15128d6caf21215f"},
+		{"blake3", "abcd", "8c9c9881805d1a847102d7a42e58b990d088dd88a84f7314d71c838107571f2b"},
+		{"blake3", "hello world", "d74981efa70a0c880b8d8c1985d075dbcbf679b99a5f9914e5aaf96b831a9e24"},
+		{"blake3", strings.Repeat("0123456789", 20), "f3e34b46120da6acc341b179e03e162b6b153fcbed3382d1d73d87f4fb6051d0"},
+		{"blake3", strings.Repeat("0123456789", 500), "66357ec3a42b74e35b8b0ae26ee44356a96ca636ec89a691573cdaaa248b5cd9"},
+	}
+	for _, tt := range tests {
+		hasher, err := lookupHasher(tt.algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Whole, then a byte at a time across blocks and chunks
+		for _, step := range []int{len(tt.in) + 1, 1} {
+			h := hasher.New()
+			for i := 0; i < len(tt.in); i += step {
+				h.Write([]byte(tt.in[i:min(i+step, len(tt.in))]))
+			}
+			if got := hexDigest(h); got != tt.want {
+				t.Errorf("%s of %d bytes written %d at a time = %s, want %s", tt.algorithm, len(tt.in), step, got, tt.want)
+			}
+		}
+	}
+}
+
+func hexDigest(h hash.Hash) string {
+	if h64, ok := h.(hash.Hash64); ok {
+		return fmt.Sprintf("%016x", h64.Sum64())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,381 @@
+package sorter
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// hashIndex is the persistent record of the sorted files' full hashes,
+// keyed by their slash-separated path relative to the sorted directory
+type hashIndex struct {
+	Algorithm string                `json:"algorithm,omitempty"` // xxh64 when empty
+	Count     int                   `json:"count,omitempty"`     // Files, and bytes, found by the Index that wrote it
+	Bytes     int64                 `json:"bytes,omitempty"`
+	Files     map[string]indexEntry `json:"files"` // Last, so scanHashIndex sees the rest first
+}
+
+// indexEntry is what a sorted file looked like when it was indexed
+type indexEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+	Partial string    `json:"partial,omitempty"` // Hash of the first 64KB, when the file is larger
+}
+
+// loadHashIndex reads Options.IndexFile, returning an empty index when it
+// doesn't exist yet
+func (s *Sorter) loadHashIndex() (*hashIndex, error) {
+	ix := &hashIndex{Files: make(map[string]indexEntry)}
+	data, err := readFile(s.opts.IndexFile)
+	if os.IsNotExist(err) {
+		return ix, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, ix); err != nil {
+		return nil, fmt.Errorf("invalid hash index %s: %w", s.opts.IndexFile, err)
+	}
+	if ix.Files == nil {
+		ix.Files = make(map[string]indexEntry)
+	}
+	return ix, nil
+}
+
+// saveHashIndex writes the index through a temporary file so a crash never
+// leaves half of one behind
+func (s *Sorter) saveHashIndex(ix *hashIndex) error {
+	data, err := json.Marshal(ix)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.opts.IndexFile, data)
+}
+
+// reuseIndexedHashes fills in the hashes of sorted files whose size and
+// modification time still match their entry in Options.IndexFile, so runs
+// don't read them again
+func (s *Sorter) reuseIndexedHashes(files []*indexedFile) error {
+	if s.opts.IndexFile == "" || len(files) == 0 {
+		return nil
+	}
+	byKey := make(map[string]*indexedFile, len(files))
+	for _, file := range files {
+		byKey[s.indexKey(file.path)] = file
+	}
+	reused := 0
+	err := s.scanHashIndex(func(head *hashIndex) bool {
+		return cmp.Or(head.Algorithm, DefaultHashAlgorithm) == s.opts.HashAlgorithm
+	}, func(key string, entry indexEntry) {
+		file, ok := byKey[key]
+		if !ok || file.full != "" || entry.Size != file.size || !entry.ModTime.Equal(file.modTime) {
+			return
+		}
+		if entry.Partial == "" && file.size > partialHashSize {
+			return // Indexed before partial hashes were recorded
+		}
+		file.partial, file.full = cmp.Or(entry.Partial, entry.Hash), entry.Hash
+		reused++
+	})
+	s.log.Debug("Reused hashes of the hash index", "files", reused)
+	return err
+}
+
+// lastIndexed returns how many files and bytes the last Index found, or
+// zeros when unknown
+func (s *Sorter) lastIndexed() (int, int64) {
+	var files int
+	var bytes int64
+	if s.opts.IndexFile != "" {
+		s.scanHashIndex(func(head *hashIndex) bool {
+			files, bytes = head.Count, head.Bytes
+			return false
+		}, nil)
+	}
+	return files, bytes
+}
+
+// scanHashIndex streams Options.IndexFile rather than loading it, which
+// keeps memory bounded however many files it holds. head is given the
+// fields before the files, and entry, unless head returns false, every
+// file. A missing index holds nothing.
+func (s *Sorter) scanHashIndex(head func(*hashIndex) bool, entry func(key string, entry indexEntry)) error {
+	f, err := storageAt(s.opts.IndexFile).Open(s.opts.IndexFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	invalid := func(err error) error {
+		return fmt.Errorf("invalid hash index %s: %w", s.opts.IndexFile, err)
+	}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return invalid(cmp.Or(err, errors.New("not an object")))
+	}
+	var ix hashIndex
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return invalid(err)
+		}
+		switch tok {
+		case "algorithm":
+			err = dec.Decode(&ix.Algorithm)
+		case "count":
+			err = dec.Decode(&ix.Count)
+		case "bytes":
+			err = dec.Decode(&ix.Bytes)
+		case "files":
+			if !head(&ix) {
+				return nil
+			}
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+				return invalid(cmp.Or(err, errors.New("files is not an object")))
+			}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return invalid(err)
+				}
+				var e indexEntry
+				if err := dec.Decode(&e); err != nil {
+					return invalid(err)
+				}
+				entry(key.(string), e)
+			}
+			_, err = dec.Token()
+		default:
+			err = dec.Decode(new(json.RawMessage))
+		}
+		if err != nil {
+			return invalid(err)
+		}
+	}
+	return nil
+}
+
+// IndexedFile is a sorted file as the last Index recorded it
+type IndexedFile struct {
+	Path    string    `json:"path"` // Slash-separated, relative to the sorted directory
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// Indexed calls fn with every file of the hash index (see Index), in no
+// particular order, until it returns false
+func (s *Sorter) Indexed(fn func(IndexedFile) bool) error {
+	more := true
+	return s.scanHashIndex(func(*hashIndex) bool { return true }, func(key string, e indexEntry) {
+		if more {
+			more = fn(IndexedFile{Path: key, Size: e.Size, ModTime: e.ModTime, Hash: e.Hash})
+		}
+	})
+}
+
+// indexKey is the key of a sorted file in the hash index
+func (s *Sorter) indexKey(path string) string {
+	rel, err := filepath.Rel(s.opts.SortedDir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// updateHashIndex records the full and partial hashes of every sorted file
+// in Options.IndexFile, and writes the filter runs check first (see
+// hashFilter). Files whose size and modification time match their entry
+// keep it without being read again; entries of files that are gone are
+// dropped.
+func (s *Sorter) updateHashIndex(files []*indexedFile, hasher *dupIndex) error {
+	ix, err := s.loadHashIndex()
+	if err != nil {
+		return err
+	}
+	if algorithm := cmp.Or(ix.Algorithm, DefaultHashAlgorithm); algorithm != s.opts.HashAlgorithm && len(ix.Files) > 0 {
+		s.log.Warn("Hash algorithm changed, hashing every file again", "index", algorithm, "algorithm", s.opts.HashAlgorithm)
+		clear(ix.Files)
+	}
+	ix.Algorithm = s.opts.HashAlgorithm
+	ix.Count, ix.Bytes = len(files), 0
+	for _, f := range files {
+		ix.Bytes += f.size
+	}
+
+	var stale, noPartial []*indexedFile
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		key := s.indexKey(f.path)
+		seen[key] = true
+		entry, ok := ix.Files[key]
+		switch {
+		case !ok || entry.Size != f.size || !entry.ModTime.Equal(f.modTime):
+			stale = append(stale, f)
+		case entry.Partial == "" && f.size > partialHashSize:
+			f.full = entry.Hash // Indexed before partial hashes were recorded
+			noPartial = append(noPartial, f)
+		}
+	}
+	removed := 0
+	for key := range ix.Files {
+		if !seen[key] {
+			delete(ix.Files, key)
+			removed++
+		}
+	}
+
+	var totalBytes int64
+	for _, f := range stale {
+		totalBytes += f.size
+	}
+	progress := s.newProgress("Hashing", len(stale), totalBytes)
+	hasher.hashIndexed(stale, hasher.fullHash, progress, func(f *indexedFile, hash string) { f.full = hash })
+	progress.finish()
+	needPartial := noPartial
+	for _, f := range stale {
+		if f.full != "" && f.size > partialHashSize {
+			needPartial = append(needPartial, f)
+		}
+	}
+	hasher.hashIndexed(needPartial, hasher.partialHash, nil, func(f *indexedFile, hash string) { f.partial = hash })
+
+	hashed := 0
+	for _, f := range append(stale, noPartial...) {
+		if f.full == "" || f.size > partialHashSize && f.partial == "" {
+			if f.err != nil {
+				s.log.Error("Failed to hash file", "path", f.path, "err", f.err)
+				s.emitError(f.path, f.err)
+			}
+			continue
+		}
+		entry := indexEntry{Size: f.size, ModTime: f.modTime, Hash: f.full}
+		if f.size > partialHashSize {
+			entry.Partial = f.partial
+		}
+		ix.Files[s.indexKey(f.path)] = entry
+		hashed++
+	}
+
+	s.log.Info("Hash index updated", "path", s.opts.IndexFile, "files", len(ix.Files), "hashed", hashed, "removed", removed)
+	if s.opts.DryRun {
+		return nil
+	}
+	if err := s.saveHashIndex(ix); err != nil {
+		return err
+	}
+	return s.saveHashFilter(s.buildHashFilter(ix))
+}
+
+// VerifyResult lists the sorted files whose content no longer matches the
+// hash index
+type VerifyResult struct {
+	Checked   int      `json:"checked"`
+	Corrupted []string `json:"corrupted"` // Content changed while size and modification time didn't, e.g. bit rot
+	Modified  []string `json:"modified"`  // Changed along with its modification time or size
+	Missing   []string `json:"missing"`   // Indexed but gone
+	Unindexed int      `json:"unindexed"` // Present but not indexed yet
+}
+
+// OK reports whether every indexed file was found intact
+func (r *VerifyResult) OK() bool {
+	return len(r.Corrupted) == 0 && len(r.Modified) == 0 && len(r.Missing) == 0
+}
+
+// Verify re-hashes every file recorded in the hash index (see Index), with
+// the algorithm the index was built with, and reports those whose content
+// changed or that went missing. The index isn't updated, so a change keeps
+// being reported until the next Index.
+func (s *Sorter) Verify() (*VerifyResult, error) {
+	if s.opts.IndexFile == "" {
+		return nil, &ConfigError{errors.New("no hash index file configured")}
+	}
+	if _, err := storageAt(s.opts.IndexFile).Stat(s.opts.IndexFile); os.IsNotExist(err) {
+		return nil, &ConfigError{fmt.Errorf("no hash index at %s yet, index the sorted directory first", s.opts.IndexFile)}
+	}
+	ix, err := s.loadHashIndex()
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := lookupHasher(ix.Algorithm)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("hash index %s: %w", s.opts.IndexFile, err)}
+	}
+	sorted, err := s.collectSortedFiles(nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error collecting sorted files: %w", err)
+	}
+	s.failed = 0
+
+	result := &VerifyResult{}
+	present := make(map[string]*indexedFile)
+	for _, f := range sorted.files() {
+		key := s.indexKey(f.path)
+		if _, ok := ix.Files[key]; ok {
+			present[key] = f
+		} else {
+			result.Unindexed++
+		}
+	}
+
+	var check []*indexedFile
+	var totalBytes int64
+	for key := range ix.Files {
+		if f, ok := present[key]; ok {
+			check = append(check, f)
+			totalBytes += f.size
+		} else {
+			path := filepath.Join(s.opts.SortedDir, filepath.FromSlash(key))
+			result.Missing = append(result.Missing, path)
+			s.log.Warn("Indexed file is missing", "path", path)
+			s.emit(Event{Type: EventError, Path: path, Error: "missing"})
+		}
+	}
+	progress := s.newProgress("Verifying", len(check), totalBytes)
+	sorted.hashIndexed(check, func(path string) (string, error) { return hashFile(s.ctx, path, hasher, -1) }, progress, func(f *indexedFile, hash string) { f.full = hash })
+	progress.finish()
+	if s.stopped() {
+		return result, s.aborted()
+	}
+
+	for _, f := range check {
+		if f.err != nil {
+			s.log.Error("Failed to hash file", "path", f.path, "err", f.err)
+			s.emitError(f.path, f.err)
+			continue
+		}
+		result.Checked++
+		entry := ix.Files[s.indexKey(f.path)]
+		switch {
+		case f.full == entry.Hash:
+		case f.size == entry.Size && f.modTime.Equal(entry.ModTime):
+			result.Corrupted = append(result.Corrupted, f.path)
+			s.log.Error("Content changed without a new modification time, possible corruption", "path", f.path)
+			s.emit(Event{Type: EventError, Path: f.path, Size: f.size, Error: "corrupted"})
+		default:
+			result.Modified = append(result.Modified, f.path)
+			s.log.Warn("File modified since it was indexed", "path", f.path, "indexed", entry.ModTime, "modified", f.modTime)
+			s.emit(Event{Type: EventError, Path: f.path, Size: f.size, Error: "modified"})
+		}
+	}
+	slices.Sort(result.Corrupted)
+	slices.Sort(result.Modified)
+	slices.Sort(result.Missing)
+
+	s.log.Info("Verification completed", "checked", result.Checked, "corrupted", len(result.Corrupted),
+		"modified", len(result.Modified), "missing", len(result.Missing), "unindexed", result.Unindexed)
+	if s.failed > 0 {
+		return result, &PartialError{Failed: s.failed}
+	}
+	return result, nil
+}
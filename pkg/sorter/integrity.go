@@ -0,0 +1,360 @@
+package sorter
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultCorruptCategory is where the CLI sends files CheckIntegrity finds
+// damaged
+const DefaultCorruptCategory = "Quarantine/Corrupt"
+
+// Formats CheckIntegrity knows how to check, by the MIME type of their
+// content
+var integrityChecks = map[string]func(f File, size int64) (string, error){
+	"image/jpeg":                  checkJPEG,
+	"image/png":                   checkPNG,
+	"image/gif":                   checkGIF,
+	"application/pdf":             checkPDF,
+	"application/zip":             checkZip,
+	"application/x-7z-compressed": check7z,
+	"video/mp4":                   checkBMFF(true),
+	"video/quicktime":             checkBMFF(true),
+	"video/x-m4v":                 checkBMFF(true),
+	"audio/mp4":                   checkBMFF(true),
+	"image/heic":                  checkBMFF(false),
+	"image/avif":                  checkBMFF(false),
+}
+
+// Extensions that claim a format CheckIntegrity checks, by its name
+var integrityExts = map[string]string{
+	"jpg": "JPEG", "jpeg": "JPEG", "png": "PNG", "gif": "GIF", "pdf": "PDF",
+	"zip": "zip", "docx": "zip", "xlsx": "zip", "pptx": "zip", "epub": "zip",
+	"7z": "7z", "mp4": "MP4", "m4v": "MP4", "m4a": "MP4", "mov": "QuickTime",
+}
+
+// How much of the end of a file paddingCheck looks at
+const paddingSize = 1024
+
+// CheckIntegrity reports what is wrong with a file that doesn't parse as
+// the format its content claims: truncated zips, JPEGs without an end of
+// image marker, videos cut off mid-box, files padded with zeros by an
+// unfinished download. A file whose extension names a checked format but
+// whose content is unrecognizable or text, such as an error page saved in
+// its place, is damaged as well. Intact files and formats it doesn't know
+// give "".
+func CheckIntegrity(filePath string) (problem string, err error) {
+	mimeType, _, err := DetectType(filePath)
+	if err != nil {
+		return "", err
+	}
+	check := integrityChecks[mimeType]
+	if check == nil {
+		ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filePath)), ".")
+		unknown := mimeType == "application/octet-stream" || strings.HasPrefix(mimeType, "text/")
+		if format := integrityExts[ext]; format != "" && unknown {
+			return fmt.Sprintf("not a %s file: content is %s", format, mimeType), nil
+		}
+		return "", nil
+	}
+
+	f, err := storageAt(filePath).Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	problem, err = check(f, info.Size())
+	if problem == "" || err != nil {
+		return "", err
+	}
+	if padding := paddingCheck(f, info.Size()); padding != "" {
+		problem += ", " + padding
+	}
+	return problem, nil
+}
+
+// paddingCheck says so when a file ends in a run of zero or 0xFF bytes,
+// which downloads reserve space with
+func paddingCheck(f File, size int64) string {
+	if size < paddingSize {
+		return ""
+	}
+	tail := make([]byte, paddingSize)
+	if _, err := f.ReadAt(tail, size-paddingSize); err != nil {
+		return ""
+	}
+	for _, pad := range []byte{0x00, 0xFF} {
+		if len(bytes.Trim(tail, string(pad))) == 0 {
+			return fmt.Sprintf("ends in 0x%02X padding (an unfinished download?)", pad)
+		}
+	}
+	return ""
+}
+
+// checkJPEG follows the segments of a JPEG through its scans to the end of
+// image marker
+func checkJPEG(f File, size int64) (string, error) {
+	const truncated = "truncated: no end of image marker"
+	r := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	if _, err := r.Discard(2); err != nil { // Start of image, sniffed
+		return truncated, nil
+	}
+	var marker byte
+	scanned := false // marker ended the last scan
+	for {
+		if !scanned {
+			b, err := r.ReadByte()
+			if err != nil {
+				return truncated, nil
+			}
+			if b != 0xFF {
+				return "invalid segment marker", nil
+			}
+			if marker, err = skipFill(r); err != nil {
+				return truncated, nil
+			}
+		}
+		scanned = false
+		switch {
+		case marker == 0xD9: // End of image
+			return "", nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01: // No length
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return truncated, nil
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return fmt.Sprintf("invalid length of marker 0x%02X", marker), nil
+		}
+		if _, err := r.Discard(n - 2); err != nil {
+			return truncated, nil
+		}
+		if marker != 0xDA { // Not a start of scan
+			continue
+		}
+
+		// Entropy-coded data runs up to the next marker: 0xFF followed by
+		// anything but a stuffed zero or a restart marker
+		for !scanned {
+			b, err := r.ReadByte()
+			if err != nil {
+				return truncated, nil
+			}
+			if b != 0xFF {
+				continue
+			}
+			if marker, err = skipFill(r); err != nil {
+				return truncated, nil
+			}
+			scanned = marker != 0x00 && (marker < 0xD0 || marker > 0xD7)
+		}
+	}
+}
+
+// skipFill reads the byte after the 0xFF starting a JPEG marker, skipping
+// the 0xFF bytes markers may be padded with
+func skipFill(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil || b != 0xFF {
+			return b, err
+		}
+	}
+}
+
+// checkPNG follows the chunks of a PNG to its IEND chunk
+func checkPNG(f File, size int64) (string, error) {
+	pos := int64(8) // After the signature
+	var head [8]byte
+	for {
+		if _, err := f.ReadAt(head[:], pos); err != nil {
+			return "truncated: no IEND chunk", nil
+		}
+		length, typ := int64(binary.BigEndian.Uint32(head[:4])), string(head[4:])
+		if typ == "IEND" {
+			return "", nil
+		}
+		if !isChunkType(typ) {
+			return fmt.Sprintf("invalid chunk at offset %d", pos), nil
+		}
+		if pos += 12 + length; pos > size { // Length, type, data and CRC
+			return fmt.Sprintf("truncated in %s chunk", typ), nil
+		}
+	}
+}
+
+// isChunkType reports whether a PNG chunk type is made of letters
+func isChunkType(typ string) bool {
+	for _, c := range []byte(typ) {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkGIF follows the blocks of a GIF to its end. A GIF that stops right
+// after a whole block without the trailer still displays, so only one cut
+// off inside a block counts as truncated.
+func checkGIF(f File, size int64) (string, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	var screen [13]byte // Header and logical screen descriptor
+	if _, err := io.ReadFull(r, screen[:]); err != nil {
+		return "truncated in the header", nil
+	}
+	if screen[10]&0x80 != 0 { // Global color table
+		if _, err := r.Discard(3 << (screen[10]&0x07 + 1)); err != nil {
+			return "truncated in the color table", nil
+		}
+	}
+	for {
+		introducer, err := r.ReadByte()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		switch introducer {
+		case 0x3B: // Trailer
+			return "", nil
+		case 0x21: // Extension: its label, then data sub-blocks
+			if _, err := r.Discard(1); err != nil {
+				return "truncated in an extension", nil
+			}
+		case 0x2C: // Image: its descriptor, color table and code size
+			var desc [9]byte
+			if _, err := io.ReadFull(r, desc[:]); err != nil {
+				return "truncated in an image descriptor", nil
+			}
+			table := 0
+			if desc[8]&0x80 != 0 {
+				table = 3 << (desc[8]&0x07 + 1)
+			}
+			if _, err := r.Discard(table + 1); err != nil {
+				return "truncated in an image descriptor", nil
+			}
+		default:
+			return "invalid block", nil
+		}
+		for { // Sub-blocks, up to an empty one
+			n, err := r.ReadByte()
+			if err == nil && n > 0 {
+				_, err = r.Discard(int(n))
+			}
+			if err != nil {
+				return "truncated: cut off inside a block", nil
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// checkPDF looks for the %%EOF marker in the last kilobyte, where the
+// specification has it
+func checkPDF(f File, size int64) (string, error) {
+	tail := make([]byte, min(size, 1024))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return "", err
+	}
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return "truncated: no %%EOF marker", nil
+	}
+	return "", nil
+}
+
+// checkZip reads the central directory at the end of a zip
+func checkZip(f File, size int64) (string, error) {
+	if _, err := zip.NewReader(f, size); err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return "unreadable zip: " + strings.TrimPrefix(err.Error(), "zip: "), nil
+	}
+	return "", nil
+}
+
+// check7z checks that the header a 7z ends with is there
+func check7z(f File, size int64) (string, error) {
+	start := make([]byte, 32)
+	if _, err := f.ReadAt(start, 0); err != nil {
+		return "truncated: no start header", nil
+	}
+	offset := binary.LittleEndian.Uint64(start[12:])
+	length := binary.LittleEndian.Uint64(start[20:])
+	if offset > uint64(size) || length > uint64(size) || 32+offset+length > uint64(size) {
+		return "truncated: header past the end of the file", nil
+	}
+	if length == 0 {
+		return "", nil // Empty archive
+	}
+	id := make([]byte, 1)
+	if _, err := f.ReadAt(id, int64(32+offset)); err != nil {
+		return "", err
+	}
+	if id[0] != sz7Header && id[0] != sz7EncodedHeader {
+		return "invalid header", nil
+	}
+	return "", nil
+}
+
+// checkBMFF follows the top-level boxes of an MP4, QuickTime or HEIF file
+// to its end, requiring a moov box (the index of the media) when movie is
+// set
+func checkBMFF(movie bool) func(f File, size int64) (string, error) {
+	return func(f File, size int64) (string, error) {
+		var head [16]byte
+		hasMoov := false
+		for pos := int64(0); pos < size; {
+			if _, err := f.ReadAt(head[:8], pos); err != nil {
+				return fmt.Sprintf("truncated box header at offset %d", pos), nil
+			}
+			boxSize, typ := int64(binary.BigEndian.Uint32(head[:4])), string(head[4:8])
+			header := int64(8)
+			switch boxSize {
+			case 0: // Runs to the end of the file
+				boxSize = size - pos
+			case 1: // 64-bit size
+				if _, err := f.ReadAt(head[8:16], pos+8); err != nil {
+					return fmt.Sprintf("truncated box header at offset %d", pos), nil
+				}
+				boxSize, header = int64(binary.BigEndian.Uint64(head[8:16])), 16
+			}
+			if boxSize < header || !isBoxType(typ) {
+				return fmt.Sprintf("invalid box at offset %d", pos), nil
+			}
+			if pos+boxSize > size || pos+boxSize < pos {
+				return fmt.Sprintf("truncated in %s box", typ), nil
+			}
+			hasMoov = hasMoov || typ == "moov"
+			pos += boxSize
+		}
+		if movie && !hasMoov {
+			return "no moov box, the index of the media", nil
+		}
+		return "", nil
+	}
+}
+
+// isBoxType reports whether a box type is printable, as real ones are
+func isBoxType(typ string) bool {
+	for _, c := range []byte(typ) {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package sorter
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// openForWriting lists the files processes have open for writing, as found
+// in /proc. Without root, only the user's own processes can be seen.
+func openForWriting() func(path string) bool {
+	writing := make(map[string]bool)
+	procs, _ := os.ReadDir("/proc")
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil || proc.Name() == strconv.Itoa(os.Getpid()) {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Gone, or someone else's
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(target, "/") || writing[target] {
+				continue
+			}
+			if fdWritable(filepath.Join("/proc", proc.Name(), "fdinfo", fd.Name())) {
+				writing[target] = true
+			}
+		}
+	}
+	return func(path string) bool {
+		abs, err := filepath.Abs(path)
+		return err == nil && writing[abs]
+	}
+}
+
+// fdWritable reads the open flags of a file descriptor from its fdinfo
+func fdWritable(fdinfo string) bool {
+	data, err := os.ReadFile(fdinfo)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "flags:"); ok {
+			flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 64)
+			return err == nil && flags&syscall.O_ACCMODE != syscall.O_RDONLY
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package sorter
+
+import (
+	"errors"
+	"syscall"
+)
+
+const errorSharingViolation syscall.Errno = 32
+
+// openForWriting tries to open files sharing them for reading only, which
+// Windows refuses while another process has them open for writing (or
+// locked against readers)
+func openForWriting() func(path string) bool {
+	return func(path string) bool {
+		name, err := syscall.UTF16PtrFromString(path)
+		if err != nil {
+			return false
+		}
+		handle, err := syscall.CreateFile(name, syscall.GENERIC_READ, syscall.FILE_SHARE_READ, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err != nil {
+			return errors.Is(err, errorSharingViolation)
+		}
+		syscall.CloseHandle(handle)
+		return false
+	}
+}
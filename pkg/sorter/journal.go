@@ -0,0 +1,197 @@
+package sorter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalEntry records a single change made to disk during a run
+type JournalEntry struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"` // "move", "trash" or "rmdir"
+	Src         string    `json:"src"`
+	Dest        string    `json:"dest,omitempty"`
+	Reason      string    `json:"reason"`                 // "sorted", "duplicate", "restored", "empty-folder", ...
+	DuplicateOf string    `json:"duplicate_of,omitempty"` // The file a duplicate matched
+}
+
+// journal records the changes of one run in its own file under dir. The
+// file is opened lazily on the first change.
+type journal struct {
+	dir    string
+	dryRun bool
+	log    *slog.Logger
+
+	mu   sync.Mutex
+	path string
+	file io.WriteCloser
+}
+
+// record appends an entry to the current run's journal. Failing to journal
+// doesn't stop the run, but is reported since undo won't be complete.
+func (j *journal) record(entry JournalEntry) {
+	if j.dryRun || j.dir == "" {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		st := storageAt(j.dir)
+		if err := st.MkdirAll(j.dir); err != nil {
+			j.log.Error("Failed to create journal folder", "dir", j.dir, "err", err)
+			return
+		}
+		path := filepath.Join(j.dir, "run-"+time.Now().Format("20060102-150405.000")+".jsonl")
+		var file io.WriteCloser
+		var err error
+		if st == local {
+			file, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		} else {
+			file, err = st.Create(path)
+		}
+		if err != nil {
+			j.log.Error("Failed to create journal", "err", err)
+			return
+		}
+		j.path, j.file = path, file
+	}
+
+	entry.Time = time.Now()
+	if err := json.NewEncoder(j.file).Encode(entry); err != nil {
+		j.log.Error("Failed to write journal", "path", j.path, "err", err)
+	}
+}
+
+// close finishes the current run's journal
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+// latest returns the most recent journal that hasn't been undone yet
+func (j *journal) latest() (string, error) {
+	if j.dir == "" {
+		return "", errors.New("journaling is disabled")
+	}
+	matches, err := glob(j.dir, "run-*.jsonl")
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", errors.New("no run to undo")
+	}
+	return matches[len(matches)-1], nil // Names start with a sortable timestamp
+}
+
+func readJournal(path string) ([]JournalEntry, error) {
+	file, err := storageAt(path).Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Undo replays the latest journal in reverse, moving every file back to
+// where it was and recreating removed folders. Entries that are already
+// restored are skipped, so an interrupted undo can simply be run again.
+func (s *Sorter) Undo() error {
+	path, err := s.journal.latest()
+	if err != nil {
+		return err
+	}
+	entries, err := readJournal(path)
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	s.log.Info("Undoing run", "changes", len(entries), "journal", path)
+
+	failed := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := s.undoEntry(entries[i]); err != nil {
+			s.log.Error("Failed to undo change", "action", entries[i].Action, "src", entries[i].Src, "err", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		s.log.Error("Some changes could not be undone, keeping the journal", "journal", path)
+		return &PartialError{Failed: failed}
+	}
+	if s.opts.DryRun {
+		return nil
+	}
+
+	// Mark the journal as undone so the next undo steps further back
+	return renamePath(path, strings.TrimSuffix(path, ".jsonl")+".undone")
+}
+
+func (s *Sorter) undoEntry(entry JournalEntry) error {
+	switch entry.Action {
+	case "rmdir":
+		if s.opts.DryRun {
+			s.log.Info("Would recreate folder", "dir", entry.Src)
+			return nil
+		}
+		return storageAt(entry.Src).MkdirAll(entry.Src)
+	case "move", "trash":
+		if entry.Dest == "" {
+			return fmt.Errorf("%s went to the Recycle Bin, restore it from there", entry.Src)
+		}
+		srcStorage := storageAt(entry.Src)
+		if _, err := storageAt(entry.Dest).Stat(entry.Dest); os.IsNotExist(err) {
+			if _, err := srcStorage.Stat(entry.Src); err == nil {
+				return nil // Already restored
+			}
+			return fmt.Errorf("%s no longer exists", entry.Dest)
+		}
+		if _, err := srcStorage.Stat(entry.Src); err == nil {
+			return fmt.Errorf("refusing to overwrite %s", entry.Src)
+		}
+		if s.opts.DryRun {
+			s.log.Info("Would restore", "src", entry.Dest, "dest", entry.Src)
+			return nil
+		}
+		if err := srcStorage.MkdirAll(filepath.Dir(entry.Src)); err != nil {
+			return err
+		}
+		if err := s.renameFile(entry.Dest, entry.Src); err != nil {
+			return err
+		}
+		if entry.Action == "trash" {
+			removeTrashInfo(entry.Dest)
+		}
+		s.log.Info("Restored", "path", entry.Src)
+		return nil
+	default:
+		return fmt.Errorf("unknown journal action %q", entry.Action)
+	}
+}
@@ -0,0 +1,132 @@
+package sorter
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fileDate returns the date a file is filed under: when the photo was taken
+// for images carrying EXIF data, otherwise its modification time
+func fileDate(filePath string) (time.Time, error) {
+	if date, err := exifDate(filePath); err == nil {
+		return date, nil
+	}
+
+	info, err := storageAt(filePath).Stat(filePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// layoutPlaceholder matches the {name} placeholders of a layout
+var layoutPlaceholder = regexp.MustCompile(`\{[a-z0-9]+\}`)
+
+// expandLayout fills in a category layout such as "{yyyy}/{mm}" or
+// "{artist}/{album}" for a file. Date placeholders are {yyyy}, {yy}, {mm},
+// {dd} and {date}; audio files can also use {artist}, {albumartist},
+// {album}, {title}, {year}, {track} and {genre}. ok is false when the file
+// lacks a value the layout needs (e.g. an untagged song), in which case it
+// belongs in the plain category.
+func expandLayout(layout, filePath string) (result string, ok bool, err error) {
+	return expandTemplate(layout, filePath, nil)
+}
+
+// expandTemplate fills in the placeholders of a layout or name template.
+// vars resolves placeholders specific to the caller (such as {name}); their
+// values are inserted as they are, while file metadata is sanitized for use
+// as a folder or file name.
+func expandTemplate(template, filePath string, vars map[string]func() (string, error)) (result string, ok bool, err error) {
+	var date *time.Time
+	var tags *AudioTags
+	ok = true
+
+	result = layoutPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if err != nil {
+			return ""
+		}
+		name := placeholder[1 : len(placeholder)-1]
+
+		if resolve, found := vars[name]; found {
+			value, varErr := resolve()
+			if varErr != nil {
+				err = varErr
+			}
+			return value
+		}
+
+		switch name {
+		case "yyyy", "yy", "mm", "dd", "date":
+			if date == nil {
+				d, dateErr := fileDate(filePath)
+				if dateErr != nil {
+					err = dateErr
+					return ""
+				}
+				date = &d
+			}
+			return date.Format(dateFormats[name])
+		case "artist", "albumartist", "album", "title", "year", "track", "genre":
+			if tags == nil {
+				if tags, _ = readAudioTags(filePath); tags == nil {
+					tags = &AudioTags{}
+				}
+			}
+			value := sanitizePathPart(tags.field(name))
+			if value == "" {
+				ok = false
+			}
+			return value
+		}
+		return placeholder // Unknown placeholders are kept literally
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.FromSlash(result), ok, nil
+}
+
+var dateFormats = map[string]string{"yyyy": "2006", "yy": "06", "mm": "01", "dd": "02", "date": "2006-01-02"}
+
+func (t *AudioTags) field(name string) string {
+	switch name {
+	case "artist":
+		if t.Artist == "" {
+			return t.AlbumArtist
+		}
+		return t.Artist
+	case "albumartist":
+		if t.AlbumArtist == "" {
+			return t.Artist
+		}
+		return t.AlbumArtist
+	case "album":
+		return t.Album
+	case "title":
+		return t.Title
+	case "year":
+		if len(t.Year) > 4 {
+			return t.Year[:4] // "2024-05-01" style dates
+		}
+		return t.Year
+	case "track":
+		track, _, _ := strings.Cut(t.Track, "/") // "3/12"
+		return track
+	case "genre":
+		return t.Genre
+	}
+	return ""
+}
+
+// sanitizePathPart makes a metadata value safe to use as a folder name
+func sanitizePathPart(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if isControl(r) || strings.ContainsRune(invalidNameChars, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	return strings.Trim(value, " .")
+}
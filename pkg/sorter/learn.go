@@ -0,0 +1,184 @@
+package sorter
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxExamples is how many file names are kept for each unknown extension
+const maxExamples = 3
+
+// unknownExtensions records, across runs, the extensions that fell through
+// to the unknown extension fallback (see Options.UnknownFile)
+type unknownExtensions struct {
+	Extensions map[string]*unknownExtension `json:"extensions"`
+}
+
+type unknownExtension struct {
+	Count    int            `json:"count"`
+	Examples []string       `json:"examples"`        // File names
+	Types    map[string]int `json:"types,omitempty"` // Detected content types
+	LastSeen time.Time      `json:"last_seen"`
+}
+
+// loadUnknownExtensions reads Options.UnknownFile, returning an empty record
+// when it doesn't exist yet
+func (s *Sorter) loadUnknownExtensions() (*unknownExtensions, error) {
+	u := &unknownExtensions{Extensions: make(map[string]*unknownExtension)}
+	data, err := readFile(s.opts.UnknownFile)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, fmt.Errorf("invalid unknown extension record %s: %w", s.opts.UnknownFile, err)
+	}
+	if u.Extensions == nil {
+		u.Extensions = make(map[string]*unknownExtension)
+	}
+	return u, nil
+}
+
+// recordUnknown notes an inbox file whose extension no category claims. The
+// record is loaded on first use and written by saveUnknownExtensions. Files
+// already sorted aren't counted again when re-sorted.
+func (s *Sorter) recordUnknown(filePath, ext string) {
+	if s.opts.UnknownFile == "" || !s.inInbox(filePath) {
+		return
+	}
+	if s.unknown == nil {
+		u, err := s.loadUnknownExtensions()
+		if err != nil {
+			s.log.Warn("Not recording unknown extensions", "err", err)
+			u = &unknownExtensions{Extensions: make(map[string]*unknownExtension)}
+		}
+		s.unknown = u
+	}
+	entry := s.unknown.Extensions[ext]
+	if entry == nil {
+		entry = &unknownExtension{Types: make(map[string]int)}
+		s.unknown.Extensions[ext] = entry
+	}
+	entry.Count++
+	entry.LastSeen = time.Now()
+	if name := filepath.Base(filePath); len(entry.Examples) < maxExamples && !slices.Contains(entry.Examples, name) {
+		entry.Examples = append(entry.Examples, name)
+	}
+	if mimeType, _, err := DetectType(filePath); err == nil && mimeType != "" {
+		if entry.Types == nil {
+			entry.Types = make(map[string]int)
+		}
+		entry.Types[mimeType]++
+	}
+}
+
+// saveUnknownExtensions writes what recordUnknown collected, through a
+// temporary file
+func (s *Sorter) saveUnknownExtensions() {
+	if s.unknown == nil || s.opts.DryRun {
+		return
+	}
+	data, err := json.MarshalIndent(s.unknown, "", "  ")
+	if err == nil {
+		err = writeFile(s.opts.UnknownFile, data)
+	}
+	if err != nil {
+		s.log.Error("Failed to save unknown extensions", "path", s.opts.UnknownFile, "err", err)
+	}
+}
+
+// Suggestion proposes adding an extension that keeps falling through to the
+// unknown extension fallback to a category
+type Suggestion struct {
+	Ext      string   // Without the dot
+	Count    int      // Files seen with it
+	Examples []string // Some of their names
+	Type     string   // Content type the category was chosen by
+	Category string   // Slash-separated; empty when no category fits
+}
+
+// Suggest lists the extensions recorded in Options.UnknownFile that the
+// categories still don't claim, most frequent first. The category proposed
+// for each holds the most extensions of the same content type (known from
+// the extension itself or detected in the files seen), or else of the same
+// kind, such as images.
+func (s *Sorter) Suggest() ([]Suggestion, error) {
+	if s.opts.UnknownFile == "" {
+		return nil, &ConfigError{errors.New("no unknown extension record configured")}
+	}
+	u, err := s.loadUnknownExtensions()
+	if err != nil {
+		return nil, err
+	}
+
+	var suggestions []Suggestion
+	for ext, entry := range u.Extensions {
+		if s.classifier.known(ext) {
+			continue // Added to the categories since
+		}
+		mimeType := expectedType(ext)
+		if mimeType == "" && len(entry.Types) > 0 {
+			mimeType = slices.MaxFunc(slices.Sorted(maps.Keys(entry.Types)), func(a, b string) int {
+				return cmp.Compare(entry.Types[a], entry.Types[b])
+			})
+		}
+		suggestions = append(suggestions, Suggestion{
+			Ext:      ext,
+			Count:    entry.Count,
+			Examples: entry.Examples,
+			Type:     mimeType,
+			Category: filepath.ToSlash(s.classifier.categoryForType(mimeType)),
+		})
+	}
+	slices.SortFunc(suggestions, func(a, b Suggestion) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Ext, b.Ext))
+	})
+	return suggestions, nil
+}
+
+// known reports whether a category claims ext, directly or through an alias
+func (c *Classifier) known(ext string) bool {
+	if canonical, ok := c.aliases[ext]; ok {
+		ext = canonical
+	}
+	_, ok := c.extensionMap[ext]
+	return ok
+}
+
+// categoryForType returns the category holding the most extensions of the
+// given content type or, failing that, of its family. Plain bytes and the
+// broad application family say too little to pick one.
+func (c *Classifier) categoryForType(mimeType string) string {
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		return ""
+	}
+	votes := make(map[string]int)
+	for ext, category := range c.extensionMap {
+		if expectedType(ext) == mimeType {
+			votes[category]++
+		}
+	}
+	if family := typeFamily(mimeType); len(votes) == 0 && family != "application" {
+		for ext, category := range c.extensionMap {
+			if typeFamily(expectedType(ext)) == family {
+				votes[category]++
+			}
+		}
+	}
+	if len(votes) == 0 {
+		return ""
+	}
+	return slices.MaxFunc(slices.Sorted(maps.Keys(votes)), func(a, b string) int {
+		return cmp.Compare(votes[a], votes[b])
+	})
+}
@@ -0,0 +1,132 @@
+package sorter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errLocked is what lockFile fails with when another open file holds the
+// lock
+var errLocked = errors.New("lock held")
+
+// lockInfo is the content of a lock file
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// LockedError reports that another run holds the lock
+type LockedError struct {
+	Path  string
+	PID   int // Zero when the lock file couldn't be read
+	Host  string
+	Since time.Time // When the other run started
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("another run holds %s", e.Path)
+	}
+	return fmt.Sprintf("another run (pid %d on %s, started %s) holds %s",
+		e.PID, e.Host, e.Since.Format(time.DateTime), e.Path)
+}
+
+// Lock takes the run lock at Options.LockFile so two processes can't sort
+// the same inbox at once, and returns the function releasing it. The lock
+// is an advisory lock of the operating system on the file, flock or
+// LockFileEx, which goes away with the process holding it: a run that
+// crashed leaves no lock behind to take over. The file also records the
+// holder, for the *LockedError returned while another run holds it.
+// Without a LockFile there is nothing to take.
+func (s *Sorter) Lock() (unlock func(), err error) {
+	path := s.opts.LockFile
+	if path == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	own := lockInfo{PID: os.Getpid(), Host: host, Started: time.Now()}
+
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			if errors.Is(err, errLocked) {
+				return nil, lockHolder(path)
+			}
+			return nil, err
+		}
+		// The file may have been removed, by hand, between opening and
+		// locking it: a lock on a file no longer at path keeps no one out
+		if !lockedAt(file, path) {
+			file.Close()
+			continue
+		}
+		if err := writeLock(file, own); err != nil {
+			file.Close()
+			return nil, err
+		}
+		s.log.Debug("Lock taken", "path", path)
+		return func() { s.unlock(file) }, nil
+	}
+}
+
+// lockedAt reports whether file is still the one at path
+func lockedAt(file *os.File, path string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(opened, current)
+}
+
+// writeLock records the holder in the locked file
+func writeLock(file *os.File, info lockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(append(data, '\n'), 0)
+	return err
+}
+
+// lockHolder describes the run holding the lock at path, as far as the lock
+// file says: it may not have recorded itself yet
+func lockHolder(path string) *LockedError {
+	held := &LockedError{Path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return held
+	}
+	var info lockInfo
+	if json.Unmarshal(data, &info) == nil {
+		held.PID, held.Host, held.Since = info.PID, info.Host, info.Started
+	}
+	return held
+}
+
+// unlock empties the lock file and releases the lock. The file stays: a
+// run that opened it meanwhile would otherwise lock a file no longer there,
+// while the next run creates and locks another.
+func (s *Sorter) unlock(file *os.File) {
+	if err := file.Truncate(0); err != nil {
+		s.log.Warn("Failed to clear lock", "path", s.opts.LockFile, "err", err)
+	}
+	if err := file.Close(); err != nil {
+		s.log.Warn("Failed to release lock", "path", s.opts.LockFile, "err", err)
+	}
+}
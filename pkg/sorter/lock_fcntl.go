@@ -0,0 +1,23 @@
+//go:build solaris || aix
+
+package sorter
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an fcntl write lock of file without waiting, there being
+// no flock. It is held until the file is closed. Such locks belong to the
+// process rather than the open file, so they only keep other processes
+// out.
+func lockFile(file *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return errLocked
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package sorter
+
+import "os"
+
+// lockFile has no file locks to take here, so runs aren't kept apart
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+package sorter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "lock")
+	s, _ := newMemSorter(t, nil, Options{LockFile: lockPath})
+
+	// Left by a crashed run: the file is there, its lock went with the run
+	if err := os.WriteFile(lockPath, []byte(`{"pid":1,"host":"elsewhere"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := s.Lock()
+	if err != nil {
+		t.Fatalf("Lock() over a crashed run's file = %v", err)
+	}
+
+	_, err = s.Lock()
+	var held *LockedError
+	if !errors.As(err, &held) {
+		t.Fatalf("second Lock() = %v, want a *LockedError", err)
+	}
+	host, _ := os.Hostname()
+	if held.PID != os.Getpid() || held.Host != host || held.Since.IsZero() {
+		t.Errorf("second Lock() names pid %d on %q since %v, want this process", held.PID, held.Host, held.Since)
+	}
+
+	unlock()
+	unlock, err = s.Lock()
+	if err != nil {
+		t.Fatalf("Lock() after release = %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,38 @@
+//go:build windows
+
+package sorter
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is MAX_PATH, the longest path the classic Win32 file APIs accept
+// without the \\?\ prefix
+const maxPath = 260
+
+// longPath returns path in its \\?\ extended-length form, which lifts the
+// MAX_PATH limit. Such paths are taken literally by Windows, so path is made
+// absolute and cleaned first. UNC paths become \\?\UNC\server\share\...
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// shortPath undoes longPath for the APIs that don't understand \\?\ paths,
+// such as the shell's
+func shortPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, `\\?\UNC\`); ok {
+		return `\\` + rest
+	}
+	return strings.TrimPrefix(path, `\\?\`)
+}
@@ -0,0 +1,302 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An LZMA decoder, enough to read the compressed headers of 7z archives.
+// It decodes into a buffer of the known unpacked size, which serves as the
+// dictionary too, so it is only meant for small streams.
+
+var errLZMACorrupt = errors.New("corrupt LZMA stream")
+
+const (
+	lzmaStates        = 12
+	lzmaPosBitsMax    = 4
+	lzmaLenToPosState = 4
+	lzmaAlignBits     = 4
+	lzmaEndPosModel   = 14
+	lzmaFullDistances = 1 << (lzmaEndPosModel >> 1)
+	lzmaMatchMinLen   = 2
+	lzmaProbInit      = 1 << 10
+)
+
+// lzmaRange is the range decoder
+type lzmaRange struct {
+	data  []byte
+	pos   int
+	rng   uint32
+	code  uint32
+	short bool // Ran past the end of data
+}
+
+func (rc *lzmaRange) next() byte {
+	if rc.pos >= len(rc.data) {
+		rc.short = true
+		return 0
+	}
+	b := rc.data[rc.pos]
+	rc.pos++
+	return b
+}
+
+func (rc *lzmaRange) init() error {
+	rc.rng = 0xFFFFFFFF
+	if rc.next() != 0 {
+		return errLZMACorrupt
+	}
+	for range 4 {
+		rc.code = rc.code<<8 | uint32(rc.next())
+	}
+	if rc.code == rc.rng {
+		return errLZMACorrupt
+	}
+	return nil
+}
+
+func (rc *lzmaRange) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		rc.code = rc.code<<8 | uint32(rc.next())
+	}
+}
+
+func (rc *lzmaRange) bit(prob *uint16) uint32 {
+	bound := (rc.rng >> 11) * uint32(*prob)
+	var bit uint32
+	if rc.code < bound {
+		*prob += (1<<11 - *prob) >> 5
+		rc.rng = bound
+	} else {
+		*prob -= *prob >> 5
+		rc.code -= bound
+		rc.rng -= bound
+		bit = 1
+	}
+	rc.normalize()
+	return bit
+}
+
+func (rc *lzmaRange) direct(n int) uint32 {
+	var res uint32
+	for range n {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		rc.normalize()
+		res = res<<1 + t + 1
+	}
+	return res
+}
+
+// tree decodes n bits high to low with the probabilities of a bit tree
+func (rc *lzmaRange) tree(probs []uint16, n int) uint32 {
+	m := uint32(1)
+	for range n {
+		m = m<<1 + rc.bit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+// reverseTree decodes n bits low to high
+func (rc *lzmaRange) reverseTree(probs []uint16, n int) uint32 {
+	m, sym := uint32(1), uint32(0)
+	for i := range n {
+		bit := rc.bit(&probs[m])
+		m = m<<1 + bit
+		sym |= bit << i
+	}
+	return sym
+}
+
+func lzmaProbs(n int) []uint16 {
+	probs := make([]uint16, n)
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+	return probs
+}
+
+// lzmaLen decodes match lengths
+type lzmaLen struct {
+	choice, choice2 uint16
+	low, mid        [1 << lzmaPosBitsMax][]uint16
+	high            []uint16
+}
+
+func newLZMALen() *lzmaLen {
+	l := &lzmaLen{choice: lzmaProbInit, choice2: lzmaProbInit, high: lzmaProbs(1 << 8)}
+	for i := range l.low {
+		l.low[i], l.mid[i] = lzmaProbs(1<<3), lzmaProbs(1<<3)
+	}
+	return l
+}
+
+func (l *lzmaLen) decode(rc *lzmaRange, posState uint32) uint32 {
+	if rc.bit(&l.choice) == 0 {
+		return rc.tree(l.low[posState], 3)
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 8 + rc.tree(l.mid[posState], 3)
+	}
+	return 16 + rc.tree(l.high, 8)
+}
+
+// lzmaAfter is the state after a match, rep or short rep: afterLiteral
+// when the state was one of a literal, else afterMatch
+func lzmaAfter(state, afterLiteral, afterMatch uint32) uint32 {
+	if state < 7 {
+		return afterLiteral
+	}
+	return afterMatch
+}
+
+// lzmaDecode decodes an LZMA stream of size bytes, with the 5 byte
+// properties 7z keeps with the coder
+func lzmaDecode(props, data []byte, size int) ([]byte, error) {
+	if len(props) < 5 {
+		return nil, errors.New("invalid LZMA properties")
+	}
+	d := int(props[0])
+	if d >= 9*5*5 {
+		return nil, errors.New("invalid LZMA properties")
+	}
+	lc, lp, pb := d%9, d/9%5, d/45
+	rc := &lzmaRange{data: data}
+	if err := rc.init(); err != nil {
+		return nil, err
+	}
+
+	literals := lzmaProbs(0x300 << (lc + lp))
+	posSlots := [lzmaLenToPosState][]uint16{}
+	for i := range posSlots {
+		posSlots[i] = lzmaProbs(1 << 6)
+	}
+	posDecoders := lzmaProbs(1 + lzmaFullDistances - lzmaEndPosModel)
+	align := lzmaProbs(1 << lzmaAlignBits)
+	var isMatch, isRep0Long [lzmaStates << lzmaPosBitsMax]uint16
+	var isRep, isRepG0, isRepG1, isRepG2 [lzmaStates]uint16
+	for _, probs := range [][]uint16{isMatch[:], isRep0Long[:], isRep[:], isRepG0[:], isRepG1[:], isRepG2[:]} {
+		for i := range probs {
+			probs[i] = lzmaProbInit
+		}
+	}
+	lenDecoder, repLenDecoder := newLZMALen(), newLZMALen()
+
+	out := make([]byte, 0, size)
+	var state, rep0, rep1, rep2, rep3 uint32
+	pbMask, lpMask := uint32(1)<<pb-1, uint32(1)<<lp-1
+	for len(out) < size {
+		if rc.short {
+			return nil, fmt.Errorf("%w: truncated", errLZMACorrupt)
+		}
+		pos := uint32(len(out))
+		posState := pos & pbMask
+		if rc.bit(&isMatch[state<<lzmaPosBitsMax+posState]) == 0 {
+			var prev uint32
+			if pos > 0 {
+				prev = uint32(out[pos-1])
+			}
+			probs := literals[0x300*((pos&lpMask)<<lc+prev>>(8-lc)):]
+			symbol := uint32(1)
+			if state >= 7 {
+				if rep0 >= pos {
+					return nil, errLZMACorrupt
+				}
+				matchByte := uint32(out[pos-rep0-1])
+				for symbol < 0x100 {
+					matchBit := matchByte >> 7 & 1
+					matchByte <<= 1
+					bit := rc.bit(&probs[(1+matchBit)<<8+symbol])
+					symbol = symbol<<1 | bit
+					if matchBit != bit {
+						break
+					}
+				}
+			}
+			for symbol < 0x100 {
+				symbol = symbol<<1 | rc.bit(&probs[symbol])
+			}
+			out = append(out, byte(symbol))
+			switch {
+			case state < 4:
+				state = 0
+			case state < 10:
+				state -= 3
+			default:
+				state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&isRep[state]) != 0 {
+			if pos == 0 {
+				return nil, errLZMACorrupt
+			}
+			if rc.bit(&isRepG0[state]) == 0 {
+				if rc.bit(&isRep0Long[state<<lzmaPosBitsMax+posState]) == 0 {
+					// Short rep: a single byte from rep0
+					if rep0 >= pos {
+						return nil, errLZMACorrupt
+					}
+					out = append(out, out[pos-rep0-1])
+					state = lzmaAfter(state, 9, 11)
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&isRepG1[state]) == 0 {
+					dist = rep1
+				} else {
+					if rc.bit(&isRepG2[state]) == 0 {
+						dist = rep2
+					} else {
+						dist = rep3
+						rep3 = rep2
+					}
+					rep2 = rep1
+				}
+				rep1 = rep0
+				rep0 = dist
+			}
+			length = repLenDecoder.decode(rc, posState)
+			state = lzmaAfter(state, 8, 11)
+		} else {
+			rep3, rep2, rep1 = rep2, rep1, rep0
+			length = lenDecoder.decode(rc, posState)
+			state = lzmaAfter(state, 7, 10)
+
+			lenState := min(length, lzmaLenToPosState-1)
+			posSlot := rc.tree(posSlots[lenState], 6)
+			if posSlot < 4 {
+				rep0 = posSlot
+			} else {
+				directBits := int(posSlot>>1) - 1
+				rep0 = (2 | posSlot&1) << directBits
+				if posSlot < lzmaEndPosModel {
+					rep0 += rc.reverseTree(posDecoders[rep0-posSlot:], directBits)
+				} else {
+					rep0 += rc.direct(directBits-lzmaAlignBits) << lzmaAlignBits
+					rep0 += rc.reverseTree(align, lzmaAlignBits)
+				}
+			}
+			if rep0 == 0xFFFFFFFF {
+				break // End marker
+			}
+		}
+		length += lzmaMatchMinLen
+		if rep0 >= uint32(len(out)) {
+			return nil, errLZMACorrupt
+		}
+		for ; length > 0 && len(out) < size; length-- {
+			out = append(out, out[uint32(len(out))-rep0-1])
+		}
+	}
+	if len(out) < size {
+		return nil, fmt.Errorf("%w: truncated", errLZMACorrupt)
+	}
+	return out, nil
+}
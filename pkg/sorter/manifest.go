@@ -0,0 +1,150 @@
+package sorter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Checksum manifest formats
+const (
+	ManifestSHA256 = "sha256" // sha256sum output, checked with sha256sum -c
+	ManifestSFV    = "sfv"    // Simple File Verification, CRC32 per file
+)
+
+// ManifestFormats lists the valid manifest formats
+var ManifestFormats = []string{ManifestSHA256, ManifestSFV}
+
+// manifestLine is one checked file of a manifest
+type manifestLine struct {
+	path string // Slash-separated, relative to the sorted directory
+	size int64
+	sum  string
+	err  error
+}
+
+// Manifest writes a checksum manifest of the sorted files to w, either for
+// the whole sorted directory or for one category folder (as listed by
+// CategoryFolders). Paths are relative to the sorted directory, so the
+// manifest is checked from there, e.g. with "sha256sum -c". Files that
+// can't be read are left out and make Manifest return a *PartialError.
+func (s *Sorter) Manifest(w io.Writer, format, category string) (Usage, error) {
+	var usage Usage
+	var newHash func() hash.Hash
+	switch format {
+	case ManifestSHA256:
+		newHash = sha256.New
+	case ManifestSFV:
+		newHash = func() hash.Hash { return crc32.NewIEEE() }
+	default:
+		return usage, &ConfigError{fmt.Errorf("invalid manifest format %q: must be one of %s", format, strings.Join(ManifestFormats, ", "))}
+	}
+
+	root := filepath.Join(s.opts.SortedDir, filepath.FromSlash(category))
+	var lines []*manifestLine
+	byPath := make(map[string]*manifestLine)
+	err := walkFiles(root, func(path string, info fs.FileInfo) {
+		usage.add(info.Size())
+		rel, _ := filepath.Rel(s.opts.SortedDir, path)
+		line := &manifestLine{path: filepath.ToSlash(rel), size: info.Size()}
+		lines = append(lines, line)
+		byPath[path] = line
+	})
+	if err != nil {
+		return usage, err
+	}
+	s.failed = 0
+
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for path := range byPath {
+			select {
+			case paths <- path:
+			case <-s.opts.Stop:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+	progress := s.newProgress("Hashing", usage.Files, usage.Bytes)
+	hashFiles(s.opts.Workers, paths, func(path string) (string, error) {
+		return checksum(s.ctx, path, newHash())
+	}, func(path, sum string, err error) {
+		line := byPath[path]
+		line.sum, line.err = sum, err
+		progress.add(line.size)
+	})
+	progress.finish()
+	if s.stopped() {
+		return usage, s.aborted()
+	}
+
+	slices.SortFunc(lines, func(a, b *manifestLine) int { return strings.Compare(a.path, b.path) })
+	if format == ManifestSFV {
+		fmt.Fprintf(w, "; Generated by sorter on %s\n", time.Now().Format(time.DateTime))
+	}
+	for _, line := range lines {
+		if line.err != nil {
+			s.log.Error("Failed to hash file", "path", line.path, "err", line.err)
+			s.emitError(filepath.Join(s.opts.SortedDir, filepath.FromSlash(line.path)), line.err)
+			continue
+		}
+		if format == ManifestSFV {
+			_, err = fmt.Fprintf(w, "%s %s\n", line.path, strings.ToUpper(line.sum))
+		} else {
+			_, err = fmt.Fprintf(w, "%s  %s\n", line.sum, line.path)
+		}
+		if err != nil {
+			return usage, err
+		}
+	}
+
+	if s.failed > 0 {
+		return usage, &PartialError{Failed: s.failed}
+	}
+	return usage, nil
+}
+
+// checksum hashes a whole file with h and returns the digest in hex
+func checksum(ctx context.Context, path string, h hash.Hash) (string, error) {
+	file, err := storageAt(path).Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := copyBuffered(ctx, h, file, path); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CategoryFolders returns the top-level folders of the sorted directory, in
+// order. Files lying directly in the sorted directory belong to none.
+func (s *Sorter) CategoryFolders() ([]string, error) {
+	entries, err := storageAt(s.opts.SortedDir).ReadDir(s.opts.SortedDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var folders []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			folders = append(folders, entry.Name())
+		}
+	}
+	return folders, nil
+}
@@ -0,0 +1,275 @@
+package sorter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS that keeps everything in memory, for trying out options or
+// testing code built on the engine without touching real directories:
+//
+//	mem := sorter.NewMemFS()
+//	sorter.Mount("/mem", mem)
+//	mem.WriteFile("/mem/inbox/photo.jpg", data)
+//	s, err := sorter.New(sorter.Options{InboxDir: "/mem/inbox", SortedDir: "/mem/sorted", DeleteDir: "/mem/delete"})
+//
+// It is safe for concurrent use.
+type MemFS struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode // By cleaned path; the filesystem root is implied
+}
+
+type memNode struct {
+	data  []byte
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+// NewMemFS returns an empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: make(map[string]*memNode)}
+}
+
+// node returns the file or folder at name. Callers hold the lock.
+func (m *MemFS) node(name string) (*memNode, bool) {
+	if filepath.Dir(name) == name {
+		return &memNode{mode: fs.ModeDir | 0o755}, true
+	}
+	n, ok := m.nodes[name]
+	return n, ok
+}
+
+func (m *MemFS) info(name string, n *memNode) *remoteFileInfo {
+	return &remoteFileInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: n.mode, mtime: n.mtime}
+}
+
+// WriteFile creates or replaces name with data, creating the folders above
+// it
+func (m *MemFS) WriteFile(name string, data []byte) error {
+	if err := m.MkdirAll(filepath.Dir(name)); err != nil {
+		return err
+	}
+	w, err := m.Create(name)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	return w.Close()
+}
+
+// ReadFile returns the contents of name
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, ok := m.node(filepath.Clean(name))
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	return slices.Clone(n.data), nil
+}
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+func (m *MemFS) Open(name string) (File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name = filepath.Clean(name)
+	n, ok := m.node(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	// Writes only append past the end of the data, or start over in a new
+	// slice, so the reader sees the file as it was when opened
+	return &memFile{Reader: bytes.NewReader(n.data), info: m.info(name, n)}, nil
+}
+
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if parent, ok := m.node(filepath.Dir(name)); !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	} else if !parent.mode.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errNotDir}
+	}
+	n, ok := m.nodes[name]
+	if ok && n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	if !ok {
+		n = &memNode{mode: 0o644}
+		m.nodes[name] = n
+	}
+	n.data, n.mtime = nil, time.Now()
+	return &memWriter{fs: m, node: n}, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name = filepath.Clean(name)
+	n, ok := m.node(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.info(name, n), nil
+}
+
+// Lstat is Stat, MemFS has no symbolic links
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name = filepath.Clean(name)
+	n, ok := m.node(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: errNotDir}
+	}
+	var entries []fs.DirEntry
+	for path, child := range m.nodes {
+		if filepath.Dir(path) == name && path != name {
+			entries = append(entries, fs.FileInfoToDirEntry(m.info(path, child)))
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (m *MemFS) MkdirAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	var missing []string
+	for dir := name; ; dir = filepath.Dir(dir) {
+		n, ok := m.node(dir)
+		if ok {
+			if !n.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for _, dir := range missing {
+		m.nodes[dir] = &memNode{mode: fs.ModeDir | 0o755, mtime: time.Now()}
+	}
+	return nil
+}
+
+// Rename moves a file or a folder with everything in it, failing when
+// newname exists
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	n, ok := m.nodes[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.nodes[newname]; ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	if parent, ok := m.node(filepath.Dir(newname)); !ok || !parent.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if n.mode.IsDir() && nested(newname, oldname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	prefix := oldname + string(filepath.Separator)
+	for path, child := range m.nodes {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			delete(m.nodes, path)
+			m.nodes[filepath.Join(newname, rest)] = child
+		}
+	}
+	delete(m.nodes, oldname)
+	m.nodes[newname] = n
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		for path := range m.nodes {
+			if filepath.Dir(path) == name {
+				return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+			}
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	n.mtime = mtime
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	n.mode = n.mode&^fs.ModePerm | mode.Perm()
+	return nil
+}
+
+// memFile is a MemFS file opened for reading
+type memFile struct {
+	*bytes.Reader
+	info *remoteFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memWriter appends to a MemFS file created by Create
+type memWriter struct {
+	fs   *MemFS
+	node *memNode
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.node.data = append(w.node.data, p...)
+	w.node.mtime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Close() error { return nil }
@@ -0,0 +1,512 @@
+package sorter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var memMounts atomic.Int64
+
+// newMemSorter mounts a MemFS holding files, named relative to the inbox,
+// and returns a Sorter on it. Files are compared by contents, so equal
+// strings make duplicates.
+func newMemSorter(t *testing.T, files map[string]string, opts Options) (*Sorter, *MemFS) {
+	t.Helper()
+	mem := NewMemFS()
+	root := filepath.Join(string(filepath.Separator)+"mem", string(rune('a'+memMounts.Add(1)%26))+strings.ReplaceAll(t.Name(), "/", "_"))
+	Mount(root, mem)
+	t.Cleanup(func() { Unmount(root) })
+
+	opts.InboxDir = filepath.Join(root, "inbox")
+	opts.SortedDir = filepath.Join(root, "sorted")
+	opts.DeleteDir = filepath.Join(root, "delete")
+	if opts.JournalDir == "" {
+		opts.JournalDir = t.TempDir()
+	}
+	if opts.Categories == nil {
+		opts.Categories = CategoryConfig{
+			"Images":    {Extensions: []string{"jpg", "png"}},
+			"Documents": {Extensions: []string{"pdf", "txt"}},
+		}
+	}
+	opts.Workers = 1
+	opts.Output = io.Discard
+	for _, dir := range []string{opts.InboxDir, opts.SortedDir, opts.DeleteDir} {
+		if err := mem.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range files {
+		if err := mem.WriteFile(filepath.Join(opts.InboxDir, filepath.FromSlash(name)), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, mem
+}
+
+// memTree returns the files under dir in mem by slash path relative to dir,
+// with their contents
+func memTree(t *testing.T, mem *MemFS, dir string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	var list func(string)
+	list = func(path string) {
+		entries, err := mem.ReadDir(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			child := filepath.Join(path, entry.Name())
+			if entry.IsDir() {
+				list(child)
+				continue
+			}
+			data, err := mem.ReadFile(child)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rel, _ := filepath.Rel(dir, child)
+			tree[filepath.ToSlash(rel)] = string(data)
+		}
+	}
+	list(dir)
+	return tree
+}
+
+// deletedNames returns the names in the delete folder with the hash the
+// delete template adds taken out, which depends on the hash algorithm
+func deletedNames(tree map[string]string) []string {
+	var names []string
+	for name := range tree {
+		names = append(names, deleteSuffix.ReplaceAllString(name, "_processed_delete"))
+	}
+	slices.Sort(names)
+	return names
+}
+
+// hashesOut replaces the hash a taken name gets in the sorted directory
+// with #
+func hashesOut(tree map[string]string) map[string]string {
+	out := make(map[string]string, len(tree))
+	for name, data := range tree {
+		out[nameHash.ReplaceAllString(name, "_#.")] = data
+	}
+	return out
+}
+
+var nameHash = regexp.MustCompile(`_[0-9a-f]{6}\.`)
+
+func checkTree(t *testing.T, what string, got, want map[string]string) {
+	t.Helper()
+	if !maps.Equal(got, want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
+
+func TestSortMemFS(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		opts    Options
+		inbox   map[string]string
+		sorted  map[string]string
+		deleted []string
+	}{
+		{
+			name:   "by extension",
+			files:  map[string]string{"a.jpg": "photo", "b.pdf": "paper", "sub/c.txt": "note"},
+			inbox:  map[string]string{},
+			sorted: map[string]string{"Images/a.jpg": "photo", "Documents/b.pdf": "paper", "Documents/c.txt": "note"},
+		},
+		{
+			name:    "duplicates in the inbox",
+			files:   map[string]string{"a.jpg": "photo", "copy/a.jpg": "photo"},
+			inbox:   map[string]string{},
+			sorted:  map[string]string{"Images/a.jpg": "photo"},
+			deleted: []string{"a_processed_delete.jpg"},
+		},
+		{
+			name:   "same name, different contents",
+			files:  map[string]string{"a.jpg": "photo", "copy/a.jpg": "other photo"},
+			inbox:  map[string]string{},
+			sorted: map[string]string{"Images/a.jpg": "photo", "Images/a_#.jpg": "other photo"},
+		},
+		{
+			name:    "same name in the delete folder",
+			files:   map[string]string{"a/x.tmp": "one", "b/x.tmp": "two"},
+			opts:    Options{DeleteTemplate: "{name}{ext}", Rules: []Rule{{Glob: "*.tmp", Action: "delete"}}},
+			inbox:   map[string]string{},
+			sorted:  map[string]string{},
+			deleted: []string{"x.tmp", "x_1.tmp"},
+		},
+		{
+			name:   "same size, different contents",
+			files:  map[string]string{"a.txt": "aaaa", "b.txt": "bbbb"},
+			inbox:  map[string]string{},
+			sorted: map[string]string{"Documents/a.txt": "aaaa", "Documents/b.txt": "bbbb"},
+		},
+		{
+			name:   "excluded folder",
+			files:  map[string]string{"a.jpg": "photo", "skip/b.jpg": "kept"},
+			opts:   Options{ExcludeDirs: []string{"skip"}},
+			inbox:  map[string]string{"skip/b.jpg": "kept"},
+			sorted: map[string]string{"Images/a.jpg": "photo"},
+		},
+		{
+			name:   "dry run",
+			files:  map[string]string{"a.jpg": "photo", "copy/a.jpg": "photo"},
+			opts:   Options{DryRun: true},
+			inbox:  map[string]string{"a.jpg": "photo", "copy/a.jpg": "photo"},
+			sorted: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mem := newMemSorter(t, tt.files, tt.opts)
+			if err := s.Sort(); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.opts.DryRun {
+				// Folders emptied by the run are removed
+				if err := s.RemoveEmptyDirs(s.opts.InboxDir); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkTree(t, "inbox", memTree(t, mem, s.opts.InboxDir), tt.inbox)
+			checkTree(t, "sorted", hashesOut(memTree(t, mem, s.opts.SortedDir)), tt.sorted)
+			if got := deletedNames(memTree(t, mem, s.opts.DeleteDir)); !slices.Equal(got, tt.deleted) {
+				t.Errorf("deleted = %v, want %v", got, tt.deleted)
+			}
+		})
+	}
+}
+
+func TestSortMemFSAgainstSorted(t *testing.T) {
+	s, mem := newMemSorter(t, map[string]string{"new.jpg": "photo", "fresh.jpg": "fresh"}, Options{})
+	if err := mem.WriteFile(filepath.Join(s.opts.SortedDir, "Images", "old.jpg"), []byte("photo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sort(); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, "sorted", memTree(t, mem, s.opts.SortedDir), map[string]string{"Images/old.jpg": "photo", "Images/fresh.jpg": "fresh"})
+	if got, want := deletedNames(memTree(t, mem, s.opts.DeleteDir)), []string{"new_processed_delete.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("deleted = %v, want %v", got, want)
+	}
+}
+
+func TestCollisionMemFS(t *testing.T) {
+	// a.jpg and a_1.jpg are taken in the sorted folder, by content other
+	// than the inbox file's
+	taken := map[string]string{"Images/a.jpg": "old", "Images/a_1.jpg": "older"}
+	tests := []struct {
+		policy  string
+		sorted  map[string]string
+		inbox   map[string]string
+		skipped bool // A collision event was sent
+		err     error
+	}{
+		{CollisionSuffixHash, map[string]string{"Images/a.jpg": "old", "Images/a_1.jpg": "older", "Images/a_#.jpg": "new"}, map[string]string{}, false, nil},
+		{CollisionSuffixCounter, map[string]string{"Images/a.jpg": "old", "Images/a_1.jpg": "older", "Images/a_2.jpg": "new"}, map[string]string{}, false, nil},
+		{CollisionSkip, taken, map[string]string{"a.jpg": "new"}, true, nil},
+		{CollisionOverwriteIdentical, taken, map[string]string{"a.jpg": "new"}, true, nil},
+		{CollisionFail, taken, map[string]string{"a.jpg": "new"}, false, ErrDestinationExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			skipped := false
+			record := func(event Event) {
+				if event.Type == EventSkipped && event.Reason == "collision" {
+					skipped = true
+				}
+			}
+			s, mem := newMemSorter(t, map[string]string{"a.jpg": "new"}, Options{CollisionPolicy: tt.policy, Events: record})
+			for name, data := range taken {
+				if err := mem.WriteFile(filepath.Join(s.opts.SortedDir, filepath.FromSlash(name)), []byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Sort(); !errors.Is(err, tt.err) {
+				t.Fatalf("Sort: got %v, want %v", err, tt.err)
+			}
+			checkTree(t, "sorted", hashesOut(memTree(t, mem, s.opts.SortedDir)), tt.sorted)
+			checkTree(t, "inbox", memTree(t, mem, s.opts.InboxDir), tt.inbox)
+			checkTree(t, "delete", memTree(t, mem, s.opts.DeleteDir), map[string]string{})
+			if skipped != tt.skipped {
+				t.Errorf("collision event sent: %v, want %v", skipped, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestCollisionReplaceMemFS(t *testing.T) {
+	// Sorting would find an identical file to be a duplicate first, so
+	// moveFile is called as the sort does once none was found
+	var replaced []Event
+	record := func(event Event) {
+		if event.Type == EventMoved && event.Reason == "replaced" {
+			replaced = append(replaced, event)
+		}
+	}
+	s, mem := newMemSorter(t, map[string]string{"a.jpg": "photo"}, Options{CollisionPolicy: CollisionOverwriteIdentical, Events: record})
+	existing := filepath.Join(s.opts.SortedDir, "Images", "a.jpg")
+	if err := mem.WriteFile(existing, []byte("photo")); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := s.moveFile(filepath.Join(s.opts.InboxDir, "a.jpg"), "Images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != existing {
+		t.Errorf("moved to %s, want %s", dest, existing)
+	}
+	checkTree(t, "sorted", memTree(t, mem, s.opts.SortedDir), map[string]string{"Images/a.jpg": "photo"})
+	checkTree(t, "inbox", memTree(t, mem, s.opts.InboxDir), map[string]string{})
+	if got, want := deletedNames(memTree(t, mem, s.opts.DeleteDir)), []string{"a_processed_delete.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("deleted = %v, want %v", got, want)
+	}
+	if len(replaced) != 1 || replaced[0].Path != existing {
+		t.Errorf("replaced events = %+v, want one for %s", replaced, existing)
+	}
+}
+
+func TestDedupeMemFS(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		inbox   map[string]string
+		deleted []string
+	}{
+		{
+			name:  "nothing to do",
+			files: map[string]string{"a.jpg": "photo", "b.jpg": "other"},
+			inbox: map[string]string{"a.jpg": "photo", "b.jpg": "other"},
+		},
+		{
+			name:    "one duplicate",
+			files:   map[string]string{"a.jpg": "photo", "b.jpg": "photo", "c.pdf": "paper"},
+			inbox:   map[string]string{"a.jpg": "photo", "c.pdf": "paper"},
+			deleted: []string{"b_processed_delete.jpg"},
+		},
+		{
+			name:    "three copies",
+			files:   map[string]string{"a.txt": "same", "b.txt": "same", "c.txt": "same"},
+			inbox:   map[string]string{"a.txt": "same"},
+			deleted: []string{"b_processed_delete.txt", "c_processed_delete.txt"},
+		},
+		{
+			name:  "empty files are left alone",
+			files: map[string]string{"a.txt": "", "b.txt": ""},
+			inbox: map[string]string{"a.txt": "", "b.txt": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mem := newMemSorter(t, tt.files, Options{})
+			if err := s.Dedupe(); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, "inbox", memTree(t, mem, s.opts.InboxDir), tt.inbox)
+			if got := deletedNames(memTree(t, mem, s.opts.DeleteDir)); !slices.Equal(got, tt.deleted) {
+				t.Errorf("deleted = %v, want %v", got, tt.deleted)
+			}
+		})
+	}
+}
+
+func TestUndoMemFS(t *testing.T) {
+	files := map[string]string{"a.jpg": "photo", "copy/a.jpg": "photo", "b.pdf": "paper"}
+	s, mem := newMemSorter(t, files, Options{})
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := memTree(t, mem, s.opts.InboxDir); len(got) != 0 {
+		t.Fatalf("inbox after run = %v, want it empty", got)
+	}
+	if err := s.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, "inbox", memTree(t, mem, s.opts.InboxDir), files)
+	checkTree(t, "sorted", memTree(t, mem, s.opts.SortedDir), map[string]string{})
+	checkTree(t, "delete", memTree(t, mem, s.opts.DeleteDir), map[string]string{})
+}
+
+func TestRestoreMemFS(t *testing.T) {
+	tests := []struct {
+		name    string
+		restore []string // Relative to the delete folder, all when nil
+		inbox   map[string]string
+		left    int
+	}{
+		{
+			name:  "all",
+			inbox: map[string]string{"a.jpg": "photo", "copy/a.jpg": "photo", "b.txt": "note", "old/b.txt": "note"},
+		},
+		{
+			name:    "one",
+			restore: []string{"b_*"},
+			inbox:   map[string]string{"a.jpg": "photo", "b.txt": "note", "old/b.txt": "note"},
+			left:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"a.jpg": "photo", "copy/a.jpg": "photo", "b.txt": "note", "old/b.txt": "note"}
+			s, mem := newMemSorter(t, files, Options{})
+			if err := s.Dedupe(); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if tt.restore == nil {
+				err = s.RestoreAll()
+			} else {
+				var paths []string
+				for _, pattern := range tt.restore {
+					matches, _ := fs.Glob(memDirFS{mem, s.opts.DeleteDir}, pattern)
+					paths = append(paths, matches...)
+				}
+				if len(paths) != len(tt.restore) {
+					t.Fatalf("found %v in the delete folder, want %d files", paths, len(tt.restore))
+				}
+				err = s.Restore(paths...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, "inbox", memTree(t, mem, s.opts.InboxDir), tt.inbox)
+			if got := memTree(t, mem, s.opts.DeleteDir); len(got) != tt.left {
+				t.Errorf("delete folder = %v, want %d files left", got, tt.left)
+			}
+		})
+	}
+}
+
+func TestPurgeMemFS(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		files int
+		bytes int64
+		left  int
+	}{
+		{name: "purge", files: 2, bytes: 10, left: 1},
+		{name: "dry run", opts: Options{DryRun: true}, files: 2, bytes: 10, left: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"a.txt": "12345", "b.txt": "12345", "c.jpg": "abcde", "d.jpg": "abcde"}
+			journal := t.TempDir()
+			s, mem := newMemSorter(t, files, Options{JournalDir: journal})
+			if err := s.Dedupe(); err != nil {
+				t.Fatal(err)
+			}
+			// Put there by hand, so of unknown age: never purged
+			if err := mem.WriteFile(filepath.Join(s.opts.DeleteDir, "stray.txt"), []byte("stray")); err != nil {
+				t.Fatal(err)
+			}
+			opts := tt.opts
+			opts.JournalDir = journal
+			opts.InboxDir, opts.SortedDir, opts.DeleteDir = s.opts.InboxDir, s.opts.SortedDir, s.opts.DeleteDir
+			opts.Categories = s.opts.Categories
+			opts.Output = io.Discard
+			purger, err := New(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing has been in the delete folder for an hour yet
+			result, err := purger.Purge(time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Files != 0 {
+				t.Errorf("Purge(1h) removed %d files, want none", result.Files)
+			}
+
+			result, err = purger.Purge(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Files != tt.files || result.Bytes != tt.bytes {
+				t.Errorf("Purge(0) = %+v, want %d files of %d bytes", result, tt.files, tt.bytes)
+			}
+			if got := memTree(t, mem, s.opts.DeleteDir); len(got) != tt.left {
+				t.Errorf("delete folder = %v, want %d files left", got, tt.left)
+			}
+			if got := memTree(t, mem, s.opts.InboxDir); len(got) != 2 {
+				t.Errorf("inbox = %v, want the two originals", got)
+			}
+		})
+	}
+}
+
+// memDirFS lets fs.Glob look into a folder of a MemFS
+type memDirFS struct {
+	mem *MemFS
+	dir string
+}
+
+func (d memDirFS) Open(name string) (fs.File, error) {
+	return d.mem.Open(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+func (d memDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return d.mem.ReadDir(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+func TestReportHashesMemFS(t *testing.T) {
+	report := NewReport()
+	s, _ := newMemSorter(t, map[string]string{"a.txt": "a\n", "b.txt": "a\n", "c.txt": "unique"}, Options{Events: report.Record})
+	if err := s.Sort(); err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[string]string)
+	for _, row := range report.Rows() {
+		hashes[filepath.Base(row.Source)+" "+row.Action] = row.Hash
+	}
+	// The duplicate was hashed to be found, the unique file never was
+	want := map[string]string{"a.txt sorted": "", "b.txt duplicate": "fbbde8981eccc855", "c.txt sorted": ""}
+	if !maps.Equal(hashes, want) {
+		t.Errorf("report hashes = %v, want %v", hashes, want)
+	}
+}
+
+func TestCancelledMemFS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dir := t.TempDir()
+	s, mem := newMemSorter(t, nil, Options{Context: ctx, IndexFile: filepath.Join(dir, "index.json")})
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := mem.WriteFile(filepath.Join(s.opts.SortedDir, "Documents", name), []byte("same")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Index(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	if _, err := s.DedupeSorted(SortedDupReport); !errors.Is(err, ErrAborted) {
+		t.Errorf("DedupeSorted = %v, want ErrAborted", err)
+	}
+	if _, err := s.Verify(); !errors.Is(err, ErrAborted) {
+		t.Errorf("Verify = %v, want ErrAborted", err)
+	}
+	a, b := filepath.Join(s.opts.SortedDir, "Documents", "a.txt"), filepath.Join(s.opts.SortedDir, "Documents", "b.txt")
+	if _, err := s.filesEqual(a, b); !errors.Is(err, ErrAborted) {
+		t.Errorf("filesEqual = %v, want ErrAborted", err)
+	}
+}
@@ -0,0 +1,64 @@
+package sorter
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Merge imports another sorted tree into the sorted directory. Its files go
+// through the same steps as inbox files: duplicates of files already sorted
+// (or merged earlier in the pass) go to the delete folder, and unique files
+// are placed by the current categories and templates rather than where the
+// other tree kept them, so both trees end up in one layout. Folders emptied
+// in the other tree are removed. A *PartialError is returned when some files
+// could not be merged.
+func (s *Sorter) Merge(other string) error {
+	other, err := mountDir(other, s.opts)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	info, err := storageAt(other).Stat(other)
+	if err != nil {
+		return &ConfigError{fmt.Errorf("cannot access %s: %w", other, err)}
+	}
+	if !info.IsDir() {
+		return &ConfigError{fmt.Errorf("%s is not a directory", other)}
+	}
+	for _, dir := range []string{s.opts.SortedDir, s.opts.DeleteDir} {
+		if nested(other, dir) || nested(dir, other) {
+			return &ConfigError{fmt.Errorf("%s overlaps %s", other, dir)}
+		}
+	}
+	defer s.journal.close()
+
+	// The other tree stands in for the inbox. A checkpoint would be mistaken
+	// for one of an inbox run, so none is kept.
+	inbox, inboxes, checkpoint := s.opts.InboxDir, s.opts.Inboxes, s.opts.CheckpointFile
+	s.opts.InboxDir, s.opts.Inboxes, s.opts.CheckpointFile = other, nil, ""
+	defer func() { s.opts.InboxDir, s.opts.Inboxes, s.opts.CheckpointFile = inbox, inboxes, checkpoint }()
+
+	s.log.Info("Merging sorted tree", "src", other, "dest", s.opts.SortedDir)
+	mergeErr := s.processInbox(true)
+	s.saveUnknownExtensions()
+	if err := s.RemoveEmptyDirs(other); err != nil {
+		s.log.Error("Failed to clean empty folders", "err", err)
+	}
+	if mergeErr == nil {
+		s.log.Info("Merge completed successfully")
+	}
+	return mergeErr
+}
+
+// nested reports whether path is dir or lies inside it
+func nested(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && filepath.IsLocal(rel)
+}
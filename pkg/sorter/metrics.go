@@ -0,0 +1,182 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics counts what the runs of a Sorter did and serves the counts in
+// the Prometheus text format, for graphing a watching sorter and alerting
+// when it stops working. Give it as Options.Metrics and serve it on
+// /metrics; it is safe for concurrent use.
+type Metrics struct {
+	mu          sync.Mutex
+	sizes       map[string]int64 // Sizes of the files of the pass in progress, by path
+	moved       map[string]int64 // Files moved, by reason
+	movedBytes  map[string]int64
+	skipped     map[string]int64 // By reason
+	duplicates  int64
+	scanned     map[string]int64 // By result, clean or infected
+	errors      int64
+	queue       int              // Inbox files left in the pass in progress
+	runs        map[string]int64 // By result
+	running     bool
+	lastStart   time.Time
+	lastEnd     time.Time
+	lastSuccess time.Time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sizes:      make(map[string]int64),
+		moved:      make(map[string]int64),
+		movedBytes: make(map[string]int64),
+		skipped:    make(map[string]int64),
+		scanned:    make(map[string]int64),
+		runs:       make(map[string]int64),
+	}
+}
+
+// record counts an event. A nil *Metrics counts nothing, as do the
+// methods below.
+func (m *Metrics) record(event Event) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch event.Type {
+	case EventFile:
+		m.sizes[event.Path] = event.Size
+	case EventScanned:
+		if event.Reason == "clean" {
+			m.scanned["clean"]++
+		} else {
+			m.scanned["infected"]++
+		}
+	case EventDuplicate:
+		m.duplicates++
+	case EventMoved:
+		m.moved[event.Reason]++
+		m.movedBytes[event.Reason] += m.sizes[event.Path]
+		delete(m.sizes, event.Path)
+	case EventSkipped:
+		m.skipped[event.Reason]++
+		delete(m.sizes, event.Path)
+	case EventError:
+		m.errors++
+		delete(m.sizes, event.Path)
+	}
+}
+
+// setQueue records how many inbox files the pass in progress has left
+func (m *Metrics) setQueue(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.queue = n
+	m.mu.Unlock()
+}
+
+func (m *Metrics) runStarted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.running = true
+	m.lastStart = time.Now()
+	clear(m.sizes)
+	m.mu.Unlock()
+}
+
+// runFinished records the end of a run and its result: ok, partial (some
+// files failed), aborted or failed
+func (m *Metrics) runFinished(err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	var partial *PartialError
+	switch {
+	case errors.Is(err, ErrAborted):
+		result = "aborted"
+	case errors.As(err, &partial):
+		result = "partial"
+	case err != nil:
+		result = "failed"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running = false
+	m.queue = 0
+	m.lastEnd = time.Now()
+	if err == nil {
+		m.lastSuccess = m.lastEnd
+	}
+	m.runs[result]++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	labeled := func(name, label string, values map[string]int64) {
+		for _, key := range slices.Sorted(maps.Keys(values)) {
+			fmt.Fprintf(&b, "%s{%s=%q} %d\n", name, label, key, values[key])
+		}
+	}
+	seconds := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixMilli()) / 1000
+	}
+	running, duration := 0, 0.0
+	if m.running {
+		running = 1
+	}
+	if !m.lastEnd.IsZero() {
+		duration = m.lastEnd.Sub(m.lastStart).Seconds()
+	}
+
+	family("sorter_files_moved_total", "counter", "Files moved, by reason: sorted, duplicate, rule, replaced or hardlink.")
+	labeled("sorter_files_moved_total", "reason", m.moved)
+	family("sorter_bytes_moved_total", "counter", "Bytes of the inbox files moved, by reason.")
+	labeled("sorter_bytes_moved_total", "reason", m.movedBytes)
+	family("sorter_files_skipped_total", "counter", "Files left where they are, by reason.")
+	labeled("sorter_files_skipped_total", "reason", m.skipped)
+	family("sorter_files_scanned_total", "counter", "Files scanned by clamd, by result: clean or infected.")
+	labeled("sorter_files_scanned_total", "result", m.scanned)
+	family("sorter_duplicates_total", "counter", "Duplicates found.")
+	fmt.Fprintf(&b, "sorter_duplicates_total %d\n", m.duplicates)
+	family("sorter_errors_total", "counter", "Files that failed.")
+	fmt.Fprintf(&b, "sorter_errors_total %d\n", m.errors)
+	family("sorter_queue_files", "gauge", "Inbox files the run in progress has left to process.")
+	fmt.Fprintf(&b, "sorter_queue_files %d\n", m.queue)
+	family("sorter_runs_total", "counter", "Runs finished, by result: ok, partial, aborted or failed.")
+	labeled("sorter_runs_total", "result", m.runs)
+	family("sorter_run_in_progress", "gauge", "1 while a run is in progress.")
+	fmt.Fprintf(&b, "sorter_run_in_progress %d\n", running)
+	family("sorter_last_run_timestamp_seconds", "gauge", "When the last run finished, 0 before the first.")
+	fmt.Fprintf(&b, "sorter_last_run_timestamp_seconds %.3f\n", seconds(m.lastEnd))
+	family("sorter_last_run_duration_seconds", "gauge", "How long the last finished run took.")
+	fmt.Fprintf(&b, "sorter_last_run_duration_seconds %g\n", duration)
+	family("sorter_last_success_timestamp_seconds", "gauge", "When the last run without failures finished, 0 before the first.")
+	fmt.Fprintf(&b, "sorter_last_success_timestamp_seconds %.3f\n", seconds(m.lastSuccess))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
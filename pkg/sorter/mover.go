@@ -0,0 +1,726 @@
+package sorter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Default destination name templates
+const (
+	DefaultNameTemplate   = "{category}/{name}{ext}"
+	DefaultDeleteTemplate = "{name}_{hash6}_processed_delete{ext}"
+)
+
+// destName resolves the placeholders of a name template for one file
+type destName struct {
+	ctx         context.Context
+	src         string
+	category    string
+	hasher      Hasher
+	replacement string      // For the characters {name} and {ext} can't contain
+	form        string      // Unicode normalization of the destination
+	classifier  *Classifier // Splits off compound extensions such as .tar.gz
+	hash        string      // Computed on first use
+}
+
+func (d *destName) fileHash() (string, error) {
+	if d.hash == "" {
+		hash, err := hashFile(d.ctx, d.src, d.hasher, -1)
+		if err != nil {
+			return "", err
+		}
+		d.hash = hash
+	}
+	return d.hash, nil
+}
+
+// path expands template below root. suffix is appended to {name}, which is
+// how name collisions are resolved. When the file lacks metadata the
+// template needs, fallback is used instead. The result is normalized, and
+// parts that exist in another normalization are used as they exist.
+func (d *destName) path(root, template, fallback, suffix string) (string, error) {
+	base := sanitizeName(filepath.Base(d.src), d.replacement)
+	ext := d.classifier.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	vars := map[string]func() (string, error){
+		"name":     func() (string, error) { return name + suffix, nil },
+		"ext":      func() (string, error) { return ext, nil },
+		"category": func() (string, error) { return filepath.ToSlash(d.category), nil },
+		"hash":     d.fileHash,
+		"hash6": func() (string, error) {
+			hash, err := d.fileHash()
+			if err != nil {
+				return "", err
+			}
+			return hash[:6], nil // First 6 characters of the hash
+		},
+	}
+
+	rel, ok, err := expandTemplate(template, d.src, vars)
+	if err == nil && !ok {
+		rel, _, err = expandTemplate(fallback, d.src, vars)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("name template %q gives %q, which is outside %s", template, rel, root)
+	}
+	if d.form == NormalizeNone {
+		return filepath.Join(root, rel), nil
+	}
+	return resolveEquivalent(root, filepath.Join(root, normalize(rel, d.form))), nil
+}
+
+// Collision policies, deciding what happens when a sorted file's destination
+// is already taken
+const (
+	CollisionSuffixHash         = "suffix-hash"            // Append the first 6 characters of the hash (default)
+	CollisionSuffixCounter      = "suffix-counter"         // Append _1, _2, ...
+	CollisionSkip               = "skip"                   // Leave the file in the inbox
+	CollisionOverwriteIdentical = "overwrite-if-identical" // Replace the existing file if it has the same content, else skip
+	CollisionFail               = "fail"                   // Stop the run
+)
+
+// CollisionPolicies lists the valid collision policies
+var CollisionPolicies = []string{CollisionSuffixHash, CollisionSuffixCounter, CollisionSkip, CollisionOverwriteIdentical, CollisionFail}
+
+// ErrDestinationExists is returned when the fail collision policy stops a run
+var ErrDestinationExists = errors.New("destination already exists")
+
+// sameContent reports whether two files have identical content
+func (s *Sorter) sameContent(a, b string) (bool, error) {
+	infoA, err := storageAt(a).Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := storageAt(b).Stat(b)
+	if err != nil {
+		return false, nil // b may only be planned (dry-run)
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+	hashA, err := hashFile(s.ctx, a, s.hasher, -1)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := hashFile(s.ctx, b, s.hasher, -1)
+	if err != nil {
+		return false, err
+	}
+	if hashA != hashB {
+		return false, nil
+	}
+	return s.sameBytes(a, b)
+}
+
+// Function to move file to its category in the sorted folder, named after
+// the name template. It returns where the file went (or would go in a dry
+// run), or "" when it was left in place.
+func (s *Sorter) moveFile(src, category string) (string, error) {
+	name := &destName{ctx: s.ctx, src: src, category: category, hasher: s.hasher, replacement: s.opts.Replacement, form: s.opts.Normalization, classifier: s.classifier}
+	destFilePath, err := name.path(s.opts.SortedDir, s.opts.NameTemplate, DefaultNameTemplate, "")
+	if err != nil {
+		return "", err
+	}
+
+	// Check if the file already exists in the destination folder
+	replace := false
+	if s.destExists(src, destFilePath) {
+		switch s.opts.CollisionPolicy {
+		case CollisionSuffixHash:
+			// File exists, create a new name using the hash (first 6 characters)
+			hash, err := name.fileHash()
+			if err != nil {
+				return "", err
+			}
+			destFilePath, err = name.path(s.opts.SortedDir, s.opts.NameTemplate, DefaultNameTemplate, "_"+hash[:6])
+			if err != nil {
+				return "", err
+			}
+		case CollisionSuffixCounter:
+			for i := 1; s.destExists(src, destFilePath); i++ {
+				destFilePath, err = name.path(s.opts.SortedDir, s.opts.NameTemplate, DefaultNameTemplate, fmt.Sprintf("_%d", i))
+				if err != nil {
+					return "", err
+				}
+			}
+		case CollisionSkip:
+			s.log.Warn("Destination already exists, leaving file in place", "path", src, "dest", destFilePath)
+			s.emit(Event{Type: EventSkipped, Path: src, Dest: destFilePath, Reason: "collision"})
+			return "", nil
+		case CollisionOverwriteIdentical:
+			identical, err := s.sameContent(src, destFilePath)
+			if err != nil {
+				return "", err
+			}
+			if !identical {
+				s.log.Warn("Destination already exists with different content, leaving file in place", "path", src, "dest", destFilePath)
+				s.emit(Event{Type: EventSkipped, Path: src, Dest: destFilePath, Reason: "collision"})
+				return "", nil
+			}
+			replace = true
+		default: // CollisionFail
+			return "", fmt.Errorf("%w: %s", ErrDestinationExists, destFilePath)
+		}
+	}
+
+	if clean := sanitizeName(filepath.Base(src), s.opts.Replacement); clean != filepath.Base(src) {
+		s.log.Info("Sanitizing file name", "path", src, "name", clean)
+	}
+
+	if ok, err := s.confirm(src, destFilePath, "sorted"); !ok {
+		return "", err
+	}
+
+	// The identical copy being replaced goes to the delete folder, so the
+	// replacement is journaled (and undone) like any other move
+	if replace {
+		s.log.Info("Replacing identical file", "path", destFilePath)
+		if err := s.moveFileWithMetadata(destFilePath, s.opts.DeleteDir, "replaced", src); err != nil {
+			return "", err
+		}
+	}
+
+	if s.opts.DryRun {
+		s.planMove(src, destFilePath, "sorted", name.hash)
+		return destFilePath, nil
+	}
+
+	dest := filepath.Dir(destFilePath)
+	s.log.Debug("Moving file", "src", src, "dir", dest)
+	if err := storageAt(dest).MkdirAll(dest); err != nil {
+		return "", err
+	}
+
+	// Move the file to the destination
+	err = s.renameFile(src, destFilePath)
+	if err != nil {
+		return "", err
+	}
+	s.journal.record(JournalEntry{Action: "move", Src: src, Dest: destFilePath, Reason: "sorted"})
+
+	s.log.Info("File moved", "src", src, "dest", destFilePath)
+	s.emit(Event{Type: EventMoved, Path: src, Dest: destFilePath, Reason: "sorted", Hash: name.hash})
+	return destFilePath, nil
+}
+
+// Function to move file to the delete folder with metadata (hash-based
+// name, from the delete template). The journal keeps where it came from and
+// the file it duplicates, for restore.
+func (s *Sorter) moveFileWithMetadata(src, dest, reason, duplicateOf string) error {
+	name := &destName{ctx: s.ctx, src: src, hasher: s.hasher, replacement: s.opts.Replacement, form: s.opts.Normalization, classifier: s.classifier}
+	if strings.Contains(s.opts.DeleteTemplate, "{category}") {
+		name.category = s.classifier.Classify(src)
+		if name.category == LeaveInInbox {
+			name.category = expandFallback(DefaultUnknownCategory, strings.TrimPrefix(filepath.Ext(src), "."))
+		}
+	}
+	destFilePath, err := name.path(dest, s.opts.DeleteTemplate, DefaultDeleteTemplate, "")
+	if err != nil {
+		return err
+	}
+	// Same-named files from different inbox folders, or a template without
+	// the hash, would otherwise take each other's place
+	for i := 1; s.destExists(src, destFilePath); i++ {
+		if destFilePath, err = name.path(dest, s.opts.DeleteTemplate, DefaultDeleteTemplate, fmt.Sprintf("_%d", i)); err != nil {
+			return err
+		}
+	}
+
+	// A replaced file was confirmed along with its replacement
+	if reason != "replaced" {
+		if ok, err := s.confirm(src, destFilePath, reason); !ok {
+			return err
+		}
+	}
+
+	if s.opts.DryRun {
+		s.planMove(src, destFilePath, reason, name.hash)
+		return nil
+	}
+
+	s.log.Debug("Moving file to delete folder", "src", src)
+	if err := storageAt(destFilePath).MkdirAll(filepath.Dir(destFilePath)); err != nil {
+		return err
+	}
+
+	err = s.renameFile(src, destFilePath)
+	if err != nil {
+		return err
+	}
+	s.journal.record(JournalEntry{Action: "move", Src: src, Dest: destFilePath, Reason: reason, DuplicateOf: duplicateOf})
+
+	s.log.Info("File moved to delete folder", "src", src, "dest", destFilePath, "reason", reason)
+	s.emit(Event{Type: EventMoved, Path: src, Dest: destFilePath, Reason: reason, Hash: name.hash})
+	return nil
+}
+
+// moveToDelete moves a file to the delete folder (or the trash), reporting
+// failures. Only ErrAborted is returned.
+func (s *Sorter) moveToDelete(filePath, reason, duplicateOf string) error {
+	var err error
+	if s.opts.Trash {
+		err = s.trashFile(filePath, reason, duplicateOf)
+	} else {
+		err = s.moveFileWithMetadata(filePath, s.opts.DeleteDir, reason, duplicateOf)
+	}
+	if errors.Is(err, ErrAborted) {
+		return err
+	}
+	if err != nil {
+		s.log.Error("Failed to move file to delete folder", "path", filePath, "err", err)
+		s.emitError(filePath, err)
+	}
+	return nil
+}
+
+// confirm asks Options.Confirm, if set, whether a move may go ahead
+func (s *Sorter) confirm(src, dest, reason string) (bool, error) {
+	if s.opts.Confirm == nil {
+		return true, nil
+	}
+	ok, err := s.opts.Confirm(src, dest, reason)
+	if err != nil || ok {
+		return ok, err
+	}
+	s.log.Info("Move declined", "path", src, "dest", dest, "reason", reason)
+	s.emit(Event{Type: EventSkipped, Path: src, Dest: dest, Reason: "declined"})
+	return false, nil
+}
+
+// Updated file sorting logic. A matching category rule overrides the
+// extension map (the mismatch check and the routing of encrypted archives),
+// and malware found by clamd or a file held back by the quarantine policy
+// overrides both. Returns where the
+// file went, as moveFile does. Only errors that should stop the run
+// (ErrDestinationExists, ErrAborted, the end of Options.Context) are
+// returned; others are reported.
+func (s *Sorter) moveFileBasedOnExtension(filePath string, rule *Rule) (string, error) {
+	var category string
+	if s.clamd != nil {
+		malware, err := s.scanFile(filePath)
+		if err != nil && s.ctx.Err() != nil {
+			return "", err
+		}
+		if err != nil {
+			s.log.Error("Failed to scan file, leaving it in the inbox", "path", filePath, "err", err)
+			s.emitError(filePath, err)
+			return "", nil
+		}
+		if malware != "" {
+			s.log.Warn("Malware found, quarantining", "path", filePath, "malware", malware)
+			category = filepath.FromSlash(s.opts.MalwareCategory)
+			s.emit(Event{Type: EventCategory, Path: filePath, Category: s.opts.MalwareCategory, Reason: "malware"})
+		}
+	}
+	if category == "" && s.opts.Quarantine != nil {
+		reason, detail, err := s.opts.Quarantine.check(filePath, s.classifier.Ext(filePath))
+		if err != nil {
+			s.log.Error("Failed to check file against the quarantine policy", "path", filePath, "err", err)
+			s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+		} else if reason != "" {
+			s.log.Warn("Suspicious file, quarantining", "path", filePath, "reason", reason, "detail", detail)
+			category = filepath.FromSlash(s.opts.Quarantine.category())
+			s.emit(Event{Type: EventCategory, Path: filePath, Category: s.opts.Quarantine.category(), Reason: reason, Detail: detail})
+		}
+	}
+	if category == "" && rule == nil && s.opts.EncryptedCategory != "" {
+		format, err := archiveEncrypted(filePath)
+		switch {
+		case err != nil:
+			s.log.Error("Failed to check archive for encryption", "path", filePath, "err", err)
+			s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+		case format != "" && s.opts.EncryptedCategory == LeaveInInbox:
+			s.log.Info("Encrypted archive, leaving it in the inbox", "path", filePath, "format", format)
+			s.emit(Event{Type: EventSkipped, Path: filePath, Reason: "encrypted"})
+			return "", nil
+		case format != "":
+			s.log.Info("Encrypted archive", "path", filePath, "format", format, "category", s.opts.EncryptedCategory)
+			category = filepath.FromSlash(s.opts.EncryptedCategory)
+			s.emit(Event{Type: EventCategory, Path: filePath, Category: s.opts.EncryptedCategory, Reason: "encrypted", Detail: format})
+		}
+	}
+	if category == "" {
+		category = s.categoryFor(filePath, rule)
+	}
+	if category == LeaveInInbox {
+		s.log.Info("Unknown extension, leaving file in inbox", "path", filePath)
+		s.emit(Event{Type: EventSkipped, Path: filePath, Reason: "unknown-extension"})
+		return "", nil
+	}
+	dest, err := s.moveFile(filePath, category)
+	if errors.Is(err, ErrAborted) {
+		return "", err
+	}
+	if err != nil {
+		s.emitError(filePath, err)
+	}
+	if errors.Is(err, ErrDestinationExists) {
+		return "", err
+	}
+	if err != nil {
+		s.log.Error("Failed to move file", "path", filePath, "err", err)
+	}
+	return dest, nil
+}
+
+// categoryFor decides the category path of a file, subfolders from the
+// category's layout included. It is LeaveInInbox for files the unknown
+// extension fallbacks leave in the inbox.
+func (s *Sorter) categoryFor(filePath string, rule *Rule) string {
+	var categoryPath, reason, detail string
+	if rule != nil && rule.Action == ActionCategory {
+		s.log.Info("Rule matched", "path", filePath, "rule", rule.Name, "category", rule.Category)
+		categoryPath = filepath.FromSlash(rule.Category)
+	} else {
+		var unknownExt string
+		categoryPath, unknownExt = s.classifier.classify(filePath)
+		if s.opts.Script != nil {
+			category, err := s.opts.Script.run(filePath, s.classifier.Ext(filePath), categoryPath, s.log)
+			if err != nil {
+				s.log.Error("Rules script failed, using the built-in category", "path", filePath, "err", err)
+				s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+			} else if category != categoryPath {
+				s.log.Debug("Rules script chose category", "path", filePath, "category", category)
+				categoryPath, unknownExt = category, ""
+			}
+		}
+		for _, module := range s.modules {
+			category, err := module.classify(filePath, s.classifier.Ext(filePath), categoryPath)
+			if err != nil {
+				s.log.Error("Classifier module failed, using the built-in category", "path", filePath, "err", err)
+				s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+			} else if category != categoryPath {
+				s.log.Debug("Classifier module chose category", "path", filePath, "module", module.module.name, "category", category)
+				categoryPath, unknownExt = category, ""
+			}
+		}
+		if s.plugin != nil {
+			category, err := s.plugin.classify(filePath, s.classifier.Ext(filePath), categoryPath)
+			if err != nil {
+				s.log.Error("External classifier failed, using the built-in category", "path", filePath, "err", err)
+				s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+			} else if category != categoryPath {
+				s.log.Debug("External classifier chose category", "path", filePath, "category", category)
+				categoryPath, unknownExt = category, ""
+			}
+		}
+		if unknownExt != "" {
+			s.recordUnknown(filePath, unknownExt)
+			reason = "unknown-extension"
+		}
+		if categoryPath == LeaveInInbox {
+			return LeaveInInbox
+		}
+	}
+
+	// Don't trust the extension of a file whose content says otherwise
+	mismatched := false
+	if s.opts.MismatchCategory != "" && rule == nil {
+		mismatch, expected, actual, err := DetectMismatch(filePath)
+		if err != nil {
+			s.log.Error("Failed to check content", "path", filePath, "err", err)
+			s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+		} else if mismatch {
+			s.log.Warn("Extension mismatch, quarantining", "path", filePath, "expected", expected, "actual", actual)
+			categoryPath = s.opts.MismatchCategory
+			mismatched = true
+		}
+	}
+
+	// Nor file a damaged one with the intact files of its kind
+	if s.opts.CorruptCategory != "" && rule == nil && !mismatched {
+		problem, err := CheckIntegrity(filePath)
+		if err != nil {
+			s.log.Error("Failed to check integrity", "path", filePath, "err", err)
+			s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+		} else if problem != "" {
+			s.log.Warn("Corrupt file, quarantining", "path", filePath, "problem", problem)
+			categoryPath = filepath.FromSlash(s.opts.CorruptCategory)
+			reason, detail = "corrupt", problem
+		}
+	}
+
+	// Place the file in date (or tag) subfolders if the category asks for it
+	if layout := s.classifier.Layout(categoryPath); layout != "" {
+		subPath, ok, err := expandLayout(layout, filePath)
+		switch {
+		case err != nil:
+			s.log.Error("Failed to read metadata", "path", filePath, "err", err)
+			s.emit(Event{Type: EventError, Path: filePath, Error: err.Error()}) // Not fatal for the file
+		case !ok:
+			s.log.Info("Missing metadata for layout, using the plain category", "path", filePath, "layout", layout, "category", categoryPath)
+		default:
+			categoryPath = filepath.Join(categoryPath, subPath)
+		}
+	}
+	ruleName := ""
+	if rule != nil {
+		ruleName = rule.Name
+	}
+	s.emit(Event{Type: EventCategory, Path: filePath, Category: filepath.ToSlash(categoryPath), Rule: ruleName, Reason: reason, Detail: detail})
+	return categoryPath
+}
+
+// RemoveEmptyDirs scans and removes empty folders in the inbox directory after sorting
+func (s *Sorter) RemoveEmptyDirs(root string) error {
+	st := storageAt(root)
+	return walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			s.log.Warn("Skipping folder", "path", path, "err", err)
+			return nil
+		}
+		if path == root || !info.IsDir() {
+			return nil
+		}
+		entries, err := st.ReadDir(path)
+		if err != nil {
+			return nil // skip if we can't read
+		}
+		if s.opts.DryRun {
+			if s.wouldBeEmpty(path, entries) {
+				s.log.Info("Would remove empty folder", "path", path)
+				s.emit(Event{Type: EventRemoved, Path: path})
+			}
+			return nil
+		}
+		if len(entries) == 0 {
+			s.log.Info("Removing empty folder", "path", path)
+			if err := st.Remove(path); err != nil {
+				return err
+			}
+			s.journal.record(JournalEntry{Action: "rmdir", Src: path, Reason: "empty-folder"})
+			s.emit(Event{Type: EventRemoved, Path: path})
+		}
+		return nil
+	})
+}
+
+// destExists reports whether a destination is taken on disk or, in dry-run
+// mode, by a move planned earlier in the run. On a case-insensitive
+// filesystem a name differing only in case takes it too, unless that entry
+// is src itself, which is then merely renamed.
+func (s *Sorter) destExists(src, path string) bool {
+	if s.opts.DryRun && s.plannedDests[s.pathKey(path)] {
+		return true
+	}
+	info, err := storageAt(path).Stat(path)
+	if err != nil {
+		return false
+	}
+	if s.foldCase() && filepath.Base(path) != filepath.Base(src) {
+		if srcInfo, err := os.Stat(src); err == nil && os.SameFile(info, srcInfo) {
+			return false
+		}
+	}
+	return true
+}
+
+// planMove records and reports a move that dry-run mode skipped, with the
+// hash of the file if it was computed
+func (s *Sorter) planMove(src, dest, reason, hash string) {
+	s.plannedDests[s.pathKey(dest)] = true
+	s.plannedSrcs[src] = true
+	s.log.Info("Would move", "src", src, "dest", dest, "reason", reason)
+	s.emit(Event{Type: EventMoved, Path: src, Dest: dest, Reason: reason, Hash: hash})
+}
+
+// wouldBeEmpty reports whether a folder would be empty once the planned
+// moves had happened
+func (s *Sorter) wouldBeEmpty(dir string, entries []os.DirEntry) bool {
+	for _, entry := range entries {
+		if !s.plannedSrcs[filepath.Join(dir, entry.Name())] {
+			return false
+		}
+	}
+	return true
+}
+
+// ERROR_NOT_SAME_DEVICE, what Windows returns instead of EXDEV
+const errNotSameDevice = syscall.Errno(17)
+
+// renameFile moves src to dest. When they live on different filesystems
+// (os.Rename fails with EXDEV, or checkMounts found them apart) or
+// storages, the file is copied instead, verified, given the metadata
+// Options.Preserve names and only then removed from its original location.
+func (s *Sorter) renameFile(src, dest string) error {
+	if !s.separateMounts(src, dest) {
+		err := renamePath(src, dest)
+		if err == nil || !isCrossDevice(err) {
+			return err
+		}
+	}
+
+	s.log.Info("Cross-device move, copying instead", "src", src)
+	cloned, err := s.copyVerified(src, dest)
+	if err != nil {
+		return err
+	}
+	if cloned {
+		s.log.Debug("Copied by cloning", "src", src)
+	}
+	return storageAt(src).Remove(src)
+}
+
+func isCrossDevice(err error) bool {
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return false
+	}
+	if linkErr.Err == errCrossStorage {
+		return true
+	}
+	if runtime.GOOS == "windows" {
+		return linkErr.Err == errNotSameDevice
+	}
+	return linkErr.Err == syscall.EXDEV
+}
+
+// copyVerified copies src into a temporary file next to dest, checks that
+// the copy hashes the same as the source, and atomically renames it into
+// place so dest is never left half-written. Where the filesystem supports
+// it (e.g. between Btrfs subvolumes) the file is cloned instead, which is
+// instant, takes no space and needs no verification. The metadata named by
+// Options.Preserve is carried over once the copy is verified.
+func (s *Sorter) copyVerified(src, dest string) (cloned bool, err error) {
+	if isRemote(src) || isRemote(dest) {
+		return false, s.copyAcross(src, dest)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".sorter-*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	cloned = cloneFile(tmp, in) == nil
+	srcHash := xxhash.New()
+	if !cloned {
+		if _, err = copyBuffered(s.ctx, tmp, io.TeeReader(in, srcHash), src, dest); err != nil {
+			return false, fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return false, err
+	}
+	if err = tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if !cloned {
+		copyHash, err := fileHash(s.ctx, tmp.Name())
+		if err != nil {
+			return false, err
+		}
+		if want := fmt.Sprintf("%x", srcHash.Sum64()); copyHash != want {
+			return false, fmt.Errorf("copy of %s failed verification (hash %s, expected %s)", src, copyHash, want)
+		}
+	}
+	if err = s.preserveMetadata(src, tmp.Name(), info); err != nil {
+		return false, err
+	}
+
+	return cloned, os.Rename(tmp.Name(), dest)
+}
+
+// copyAcross is copyVerified for files on different storages, at least one
+// of them remote. The copy is hashed where it landed, by the server when it
+// can, unless the storage has the server check it as it is written. Only
+// the mode and modification time are carried over.
+func (s *Sorter) copyAcross(src, dest string) (err error) {
+	srcStorage, destStorage := storageAt(src), storageAt(dest)
+	in, err := srcStorage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := destStorage.(atomicStorage); ok {
+		out, err := destStorage.Create(dest)
+		if err != nil {
+			return err
+		}
+		if _, err := copyBuffered(s.ctx, out, in, src, dest); err != nil {
+			if a, ok := out.(aborter); ok {
+				a.abort()
+			}
+			return fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+		return out.Close()
+	}
+
+	tmp := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".sorter-%016x.tmp", rand.Uint64()))
+	out, err := destStorage.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			destStorage.Remove(tmp)
+		}
+	}()
+
+	srcHash := xxhash.New()
+	if _, err = copyBuffered(s.ctx, out, io.TeeReader(in, srcHash), src, dest); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	copyHash, err := fileHash(s.ctx, tmp)
+	if err != nil {
+		return err
+	}
+	if want := fmt.Sprintf("%x", srcHash.Sum64()); copyHash != want {
+		return fmt.Errorf("copy of %s failed verification (hash %s, expected %s)", src, copyHash, want)
+	}
+	if ms, ok := destStorage.(modeSetter); ok && s.preserve.mode {
+		if err = ms.Chmod(tmp, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if ts, ok := destStorage.(timeSetter); ok && s.preserve.times {
+		// Servers may not let times be set
+		if err = ts.Chtimes(tmp, accessTime(info), info.ModTime()); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	return destStorage.Rename(tmp, dest)
+}
@@ -0,0 +1,183 @@
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// networkBufferSize is how much is read at once from files on network shares
+// and remote storages, where every read costs a round trip
+const networkBufferSize = 1 << 20
+
+var networkBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, networkBufferSize)
+	return &buf
+}}
+
+// Local directories found on network filesystems, with the filesystem type
+var (
+	networkMu   sync.RWMutex
+	networkDirs = make(map[string]string)
+)
+
+// existingDir returns dir or, when it doesn't exist yet, the nearest folder
+// above it that does, which is where it would be created
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// probeNetworkDir records whether the local directory dir is on a network
+// filesystem such as NFS or SMB, and returns its type if so
+func probeNetworkDir(dir string) (string, bool) {
+	fstype, ok := networkFilesystem(existingDir(dir))
+	if !ok {
+		return "", false
+	}
+	networkMu.Lock()
+	defer networkMu.Unlock()
+	networkDirs[dir] = fstype
+	return fstype, true
+}
+
+// onNetwork reports whether any of paths lies on a remote storage or below
+// a directory found on a network filesystem
+func onNetwork(paths ...string) bool {
+	networkMu.RLock()
+	defer networkMu.RUnlock()
+	for _, path := range paths {
+		if isRemote(path) {
+			return true
+		}
+		for dir := range networkDirs {
+			if nested(path, dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyBuffered is io.Copy, with large reads when the data comes from or goes
+// to one of paths on the network. It stops with abortErr once ctx is done.
+// Options.BandwidthLimit applies here, so to hashing as well as copies.
+func copyBuffered(ctx context.Context, dst io.Writer, src io.Reader, paths ...string) (int64, error) {
+	src = ctxReader{ctx, src}
+	if !onNetwork(paths...) {
+		return io.Copy(dst, src)
+	}
+	buf := networkBuffers.Get().(*[]byte)
+	defer networkBuffers.Put(buf)
+	// Hidden from io.CopyBuffer, ReadFrom would use a buffer of its own
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
+
+// ctxReader fails reads once ctx is done, so hashing or copying a large
+// file stops midway, and keeps them to the bandwidth limit ctx carries
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, abortErr(r.ctx)
+	}
+	n, err := r.r.Read(p)
+	tracking(r.ctx).touch()
+	if waitErr := bandwidth(r.ctx).wait(r.ctx, n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// checkMounts notes which working directories are on network shares and
+// which filesystem each local one is on, so moves between filesystems are
+// copied right away
+func (s *Sorter) checkMounts() {
+	s.mountIDs = make(map[string]string)
+	for _, dir := range s.workDirs() {
+		if isRemote(dir) {
+			continue
+		}
+		if fstype, ok := probeNetworkDir(dir); ok {
+			s.log.Debug("Directory is on a network share", "dir", dir, "filesystem", fstype)
+		}
+		if id, ok := mountID(existingDir(dir)); ok {
+			s.mountIDs[dir] = id
+		}
+	}
+	for _, inbox := range s.inboxes() {
+		if s.separateMounts(inbox.Dir, s.opts.SortedDir) {
+			s.log.Debug("Inbox and sorted directory are on different filesystems, files will be copied and verified", "inbox", inbox.Dir, "sorted", s.opts.SortedDir)
+		}
+	}
+}
+
+// workDirs lists the inboxes, the sorted and the delete directory
+func (s *Sorter) workDirs() []string {
+	var dirs []string
+	for _, inbox := range s.inboxes() {
+		dirs = append(dirs, inbox.Dir)
+	}
+	return append(dirs, s.opts.SortedDir, s.opts.DeleteDir)
+}
+
+// separateMounts reports whether a and b, below working directories, are
+// known to be on different local filesystems, where renames can't work
+func (s *Sorter) separateMounts(a, b string) bool {
+	idA, idB := s.mountOf(a), s.mountOf(b)
+	return idA != "" && idB != "" && idA != idB
+}
+
+// mountOf returns the filesystem of the working directory holding path, ""
+// when unknown. The innermost directory wins, as the delete directory may
+// lie in the inbox.
+func (s *Sorter) mountOf(path string) string {
+	var best, id string
+	for dir, dirID := range s.mountIDs {
+		if nested(path, dir) && len(dir) > len(best) {
+			best, id = dir, dirID
+		}
+	}
+	return id
+}
+
+// sharedDirs returns the working directories on network shares or remote
+// storages that are there
+func (s *Sorter) sharedDirs() []string {
+	var dirs []string
+	for _, dir := range s.workDirs() {
+		if !onNetwork(dir) {
+			continue
+		}
+		if _, err := storageAt(dir).Stat(dir); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// lostShare checks, after a failure, whether one of dirs (see sharedDirs)
+// has gone away, as when a NAS drops off the network or a share is
+// unmounted
+func lostShare(dirs []string) error {
+	for _, dir := range dirs {
+		if _, err := storageAt(dir).Stat(dir); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrShareLost, dir, err)
+		}
+	}
+	return nil
+}
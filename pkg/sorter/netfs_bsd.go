@@ -0,0 +1,42 @@
+//go:build darwin || freebsd
+
+package sorter
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Filesystem type names statfs reports for network filesystems
+var networkTypes = map[string]bool{
+	"nfs":    true,
+	"smbfs":  true,
+	"afpfs":  true,
+	"webdav": true,
+	"cifs":   true,
+}
+
+// networkFilesystem reports the type of the network filesystem dir is on
+func networkFilesystem(dir string) (string, bool) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return "", false
+	}
+	var name []byte
+	for _, c := range fs.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name), networkTypes[string(name)]
+}
+
+// mountID identifies the filesystem dir is on
+func mountID(dir string) (string, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return "", false
+	}
+	return fmt.Sprint(st.Dev), true
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package sorter
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Magic numbers statfs reports for network filesystems
+var networkMagic = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x01021997: "9p", // Also how WSL sees Windows drives
+	0x00c36400: "ceph",
+	0x5346414f: "afs",
+	0x47504653: "gpfs",
+	0x0bd00bd0: "lustre",
+}
+
+// networkFilesystem reports the type of the network filesystem dir is on
+func networkFilesystem(dir string) (string, bool) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return "", false
+	}
+	fstype, ok := networkMagic[int64(fs.Type)]
+	return fstype, ok
+}
+
+// mountID identifies the filesystem dir is on
+func mountID(dir string) (string, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return "", false
+	}
+	return fmt.Sprint(st.Dev), true
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package sorter
+
+// networkFilesystem can't tell network filesystems apart on this platform
+func networkFilesystem(dir string) (string, bool) {
+	return "", false
+}
+
+// mountID can't tell filesystems apart on this platform, renames between
+// them are left to fail and fall back to copying
+func mountID(dir string) (string, bool) {
+	return "", false
+}
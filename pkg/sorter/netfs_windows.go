@@ -0,0 +1,47 @@
+//go:build windows
+
+package sorter
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDriveTypeW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW")
+
+const driveRemote = 4
+
+// volumeOf returns the drive or share dir is on, as C:\ or \\server\share\,
+// without the extended-length prefix
+func volumeOf(dir string) string {
+	volume := filepath.VolumeName(dir)
+	if rest, ok := strings.CutPrefix(volume, `\\?\UNC\`); ok {
+		volume = `\\` + rest
+	} else {
+		volume = strings.TrimPrefix(volume, `\\?\`)
+	}
+	return volume + `\`
+}
+
+// networkFilesystem reports whether dir is on a share, by UNC path or
+// mapped drive
+func networkFilesystem(dir string) (string, bool) {
+	volume := volumeOf(dir)
+	if strings.HasPrefix(volume, `\\`) {
+		return "smb", true
+	}
+	p, err := syscall.UTF16PtrFromString(volume)
+	if err != nil {
+		return "", false
+	}
+	kind, _, _ := procGetDriveTypeW.Call(uintptr(unsafe.Pointer(p)))
+	return "smb", kind == driveRemote
+}
+
+// mountID identifies the drive or share dir is on
+func mountID(dir string) (string, bool) {
+	volume := volumeOf(dir)
+	return strings.ToLower(volume), volume != `\`
+}
@@ -0,0 +1,214 @@
+package sorter
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:generate go run ../../internal/gen/normtables -version 14.0.0 -output normtables.go
+
+// Unicode normalization forms for file names. The same accented name can be
+// written as one precomposed character or as a letter followed by combining
+// marks; macOS produces the latter, most other systems the former.
+const (
+	NormalizeNFC  = "nfc"  // Composed, as Windows and Linux programs usually write names (default)
+	NormalizeNFD  = "nfd"  // Decomposed, as macOS HFS+ stores names
+	NormalizeNone = "none" // Names are kept byte for byte
+)
+
+// Normalizations lists the valid normalization forms
+var Normalizations = []string{NormalizeNFC, NormalizeNFD, NormalizeNone}
+
+// normalize returns s in the given normalization form
+func normalize(s, form string) string {
+	if form == NormalizeNone || isASCII(s) {
+		return s
+	}
+	runes := decomposeString(s)
+	if form == NormalizeNFC {
+		runes = compose(runes)
+	}
+	return string(runes)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Hangul syllables are composed and decomposed arithmetically
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// decomposeString returns the canonical decomposition of s (NFD), combining
+// marks in canonical order
+func decomposeString(s string) []rune {
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		runes = decompose(runes, r)
+	}
+	// Reorder each run of combining marks by class, keeping marks of the
+	// same class in their order
+	for start := 0; start < len(runes); {
+		if combiningClass(runes[start]) == 0 {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && combiningClass(runes[end]) != 0 {
+			end++
+		}
+		slices.SortStableFunc(runes[start:end], func(a, b rune) int {
+			return cmp.Compare(combiningClass(a), combiningClass(b))
+		})
+		start = end
+	}
+	return runes
+}
+
+// decompose appends the full canonical decomposition of r to dst
+func decompose(dst []rune, r rune) []rune {
+	if s := r - hangulSBase; s >= 0 && s < hangulSCount {
+		dst = append(dst, hangulLBase+s/hangulNCount, hangulVBase+s%hangulNCount/hangulTCount)
+		if t := s % hangulTCount; t != 0 {
+			dst = append(dst, hangulTBase+t)
+		}
+		return dst
+	}
+	d, ok := decompositions[r]
+	if !ok {
+		return append(dst, r)
+	}
+	for _, c := range d {
+		dst = decompose(dst, c)
+	}
+	return dst
+}
+
+// compose turns decomposed runes into their canonical composition (NFC),
+// reusing the slice
+func compose(runes []rune) []rune {
+	out := runes[:0]
+	starter := -1
+	var lastClass uint8
+	for _, r := range runes {
+		class := combiningClass(r)
+		// A mark can join the last starter unless something in between
+		// has a class at least as high, or is a starter itself
+		blocked := len(out)-1 > starter && (lastClass == 0 || lastClass >= class)
+		if starter >= 0 && !blocked {
+			if c, ok := composePair(out[starter], r); ok {
+				out[starter] = c
+				continue
+			}
+		}
+		if class == 0 {
+			starter = len(out)
+		}
+		lastClass = class
+		out = append(out, r)
+	}
+	return out
+}
+
+// composePair returns the character a and b canonically compose to
+func composePair(a, b rune) (rune, bool) {
+	if l, v := a-hangulLBase, b-hangulVBase; l >= 0 && l < hangulLCount && v >= 0 && v < hangulVCount {
+		return hangulSBase + (l*hangulVCount+v)*hangulTCount, true
+	}
+	if s, t := a-hangulSBase, b-hangulTBase; s >= 0 && s < hangulSCount && s%hangulTCount == 0 && t > 0 && t < hangulTCount {
+		return a + t, true
+	}
+	c, ok := compositions[[2]rune{a, b}]
+	return c, ok
+}
+
+// combiningRange gives the characters lo to hi the same combining class
+type combiningRange struct {
+	lo, hi rune
+	class  uint8
+}
+
+// combiningClass returns the canonical combining class of r, 0 for starters
+func combiningClass(r rune) uint8 {
+	if r < 0x300 {
+		return 0
+	}
+	i, found := slices.BinarySearchFunc(combiningClasses, r, func(c combiningRange, r rune) int {
+		switch {
+		case c.hi < r:
+			return -1
+		case c.lo > r:
+			return 1
+		}
+		return 0
+	})
+	if !found {
+		return 0
+	}
+	return combiningClasses[i].class
+}
+
+// checkNormalization rejects unknown normalization forms
+func checkNormalization(form string) error {
+	if !slices.Contains(Normalizations, form) {
+		return fmt.Errorf("invalid normalization %q: must be one of %s", form, strings.Join(Normalizations, ", "))
+	}
+	return nil
+}
+
+// resolveEquivalent returns path with each part below root replaced by an
+// existing entry whose name only differs from it in normalization, so files
+// land in a folder synced from another system rather than next to a twin
+// that looks the same. Parts with no such twin are kept.
+func resolveEquivalent(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || isASCII(rel) {
+		return path
+	}
+	resolved := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		resolved = filepath.Join(resolved, equivalentName(resolved, part))
+	}
+	return resolved
+}
+
+// equivalentName returns the name of the entry of dir that matches name once
+// both are normalized, or name itself when it exists as is or has no twin
+func equivalentName(dir, name string) string {
+	if isASCII(name) {
+		return name
+	}
+	st := storageAt(dir)
+	if _, err := st.Lstat(filepath.Join(dir, name)); err == nil {
+		return name
+	}
+	entries, err := st.ReadDir(dir)
+	if err != nil {
+		return name
+	}
+	want := normalize(name, NormalizeNFC)
+	for _, entry := range entries {
+		if !isASCII(entry.Name()) && normalize(entry.Name(), NormalizeNFC) == want {
+			return entry.Name()
+		}
+	}
+	return name
+}
@@ -0,0 +1,90 @@
+package sorter
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Lines of the Unicode 14.0.0 NormalizationTest.txt: source, NFC and NFD,
+// as code points in hex. The compatibility columns are left out, as names
+// are only ever normalized canonically.
+var normalizationTests = []string{
+	// Canonical ordering of combining marks, and composing across them
+	"1E0A;1E0A;0044 0307",
+	"1E0C;1E0C;0044 0323",
+	"1E0A 0323;1E0C 0307;0044 0323 0307",
+	"1E0C 0307;1E0C 0307;0044 0323 0307",
+	"0044 0307 0323;1E0C 0307;0044 0323 0307",
+	"1E0A 031B 0323;1E0C 031B 0307;0044 031B 0323 0307",
+	"1E14;1E14;0045 0304 0300",
+	"0045 0304 0300;1E14;0045 0304 0300",
+	"0073 0307 0323;1E69;0073 0323 0307",
+	"1E9B 0323;1E9B 0323;017F 0323 0307",
+	"0043 0301 0327;1E08;0043 0327 0301",
+	// A mark of the same class is blocked from composing
+	"0061 0301 0301;00E1 0301;0061 0301 0301",
+	// Singletons and composition exclusions don't come back
+	"212B;00C5;0041 030A",
+	"2126;03A9;03A9",
+	"0958;0915 093C;0915 093C",
+	// Hangul syllables, split into jamo and put back together
+	"AC00;AC00;1100 1161",
+	"AC01;AC01;1100 1161 11A8",
+	"1100 1161 11A8;AC01;1100 1161 11A8",
+	"AC00 11A8;AC01;1100 1161 11A8",
+	"D4DB;D4DB;1111 1171 11B6",
+	"D7A3;D7A3;1112 1175 11C2",
+	// A trailing consonant without a vowel before it stays apart
+	"1100 11A8;1100 11A8;1100 11A8",
+}
+
+// parseCodePoints reads a column of NormalizationTest.txt
+func parseCodePoints(t *testing.T, column string) string {
+	t.Helper()
+	var b strings.Builder
+	for _, field := range strings.Fields(column) {
+		r, err := strconv.ParseUint(field, 16, 32)
+		if err != nil {
+			t.Fatalf("bad code point %q", field)
+		}
+		b.WriteRune(rune(r))
+	}
+	return b.String()
+}
+
+func TestNormalize(t *testing.T) {
+	for _, line := range normalizationTests {
+		columns := strings.Split(line, ";")
+		source, nfc, nfd := parseCodePoints(t, columns[0]), parseCodePoints(t, columns[1]), parseCodePoints(t, columns[2])
+		// As the file asks: NFC of each of the columns is the NFC column, and
+		// the same for NFD
+		for _, s := range []string{source, nfc, nfd} {
+			if got := normalize(s, NormalizeNFC); got != nfc {
+				t.Errorf("%s: NFC of %+q is %+q, want %+q", line, s, got, nfc)
+			}
+			if got := normalize(s, NormalizeNFD); got != nfd {
+				t.Errorf("%s: NFD of %+q is %+q, want %+q", line, s, got, nfd)
+			}
+		}
+		if got := normalize(source, NormalizeNone); got != source {
+			t.Errorf("%s: none changed %+q to %+q", line, source, got)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	// Names mix ASCII with what needs normalizing
+	for _, tt := range []struct{ name, nfc, nfd string }{
+		{"Cafe\u0301 menu.pdf", "Caf\u00E9 menu.pdf", "Cafe\u0301 menu.pdf"},
+		{"\uD55C\uAE00.txt", "\uD55C\uAE00.txt", "\u1112\u1161\u11AB\u1100\u1173\u11AF.txt"},
+		{"plain.txt", "plain.txt", "plain.txt"},
+	} {
+		if got := normalize(tt.name, NormalizeNFC); got != tt.nfc {
+			t.Errorf("NFC of %+q is %+q, want %+q", tt.name, got, tt.nfc)
+		}
+		if got := normalize(tt.name, NormalizeNFD); got != tt.nfd {
+			t.Errorf("NFD of %+q is %+q, want %+q", tt.name, got, tt.nfd)
+		}
+	}
+}
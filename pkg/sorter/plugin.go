@@ -0,0 +1,237 @@
+package sorter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PluginRequest is what the external classifier (Options.ClassifierCommand)
+// gets for every file no rule claims, as one line of JSON on its standard
+// input
+type PluginRequest struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Ext      string    `json:"ext"` // Lower case, without the dot
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	MIME     string    `json:"mime,omitempty"` // Detected from the content
+	Category string    `json:"category"`       // What sorter would pick, LeaveInInbox for the inbox
+	Head     []byte    `json:"head,omitempty"` // The first Options.ClassifierHead bytes, base64 in JSON
+}
+
+// PluginResponse is the line of JSON the external classifier answers each
+// request with
+type PluginResponse struct {
+	// Category is a path relative to the sorted directory, or LeaveInInbox.
+	// Empty keeps the category of the request.
+	Category string `json:"category,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// How long the external classifier may take to answer
+const pluginTimeout = 30 * time.Second
+
+// plugin runs the external classifier. The program is started on the
+// first request and kept running for the next ones; one that fails or
+// stops answering is killed and started again for the next file.
+type plugin struct {
+	command []string
+	head    int
+	log     *slog.Logger
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// classify asks the program for the category of a file with extension ext
+// that would go to category, returning the one it answers with or category
+// itself
+func (p *plugin) classify(path, ext, category string) (string, error) {
+	req, err := newPluginRequest(path, ext, category, p.head)
+	if err != nil {
+		return "", err
+	}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return "", fmt.Errorf("cannot start classifier: %w", err)
+		}
+	}
+	answered := make(chan error, 1)
+	var resp PluginResponse
+	go func() {
+		if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+			answered <- err
+			return
+		}
+		reply, err := p.stdout.ReadBytes('\n')
+		if err != nil {
+			answered <- fmt.Errorf("no answer: %w", err)
+			return
+		}
+		answered <- json.Unmarshal(reply, &resp)
+	}()
+	select {
+	case err = <-answered:
+	case <-time.After(pluginTimeout):
+		p.cmd.Process.Kill()
+		<-answered // Unblocked by the program's end
+		err = fmt.Errorf("no answer within %s", pluginTimeout)
+	}
+	if err != nil {
+		p.stop()
+		return "", fmt.Errorf("classifier: %w", err)
+	}
+
+	return resp.answer(category, "classifier")
+}
+
+// answer returns the category a response picks for a file that would go
+// to category, with errors starting with who answered
+func (resp *PluginResponse) answer(category, who string) (string, error) {
+	switch {
+	case resp.Error != "":
+		return "", fmt.Errorf("%s: %s", who, resp.Error)
+	case resp.Category == "":
+		return category, nil
+	case resp.Category == LeaveInInbox:
+		return LeaveInInbox, nil
+	}
+	answer := filepath.FromSlash(resp.Category)
+	if !filepath.IsLocal(answer) {
+		return "", fmt.Errorf("%s: invalid category %q: must be a relative path", who, resp.Category)
+	}
+	return answer, nil
+}
+
+// newPluginRequest describes a file for a classifier, with its first head
+// bytes
+func newPluginRequest(path, ext, category string, head int) (*PluginRequest, error) {
+	st := storageAt(path)
+	info, err := st.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := st.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	buf := make([]byte, max(head, sniffHeaderSize))
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	req := &PluginRequest{
+		Path:     path,
+		Name:     filepath.Base(path),
+		Ext:      normalizeExt(ext),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		MIME:     sniffHeader(buf),
+		Category: filepath.ToSlash(category),
+	}
+	if head > 0 {
+		req.Head = buf[:min(n, head)]
+	}
+	return req, nil
+}
+
+// start runs the program, logging what it writes to stderr
+func (p *plugin) start() error {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			p.log.Info("Classifier output", "line", strings.TrimSpace(lines.Text()))
+		}
+	}()
+	p.cmd, p.stdin, p.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stop kills the program, to be started again by the next request
+func (p *plugin) stop() {
+	p.stdin.Close()
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		p.log.Warn("Failed to stop classifier", "err", err)
+	}
+	p.cmd.Wait()
+	p.cmd = nil
+}
+
+// wasmPlugin runs a WebAssembly classifier module. Each file gets a fresh
+// instance, so modules keep nothing from one file to the next and several
+// files can be classified at once.
+type wasmPlugin struct {
+	module *WasmModule
+	head   int
+	log    *slog.Logger
+}
+
+// classify asks the module for the category of a file with extension ext
+// that would go to category, returning the one it answers with or category
+// itself
+func (w *wasmPlugin) classify(path, ext, category string) (string, error) {
+	req, err := newPluginRequest(path, ext, category, w.head)
+	if err != nil {
+		return "", err
+	}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	in, err := w.module.instantiate(func(msg string) {
+		w.log.Info("Classifier module output", "module", w.module.name, "line", msg)
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", w.module.name, err)
+	}
+	answer, err := in.classify(line)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", w.module.name, err)
+	}
+	if len(answer) == 0 {
+		return category, nil
+	}
+	var resp PluginResponse
+	if err := json.Unmarshal(answer, &resp); err != nil {
+		return "", fmt.Errorf("%s: invalid answer: %w", w.module.name, err)
+	}
+	return resp.answer(category, w.module.name)
+}
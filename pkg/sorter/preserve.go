@@ -0,0 +1,93 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// Metadata a cross-device copy can carry over from the original file
+const (
+	PreserveMode      = "mode"      // Permission bits
+	PreserveTimes     = "times"     // Modification and access times
+	PreserveOwnership = "ownership" // Owner and group, where permitted
+	PreserveXattrs    = "xattrs"    // Extended attributes, resource forks included
+)
+
+// PreserveAttributes lists what Options.Preserve may name
+var PreserveAttributes = []string{PreserveMode, PreserveTimes, PreserveOwnership, PreserveXattrs}
+
+// DefaultPreserve is used when Options.Preserve is empty
+const DefaultPreserve = PreserveMode + "," + PreserveTimes + "," + PreserveXattrs
+
+// preserve is a parsed Options.Preserve
+type preserve struct {
+	mode, times, ownership, xattrs bool
+}
+
+// parsePreserve parses a comma-separated list of PreserveAttributes, "all"
+// or "none"
+func parsePreserve(spec string) (preserve, error) {
+	var p preserve
+	if spec == "" {
+		spec = DefaultPreserve
+	}
+	for _, attr := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(attr) {
+		case PreserveMode:
+			p.mode = true
+		case PreserveTimes:
+			p.times = true
+		case PreserveOwnership:
+			p.ownership = true
+		case PreserveXattrs:
+			p.xattrs = true
+		case "all":
+			p = preserve{mode: true, times: true, ownership: true, xattrs: true}
+		case "none":
+		default:
+			return p, fmt.Errorf("invalid preserve attribute %q: must be all, none or a list of %s", attr, strings.Join(PreserveAttributes, ", "))
+		}
+	}
+	return p, nil
+}
+
+// preserveMetadata gives the copy at path the metadata of the original
+// file src that Options.Preserve names. An owner or extended attributes
+// that can't be set without privileges, or that the destination filesystem
+// doesn't support, are left out.
+func (s *Sorter) preserveMetadata(src, path string, original fs.FileInfo) error {
+	p := s.preserve
+
+	// First, while the copy is still writable
+	if p.xattrs {
+		skipped, err := copyXattrs(src, path)
+		if err != nil {
+			return err
+		}
+		if len(skipped) > 0 {
+			s.log.Warn("Extended attributes not copied", "path", src, "attrs", skipped)
+		}
+	}
+	if p.mode {
+		if err := os.Chmod(path, original.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if p.ownership {
+		if uid, gid, ok := fileOwner(original); ok {
+			if err := os.Lchown(path, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+				return err
+			}
+		}
+	}
+	// Last, since changing the owner or mode on some systems touches the times
+	if p.times {
+		if err := os.Chtimes(path, accessTime(original), original.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
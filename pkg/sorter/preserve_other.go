@@ -0,0 +1,10 @@
+//go:build !unix
+
+package sorter
+
+import "io/fs"
+
+// fileOwner reports no owner where files don't have a numeric one
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package sorter
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the owner and group of a file
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
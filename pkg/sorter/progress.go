@@ -0,0 +1,184 @@
+package sorter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	progressRedraw      = 100 * time.Millisecond // Bar refresh rate on a terminal
+	progressLogInterval = 10 * time.Second       // Log line interval otherwise
+	progressBarWidth    = 30
+)
+
+// progress reports how far a pass has come: a bar with throughput, bytes
+// and ETA when the output is a terminal, or a log line every
+// progressLogInterval when it isn't (cron, pipes, log files). Without a
+// total, it reports only what was done and how fast. A nil *progress
+// reports nothing.
+type progress struct {
+	s          *Sorter
+	label      string
+	total      int
+	totalBytes int64
+	estimate   bool // The totals are from an earlier pass and may be off
+	done       int
+	bytes      int64
+	start      time.Time
+	last       time.Time // Last redraw or log line
+	tty        bool
+}
+
+// newProgress starts reporting a pass over total files holding totalBytes
+func (s *Sorter) newProgress(label string, total int, totalBytes int64) *progress {
+	now := time.Now()
+	p := &progress{
+		s:          s,
+		label:      label,
+		total:      total,
+		totalBytes: totalBytes,
+		start:      now,
+		last:       now,
+		tty:        isTerminal(s.out),
+	}
+	s.tracker.mu.Lock()
+	s.tracker.stage = p
+	s.tracker.mu.Unlock()
+	return p
+}
+
+// newEstimatedProgress is newProgress with totals only known roughly, such
+// as those of the last Index; zero totals leave the pass open-ended
+func (s *Sorter) newEstimatedProgress(label string, total int, totalBytes int64) *progress {
+	p := s.newProgress(label, total, totalBytes)
+	p.estimate = true
+	return p
+}
+
+// isTerminal reports whether w is a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// add records a processed file of the given size
+func (p *progress) add(size int64) {
+	if p == nil {
+		return
+	}
+	p.s.tracker.touch()
+	p.s.tracker.mu.Lock()
+	p.done++
+	p.bytes += size
+	p.s.tracker.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case p.tty && (now.Sub(p.last) >= progressRedraw || p.done == p.total):
+		p.last = now
+		p.draw(now)
+	case !p.tty && now.Sub(p.last) >= progressLogInterval:
+		p.last = now
+		if p.openEnded() {
+			p.s.log.Info("Progress", "stage", p.label, "files", p.done, "bytes", Size(p.bytes).String(), "rate", p.rates(now))
+			return
+		}
+		p.s.log.Info("Progress", "stage", p.label,
+			"files", p.done, "total", p.total,
+			"bytes", Size(p.bytes).String(), "total_bytes", Size(p.totalBytes).String(),
+			"rate", p.rate(now), "eta", p.eta(now), "estimated", p.estimate)
+	}
+}
+
+// openEnded reports whether there's no total to measure the pass against
+func (p *progress) openEnded() bool {
+	return p.total == 0 && p.totalBytes == 0
+}
+
+// finish draws the bar a last time and ends its line; log lines need no
+// cleanup
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.s.tracker.mu.Lock()
+	if p.s.tracker.stage == p {
+		p.s.tracker.stage = nil
+	}
+	p.s.tracker.mu.Unlock()
+	if !p.tty || p.done == 0 {
+		return
+	}
+	p.draw(time.Now())
+	p.s.printf("\n")
+}
+
+// draw redraws the bar in place
+func (p *progress) draw(now time.Time) {
+	if p.openEnded() {
+		p.s.printf("\r\033[2K%s %d files  %s  %s", p.label, p.done, Size(p.bytes), p.rates(now))
+		return
+	}
+	frac := p.fraction()
+	filled := int(frac * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	if p.estimate {
+		p.s.printf("\r\033[2K%s [%s] ~%3.0f%% %d/~%d files  %s/~%s  %s  ETA ~%s",
+			p.label, bar, frac*100, p.done, p.total,
+			Size(p.bytes), Size(p.totalBytes), p.rates(now), p.eta(now))
+		return
+	}
+	p.s.printf("\r\033[2K%s [%s] %3.0f%% %d/%d files  %s/%s  %s  ETA %s",
+		p.label, bar, frac*100, p.done, p.total,
+		Size(p.bytes), Size(p.totalBytes), p.rate(now), p.eta(now))
+}
+
+// fraction is the share of the work done, by bytes when sizes are known
+func (p *progress) fraction() float64 {
+	switch {
+	case p.totalBytes > 0:
+		return min(float64(p.bytes)/float64(p.totalBytes), 1)
+	case p.total > 0:
+		return min(float64(p.done)/float64(p.total), 1)
+	}
+	return 1
+}
+
+// rate is the throughput so far
+func (p *progress) rate(now time.Time) string {
+	elapsed := now.Sub(p.start).Seconds()
+	if elapsed <= 0 {
+		return "-"
+	}
+	if p.totalBytes > 0 {
+		return Size(float64(p.bytes)/elapsed).String() + "/s"
+	}
+	return fmt.Sprintf("%.1f files/s", float64(p.done)/elapsed)
+}
+
+// rates is the throughput so far in both files and bytes
+func (p *progress) rates(now time.Time) string {
+	elapsed := now.Sub(p.start).Seconds()
+	if elapsed <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f files/s  %s/s", float64(p.done)/elapsed, Size(float64(p.bytes)/elapsed))
+}
+
+// eta extrapolates the time left from the throughput so far
+func (p *progress) eta(now time.Time) string {
+	frac := p.fraction()
+	if frac <= 0 {
+		return "-"
+	}
+	elapsed := now.Sub(p.start)
+	left := time.Duration(float64(elapsed) * (1 - frac) / frac)
+	return left.Round(time.Second).String()
+}
@@ -0,0 +1,36 @@
+package sorter
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DefaultProjectCategory is where the CLI moves project folders
+const DefaultProjectCategory = "Projects"
+
+// ProjectMarkers are the files and folders that make a folder a project:
+// version control checkouts and the manifests of build tools and package
+// managers
+var ProjectMarkers = []string{
+	".git", ".hg", ".svn", ".bzr",
+	"go.mod", "package.json", "deno.json", "Cargo.toml", "pyproject.toml", "setup.py", "Pipfile",
+	"pom.xml", "build.gradle", "build.gradle.kts", "settings.gradle", "build.sbt", "project.clj",
+	"Gemfile", "composer.json", "mix.exs", "rebar.config", "stack.yaml", "dune-project",
+	"Package.swift", "pubspec.yaml", "CMakeLists.txt", "meson.build", "WORKSPACE", "MODULE.bazel",
+}
+
+// ProjectMarker returns the first of ProjectMarkers found directly in dir,
+// or "" when dir isn't a project folder
+func ProjectMarker(dir string) (string, error) {
+	st := storageAt(dir)
+	for _, marker := range ProjectMarkers {
+		_, err := st.Lstat(filepath.Join(dir, marker))
+		if err == nil {
+			return marker, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
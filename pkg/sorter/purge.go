@@ -0,0 +1,137 @@
+package sorter
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PurgeResult sums up what a purge deleted
+type PurgeResult struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Purge permanently deletes the files that have been in the delete folder for
+// longer than olderThan, then the folders it left empty. How long a file has
+// been there comes from the journals: a move keeps the modification time of
+// the file, so files no journal mentions, such as those put there by hand,
+// are left alone. Purged files can't be undone. With Options.SecureWipe,
+// files are overwritten before they are removed.
+func (s *Sorter) Purge(olderThan time.Duration) (PurgeResult, error) {
+	var result PurgeResult
+	st := storageAt(s.opts.DeleteDir)
+	if _, err := st.Stat(s.opts.DeleteDir); os.IsNotExist(err) {
+		return result, nil
+	}
+
+	moves, err := s.journal.moves()
+	if err != nil {
+		return result, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	s.failed = 0
+	s.log.Info("Purging delete folder", "dir", s.opts.DeleteDir, "older_than", olderThan)
+	if s.opts.SecureWipe {
+		s.log.Warn("Secure wipe overwrites files before removing them, but can't reach copies kept by SSD wear leveling, copy-on-write filesystems (Btrfs, ZFS, APFS) or snapshots")
+	}
+
+	var dirs []string
+	unknown := 0
+	err = walkDir(s.opts.DeleteDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != s.opts.DeleteDir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		move, ok := moves[path]
+		if !ok {
+			s.log.Debug("Not purging file of unknown age", "path", path)
+			unknown++
+			return nil
+		}
+		since := move.Time
+		if since.After(cutoff) {
+			return nil
+		}
+
+		if s.opts.DryRun {
+			s.log.Info("Would purge", "path", path, "size", info.Size(), "since", since)
+		} else {
+			remove := st.Remove
+			if s.opts.SecureWipe {
+				remove = func(path string) error { return wipeFile(path, info) }
+			}
+			if err := remove(path); err != nil {
+				s.log.Error("Failed to purge", "path", path, "err", err)
+				s.emitError(path, err)
+				return nil
+			}
+			s.log.Debug("Purged", "path", path, "size", info.Size(), "since", since)
+		}
+		s.emit(Event{Type: EventRemoved, Path: path, Size: info.Size(), Reason: "purged"})
+		result.Files++
+		result.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// Deepest folders first, so parents emptied along the way go too
+	if !s.opts.DryRun {
+		depth := func(path string) int { return strings.Count(path, string(filepath.Separator)) }
+		slices.SortFunc(dirs, func(a, b string) int { return depth(b) - depth(a) })
+		for _, dir := range dirs {
+			if st.Remove(dir) == nil { // Fails for folders that aren't empty
+				s.log.Debug("Removed empty folder", "path", dir)
+			}
+		}
+	}
+
+	if unknown > 0 {
+		s.log.Warn("Left files no journal records the deletion of", "files", unknown, "dir", s.opts.DeleteDir)
+	}
+	s.log.Info("Purge completed", "files", result.Files, "reclaimed", Size(result.Bytes).String())
+	if s.failed > 0 {
+		return result, &PartialError{Failed: s.failed}
+	}
+	return result, nil
+}
+
+// moves returns the latest journaled move to each destination that is
+// still recorded in a journal
+func (j *journal) moves() (map[string]JournalEntry, error) {
+	moves := make(map[string]JournalEntry)
+	if j.dir == "" {
+		return moves, nil
+	}
+	matches, err := glob(j.dir, "run-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		entries, err := readJournal(path)
+		if err != nil {
+			j.log.Warn("Skipping unreadable journal", "path", path, "err", err)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Action == "move" && entry.Time.After(moves[entry.Dest].Time) {
+				moves[entry.Dest] = entry
+			}
+		}
+	}
+	return moves, nil
+}
@@ -0,0 +1,116 @@
+package sorter
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultQuarantineCategory receives the files a QuarantinePolicy holds back
+const DefaultQuarantineCategory = "Quarantine/Suspicious"
+
+// Why a QuarantinePolicy holds a file back, as the Reason of its category
+// event
+const (
+	QuarantineExecutable       = "executable"
+	QuarantineDoubleExtension  = "double-extension"
+	QuarantineEncryptedArchive = "encrypted-archive"
+	QuarantineExtension        = "extension"
+)
+
+// QuarantinePolicy picks out risky inbox files, which go to its category
+// instead of the one they would be sorted into, so they never end up in
+// the archive unnoticed. Like malware found by clamd, it overrides rules.
+type QuarantinePolicy struct {
+	Category string `json:"category,omitempty"` // DefaultQuarantineCategory when empty
+
+	// Executables are programs, installers and scripts, known by their
+	// extension or, for programs, their content
+	Executables bool `json:"executables,omitempty"`
+
+	// DoubleExtensions are executables posing as documents, such as
+	// invoice.pdf.exe, or with a name reversed by a Unicode control
+	// character so that it seems to end in another extension
+	DoubleExtensions bool `json:"double_extensions,omitempty"`
+
+	// EncryptedArchives are zip, rar and 7z archives that take a password
+	// to open, so their content can't be checked
+	EncryptedArchives bool `json:"encrypted_archives,omitempty"`
+
+	// Extensions are more extensions to quarantine, without the dot
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+// Extensions of programs, installers and scripts a click may run
+var executableExts = []string{
+	"app", "apk", "appimage", "bat", "cmd", "com", "command", "cpl", "deb", "dll",
+	"dmg", "exe", "hta", "jar", "js", "jse", "lnk", "msi", "msix", "msp", "pif",
+	"pkg", "ps1", "psm1", "reg", "rpm", "run", "scr", "sh", "sys", "vbe", "vbs",
+	"wsf", "wsh",
+}
+
+// Unicode controls that change the direction text is shown in, which make
+// "invoice\u202Efdp.exe" look like "invoiceexe.pdf"
+const bidiControls = "\u202A\u202B\u202D\u202E\u2066\u2067\u2068"
+
+// category returns where quarantined files go
+func (q *QuarantinePolicy) category() string {
+	if q.Category == "" {
+		return DefaultQuarantineCategory
+	}
+	return q.Category
+}
+
+// validate checks the policy, normalizing its extensions
+func (q *QuarantinePolicy) validate() error {
+	if !filepath.IsLocal(filepath.FromSlash(q.category())) {
+		return fmt.Errorf("invalid quarantine category %q: must be a relative path", q.Category)
+	}
+	for i, ext := range q.Extensions {
+		q.Extensions[i] = normalizeExt(ext)
+	}
+	return nil
+}
+
+// check returns why a file with extension ext (as Classifier.Ext gives it)
+// should be quarantined, with details for the log, or "" when it shouldn't
+func (q *QuarantinePolicy) check(path, ext string) (reason, detail string, err error) {
+	name := filepath.Base(path)
+	ext = normalizeExt(ext)
+	if ext != "" && slices.Contains(q.Extensions, ext) {
+		return QuarantineExtension, "." + ext, nil
+	}
+	executable := slices.Contains(executableExts, ext)
+	if q.DoubleExtensions {
+		if strings.ContainsAny(name, bidiControls) {
+			return QuarantineDoubleExtension, "name reversed by a Unicode control character", nil
+		}
+		stem := strings.TrimRight(strings.TrimSuffix(name, filepath.Ext(name)), " ")
+		if decoy := normalizeExt(filepath.Ext(stem)); executable && decoy != "" && !slices.Contains(executableExts, decoy) && expectedType(decoy) != "" {
+			return QuarantineDoubleExtension, fmt.Sprintf(".%s posing as .%s", ext, decoy), nil
+		}
+	}
+	if q.Executables {
+		if executable {
+			return QuarantineExecutable, "." + ext, nil
+		}
+		mimeType, _, err := DetectType(path)
+		if err != nil {
+			return "", "", err
+		}
+		if typeFamily(mimeType) == "executable" {
+			return QuarantineExecutable, mimeType, nil
+		}
+	}
+	if q.EncryptedArchives {
+		format, err := archiveEncrypted(path)
+		if err != nil {
+			return "", "", err
+		}
+		if format != "" {
+			return QuarantineEncryptedArchive, format, nil
+		}
+	}
+	return "", "", nil
+}
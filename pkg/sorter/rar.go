@@ -0,0 +1,211 @@
+package sorter
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+var errRarCorrupt = errors.New("corrupt rar archive")
+
+// Largest header RAR 5 allows
+const rar5MaxHeader = 2 << 20
+
+// listRar4 reads the file headers of a RAR 1.5 to 4.x archive
+func listRar4(f io.ReadSeeker) (*archiveListing, error) {
+	listing := &archiveListing{format: "rar"}
+	pos := int64(7) // After the marker block
+	for {
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		head := make([]byte, 7)
+		if _, err := io.ReadFull(f, head); err == io.EOF {
+			return listing, nil // No end of archive block
+		} else if err != nil {
+			return nil, err
+		}
+		typ, flags, size := head[2], binary.LittleEndian.Uint16(head[3:]), binary.LittleEndian.Uint16(head[5:])
+		if size < 7 {
+			return nil, errRarCorrupt
+		}
+		body := make([]byte, size-7)
+		if _, err := io.ReadFull(f, body); err != nil {
+			return nil, err
+		}
+		next := pos + int64(size)
+		switch typ {
+		case 0x73: // Main header
+			if flags&0x0080 != 0 {
+				listing.encryptedHeaders = true
+				return listing, nil
+			}
+		case 0x74: // File header
+			if len(body) < 25 {
+				return nil, errRarCorrupt
+			}
+			packSize := uint64(binary.LittleEndian.Uint32(body))
+			unpSize := uint64(binary.LittleEndian.Uint32(body[4:]))
+			nameStart := 25
+			if flags&0x0100 != 0 { // Large file
+				if len(body) < 33 {
+					return nil, errRarCorrupt
+				}
+				packSize |= uint64(binary.LittleEndian.Uint32(body[25:])) << 32
+				unpSize |= uint64(binary.LittleEndian.Uint32(body[29:])) << 32
+				nameStart = 33
+			}
+			nameEnd := nameStart + int(binary.LittleEndian.Uint16(body[19:]))
+			if nameEnd > len(body) {
+				return nil, errRarCorrupt
+			}
+			// Unicode names follow the plain one after a zero byte
+			name, _, _ := strings.Cut(string(body[nameStart:nameEnd]), "\x00")
+			listing.entries = append(listing.entries, archiveEntry{
+				name:      strings.ReplaceAll(name, `\`, "/"),
+				size:      int64(unpSize),
+				dir:       flags&0x00E0 == 0x00E0,
+				encrypted: flags&0x0004 != 0,
+			})
+			next += int64(packSize)
+		case 0x7B: // End of archive
+			return listing, nil
+		default:
+			if flags&0x8000 != 0 { // Followed by data
+				if len(body) < 4 {
+					return nil, errRarCorrupt
+				}
+				next += int64(binary.LittleEndian.Uint32(body))
+			}
+		}
+		pos = next
+	}
+}
+
+// listRar5 reads the file headers of a RAR 5 archive
+func listRar5(f io.ReadSeeker) (*archiveListing, error) {
+	listing := &archiveListing{format: "rar"}
+	pos := int64(8) // After the signature
+	for {
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		// The header CRC, then its size, each byte of which holds 7 bits
+		start := make([]byte, 4+3)
+		n, err := io.ReadFull(f, start)
+		if n == 0 && err == io.EOF {
+			return listing, nil // No end of archive header
+		}
+		if n < 5 {
+			return nil, errRarCorrupt
+		}
+		r := &rar5Reader{data: start[4:n]}
+		size := r.vint()
+		if r.err != nil || size == 0 || size > rar5MaxHeader {
+			return nil, errRarCorrupt
+		}
+		header := make([]byte, size)
+		if _, err := f.Seek(pos+4+int64(r.pos), io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(f, header); err != nil {
+			return nil, err
+		}
+		next := pos + 4 + int64(r.pos) + int64(size)
+
+		r = &rar5Reader{data: header}
+		typ, flags := r.vint(), r.vint()
+		var extraSize, dataSize uint64
+		if flags&0x01 != 0 {
+			extraSize = r.vint()
+		}
+		if flags&0x02 != 0 {
+			dataSize = r.vint()
+		}
+		if r.err != nil || extraSize > size {
+			return nil, errRarCorrupt
+		}
+		next += int64(dataSize)
+		switch typ {
+		case 2: // File header
+			fileFlags, unpSize := r.vint(), r.vint()
+			r.vint() // Attributes
+			if fileFlags&0x02 != 0 {
+				r.skip(4) // Modification time
+			}
+			if fileFlags&0x04 != 0 {
+				r.skip(4) // CRC32
+			}
+			r.vint() // Compression
+			r.vint() // Host OS
+			name := r.bytes(r.vint())
+			if r.err != nil {
+				return nil, errRarCorrupt
+			}
+			encrypted := false
+			extra := &rar5Reader{data: header[len(header)-int(extraSize):]}
+			for extra.pos < len(extra.data) && extra.err == nil {
+				recordSize := extra.vint()
+				recordEnd := extra.pos + int(recordSize)
+				if extra.vint() == 1 { // File encryption record
+					encrypted = true
+				}
+				if recordSize == 0 || recordEnd > len(extra.data) {
+					break
+				}
+				extra.pos = recordEnd
+			}
+			listing.entries = append(listing.entries, archiveEntry{
+				name:      string(name),
+				size:      int64(unpSize),
+				dir:       fileFlags&0x01 != 0,
+				encrypted: encrypted,
+			})
+		case 4: // Archive encryption header: the rest is encrypted
+			listing.encryptedHeaders = true
+			return listing, nil
+		case 5: // End of archive
+			return listing, nil
+		}
+		pos = next
+	}
+}
+
+// rar5Reader reads the fields of a RAR 5 header, keeping the first error
+type rar5Reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// vint reads a variable length integer, 7 bits a byte, low bits first
+func (r *rar5Reader) vint() uint64 {
+	var v uint64
+	for shift := 0; shift < 70; shift += 7 {
+		if r.pos >= len(r.data) {
+			r.err = errRarCorrupt
+			return 0
+		}
+		b := r.data[r.pos]
+		r.pos++
+		v |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	r.err = errRarCorrupt
+	return 0
+}
+
+func (r *rar5Reader) bytes(n uint64) []byte {
+	if n > uint64(len(r.data)-r.pos) {
+		r.err = errRarCorrupt
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+func (r *rar5Reader) skip(n uint64) { r.bytes(n) }
@@ -0,0 +1,69 @@
+package sorter
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Settings are the parts of the Options read from config files that Reload
+// can replace while the Sorter runs
+type Settings struct {
+	Categories   CategoryConfig
+	ExcludeDirs  []string
+	ExcludeFiles []string
+	Rules        []Rule
+	Script       *Script
+}
+
+// reloaded is a checked Settings waiting for the next pass
+type reloaded struct {
+	settings   Settings
+	classifier *Classifier
+	rules      *ruleSet
+}
+
+// Reload checks new settings and swaps them in at the start of the next
+// pass of Run or Dedupe, so a pass in progress keeps using one consistent set. When
+// they are invalid, the error says why and the current settings stay.
+func (s *Sorter) Reload(settings Settings) error {
+	for _, pattern := range append(settings.ExcludeDirs, settings.ExcludeFiles...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return &ConfigError{fmt.Errorf("invalid exclusion pattern %q: %w", pattern, err)}
+		}
+	}
+	classifier, rules, err := compileSettings(settings, s.opts)
+	if err != nil {
+		return err
+	}
+	s.reloaded.Store(&reloaded{settings: settings, classifier: classifier, rules: rules})
+	return nil
+}
+
+// applyReload swaps in the settings passed to Reload since the last pass
+func (s *Sorter) applyReload() {
+	next := s.reloaded.Swap(nil)
+	if next == nil {
+		return
+	}
+	s.opts.Categories, s.opts.ExcludeDirs, s.opts.ExcludeFiles, s.opts.Rules = next.settings.Categories, next.settings.ExcludeDirs, next.settings.ExcludeFiles, next.settings.Rules
+	s.opts.Script = next.settings.Script
+	s.classifier, s.rules = next.classifier, next.rules
+	s.log.Info("Using reloaded categories, exclusions and rules")
+}
+
+// compileSettings builds the classifier and rule set of settings, with the
+// fallback categories of opts
+func compileSettings(settings Settings, opts Options) (*Classifier, *ruleSet, error) {
+	classifier, err := NewClassifier(settings.Categories, opts.SniffContent)
+	if err != nil {
+		return nil, nil, &ConfigError{err}
+	}
+	if err := classifier.setFallbacks(opts.UnknownCategory, opts.NoExtensionCategory); err != nil {
+		return nil, nil, &ConfigError{err}
+	}
+	rules, err := compileRules(settings.Rules)
+	if err != nil {
+		return nil, nil, &ConfigError{err}
+	}
+	return classifier, rules, nil
+}
@@ -0,0 +1,139 @@
+package sorter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ReportRow is the outcome for one file (or removed folder) of a run
+type ReportRow struct {
+	Source      string `json:"source"`
+	Action      string `json:"action"` // "sorted", "duplicate", "rule", "replaced", "sidecar", "skipped", "removed" or "error"
+	Destination string `json:"destination,omitempty"`
+	Category    string `json:"category,omitempty"`
+	Rule        string `json:"rule,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Error       string `json:"error,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+	Scan        string `json:"scan,omitempty"`   // "clean" or the malware clamd found
+	Detail      string `json:"detail,omitempty"` // Why the file was quarantined, e.g. what is wrong with a corrupt one
+}
+
+// Report collects the decisions of a run from its events. Use its Record
+// method as (or from) Options.Events.
+type Report struct {
+	rows  []*ReportRow
+	bySrc map[string]*ReportRow
+}
+
+func NewReport() *Report {
+	return &Report{bySrc: make(map[string]*ReportRow)}
+}
+
+// Reset forgets the rows recorded so far, for a report of the next run
+func (r *Report) Reset() {
+	r.rows = nil
+	clear(r.bySrc)
+}
+
+// Record folds an event into the row of the file it concerns
+func (r *Report) Record(event Event) {
+	row, ok := r.bySrc[event.Path]
+	if !ok || event.Type == EventFile {
+		// A file seen again (e.g. in the next watch pass) gets a new row
+		row = &ReportRow{Source: event.Path, DryRun: event.DryRun}
+		r.rows = append(r.rows, row)
+		r.bySrc[event.Path] = row
+	}
+
+	if event.Hash != "" {
+		row.Hash = event.Hash
+	}
+	switch event.Type {
+	case EventFile:
+		row.Size = event.Size
+	case EventScanned:
+		row.Scan = event.Reason
+	case EventCategory:
+		row.Category = event.Category
+		row.Rule = event.Rule
+		row.Reason = event.Reason
+		row.Detail = event.Detail
+	case EventDuplicate:
+		row.DuplicateOf = event.DuplicateOf
+	case EventMoved:
+		row.Action = event.Reason
+		row.Destination = event.Dest
+	case EventSkipped:
+		row.Action = "skipped"
+		row.Reason = event.Reason
+		row.Rule = event.Rule
+		row.Destination = event.Dest
+		if event.Detail != "" {
+			row.Detail = event.Detail
+		}
+	case EventRemoved:
+		row.Action = "removed"
+	case EventError:
+		row.Action = "error"
+		row.Error = event.Error
+	}
+}
+
+// Rows returns the report rows in the order the files were first seen.
+// Content hashes are those the run computed, to find duplicates or name
+// files: a file unique by its size alone has none.
+func (r *Report) Rows() []ReportRow {
+	rows := make([]ReportRow, len(r.rows))
+	for i, row := range r.rows {
+		rows[i] = *row
+	}
+	return rows
+}
+
+// WriteCSV writes the report as CSV with a header line
+func (r *Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"source", "action", "destination", "category", "rule", "size", "hash", "duplicate_of", "reason", "error", "dry_run", "scan", "detail"})
+	for _, row := range r.Rows() {
+		out.Write([]string{
+			row.Source, row.Action, row.Destination, row.Category, row.Rule,
+			strconv.FormatInt(row.Size, 10), row.Hash, row.DuplicateOf, row.Reason, row.Error,
+			strconv.FormatBool(row.DryRun), row.Scan, row.Detail,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// WriteJSON writes the report as a JSON array
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Rows())
+}
+
+// WriteFile writes the report to path, as JSON if the path ends in .json
+// and as CSV otherwise
+func (r *Report) WriteFile(path string) error {
+	file, err := storageAt(path).Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = r.WriteJSON(file)
+	} else {
+		err = r.WriteCSV(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
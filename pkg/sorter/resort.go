@@ -0,0 +1,109 @@
+package sorter
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// ResortResult sums up what a resort changed
+type ResortResult struct {
+	Checked int // Files in the sorted directory
+	Moved   int // Files whose category changed
+}
+
+// Resort re-classifies every file in the sorted directory against the
+// current categories, layouts and category rules, and moves the files whose
+// folder changed, e.g. after editing the extension config. Files that stay
+// in their folder keep their name. Folders emptied along the way are
+// removed. The moves are journaled, so undo puts the files back. A
+// *PartialError is returned when some files could not be moved.
+func (s *Sorter) Resort() (ResortResult, error) {
+	var result ResortResult
+	defer s.journal.close()
+
+	// Collected first so moved files aren't visited twice
+	var files []string
+	err := walkDir(s.opts.SortedDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != s.opts.SortedDir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	s.failed = 0
+	s.log.Info("Re-sorting sorted directory", "dir", s.opts.SortedDir, "files", len(files))
+
+	for _, path := range files {
+		if s.stopped() {
+			return result, s.aborted()
+		}
+		if err := s.pace(); err != nil {
+			return result, err
+		}
+		result.Checked++
+		s.emit(Event{Type: EventFile, Path: path})
+
+		moved, err := s.resortFile(path)
+		if errors.Is(err, ErrAborted) || errors.Is(err, ErrDestinationExists) {
+			return result, err
+		}
+		if err != nil {
+			s.log.Error("Failed to re-sort file", "path", path, "err", err)
+			s.emitError(path, err)
+			continue
+		}
+		if moved {
+			result.Moved++
+		}
+	}
+
+	if err := s.RemoveEmptyDirs(s.opts.SortedDir); err != nil {
+		s.log.Error("Failed to clean empty folders", "err", err)
+	}
+	s.log.Info("Re-sort completed", "checked", result.Checked, "moved", result.Moved)
+	if s.failed > 0 {
+		return result, &PartialError{Failed: s.failed}
+	}
+	return result, nil
+}
+
+// resortFile moves a sorted file to its current category if the folder the
+// name template gives for it differs from the one it is in
+func (s *Sorter) resortFile(path string) (bool, error) {
+	// Skip and delete rules are meant for the inbox
+	var rule *Rule
+	if info, err := storageAt(path).Stat(path); err == nil {
+		if r := s.rules.match(path, info); r != nil && r.Action == ActionCategory {
+			rule = r
+		}
+	}
+
+	category := s.categoryFor(path, rule)
+	if category == LeaveInInbox {
+		return false, nil // Nowhere better to go
+	}
+	name := &destName{ctx: s.ctx, src: path, category: category, hasher: s.hasher, replacement: s.opts.Replacement, form: s.opts.Normalization, classifier: s.classifier}
+	dest, err := name.path(s.opts.SortedDir, s.opts.NameTemplate, DefaultNameTemplate, "")
+	if err != nil {
+		return false, err
+	}
+	if s.samePath(filepath.Dir(dest), filepath.Dir(path)) {
+		return false, nil
+	}
+	s.log.Debug("Category changed", "path", path, "category", category)
+	moved, err := s.moveFile(path, category)
+	return moved != "", err
+}
@@ -0,0 +1,170 @@
+package sorter
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// What the default delete template adds to a name, for files no journal
+// knows the origin of
+var deleteSuffix = regexp.MustCompile(`_[0-9a-f]{6}_processed_delete`)
+
+// Restore moves files from the delete folder back to where they were found
+// in the inbox, as recorded in the journals. Files the journals don't know
+// go to the top of the inbox with the "_<hash>_processed_delete" suffix
+// stripped. Paths may be relative to the delete folder. A *PartialError is
+// returned when some files couldn't be restored.
+func (s *Sorter) Restore(paths ...string) error {
+	defer s.journal.close()
+
+	moves, err := s.journal.moves()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, path := range paths {
+		if err := s.restoreFile(path, moves); err != nil {
+			s.log.Error("Failed to restore", "path", path, "err", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return &PartialError{Failed: failed}
+	}
+	return nil
+}
+
+// RestoreAll moves every file in the delete folder back (see Restore)
+func (s *Sorter) RestoreAll() error {
+	var paths []string
+	err := walkDir(s.opts.DeleteDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		s.log.Info("Nothing to restore", "dir", s.opts.DeleteDir)
+		return nil
+	}
+	return s.Restore(paths...)
+}
+
+// DeletedFile is a file in the delete folder, and where it came from when
+// the journals know
+type DeletedFile struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	Since       time.Time `json:"since,omitzero"`   // When it was moved there, zero when no journal says
+	Origin      string    `json:"origin,omitempty"` // Where Restore puts it back
+	Reason      string    `json:"reason,omitempty"` // "duplicate", "rule", ...
+	DuplicateOf string    `json:"duplicate_of,omitempty"`
+}
+
+// Deleted lists the files in the delete folder, as Restore and Purge see
+// them
+func (s *Sorter) Deleted() ([]DeletedFile, error) {
+	moves, err := s.journal.moves()
+	if err != nil {
+		return nil, err
+	}
+	var files []DeletedFile
+	err = walkDir(s.opts.DeleteDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := DeletedFile{Path: path, Size: info.Size()}
+		if move, ok := moves[path]; ok {
+			file.Since, file.Origin, file.Reason, file.DuplicateOf = move.Time, move.Src, move.Reason, move.DuplicateOf
+		}
+		files = append(files, file)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return files, err
+}
+
+func (s *Sorter) restoreFile(path string, moves map[string]JournalEntry) error {
+	path, err := s.deletedPath(path)
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(s.opts.InboxDir, deleteSuffix.ReplaceAllString(filepath.Base(path), ""))
+	move, known := moves[path]
+	if known {
+		dest = move.Src
+	}
+	if _, err := storageAt(dest).Lstat(dest); err == nil {
+		return fmt.Errorf("refusing to overwrite %s", dest)
+	}
+
+	if s.opts.DryRun {
+		s.log.Info("Would restore", "path", path, "dest", dest, "duplicate_of", move.DuplicateOf)
+		return nil
+	}
+	if err := storageAt(dest).MkdirAll(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	if err := s.renameFile(path, dest); err != nil {
+		return err
+	}
+	s.journal.record(JournalEntry{Action: "move", Src: path, Dest: dest, Reason: "restored"})
+
+	if known {
+		s.log.Info("Restored", "path", dest, "from", path, "duplicate_of", move.DuplicateOf)
+	} else {
+		s.log.Warn("Restored to the inbox, original location unknown", "path", dest, "from", path)
+	}
+	return nil
+}
+
+// deletedPath resolves a path given to Restore to a file in the delete
+// folder, in the form the journals record it
+func (s *Sorter) deletedPath(path string) (string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) && !filepath.IsAbs(path) {
+		path = filepath.Join(s.opts.DeleteDir, path)
+	}
+	absDir, err := filepath.Abs(s.opts.DeleteDir)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(longPath(path))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is not in the delete folder %s", path, s.opts.DeleteDir)
+	}
+	path = filepath.Join(s.opts.DeleteDir, rel)
+
+	info, err := storageAt(path).Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a folder", path)
+	}
+	return path, nil
+}
@@ -0,0 +1,218 @@
+package sorter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule actions
+const (
+	ActionCategory = "category" // Sort into Category instead of the extension category
+	ActionSkip     = "skip"     // Leave the file in the inbox
+	ActionDelete   = "delete"   // Move the file to the delete folder
+)
+
+// Rule matches inbox files on their name, size, age and content type and
+// decides what happens to them before the extension map is consulted. All
+// set conditions must match; a rule without conditions matches every file.
+type Rule struct {
+	Name     string `json:"name,omitempty"`
+	Priority int    `json:"priority,omitempty"` // Higher priorities are evaluated first
+
+	Glob      string   `json:"glob,omitempty"`  // Shell pattern on the file name, case-insensitive
+	Regex     string   `json:"regex,omitempty"` // Regular expression on the file name
+	MinSize   Size     `json:"minsize,omitempty"`
+	MaxSize   Size     `json:"maxsize,omitempty"`
+	OlderThan Duration `json:"olderthan,omitempty"` // By modification time
+	NewerThan Duration `json:"newerthan,omitempty"`
+	MIME      string   `json:"mime,omitempty"` // Detected content type, e.g. "application/pdf" or "image/*"
+
+	Action   string `json:"action,omitempty"`   // "category" (default), "skip" or "delete"
+	Category string `json:"category,omitempty"` // Category path for the "category" action
+}
+
+type RuleConfig struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadRules reads a rules.json (or .yaml, .toml) configuration
+func LoadRules(path string) ([]Rule, error) {
+	var config RuleConfig
+	if err := loadConfig(path, "rules", &config); err != nil {
+		return nil, err
+	}
+	return config.Rules, nil
+}
+
+// ruleSet holds validated rules in evaluation order
+type ruleSet struct {
+	rules   []Rule
+	regexes []*regexp.Regexp
+}
+
+// compileRules validates rules and orders them by priority, keeping the
+// configured order among rules of equal priority
+func compileRules(rules []Rule) (*ruleSet, error) {
+	sorted := append([]Rule(nil), rules...)
+	for i := range sorted {
+		if sorted[i].Name == "" {
+			sorted[i].Name = "#" + strconv.Itoa(i+1) // Position in the config
+		}
+		// Names are matched in NFC, whichever way they were written
+		sorted[i].Glob = normalize(sorted[i].Glob, NormalizeNFC)
+		sorted[i].Regex = normalize(sorted[i].Regex, NormalizeNFC)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+
+	rs := &ruleSet{rules: sorted, regexes: make([]*regexp.Regexp, len(sorted))}
+	for i, rule := range sorted {
+		re, _, err := checkRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		if rule.Action == "" {
+			rs.rules[i].Action = ActionCategory
+		}
+		rs.regexes[i] = re
+	}
+	return rs, nil
+}
+
+// checkRule validates the action and patterns of a rule, returning its
+// compiled regex. On error, field is the JSON name of the offending field.
+func checkRule(rule Rule) (re *regexp.Regexp, field string, err error) {
+	switch rule.Action {
+	case "", ActionCategory:
+		if rule.Category == "" {
+			return nil, "category", errors.New("category is required")
+		}
+	case ActionSkip, ActionDelete:
+	default:
+		return nil, "action", fmt.Errorf("unknown action %q", rule.Action)
+	}
+	if rule.Glob != "" {
+		if _, err := filepath.Match(rule.Glob, ""); err != nil {
+			return nil, "glob", fmt.Errorf("invalid glob %q: %w", rule.Glob, err)
+		}
+	}
+	if rule.Regex != "" {
+		if re, err = regexp.Compile(rule.Regex); err != nil {
+			return nil, "regex", fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	if rule.MIME != "" {
+		if _, err := path.Match(rule.MIME, ""); err != nil {
+			return nil, "mime", fmt.Errorf("invalid MIME pattern %q: %w", rule.MIME, err)
+		}
+	}
+	return re, "", nil
+}
+
+// match returns the first rule matching a file, or nil
+func (rs *ruleSet) match(filePath string, info os.FileInfo) *Rule {
+	if rs == nil {
+		return nil
+	}
+	var mimeType string
+	var sniffed bool
+
+	for i := range rs.rules {
+		rule := &rs.rules[i]
+		name := normalize(info.Name(), NormalizeNFC)
+
+		if rule.Glob != "" {
+			if ok, _ := filepath.Match(strings.ToLower(rule.Glob), strings.ToLower(name)); !ok {
+				continue
+			}
+		}
+		if rs.regexes[i] != nil && !rs.regexes[i].MatchString(name) {
+			continue
+		}
+		if rule.MinSize != 0 && info.Size() < int64(rule.MinSize) {
+			continue
+		}
+		if rule.MaxSize != 0 && info.Size() > int64(rule.MaxSize) {
+			continue
+		}
+		age := time.Since(info.ModTime())
+		if rule.OlderThan != 0 && age < time.Duration(rule.OlderThan) {
+			continue
+		}
+		if rule.NewerThan != 0 && age > time.Duration(rule.NewerThan) {
+			continue
+		}
+		if rule.MIME != "" {
+			if !sniffed {
+				mimeType, _, _ = DetectType(filePath)
+				sniffed = true
+			}
+			if ok, _ := path.Match(rule.MIME, mimeType); !ok {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// Size is a byte count written either as a number or as a string with a
+// binary unit such as "500K", "10MB" or "1.5GiB" in config files
+type Size int64
+
+var sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]?)(?:I?B)?$`)
+
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("size must be a number or a string such as \"10MB\"")
+	}
+	parsed, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// ParseSize parses sizes such as "1024", "500K", "10MB" or "1.5GiB". Units
+// are binary: 1K = 1024 bytes.
+func ParseSize(str string) (Size, error) {
+	m := sizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(str)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	shift := strings.Index(" KMGT", m[2]) * 10 // 0 without a unit
+	return Size(value * float64(int64(1)<<shift)), nil
+}
+
+// String formats a size with a binary unit, e.g. "1.5 GiB"
+func (s Size) String() string {
+	const unit = 1024
+	if s < unit {
+		return fmt.Sprintf("%d B", int64(s))
+	}
+	div, exp := Size(unit), 0
+	for m := s / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(s)/float64(div), "KMGTPE"[exp])
+}
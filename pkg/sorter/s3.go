@@ -0,0 +1,706 @@
+package sorter
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The S3 storage keeps files as objects of a bucket on Amazon S3 or a
+// compatible server (MinIO, Ceph, Backblaze B2, Wasabi...). Folders are the
+// key prefixes between slashes; empty ones are kept as zero-length objects
+// named after the folder with a trailing slash, as the S3 console does.
+// Requests are signed with AWS Signature Version 4, using the credentials
+// of the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+// or of ~/.aws/credentials.
+
+const (
+	s3PartSize    = 16 << 20 // Uploads are sent in parts of this size, doubled every 1000 parts
+	s3MaxCopySize = 5 << 30  // Largest object the server copies in one request
+	s3Attempts    = 3        // Tries of requests failing with server or network errors
+)
+
+// s3Storage is a bucket, mounted at root
+type s3Storage struct {
+	root      string // Mount root, e.g. /s3:photos
+	bucket    string
+	endpoint  *url.URL
+	pathStyle bool // Bucket in the path rather than the host name
+	region    string
+	creds     s3Credentials
+	client    *http.Client
+
+	dirs sync.Map // Folders known to exist, by key
+}
+
+type s3Credentials struct {
+	accessKey, secretKey, token string
+}
+
+// newS3Storage parses the part of an s3:// URL after the scheme. Without an
+// endpoint, AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL, Amazon S3 in the region
+// of AWS_REGION is used.
+func newS3Storage(rest, endpoint string) (root string, st *s3Storage, dir string, err error) {
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", nil, "", errors.New("missing bucket")
+	}
+	creds, err := loadS3Credentials()
+	if err != nil {
+		return "", nil, "", err
+	}
+	region := cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+
+	// Compatible servers rarely have a DNS name per bucket, nor can a
+	// bucket name with dots be one under the amazonaws.com certificate
+	endpoint = cmp.Or(endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	pathStyle := true
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+		pathStyle = strings.Contains(bucket, ".")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", nil, "", fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+
+	root = filepath.FromSlash("/s3:" + bucket)
+	st = &s3Storage{root: root, bucket: bucket, endpoint: u, pathStyle: pathStyle, region: region, creds: creds, client: &http.Client{}}
+	return root, st, path.Clean("/" + prefix), nil
+}
+
+// loadS3Credentials reads the credentials from the environment, or from the
+// shared credentials file of the AWS tools (the profile AWS_PROFILE names)
+func loadS3Credentials() (s3Credentials, error) {
+	creds := s3Credentials{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}
+	if creds.accessKey != "" && creds.secretKey != "" {
+		return creds, nil
+	}
+
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if home, err := os.UserHomeDir(); file == "" && err == nil {
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := cmp.Or(os.Getenv("AWS_PROFILE"), "default")
+	if data, err := os.ReadFile(file); err == nil {
+		section := ""
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || section != profile {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "aws_access_key_id":
+				creds.accessKey = strings.TrimSpace(value)
+			case "aws_secret_access_key":
+				creds.secretKey = strings.TrimSpace(value)
+			case "aws_session_token":
+				creds.token = strings.TrimSpace(value)
+			}
+		}
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return creds, errors.New("no S3 credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or add them to ~/.aws/credentials")
+	}
+	return creds, nil
+}
+
+func (st *s3Storage) atomicCreate() {}
+
+// key returns the object key of a path below the mount root
+func (st *s3Storage) key(name string) string {
+	return strings.TrimPrefix(remotePath(st.root, name), "/")
+}
+
+// do sends a signed request about key. Requests failing with a server or
+// network error are retried. Error statuses are returned as errors; the
+// caller closes the body of other responses.
+func (st *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *st.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	if st.pathStyle {
+		u.Path += st.bucket + "/"
+	} else {
+		u.Host = st.bucket + "." + u.Host
+	}
+	u.Path += key
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	payload := sha256.Sum256(body)
+	var resp *http.Response
+	var err error
+	for attempt := range s3Attempts {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		req, reqErr := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if body != nil {
+			sum := md5.Sum(body)
+			req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		st.sign(req, hex.EncodeToString(payload[:]), time.Now())
+
+		resp, err = st.client.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+		err = s3ResponseError(resp)
+		resp.Body.Close()
+		if resp.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, err
+}
+
+// sign adds the AWS Signature Version 4 authorization to a request, signing
+// the host, the range and all x-amz- headers
+func (st *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if st.creds.token != "" {
+		req.Header.Set("X-Amz-Security-Token", st.creds.token)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-md5" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, payloadHash}, "\n")
+	scope := date[:8] + "/" + st.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + st.creds.secretKey)
+	for _, part := range []string{date[:8], st.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+st.creds.accessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, and
+// slashes unless escapeSlash is set, as signatures require
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query parameters in the canonical form, sorted by name
+func s3Query(query url.Values) string {
+	var params []string
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, value := range query[name] {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// s3ResponseError turns an error response into an error, the usual ones
+// into those of the fs package
+func s3ResponseError(resp *http.Response) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(data, &e)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fs.ErrNotExist
+	case resp.StatusCode == http.StatusForbidden:
+		return fs.ErrPermission
+	case e.Code == "":
+		return fmt.Errorf("s3: %s", resp.Status)
+	}
+	return fmt.Errorf("s3: %s (%s)", cmp.Or(e.Message, resp.Status), e.Code)
+}
+
+// checkBody reads the body of a successful response, which some requests
+// (copies, completed uploads) still use to report an error
+func checkBody(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &e) == nil && e.XMLName.Local == "Error" {
+		return fmt.Errorf("s3: %s (%s)", e.Message, e.Code)
+	}
+	if v != nil {
+		return xml.Unmarshal(data, v)
+	}
+	return nil
+}
+
+// head returns the size, modification time and ETag of an object
+func (st *s3Storage) head(key string) (*remoteFileInfo, string, error) {
+	resp, err := st.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	info := &remoteFileInfo{name: path.Base(key), size: resp.ContentLength, mode: 0o644, mtime: mtime}
+	return info, resp.Header.Get("ETag"), nil
+}
+
+type s3Listing struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// list returns the objects and folders right below prefix, the first
+// maxKeys of them or all when maxKeys is 0
+func (st *s3Storage) list(prefix string, maxKeys int) (*s3Listing, error) {
+	all := &s3Listing{}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	for {
+		resp, err := st.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page s3Listing
+		if err := checkBody(resp, &page); err != nil {
+			return nil, err
+		}
+		all.Contents = append(all.Contents, page.Contents...)
+		all.CommonPrefixes = append(all.CommonPrefixes, page.CommonPrefixes...)
+		if !page.IsTruncated || maxKeys > 0 || page.NextContinuationToken == "" {
+			return all, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func dirInfo(name string, mtime time.Time) fs.FileInfo {
+	return &remoteFileInfo{name: name, mode: fs.ModeDir | 0o755, mtime: mtime}
+}
+
+func (st *s3Storage) Open(name string) (File, error) {
+	key := st.key(name)
+	info, etag, err := st.head(key)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	get := func(off, end int64) (io.ReadCloser, error) { return st.get(key, etag, off, end) }
+	return &rangeFile{name: name, info: info, get: get}, nil
+}
+
+func (st *s3Storage) Create(name string) (io.WriteCloser, error) {
+	if st.key(name) == "" {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &s3Writer{st: st, name: name, key: st.key(name)}, nil
+}
+
+func (st *s3Storage) Stat(name string) (fs.FileInfo, error) {
+	key := st.key(name)
+	if key == "" {
+		// The bucket itself, which has to be there
+		if _, err := st.list("", 1); err != nil {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		}
+		return dirInfo(filepath.Base(name), time.Time{}), nil
+	}
+	info, _, err := st.head(key)
+	if err == nil {
+		return info, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	listing, err := st.list(key+"/", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(listing.Contents) == 0 && len(listing.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return dirInfo(path.Base(key), time.Time{}), nil
+}
+
+// Lstat is Stat, as objects can't be links
+func (st *s3Storage) Lstat(name string) (fs.FileInfo, error) {
+	return st.Stat(name)
+}
+
+func (st *s3Storage) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := st.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+	listing, err := st.list(prefix, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if prefix != "" && len(listing.Contents) == 0 && len(listing.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// Names that can't be paths, such as those of keys with double
+	// slashes, are left out
+	valid := func(name string) bool { return name != "" && name != "." && name != ".." }
+	var entries []fs.DirEntry
+	for _, object := range listing.Contents {
+		if name := strings.TrimPrefix(object.Key, prefix); valid(name) {
+			info := &remoteFileInfo{name: name, size: object.Size, mode: 0o644, mtime: object.LastModified.Truncate(time.Second)}
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+	for _, p := range listing.CommonPrefixes {
+		if name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); valid(name) {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(name, time.Time{})))
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// MkdirAll stores a folder object unless the folder has objects already;
+// the folders above it then exist too
+func (st *s3Storage) MkdirAll(name string) error {
+	key := st.key(name)
+	if _, ok := st.dirs.Load(key); ok || key == "" {
+		return nil
+	}
+	info, err := st.Stat(name)
+	switch {
+	case err == nil && !info.IsDir():
+		return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+	case errors.Is(err, fs.ErrNotExist):
+		resp, err := st.do(http.MethodPut, key+"/", nil, nil, []byte{})
+		if err != nil {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+		resp.Body.Close()
+	case err != nil:
+		return err
+	}
+	st.dirs.Store(key, true)
+	return nil
+}
+
+// Rename copies the object on the server and deletes the original
+func (st *s3Storage) Rename(oldname, newname string) error {
+	oldKey, newKey := st.key(oldname), st.key(newname)
+	if _, _, err := st.head(newKey); err == nil {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+	}
+	info, _, err := st.head(oldKey)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	if err := st.copyObject(oldKey, newKey, info.Size()); err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	resp, err := st.do(http.MethodDelete, oldKey, nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copyObject copies an object within the bucket, in parts when it is too
+// large for a single request
+func (st *s3Storage) copyObject(src, dest string, size int64) error {
+	source := http.Header{"X-Amz-Copy-Source": {"/" + st.bucket + "/" + s3Escape(src, false)}}
+	if size <= s3MaxCopySize {
+		resp, err := st.do(http.MethodPut, dest, nil, source, nil)
+		if err != nil {
+			return err
+		}
+		return checkBody(resp, nil)
+	}
+
+	upload, err := st.startUpload(dest)
+	if err != nil {
+		return err
+	}
+	for off := int64(0); off < size; off += s3MaxCopySize {
+		header := source.Clone()
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", off, min(off+s3MaxCopySize, size)-1))
+		resp, err := st.do(http.MethodPut, dest, upload.query(len(upload.parts)+1), header, nil)
+		if err != nil {
+			upload.abort()
+			return err
+		}
+		var result struct{ ETag string }
+		if err := checkBody(resp, &result); err != nil {
+			upload.abort()
+			return err
+		}
+		upload.parts = append(upload.parts, result.ETag)
+	}
+	return upload.complete()
+}
+
+// Remove deletes an object, or a folder object once nothing else is in
+// the folder
+func (st *s3Storage) Remove(name string) error {
+	key := st.key(name)
+	if _, _, err := st.head(key); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		listing, err := st.list(key+"/", 2)
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		if len(listing.Contents) == 0 && len(listing.CommonPrefixes) == 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+		}
+		if len(listing.CommonPrefixes) > 0 || len(listing.Contents) > 1 || listing.Contents[0].Key != key+"/" {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+		st.dirs.Delete(key)
+		key += "/"
+	}
+	resp, err := st.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get requests an object from off to end (exclusive); a changed object
+// fails rather than mixing versions
+func (st *s3Storage) get(key, etag string, off, end int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, end-1)}}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, err := st.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3Writer uploads an object: in one request when it is small, otherwise
+// as a multipart upload of which each part is sent as soon as it is full.
+// The server checks every request body against the SHA-256 its signature
+// holds and the MD5 sent along, and the object only appears once the
+// upload is complete.
+type s3Writer struct {
+	st     *s3Storage
+	name   string
+	key    string
+	buf    []byte
+	upload *s3Upload
+	err    error
+}
+
+func (w *s3Writer) partSize() int {
+	parts := 0
+	if w.upload != nil {
+		parts = len(w.upload.parts)
+	}
+	return s3PartSize << (parts / 1000)
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for size := w.partSize(); len(w.buf) >= size; size = w.partSize() {
+		if w.err = w.sendPart(w.buf[:size]); w.err != nil {
+			return 0, w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[size:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) sendPart(data []byte) error {
+	if w.upload == nil {
+		upload, err := w.st.startUpload(w.key)
+		if err != nil {
+			return &fs.PathError{Op: "write", Path: w.name, Err: err}
+		}
+		w.upload = upload
+	}
+	resp, err := w.st.do(http.MethodPut, w.key, w.upload.query(len(w.upload.parts)+1), nil, data)
+	if err != nil {
+		w.upload.abort()
+		return &fs.PathError{Op: "write", Path: w.name, Err: err}
+	}
+	resp.Body.Close()
+	w.upload.parts = append(w.upload.parts, resp.Header.Get("ETag"))
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = fs.ErrClosed
+	if w.upload == nil {
+		resp, err := w.st.do(http.MethodPut, w.key, nil, nil, w.buf)
+		if err != nil {
+			return &fs.PathError{Op: "write", Path: w.name, Err: err}
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.sendPart(w.buf); err != nil {
+			return err
+		}
+	}
+	if err := w.upload.complete(); err != nil {
+		return &fs.PathError{Op: "write", Path: w.name, Err: err}
+	}
+	return nil
+}
+
+func (w *s3Writer) abort() {
+	w.err = fs.ErrClosed
+	if w.upload != nil {
+		w.upload.abort()
+	}
+}
+
+// s3Upload is a multipart upload in progress
+type s3Upload struct {
+	st    *s3Storage
+	key   string
+	id    string
+	parts []string // ETags
+}
+
+func (st *s3Storage) startUpload(key string) (*s3Upload, error) {
+	resp, err := st.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct{ UploadId string }
+	if err := checkBody(resp, &result); err != nil {
+		return nil, err
+	}
+	return &s3Upload{st: st, key: key, id: result.UploadId}, nil
+}
+
+func (u *s3Upload) query(part int) url.Values {
+	return url.Values{"partNumber": {strconv.Itoa(part)}, "uploadId": {u.id}}
+}
+
+func (u *s3Upload) complete() error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var request struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range u.parts {
+		request.Parts = append(request.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := u.st.do(http.MethodPost, u.key, url.Values{"uploadId": {u.id}}, nil, body)
+	if err == nil {
+		err = checkBody(resp, nil)
+	}
+	if err != nil {
+		u.abort()
+	}
+	return err
+}
+
+// abort drops the parts uploaded so far, which the bucket would otherwise
+// keep (and bill for)
+func (u *s3Upload) abort() {
+	if resp, err := u.st.do(http.MethodDelete, u.key, url.Values{"uploadId": {u.id}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package sorter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultReplacement replaces the characters file names can't contain
+const DefaultReplacement = "_"
+
+// invalidNameChars can't appear in file names on Windows (and / nowhere)
+const invalidNameChars = `<>:"/\|?*`
+
+// reservedNames are the DOS device names Windows won't use as file names,
+// whatever their extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkReplacement rejects replacements that would themselves make a name invalid
+func checkReplacement(replacement string) error {
+	if replacement == "" || strings.ContainsAny(replacement, invalidNameChars) || strings.ContainsFunc(replacement, isControl) {
+		return fmt.Errorf("invalid replacement %q: must be non-empty and valid in file names", replacement)
+	}
+	return nil
+}
+
+// sanitizeName makes a file name valid on every platform the sorted tree may
+// be synced to: invalid and control characters become replacement, trailing
+// dots and spaces (which Windows drops) are removed, and reserved device
+// names such as CON or LPT1.txt get replacement appended to their stem.
+func sanitizeName(name, replacement string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if isControl(r) || strings.ContainsRune(invalidNameChars, r) {
+			b.WriteString(replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	name = strings.TrimRight(b.String(), " .")
+	if name == "" {
+		return replacement
+	}
+	stem, ext, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		name = stem + replacement
+		if ext != "" {
+			name += "." + ext
+		}
+	}
+	return name
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
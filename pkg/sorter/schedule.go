@@ -0,0 +1,246 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a timetable in the five fields of a crontab line: minute,
+// hour, day of month, month and day of week. Fields take *, numbers, names
+// (jan, mon), ranges, lists and steps, as in "0 */2 * * *" or
+// "30 8 * * mon-fri", and @hourly, @daily, @weekly, @monthly and @yearly
+// stand for a whole line. As in cron, a day that matches either of the day
+// of month and day of week fires when both are restricted. Times are in
+// the zone of the time given to Next; times a clock change skips don't
+// fire.
+type Schedule struct {
+	expr   string
+	minute uint64 // Bit n set when the field matches n
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// Set when the day fields are *, so the other one alone decides
+	domAny, dowAny bool
+}
+
+var scheduleMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseSchedule parses a crontab timetable such as "0 */2 * * *"
+func ParseSchedule(expr string) (*Schedule, error) {
+	line := strings.TrimSpace(expr)
+	if macro, ok := scheduleMacros[strings.ToLower(line)]; ok {
+		line = macro
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: needs 5 fields, minute hour day month weekday", expr)
+	}
+	sch := &Schedule{expr: expr}
+	var err error
+	for _, f := range []struct {
+		bits       *uint64
+		any        *bool
+		text       string
+		name       string
+		min, max   int
+		valueNames []string
+	}{
+		{&sch.minute, nil, fields[0], "minute", 0, 59, nil},
+		{&sch.hour, nil, fields[1], "hour", 0, 23, nil},
+		{&sch.dom, &sch.domAny, fields[2], "day of month", 1, 31, nil},
+		{&sch.month, nil, fields[3], "month", 1, 12, monthNames},
+		{&sch.dow, &sch.dowAny, fields[4], "day of week", 0, 7, dayNames},
+	} {
+		if *f.bits, err = parseScheduleField(f.text, f.min, f.max, f.valueNames); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s: %w", expr, f.name, err)
+		}
+		if f.any != nil {
+			*f.any = f.text == "*" || f.text == "?"
+		}
+	}
+	// Sunday is both 0 and 7
+	if sch.dow&(1<<7) != 0 {
+		sch.dow |= 1
+	}
+	if sch.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never fires", expr)
+	}
+	return sch, nil
+}
+
+// parseScheduleField returns the bits of the values a field matches
+func parseScheduleField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rangePart != "*" && rangePart != "?" {
+			loText, hiText, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = scheduleValue(loText, min, max, names); err != nil {
+				return 0, err
+			}
+			switch {
+			case isRange:
+				if hi, err = scheduleValue(hiText, min, max, names); err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("range %q ends before it starts", rangePart)
+				}
+			case !hasStep:
+				hi = lo // "5/15" runs from 5 to the end
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func scheduleValue(text string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(text, name) {
+			return i, nil
+		}
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%q is not a number from %d to %d", text, min, max)
+	}
+	return n, nil
+}
+
+func (sch *Schedule) String() string {
+	return sch.expr
+}
+
+// Next returns the first time after t the schedule fires, or the zero time
+// if it never does, as on February 30th
+func (sch *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	loc := t.Location()
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		var next time.Time
+		switch {
+		case sch.month&(1<<uint(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !sch.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case sch.hour&(1<<uint(t.Hour())) == 0:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case sch.minute&(1<<uint(t.Minute())) == 0:
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// time.Date takes a time a clock change skips back to before the
+		// change, which may be t or earlier: go on from the end of the gap
+		if !next.After(t) {
+			next = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+func (sch *Schedule) dayMatches(t time.Time) bool {
+	dom := sch.dom&(1<<uint(t.Day())) != 0
+	dow := sch.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case sch.domAny:
+		return dow
+	case sch.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// RunOnSchedule sorts the inboxes at the times of Options.Schedule until
+// stop is closed, each run starting up to Options.ScheduleJitter late, at
+// random, so machines sharing a schedule don't all reach a server at once.
+// Rather than holding the run lock throughout, it takes it for each run:
+// a run falling due while another process holds it, or while the previous
+// run is still going, is skipped.
+func (s *Sorter) RunOnSchedule(stop <-chan struct{}) error {
+	sch := s.opts.Schedule
+	if sch == nil {
+		return errors.New("no schedule to run on")
+	}
+	s.log.Info("Sorting on schedule", "schedule", sch.String(), "jitter", s.opts.ScheduleJitter)
+	for {
+		due := sch.Next(time.Now())
+		if due.IsZero() {
+			return fmt.Errorf("schedule %q never fires", sch)
+		}
+		start := due
+		if s.opts.ScheduleJitter > 0 {
+			start = start.Add(rand.N(s.opts.ScheduleJitter))
+		}
+		s.log.Info("Next run scheduled", "at", start.Format(time.DateTime))
+		timer := time.NewTimer(time.Until(start))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			s.log.Info("Stopping schedule")
+			return nil
+		case <-s.ctx.Done():
+			timer.Stop()
+			s.log.Info("Stopping schedule")
+			return nil
+		}
+
+		s.runScheduled()
+		if missed := sch.Next(due); missed.Before(time.Now()) {
+			s.log.Warn("Skipped scheduled runs while the previous one was still going", "from", missed.Format(time.DateTime))
+		}
+	}
+}
+
+// runScheduled runs a pass under the run lock, or skips it while another
+// run holds the lock
+func (s *Sorter) runScheduled() {
+	if !s.opts.DryRun {
+		unlock, err := s.Lock()
+		var locked *LockedError
+		if errors.As(err, &locked) {
+			s.log.Warn("Skipping scheduled run, another one is still going", "err", err)
+			return
+		}
+		if err != nil {
+			s.log.Error("Skipping scheduled run", "err", err)
+			return
+		}
+		defer unlock()
+	}
+	s.Run()
+}
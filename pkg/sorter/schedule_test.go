@@ -0,0 +1,102 @@
+package sorter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, 5, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		from time.Time
+		want []string // The next times it fires, in order
+	}{
+		{"* * * * *", from, []string{"2024-05-15 10:08", "2024-05-15 10:09"}},
+		{"0 */2 * * *", from, []string{"2024-05-15 12:00", "2024-05-15 14:00"}},
+		{"5/20 * * * *", from, []string{"2024-05-15 10:25", "2024-05-15 10:45", "2024-05-15 11:05"}},
+		{"10-12 9 * * *", from, []string{"2024-05-16 09:10", "2024-05-16 09:11", "2024-05-16 09:12", "2024-05-17 09:10"}},
+		{"0 0 1,15 * *", from, []string{"2024-06-01 00:00", "2024-06-15 00:00"}},
+		{"30 8 * * mon-fri", from, []string{"2024-05-16 08:30", "2024-05-17 08:30", "2024-05-20 08:30"}},
+		{"0 12 * JAN,jul *", from, []string{"2024-07-01 12:00", "2024-07-02 12:00"}},
+		{"0 0 * * 7", from, []string{"2024-05-19 00:00", "2024-05-26 00:00"}}, // Sunday as 7
+		{"@monthly", from, []string{"2024-06-01 00:00", "2024-07-01 00:00"}},
+		// Both day fields restricted: either one fires
+		{"0 0 13 * fri", from, []string{"2024-05-17 00:00", "2024-05-24 00:00", "2024-05-31 00:00", "2024-06-07 00:00", "2024-06-13 00:00"}},
+		// Only one restricted: that one alone
+		{"0 0 13 * *", from, []string{"2024-06-13 00:00"}},
+		{"0 0 29 2 *", from, []string{"2028-02-29 00:00"}},
+	}
+	for _, tt := range tests {
+		sch, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		next := tt.from
+		for _, want := range tt.want {
+			next = sch.Next(next)
+			if got := next.Format("2006-01-02 15:04"); got != want {
+				t.Errorf("%q fires at %s, want %s", tt.expr, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestScheduleErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"* * * *", "needs 5 fields"},
+		{"60 * * * *", "minute"},
+		{"* 24 * * *", "hour"},
+		{"* * 0 * *", "day of month"},
+		{"* * * foo *", "month"},
+		{"* * * * 8", "day of week"},
+		{"*/0 * * * *", "invalid step"},
+		{"10-5 * * * *", "ends before it starts"},
+		{"0 0 30 2 *", "never fires"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSchedule(tt.expr); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseSchedule(%q) = %v, want an error about %s", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestScheduleNever(t *testing.T) {
+	// February 30th, which ParseSchedule turns down
+	sch := &Schedule{minute: 1, hour: 1, dom: 1 << 30, month: 1 << 2, dowAny: true}
+	if next := sch.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("February 30th fires at %s", next)
+	}
+}
+
+func TestScheduleDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	sch, err := ParseSchedule("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2:30 doesn't exist on March 10th, 2024, when clocks skip from 2:00
+	// to 3:00, so that day has no run
+	next := sch.Next(time.Date(2024, 3, 9, 12, 0, 0, 0, loc))
+	if got, want := next.Format("2006-01-02 15:04 MST"), "2024-03-11 02:30 EDT"; got != want {
+		t.Errorf("fires at %s, want %s", got, want)
+	}
+	// An hourly schedule goes on past the gap
+	hourly, err := ParseSchedule("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hourly.Next(time.Date(2024, 3, 10, 1, 30, 0, 0, loc)).Format("15:04 MST"), "03:00 EDT"; got != want {
+		t.Errorf("hourly fires at %s after 1:30, want %s", got, want)
+	}
+}
@@ -0,0 +1,263 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Script is a rules script (rules.star): a Starlark program defining
+//
+//	def classify(file):
+//
+// which is called for every file no rule claims and returns the category
+// to sort it into, a path relative to the sorted directory, or "leave" to
+// keep it in the inbox. None keeps the category sorter picked, which the
+// script finds in file.category. The file has these attributes:
+//
+//	path, name, ext    Full path, base name, and lower case extension without the dot
+//	stem, folder       Name without the extension, name of the folder holding it
+//	size               Size in bytes
+//	modified           Modification time
+//	taken              EXIF date a photo was taken, or None
+//	mime               MIME type detected from the content, "" when unknown
+//	tags               Audio tags (artist, album_artist, album, title, year,
+//	                   track, genre) as a dict, or None
+//	category           Category sorter picked, "leave" for the inbox
+//
+// Times have the year, month, day, hour, minute, second, weekday (0 is
+// Monday), yday and unix attributes, and a strftime(format) method.
+type Script struct {
+	name     string
+	classify *starFunction
+}
+
+// LoadScript reads and runs a rules script, which must define classify
+func LoadScript(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("failed to open rules script: %w", err)}
+	}
+	script, err := ParseScript(path, data)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid rules script %s: %w", path, err)}
+	}
+	return script, nil
+}
+
+// ParseScript runs the top level of a rules script, named name in errors
+func ParseScript(name string, src []byte) (*Script, error) {
+	stmts, err := parseStarlark(string(src))
+	if err != nil {
+		return nil, err
+	}
+	globals := make(map[string]any)
+	env := &starEnv{th: &starThread{}, globals: globals}
+	if _, _, err := env.exec(stmts); err != nil {
+		return nil, err
+	}
+	classify, ok := globals["classify"].(*starFunction)
+	if !ok {
+		return nil, errors.New("no classify(file) function defined")
+	}
+	if len(classify.params) == 0 || len(classify.params) > 1 && classify.params[1].def == nil {
+		return nil, errors.New("classify must take one argument, the file")
+	}
+	for _, v := range globals {
+		freezeStar(v)
+	}
+	return &Script{name: filepath.Base(name), classify: classify}, nil
+}
+
+// run calls classify for a file with extension ext that would go to
+// category, returning the category it picks
+func (sc *Script) run(path, ext, category string, log *slog.Logger) (string, error) {
+	th := &starThread{print: func(msg string) {
+		log.Debug("Rules script output", "path", path, "line", msg)
+	}}
+	file := &scriptFile{path: path, ext: normalizeExt(ext), category: category}
+	result, err := th.call(sc.classify, []any{file}, nil)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", sc.name, err)
+	}
+	switch result := result.(type) {
+	case nil:
+		return category, nil
+	case string:
+		if result == LeaveInInbox {
+			return LeaveInInbox, nil
+		}
+		answer := filepath.FromSlash(result)
+		if !filepath.IsLocal(answer) {
+			return "", fmt.Errorf("%s: invalid category %q: must be a relative path", sc.name, result)
+		}
+		return answer, nil
+	}
+	return "", fmt.Errorf("%s: classify returned %s, want a string or None", sc.name, starType(result))
+}
+
+// scriptFile is the file classify gets. Its attributes are read as the
+// script asks for them, so the content is only opened when needed.
+type scriptFile struct {
+	path, ext, category string
+	info                fs.FileInfo
+}
+
+func (f *scriptFile) typeName() string { return "file" }
+
+func (f *scriptFile) String() string { return "<file " + f.path + ">" }
+
+func (f *scriptFile) attr(name string) (any, bool, error) {
+	switch name {
+	case "path":
+		return f.path, true, nil
+	case "name":
+		return filepath.Base(f.path), true, nil
+	case "ext":
+		return f.ext, true, nil
+	case "stem":
+		base := filepath.Base(f.path)
+		if f.ext != "" && strings.HasSuffix(strings.ToLower(base), "."+f.ext) {
+			return base[:len(base)-len(f.ext)-1], true, nil
+		}
+		return base, true, nil
+	case "folder":
+		return filepath.Base(filepath.Dir(f.path)), true, nil
+	case "category":
+		return filepath.ToSlash(f.category), true, nil
+	case "size", "modified":
+		if f.info == nil {
+			info, err := storageAt(f.path).Stat(f.path)
+			if err != nil {
+				return nil, true, err
+			}
+			f.info = info
+		}
+		if name == "size" {
+			return int(f.info.Size()), true, nil
+		}
+		return starTime{f.info.ModTime()}, true, nil
+	case "taken":
+		taken, err := exifDate(f.path)
+		if errors.Is(err, errNoExif) {
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		return starTime{taken}, true, nil
+	case "mime":
+		mimeType, _, err := DetectType(f.path)
+		return mimeType, true, err
+	case "tags":
+		tags, err := readAudioTags(f.path)
+		if errors.Is(err, errNoTags) {
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		dict := newStarDict()
+		for key, value := range map[string]string{
+			"artist": tags.Artist, "album_artist": tags.AlbumArtist, "album": tags.Album,
+			"title": tags.Title, "year": tags.Year, "track": tags.Track, "genre": tags.Genre,
+		} {
+			dict.set(key, value)
+		}
+		return dict, true, nil
+	}
+	return nil, false, nil
+}
+
+// starTime is a time in a rules script
+type starTime struct{ t time.Time }
+
+func (t starTime) typeName() string { return "time" }
+
+func (t starTime) String() string { return t.t.Format(time.RFC3339) }
+
+func (t starTime) attr(name string) (any, bool, error) {
+	switch name {
+	case "year":
+		return t.t.Year(), true, nil
+	case "month":
+		return int(t.t.Month()), true, nil
+	case "day":
+		return t.t.Day(), true, nil
+	case "hour":
+		return t.t.Hour(), true, nil
+	case "minute":
+		return t.t.Minute(), true, nil
+	case "second":
+		return t.t.Second(), true, nil
+	case "weekday":
+		return (int(t.t.Weekday()) + 6) % 7, true, nil
+	case "yday":
+		return t.t.YearDay(), true, nil
+	case "unix":
+		return int(t.t.Unix()), true, nil
+	case "strftime":
+		return &starBuiltin{name: "strftime", fn: func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("strftime", args, kwargs, 1, 1); err != nil {
+				return nil, err
+			}
+			format, err := starString("strftime", args[0])
+			if err != nil {
+				return nil, err
+			}
+			return strftime(t.t, format)
+		}}, true, nil
+	}
+	return nil, false, nil
+}
+
+// strftime formats a time with the usual %Y, %m, %d, %H, %M, %S, %y, %j,
+// %b, %B, %a, %A and %% directives
+func strftime(t time.Time, format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		if i++; i == len(format) {
+			return "", errors.New("strftime: incomplete directive")
+		}
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("strftime: unsupported directive %%%c", format[i])
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,541 @@
+package sorter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+var err7zCorrupt = errors.New("corrupt 7z archive")
+
+// Property IDs of 7z headers
+const (
+	sz7End                = 0x00
+	sz7Header             = 0x01
+	sz7ArchiveProperties  = 0x02
+	sz7AdditionalStreams  = 0x03
+	sz7MainStreams        = 0x04
+	sz7FilesInfo          = 0x05
+	sz7PackInfo           = 0x06
+	sz7UnpackInfo         = 0x07
+	sz7SubStreamsInfo     = 0x08
+	sz7Size               = 0x09
+	sz7CRC                = 0x0A
+	sz7Folders            = 0x0B
+	sz7CodersUnpackSize   = 0x0C
+	sz7NumUnpackStream    = 0x0D
+	sz7EmptyStream        = 0x0E
+	sz7EmptyFile          = 0x0F
+	sz7Name               = 0x11
+	sz7Attributes         = 0x15
+	sz7EncodedHeader      = 0x17
+	sz7AttributeDirectory = 0x10 // In the Windows attributes
+)
+
+// Coder method IDs
+var (
+	sz7MethodLZMA = []byte{0x03, 0x01, 0x01}
+	sz7MethodAES  = []byte{0x06, 0xF1, 0x07, 0x01}
+)
+
+// sz7Coder is one step of decoding a folder
+type sz7Coder struct {
+	method []byte
+	props  []byte
+}
+
+// sz7Folder is a set of streams packed together, in solid archives several
+// files
+type sz7Folder struct {
+	coders      []sz7Coder
+	unpackSizes []uint64 // Of each coder output
+	streams     uint64   // Files in the folder
+	crc         bool     // The unpacked folder has a CRC
+}
+
+func (f *sz7Folder) encrypted() bool {
+	for _, coder := range f.coders {
+		if bytes.Equal(coder.method, sz7MethodAES) {
+			return true
+		}
+	}
+	return false
+}
+
+// unpackSize is the size of the folder's final output
+func (f *sz7Folder) unpackSize() uint64 {
+	if len(f.unpackSizes) == 0 {
+		return 0
+	}
+	return f.unpackSizes[len(f.unpackSizes)-1]
+}
+
+// sz7Streams is the streams info of a 7z header
+type sz7Streams struct {
+	packPos   uint64
+	packSizes []uint64
+	folders   []*sz7Folder
+	sizes     []uint64 // Of the files in the folders, in order
+}
+
+// list7z reads the header of a 7z archive, decompressing it when it is
+// packed, as it is by default
+func list7z(f io.ReaderAt, size int64) (*archiveListing, error) {
+	start := make([]byte, 32)
+	if _, err := f.ReadAt(start, 0); err != nil {
+		return nil, err
+	}
+	offset := binary.LittleEndian.Uint64(start[12:])
+	length := binary.LittleEndian.Uint64(start[20:])
+	if length == 0 || length > archiveMaxHeader || offset > uint64(size) || 32+offset+length > uint64(size) {
+		return nil, err7zCorrupt
+	}
+	header := make([]byte, length)
+	if _, err := f.ReadAt(header, int64(32+offset)); err != nil {
+		return nil, err
+	}
+	listing := &archiveListing{format: "7z"}
+	for decoded := false; ; decoded = true {
+		r := &sz7Reader{data: header}
+		switch r.byte() {
+		case sz7Header:
+			if err := r.header(listing); err != nil {
+				return nil, err
+			}
+			return listing, nil
+		case sz7EncodedHeader:
+			if decoded {
+				return nil, err7zCorrupt // Encoded only once
+			}
+			streams := r.streams()
+			if r.err != nil {
+				return nil, r.err
+			}
+			if len(streams.folders) != 1 || len(streams.packSizes) == 0 {
+				return nil, fmt.Errorf("%w: unsupported header encoding", err7zCorrupt)
+			}
+			folder := streams.folders[0]
+			if folder.encrypted() {
+				listing.encryptedHeaders = true
+				return listing, nil
+			}
+			if len(folder.coders) != 1 || !bytes.Equal(folder.coders[0].method, sz7MethodLZMA) {
+				return nil, errors.New("unsupported 7z header compression")
+			}
+			packed, unpacked := streams.packSizes[0], folder.unpackSize()
+			if packed > archiveMaxHeader || unpacked > archiveMaxHeader || 32+streams.packPos+packed > uint64(size) {
+				return nil, err7zCorrupt
+			}
+			data := make([]byte, packed)
+			if _, err := f.ReadAt(data, int64(32+streams.packPos)); err != nil {
+				return nil, err
+			}
+			var err error
+			if header, err = lzmaDecode(folder.coders[0].props, data, int(unpacked)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err7zCorrupt
+		}
+	}
+}
+
+// sz7Reader reads the fields of a 7z header, keeping the first error
+type sz7Reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *sz7Reader) fail() {
+	if r.err == nil {
+		r.err = err7zCorrupt
+	}
+	r.pos = len(r.data)
+}
+
+func (r *sz7Reader) byte() byte {
+	if r.pos >= len(r.data) {
+		r.fail()
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *sz7Reader) bytes(n uint64) []byte {
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail()
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// number reads a 7z number: the high bits of the first byte tell how many
+// bytes follow
+func (r *sz7Reader) number() uint64 {
+	first := r.byte()
+	var value uint64
+	for i := range 8 {
+		mask := byte(0x80) >> i
+		if first&mask == 0 {
+			return value | uint64(first&(mask-1))<<(8*i)
+		}
+		value |= uint64(r.byte()) << (8 * i)
+	}
+	return value
+}
+
+// count reads a number of items, each taking at least one byte
+func (r *sz7Reader) count() int {
+	n := r.number()
+	if n > uint64(len(r.data)) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+// bits reads a vector of n booleans, high bit first
+func (r *sz7Reader) bits(n int) []bool {
+	v := make([]bool, n)
+	var b, mask byte
+	for i := range v {
+		if mask == 0 {
+			b, mask = r.byte(), 0x80
+		}
+		v[i] = b&mask != 0
+		mask >>= 1
+	}
+	return v
+}
+
+// defined reads which of n items have a value: all of them, or those a
+// vector says
+func (r *sz7Reader) defined(n int) []bool {
+	if r.byte() == 0 {
+		return r.bits(n)
+	}
+	all := make([]bool, n)
+	for i := range all {
+		all[i] = true
+	}
+	return all
+}
+
+// digests skips the CRCs of n streams, returning which have one
+func (r *sz7Reader) digests(n int) []bool {
+	defined := r.defined(n)
+	for _, d := range defined {
+		if d {
+			r.bytes(4)
+		}
+	}
+	return defined
+}
+
+// skipProperty skips a property of unknown meaning, which has its size
+func (r *sz7Reader) skipProperty() {
+	r.bytes(r.number())
+}
+
+// header reads the plain header, listing the files
+func (r *sz7Reader) header(listing *archiveListing) error {
+	var streams *sz7Streams
+	id := r.byte()
+	if id == sz7ArchiveProperties {
+		for r.byte() != sz7End && r.err == nil {
+			r.skipProperty()
+		}
+		id = r.byte()
+	}
+	if id == sz7AdditionalStreams {
+		r.streams()
+		id = r.byte()
+	}
+	if id == sz7MainStreams {
+		streams = r.streams()
+		id = r.byte()
+	}
+	if id == sz7FilesInfo {
+		r.files(listing, streams)
+		id = r.byte()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if id != sz7End {
+		return err7zCorrupt
+	}
+	return nil
+}
+
+// streams reads a streams info
+func (r *sz7Reader) streams() *sz7Streams {
+	s := &sz7Streams{}
+	id := r.byte()
+	if id == sz7PackInfo {
+		s.packPos = r.number()
+		s.packSizes = make([]uint64, r.count())
+		for id = r.byte(); id != sz7End && r.err == nil; id = r.byte() {
+			switch id {
+			case sz7Size:
+				for i := range s.packSizes {
+					s.packSizes[i] = r.number()
+				}
+			case sz7CRC:
+				r.digests(len(s.packSizes))
+			default:
+				r.skipProperty()
+			}
+		}
+		id = r.byte()
+	}
+	if id == sz7UnpackInfo {
+		if r.byte() != sz7Folders {
+			r.fail()
+			return s
+		}
+		s.folders = make([]*sz7Folder, r.count())
+		if r.byte() != 0 { // External
+			r.fail()
+			return s
+		}
+		for i := range s.folders {
+			s.folders[i] = r.folder()
+		}
+		if r.byte() != sz7CodersUnpackSize {
+			r.fail()
+			return s
+		}
+		for _, folder := range s.folders {
+			for i := range folder.unpackSizes {
+				folder.unpackSizes[i] = r.number()
+			}
+		}
+		for id = r.byte(); id != sz7End && r.err == nil; id = r.byte() {
+			if id == sz7CRC {
+				for i, d := range r.digests(len(s.folders)) {
+					s.folders[i].crc = d
+				}
+			} else {
+				r.skipProperty()
+			}
+		}
+		id = r.byte()
+	}
+	for _, folder := range s.folders {
+		folder.streams = 1
+	}
+	if id == sz7SubStreamsInfo {
+		id = r.byte()
+		if id == sz7NumUnpackStream {
+			for _, folder := range s.folders {
+				folder.streams = uint64(r.count())
+			}
+			id = r.byte()
+		}
+		// Sizes of all but the last file of each folder, which gets the rest
+		for _, folder := range s.folders {
+			if folder.streams == 0 {
+				continue
+			}
+			var sum uint64
+			if id == sz7Size {
+				for range folder.streams - 1 {
+					size := r.number()
+					s.sizes = append(s.sizes, size)
+					sum += size
+					if r.err != nil {
+						return s
+					}
+				}
+			}
+			s.sizes = append(s.sizes, folder.unpackSize()-sum)
+		}
+		if id == sz7Size {
+			id = r.byte()
+		}
+		for ; id != sz7End && r.err == nil; id = r.byte() {
+			if id == sz7CRC {
+				// Files alone in a folder with a CRC have theirs already
+				n := 0
+				for _, folder := range s.folders {
+					if folder.streams != 1 || !folder.crc {
+						n += int(folder.streams)
+					}
+				}
+				if n > len(r.data) {
+					r.fail()
+				}
+				r.digests(n)
+			} else {
+				r.skipProperty()
+			}
+		}
+		id = r.byte()
+	} else {
+		for _, folder := range s.folders {
+			s.sizes = append(s.sizes, folder.unpackSize())
+		}
+	}
+	if id != sz7End {
+		r.fail()
+	}
+	return s
+}
+
+// folder reads the coders of a folder
+func (r *sz7Reader) folder() *sz7Folder {
+	f := &sz7Folder{}
+	var inStreams, outStreams uint64
+	for range r.count() {
+		flags := r.byte()
+		if flags&0x80 != 0 { // Alternative methods, never written
+			r.fail()
+			return f
+		}
+		coder := sz7Coder{method: r.bytes(uint64(flags & 0x0F))}
+		in, out := uint64(1), uint64(1)
+		if flags&0x10 != 0 {
+			in, out = r.number(), r.number()
+		}
+		if flags&0x20 != 0 {
+			coder.props = r.bytes(r.number())
+		}
+		inStreams += in
+		outStreams += out
+		f.coders = append(f.coders, coder)
+	}
+	if outStreams == 0 || inStreams < outStreams-1 || outStreams > uint64(len(r.data)) || inStreams > uint64(len(r.data)) {
+		r.fail()
+		return f
+	}
+	for range outStreams - 1 { // Bind pairs
+		r.number()
+		r.number()
+	}
+	if packed := inStreams - (outStreams - 1); packed > 1 {
+		for range packed {
+			r.number()
+		}
+	}
+	f.unpackSizes = make([]uint64, outStreams)
+	return f
+}
+
+// files reads the files info: names, and which files have no content
+func (r *sz7Reader) files(listing *archiveListing, streams *sz7Streams) {
+	n := r.count()
+	entries := make([]archiveEntry, n)
+	var emptyStream, emptyFile []bool
+	var attributes []uint32
+	for {
+		id := r.number()
+		if id == sz7End || r.err != nil {
+			break
+		}
+		size := r.number()
+		end := r.pos + int(size)
+		if size > uint64(len(r.data)-r.pos) {
+			r.fail()
+			return
+		}
+		switch id {
+		case sz7EmptyStream:
+			emptyStream = r.bits(n)
+		case sz7EmptyFile:
+			empties := 0
+			for _, e := range emptyStream {
+				if e {
+					empties++
+				}
+			}
+			emptyFile = r.bits(empties)
+		case sz7Name:
+			if r.byte() != 0 { // External
+				r.fail()
+				return
+			}
+			names := r.bytes(uint64(end - r.pos))
+			for i := range entries {
+				var units []uint16
+				for len(names) >= 2 {
+					unit := binary.LittleEndian.Uint16(names)
+					names = names[2:]
+					if unit == 0 {
+						break
+					}
+					units = append(units, unit)
+				}
+				entries[i].name = string(utf16.Decode(units))
+			}
+		case sz7Attributes:
+			defined := r.defined(n)
+			if r.byte() != 0 { // External
+				r.fail()
+				return
+			}
+			attributes = make([]uint32, n)
+			for i, d := range defined {
+				if !d {
+					continue
+				}
+				if b := r.bytes(4); b != nil {
+					attributes[i] = binary.LittleEndian.Uint32(b)
+				}
+			}
+		}
+		r.pos = end
+	}
+	if r.err != nil {
+		return
+	}
+
+	// Files with content take the streams of the folders in order
+	stream, empty := 0, 0
+	var folder int
+	var folderLeft uint64
+	if streams != nil {
+		for folder < len(streams.folders) && streams.folders[folder].streams == 0 {
+			folder++
+		}
+		if folder < len(streams.folders) {
+			folderLeft = streams.folders[folder].streams
+		}
+	}
+	for i := range entries {
+		entry := &entries[i]
+		if attributes != nil && attributes[i]&sz7AttributeDirectory != 0 {
+			entry.dir = true
+		}
+		if i < len(emptyStream) && emptyStream[i] {
+			if empty >= len(emptyFile) || !emptyFile[empty] {
+				entry.dir = true // An empty stream that isn't an empty file is a folder
+			}
+			empty++
+			continue
+		}
+		if streams == nil || stream >= len(streams.sizes) || folder >= len(streams.folders) {
+			r.fail()
+			return
+		}
+		entry.size = int64(streams.sizes[stream])
+		entry.encrypted = streams.folders[folder].encrypted()
+		stream++
+		if folderLeft--; folderLeft == 0 {
+			for folder++; folder < len(streams.folders) && streams.folders[folder].streams == 0; folder++ {
+			}
+			if folder < len(streams.folders) {
+				folderLeft = streams.folders[folder].streams
+			}
+		}
+	}
+	listing.entries = append(listing.entries, entries...)
+}
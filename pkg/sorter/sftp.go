@@ -0,0 +1,898 @@
+package sorter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The SFTP storage speaks version 3 of the SFTP protocol, the one OpenSSH
+// implements, to the sftp subsystem of a server reached through the ssh
+// command. Authentication, host keys and connection settings are thus those
+// of the user's OpenSSH setup (~/.ssh/config, the agent, known_hosts).
+
+// DefaultSSHCommand runs the sftp subsystem and remote hash commands
+var DefaultSSHCommand = []string{"ssh"}
+
+// SFTP packet types
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+)
+
+// Status codes
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpOpUnsupported    = 8
+)
+
+// Attribute flags
+const (
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+	sftpAttrExtended    = 0x80000000
+)
+
+// Open flags
+const (
+	sftpOpenRead  = 0x1
+	sftpOpenWrite = 0x2
+	sftpOpenCreat = 0x8
+	sftpOpenTrunc = 0x10
+)
+
+const (
+	sftpChunk    = 32 * 1024 // Largest read or write every server accepts
+	sftpPipeline = 16        // Requests in flight while streaming a file
+
+	// Files at least this large are hashed on the server when it can,
+	// since starting a command there costs less than reading them over
+	remoteHashMin = 16 << 20
+)
+
+// sftpStorage is a directory tree on an SFTP server, mounted at root
+type sftpStorage struct {
+	root string   // Mount root, e.g. /sftp:me@nas
+	ssh  []string // Command and arguments up to the destination
+
+	mu     sync.Mutex
+	client *sftpClient
+
+	noHash sync.Map // Algorithms the server failed to hash with
+}
+
+// newSFTPStorage parses the part of an sftp:// URL after the scheme
+func newSFTPStorage(rest string, sshCommand []string) (root string, st *sftpStorage, dir string, err error) {
+	u, err := url.Parse("sftp://" + rest)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if u.Hostname() == "" {
+		return "", nil, "", errors.New("missing host")
+	}
+	if u.Path == "" || u.Path == "/" {
+		return "", nil, "", errors.New("missing directory")
+	}
+	if _, ok := u.User.Password(); ok {
+		return "", nil, "", errors.New("passwords can't be given in the URL; use ssh keys or the agent")
+	}
+
+	dest := u.Hostname()
+	if u.User != nil {
+		dest = u.User.Username() + "@" + dest
+	}
+	ssh := slices.Clone(sshCommand)
+	if len(ssh) == 0 {
+		ssh = slices.Clone(DefaultSSHCommand)
+	}
+	root = "/sftp:" + dest
+	if port := u.Port(); port != "" {
+		ssh = append(ssh, "-p", port)
+		root += ":" + port
+	}
+	root = filepath.FromSlash(root)
+	return root, &sftpStorage{root: root, ssh: append(ssh, dest)}, path.Clean(u.Path), nil
+}
+
+// conn returns the connection to the server, (re)connecting when there is
+// none or it was lost
+func (st *sftpStorage) conn() (*sftpClient, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.client != nil && st.client.alive() {
+		return st.client, nil
+	}
+	dest := st.ssh[len(st.ssh)-1]
+	args := append(slices.Clone(st.ssh[:len(st.ssh)-1]), "-s", dest, "sftp")
+	client, err := dialSFTP(args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", dest, err)
+	}
+	st.client = client
+	return client, nil
+}
+
+func (st *sftpStorage) remote(name string) string {
+	return remotePath(st.root, name)
+}
+
+func (st *sftpStorage) Open(name string) (File, error) {
+	c, err := st.conn()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := c.open(st.remote(name), sftpOpenRead)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &sftpFile{c: c, name: name, handle: handle}, nil
+}
+
+func (st *sftpStorage) Create(name string) (io.WriteCloser, error) {
+	c, err := st.conn()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := c.open(st.remote(name), sftpOpenWrite|sftpOpenCreat|sftpOpenTrunc)
+	if err != nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	return &sftpWriter{c: c, name: name, handle: handle}, nil
+}
+
+func (st *sftpStorage) Stat(name string) (fs.FileInfo, error) {
+	return st.stat(sftpStat, "stat", name)
+}
+
+func (st *sftpStorage) Lstat(name string) (fs.FileInfo, error) {
+	return st.stat(sftpLstat, "lstat", name)
+}
+
+func (st *sftpStorage) stat(typ byte, op, name string) (fs.FileInfo, error) {
+	c, err := st.conn()
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := c.stat(typ, st.remote(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return attrs.info(filepath.Base(name)), nil
+}
+
+func (st *sftpStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	c, err := st.conn()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := c.readDir(st.remote(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (st *sftpStorage) MkdirAll(name string) error {
+	info, err := st.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(name); parent != name && parent != st.root {
+		if err := st.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	c, err := st.conn()
+	if err != nil {
+		return err
+	}
+	if err := c.status(sftpMkdir, sftpString(st.remote(name)), sftpUint32(0)); err != nil {
+		// Someone else may have just created it
+		if info, statErr := st.Stat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (st *sftpStorage) Rename(oldname, newname string) error {
+	c, err := st.conn()
+	if err != nil {
+		return err
+	}
+	if err := c.status(sftpRename, sftpString(st.remote(oldname)), sftpString(st.remote(newname))); err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	return nil
+}
+
+func (st *sftpStorage) Remove(name string) error {
+	info, err := st.Lstat(name)
+	if err != nil {
+		return err
+	}
+	c, err := st.conn()
+	if err != nil {
+		return err
+	}
+	typ := byte(sftpRemove)
+	if info.IsDir() {
+		typ = sftpRmdir
+	}
+	if err := c.status(typ, sftpString(st.remote(name))); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (st *sftpStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return st.setstat(name, sftpAttrACModTime, sftpUint32(uint32(atime.Unix())), sftpUint32(uint32(mtime.Unix())))
+}
+
+func (st *sftpStorage) Chmod(name string, mode fs.FileMode) error {
+	return st.setstat(name, sftpAttrPermissions, sftpUint32(uint32(mode.Perm())))
+}
+
+func (st *sftpStorage) setstat(name string, flags uint32, values ...[]byte) error {
+	c, err := st.conn()
+	if err != nil {
+		return err
+	}
+	args := append([][]byte{sftpString(st.remote(name)), sftpUint32(flags)}, values...)
+	if err := c.status(sftpSetstat, args...); err != nil {
+		return &fs.PathError{Op: "setstat", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Commands printing a digest the way hashFile formats it, by algorithm
+var remoteHashCommands = map[string]string{
+	"xxh64":  "xxhsum -H1",
+	"sha256": "sha256sum",
+}
+
+// Hash runs a hash command on the server. Algorithms it has no command for,
+// or whose command failed before, aren't tried. Remote paths are absolute,
+// so they can't be taken for options.
+func (st *sftpStorage) Hash(name, algorithm string) (string, error) {
+	command, ok := remoteHashCommands[algorithm]
+	if _, failed := st.noHash.Load(algorithm); !ok || failed {
+		return "", errNoRemoteHash
+	}
+	args := append(slices.Clone(st.ssh), command+" "+shellQuote(st.remote(name)))
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	fields := strings.Fields(string(out))
+	if err != nil || len(fields) == 0 {
+		st.noHash.Store(algorithm, true)
+		return "", errNoRemoteHash
+	}
+	digest := strings.ToLower(fields[0])
+	if algorithm == "xxh64" {
+		// hashFile leaves out leading zeros
+		n, err := strconv.ParseUint(digest, 16, 64)
+		if err != nil {
+			st.noHash.Store(algorithm, true)
+			return "", errNoRemoteHash
+		}
+		return strconv.FormatUint(n, 16), nil
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		st.noHash.Store(algorithm, true)
+		return "", errNoRemoteHash
+	}
+	return digest, nil
+}
+
+// shellQuote quotes s for the POSIX shell that runs remote ssh commands
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sftpClient is one SFTP session. Requests can be sent from several
+// goroutines; replies are matched to them by id.
+type sftpClient struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stderr  *bytes.Buffer
+	writeMu sync.Mutex
+	exts    map[string]string // Protocol extensions the server supports
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpPacket
+	err     error // Why the session ended
+}
+
+type sftpPacket struct {
+	typ  byte
+	data []byte // After the request id
+}
+
+// dialSFTP starts the ssh command and sets up the session
+func dialSFTP(args []string) (*sftpClient, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &sftpClient{cmd: cmd, stdin: stdin, stderr: stderr, pending: make(map[uint32]chan sftpPacket), exts: make(map[string]string)}
+
+	fail := func(err error) (*sftpClient, error) {
+		stdin.Close()
+		cmd.Wait()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	if err := c.send(sftpInit, nil, sftpUint32(3)); err != nil {
+		return fail(err)
+	}
+	typ, data, err := readSFTPPacket(stdout)
+	if err != nil {
+		return fail(fmt.Errorf("no sftp session: %w", err))
+	}
+	if typ != sftpVersion || len(data) < 4 {
+		return fail(errors.New("not an sftp server"))
+	}
+	for r := sftpReader(data[4:]); len(r) > 0; {
+		name, value := r.string(), r.string()
+		if r == nil {
+			break
+		}
+		c.exts[name] = value
+	}
+	go c.receive(stdout)
+	return c, nil
+}
+
+// receive hands replies to the requests waiting for them until the
+// session ends
+func (c *sftpClient) receive(r io.Reader) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err == nil && len(data) < 4 {
+			err = errors.New("short sftp packet")
+		}
+		if err != nil {
+			c.stdin.Close()
+			c.cmd.Wait()
+			if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+				err = fmt.Errorf("%w: %s", err, msg)
+			}
+			c.mu.Lock()
+			c.err = fmt.Errorf("sftp connection lost: %w", err)
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+		id := binary.BigEndian.Uint32(data)
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- sftpPacket{typ: typ, data: data[4:]}
+		}
+	}
+}
+
+func (c *sftpClient) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+// send writes one packet; id is nil for the init packet, which has none
+func (c *sftpClient) send(typ byte, id []byte, fields ...[]byte) error {
+	length := 1 + len(id)
+	for _, f := range fields {
+		length += len(f)
+	}
+	buf := make([]byte, 0, 4+length)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(length))
+	buf = append(buf, typ)
+	buf = append(buf, id...)
+	for _, f := range fields {
+		buf = append(buf, f...)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.stdin.Write(buf)
+	return err
+}
+
+// start sends a request and returns the channel its reply arrives on,
+// closed if the session ends first
+func (c *sftpClient) start(typ byte, fields ...[]byte) (<-chan sftpPacket, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan sftpPacket, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	if err := c.send(typ, sftpUint32(id), fields...); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// wait returns the reply arriving on ch
+func (c *sftpClient) wait(ch <-chan sftpPacket) (sftpPacket, error) {
+	p, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return p, c.err
+	}
+	return p, nil
+}
+
+func (c *sftpClient) request(typ byte, fields ...[]byte) (sftpPacket, error) {
+	ch, err := c.start(typ, fields...)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return c.wait(ch)
+}
+
+// status sends a request answered by a status alone
+func (c *sftpClient) status(typ byte, fields ...[]byte) error {
+	p, err := c.request(typ, fields...)
+	if err != nil {
+		return err
+	}
+	return p.err()
+}
+
+func (c *sftpClient) open(name string, flags uint32) (string, error) {
+	p, err := c.request(sftpOpen, sftpString(name), sftpUint32(flags), sftpUint32(0))
+	if err != nil {
+		return "", err
+	}
+	if p.typ != sftpHandle {
+		return "", p.err()
+	}
+	r := sftpReader(p.data)
+	return r.string(), nil
+}
+
+func (c *sftpClient) close(handle string) error {
+	return c.status(sftpClose, sftpString(handle))
+}
+
+func (c *sftpClient) stat(typ byte, name string) (sftpAttributes, error) {
+	return c.attrs(c.request(typ, sftpString(name)))
+}
+
+func (c *sftpClient) attrs(p sftpPacket, err error) (sftpAttributes, error) {
+	if err != nil {
+		return sftpAttributes{}, err
+	}
+	if p.typ != sftpAttrs {
+		return sftpAttributes{}, p.err()
+	}
+	r := sftpReader(p.data)
+	return r.attrs(), nil
+}
+
+func (c *sftpClient) readDir(dir string) ([]fs.FileInfo, error) {
+	p, err := c.request(sftpOpendir, sftpString(dir))
+	if err != nil {
+		return nil, err
+	}
+	if p.typ != sftpHandle {
+		return nil, p.err()
+	}
+	r := sftpReader(p.data)
+	handle := r.string()
+	defer c.close(handle)
+
+	var infos []fs.FileInfo
+	for {
+		p, err := c.request(sftpReaddir, sftpString(handle))
+		if err != nil {
+			return nil, err
+		}
+		if p.typ != sftpName {
+			if err := p.err(); err != io.EOF {
+				return nil, err
+			}
+			return infos, nil
+		}
+		r := sftpReader(p.data)
+		for n := r.uint32(); n > 0 && r != nil; n-- {
+			name := r.string()
+			r.string() // ls -l style line
+			attrs := r.attrs()
+			if name != "." && name != ".." && r != nil {
+				infos = append(infos, attrs.info(name))
+			}
+		}
+	}
+}
+
+// err turns a status reply into an error, nil for success. Missing files
+// and denied access come as fs.ErrNotExist and fs.ErrPermission, so
+// os.IsNotExist and os.IsPermission recognize them.
+func (p sftpPacket) err() error {
+	if p.typ != sftpStatus {
+		return fmt.Errorf("unexpected sftp reply %d", p.typ)
+	}
+	r := sftpReader(p.data)
+	code, msg := r.uint32(), r.string()
+	switch code {
+	case sftpOK:
+		return nil
+	case sftpEOF:
+		return io.EOF
+	case sftpNoSuchFile:
+		return fs.ErrNotExist
+	case sftpPermissionDenied:
+		return fs.ErrPermission
+	case sftpOpUnsupported:
+		return errors.ErrUnsupported
+	}
+	if msg == "" {
+		msg = "failure"
+	}
+	return fmt.Errorf("sftp: %s (status %d)", msg, code)
+}
+
+// sftpFile is a file opened for reading. Sequential reads keep several
+// requests in flight, so throughput doesn't hinge on the round-trip time.
+type sftpFile struct {
+	c      *sftpClient
+	name   string
+	handle string
+	offset int64
+	buf    []byte // Read ahead of offset
+	eof    bool   // The server reported the end after buf
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if len(f.buf) == 0 && !f.eof {
+		if err := f.readAhead(); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	f.offset += int64(n)
+	return n, nil
+}
+
+// readAhead fetches the chunks following offset with concurrent requests
+func (f *sftpFile) readAhead() error {
+	var replies []<-chan sftpPacket
+	for i := range sftpPipeline {
+		ch, err := f.c.start(sftpRead, sftpString(f.handle), sftpUint64(uint64(f.offset)+uint64(i*sftpChunk)), sftpUint32(sftpChunk))
+		if err != nil {
+			return err
+		}
+		replies = append(replies, ch)
+	}
+	// Chunks only follow on from a full one; a short chunk is usually the
+	// end, but servers may also send less mid-file
+	var firstErr error
+	done := false
+	for _, ch := range replies {
+		p, err := f.c.wait(ch)
+		if done {
+			continue // Drain the rest
+		}
+		switch {
+		case err != nil:
+			firstErr, done = err, true
+		case p.typ == sftpData:
+			r := sftpReader(p.data)
+			data := r.string()
+			f.buf = append(f.buf, data...)
+			f.eof = len(data) == 0
+			done = len(data) < sftpChunk
+		default:
+			if err := p.err(); err == io.EOF {
+				f.eof = true
+			} else {
+				firstErr = &fs.PathError{Op: "read", Path: f.name, Err: err}
+			}
+			done = true
+		}
+	}
+	return firstErr
+}
+
+func (f *sftpFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		size := min(len(p)-n, sftpChunk)
+		reply, err := f.c.request(sftpRead, sftpString(f.handle), sftpUint64(uint64(off)+uint64(n)), sftpUint32(uint32(size)))
+		if err != nil {
+			return n, err
+		}
+		if reply.typ != sftpData {
+			if err := reply.err(); err != io.EOF {
+				return n, &fs.PathError{Op: "read", Path: f.name, Err: err}
+			}
+			return n, io.EOF
+		}
+		r := sftpReader(reply.data)
+		data := r.string()
+		if len(data) == 0 {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data)
+	}
+	return n, nil
+}
+
+func (f *sftpFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset {
+		f.offset, f.buf, f.eof = offset, nil, false
+	}
+	return offset, nil
+}
+
+func (f *sftpFile) Stat() (fs.FileInfo, error) {
+	attrs, err := f.c.attrs(f.c.request(sftpFstat, sftpString(f.handle)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+	return attrs.info(filepath.Base(f.name)), nil
+}
+
+func (f *sftpFile) Close() error {
+	return f.c.close(f.handle)
+}
+
+// sftpWriter is a file opened for writing. Writes are gathered and sent
+// several chunks at a time.
+type sftpWriter struct {
+	c      *sftpClient
+	name   string
+	handle string
+	offset int64
+	buf    []byte
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= sftpPipeline*sftpChunk {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *sftpWriter) flush() error {
+	var replies []<-chan sftpPacket
+	for off := 0; off < len(w.buf); off += sftpChunk {
+		chunk := w.buf[off:min(off+sftpChunk, len(w.buf))]
+		ch, err := w.c.start(sftpWrite, sftpString(w.handle), sftpUint64(uint64(w.offset)), sftpString(string(chunk)))
+		if err != nil {
+			return err
+		}
+		replies = append(replies, ch)
+		w.offset += int64(len(chunk))
+	}
+	w.buf = w.buf[:0]
+	var firstErr error
+	for _, ch := range replies {
+		p, err := w.c.wait(ch)
+		if err == nil {
+			err = p.err()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = &fs.PathError{Op: "write", Path: w.name, Err: err}
+		}
+	}
+	return firstErr
+}
+
+// Close sends what is left and, where the server offers it, has the file
+// flushed to disk before closing it
+func (w *sftpWriter) Close() error {
+	err := w.flush()
+	if _, ok := w.c.exts["fsync@openssh.com"]; ok && err == nil {
+		err = w.c.status(sftpExtended, sftpString("fsync@openssh.com"), sftpString(w.handle))
+	}
+	if closeErr := w.c.close(w.handle); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sftpAttributes are the file attributes in SFTP replies
+type sftpAttributes struct {
+	size  int64
+	perm  uint32 // Unix mode, type bits included
+	mtime time.Time
+}
+
+func (a sftpAttributes) info(name string) fs.FileInfo {
+	mode := fs.FileMode(a.perm & 0o777)
+	switch a.perm & 0o170000 {
+	case 0o040000:
+		mode |= fs.ModeDir
+	case 0o120000:
+		mode |= fs.ModeSymlink
+	case 0o010000:
+		mode |= fs.ModeNamedPipe
+	case 0o140000:
+		mode |= fs.ModeSocket
+	case 0o020000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0o060000:
+		mode |= fs.ModeDevice
+	}
+	return &remoteFileInfo{name: name, size: a.size, mode: mode, mtime: a.mtime}
+}
+
+// readSFTPPacket reads one length-prefixed packet
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 1<<24 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+func sftpUint32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func sftpUint64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func sftpString(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// sftpReader decodes the fields of a packet. It becomes nil once data runs
+// short, and reads from a nil reader give zero values.
+type sftpReader []byte
+
+func (r *sftpReader) uint32() uint32 {
+	if len(*r) < 4 {
+		*r = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(*r) < 8 {
+		*r = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if *r == nil || uint32(len(*r)) < n {
+		*r = nil
+		return ""
+	}
+	s := string((*r)[:n])
+	*r = (*r)[n:]
+	return s
+}
+
+func (r *sftpReader) attrs() sftpAttributes {
+	var a sftpAttributes
+	flags := r.uint32()
+	if flags&sftpAttrSize != 0 {
+		a.size = int64(r.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		a.perm = r.uint32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		r.uint32() // Access time
+		a.mtime = time.Unix(int64(r.uint32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && *r != nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
@@ -0,0 +1,229 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSidecars are the extensions of the files the CLI keeps with the
+// file they describe: edits and metadata of photos (xmp, aae, thm),
+// subtitles and media info (srt, sub, idx, ass, ssa, vtt, nfo)
+var DefaultSidecars = []string{"xmp", "aae", "thm", "srt", "sub", "idx", "ass", "ssa", "vtt", "nfo"}
+
+// sidecarSet parses Options.Sidecars into lower-case extensions without
+// the dot
+func sidecarSet(exts []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" || strings.ContainsAny(ext, `./\`) {
+			return nil, fmt.Errorf("invalid sidecar extension %q", ext)
+		}
+		set[ext] = true
+	}
+	return set, nil
+}
+
+// isSidecar reports whether a file has one of the sidecar extensions
+func (s *Sorter) isSidecar(path string) bool {
+	return s.sidecars[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))]
+}
+
+// Extensions of camera RAW files, and of the pictures cameras save
+// alongside them, paired by Options.RawPairs
+var (
+	rawExts = map[string]bool{
+		"cr2": true, "cr3": true, "crw": true, "nef": true, "nrw": true, "arw": true, "srf": true, "sr2": true, "dng": true,
+		"raf": true, "orf": true, "rw2": true, "pef": true, "srw": true, "x3f": true, "3fr": true, "iiq": true,
+	}
+	rawCompanionExts = map[string]bool{"jpg": true, "jpeg": true, "heic": true, "heif": true}
+)
+
+// lowerExt returns the extension of a file in lower case, without the dot
+func lowerExt(path string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// pairSidecars takes the sidecars of other inbox files out of the
+// candidates, attaching them to the file they share a folder and a name
+// with: photo.xmp or photo.cr2.xmp to photo.cr2. With Options.RawPairs the
+// JPEG a camera saved along with a RAW file is attached to it the same way,
+// sidecars of its own included. When several files could own a sidecar,
+// the first in walk order gets it. Sidecars without one, and those a rule
+// claims, are sorted on their own.
+func (s *Sorter) pairSidecars(candidates []*indexedFile) []*indexedFile {
+	if len(s.sidecars) == 0 && !s.opts.RawPairs {
+		return candidates
+	}
+	stemOf := func(file *indexedFile) string {
+		return strings.ToLower(strings.TrimSuffix(file.path, filepath.Ext(file.path)))
+	}
+	raws := make(map[string]*indexedFile)
+	if s.opts.RawPairs {
+		for _, file := range candidates {
+			if rawExts[lowerExt(file.path)] && raws[stemOf(file)] == nil {
+				raws[stemOf(file)] = file
+			}
+		}
+	}
+	rawOf := func(file *indexedFile) *indexedFile {
+		if file.rule != nil || !rawCompanionExts[lowerExt(file.path)] {
+			return nil
+		}
+		return raws[stemOf(file)]
+	}
+
+	primaries := make(map[string]*indexedFile)
+	for _, file := range candidates {
+		if s.isSidecar(file.path) {
+			continue
+		}
+		owner := file
+		if raw := rawOf(file); raw != nil {
+			owner = raw // So that its sidecars follow the RAW file too
+		}
+		for _, key := range []string{strings.ToLower(file.path), stemOf(file)} {
+			if primaries[key] == nil {
+				primaries[key] = owner
+			}
+		}
+	}
+
+	files := make([]*indexedFile, 0, len(candidates))
+	for _, file := range candidates {
+		var owner *indexedFile
+		switch {
+		case file.rule != nil:
+		case s.isSidecar(file.path):
+			owner = primaries[stemOf(file)]
+		default:
+			owner = rawOf(file)
+			file.companion = owner != nil
+		}
+		if owner == nil {
+			files = append(files, file)
+			continue
+		}
+		s.log.Debug("Sidecar paired", "path", file.path, "primary", owner.path)
+		owner.sidecars = append(owner.sidecars, file)
+	}
+	return files
+}
+
+// sidecarDest names a sidecar of primary after where primary went, dest:
+// photo.xmp follows photo.cr2 to 2024/photo_1.cr2 as 2024/photo_1.xmp,
+// photo.cr2.xmp as 2024/photo_1.cr2.xmp
+func sidecarDest(primary, sidecar, dest string) string {
+	name, side := filepath.Base(primary), filepath.Base(sidecar)
+	destName := filepath.Base(dest)
+	if len(side) > len(name) && strings.EqualFold(side[:len(name)], name) {
+		return filepath.Join(filepath.Dir(dest), destName+side[len(name):])
+	}
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	return filepath.Join(filepath.Dir(dest), strings.TrimSuffix(destName, filepath.Ext(destName))+side[len(stem):])
+}
+
+// moveSidecars moves the sidecars of a file sorted to dest next to it,
+// indexing the JPEGs of RAW files for the duplicate checks of later files.
+// Only errors that should stop the run are returned.
+func (s *Sorter) moveSidecars(file *indexedFile, dest string, index *dupIndex) error {
+	for _, sidecar := range file.sidecars {
+		s.emit(Event{Type: EventFile, Path: sidecar.path, Size: sidecar.size})
+		if err := s.moveSidecar(sidecar, sidecarDest(file.path, sidecar.path, dest)); err != nil {
+			return err
+		}
+		if sidecar.companion {
+			sidecar.inRun = true
+			index.add(sidecar)
+		}
+	}
+	return nil
+}
+
+// moveSidecar moves a sidecar to target, leaving it in the inbox when the
+// name is taken there. Only errors that should stop the run are returned.
+func (s *Sorter) moveSidecar(sidecar *indexedFile, target string) error {
+	if s.destExists(sidecar.path, target) {
+		s.log.Warn("Destination of sidecar already exists, leaving it in place", "path", sidecar.path, "dest", target)
+		s.emit(Event{Type: EventSkipped, Path: sidecar.path, Dest: target, Reason: "collision"})
+		return nil
+	}
+	if s.opts.DryRun {
+		s.planMove(sidecar.path, target, "sidecar", "")
+		return nil
+	}
+	if err := s.renameFile(sidecar.path, target); err != nil {
+		if s.ctx.Err() != nil {
+			return s.aborted()
+		}
+		s.log.Error("Failed to move sidecar", "path", sidecar.path, "err", err)
+		s.emitError(sidecar.path, err)
+		return nil
+	}
+	sidecar.movedTo = target
+	s.journal.record(JournalEntry{Action: "move", Src: sidecar.path, Dest: target, Reason: "sidecar"})
+	s.log.Info("Sidecar moved", "src", sidecar.path, "dest", target)
+	s.emit(Event{Type: EventMoved, Path: sidecar.path, Dest: target, Reason: "sidecar"})
+	return nil
+}
+
+// deleteSidecars sends the sidecars of a file that went to the delete
+// folder after it. They stay with it when it was left in the inbox.
+//
+// The JPEG of a RAW file that duplicates kept, on the other hand, is only a
+// duplicate when its own content is found elsewhere. Otherwise it joins
+// the RAW file kept when sorting (or stays in the inbox, with dedupe), so
+// the pair is whole again.
+func (s *Sorter) deleteSidecars(file, kept *indexedFile, index *dupIndex, sortUnique bool) error {
+	if s.opts.DryRun {
+		if !s.plannedSrcs[file.path] {
+			return nil
+		}
+	} else if _, err := storageAt(file.path).Lstat(file.path); !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	for _, sidecar := range file.sidecars {
+		s.emit(Event{Type: EventFile, Path: sidecar.path, Size: sidecar.size})
+		if !sidecar.companion || kept == nil {
+			if err := s.moveToDelete(sidecar.path, "sidecar", file.path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		duplicate, err := index.find(sidecar)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return s.aborted()
+			}
+			s.log.Error("Failed to hash file", "path", sidecar.path, "err", err)
+			s.emitError(sidecar.path, err)
+			continue
+		}
+		if duplicate != nil {
+			s.log.Info("Duplicate found", "path", sidecar.path, "duplicate_of", duplicate.path)
+			s.emit(Event{Type: EventDuplicate, Path: sidecar.path, DuplicateOf: duplicate.path, Hash: sidecar.full})
+			if err := s.moveToDelete(sidecar.path, "duplicate", duplicate.path); err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case !sortUnique:
+			// Unique files stay in the inbox
+		case nested(kept.location(), s.opts.SortedDir):
+			if err := s.moveSidecar(sidecar, sidecarDest(file.path, sidecar.path, kept.location())); err != nil {
+				return err
+			}
+		default:
+			s.log.Warn("RAW file is a duplicate but its JPEG isn't, and the RAW file kept isn't sorted; leaving the JPEG in the inbox", "path", sidecar.path, "raw", file.path)
+			s.emit(Event{Type: EventSkipped, Path: sidecar.path, Reason: "unpaired"})
+		}
+		sidecar.inRun = true
+		index.add(sidecar)
+	}
+	return nil
+}
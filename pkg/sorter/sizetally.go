@@ -0,0 +1,126 @@
+package sorter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"slices"
+)
+
+// Sizes a sizeTally keeps in memory before spilling them to disk, 8 MiB
+const sizeTallyBuffer = 1 << 20
+
+// sizeTally finds the file sizes that occur more than once among any
+// number of files with bounded memory: sizes are buffered, and every full
+// buffer is sorted and spilled to a temporary file, the runs being merged
+// at the end
+type sizeTally struct {
+	buf  []int64
+	runs []*os.File
+}
+
+func (t *sizeTally) add(size int64) error {
+	t.buf = append(t.buf, size)
+	if len(t.buf) < sizeTallyBuffer {
+		return nil
+	}
+	return t.spill()
+}
+
+func (t *sizeTally) spill() error {
+	slices.Sort(t.buf)
+	f, err := os.CreateTemp("", "sorter-sizes-*")
+	if err != nil {
+		return err
+	}
+	t.runs = append(t.runs, f)
+	w := bufio.NewWriter(f)
+	if err := binary.Write(w, binary.LittleEndian, t.buf); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	t.buf = t.buf[:0]
+	return nil
+}
+
+// repeated returns the sizes added more than once and removes the
+// temporary files
+func (t *sizeTally) repeated() (map[int64]bool, error) {
+	defer t.close()
+	repeated := make(map[int64]bool)
+	if len(t.runs) == 0 {
+		slices.Sort(t.buf)
+		for i := 1; i < len(t.buf); i++ {
+			if t.buf[i] == t.buf[i-1] {
+				repeated[t.buf[i]] = true
+			}
+		}
+		return repeated, nil
+	}
+	if len(t.buf) > 0 {
+		if err := t.spill(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Merge the runs, always taking the smallest size at their heads
+	type run struct {
+		r    *bufio.Reader
+		head int64
+	}
+	var heads []*run
+	for _, f := range t.runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		heads = append(heads, &run{r: bufio.NewReader(f)})
+	}
+	next := func(r *run) (bool, error) {
+		err := binary.Read(r.r, binary.LittleEndian, &r.head)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	for i := 0; i < len(heads); {
+		if ok, err := next(heads[i]); err != nil {
+			return nil, err
+		} else if !ok {
+			heads = slices.Delete(heads, i, i+1)
+		} else {
+			i++
+		}
+	}
+	last, seen := int64(0), false
+	for len(heads) > 0 {
+		i := 0
+		for j := range heads {
+			if heads[j].head < heads[i].head {
+				i = j
+			}
+		}
+		size := heads[i].head
+		if seen && size == last {
+			repeated[size] = true
+		}
+		last, seen = size, true
+		if ok, err := next(heads[i]); err != nil {
+			return nil, err
+		} else if !ok {
+			heads = slices.Delete(heads, i, i+1)
+		}
+	}
+	return repeated, nil
+}
+
+func (t *sizeTally) close() {
+	for _, f := range t.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	t.runs, t.buf = nil, nil
+}
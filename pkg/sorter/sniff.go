@@ -0,0 +1,181 @@
+package sorter
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffHeaderSize is how much of a file content detection looks at
+const sniffHeaderSize = 512
+
+// signature identifies a format by the bytes at a fixed offset
+type signature struct {
+	offset   int
+	magic    string
+	mimeType string
+}
+
+// Formats http.DetectContentType doesn't know about (or lumps together),
+// checked before falling back to it
+var extraSignatures = []signature{
+	{0, "fLaC", "audio/flac"},
+	{0, "7z\xBC\xAF\x27\x1C", "application/x-7z-compressed"},
+	{0, "Rar!\x1A\x07", "application/vnd.rar"},
+	{0, "II*\x00", "image/tiff"},
+	{0, "MM\x00*", "image/tiff"},
+	{4, "ftypheic", "image/heic"},
+	{4, "ftypheix", "image/heic"},
+	{4, "ftypmif1", "image/heic"},
+	{4, "ftypavif", "image/avif"},
+	{4, "ftypqt  ", "video/quicktime"},
+	{4, "ftypM4A ", "audio/mp4"},
+	{4, "ftypM4V ", "video/x-m4v"},
+	{0, "ID3", "audio/mpeg"},
+	{0, "\x00\x00\x01\xBA", "video/mpeg"},
+	{0, "FLV\x01", "video/x-flv"},
+	{0, "AT&TFORM", "image/vnd.djvu"},
+	{0, "{\\rtf", "application/rtf"},
+	{0, "SQLite format 3\x00", "application/vnd.sqlite3"},
+	{0, "MZ", "application/x-msdownload"},
+	{0, "\x7FELF", "application/x-executable"},
+	{0, "\xCF\xFA\xED\xFE", "application/x-mach-binary"},
+	{0, "\xFE\xED\xFA\xCF", "application/x-mach-binary"},
+}
+
+// Canonical extension for each detectable MIME type, used to look the
+// content up in the extension map
+var mimeExtensions = map[string]string{
+	"application/pdf":               "pdf",
+	"application/postscript":        "ps",
+	"application/rtf":               "rtf",
+	"application/zip":               "zip",
+	"application/x-gzip":            "gz",
+	"application/x-rar-compressed":  "rar",
+	"application/vnd.rar":           "rar",
+	"application/x-7z-compressed":   "7z",
+	"application/wasm":              "wasm",
+	"application/ogg":               "ogg",
+	"application/vnd.sqlite3":       "sqlite",
+	"application/x-msdownload":      "exe",
+	"application/x-executable":      "elf",
+	"application/x-mach-binary":     "macho",
+	"application/vnd.ms-fontobject": "eot",
+	"audio/aiff":                    "aiff",
+	"audio/basic":                   "au",
+	"audio/flac":                    "flac",
+	"audio/midi":                    "mid",
+	"audio/mp4":                     "m4a",
+	"audio/mpeg":                    "mp3",
+	"audio/wave":                    "wav",
+	"font/collection":               "ttc",
+	"font/otf":                      "otf",
+	"font/ttf":                      "ttf",
+	"font/woff":                     "woff",
+	"font/woff2":                    "woff2",
+	"image/avif":                    "avif",
+	"image/bmp":                     "bmp",
+	"image/gif":                     "gif",
+	"image/heic":                    "heic",
+	"image/jpeg":                    "jpg",
+	"image/png":                     "png",
+	"image/tiff":                    "tiff",
+	"image/vnd.djvu":                "djvu",
+	"image/webp":                    "webp",
+	"image/x-icon":                  "ico",
+	"text/html":                     "html",
+	"text/plain":                    "txt",
+	"text/xml":                      "xml",
+	"video/avi":                     "avi",
+	"video/mp4":                     "mp4",
+	"video/mpeg":                    "mpg",
+	"video/quicktime":               "mov",
+	"video/webm":                    "webm",
+	"video/x-flv":                   "flv",
+	"video/x-m4v":                   "m4v",
+}
+
+// DetectType sniffs the first 512 bytes of a file and returns its MIME type
+// along with the canonical extension for it ("" when the content isn't
+// recognized)
+func DetectType(filePath string) (mimeType, ext string, err error) {
+	file, err := storageAt(filePath).Open(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", err
+	}
+	mimeType = sniffHeader(header[:n])
+	return mimeType, mimeExtensions[mimeType], nil
+}
+
+func sniffHeader(header []byte) string {
+	for _, sig := range extraSignatures {
+		if len(header) >= sig.offset+len(sig.magic) &&
+			bytes.Equal(header[sig.offset:sig.offset+len(sig.magic)], []byte(sig.magic)) {
+			return sig.mimeType
+		}
+	}
+
+	// Drop parameters such as "; charset=utf-8"
+	mimeType, _, _ := strings.Cut(http.DetectContentType(header), ";")
+	return mimeType
+}
+
+// expectedType returns the MIME type a file with the given extension
+// (without the dot, lower case) should contain, or "" if unknown
+func expectedType(ext string) string {
+	for mimeType, canonical := range mimeExtensions {
+		if canonical == ext {
+			return mimeType
+		}
+	}
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension("."+ext), ";")
+	return mimeType
+}
+
+// typeFamily groups MIME types into broad kinds of content. Executables get
+// a family of their own so they never blend in with other binaries.
+func typeFamily(mimeType string) string {
+	switch mimeType {
+	case "application/x-msdownload", "application/x-executable", "application/x-mach-binary",
+		"application/x-msdos-program", "application/vnd.microsoft.portable-executable":
+		return "executable"
+	case "application/ogg":
+		return "audio"
+	}
+	family, _, _ := strings.Cut(mimeType, "/")
+	return family
+}
+
+// DetectMismatch sniffs a file and reports whether its content belongs to a
+// different kind of file than its extension claims (e.g. an executable named
+// .jpg). Text and unrecognized content never count as a mismatch since
+// sniffing can't tell those formats apart reliably.
+func DetectMismatch(filePath string) (mismatch bool, expected, actual string, err error) {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filePath)), ".")
+	if ext == "" {
+		return false, "", "", nil
+	}
+	expected = expectedType(ext)
+	if expected == "" {
+		return false, "", "", nil
+	}
+
+	actual, actualExt, err := DetectType(filePath)
+	if err != nil {
+		return false, "", "", err
+	}
+	if actualExt == "" || actualExt == ext || strings.HasPrefix(actual, "text/") {
+		return false, expected, actual, nil
+	}
+	return typeFamily(expected) != typeFamily(actual), expected, actual, nil
+}
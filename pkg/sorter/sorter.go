@@ -0,0 +1,715 @@
+// Package sorter is the engine behind the sorter command: it walks an inbox,
+// classifies files by extension, detects duplicates against a sorted tree and
+// moves every file either into its category or into a delete folder.
+package sorter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configures a Sorter
+type Options struct {
+	InboxDir  string // Directory to sort files from
+	SortedDir string // Directory unique files are moved into, by category
+	DeleteDir string // Directory duplicates are moved into
+
+	// The directories can also live on an SFTP server, given as URLs such
+	// as sftp://me@nas/srv/sorted. The server is reached by running
+	// SSHCommand (default DefaultSSHCommand, plain "ssh"), which has the
+	// user's OpenSSH configuration, keys and known hosts apply.
+	SSHCommand []string
+
+	// S3Endpoint is the server of s3://bucket/prefix directories, for
+	// S3-compatible storage such as MinIO (default AWS_ENDPOINT_URL_S3,
+	// AWS_ENDPOINT_URL, or Amazon S3 in the AWS_REGION region)
+	S3Endpoint string
+
+	// JournalDir receives one journal per run so runs can be undone.
+	// Journaling is disabled when empty.
+	JournalDir string
+
+	Categories   CategoryConfig // Extension to category mapping
+	ExcludeDirs  []string       // Glob patterns of inbox folders to skip
+	ExcludeFiles []string       // Glob patterns of inbox files to skip
+
+	// Inboxes are further directories sorted in the same pass as InboxDir,
+	// such as the desktop or a NAS drop folder. Unlike InboxDir they aren't
+	// created, and are skipped while missing, e.g. when a share isn't mounted.
+	Inboxes []Inbox
+
+	// MinSize and MaxSize, when set, leave inbox files smaller or larger
+	// than them where they are, such as tiny junk files or disk images.
+	// A matching rule still applies to them, so a rule with its own minsize
+	// or maxsize can route them to a category instead.
+	MinSize Size
+	MaxSize Size
+
+	// MinAge leaves inbox files modified more recently than this where they
+	// are, so files still being downloaded or synced aren't grabbed
+	// half-written. Watch runs again once the first of them is old enough.
+	MinAge time.Duration
+
+	// StableWait, when set, has every pass wait this long after finding
+	// the inbox files and leave those whose size or modification time
+	// changed meanwhile, or that another process has open for writing
+	// (detected on Linux and Windows), so half-downloaded files aren't
+	// sorted as if complete
+	StableWait time.Duration
+
+	// Rules are evaluated before the extension map and can send a file to
+	// a category, leave it in the inbox or move it to the delete folder
+	Rules []Rule
+
+	// NameTemplate names files in the sorted directory, relative to it
+	// (default DefaultNameTemplate, "{category}/{name}{ext}").
+	// DeleteTemplate names files moved to the delete directory (default
+	// DefaultDeleteTemplate, "{name}_{hash6}_processed_delete{ext}").
+	NameTemplate   string
+	DeleteTemplate string
+
+	// UnknownCategory is where files go whose extension isn't configured
+	// and whose content (see SniffContent) didn't tell, {EXT} standing for
+	// the upper-case extension; LeaveInInbox leaves them in the inbox.
+	// NoExtensionCategory is the same for files without an extension, which
+	// have NO_EXTENSION as {EXT}. Both default to DefaultUnknownCategory.
+	UnknownCategory     string
+	NoExtensionCategory string
+
+	// CollisionPolicy decides what happens when a sorted file's destination
+	// is taken: CollisionSuffixHash (default), CollisionSuffixCounter,
+	// CollisionSkip, CollisionOverwriteIdentical or CollisionFail
+	CollisionPolicy string
+
+	// Replacement stands in for the characters a sorted file's name can't
+	// contain, such as ? or | (default DefaultReplacement). Names reserved
+	// on Windows, such as CON, get it appended.
+	Replacement string
+
+	// Normalization is the Unicode normalization form of sorted file and
+	// folder names: NormalizeNFC (default), NormalizeNFD or NormalizeNone.
+	// Names are always compared normalized, so a folder synced from macOS
+	// isn't duplicated by one that only differs in how accents are encoded.
+	Normalization string
+
+	// Trash sends files that would go to DeleteDir (duplicates and rule
+	// deletions) to the platform trash instead: the FreeDesktop.org trash,
+	// ~/.Trash on macOS or the Windows Recycle Bin
+	Trash bool
+
+	// Retention, when set, makes every Run purge the files that have been
+	// in DeleteDir for longer (see Purge)
+	Retention time.Duration
+
+	// SecureWipe overwrites purged files with random data before removing
+	// them. It can't reach copies kept by SSDs, copy-on-write filesystems or
+	// snapshots, and refuses files with other hard links.
+	SecureWipe bool
+
+	// HashAlgorithm names the hash files are compared with: "xxh64" (the
+	// default, fast), "xxh3", "sha256", "blake3" or one added with
+	// RegisterHasher
+	HashAlgorithm string
+
+	// Preserve names what a copy across filesystems keeps from the original:
+	// a comma-separated list of PreserveMode, PreserveTimes,
+	// PreserveOwnership and PreserveXattrs, "all" or "none" (default
+	// DefaultPreserve, all but ownership). Same-filesystem moves keep
+	// everything.
+	Preserve string
+
+	// TrustHashes treats files with matching hashes as duplicates without
+	// comparing them byte by byte first
+	TrustHashes bool
+
+	Workers int  // Number of files hashed concurrently (default runtime.NumCPU())
+	DryRun  bool // Report what would happen without touching anything
+
+	// SniffContent classifies files with a missing or unknown extension by
+	// their content (magic numbers in the first 512 bytes)
+	SniffContent bool
+
+	// Script, when set, is asked for the category of every file no rule
+	// claims, before the external classifier; see Script
+	Script *Script
+
+	// ClassifierModules are WebAssembly classifiers, asked in turn for the
+	// category of every file no rule claims, after the script and before
+	// the external classifier. Each gets the PluginRequest of a file as
+	// JSON and answers with a PluginResponse, through functions it exports
+	// along with its memory:
+	//
+	//	alloc(size i32) -> i32             Where to write a request of size bytes
+	//	classify(ptr i32, len i32) -> i64  Where the answer is: address << 32 | length
+	//
+	// An empty answer keeps the category, as an empty PluginResponse does.
+	// Modules can import only env.log(ptr, len i32), which logs a message,
+	// and env.abort. They get the first ClassifierHead bytes of each file.
+	ClassifierModules []*WasmModule
+
+	// ClassifierCommand, when set, runs an external classifier: a program
+	// kept running and asked for the category of every file no rule claims,
+	// with a line of JSON (PluginRequest) on its standard input for each,
+	// which it answers with a line of its own (PluginResponse). It gets the
+	// first ClassifierHead bytes of each file too.
+	ClassifierCommand []string
+	ClassifierHead    int
+
+	// ClamdAddress, when set, has the ClamAV daemon listening there (a Unix
+	// socket path or host:port) scan every inbox file before it is sorted.
+	// Files it finds malware in go to MalwareCategory, by default
+	// DefaultMalwareCategory, whatever the rules say; files it can't scan
+	// are left in the inbox.
+	ClamdAddress    string
+	MalwareCategory string
+
+	// Quarantine, when set, holds back risky files such as executables;
+	// see QuarantinePolicy
+	Quarantine *QuarantinePolicy
+
+	// EncryptedCategory receives the zip, rar and 7z archives that take a
+	// password to open, whose content can't be looked into, when no rule
+	// claims them; LeaveInInbox leaves them in the inbox instead. They are
+	// sorted with the other archives when it is empty. The quarantine
+	// policy, when it holds them back, comes first.
+	EncryptedCategory string
+
+	// ExtractArchives has the zip and tar archives (plain, gzip or bzip2
+	// compressed) found in the inboxes unpacked into StagingDir, which is
+	// sorted as one more inbox, so their files are classified and
+	// deduplicated like any other. The archives themselves go to
+	// ExtractedDir. Archives a rule claims, encrypted ones and those that
+	// fail to unpack are sorted as they are. Dedupe leaves archives alone.
+	ExtractArchives bool
+	StagingDir      string
+	ExtractedDir    string
+
+	// Sidecars are the extensions of files that belong with another one,
+	// e.g. DefaultSidecars: an inbox file named like another in its folder,
+	// photo.xmp or photo.cr2.xmp next to photo.cr2, goes wherever that one
+	// goes, renamed after it, rather than being sorted or deduplicated on
+	// its own. Sidecars without such a file are sorted as usual.
+	Sidecars []string
+
+	// RawPairs keeps the JPEG or HEIF a camera saved along with a RAW file,
+	// IMG_1234.JPG next to IMG_1234.CR3, with the RAW file as if it were a
+	// sidecar. The JPEG isn't checked for duplicates on its own unless the
+	// RAW file is a duplicate, when it is sorted next to the RAW file kept
+	// if its content is found nowhere else.
+	RawPairs bool
+
+	// Units, when set, picks inbox folders to move whole into a category of
+	// their own rather than sort their files one by one; see UnitPolicy.
+	// Dedupe leaves them alone.
+	Units *UnitPolicy
+
+	// ProjectCategory receives project folders, those holding one of
+	// ProjectMarkers such as .git or go.mod, moved whole as units are so
+	// that a checkout isn't torn apart by extension, e.g.
+	// DefaultProjectCategory. LeaveInInbox leaves them in the inbox
+	// instead. Detection is off when empty; it comes before Units.
+	ProjectCategory string
+
+	// MismatchCategory receives files whose content contradicts their
+	// extension, e.g. Quarantine/Mismatched. Detection is off when empty.
+	MismatchCategory string
+
+	// CorruptCategory receives files that fail to parse as their format,
+	// such as truncated zips or JPEGs without an end, see CheckIntegrity,
+	// e.g. DefaultCorruptCategory. Like the mismatch check it doesn't apply
+	// to files a rule claims. The check is off when empty.
+	CorruptCategory string
+
+	WatchDebounce time.Duration // Quiet period after inbox activity before sorting (default 2s)
+	WatchRescan   time.Duration // Interval between full inbox re-scans in watch mode (default 10m)
+
+	// Schedule and ScheduleJitter are the timetable of RunOnSchedule and how
+	// late at most, at random, each of its runs starts
+	Schedule       *Schedule
+	ScheduleJitter time.Duration
+
+	// Events, when set, is called for every action taken on an inbox file
+	// (see Event), from one goroutine at a time
+	Events func(Event)
+
+	// BeforeRun, when set, is called at the start of every pass of Run. An
+	// error skips the pass, which fails with it.
+	BeforeRun func() error
+
+	// RunFinished, when set, is called at the end of every pass of Run with
+	// its result, once the pass's cleanup is done too; a watching Sorter
+	// calls it once per batch
+	RunFinished func(err error)
+
+	// Metrics, when set, counts the actions and runs (see Metrics)
+	Metrics *Metrics
+
+	// Tracer, when set, sends a trace of every sort or dedupe pass to an
+	// OpenTelemetry collector (see Tracer)
+	Tracer *Tracer
+
+	// Stop, when closed, ends a pass after the file in progress with
+	// ErrAborted. With CheckpointFile set, the pass records how far it got
+	// there, and the next pass skips the files already decided and reuses
+	// the hashes computed so far.
+	Stop           <-chan struct{}
+	CheckpointFile string
+
+	// Context, when set, cancels whatever the Sorter is doing once it is
+	// done: walks, hashing and copies stop midway, a half-made copy is
+	// removed, and the pass ends as with Stop, checkpoint included, with an
+	// error matching both ErrAborted and the context's error. Watch returns.
+	Context context.Context
+
+	// BandwidthLimit caps the bytes read per second for hashing and copying,
+	// and FilesPerSecond the files handled per second, so a scheduled run
+	// on a busy disk or NAS leaves room for its other users. Zero means no
+	// limit. Hashing done by a remote server isn't counted.
+	BandwidthLimit Size
+	FilesPerSecond float64
+
+	// IndexFile keeps the full hash of every sorted file, recorded by Index
+	// and checked by Verify
+	IndexFile string
+
+	// UnknownFile records the extensions no category claims, with how many
+	// files had them, for Suggest
+	UnknownFile string
+
+	// LockFile is taken by Lock to keep other runs away from the same
+	// directories (see Lock)
+	LockFile string
+
+	// Confirm, when set, is asked before every move with the file, where it
+	// would go and why ("sorted", "duplicate" or "rule"). Returning false
+	// leaves the file in place; an error (such as ErrAborted) stops the run.
+	Confirm func(src, dest, reason string) (bool, error)
+
+	Output io.Writer    // Where progress is reported (default os.Stdout)
+	Logger *slog.Logger // Where decisions are logged (default text to Output)
+}
+
+// Inbox is a directory sorted along with Options.InboxDir. Its exclusion
+// patterns replace the ones of Options when set.
+type Inbox struct {
+	Dir          string
+	ExcludeDirs  []string
+	ExcludeFiles []string
+}
+
+// Sorter sorts an inbox into a sorted tree
+type Sorter struct {
+	opts       Options
+	ctx        context.Context // Options.Context, or one never done, carrying the bandwidth limit
+	filePacer  *pacer          // Options.FilesPerSecond
+	tracker    *tracker        // What Status reports
+	classifier *Classifier
+	plugin     *plugin // Options.ClassifierCommand
+	modules    []*wasmPlugin
+	clamd      *clamd // Options.ClamdAddress
+	rules      *ruleSet
+	sidecars   map[string]bool // Options.Sidecars
+	units      []unitDir       // Folders the last walk found to move whole
+	hasher     Hasher
+	preserve   preserve
+	journal    *journal
+	out        io.Writer
+	log        *slog.Logger
+	unknown    *unknownExtensions // Collected by recordUnknown, saved after each pass
+	nextReady  time.Time          // When the inbox files left for being too new or busy are worth another look
+
+	// Dry-run state: nothing is touched on disk, planned moves are tracked
+	// instead so later decisions (name collisions, empty folders) match a real run
+	plannedDests map[string]bool // Destinations claimed by planned moves
+	plannedSrcs  map[string]bool // Inbox files that would be moved away
+	foldCase     func() bool     // Whether the sorted directory ignores case, probed on first use
+
+	mountIDs map[string]string // Filesystem of each local working directory, see checkMounts
+
+	failed   int   // Files that failed during the current pass
+	fileSpan *span // Trace span of the inbox file in progress, if it has one
+
+	reloaded atomic.Pointer[reloaded] // Settings passed to Reload, applied by the next pass
+}
+
+// New validates the options, fills in defaults and returns a Sorter
+func New(opts Options) (*Sorter, error) {
+	if opts.InboxDir == "" || opts.SortedDir == "" || opts.DeleteDir == "" {
+		return nil, &ConfigError{errors.New("inbox, sorted and delete directories are required")}
+	}
+	// Remote directories are mounted. On Windows, deep category trees and
+	// long download names easily go past MAX_PATH, so every local path is
+	// built on extended-length roots.
+	for _, dir := range []*string{&opts.InboxDir, &opts.SortedDir, &opts.DeleteDir} {
+		mounted, err := mountDir(*dir, opts)
+		if err != nil {
+			return nil, &ConfigError{err}
+		}
+		*dir = mounted
+	}
+	// Sorted files found again in the inbox would be taken for duplicates
+	// of themselves
+	for _, pair := range [][2]string{{opts.InboxDir, opts.SortedDir}, {opts.InboxDir, opts.DeleteDir}, {opts.SortedDir, opts.DeleteDir}} {
+		if nested(pair[0], pair[1]) || nested(pair[1], pair[0]) {
+			return nil, &ConfigError{fmt.Errorf("%s overlaps %s", pair[0], pair[1])}
+		}
+	}
+	opts.Inboxes = slices.Clone(opts.Inboxes)
+	for i, inbox := range opts.Inboxes {
+		if inbox.Dir == "" {
+			return nil, &ConfigError{errors.New("inbox directory is required")}
+		}
+		mounted, err := mountDir(inbox.Dir, opts)
+		if err != nil {
+			return nil, &ConfigError{err}
+		}
+		inbox.Dir = mounted
+		// A file in two inboxes at once would be sorted twice
+		for _, dir := range []string{opts.InboxDir, opts.SortedDir, opts.DeleteDir} {
+			if nested(inbox.Dir, dir) || nested(dir, inbox.Dir) {
+				return nil, &ConfigError{fmt.Errorf("inbox %s overlaps %s", inbox.Dir, dir)}
+			}
+		}
+		for _, other := range opts.Inboxes[:i] {
+			if nested(inbox.Dir, other.Dir) || nested(other.Dir, inbox.Dir) {
+				return nil, &ConfigError{fmt.Errorf("inbox %s overlaps %s", inbox.Dir, other.Dir)}
+			}
+		}
+		opts.Inboxes[i] = inbox
+	}
+	if opts.ExtractArchives {
+		if opts.StagingDir == "" || opts.ExtractedDir == "" {
+			return nil, &ConfigError{errors.New("staging and extracted directories are required to extract archives")}
+		}
+		for _, dir := range []*string{&opts.StagingDir, &opts.ExtractedDir} {
+			mounted, err := mountDir(*dir, opts)
+			if err != nil {
+				return nil, &ConfigError{err}
+			}
+			*dir = mounted
+		}
+		// Archives moved back into an inbox would be unpacked again, and
+		// purge and restore would reach into them in the delete directory
+		dirs := []string{opts.InboxDir, opts.SortedDir, opts.DeleteDir}
+		for _, inbox := range opts.Inboxes {
+			dirs = append(dirs, inbox.Dir)
+		}
+		for _, extractDir := range []string{opts.StagingDir, opts.ExtractedDir} {
+			for _, dir := range dirs {
+				if nested(extractDir, dir) || nested(dir, extractDir) {
+					return nil, &ConfigError{fmt.Errorf("%s overlaps %s", extractDir, dir)}
+				}
+			}
+		}
+	}
+	if opts.Workers == 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.Workers < 1 {
+		return nil, &ConfigError{fmt.Errorf("invalid worker count %d: must be at least 1", opts.Workers)}
+	}
+	if opts.HashAlgorithm == "" {
+		opts.HashAlgorithm = DefaultHashAlgorithm
+	}
+	hasher, err := lookupHasher(opts.HashAlgorithm)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+	preserve, err := parsePreserve(opts.Preserve)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+	sidecars, err := sidecarSet(opts.Sidecars)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+	if opts.MinSize < 0 || opts.MaxSize < 0 || (opts.MaxSize != 0 && opts.MaxSize < opts.MinSize) {
+		return nil, &ConfigError{fmt.Errorf("invalid size limits %d to %d", opts.MinSize, opts.MaxSize)}
+	}
+	if opts.MinAge < 0 {
+		return nil, &ConfigError{fmt.Errorf("invalid minimum age %s", opts.MinAge)}
+	}
+	if opts.StableWait < 0 {
+		return nil, &ConfigError{fmt.Errorf("invalid stability wait %s", opts.StableWait)}
+	}
+	if opts.Trash && (isRemote(opts.InboxDir) || isRemote(opts.SortedDir) || slices.ContainsFunc(opts.Inboxes, func(inbox Inbox) bool { return isRemote(inbox.Dir) })) {
+		return nil, &ConfigError{errors.New("the trash only takes local files, use a delete directory with remote inboxes")}
+	}
+	if opts.SecureWipe && isRemote(opts.DeleteDir) {
+		return nil, &ConfigError{errors.New("secure wipe needs a local delete directory")}
+	}
+	if opts.NameTemplate == "" {
+		opts.NameTemplate = DefaultNameTemplate
+	}
+	if opts.DeleteTemplate == "" {
+		opts.DeleteTemplate = DefaultDeleteTemplate
+	}
+	if opts.CollisionPolicy == "" {
+		opts.CollisionPolicy = CollisionSuffixHash
+	}
+	if !slices.Contains(CollisionPolicies, opts.CollisionPolicy) {
+		return nil, &ConfigError{fmt.Errorf("invalid collision policy %q: must be one of %s", opts.CollisionPolicy, strings.Join(CollisionPolicies, ", "))}
+	}
+	if opts.Replacement == "" {
+		opts.Replacement = DefaultReplacement
+	}
+	if err := checkReplacement(opts.Replacement); err != nil {
+		return nil, &ConfigError{err}
+	}
+	if opts.Normalization == "" {
+		opts.Normalization = NormalizeNFC
+	}
+	if err := checkNormalization(opts.Normalization); err != nil {
+		return nil, &ConfigError{err}
+	}
+	if opts.WatchDebounce == 0 {
+		opts.WatchDebounce = 2 * time.Second
+	}
+	if opts.WatchRescan == 0 {
+		opts.WatchRescan = 10 * time.Minute
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(opts.Output, nil))
+	}
+	logger := opts.Logger
+	if opts.DryRun {
+		logger = logger.With("dry_run", true)
+	}
+
+	if opts.UnknownCategory == "" {
+		opts.UnknownCategory = DefaultUnknownCategory
+	}
+	if opts.NoExtensionCategory == "" {
+		opts.NoExtensionCategory = opts.UnknownCategory
+	}
+	classifier, rules, err := compileSettings(Settings{Categories: opts.Categories, Rules: opts.Rules}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MalwareCategory == "" {
+		opts.MalwareCategory = DefaultMalwareCategory
+	}
+	if !filepath.IsLocal(filepath.FromSlash(opts.MalwareCategory)) {
+		return nil, &ConfigError{fmt.Errorf("invalid malware category %q: must be a relative path", opts.MalwareCategory)}
+	}
+	if c := opts.EncryptedCategory; c != "" && c != LeaveInInbox && !filepath.IsLocal(filepath.FromSlash(c)) {
+		return nil, &ConfigError{fmt.Errorf("invalid encrypted category %q: must be a relative path", c)}
+	}
+	if opts.CorruptCategory != "" && !filepath.IsLocal(filepath.FromSlash(opts.CorruptCategory)) {
+		return nil, &ConfigError{fmt.Errorf("invalid corrupt category %q: must be a relative path", opts.CorruptCategory)}
+	}
+	if opts.Quarantine != nil {
+		if err := opts.Quarantine.validate(); err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+	if c := opts.ProjectCategory; c != "" && c != LeaveInInbox && !filepath.IsLocal(filepath.FromSlash(c)) {
+		return nil, &ConfigError{fmt.Errorf("invalid project category %q: must be a relative path", c)}
+	}
+	if opts.Units != nil {
+		if err := opts.Units.validate(); err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+	var scanner *clamd
+	if opts.ClamdAddress != "" {
+		if scanner, err = newClamd(opts.ClamdAddress); err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+
+	if opts.ClassifierHead < 0 {
+		return nil, &ConfigError{fmt.Errorf("invalid classifier head size %d", opts.ClassifierHead)}
+	}
+
+	if opts.BandwidthLimit < 0 || opts.FilesPerSecond < 0 {
+		return nil, &ConfigError{fmt.Errorf("invalid throttle %d bytes and %g files per second", opts.BandwidthLimit, opts.FilesPerSecond)}
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = withBandwidth(ctx, newPacer(float64(opts.BandwidthLimit)))
+	tracker := &tracker{reading: make(map[string]time.Time)}
+	tracker.touch()
+	ctx = withTracker(ctx, tracker)
+	s := &Sorter{
+		opts:         opts,
+		ctx:          ctx,
+		filePacer:    newPacer(opts.FilesPerSecond),
+		tracker:      tracker,
+		rules:        rules,
+		hasher:       hasher,
+		preserve:     preserve,
+		sidecars:     sidecars,
+		classifier:   classifier,
+		out:          opts.Output,
+		log:          logger,
+		plannedDests: make(map[string]bool),
+		plannedSrcs:  make(map[string]bool),
+		clamd:        scanner,
+	}
+	for _, module := range opts.ClassifierModules {
+		s.modules = append(s.modules, &wasmPlugin{module: module, head: opts.ClassifierHead, log: logger})
+	}
+	if len(opts.ClassifierCommand) > 0 {
+		s.plugin = &plugin{command: opts.ClassifierCommand, head: opts.ClassifierHead, log: logger}
+	}
+	s.foldCase = sync.OnceValue(func() bool { return caseInsensitive(s.opts.SortedDir) })
+	s.journal = &journal{dir: opts.JournalDir, dryRun: opts.DryRun, log: logger}
+	s.checkMounts()
+	return s, nil
+}
+
+// printf reports progress to the configured output
+func (s *Sorter) printf(format string, args ...any) {
+	fmt.Fprintf(s.out, format, args...)
+}
+
+// EnsureDirs makes sure every working directory exists (creating it if
+// needed) before any walking starts. Options.Inboxes are left alone.
+func (s *Sorter) EnsureDirs() error {
+	dirs := []string{s.opts.InboxDir, s.opts.SortedDir, s.opts.DeleteDir}
+	if s.opts.ExtractArchives {
+		dirs = append(dirs, s.opts.StagingDir, s.opts.ExtractedDir)
+	}
+	for _, dir := range dirs {
+		st := storageAt(dir)
+		info, err := st.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return &ConfigError{fmt.Errorf("%s exists but is not a directory", dir)}
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return &ConfigError{fmt.Errorf("cannot access %s: %w", dir, err)}
+		}
+		if s.opts.DryRun {
+			s.log.Info("Would create directory", "dir", dir)
+			continue
+		}
+		if err := st.MkdirAll(dir); err != nil {
+			return &ConfigError{fmt.Errorf("cannot create %s: %w", dir, err)}
+		}
+	}
+	return nil
+}
+
+// Run performs a single sorting pass over the inbox and cleans up the
+// folders it emptied. A *PartialError is returned when some files could not
+// be processed.
+func (s *Sorter) Run() error {
+	if s.opts.DryRun {
+		// Every pass plans against the untouched disk state
+		clear(s.plannedDests)
+		clear(s.plannedSrcs)
+	}
+	defer s.journal.close()
+	s.applyReload()
+
+	s.setRunning(true)
+	defer s.setRunning(false)
+	s.opts.Metrics.runStarted()
+	var sortErr error
+	if s.opts.BeforeRun != nil {
+		sortErr = s.opts.BeforeRun()
+	}
+	if sortErr == nil {
+		sortErr = s.Sort()
+	}
+	s.opts.Metrics.runFinished(sortErr)
+	s.saveUnknownExtensions()
+	var partial *PartialError
+	if errors.Is(sortErr, ErrAborted) {
+		s.log.Info("Sorting aborted")
+	} else if errors.As(sortErr, &partial) {
+		s.log.Warn("File sorting completed with failures", "failed", partial.Failed)
+	} else if sortErr != nil {
+		s.log.Error("Sorting failed", "err", sortErr)
+	} else {
+		s.log.Info("File sorting completed successfully")
+	}
+	for _, inbox := range s.existingInboxes() {
+		if err := s.RemoveEmptyDirs(inbox.Dir); err != nil {
+			s.log.Error("Failed to clean empty folders", "err", err)
+		}
+	}
+	if s.opts.Retention > 0 && sortErr == nil {
+		if _, err := s.Purge(s.opts.Retention); err != nil {
+			s.log.Error("Failed to purge delete folder", "err", err)
+		}
+	}
+	if s.opts.RunFinished != nil {
+		s.opts.RunFinished(sortErr)
+	}
+	return sortErr
+}
+
+// CleanEmpty removes the empty folders left in the inboxes
+func (s *Sorter) CleanEmpty() error {
+	defer s.journal.close()
+	for _, inbox := range s.existingInboxes() {
+		if err := s.RemoveEmptyDirs(inbox.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inboxes returns InboxDir followed by the other inboxes, with the
+// exclusion patterns that apply to each. The staging directory of extracted
+// archives is one of them.
+func (s *Sorter) inboxes() []Inbox {
+	inboxes := []Inbox{{Dir: s.opts.InboxDir, ExcludeDirs: s.opts.ExcludeDirs, ExcludeFiles: s.opts.ExcludeFiles}}
+	if s.opts.ExtractArchives {
+		inboxes = append(inboxes, Inbox{Dir: s.opts.StagingDir})
+	}
+	for _, inbox := range s.opts.Inboxes {
+		if inbox.ExcludeDirs == nil {
+			inbox.ExcludeDirs = s.opts.ExcludeDirs
+		}
+		if inbox.ExcludeFiles == nil {
+			inbox.ExcludeFiles = s.opts.ExcludeFiles
+		}
+		inboxes = append(inboxes, inbox)
+	}
+	return inboxes
+}
+
+// existingInboxes returns the inboxes that are there. InboxDir only goes
+// missing in dry runs, which don't create it.
+func (s *Sorter) existingInboxes() []Inbox {
+	var inboxes []Inbox
+	for _, inbox := range s.inboxes() {
+		if info, err := storageAt(inbox.Dir).Stat(inbox.Dir); err == nil && info.IsDir() {
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return inboxes
+}
+
+// inInbox reports whether path lies in one of the inboxes
+func (s *Sorter) inInbox(path string) bool {
+	for _, inbox := range s.inboxes() {
+		if nested(path, inbox.Dir) {
+			return true
+		}
+	}
+	return false
+}
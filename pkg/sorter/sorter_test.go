@@ -0,0 +1,31 @@
+package sorter
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractDirOverlap(t *testing.T) {
+	root := t.TempDir()
+	opts := Options{
+		InboxDir:        filepath.Join(root, "inbox"),
+		SortedDir:       filepath.Join(root, "sorted"),
+		DeleteDir:       filepath.Join(root, "delete"),
+		ExtractArchives: true,
+		ExtractedDir:    filepath.Join(root, "extracted"),
+		Output:          io.Discard,
+	}
+	for _, staging := range []string{filepath.Join(root, "inbox", "staging"), filepath.Join(root, "delete", "staging"), root} {
+		opts.StagingDir = staging
+		var configErr *ConfigError
+		if _, err := New(opts); !errors.As(err, &configErr) {
+			t.Errorf("New with staging %s = %v, want a ConfigError", staging, err)
+		}
+	}
+	opts.StagingDir = filepath.Join(root, "staging")
+	if _, err := New(opts); err != nil {
+		t.Errorf("New with staging apart: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package sorter
+
+import "time"
+
+// settle drops the inbox files that are still being written: those whose
+// size or modification time changes within Options.StableWait and, where
+// the platform tells, those another process has open for writing. All files
+// share the one wait, so it costs the same however many there are.
+func (s *Sorter) settle(candidates []*indexedFile) []*indexedFile {
+	if s.opts.StableWait == 0 || len(candidates) == 0 {
+		return candidates
+	}
+	s.log.Debug("Waiting for inbox files to settle", "files", len(candidates), "wait", s.opts.StableWait)
+	select {
+	case <-time.After(s.opts.StableWait):
+	case <-s.opts.Stop:
+		return candidates // The pass stops before the first file anyway
+	case <-s.ctx.Done():
+		return candidates
+	}
+
+	inUse := openForWriting()
+	stable := candidates[:0]
+	for _, file := range candidates {
+		info, err := storageAt(file.path).Stat(file.path)
+		switch {
+		case err != nil:
+			s.log.Debug("Inbox file disappeared", "path", file.path, "err", err)
+			continue
+		case info.Size() != file.size || !info.ModTime().Equal(file.modTime):
+			s.log.Info("Skipping file still being written", "path", file.path, "size", info.Size())
+			s.emit(Event{Type: EventSkipped, Path: file.path, Size: info.Size(), Reason: "unstable"})
+		case !isRemote(file.path) && inUse(file.path):
+			s.log.Info("Skipping file open for writing", "path", file.path)
+			s.emit(Event{Type: EventSkipped, Path: file.path, Size: info.Size(), Reason: "in-use"})
+		default:
+			stable = append(stable, file)
+			continue
+		}
+		// Look again once the writer had time to finish
+		if ready := time.Now().Add(s.opts.StableWait); s.nextReady.IsZero() || ready.Before(s.nextReady) {
+			s.nextReady = ready
+		}
+	}
+	return stable
+}
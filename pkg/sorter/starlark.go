@@ -0,0 +1,2295 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A small interpreter for the part of Starlark (a Python dialect) rules
+// scripts need: def, if/elif/else, for, return, break, continue and pass;
+// None, booleans, ints, floats, strings, lists, tuples and dicts; the usual
+// operators, conditional expressions, list comprehensions and % formatting;
+// and the common builtins and string, list and dict methods. There is no
+// while, lambda, load or set, and dict keys must be None, booleans,
+// numbers or strings. Globals are frozen once the script has run, and each
+// call gets a step budget, so a script can neither keep state between files
+// nor hang the sorter. Strings, lists and tuples are capped in length, and
+// ints are 64-bit with overflow an error, so it can't run it out of memory
+// either.
+
+// Limits of a single call into a script
+const (
+	starMaxSteps = 1_000_000
+	starMaxDepth = 100
+	starMaxRange = 1_000_000
+	starMaxLen   = 1_000_000 // Bytes of a string, elements of a list or tuple
+)
+
+type starTokenKind int
+
+const (
+	tokEOF starTokenKind = iota
+	tokNewline
+	tokIndent
+	tokDedent
+	tokName
+	tokInt
+	tokFloat
+	tokString
+	tokOp
+)
+
+type starToken struct {
+	kind starTokenKind
+	text string // Name or operator
+	val  any    // Value of a literal
+	line int
+}
+
+// Operators, longest first
+var starOps = []string{
+	"//=", "==", "!=", "<=", ">=", "+=", "-=", "*=", "/=", "%=", "//",
+	"+", "-", "*", "/", "%", "<", ">", "=", "(", ")", "[", "]", "{", "}", ",", ":", ".", ";",
+}
+
+var starKeywords = map[string]bool{
+	"and": true, "break": true, "continue": true, "def": true, "elif": true, "else": true,
+	"for": true, "if": true, "in": true, "not": true, "or": true, "pass": true, "return": true,
+	"lambda": true, "load": true, "while": true,
+}
+
+func isStarNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isStarDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// lexStarlark splits a script into tokens, with INDENT and DEDENT tokens
+// marking blocks as in Python
+func lexStarlark(src string) ([]starToken, error) {
+	var toks []starToken
+	indents := []int{0}
+	depth := 0 // Open brackets, inside which lines join
+	line := 1
+	lineStart := true
+	emit := func(kind starTokenKind, text string, val any) {
+		toks = append(toks, starToken{kind, text, val, line})
+	}
+
+	for i := 0; i < len(src); {
+		if lineStart && depth == 0 {
+			col, j := 0, i
+			for ; j < len(src) && (src[j] == ' ' || src[j] == '\t'); j++ {
+				if src[j] == '\t' {
+					col += 8 - col%8
+				} else {
+					col++
+				}
+			}
+			if j == len(src) {
+				break
+			}
+			if src[j] == '\n' || src[j] == '\r' || src[j] == '#' {
+				// Blank and comment lines don't count
+				for j < len(src) && src[j] != '\n' {
+					j++
+				}
+				if j < len(src) {
+					j++
+					line++
+				}
+				i = j
+				continue
+			}
+			i, lineStart = j, false
+			if top := indents[len(indents)-1]; col > top {
+				indents = append(indents, col)
+				emit(tokIndent, "", nil)
+			} else if col < top {
+				for col < indents[len(indents)-1] {
+					indents = indents[:len(indents)-1]
+					emit(tokDedent, "", nil)
+				}
+				if col != indents[len(indents)-1] {
+					return nil, lineErrorf(line, "unindent does not match any outer indentation level")
+				}
+			}
+			continue
+		}
+
+		c := src[i]
+		switch {
+		case c == '\n':
+			if depth == 0 {
+				emit(tokNewline, "", nil)
+				lineStart = true
+			}
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '\\' && strings.HasPrefix(src[i+1:], "\n"):
+			i += 2
+			line++
+		case c == '"' || c == '\'' || (c == 'r' || c == 'R') && i+1 < len(src) && (src[i+1] == '"' || src[i+1] == '\''):
+			raw := c == 'r' || c == 'R'
+			if raw {
+				i++
+			}
+			s, n, lines, err := lexStarString(src[i:], raw)
+			if err != nil {
+				return nil, lineErrorf(line, "%v", err)
+			}
+			emit(tokString, "", s)
+			i += n
+			line += lines
+		case isStarNameStart(c):
+			j := i
+			for j < len(src) && (isStarNameStart(src[j]) || isStarDigit(src[j])) {
+				j++
+			}
+			emit(tokName, src[i:j], nil)
+			i = j
+		case isStarDigit(c) || c == '.' && i+1 < len(src) && isStarDigit(src[i+1]):
+			j := i
+			for j < len(src) && (isStarNameStart(src[j]) || isStarDigit(src[j]) || src[j] == '.' ||
+				(src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E') && !strings.HasPrefix(src[i:], "0x")) {
+				j++
+			}
+			text := src[i:j]
+			if n, err := strconv.ParseInt(text, 0, 64); err == nil {
+				emit(tokInt, text, int(n))
+			} else if f, err := strconv.ParseFloat(text, 64); err == nil && !strings.HasPrefix(text, "0x") {
+				emit(tokFloat, text, f)
+			} else {
+				return nil, lineErrorf(line, "invalid number %q", text)
+			}
+			i = j
+		default:
+			op := ""
+			for _, candidate := range starOps {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				r, _ := utf8.DecodeRuneInString(src[i:])
+				return nil, lineErrorf(line, "unexpected character %q", r)
+			}
+			switch op {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+			emit(tokOp, op, nil)
+			i += len(op)
+		}
+	}
+	if depth > 0 {
+		return nil, lineErrorf(line, "unclosed bracket")
+	}
+	if !lineStart {
+		emit(tokNewline, "", nil)
+	}
+	for len(indents) > 1 {
+		indents = indents[:len(indents)-1]
+		emit(tokDedent, "", nil)
+	}
+	emit(tokEOF, "", nil)
+	return toks, nil
+}
+
+// lexStarString reads the string literal s starts with, returning its value,
+// its length in the source and the line breaks it spans
+func lexStarString(s string, raw bool) (value string, n, lines int, err error) {
+	quote := s[:1]
+	if strings.HasPrefix(s, quote+quote+quote) {
+		quote = s[:3]
+	}
+	var b strings.Builder
+	for i := len(quote); i < len(s); {
+		if strings.HasPrefix(s[i:], quote) {
+			return b.String(), i + len(quote), lines, nil
+		}
+		c := s[i]
+		switch {
+		case c == '\n' && len(quote) == 1:
+			return "", 0, 0, fmt.Errorf("unterminated string")
+		case c == '\n':
+			lines++
+		case c == '\\' && i+1 < len(s):
+			e := s[i+1]
+			if e == '\n' {
+				lines++
+			}
+			if raw {
+				b.WriteByte(c)
+				b.WriteByte(e)
+				i += 2
+				continue
+			}
+			i += 2
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case '\\', '\'', '"':
+				b.WriteByte(e)
+			case '\n':
+			case 'x', 'u', 'U':
+				size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+				if i+size > len(s) {
+					return "", 0, 0, fmt.Errorf("invalid escape \\%c", e)
+				}
+				code, err := strconv.ParseUint(s[i:i+size], 16, 32)
+				if err != nil {
+					return "", 0, 0, fmt.Errorf("invalid escape \\%c%s", e, s[i:i+size])
+				}
+				if e == 'x' {
+					b.WriteByte(byte(code))
+				} else {
+					b.WriteRune(rune(code))
+				}
+				i += size
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+			continue
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return "", 0, 0, fmt.Errorf("unterminated string")
+}
+
+// Statements
+type (
+	starStmt interface{}
+
+	defStmt struct {
+		line   int
+		name   string
+		params []starParam
+		body   []starStmt
+	}
+	returnStmt struct {
+		line  int
+		value starExpr // nil for None
+	}
+	ifStmt struct {
+		line      int
+		cond      starExpr
+		then, els []starStmt
+	}
+	forStmt struct {
+		line int
+		vars []string
+		iter starExpr
+		body []starStmt
+	}
+	branchStmt struct {
+		line int
+		kind string // break, continue or pass
+	}
+	assignStmt struct {
+		line   int
+		target starExpr
+		op     string // "=" or an augmented assignment such as "+="
+		value  starExpr
+	}
+	exprStmt struct {
+		line int
+		x    starExpr
+	}
+)
+
+type starParam struct {
+	name string
+	def  starExpr // Default value, if any
+}
+
+// Expressions
+type (
+	starExpr interface{}
+
+	identExpr struct {
+		line int
+		name string
+	}
+	literalExpr struct {
+		line  int
+		value any
+	}
+	listExpr struct {
+		line  int
+		elems []starExpr
+	}
+	tupleExpr struct {
+		line  int
+		elems []starExpr
+	}
+	dictExpr struct {
+		line         int
+		keys, values []starExpr
+	}
+	compExpr struct { // [body for vars in iter if cond]
+		line int
+		body starExpr
+		vars []string
+		iter starExpr
+		cond starExpr
+	}
+	unaryExpr struct {
+		line int
+		op   string
+		x    starExpr
+	}
+	binaryExpr struct {
+		line int
+		op   string
+		x, y starExpr
+	}
+	condExpr struct {
+		line            int
+		cond, then, els starExpr
+	}
+	callExpr struct {
+		line  int
+		fn    starExpr
+		args  []starExpr
+		names []string // Keyword of each argument, empty for positional ones
+	}
+	indexExpr struct {
+		line     int
+		x, index starExpr
+	}
+	sliceExpr struct {
+		line      int
+		x, lo, hi starExpr
+	}
+	dotExpr struct {
+		line int
+		x    starExpr
+		name string
+	}
+)
+
+type starParser struct {
+	toks []starToken
+	pos  int
+}
+
+// parseStarlark parses a script into its statements
+func parseStarlark(src string) ([]starStmt, error) {
+	toks, err := lexStarlark(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &starParser{toks: toks}
+	var stmts []starStmt
+	for p.peek().kind != tokEOF {
+		stmt, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt...)
+	}
+	return stmts, nil
+}
+
+func (p *starParser) peek() starToken { return p.toks[p.pos] }
+
+func (p *starParser) next() starToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *starParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *starParser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokName && t.text == word
+}
+
+func (p *starParser) errorf(format string, args ...any) error {
+	return lineErrorf(p.peek().line, format, args...)
+}
+
+func (p *starParser) expectOp(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected %s, found %s", op, p.describe())
+	}
+	p.next()
+	return nil
+}
+
+func (p *starParser) expectKeyword(word string) error {
+	if !p.isKeyword(word) {
+		return p.errorf("expected %s, found %s", word, p.describe())
+	}
+	p.next()
+	return nil
+}
+
+// describe names the next token in errors
+func (p *starParser) describe() string {
+	switch t := p.peek(); t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokNewline:
+		return "end of line"
+	case tokIndent:
+		return "indentation"
+	case tokDedent:
+		return "end of block"
+	case tokString:
+		return "string"
+	case tokInt, tokFloat:
+		return "number " + t.text
+	default:
+		return strconv.Quote(t.text)
+	}
+}
+
+func (p *starParser) name() (string, error) {
+	t := p.peek()
+	if t.kind != tokName || starKeywords[t.text] {
+		return "", p.errorf("expected a name, found %s", p.describe())
+	}
+	p.next()
+	return t.text, nil
+}
+
+func (p *starParser) parseStmt() ([]starStmt, error) {
+	t := p.peek()
+	if t.kind == tokIndent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	if t.kind == tokName {
+		switch t.text {
+		case "def":
+			stmt, err := p.parseDef()
+			return []starStmt{stmt}, err
+		case "if":
+			p.next()
+			stmt, err := p.parseIf(t.line)
+			return []starStmt{stmt}, err
+		case "for":
+			stmt, err := p.parseFor()
+			return []starStmt{stmt}, err
+		case "while", "lambda", "load":
+			return nil, p.errorf("%s is not supported", t.text)
+		}
+	}
+	return p.parseSimpleStmts()
+}
+
+func (p *starParser) parseDef() (starStmt, error) {
+	line := p.next().line
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	var params []starParam
+	for !p.isOp(")") {
+		param, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		var def starExpr
+		if p.isOp("=") {
+			p.next()
+			if def, err = p.parseTest(); err != nil {
+				return nil, err
+			}
+		} else if len(params) > 0 && params[len(params)-1].def != nil {
+			return nil, p.errorf("parameter %s without a default follows one with a default", param)
+		}
+		params = append(params, starParam{param, def})
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseSuite()
+	if err != nil {
+		return nil, err
+	}
+	return &defStmt{line, name, params, body}, nil
+}
+
+// parseIf parses an if statement after its if or elif keyword
+func (p *starParser) parseIf(line int) (starStmt, error) {
+	cond, err := p.parseTest()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.parseSuite()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &ifStmt{line: line, cond: cond, then: then}
+	switch {
+	case p.isKeyword("elif"):
+		elif, err := p.parseIf(p.next().line)
+		if err != nil {
+			return nil, err
+		}
+		stmt.els = []starStmt{elif}
+	case p.isKeyword("else"):
+		p.next()
+		if stmt.els, err = p.parseSuite(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *starParser) parseFor() (starStmt, error) {
+	line := p.next().line
+	vars, err := p.parseLoopVars()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := p.parseExprList()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseSuite()
+	if err != nil {
+		return nil, err
+	}
+	return &forStmt{line, vars, iter, body}, nil
+}
+
+// parseLoopVars parses the variables of a for loop or comprehension, up
+// to and including in
+func (p *starParser) parseLoopVars() ([]string, error) {
+	parens := p.isOp("(")
+	if parens {
+		p.next()
+	}
+	var vars []string
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, name)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if parens {
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+	return vars, p.expectKeyword("in")
+}
+
+// parseSuite parses the block after a colon: statements on the same line,
+// or an indented block on the next ones
+func (p *starParser) parseSuite() ([]starStmt, error) {
+	if err := p.expectOp(":"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokNewline {
+		return p.parseSimpleStmts()
+	}
+	p.next()
+	if p.peek().kind != tokIndent {
+		return nil, p.errorf("expected an indented block")
+	}
+	p.next()
+	var stmts []starStmt
+	for p.peek().kind != tokDedent && p.peek().kind != tokEOF {
+		stmt, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt...)
+	}
+	p.next()
+	return stmts, nil
+}
+
+func (p *starParser) parseSimpleStmts() ([]starStmt, error) {
+	var stmts []starStmt
+	for {
+		stmt, err := p.parseSmallStmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if !p.isOp(";") {
+			break
+		}
+		p.next()
+		if p.peek().kind == tokNewline {
+			break
+		}
+	}
+	if t := p.peek(); t.kind != tokNewline && t.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	p.next()
+	return stmts, nil
+}
+
+func (p *starParser) parseSmallStmt() (starStmt, error) {
+	t := p.peek()
+	if t.kind == tokName {
+		switch t.text {
+		case "return":
+			p.next()
+			if next := p.peek(); next.kind == tokNewline || next.kind == tokEOF || p.isOp(";") {
+				return &returnStmt{t.line, nil}, nil
+			}
+			value, err := p.parseExprList()
+			return &returnStmt{t.line, value}, err
+		case "break", "continue", "pass":
+			p.next()
+			return &branchStmt{t.line, t.text}, nil
+		}
+	}
+
+	x, err := p.parseExprList()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	if op.kind != tokOp || op.text != "=" && !strings.HasSuffix(op.text, "=") || op.text == "==" || op.text == "!=" || op.text == "<=" || op.text == ">=" {
+		return &exprStmt{t.line, x}, nil
+	}
+	p.next()
+	if err := checkStarTarget(x, op.text == "="); err != nil {
+		return nil, lineErrorf(t.line, "%v", err)
+	}
+	value, err := p.parseExprList()
+	if err != nil {
+		return nil, err
+	}
+	return &assignStmt{t.line, x, op.text, value}, nil
+}
+
+// checkStarTarget checks what an assignment assigns to: a name, an index,
+// or, for plain assignments, a tuple or list of them
+func checkStarTarget(x starExpr, unpack bool) error {
+	switch x := x.(type) {
+	case *identExpr, *indexExpr:
+		return nil
+	case *tupleExpr:
+		if unpack {
+			for _, elem := range x.elems {
+				if err := checkStarTarget(elem, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case *listExpr:
+		if unpack {
+			for _, elem := range x.elems {
+				if err := checkStarTarget(elem, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot assign to this expression")
+}
+
+// parseExprList parses expressions separated by commas, a tuple if there
+// are several
+func (p *starParser) parseExprList() (starExpr, error) {
+	line := p.peek().line
+	x, err := p.parseTest()
+	if err != nil || !p.isOp(",") {
+		return x, err
+	}
+	elems := []starExpr{x}
+	for p.isOp(",") {
+		p.next()
+		if t := p.peek(); t.kind == tokNewline || t.kind == tokEOF || t.kind == tokOp && (t.text == "=" || t.text == ")" || t.text == ":" || t.text == ";") {
+			break
+		}
+		x, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, x)
+	}
+	return &tupleExpr{line, elems}, nil
+}
+
+// parseTest parses an expression, conditional expressions included
+func (p *starParser) parseTest() (starExpr, error) {
+	x, err := p.parseOr()
+	if err != nil || !p.isKeyword("if") {
+		return x, err
+	}
+	line := p.next().line
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("else"); err != nil {
+		return nil, err
+	}
+	els, err := p.parseTest()
+	if err != nil {
+		return nil, err
+	}
+	return &condExpr{line, cond, x, els}, nil
+}
+
+func (p *starParser) parseOr() (starExpr, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.isKeyword("or") {
+		line := p.next().line
+		var y starExpr
+		y, err = p.parseAnd()
+		x = &binaryExpr{line, "or", x, y}
+	}
+	return x, err
+}
+
+func (p *starParser) parseAnd() (starExpr, error) {
+	x, err := p.parseNot()
+	for err == nil && p.isKeyword("and") {
+		line := p.next().line
+		var y starExpr
+		y, err = p.parseNot()
+		x = &binaryExpr{line, "and", x, y}
+	}
+	return x, err
+}
+
+func (p *starParser) parseNot() (starExpr, error) {
+	if p.isKeyword("not") {
+		line := p.next().line
+		x, err := p.parseNot()
+		return &unaryExpr{line, "not", x}, err
+	}
+	return p.parseComparison()
+}
+
+func (p *starParser) parseComparison() (starExpr, error) {
+	x, err := p.parseArith()
+	for err == nil {
+		t := p.peek()
+		var op string
+		switch {
+		case t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == ">" || t.text == "<=" || t.text == ">="):
+			op = t.text
+			p.next()
+		case p.isKeyword("in"):
+			op = "in"
+			p.next()
+		case p.isKeyword("not") && p.toks[p.pos+1].kind == tokName && p.toks[p.pos+1].text == "in":
+			op = "not in"
+			p.pos += 2
+		default:
+			return x, nil
+		}
+		var y starExpr
+		y, err = p.parseArith()
+		x = &binaryExpr{t.line, op, x, y}
+	}
+	return x, err
+}
+
+func (p *starParser) parseArith() (starExpr, error) {
+	x, err := p.parseTerm()
+	for err == nil && (p.isOp("+") || p.isOp("-")) {
+		t := p.next()
+		var y starExpr
+		y, err = p.parseTerm()
+		x = &binaryExpr{t.line, t.text, x, y}
+	}
+	return x, err
+}
+
+func (p *starParser) parseTerm() (starExpr, error) {
+	x, err := p.parseUnary()
+	for err == nil && (p.isOp("*") || p.isOp("/") || p.isOp("//") || p.isOp("%")) {
+		t := p.next()
+		var y starExpr
+		y, err = p.parseUnary()
+		x = &binaryExpr{t.line, t.text, x, y}
+	}
+	return x, err
+}
+
+func (p *starParser) parseUnary() (starExpr, error) {
+	if p.isOp("-") || p.isOp("+") {
+		t := p.next()
+		x, err := p.parseUnary()
+		return &unaryExpr{t.line, t.text, x}, err
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses an operand followed by attribute accesses, indexes,
+// slices and calls
+func (p *starParser) parsePrimary() (starExpr, error) {
+	x, err := p.parseOperand()
+	for err == nil {
+		t := p.peek()
+		switch {
+		case p.isOp("."):
+			p.next()
+			var name string
+			if name, err = p.name(); err == nil {
+				x = &dotExpr{t.line, x, name}
+			}
+		case p.isOp("["):
+			p.next()
+			x, err = p.parseIndex(x, t.line)
+		case p.isOp("("):
+			p.next()
+			x, err = p.parseCall(x, t.line)
+		default:
+			return x, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *starParser) parseIndex(x starExpr, line int) (starExpr, error) {
+	var lo, hi starExpr
+	var err error
+	if !p.isOp(":") {
+		if lo, err = p.parseTest(); err != nil {
+			return nil, err
+		}
+		if p.isOp("]") {
+			p.next()
+			return &indexExpr{line, x, lo}, nil
+		}
+	}
+	if err := p.expectOp(":"); err != nil {
+		return nil, err
+	}
+	if !p.isOp("]") {
+		if hi, err = p.parseTest(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectOp("]"); err != nil {
+		return nil, err
+	}
+	return &sliceExpr{line, x, lo, hi}, nil
+}
+
+func (p *starParser) parseCall(fn starExpr, line int) (starExpr, error) {
+	call := &callExpr{line: line, fn: fn}
+	for !p.isOp(")") {
+		name := ""
+		if t := p.peek(); t.kind == tokName && !starKeywords[t.text] && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].text == "=" {
+			name = t.text
+			p.pos += 2
+		} else if len(call.names) > 0 && call.names[len(call.names)-1] != "" {
+			return nil, p.errorf("positional argument follows keyword argument")
+		}
+		arg, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		call.names = append(call.names, name)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	return call, p.expectOp(")")
+}
+
+func (p *starParser) parseOperand() (starExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokName:
+		switch t.text {
+		case "None":
+			p.next()
+			return &literalExpr{t.line, nil}, nil
+		case "True", "False":
+			p.next()
+			return &literalExpr{t.line, t.text == "True"}, nil
+		}
+		name, err := p.name()
+		return &identExpr{t.line, name}, err
+	case tokInt, tokFloat:
+		p.next()
+		return &literalExpr{t.line, t.val}, nil
+	case tokString:
+		// Adjacent strings are joined
+		var b strings.Builder
+		for p.peek().kind == tokString {
+			b.WriteString(p.next().val.(string))
+		}
+		return &literalExpr{t.line, b.String()}, nil
+	}
+
+	switch {
+	case p.isOp("("):
+		p.next()
+		if p.isOp(")") {
+			p.next()
+			return &tupleExpr{t.line, nil}, nil
+		}
+		x, err := p.parseExprList()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expectOp(")")
+	case p.isOp("["):
+		p.next()
+		list := &listExpr{line: t.line}
+		for !p.isOp("]") {
+			x, err := p.parseTest()
+			if err != nil {
+				return nil, err
+			}
+			if len(list.elems) == 0 && p.isKeyword("for") {
+				return p.parseComprehension(x, t.line)
+			}
+			list.elems = append(list.elems, x)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+		return list, p.expectOp("]")
+	case p.isOp("{"):
+		p.next()
+		dict := &dictExpr{line: t.line}
+		for !p.isOp("}") {
+			key, err := p.parseTest()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(":"); err != nil {
+				return nil, err
+			}
+			value, err := p.parseTest()
+			if err != nil {
+				return nil, err
+			}
+			dict.keys = append(dict.keys, key)
+			dict.values = append(dict.values, value)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+		return dict, p.expectOp("}")
+	}
+	return nil, p.errorf("unexpected %s", p.describe())
+}
+
+// parseComprehension parses a list comprehension after its first expression
+func (p *starParser) parseComprehension(body starExpr, line int) (starExpr, error) {
+	p.next()
+	vars, err := p.parseLoopVars()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	comp := &compExpr{line: line, body: body, vars: vars, iter: iter}
+	if p.isKeyword("if") {
+		p.next()
+		if comp.cond, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	return comp, p.expectOp("]")
+}
+
+// Values beyond the Go types standing for None (nil), booleans, ints,
+// floats and strings
+type (
+	starList struct {
+		elems  []any
+		frozen bool
+	}
+	starTuple []any
+	starDict  struct {
+		keys    []any // In insertion order
+		entries map[any]any
+		frozen  bool
+	}
+	starFunction struct {
+		name    string
+		params  []starParam
+		defs    []any // Values of the parameter defaults
+		body    []starStmt
+		globals map[string]any
+	}
+	starBuiltin struct {
+		name string
+		fn   func(th *starThread, args []any, kwargs map[string]any) (any, error)
+	}
+	// starObject is a value of the host with attributes, such as a file
+	starObject interface {
+		typeName() string
+		attr(name string) (v any, ok bool, err error)
+	}
+)
+
+func newStarDict() *starDict { return &starDict{entries: make(map[any]any)} }
+
+func (d *starDict) set(key, value any) error {
+	if d.frozen {
+		return fmt.Errorf("cannot modify frozen dict")
+	}
+	if err := checkHashable(key); err != nil {
+		return err
+	}
+	key = dictKey(key)
+	if _, ok := d.entries[key]; !ok {
+		d.keys = append(d.keys, key)
+	}
+	d.entries[key] = value
+	return nil
+}
+
+func (d *starDict) get(key any) (any, bool) {
+	if checkHashable(key) != nil {
+		return nil, false
+	}
+	value, ok := d.entries[dictKey(key)]
+	return value, ok
+}
+
+// dictKey makes integral floats the same key as the equal int
+func dictKey(key any) any {
+	if f, ok := key.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int(f)
+	}
+	return key
+}
+
+func checkHashable(key any) error {
+	switch key.(type) {
+	case nil, bool, int, float64, string:
+		return nil
+	}
+	return fmt.Errorf("unhashable type: %s", starType(key))
+}
+
+// freezeStar makes a value and everything it holds immutable
+func freezeStar(v any) {
+	switch v := v.(type) {
+	case *starList:
+		if !v.frozen {
+			v.frozen = true
+			for _, elem := range v.elems {
+				freezeStar(elem)
+			}
+		}
+	case starTuple:
+		for _, elem := range v {
+			freezeStar(elem)
+		}
+	case *starDict:
+		if !v.frozen {
+			v.frozen = true
+			for _, value := range v.entries {
+				freezeStar(value)
+			}
+		}
+	}
+}
+
+func starType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NoneType"
+	case bool:
+		return "bool"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case *starList:
+		return "list"
+	case starTuple:
+		return "tuple"
+	case *starDict:
+		return "dict"
+	case *starFunction:
+		return "function"
+	case *starBuiltin:
+		return "builtin_function_or_method"
+	case starObject:
+		return v.typeName()
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func starTruth(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case *starList:
+		return len(v.elems) > 0
+	case starTuple:
+		return len(v) > 0
+	case *starDict:
+		return len(v.keys) > 0
+	}
+	return true
+}
+
+// starStr is str(v): strings as they are, everything else as repr(v)
+func starStr(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return starRepr(v)
+}
+
+// starRepr is repr(v). It stops short once longer than starMaxLen, which
+// callers turning it into a value check with starCheckLen, so that a list
+// holding the same big list many times can't run the sorter out of memory.
+func starRepr(v any) string {
+	var b strings.Builder
+	starWriteRepr(&b, v)
+	return b.String()
+}
+
+func starWriteRepr(b *strings.Builder, v any) {
+	if b.Len() > starMaxLen {
+		return
+	}
+	elems := func(elems []any) {
+		for i, elem := range elems {
+			if b.Len() > starMaxLen {
+				return
+			}
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			starWriteRepr(b, elem)
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("None")
+	case bool:
+		if v {
+			b.WriteString("True")
+		} else {
+			b.WriteString("False")
+		}
+	case int:
+		b.WriteString(strconv.Itoa(v))
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEnI") {
+			s += ".0"
+		}
+		b.WriteString(s)
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case *starList:
+		b.WriteByte('[')
+		elems(v.elems)
+		b.WriteByte(']')
+	case starTuple:
+		b.WriteByte('(')
+		elems(v)
+		if len(v) == 1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte(')')
+	case *starDict:
+		b.WriteByte('{')
+		for i, key := range v.keys {
+			if b.Len() > starMaxLen {
+				break
+			}
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			starWriteRepr(b, key)
+			b.WriteString(": ")
+			starWriteRepr(b, v.entries[key])
+		}
+		b.WriteByte('}')
+	case *starFunction:
+		b.WriteString("<function " + v.name + ">")
+	case *starBuiltin:
+		b.WriteString("<built-in function " + v.name + ">")
+	case fmt.Stringer:
+		b.WriteString(v.String())
+	default:
+		b.WriteString("<" + starType(v) + ">")
+	}
+}
+
+// starCheckLen fails operations whose result would hold more than
+// starMaxLen bytes or elements
+func starCheckLen(n int) error {
+	if n > starMaxLen {
+		return fmt.Errorf("result too large: more than %d bytes or elements", starMaxLen)
+	}
+	return nil
+}
+
+// starRepeatLen is the length of a sequence of length n repeated times
+// times, or more than starMaxLen when it would overflow
+func starRepeatLen(n, times int) int {
+	if times <= 0 || n == 0 {
+		return 0
+	}
+	if n > starMaxLen/times {
+		return starMaxLen + 1
+	}
+	return n * times
+}
+
+func starEqual(x, y any) bool {
+	switch x := x.(type) {
+	case int:
+		switch y := y.(type) {
+		case int:
+			return x == y
+		case float64:
+			return float64(x) == y
+		}
+		return false
+	case float64:
+		switch y := y.(type) {
+		case int:
+			return x == float64(y)
+		case float64:
+			return x == y
+		}
+		return false
+	case *starList:
+		other, ok := y.(*starList)
+		return ok && starEqualElems(x.elems, other.elems)
+	case starTuple:
+		other, ok := y.(starTuple)
+		return ok && starEqualElems(x, other)
+	case *starDict:
+		other, ok := y.(*starDict)
+		if !ok || len(x.keys) != len(other.keys) {
+			return false
+		}
+		for _, key := range x.keys {
+			value, ok := other.entries[key]
+			if !ok || !starEqual(x.entries[key], value) {
+				return false
+			}
+		}
+		return true
+	case nil, bool, string:
+		return x == y
+	}
+	return x == y
+}
+
+func starEqualElems(x, y []any) bool {
+	return slices.EqualFunc(x, y, starEqual)
+}
+
+// starCompare orders numbers, strings, and lists or tuples of them
+func starCompare(x, y any) (int, error) {
+	switch x := x.(type) {
+	case int:
+		switch y := y.(type) {
+		case int:
+			return cmpOrdered(x, y), nil
+		case float64:
+			return cmpOrdered(float64(x), y), nil
+		}
+	case float64:
+		switch y := y.(type) {
+		case int:
+			return cmpOrdered(x, float64(y)), nil
+		case float64:
+			return cmpOrdered(x, y), nil
+		}
+	case string:
+		if y, ok := y.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	case *starList:
+		if y, ok := y.(*starList); ok {
+			return starCompareElems(x.elems, y.elems)
+		}
+	case starTuple:
+		if y, ok := y.(starTuple); ok {
+			return starCompareElems(x, y)
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", starType(x), starType(y))
+}
+
+func starCompareElems(x, y []any) (int, error) {
+	for i := range min(len(x), len(y)) {
+		if c, err := starCompare(x[i], y[i]); err != nil || c != 0 {
+			return c, err
+		}
+	}
+	return cmpOrdered(len(x), len(y)), nil
+}
+
+func cmpOrdered[T int | float64](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// starIterate returns the elements a for loop goes through
+func starIterate(v any) ([]any, error) {
+	switch v := v.(type) {
+	case *starList:
+		return slices.Clone(v.elems), nil
+	case starTuple:
+		return v, nil
+	case *starDict:
+		return slices.Clone(v.keys), nil
+	case string:
+		var chars []any
+		for _, r := range v {
+			chars = append(chars, string(r))
+		}
+		return chars, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", starType(v))
+}
+
+func starContains(container, x any) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := x.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires a string, not %s", starType(x))
+		}
+		return strings.Contains(c, s), nil
+	case *starList:
+		return slices.ContainsFunc(c.elems, func(elem any) bool { return starEqual(elem, x) }), nil
+	case starTuple:
+		return slices.ContainsFunc(c, func(elem any) bool { return starEqual(elem, x) }), nil
+	case *starDict:
+		_, ok := c.get(x)
+		return ok, nil
+	}
+	return false, fmt.Errorf("'in' needs a string, list, tuple or dict, not %s", starType(container))
+}
+
+func starBinary(op string, x, y any) (any, error) {
+	switch op {
+	case "==":
+		return starEqual(x, y), nil
+	case "!=":
+		return !starEqual(x, y), nil
+	case "<", ">", "<=", ">=":
+		c, err := starCompare(x, y)
+		if err != nil {
+			return nil, err
+		}
+		return op == "<" && c < 0 || op == ">" && c > 0 || op == "<=" && c <= 0 || op == ">=" && c >= 0, nil
+	case "in":
+		return starContains(y, x)
+	case "not in":
+		in, err := starContains(y, x)
+		return !in, err
+	}
+
+	// Arithmetic, with ints turning into floats next to floats
+	if a, ok := x.(int); ok {
+		if b, ok := y.(int); ok {
+			return starIntOp(op, a, b)
+		}
+	}
+	a, aNum := starFloat(x)
+	b, bNum := starFloat(y)
+	if aNum && bNum {
+		return starFloatOp(op, a, b)
+	}
+
+	switch x := x.(type) {
+	case string:
+		switch op {
+		case "+":
+			if y, ok := y.(string); ok {
+				if err := starCheckLen(len(x) + len(y)); err != nil {
+					return nil, err
+				}
+				return x + y, nil
+			}
+		case "*":
+			if n, ok := y.(int); ok {
+				if err := starCheckLen(starRepeatLen(len(x), n)); err != nil {
+					return nil, err
+				}
+				return strings.Repeat(x, max(n, 0)), nil
+			}
+		case "%":
+			return starFormat(x, y)
+		}
+	case *starList:
+		switch op {
+		case "+":
+			if y, ok := y.(*starList); ok {
+				if err := starCheckLen(len(x.elems) + len(y.elems)); err != nil {
+					return nil, err
+				}
+				return &starList{elems: append(slices.Clone(x.elems), y.elems...)}, nil
+			}
+		case "*":
+			if n, ok := y.(int); ok {
+				if err := starCheckLen(starRepeatLen(len(x.elems), n)); err != nil {
+					return nil, err
+				}
+				return &starList{elems: starRepeat(x.elems, n)}, nil
+			}
+		}
+	case starTuple:
+		switch op {
+		case "+":
+			if y, ok := y.(starTuple); ok {
+				if err := starCheckLen(len(x) + len(y)); err != nil {
+					return nil, err
+				}
+				return append(slices.Clone(x), y...), nil
+			}
+		case "*":
+			if n, ok := y.(int); ok {
+				if err := starCheckLen(starRepeatLen(len(x), n)); err != nil {
+					return nil, err
+				}
+				return starTuple(starRepeat(x, n)), nil
+			}
+		}
+	case int:
+		if op == "*" {
+			switch y.(type) {
+			case string, *starList, starTuple:
+				return starBinary(op, y, x)
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported operation %s %s %s", starType(x), op, starType(y))
+}
+
+func starRepeat(elems []any, n int) []any {
+	repeated := make([]any, 0, starRepeatLen(len(elems), n))
+	for range max(n, 0) {
+		repeated = append(repeated, elems...)
+	}
+	return repeated
+}
+
+func starFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// errStarOverflow reports int arithmetic past 64 bits, which Starlark's
+// arbitrary precision ints would hold
+var errStarOverflow = errors.New("integer overflow")
+
+func starIntOp(op string, a, b int) (any, error) {
+	switch op {
+	case "+":
+		if b > 0 && a > math.MaxInt-b || b < 0 && a < math.MinInt-b {
+			return nil, errStarOverflow
+		}
+		return a + b, nil
+	case "-":
+		if b < 0 && a > math.MaxInt+b || b > 0 && a < math.MinInt+b {
+			return nil, errStarOverflow
+		}
+		return a - b, nil
+	case "*":
+		if a != 0 && b != 0 {
+			product := a * b
+			if product/b != a || a == -1 && b == math.MinInt || b == -1 && a == math.MinInt {
+				return nil, errStarOverflow
+			}
+		}
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return float64(a) / float64(b), nil
+	case "//", "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if a == math.MinInt && b == -1 && op == "//" {
+			return nil, errStarOverflow
+		}
+		// Rounding towards negative infinity, as in Python
+		q, r := a/b, a%b
+		if r != 0 && (r < 0) != (b < 0) {
+			q, r = q-1, r+b
+		}
+		if op == "//" {
+			return q, nil
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("unsupported operation int %s int", op)
+}
+
+func starFloatOp(op string, a, b float64) (any, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "//", "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		switch op {
+		case "/":
+			return a / b, nil
+		case "//":
+			return math.Floor(a / b), nil
+		}
+		r := math.Mod(a, b)
+		if r != 0 && (r < 0) != (b < 0) {
+			r += b
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("unsupported operation float %s float", op)
+}
+
+// starFormat is format % args, with the %s, %r, %d, %i, %x, %X, %o, %e, %f
+// and %g conversions, flags, width and precision
+func starFormat(format string, arg any) (string, error) {
+	args := []any{arg}
+	if tuple, ok := arg.(starTuple); ok {
+		args = tuple
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("-+ 0#", format[j]) >= 0 {
+			j++
+		}
+		for j < len(format) && (isStarDigit(format[j]) || format[j] == '.') {
+			j++
+		}
+		if j == len(format) {
+			return "", fmt.Errorf("incomplete format")
+		}
+		spec, verb := format[i+1:j], format[j]
+		i = j
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if n == len(args) {
+			return "", fmt.Errorf("not enough arguments for format string")
+		}
+		value := args[n]
+		n++
+		switch verb {
+		case 's':
+			fmt.Fprintf(&b, "%"+spec+"s", starStr(value))
+		case 'r':
+			fmt.Fprintf(&b, "%"+spec+"s", starRepr(value))
+		case 'd', 'i', 'x', 'X', 'o':
+			var integer int
+			switch v := value.(type) {
+			case int:
+				integer = v
+			case float64:
+				integer = int(v)
+			default:
+				return "", fmt.Errorf("%%%c format: a number is required, not %s", verb, starType(value))
+			}
+			if verb == 'i' {
+				verb = 'd'
+			}
+			fmt.Fprintf(&b, "%"+spec+string(verb), integer)
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			f, ok := starFloat(value)
+			if !ok {
+				return "", fmt.Errorf("%%%c format: a number is required, not %s", verb, starType(value))
+			}
+			fmt.Fprintf(&b, "%"+spec+string(verb), f)
+		default:
+			return "", fmt.Errorf("unsupported format character %q", verb)
+		}
+		if err := starCheckLen(b.Len()); err != nil {
+			return "", err
+		}
+	}
+	if n < len(args) {
+		return "", fmt.Errorf("not all arguments converted during string formatting")
+	}
+	return b.String(), nil
+}
+
+// starThread counts the steps and depth of one call into a script
+type starThread struct {
+	steps int
+	depth int
+	print func(msg string)
+}
+
+func (th *starThread) step() error {
+	th.steps++
+	if th.steps > starMaxSteps {
+		return fmt.Errorf("script took more than %d steps", starMaxSteps)
+	}
+	return nil
+}
+
+// call calls a function or builtin with positional and keyword arguments
+func (th *starThread) call(fn any, args []any, kwargs map[string]any) (any, error) {
+	switch fn := fn.(type) {
+	case *starBuiltin:
+		return fn.fn(th, args, kwargs)
+	case *starFunction:
+		if th.depth >= starMaxDepth {
+			return nil, fmt.Errorf("calls nested more than %d deep", starMaxDepth)
+		}
+		if len(args) > len(fn.params) {
+			return nil, fmt.Errorf("%s() takes %d arguments, got %d", fn.name, len(fn.params), len(args))
+		}
+		locals := make(map[string]any, len(fn.params))
+		for i, arg := range args {
+			locals[fn.params[i].name] = arg
+		}
+		for name, value := range kwargs {
+			i := slices.IndexFunc(fn.params, func(p starParam) bool { return p.name == name })
+			if i < 0 {
+				return nil, fmt.Errorf("%s() got an unexpected keyword argument %s", fn.name, name)
+			}
+			if i < len(args) {
+				return nil, fmt.Errorf("%s() got multiple values for argument %s", fn.name, name)
+			}
+			locals[name] = value
+		}
+		for i, param := range fn.params {
+			if _, ok := locals[param.name]; ok {
+				continue
+			}
+			if param.def == nil {
+				return nil, fmt.Errorf("%s() missing argument %s", fn.name, param.name)
+			}
+			locals[param.name] = fn.defs[i]
+		}
+
+		th.depth++
+		defer func() { th.depth-- }()
+		env := &starEnv{th: th, globals: fn.globals, locals: locals}
+		ctrl, value, err := env.exec(fn.body)
+		if err != nil {
+			return nil, err
+		}
+		if ctrl == ctrlReturn {
+			return value, nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s is not callable", starType(fn))
+}
+
+// Control flow out of a block
+const (
+	ctrlNone = iota
+	ctrlReturn
+	ctrlBreak
+	ctrlContinue
+)
+
+// starEnv runs statements: at the top level of a script, where names are
+// globals, or in a function, where they are locals
+type starEnv struct {
+	th      *starThread
+	globals map[string]any
+	locals  map[string]any // nil at the top level
+}
+
+func (env *starEnv) lookup(name string, line int) (any, error) {
+	if env.locals != nil {
+		if v, ok := env.locals[name]; ok {
+			return v, nil
+		}
+	}
+	if v, ok := env.globals[name]; ok {
+		return v, nil
+	}
+	if b, ok := starBuiltins[name]; ok {
+		return b, nil
+	}
+	return nil, lineErrorf(line, "undefined: %s", name)
+}
+
+func (env *starEnv) define(name string, value any) {
+	if env.locals != nil {
+		env.locals[name] = value
+	} else {
+		env.globals[name] = value
+	}
+}
+
+func (env *starEnv) exec(stmts []starStmt) (ctrl int, value any, err error) {
+	for _, stmt := range stmts {
+		if ctrl, value, err = env.execStmt(stmt); err != nil || ctrl != ctrlNone {
+			return ctrl, value, err
+		}
+	}
+	return ctrlNone, nil, nil
+}
+
+func (env *starEnv) execStmt(stmt starStmt) (int, any, error) {
+	if err := env.th.step(); err != nil {
+		return 0, nil, err
+	}
+	switch s := stmt.(type) {
+	case *exprStmt:
+		_, err := env.eval(s.x)
+		return ctrlNone, nil, err
+	case *assignStmt:
+		value, err := env.eval(s.value)
+		if err != nil {
+			return 0, nil, err
+		}
+		if s.op != "=" {
+			current, err := env.eval(s.target)
+			if err != nil {
+				return 0, nil, err
+			}
+			if value, err = starBinary(strings.TrimSuffix(s.op, "="), current, value); err != nil {
+				return 0, nil, lineErrorf(s.line, "%v", err)
+			}
+		}
+		return ctrlNone, nil, env.assign(s.target, value, s.line)
+	case *returnStmt:
+		if env.locals == nil {
+			return 0, nil, lineErrorf(s.line, "return outside function")
+		}
+		if s.value == nil {
+			return ctrlReturn, nil, nil
+		}
+		value, err := env.eval(s.value)
+		return ctrlReturn, value, err
+	case *ifStmt:
+		cond, err := env.eval(s.cond)
+		if err != nil {
+			return 0, nil, err
+		}
+		if starTruth(cond) {
+			return env.exec(s.then)
+		}
+		return env.exec(s.els)
+	case *forStmt:
+		iter, err := env.eval(s.iter)
+		if err != nil {
+			return 0, nil, err
+		}
+		elems, err := starIterate(iter)
+		if err != nil {
+			return 0, nil, lineErrorf(s.line, "%v", err)
+		}
+		for _, elem := range elems {
+			if err := env.bindVars(s.vars, elem, s.line); err != nil {
+				return 0, nil, err
+			}
+			ctrl, value, err := env.exec(s.body)
+			if err != nil || ctrl == ctrlReturn {
+				return ctrl, value, err
+			}
+			if ctrl == ctrlBreak {
+				break
+			}
+		}
+		return ctrlNone, nil, nil
+	case *branchStmt:
+		switch s.kind {
+		case "break":
+			return ctrlBreak, nil, nil
+		case "continue":
+			return ctrlContinue, nil, nil
+		}
+		return ctrlNone, nil, nil
+	case *defStmt:
+		fn := &starFunction{name: s.name, params: s.params, body: s.body, globals: env.globals}
+		for _, param := range s.params {
+			var def any
+			if param.def != nil {
+				var err error
+				if def, err = env.eval(param.def); err != nil {
+					return 0, nil, err
+				}
+			}
+			fn.defs = append(fn.defs, def)
+		}
+		env.define(s.name, fn)
+		return ctrlNone, nil, nil
+	}
+	return 0, nil, fmt.Errorf("unknown statement %T", stmt)
+}
+
+// bindVars sets the variables of a for loop or comprehension to an element,
+// unpacking it when there are several
+func (env *starEnv) bindVars(vars []string, elem any, line int) error {
+	if len(vars) == 1 {
+		env.define(vars[0], elem)
+		return nil
+	}
+	values, err := starIterate(elem)
+	if err != nil || len(values) != len(vars) {
+		return lineErrorf(line, "cannot unpack %s into %d variables", starType(elem), len(vars))
+	}
+	for i, name := range vars {
+		env.define(name, values[i])
+	}
+	return nil
+}
+
+func (env *starEnv) assign(target starExpr, value any, line int) error {
+	switch t := target.(type) {
+	case *identExpr:
+		env.define(t.name, value)
+		return nil
+	case *indexExpr:
+		container, err := env.eval(t.x)
+		if err != nil {
+			return err
+		}
+		index, err := env.eval(t.index)
+		if err != nil {
+			return err
+		}
+		switch c := container.(type) {
+		case *starList:
+			if c.frozen {
+				return lineErrorf(line, "cannot modify frozen list")
+			}
+			i, err := starIndex(index, len(c.elems))
+			if err != nil {
+				return lineErrorf(line, "%v", err)
+			}
+			c.elems[i] = value
+			return nil
+		case *starDict:
+			if err := c.set(index, value); err != nil {
+				return lineErrorf(line, "%v", err)
+			}
+			return nil
+		}
+		return lineErrorf(line, "%s does not support item assignment", starType(container))
+	case *tupleExpr, *listExpr:
+		var targets []starExpr
+		if tuple, ok := t.(*tupleExpr); ok {
+			targets = tuple.elems
+		} else {
+			targets = t.(*listExpr).elems
+		}
+		values, err := starIterate(value)
+		if err != nil || len(values) != len(targets) {
+			return lineErrorf(line, "cannot unpack %s into %d values", starType(value), len(targets))
+		}
+		for i, target := range targets {
+			if err := env.assign(target, values[i], line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return lineErrorf(line, "cannot assign to this expression")
+}
+
+// starIndex checks an index into a sequence of length n, counting negative
+// ones from the end
+func starIndex(index any, n int) (int, error) {
+	i, ok := index.(int)
+	if !ok {
+		return 0, fmt.Errorf("indices must be integers, not %s", starType(index))
+	}
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("index %d out of range", index)
+	}
+	return i, nil
+}
+
+func (env *starEnv) eval(x starExpr) (any, error) {
+	switch x := x.(type) {
+	case *literalExpr:
+		return x.value, nil
+	case *identExpr:
+		return env.lookup(x.name, x.line)
+	case *listExpr:
+		elems, err := env.evalAll(x.elems)
+		return &starList{elems: elems}, err
+	case *tupleExpr:
+		elems, err := env.evalAll(x.elems)
+		return starTuple(elems), err
+	case *dictExpr:
+		dict := newStarDict()
+		for i := range x.keys {
+			key, err := env.eval(x.keys[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := env.eval(x.values[i])
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.set(key, value); err != nil {
+				return nil, lineErrorf(x.line, "%v", err)
+			}
+		}
+		return dict, nil
+	case *compExpr:
+		iter, err := env.eval(x.iter)
+		if err != nil {
+			return nil, err
+		}
+		elems, err := starIterate(iter)
+		if err != nil {
+			return nil, lineErrorf(x.line, "%v", err)
+		}
+		result := &starList{}
+		for _, elem := range elems {
+			if err := env.th.step(); err != nil {
+				return nil, err
+			}
+			if err := env.bindVars(x.vars, elem, x.line); err != nil {
+				return nil, err
+			}
+			if x.cond != nil {
+				cond, err := env.eval(x.cond)
+				if err != nil {
+					return nil, err
+				}
+				if !starTruth(cond) {
+					continue
+				}
+			}
+			value, err := env.eval(x.body)
+			if err != nil {
+				return nil, err
+			}
+			result.elems = append(result.elems, value)
+		}
+		return result, nil
+	case *unaryExpr:
+		v, err := env.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "not":
+			return !starTruth(v), nil
+		case "-":
+			switch v := v.(type) {
+			case int:
+				if v == math.MinInt {
+					return nil, lineErrorf(x.line, "%v", errStarOverflow)
+				}
+				return -v, nil
+			case float64:
+				return -v, nil
+			}
+		case "+":
+			switch v.(type) {
+			case int, float64:
+				return v, nil
+			}
+		}
+		return nil, lineErrorf(x.line, "unsupported operation %s%s", x.op, starType(v))
+	case *binaryExpr:
+		a, err := env.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "and":
+			if !starTruth(a) {
+				return a, nil
+			}
+			return env.eval(x.y)
+		case "or":
+			if starTruth(a) {
+				return a, nil
+			}
+			return env.eval(x.y)
+		}
+		b, err := env.eval(x.y)
+		if err != nil {
+			return nil, err
+		}
+		v, err := starBinary(x.op, a, b)
+		if err != nil {
+			return nil, lineErrorf(x.line, "%v", err)
+		}
+		return v, nil
+	case *condExpr:
+		cond, err := env.eval(x.cond)
+		if err != nil {
+			return nil, err
+		}
+		if starTruth(cond) {
+			return env.eval(x.then)
+		}
+		return env.eval(x.els)
+	case *callExpr:
+		fn, err := env.eval(x.fn)
+		if err != nil {
+			return nil, err
+		}
+		var args []any
+		var kwargs map[string]any
+		for i, argExpr := range x.args {
+			arg, err := env.eval(argExpr)
+			if err != nil {
+				return nil, err
+			}
+			if x.names[i] == "" {
+				args = append(args, arg)
+				continue
+			}
+			if kwargs == nil {
+				kwargs = make(map[string]any)
+			}
+			kwargs[x.names[i]] = arg
+		}
+		v, err := env.th.call(fn, args, kwargs)
+		if err != nil {
+			var lineErr *lineError
+			if !errors.As(err, &lineErr) {
+				err = lineErrorf(x.line, "%v", err)
+			}
+			return nil, err
+		}
+		return v, nil
+	case *indexExpr:
+		container, err := env.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		index, err := env.eval(x.index)
+		if err != nil {
+			return nil, err
+		}
+		v, err := starGetIndex(container, index)
+		if err != nil {
+			return nil, lineErrorf(x.line, "%v", err)
+		}
+		return v, nil
+	case *sliceExpr:
+		container, err := env.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		var lo, hi any
+		if x.lo != nil {
+			if lo, err = env.eval(x.lo); err != nil {
+				return nil, err
+			}
+		}
+		if x.hi != nil {
+			if hi, err = env.eval(x.hi); err != nil {
+				return nil, err
+			}
+		}
+		v, err := starSlice(container, lo, hi)
+		if err != nil {
+			return nil, lineErrorf(x.line, "%v", err)
+		}
+		return v, nil
+	case *dotExpr:
+		v, err := env.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := starAttr(v, x.name)
+		if err != nil {
+			return nil, lineErrorf(x.line, "%v", err)
+		}
+		return attr, nil
+	}
+	return nil, fmt.Errorf("unknown expression %T", x)
+}
+
+func (env *starEnv) evalAll(exprs []starExpr) ([]any, error) {
+	values := make([]any, len(exprs))
+	for i, x := range exprs {
+		v, err := env.eval(x)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func starGetIndex(container, index any) (any, error) {
+	switch c := container.(type) {
+	case *starList:
+		i, err := starIndex(index, len(c.elems))
+		if err != nil {
+			return nil, err
+		}
+		return c.elems[i], nil
+	case starTuple:
+		i, err := starIndex(index, len(c))
+		if err != nil {
+			return nil, err
+		}
+		return c[i], nil
+	case string:
+		i, err := starIndex(index, len(c))
+		if err != nil {
+			return nil, err
+		}
+		return c[i : i+1], nil
+	case *starDict:
+		v, ok := c.get(index)
+		if !ok {
+			return nil, fmt.Errorf("key %s not in dict", starRepr(index))
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s is not indexable", starType(container))
+}
+
+func starSlice(container, lo, hi any) (any, error) {
+	var n int
+	switch c := container.(type) {
+	case *starList:
+		n = len(c.elems)
+	case starTuple:
+		n = len(c)
+	case string:
+		n = len(c)
+	default:
+		return nil, fmt.Errorf("%s cannot be sliced", starType(container))
+	}
+	bound := func(v any, def int) (int, error) {
+		if v == nil {
+			return def, nil
+		}
+		i, ok := v.(int)
+		if !ok {
+			return 0, fmt.Errorf("slice indices must be integers, not %s", starType(v))
+		}
+		if i < 0 {
+			i += n
+		}
+		return min(max(i, 0), n), nil
+	}
+	start, err := bound(lo, 0)
+	if err != nil {
+		return nil, err
+	}
+	end, err := bound(hi, n)
+	if err != nil {
+		return nil, err
+	}
+	end = max(start, end)
+	switch c := container.(type) {
+	case *starList:
+		return &starList{elems: slices.Clone(c.elems[start:end])}, nil
+	case starTuple:
+		return slices.Clone(c[start:end]), nil
+	}
+	return container.(string)[start:end], nil
+}
+
+// starAttr returns an attribute of a value: a method bound to it, or a
+// field of a host object
+func starAttr(v any, name string) (any, error) {
+	var methods map[string]starMethod
+	switch v := v.(type) {
+	case string:
+		methods = starStringMethods
+	case *starList:
+		methods = starListMethods
+	case *starDict:
+		methods = starDictMethods
+	case starObject:
+		attr, ok, err := v.attr(name)
+		if err != nil || ok {
+			return attr, err
+		}
+	}
+	if m, ok := methods[name]; ok {
+		return &starBuiltin{name: name, fn: func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+			return m(th, v, args, kwargs)
+		}}, nil
+	}
+	return nil, fmt.Errorf("%s has no attribute %s", starType(v), name)
+}
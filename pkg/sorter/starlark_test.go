@@ -0,0 +1,140 @@
+package sorter
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runStar runs a Starlark program and returns the repr of its global x
+func runStar(src string) (string, error) {
+	stmts, err := parseStarlark(src)
+	if err != nil {
+		return "", err
+	}
+	env := &starEnv{th: &starThread{}, globals: make(map[string]any)}
+	if _, _, err := env.exec(stmts); err != nil {
+		return "", err
+	}
+	return starRepr(env.globals["x"]), nil
+}
+
+func TestStarlark(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"arithmetic", "x = 1 + 2 * 3 - 4 // 3 + 7 % 4", "9"},
+		{"floor division rounds down", "x = (-7 // 2, -7 % 2, 7 // -2)", "(-4, 1, -4)"},
+		{"float", "x = 1 / 4 + 0.5", "0.75"},
+		{"strings", `x = "a" + "b" * 3 + "%d-%s" % (4, "c")`, `"abbb4-c"`},
+		{"string methods", `x = "  Hello World ".strip().lower().split(" ")`, `["hello", "world"]`},
+		{"format", `x = "{}/{name}".format("a", name = "b")`, `"a/b"`},
+		{"list", "x = [1, 2] + [3] * 2\nx.append(4)", "[1, 2, 3, 3, 4]"},
+		{"slices", `x = ([0, 1, 2, 3, 4][1:4], "hello"[-3:])`, `([1, 2, 3], "llo")`},
+		{"dict", `x = {"a": 1}` + "\nx[\"b\"] = 2\nx = sorted(x.items())", `[("a", 1), ("b", 2)]`},
+		{"comprehension", "x = [i * i for i in range(5) if i % 2 == 0]", "[0, 4, 16]"},
+		{"function", "def f(a, b = 2, c = 3):\n    return (a, b, c)\nx = f(1, c = 4)", "(1, 2, 4)"},
+		{"big but allowed", "x = len(\"ab\" * 499999 + \"cd\")", "1000000"},
+		{"largest int", "x = (9223372036854775807, -9223372036854775807 - 1, (-9223372036854775807 - 1) % -1)", "(9223372036854775807, -9223372036854775808, 0)"},
+		{"recursion", "def fact(n):\n    if n <= 1:\n        return 1\n    return n * fact(n - 1)\nx = fact(10)", "3628800"},
+		{"loop", "x = 0\nfor i in range(10):\n    if i == 5:\n        break\n    x += i", "10"},
+		{"conditional expression", `x = "yes" if 1 < 2 else "no"`, `"yes"`},
+		{"unpacking", "a, b = 1, 2\nfor c, d in [(3, 4)]:\n    x = a + b + c + d", "10"},
+		{"builtins", `x = (len("abc"), str(1), int("42"), max([3, 1, 2]), "b" in ["a", "b"], any([0, 1]))`, `(3, "1", 42, 3, True, True)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runStar(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("x = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStarlarkErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"syntax", "x = (1", "line 1"},
+		{"undefined", "x = y", "y"},
+		{"type", `x = 1 + "a"`, "unsupported"},
+		{"division by zero", "x = 1 // 0", "division by zero"},
+		{"index", "x = [1][2]", "out of range"},
+		{"endless loop", "def f():\n    for i in range(1000000):\n        for j in range(1000000):\n            pass\nf()", "steps"},
+		{"deep recursion", "def f(n):\n    return f(n + 1)\nx = f(0)", "deep"},
+		{"huge list", "x = [0] * 2000000000", "too large"},
+		{"huge list from the left", "x = 2000000000 * [0]", "too large"},
+		{"repeat overflow", "x = [0, 1] * 9223372036854775807", "too large"},
+		{"doubling string", "x = \"ab\"\nfor i in range(40):\n    x = x + x", "too large"},
+		{"doubling list", "x = [1]\nfor i in range(40):\n    x.extend(x)", "too large"},
+		{"doubling tuple", "x = (1,)\nfor i in range(40):\n    x += x", "too large"},
+		{"huge replace", "x = (\"a\" * 1000).replace(\"a\", \"b\" * 10000)", "too large"},
+		{"huge join", "x = (\"a\" * 1000).join([\"b\"] * 10000)", "too large"},
+		{"huge repr", "a = [\"x\" * 1000] * 1000\nx = str([a] * 1000)", "too large"},
+		{"huge format", "x = \"%1000000s\" * 1000 % tuple([\"a\"] * 1000)", "too large"},
+		{"floor division overflow", "x = (-9223372036854775807 - 1) // -1", "integer overflow"},
+		{"addition overflow", "x = 9223372036854775807 + 1", "integer overflow"},
+		{"subtraction overflow", "x = -9223372036854775807 - 2", "integer overflow"},
+		{"multiplication overflow", "x = 4294967296 * 4294967296", "integer overflow"},
+		{"negation overflow", "x = -(-9223372036854775807 - 1)", "integer overflow"},
+		{"abs overflow", "x = abs(-9223372036854775807 - 1)", "integer overflow"},
+		{"augmented overflow", "x = 9223372036854775807\nx *= 2", "integer overflow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runStar(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestScript(t *testing.T) {
+	script, err := ParseScript("rules.star", []byte(`
+def classify(file):
+    if file.ext == "pdf" and file.stem.startswith("invoice"):
+        return "Finance/Invoices"
+    if file.name.startswith("."):
+        return "leave"
+    return None
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, ext, category string
+		want                string
+	}{
+		{"/in/invoice-42.pdf", "pdf", "Documents", filepath.FromSlash("Finance/Invoices")},
+		{"/in/paper.pdf", "pdf", "Documents", "Documents"},
+		{"/in/.hidden", "", "Other", LeaveInInbox},
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tt := range tests {
+		got, err := script.run(filepath.FromSlash(tt.path), tt.ext, tt.category, log)
+		if err != nil {
+			t.Errorf("run(%s): %v", tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("run(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	for _, src := range []string{"x = 1", "def classify():\n    pass", "def classify(file):\n    return 1 +"} {
+		if _, err := ParseScript("rules.star", []byte(src)); err == nil {
+			t.Errorf("ParseScript(%q) succeeded, want an error", src)
+		}
+	}
+}
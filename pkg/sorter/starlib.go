@@ -0,0 +1,989 @@
+package sorter
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The builtins and the string, list and dict methods of rules scripts
+
+// starMethod is a method of a value, which is passed as recv
+type starMethod func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error)
+
+var (
+	starBuiltins      map[string]*starBuiltin
+	starStringMethods map[string]starMethod
+	starListMethods   map[string]starMethod
+	starDictMethods   map[string]starMethod
+)
+
+// starArgs checks the arguments of a builtin: at least min and at most
+// max positional ones, and no keyword ones but those named in keywords
+func starArgs(name string, args []any, kwargs map[string]any, minArgs, maxArgs int, keywords ...string) error {
+	if len(args) < minArgs || len(args) > maxArgs {
+		if minArgs == maxArgs {
+			return fmt.Errorf("%s() takes %d arguments, got %d", name, minArgs, len(args))
+		}
+		return fmt.Errorf("%s() takes %d to %d arguments, got %d", name, minArgs, maxArgs, len(args))
+	}
+	for kw := range kwargs {
+		if !slices.Contains(keywords, kw) {
+			return fmt.Errorf("%s() got an unexpected keyword argument %s", name, kw)
+		}
+	}
+	return nil
+}
+
+func starString(name string, v any) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s() needs a string, not %s", name, starType(v))
+	}
+	return s, nil
+}
+
+func starInt(name string, v any) (int, error) {
+	i, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("%s() needs an int, not %s", name, starType(v))
+	}
+	return i, nil
+}
+
+func init() {
+	starBuiltins = make(map[string]*starBuiltin)
+	builtin := func(name string, fn func(th *starThread, args []any, kwargs map[string]any) (any, error)) {
+		starBuiltins[name] = &starBuiltin{name: name, fn: fn}
+	}
+
+	builtin("len", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("len", args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		switch v := args[0].(type) {
+		case string:
+			return len(v), nil
+		case *starList:
+			return len(v.elems), nil
+		case starTuple:
+			return len(v), nil
+		case *starDict:
+			return len(v.keys), nil
+		}
+		return nil, fmt.Errorf("len() of %s", starType(args[0]))
+	})
+	builtin("str", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("str", args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		str := starStr(args[0])
+		if err := starCheckLen(len(str)); err != nil {
+			return nil, err
+		}
+		return str, nil
+	})
+	builtin("repr", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("repr", args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		repr := starRepr(args[0])
+		if err := starCheckLen(len(repr)); err != nil {
+			return nil, err
+		}
+		return repr, nil
+	})
+	builtin("bool", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("bool", args, kwargs, 0, 1); err != nil {
+			return nil, err
+		}
+		return len(args) == 1 && starTruth(args[0]), nil
+	})
+	builtin("int", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("int", args, kwargs, 1, 2); err != nil {
+			return nil, err
+		}
+		switch v := args[0].(type) {
+		case int:
+			return v, nil
+		case bool:
+			if v {
+				return 1, nil
+			}
+			return 0, nil
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("int() of %v", v)
+			}
+			return int(v), nil
+		case string:
+			base := 10
+			if len(args) == 2 {
+				var err error
+				if base, err = starInt("int", args[1]); err != nil {
+					return nil, err
+				}
+			}
+			n, err := strconv.ParseInt(strings.TrimSpace(v), base, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid literal for int(): %s", starRepr(v))
+			}
+			return int(n), nil
+		}
+		return nil, fmt.Errorf("int() of %s", starType(args[0]))
+	})
+	builtin("float", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("float", args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		if s, ok := args[0].(string); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid literal for float(): %s", starRepr(s))
+			}
+			return f, nil
+		}
+		if f, ok := starFloat(args[0]); ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("float() of %s", starType(args[0]))
+	})
+	builtin("abs", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("abs", args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		switch v := args[0].(type) {
+		case int:
+			if v == math.MinInt {
+				return nil, errStarOverflow
+			}
+			return max(v, -v), nil
+		case float64:
+			return math.Abs(v), nil
+		}
+		return nil, fmt.Errorf("abs() of %s", starType(args[0]))
+	})
+	minMax := func(name string, want int) {
+		builtin(name, func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs(name, args, kwargs, 1, math.MaxInt); err != nil {
+				return nil, err
+			}
+			elems := args
+			if len(args) == 1 {
+				var err error
+				if elems, err = starIterate(args[0]); err != nil {
+					return nil, err
+				}
+			}
+			if len(elems) == 0 {
+				return nil, fmt.Errorf("%s() of an empty sequence", name)
+			}
+			best := elems[0]
+			for _, elem := range elems[1:] {
+				c, err := starCompare(elem, best)
+				if err != nil {
+					return nil, err
+				}
+				if c == want {
+					best = elem
+				}
+			}
+			return best, nil
+		})
+	}
+	minMax("min", -1)
+	minMax("max", 1)
+	builtin("range", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("range", args, kwargs, 1, 3); err != nil {
+			return nil, err
+		}
+		bounds := []int{0, 0, 1}
+		for i, arg := range args {
+			n, err := starInt("range", arg)
+			if err != nil {
+				return nil, err
+			}
+			bounds[i] = n
+		}
+		start, stop, step := bounds[0], bounds[1], bounds[2]
+		if len(args) == 1 {
+			start, stop = 0, bounds[0]
+		}
+		if step == 0 {
+			return nil, fmt.Errorf("range() step must not be zero")
+		}
+		list := &starList{}
+		for i := start; step > 0 && i < stop || step < 0 && i > stop; i += step {
+			if len(list.elems) == starMaxRange {
+				return nil, fmt.Errorf("range() of more than %d numbers", starMaxRange)
+			}
+			list.elems = append(list.elems, i)
+		}
+		return list, nil
+	})
+	builtin("list", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("list", args, kwargs, 0, 1); err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return &starList{}, nil
+		}
+		elems, err := starIterate(args[0])
+		return &starList{elems: slices.Clone(elems)}, err
+	})
+	builtin("tuple", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("tuple", args, kwargs, 0, 1); err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return starTuple{}, nil
+		}
+		elems, err := starIterate(args[0])
+		return starTuple(slices.Clone(elems)), err
+	})
+	builtin("dict", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("dict() takes at most 1 argument, got %d", len(args))
+		}
+		dict := newStarDict()
+		if len(args) == 1 {
+			if err := starDictUpdate(dict, args[0]); err != nil {
+				return nil, err
+			}
+		}
+		for _, kw := range slices.Sorted(maps.Keys(kwargs)) {
+			dict.set(kw, kwargs[kw])
+		}
+		return dict, nil
+	})
+	builtin("enumerate", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("enumerate", args, kwargs, 1, 2); err != nil {
+			return nil, err
+		}
+		elems, err := starIterate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		start := 0
+		if len(args) == 2 {
+			if start, err = starInt("enumerate", args[1]); err != nil {
+				return nil, err
+			}
+		}
+		list := &starList{}
+		for i, elem := range elems {
+			list.elems = append(list.elems, starTuple{start + i, elem})
+		}
+		return list, nil
+	})
+	builtin("zip", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("zip", args, kwargs, 0, math.MaxInt); err != nil {
+			return nil, err
+		}
+		var seqs [][]any
+		n := math.MaxInt
+		for _, arg := range args {
+			elems, err := starIterate(arg)
+			if err != nil {
+				return nil, err
+			}
+			seqs = append(seqs, elems)
+			n = min(n, len(elems))
+		}
+		list := &starList{}
+		for i := 0; len(seqs) > 0 && i < n; i++ {
+			tuple := make(starTuple, len(seqs))
+			for j, seq := range seqs {
+				tuple[j] = seq[i]
+			}
+			list.elems = append(list.elems, tuple)
+		}
+		return list, nil
+	})
+	builtin("sorted", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("sorted", args, kwargs, 1, 1, "key", "reverse"); err != nil {
+			return nil, err
+		}
+		elems, err := starIterate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		elems = slices.Clone(elems)
+		keys := elems
+		if key := kwargs["key"]; key != nil {
+			keys = make([]any, len(elems))
+			for i, elem := range elems {
+				if keys[i], err = th.call(key, []any{elem}, nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		reverse := starTruth(kwargs["reverse"])
+		order := make([]int, len(elems))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			c, cmpErr := starCompare(keys[order[a]], keys[order[b]])
+			if cmpErr != nil && err == nil {
+				err = cmpErr
+			}
+			if reverse {
+				return c > 0
+			}
+			return c < 0
+		})
+		if err != nil {
+			return nil, err
+		}
+		list := &starList{elems: make([]any, len(elems))}
+		for i, j := range order {
+			list.elems[i] = elems[j]
+		}
+		return list, nil
+	})
+	builtin("reversed", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("reversed", args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		elems, err := starIterate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		elems = slices.Clone(elems)
+		slices.Reverse(elems)
+		return &starList{elems: elems}, nil
+	})
+	anyAll := func(name string, all bool) {
+		builtin(name, func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs(name, args, kwargs, 1, 1); err != nil {
+				return nil, err
+			}
+			elems, err := starIterate(args[0])
+			if err != nil {
+				return nil, err
+			}
+			for _, elem := range elems {
+				if starTruth(elem) != all {
+					return !all, nil
+				}
+			}
+			return all, nil
+		})
+	}
+	anyAll("any", false)
+	anyAll("all", true)
+	builtin("type", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("type", args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		return starType(args[0]), nil
+	})
+	builtin("hasattr", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("hasattr", args, kwargs, 2, 2); err != nil {
+			return nil, err
+		}
+		name, err := starString("hasattr", args[1])
+		if err != nil {
+			return nil, err
+		}
+		_, err = starAttr(args[0], name)
+		return err == nil, nil
+	})
+	builtin("getattr", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("getattr", args, kwargs, 2, 3); err != nil {
+			return nil, err
+		}
+		name, err := starString("getattr", args[1])
+		if err != nil {
+			return nil, err
+		}
+		v, err := starAttr(args[0], name)
+		if err != nil && len(args) == 3 {
+			return args[2], nil
+		}
+		return v, err
+	})
+	builtin("print", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("print", args, kwargs, 0, math.MaxInt, "sep"); err != nil {
+			return nil, err
+		}
+		sep := " "
+		if s, ok := kwargs["sep"].(string); ok {
+			sep = s
+		}
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			parts[i] = starStr(arg)
+		}
+		if th.print != nil {
+			th.print(strings.Join(parts, sep))
+		}
+		return nil, nil
+	})
+	builtin("fail", func(th *starThread, args []any, kwargs map[string]any) (any, error) {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			parts[i] = starStr(arg)
+		}
+		return nil, fmt.Errorf("fail: %s", strings.Join(parts, " "))
+	})
+
+	starStringMethods = map[string]starMethod{
+		"lower":      stringMethod0(strings.ToLower),
+		"upper":      stringMethod0(strings.ToUpper),
+		"title":      stringMethod0(starTitle),
+		"capitalize": stringMethod0(starCapitalize),
+		"strip":      stringStrip(strings.Trim, strings.TrimSpace),
+		"lstrip":     stringStrip(strings.TrimLeft, func(s string) string { return strings.TrimLeftFunc(s, unicode.IsSpace) }),
+		"rstrip":     stringStrip(strings.TrimRight, func(s string) string { return strings.TrimRightFunc(s, unicode.IsSpace) }),
+		"isdigit":    stringTest(unicode.IsDigit),
+		"isalpha":    stringTest(unicode.IsLetter),
+		"isalnum":    stringTest(func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }),
+		"isspace":    stringTest(unicode.IsSpace),
+		"isupper": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			s := recv.(string)
+			return strings.ToUpper(s) == s && strings.ToLower(s) != s, starArgs("isupper", args, kwargs, 0, 0)
+		},
+		"islower": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			s := recv.(string)
+			return strings.ToLower(s) == s && strings.ToUpper(s) != s, starArgs("islower", args, kwargs, 0, 0)
+		},
+		"startswith": stringAffix("startswith", strings.HasPrefix),
+		"endswith":   stringAffix("endswith", strings.HasSuffix),
+		"removeprefix": stringMethod1("removeprefix", func(s, arg string) (any, error) {
+			return strings.TrimPrefix(s, arg), nil
+		}),
+		"removesuffix": stringMethod1("removesuffix", func(s, arg string) (any, error) {
+			return strings.TrimSuffix(s, arg), nil
+		}),
+		"find": stringMethod1("find", func(s, arg string) (any, error) {
+			return strings.Index(s, arg), nil
+		}),
+		"rfind": stringMethod1("rfind", func(s, arg string) (any, error) {
+			return strings.LastIndex(s, arg), nil
+		}),
+		"index": stringMethod1("index", func(s, arg string) (any, error) {
+			if i := strings.Index(s, arg); i >= 0 {
+				return i, nil
+			}
+			return nil, fmt.Errorf("substring not found")
+		}),
+		"count": stringMethod1("count", func(s, arg string) (any, error) {
+			return strings.Count(s, arg), nil
+		}),
+		"partition":  stringPartition("partition", strings.Cut),
+		"rpartition": stringPartition("rpartition", cutLast),
+		"split":      stringSplit("split", false),
+		"rsplit":     stringSplit("rsplit", true),
+		"splitlines": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("splitlines", args, kwargs, 0, 0); err != nil {
+				return nil, err
+			}
+			list := &starList{}
+			for _, line := range strings.Split(strings.TrimSuffix(recv.(string), "\n"), "\n") {
+				list.elems = append(list.elems, strings.TrimSuffix(line, "\r"))
+			}
+			if recv.(string) == "" {
+				list.elems = nil
+			}
+			return list, nil
+		},
+		"replace": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("replace", args, kwargs, 2, 3); err != nil {
+				return nil, err
+			}
+			old, err := starString("replace", args[0])
+			if err != nil {
+				return nil, err
+			}
+			repl, err := starString("replace", args[1])
+			if err != nil {
+				return nil, err
+			}
+			n := -1
+			if len(args) == 3 {
+				if n, err = starInt("replace", args[2]); err != nil {
+					return nil, err
+				}
+			}
+			s := recv.(string)
+			if count := strings.Count(s, old); len(repl) > len(old) && count > 0 {
+				if n >= 0 {
+					count = min(count, n)
+				}
+				if err := starCheckLen(len(s) + starRepeatLen(len(repl)-len(old), count)); err != nil {
+					return nil, err
+				}
+			}
+			return strings.Replace(s, old, repl, n), nil
+		},
+		"join": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("join", args, kwargs, 1, 1); err != nil {
+				return nil, err
+			}
+			elems, err := starIterate(args[0])
+			if err != nil {
+				return nil, err
+			}
+			parts := make([]string, len(elems))
+			size := len(recv.(string)) * max(len(elems)-1, 0)
+			for i, elem := range elems {
+				if parts[i], err = starString("join", elem); err != nil {
+					return nil, err
+				}
+				size += len(parts[i])
+				if err := starCheckLen(size); err != nil {
+					return nil, err
+				}
+			}
+			return strings.Join(parts, recv.(string)), nil
+		},
+		"format": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			return starFormatBraces(recv.(string), args, kwargs)
+		},
+	}
+
+	starListMethods = map[string]starMethod{
+		"append": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			list := recv.(*starList)
+			if err := starArgs("append", args, kwargs, 1, 1); err != nil {
+				return nil, err
+			}
+			if list.frozen {
+				return nil, fmt.Errorf("cannot modify frozen list")
+			}
+			list.elems = append(list.elems, args[0])
+			return nil, nil
+		},
+		"extend": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			list := recv.(*starList)
+			if err := starArgs("extend", args, kwargs, 1, 1); err != nil {
+				return nil, err
+			}
+			if list.frozen {
+				return nil, fmt.Errorf("cannot modify frozen list")
+			}
+			elems, err := starIterate(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if err := starCheckLen(len(list.elems) + len(elems)); err != nil {
+				return nil, err
+			}
+			list.elems = append(list.elems, elems...)
+			return nil, nil
+		},
+		"insert": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			list := recv.(*starList)
+			if err := starArgs("insert", args, kwargs, 2, 2); err != nil {
+				return nil, err
+			}
+			if list.frozen {
+				return nil, fmt.Errorf("cannot modify frozen list")
+			}
+			i, err := starInt("insert", args[0])
+			if err != nil {
+				return nil, err
+			}
+			if i < 0 {
+				i += len(list.elems)
+			}
+			i = min(max(i, 0), len(list.elems))
+			list.elems = slices.Insert(list.elems, i, args[1])
+			return nil, nil
+		},
+		"pop": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			list := recv.(*starList)
+			if err := starArgs("pop", args, kwargs, 0, 1); err != nil {
+				return nil, err
+			}
+			if list.frozen {
+				return nil, fmt.Errorf("cannot modify frozen list")
+			}
+			var index any = -1
+			if len(args) == 1 {
+				index = args[0]
+			}
+			i, err := starIndex(index, len(list.elems))
+			if err != nil {
+				return nil, err
+			}
+			v := list.elems[i]
+			list.elems = slices.Delete(list.elems, i, i+1)
+			return v, nil
+		},
+		"index": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("index", args, kwargs, 1, 1); err != nil {
+				return nil, err
+			}
+			if i := slices.IndexFunc(recv.(*starList).elems, func(elem any) bool { return starEqual(elem, args[0]) }); i >= 0 {
+				return i, nil
+			}
+			return nil, fmt.Errorf("%s not in list", starRepr(args[0]))
+		},
+	}
+
+	starDictMethods = map[string]starMethod{
+		"get": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("get", args, kwargs, 1, 2); err != nil {
+				return nil, err
+			}
+			if v, ok := recv.(*starDict).get(args[0]); ok {
+				return v, nil
+			}
+			if len(args) == 2 {
+				return args[1], nil
+			}
+			return nil, nil
+		},
+		"keys": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			return &starList{elems: slices.Clone(recv.(*starDict).keys)}, starArgs("keys", args, kwargs, 0, 0)
+		},
+		"values": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			dict := recv.(*starDict)
+			list := &starList{}
+			for _, key := range dict.keys {
+				list.elems = append(list.elems, dict.entries[key])
+			}
+			return list, starArgs("values", args, kwargs, 0, 0)
+		},
+		"items": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			dict := recv.(*starDict)
+			list := &starList{}
+			for _, key := range dict.keys {
+				list.elems = append(list.elems, starTuple{key, dict.entries[key]})
+			}
+			return list, starArgs("items", args, kwargs, 0, 0)
+		},
+		"setdefault": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("setdefault", args, kwargs, 1, 2); err != nil {
+				return nil, err
+			}
+			dict := recv.(*starDict)
+			if v, ok := dict.get(args[0]); ok {
+				return v, nil
+			}
+			var def any
+			if len(args) == 2 {
+				def = args[1]
+			}
+			return def, dict.set(args[0], def)
+		},
+		"pop": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if err := starArgs("pop", args, kwargs, 1, 2); err != nil {
+				return nil, err
+			}
+			dict := recv.(*starDict)
+			if dict.frozen {
+				return nil, fmt.Errorf("cannot modify frozen dict")
+			}
+			v, ok := dict.get(args[0])
+			if !ok {
+				if len(args) == 2 {
+					return args[1], nil
+				}
+				return nil, fmt.Errorf("key %s not in dict", starRepr(args[0]))
+			}
+			key := dictKey(args[0])
+			delete(dict.entries, key)
+			dict.keys = slices.DeleteFunc(dict.keys, func(k any) bool { return k == key })
+			return v, nil
+		},
+		"update": func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+			if len(args) > 1 {
+				return nil, fmt.Errorf("update() takes at most 1 argument, got %d", len(args))
+			}
+			dict := recv.(*starDict)
+			if len(args) == 1 {
+				if err := starDictUpdate(dict, args[0]); err != nil {
+					return nil, err
+				}
+			}
+			for _, kw := range slices.Sorted(maps.Keys(kwargs)) {
+				if err := dict.set(kw, kwargs[kw]); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		},
+	}
+}
+
+// starDictUpdate sets the entries of a dict, or of a sequence of pairs, in
+// dict
+func starDictUpdate(dict *starDict, from any) error {
+	if other, ok := from.(*starDict); ok {
+		for _, key := range other.keys {
+			if err := dict.set(key, other.entries[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pairs, err := starIterate(from)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		kv, err := starIterate(pair)
+		if err != nil || len(kv) != 2 {
+			return fmt.Errorf("dict update needs pairs, not %s", starType(pair))
+		}
+		if err := dict.set(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stringMethod0(fn func(string) string) starMethod {
+	return func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+		if len(args) > 0 || len(kwargs) > 0 {
+			return nil, fmt.Errorf("method takes no arguments")
+		}
+		return fn(recv.(string)), nil
+	}
+}
+
+func stringMethod1(name string, fn func(s, arg string) (any, error)) starMethod {
+	return func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs(name, args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		arg, err := starString(name, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(recv.(string), arg)
+	}
+}
+
+func stringTest(fn func(rune) bool) starMethod {
+	return func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+		s := recv.(string)
+		for _, r := range s {
+			if !fn(r) {
+				return false, nil
+			}
+		}
+		return s != "", nil
+	}
+}
+
+// stringStrip makes strip and its variants, which strip the characters
+// given or else white space
+func stringStrip(trim func(s, cutset string) string, trimSpace func(string) string) starMethod {
+	return func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs("strip", args, kwargs, 0, 1); err != nil {
+			return nil, err
+		}
+		if len(args) == 0 || args[0] == nil {
+			return trimSpace(recv.(string)), nil
+		}
+		cutset, err := starString("strip", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return trim(recv.(string), cutset), nil
+	}
+}
+
+// stringAffix makes startswith and endswith, which take a string or a tuple
+// of strings
+func stringAffix(name string, has func(s, affix string) bool) starMethod {
+	return func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs(name, args, kwargs, 1, 1); err != nil {
+			return nil, err
+		}
+		affixes := []any{args[0]}
+		if tuple, ok := args[0].(starTuple); ok {
+			affixes = tuple
+		}
+		for _, affix := range affixes {
+			s, err := starString(name, affix)
+			if err != nil {
+				return nil, err
+			}
+			if has(recv.(string), s) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+func stringPartition(name string, cut func(s, sep string) (before, after string, found bool)) starMethod {
+	return stringMethod1(name, func(s, sep string) (any, error) {
+		if sep == "" {
+			return nil, fmt.Errorf("%s() needs a separator", name)
+		}
+		before, after, found := cut(s, sep)
+		if !found {
+			if name == "rpartition" {
+				return starTuple{"", "", s}, nil
+			}
+			return starTuple{s, "", ""}, nil
+		}
+		return starTuple{before, sep, after}, nil
+	})
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// stringSplit makes split and rsplit, which split at a separator or else
+// at runs of white space, at most maxsplit times
+func stringSplit(name string, fromEnd bool) starMethod {
+	return func(th *starThread, recv any, args []any, kwargs map[string]any) (any, error) {
+		if err := starArgs(name, args, kwargs, 0, 2, "sep", "maxsplit"); err != nil {
+			return nil, err
+		}
+		var sep, maxsplit any = nil, -1
+		if len(args) > 0 {
+			sep = args[0]
+		} else if v, ok := kwargs["sep"]; ok {
+			sep = v
+		}
+		if len(args) > 1 {
+			maxsplit = args[1]
+		} else if v, ok := kwargs["maxsplit"]; ok {
+			maxsplit = v
+		}
+		n, err := starInt(name, maxsplit)
+		if err != nil {
+			return nil, err
+		}
+		s := recv.(string)
+		var parts []string
+		if sep == nil {
+			parts = strings.Fields(s)
+			if n >= 0 && len(parts) > n+1 {
+				// Keep the rest of the string whole, white space included
+				if fromEnd {
+					rest := s
+					for range n {
+						rest = strings.TrimRightFunc(rest, unicode.IsSpace)
+						rest = rest[:strings.LastIndexFunc(rest, unicode.IsSpace)+1]
+					}
+					parts = append([]string{strings.TrimSpace(rest)}, parts[len(parts)-n:]...)
+				} else {
+					rest := s
+					for range n {
+						rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+						rest = rest[strings.IndexFunc(rest, unicode.IsSpace):]
+					}
+					parts = append(parts[:n], strings.TrimSpace(rest))
+				}
+			}
+		} else {
+			sepStr, err := starString(name, sep)
+			if err != nil {
+				return nil, err
+			}
+			if sepStr == "" {
+				return nil, fmt.Errorf("%s() needs a non-empty separator", name)
+			}
+			switch {
+			case n < 0:
+				parts = strings.Split(s, sepStr)
+			case fromEnd:
+				parts = strings.Split(s, sepStr)
+				if len(parts) > n+1 {
+					head := strings.Join(parts[:len(parts)-n], sepStr)
+					parts = append([]string{head}, parts[len(parts)-n:]...)
+				}
+			default:
+				parts = strings.SplitN(s, sepStr, n+1)
+			}
+		}
+		list := &starList{elems: make([]any, len(parts))}
+		for i, part := range parts {
+			list.elems[i] = part
+		}
+		return list, nil
+	}
+}
+
+func starTitle(s string) string {
+	var b strings.Builder
+	prev := ' '
+	for _, r := range s {
+		if unicode.IsLetter(prev) {
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func starCapitalize(s string) string {
+	for i, r := range s {
+		return string(unicode.ToUpper(r)) + strings.ToLower(s[i+len(string(r)):])
+	}
+	return s
+}
+
+// starFormatBraces is str.format: {} takes the next argument, {0} the first
+// and {name} a keyword argument; {{ and }} are literal braces
+func starFormatBraces(format string, args []any, kwargs map[string]any) (string, error) {
+	var b strings.Builder
+	next := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		switch {
+		case c == '{' && strings.HasPrefix(format[i+1:], "{"), c == '}' && strings.HasPrefix(format[i+1:], "}"):
+			b.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("format: unmatched {")
+			}
+			field := format[i+1 : i+end]
+			i += end
+			if strings.ContainsAny(field, ":!") {
+				return "", fmt.Errorf("format: conversions and specs are not supported, use %% instead")
+			}
+			var v any
+			switch n, err := strconv.Atoi(field); {
+			case field == "":
+				if next == len(args) {
+					return "", fmt.Errorf("format: not enough arguments")
+				}
+				v = args[next]
+				next++
+			case err == nil:
+				if n < 0 || n >= len(args) {
+					return "", fmt.Errorf("format: no argument %d", n)
+				}
+				v = args[n]
+			default:
+				var ok bool
+				if v, ok = kwargs[field]; !ok {
+					return "", fmt.Errorf("format: no argument %s", field)
+				}
+			}
+			b.WriteString(starStr(v))
+			if err := starCheckLen(b.Len()); err != nil {
+				return "", err
+			}
+		case c == '}':
+			return "", fmt.Errorf("format: single } found")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,114 @@
+package sorter
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Usage counts the files and bytes in a directory or category
+type Usage struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (u *Usage) add(size int64) {
+	u.Files++
+	u.Bytes += size
+}
+
+// CategoryUsage is the usage of one category folder of the sorted tree
+type CategoryUsage struct {
+	Category string `json:"category"`
+	Usage
+}
+
+// Stats summarizes the inbox, sorted and delete directories
+type Stats struct {
+	Inbox      Usage           `json:"inbox"` // All inboxes together
+	Sorted     Usage           `json:"sorted"`
+	Delete     Usage           `json:"delete"`
+	Categories []CategoryUsage `json:"categories"` // Sorted by category path
+}
+
+// Index walks the sorted directory and reports how much it holds. With
+// Options.IndexFile set, it also records the full hash of every file there
+// for Verify, hashing only files that are new or changed since the last Index.
+func (s *Sorter) Index() (Usage, error) {
+	var usage Usage
+	index, err := s.collectSortedFiles(nil)
+	if err != nil {
+		return usage, err
+	}
+	for size, files := range index.bySize {
+		usage.Files += len(files)
+		usage.Bytes += size * int64(len(files))
+	}
+	if s.opts.IndexFile != "" {
+		s.failed = 0
+		if err := s.updateHashIndex(index.files(), index); err != nil {
+			return usage, err
+		}
+		if s.failed > 0 {
+			return usage, &PartialError{Failed: s.failed}
+		}
+	}
+	return usage, nil
+}
+
+// Stats gathers file counts and sizes for every directory, with the sorted
+// tree broken down by category folder
+func (s *Sorter) Stats() (*Stats, error) {
+	stats := &Stats{}
+	categories := make(map[string]*Usage)
+
+	err := walkFiles(s.opts.SortedDir, func(path string, info fs.FileInfo) {
+		stats.Sorted.add(info.Size())
+
+		category, err := filepath.Rel(s.opts.SortedDir, filepath.Dir(path))
+		if err != nil {
+			return
+		}
+		if categories[category] == nil {
+			categories[category] = &Usage{}
+		}
+		categories[category].add(info.Size())
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, inbox := range s.existingInboxes() {
+		if err := walkFiles(inbox.Dir, func(_ string, info fs.FileInfo) { stats.Inbox.add(info.Size()) }); err != nil {
+			return nil, err
+		}
+	}
+	if err := walkFiles(s.opts.DeleteDir, func(_ string, info fs.FileInfo) { stats.Delete.add(info.Size()) }); err != nil {
+		return nil, err
+	}
+
+	for category, usage := range categories {
+		stats.Categories = append(stats.Categories, CategoryUsage{Category: category, Usage: *usage})
+	}
+	sort.Slice(stats.Categories, func(i, j int) bool {
+		return stats.Categories[i].Category < stats.Categories[j].Category
+	})
+	return stats, nil
+}
+
+// walkFiles calls fn for every regular file under root; a missing root
+// simply has no files
+func walkFiles(root string, fn func(path string, info fs.FileInfo)) error {
+	if _, err := storageAt(root).Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			fn(path, info)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,112 @@
+package sorter
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of what a Sorter is doing, for telling a slow run
+// from a stuck one, say a walk or a hash hanging on a flaky network mount
+// (see Sorter.Status)
+type Status struct {
+	Running bool       `json:"running"`         // A pass of Run is in progress
+	Active  time.Time  `json:"active"`          // Last sign of progress: a file walked, read from or processed
+	Stage   string     `json:"stage,omitempty"` // Indexing, Hashing, ... as in the progress bar; empty between them
+	Since   time.Time  `json:"since"`           // When the stage started
+	Done    int        `json:"done"`            // Files the stage went through
+	Total   int        `json:"total"`           // Files it has, 0 when unknown
+	Bytes   int64      `json:"bytes"`
+	Current string     `json:"current,omitempty"` // Last file walked or processed
+	Reading []Activity `json:"reading,omitempty"` // Files being hashed, the longest first
+}
+
+// Activity is a file being worked on
+type Activity struct {
+	Path  string    `json:"path"`
+	Since time.Time `json:"since"`
+}
+
+// tracker keeps the Status of a Sorter up to date. It rides along s.ctx,
+// like the bandwidth limit, so hashing can report what it reads.
+type tracker struct {
+	mu      sync.Mutex
+	running bool
+	stage   *progress
+	current string
+	reading map[string]time.Time
+	active  atomic.Int64 // Unix nanoseconds, as reads touch it without the lock
+}
+
+type trackerKey struct{}
+
+func withTracker(ctx context.Context, t *tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// tracking returns the tracker ctx carries, or nil
+func tracking(ctx context.Context) *tracker {
+	t, _ := ctx.Value(trackerKey{}).(*tracker)
+	return t
+}
+
+// touch records a sign of progress. A nil *tracker records nothing.
+func (t *tracker) touch() {
+	if t != nil {
+		t.active.Store(time.Now().UnixNano())
+	}
+}
+
+// trackRead records that path is being read until the returned function
+// is called
+func trackRead(ctx context.Context, path string) func() {
+	t := tracking(ctx)
+	if t == nil {
+		return func() {}
+	}
+	t.touch()
+	t.mu.Lock()
+	t.reading[path] = time.Now()
+	t.mu.Unlock()
+	return func() {
+		t.touch()
+		t.mu.Lock()
+		delete(t.reading, path)
+		t.mu.Unlock()
+	}
+}
+
+// setCurrent records the file walked or processed last
+func (s *Sorter) setCurrent(path string) {
+	s.tracker.touch()
+	s.tracker.mu.Lock()
+	s.tracker.current = path
+	s.tracker.mu.Unlock()
+}
+
+// setRunning records the start or end of a pass of Run
+func (s *Sorter) setRunning(running bool) {
+	s.tracker.touch()
+	s.tracker.mu.Lock()
+	s.tracker.running = running
+	s.tracker.mu.Unlock()
+}
+
+// Status returns what the Sorter is doing right now. It may be called from
+// any goroutine, while a run is in progress.
+func (s *Sorter) Status() Status {
+	t := s.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := Status{Running: t.running, Active: time.Unix(0, t.active.Load()), Current: t.current}
+	if p := t.stage; p != nil {
+		status.Stage, status.Since, status.Done, status.Total, status.Bytes = p.label, p.start, p.done, p.total, p.bytes
+	}
+	for path, since := range t.reading {
+		status.Reading = append(status.Reading, Activity{Path: path, Since: since})
+	}
+	slices.SortFunc(status.Reading, func(a, b Activity) int { return a.Since.Compare(b.Since) })
+	return status
+}
@@ -0,0 +1,72 @@
+package sorter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pacer spreads units of work, bytes or files, to a rate per second. Work
+// that kept under the rate for a while may burst up to a second's worth.
+// A nil pacer doesn't limit anything.
+type pacer struct {
+	mu   sync.Mutex
+	rate float64   // Units per second
+	next time.Time // When the units handed out so far are paid for
+}
+
+func newPacer(rate float64) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{rate: rate}
+}
+
+// wait blocks until n units used are paid for, or ctx is done. Workers
+// sharing the pacer share its rate.
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p == nil || n <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); p.next.Before(earliest) {
+		p.next = earliest
+	}
+	p.next = p.next.Add(time.Duration(float64(n) / p.rate * float64(time.Second)))
+	delay := p.next.Sub(now)
+	p.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return abortErr(ctx)
+	}
+}
+
+// The pacer of Options.BandwidthLimit rides along the context every read
+// for hashing and copying is given (see copyBuffered)
+type bandwidthKey struct{}
+
+func withBandwidth(ctx context.Context, p *pacer) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bandwidthKey{}, p)
+}
+
+func bandwidth(ctx context.Context) *pacer {
+	p, _ := ctx.Value(bandwidthKey{}).(*pacer)
+	return p
+}
+
+// pace waits before the next file while Options.FilesPerSecond is reached
+func (s *Sorter) pace() error {
+	return s.filePacer.wait(s.ctx, 1)
+}
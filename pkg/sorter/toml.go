@@ -0,0 +1,478 @@
+package sorter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses a TOML document into the values encoding/json would
+// produce, along with the line of every value by its JSON pointer. Dates
+// and times are kept as strings.
+func parseTOML(data []byte) (any, map[string]int, error) {
+	p := &tomlParser{
+		src:     string(data),
+		at:      map[string]int{"": 1},
+		root:    make(map[string]any),
+		headers: make(map[string]bool),
+	}
+	for i, c := range p.src {
+		if c == '\n' {
+			p.lineStarts = append(p.lineStarts, i+1)
+		}
+	}
+	if err := p.parse(); err != nil {
+		return nil, nil, err
+	}
+	return p.root, p.at, nil
+}
+
+type tomlParser struct {
+	src        string
+	pos        int
+	lineStarts []int          // Offsets of the second line onwards
+	at         map[string]int // JSON pointer to the line of its value
+	root       map[string]any
+	headers    map[string]bool // Tables defined by a [header], which can't be defined twice
+}
+
+// line returns the line of the current position, from 1
+func (p *tomlParser) line() int {
+	return sort.SearchInts(p.lineStarts, p.pos+1) + 1
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return lineErrorf(p.line(), format, args...)
+}
+
+func (p *tomlParser) parse() error {
+	table, ptr := p.root, ""
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.src) {
+			return nil
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "[["):
+			table, ptr, err = p.arrayTableHeader()
+		case p.src[p.pos] == '[':
+			table, ptr, err = p.tableHeader()
+		default:
+			err = p.keyValue(table, ptr)
+		}
+		if err != nil {
+			return err
+		}
+		p.skipSpace(false)
+		if p.pos < len(p.src) && p.src[p.pos] != '\n' && !strings.HasPrefix(p.src[p.pos:], "\r\n") {
+			return p.errorf("expected the end of the line, found %q", p.rest())
+		}
+	}
+}
+
+// rest returns what is left of the current line, for messages
+func (p *tomlParser) rest() string {
+	rest, _, _ := strings.Cut(p.src[p.pos:], "\n")
+	return strings.TrimSpace(rest)
+}
+
+// skipSpace skips blanks and comments, and newlines too with lines set
+func (p *tomlParser) skipSpace(lines bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case lines && (c == '\n' || c == '\r'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// tableHeader parses [a.b] and returns the table it opens
+func (p *tomlParser) tableHeader() (map[string]any, string, error) {
+	p.pos++
+	keys, err := p.key()
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.consume("]") {
+		return nil, "", p.errorf("expected ] after the table name")
+	}
+	table, ptr, err := p.descend(p.root, "", keys)
+	if err != nil {
+		return nil, "", err
+	}
+	if p.headers[ptr] {
+		return nil, "", p.errorf("table [%s] is defined twice", strings.Join(keys, "."))
+	}
+	p.headers[ptr] = true
+	return table, ptr, nil
+}
+
+// arrayTableHeader parses [[a.b]] and returns the table it appends
+func (p *tomlParser) arrayTableHeader() (map[string]any, string, error) {
+	p.pos += 2
+	keys, err := p.key()
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.consume("]]") {
+		return nil, "", p.errorf("expected ]] after the table name")
+	}
+	parent, ptr, err := p.descend(p.root, "", keys[:len(keys)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	last := keys[len(keys)-1]
+	ptr += "/" + pointerEscaper.Replace(last)
+	var tables []any
+	switch existing := parent[last].(type) {
+	case nil:
+		p.at[ptr] = p.line()
+	case []any:
+		if !p.headers[ptr] {
+			return nil, "", p.errorf("%s is an array, not an array of tables", last)
+		}
+		tables = existing
+	default:
+		return nil, "", p.errorf("%s is already defined", last)
+	}
+	p.headers[ptr] = true
+	table := make(map[string]any)
+	ptr += "/" + strconv.Itoa(len(tables))
+	p.at[ptr] = p.line()
+	parent[last] = append(tables, table)
+	return table, ptr, nil
+}
+
+// descend follows keys from table, creating the tables missing. Arrays of
+// tables lead to their last table.
+func (p *tomlParser) descend(table map[string]any, ptr string, keys []string) (map[string]any, string, error) {
+	for _, key := range keys {
+		ptr += "/" + pointerEscaper.Replace(key)
+		switch next := table[key].(type) {
+		case nil:
+			child := make(map[string]any)
+			table[key] = child
+			p.at[ptr] = p.line()
+			table = child
+		case map[string]any:
+			table = next
+		case []any:
+			var last map[string]any
+			if len(next) > 0 {
+				last, _ = next[len(next)-1].(map[string]any)
+			}
+			if last == nil || !p.headers[ptr] {
+				return nil, "", p.errorf("%s is not a table", key)
+			}
+			table = last
+			ptr += "/" + strconv.Itoa(len(next)-1)
+		default:
+			return nil, "", p.errorf("%s is not a table", key)
+		}
+	}
+	return table, ptr, nil
+}
+
+// keyValue parses key = value into table
+func (p *tomlParser) keyValue(table map[string]any, ptr string) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	if !p.consume("=") {
+		return p.errorf("expected = after %s", strings.Join(keys, "."))
+	}
+	table, ptr, err = p.descend(table, ptr, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, ok := table[last]; ok {
+		return p.errorf("%s is defined twice", strings.Join(keys, "."))
+	}
+	p.skipSpace(false)
+	ptr += "/" + pointerEscaper.Replace(last)
+	p.at[ptr] = p.line()
+	value, err := p.value(ptr)
+	if err != nil {
+		return err
+	}
+	table[last] = value
+	return nil
+}
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+
+// key parses a possibly dotted, possibly quoted key
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("expected a key")
+		}
+		switch p.src[p.pos] {
+		case '"', '\'':
+			s, err := p.string()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, s)
+		default:
+			m := bareKey.FindString(p.src[p.pos:])
+			if m == "" {
+				return nil, p.errorf("expected a key, found %q", p.rest())
+			}
+			p.pos += len(m)
+			keys = append(keys, m)
+		}
+		p.skipSpace(false)
+		if !p.consume(".") {
+			return keys, nil
+		}
+	}
+}
+
+func (p *tomlParser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// Dates, times and date-times, which JSON has no type for
+var tomlDate = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?([Zz]|[+-]\d{2}:\d{2})?)?|\d{2}:\d{2}(:\d{2}(\.\d+)?)?)`)
+
+var tomlNumber = regexp.MustCompile(`^[+-]?[0-9A-Za-z_.+-]+`)
+
+// value parses the value at ptr
+func (p *tomlParser) value(ptr string) (any, error) {
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("expected a value")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '"' || c == '\'':
+		return p.string()
+	case c == '[':
+		return p.array(ptr)
+	case c == '{':
+		return p.inlineTable(ptr)
+	case p.consume("true"):
+		return true, nil
+	case p.consume("false"):
+		return false, nil
+	}
+	if m := tomlDate.FindString(p.src[p.pos:]); m != "" {
+		p.pos += len(m)
+		return strings.TrimSpace(m), nil
+	}
+	m := tomlNumber.FindString(p.src[p.pos:])
+	if m == "" {
+		return nil, p.errorf("expected a value, found %q", p.rest())
+	}
+	p.pos += len(m)
+	digits := strings.ReplaceAll(m, "_", "")
+	unsigned := strings.TrimLeft(digits, "+-")
+	var value any
+	var err error
+	switch {
+	case strings.HasPrefix(unsigned, "0x"), strings.HasPrefix(unsigned, "0o"), strings.HasPrefix(unsigned, "0b"):
+		value, err = strconv.ParseInt(digits, 0, 64)
+	case strings.ContainsAny(unsigned, ".eE"):
+		value, err = strconv.ParseFloat(digits, 64)
+	case len(unsigned) > 1 && unsigned[0] == '0':
+		err = strconv.ErrSyntax // No leading zeros
+	default:
+		value, err = strconv.ParseInt(digits, 10, 64)
+	}
+	if err != nil {
+		// inf and nan too, which JSON can't hold
+		return nil, p.errorf("invalid value %q", m)
+	}
+	return value, nil
+}
+
+// array parses [a, b, ...], which may span lines
+func (p *tomlParser) array(ptr string) (any, error) {
+	p.pos++
+	values := []any{}
+	for {
+		p.skipSpace(true)
+		if p.consume("]") {
+			return values, nil
+		}
+		item := ptr + "/" + strconv.Itoa(len(values))
+		p.at[item] = p.line()
+		value, err := p.value(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.skipSpace(true)
+		if !p.consume(",") {
+			p.skipSpace(true)
+			if !p.consume("]") {
+				return nil, p.errorf("expected , or ] in array")
+			}
+			return values, nil
+		}
+	}
+}
+
+// inlineTable parses {a = 1, b = "x"}
+func (p *tomlParser) inlineTable(ptr string) (any, error) {
+	p.pos++
+	table := make(map[string]any)
+	p.skipSpace(false)
+	if p.consume("}") {
+		return table, nil
+	}
+	for {
+		if err := p.keyValue(table, ptr); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.consume("}") {
+			return table, nil
+		}
+		if !p.consume(",") {
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// string parses any of the four kinds of TOML strings
+func (p *tomlParser) string() (string, error) {
+	start := p.line()
+	switch {
+	case p.consume(`"""`):
+		end := strings.Index(p.src[p.pos:], `"""`)
+		if end < 0 {
+			return "", lineErrorf(start, "unterminated string")
+		}
+		// Up to two quotes may stand right before the closing ones
+		for p.pos+end+3 < len(p.src) && p.src[p.pos+end+3] == '"' {
+			end++
+		}
+		body := strings.TrimPrefix(strings.TrimPrefix(p.src[p.pos:p.pos+end], "\r"), "\n")
+		p.pos += end + 3
+		return unescapeTOML(body, true, start)
+	case p.consume(`'''`):
+		end := strings.Index(p.src[p.pos:], `'''`)
+		if end < 0 {
+			return "", lineErrorf(start, "unterminated string")
+		}
+		for p.pos+end+3 < len(p.src) && p.src[p.pos+end+3] == '\'' {
+			end++
+		}
+		body := strings.TrimPrefix(strings.TrimPrefix(p.src[p.pos:p.pos+end], "\r"), "\n")
+		p.pos += end + 3
+		return body, nil
+	case p.consume(`'`):
+		end := strings.IndexAny(p.src[p.pos:], "'\n")
+		if end < 0 || p.src[p.pos+end] != '\'' {
+			return "", lineErrorf(start, "unterminated string")
+		}
+		body := p.src[p.pos : p.pos+end]
+		p.pos += end + 1
+		return body, nil
+	}
+	p.pos++ // The opening "
+	for i := p.pos; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case '\n':
+			return "", lineErrorf(start, "unterminated string")
+		case '"':
+			body := p.src[p.pos:i]
+			p.pos = i + 1
+			return unescapeTOML(body, false, start)
+		}
+	}
+	return "", lineErrorf(start, "unterminated string")
+}
+
+// unescapeTOML replaces the escape sequences of a basic string. In
+// multi-line strings, a backslash at the end of a line trims the line break
+// and the whitespace following it.
+func unescapeTOML(s string, multiline bool, line int) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", lineErrorf(line, "invalid escape at the end of a string")
+		}
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case 'e':
+			b.WriteByte(0x1b)
+		case '"', '\\':
+			b.WriteByte(c)
+		case 'u', 'U':
+			size := 4
+			if c == 'U' {
+				size = 8
+			}
+			if i+size >= len(s) {
+				return "", lineErrorf(line, "invalid escape \\%c", c)
+			}
+			code, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", lineErrorf(line, "invalid escape \\%c%s", c, s[i+1:i+1+size])
+			}
+			b.WriteRune(rune(code))
+			i += size
+		default:
+			rest := strings.TrimLeft(s[i:], " \t\r")
+			if multiline && strings.HasPrefix(rest, "\n") {
+				i = len(s) - len(strings.TrimLeft(rest, " \t\r\n")) - 1
+				continue
+			}
+			return "", lineErrorf(line, "invalid escape \\%c", c)
+		}
+	}
+	return b.String(), nil
+}
+
+// lineError reports where a YAML or TOML config is malformed
+type lineError struct {
+	line int
+	msg  string
+}
+
+func (e *lineError) Error() string { return fmt.Sprintf("line %d: %s", e.line, e.msg) }
+
+func lineErrorf(line int, format string, args ...any) error {
+	return &lineError{line, fmt.Sprintf(format, args...)}
+}
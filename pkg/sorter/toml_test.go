@@ -0,0 +1,97 @@
+package sorter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+		at   map[string]int // Lines of some values by JSON pointer
+	}{
+		{
+			name: "key values",
+			src:  "name = \"photos\"\ncount = 3\nratio = 0.5\non = true\nhex = 0xff\nbig = 1_000\n",
+			want: map[string]any{"name": "photos", "count": int64(3), "ratio": 0.5, "on": true, "hex": int64(255), "big": int64(1000)},
+			at:   map[string]int{"/ratio": 3},
+		},
+		{
+			name: "tables",
+			src:  "[categories.Images]\nextensions = [\"jpg\", \"png\"]\n\n[categories.Documents]\nextensions = [\n  \"pdf\", # paper\n]\n",
+			want: map[string]any{"categories": map[string]any{
+				"Images":    map[string]any{"extensions": []any{"jpg", "png"}},
+				"Documents": map[string]any{"extensions": []any{"pdf"}},
+			}},
+			at: map[string]int{"/categories/Documents/extensions": 5},
+		},
+		{
+			name: "dotted keys and inline tables",
+			src:  "a.b = 1\nsizes = {min = 1, max = \"10 MB\"}\n",
+			want: map[string]any{"a": map[string]any{"b": int64(1)}, "sizes": map[string]any{"min": int64(1), "max": "10 MB"}},
+		},
+		{
+			name: "arrays of tables",
+			src:  "[[rules]]\nname = \"invoices\"\n\n[[rules]]\nname = \"junk\"\naction = \"delete\"\n",
+			want: map[string]any{"rules": []any{
+				map[string]any{"name": "invoices"},
+				map[string]any{"name": "junk", "action": "delete"},
+			}},
+			at: map[string]int{"/rules/1": 4, "/rules/1/action": 6},
+		},
+		{
+			name: "strings",
+			src:  "basic = \"tab\\there \\u00e9\"\nliteral = 'C:\\Users'\nmulti = \"\"\"\nline one\nline two\"\"\"\nraw = '''\n\\n'''\n",
+			want: map[string]any{"basic": "tab\there é", "literal": `C:\Users`, "multi": "line one\nline two", "raw": `\n`},
+		},
+		{
+			name: "dates are strings",
+			src:  "since = 2024-01-02\n",
+			want: map[string]any{"since": "2024-01-02"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, at, err := parseTOML([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML() = %#v, want %#v", got, tt.want)
+			}
+			for ptr, line := range tt.at {
+				if at[ptr] != line {
+					t.Errorf("line of %s = %d, want %d", ptr, at[ptr], line)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"table twice", "[a]\nx = 1\n[a]\n", "line 3: table [a] is defined twice"},
+		{"key twice", "a = 1\na = 2\n", "line 2:"},
+		{"leading zero", "a = 01\n", "line 1: invalid value"},
+		{"inf", "a = inf\n", "line 1:"},
+		{"unterminated string", "a = \"b\n", "line 1:"},
+		{"bad escape", "a = \"\\q\"\n", "line 1: invalid escape"},
+		{"trailing garbage", "a = 1 b\n", "line 1: expected the end of the line"},
+		{"missing value", "a =\n", "line 1:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseTOML([]byte(tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseTOML() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
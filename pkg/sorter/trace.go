@@ -0,0 +1,316 @@
+package sorter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer records where the time of a run goes as OpenTelemetry spans, and
+// sends them over OTLP/HTTP in its JSON encoding, which collectors, Jaeger
+// and Tempo accept. Each run is a trace with a span per phase (walk, index,
+// hash, process). Every SampleEvery-th inbox file, and every file that
+// fails, also gets a span of its own, with classify and move children and
+// the file's events. Give it as Options.Tracer; the spans of a run are sent
+// when the run ends.
+type Tracer struct {
+	Endpoint    string // Base URL of the collector, e.g. http://localhost:4318
+	Service     string // service.name of the spans
+	SampleEvery int    // Trace one inbox file in this many, 1 for all and 0 for none
+	Client      *http.Client
+
+	mu    sync.Mutex
+	ended []*span // Waiting to be sent
+}
+
+func NewTracer(endpoint string) *Tracer {
+	return &Tracer{
+		Endpoint:    endpoint,
+		Service:     "sorter",
+		SampleEvery: 100,
+		Client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// sampled reports whether the i-th inbox file of a run gets a span
+func (t *Tracer) sampled(i int) bool {
+	return t != nil && t.SampleEvery > 0 && i%t.SampleEvery == 0
+}
+
+// span is one timed operation of a trace. A nil *span records nothing, as
+// do the spans of a nil *Tracer, so tracing needs no checks at call sites.
+type span struct {
+	tracer *Tracer
+	parent *span
+	trace  [16]byte
+	id     [8]byte
+	name   string
+	start  time.Time
+	attrs  []traceAttr
+	events []traceEvent
+
+	// A held span keeps its ended children until it knows whether it's
+	// sent at all
+	held     bool
+	children []*span
+
+	end time.Time
+	err error
+}
+
+type traceAttr struct {
+	key   string
+	value any // string, int, int64, float64 or bool
+}
+
+type traceEvent struct {
+	time  time.Time
+	name  string
+	attrs []traceAttr
+}
+
+// start begins the root span of a new trace
+func (t *Tracer) start(name string) *span {
+	if t == nil {
+		return nil
+	}
+	sp := &span{tracer: t, name: name, start: time.Now()}
+	rand.Read(sp.trace[:])
+	rand.Read(sp.id[:])
+	return sp
+}
+
+// child begins a span within sp
+func (sp *span) child(name string) *span {
+	if sp == nil {
+		return nil
+	}
+	child := &span{tracer: sp.tracer, parent: sp, trace: sp.trace, name: name, start: time.Now()}
+	rand.Read(child.id[:])
+	return child
+}
+
+// set adds an attribute
+func (sp *span) set(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(sp.attrs, traceAttr{key, value})
+}
+
+// addEvent records an Event at the time it happened. An error event marks
+// the span failed.
+func (sp *span) addEvent(event Event) {
+	if sp == nil {
+		return
+	}
+	if event.Type == EventError {
+		sp.err = errors.New(event.Error)
+	}
+	var attrs []traceAttr
+	for _, field := range []struct{ key, value string }{
+		{"path", event.Path},
+		{"category", event.Category},
+		{"rule", event.Rule},
+		{"duplicate_of", event.DuplicateOf},
+		{"dest", event.Dest},
+		{"reason", event.Reason},
+		{"error", event.Error},
+	} {
+		if field.value != "" {
+			attrs = append(attrs, traceAttr{field.key, field.value})
+		}
+	}
+	sp.events = append(sp.events, traceEvent{event.Time, event.Type, attrs})
+}
+
+// hold makes sp keep its ended children, to be sent with it or not at all
+func (sp *span) hold() {
+	if sp != nil {
+		sp.held = true
+	}
+}
+
+// failed reports whether an error was recorded on sp
+func (sp *span) failed() bool {
+	return sp != nil && sp.err != nil
+}
+
+// finish ends the span, marking it failed when err is set. It is sent with
+// the rest of the run, or with its parent when that is held.
+func (sp *span) finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	if err != nil {
+		sp.err = err
+	}
+	if sp.parent != nil && sp.parent.held {
+		sp.parent.children = append(sp.parent.children, sp)
+		return
+	}
+	t := sp.tracer
+	t.mu.Lock()
+	t.ended = append(t.ended, sp)
+	t.ended = append(t.ended, sp.children...)
+	t.mu.Unlock()
+}
+
+// flush sends the ended spans to the collector. They are dropped either
+// way, so a collector that is down costs a run's spans, not memory.
+func (t *Tracer) flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.ended
+	t.ended = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(t.export(spans))
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(t.Endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending traces: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sending traces: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The OTLP JSON encoding: IDs in hex, 64-bit integers and timestamps in
+// strings, enums as numbers
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Events       []otlpEvent `json:"events,omitempty"`
+	Status       otlpStatus  `json:"status"`
+}
+
+type otlpEvent struct {
+	Time       string     `json:"timeUnixNano"`
+	Name       string     `json:"name"`
+	Attributes []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+const otlpSpanKindInternal = 1
+
+func (t *Tracer) export(spans []*span) otlpTraces {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "sorter"
+	for _, sp := range spans {
+		out := otlpSpan{
+			TraceID:    hex.EncodeToString(sp.trace[:]),
+			SpanID:     hex.EncodeToString(sp.id[:]),
+			Name:       sp.name,
+			Kind:       otlpSpanKindInternal,
+			Start:      unixNano(sp.start),
+			End:        unixNano(sp.end),
+			Attributes: otlpAttrs(sp.attrs),
+			Status:     otlpStatus{Code: 1},
+		}
+		if sp.parent != nil {
+			out.ParentSpanID = hex.EncodeToString(sp.parent.id[:])
+		}
+		if sp.err != nil {
+			out.Status = otlpStatus{Code: 2, Message: sp.err.Error()}
+		}
+		for _, event := range sp.events {
+			out.Events = append(out.Events, otlpEvent{unixNano(event.time), event.name, otlpAttrs(event.attrs)})
+		}
+		scope.Spans = append(scope.Spans, out)
+	}
+
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = otlpAttrs([]traceAttr{{"service.name", t.Service}})
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttrs(attrs []traceAttr) []otlpAttr {
+	out := make([]otlpAttr, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]any
+		switch v := a.value.(type) {
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpAttr{a.key, value})
+	}
+	return out
+}
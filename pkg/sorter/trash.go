@@ -0,0 +1,36 @@
+package sorter
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+)
+
+// trashFile moves a file that would go to the delete folder to the platform
+// trash instead (see Options.Trash)
+func (s *Sorter) trashFile(src, reason, duplicateOf string) error {
+	if ok, err := s.confirm(src, "trash", reason); !ok {
+		return err
+	}
+	if s.opts.DryRun {
+		s.planMove(src, "trash", reason, "")
+		return nil
+	}
+
+	dest, err := s.moveToTrash(src)
+	if err != nil {
+		return err
+	}
+	s.journal.record(JournalEntry{Action: "trash", Src: src, Dest: dest, Reason: reason, DuplicateOf: duplicateOf})
+
+	s.log.Info("File moved to trash", "src", src, "dest", dest, "reason", reason)
+	s.emit(Event{Type: EventMoved, Path: src, Dest: cmp.Or(dest, "trash"), Reason: reason})
+	return nil
+}
+
+// removeTrashInfo removes the FreeDesktop .trashinfo file that goes with a
+// file restored from the trash, if there is one
+func removeTrashInfo(trashed string) {
+	trashDir := filepath.Dir(filepath.Dir(trashed))
+	os.Remove(filepath.Join(trashDir, "info", filepath.Base(trashed)+".trashinfo"))
+}
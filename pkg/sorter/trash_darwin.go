@@ -0,0 +1,35 @@
+//go:build darwin
+
+package sorter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// moveToTrash moves a file to ~/.Trash, numbering the name the way Finder
+// does when it is taken, and returns where it ended up. Finder's "Put Back"
+// isn't available for files trashed this way.
+func (s *Sorter) moveToTrash(src string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	trashDir := filepath.Join(home, ".Trash")
+
+	ext := filepath.Ext(src)
+	stem := strings.TrimSuffix(filepath.Base(src), ext)
+	dest := filepath.Join(trashDir, stem+ext)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = filepath.Join(trashDir, fmt.Sprintf("%s %d%s", stem, i, ext))
+	}
+	if err := s.renameFile(src, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
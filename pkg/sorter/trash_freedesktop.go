@@ -0,0 +1,68 @@
+//go:build unix && !darwin
+
+package sorter
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// moveToTrash moves a file to the home trash following the FreeDesktop.org
+// Trash specification, so file managers can restore it, and returns where
+// it ended up
+func (s *Sorter) moveToTrash(src string) (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	trashDir := filepath.Join(dataHome, "Trash")
+	for _, dir := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(trashDir, dir), 0o700); err != nil {
+			return "", err
+		}
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return "", err
+	}
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: abs}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+
+	// Names are reserved by creating the .trashinfo file exclusively
+	ext := filepath.Ext(src)
+	stem := strings.TrimSuffix(filepath.Base(src), ext)
+	name := stem + ext
+	for i := 2; ; i++ {
+		infoPath := filepath.Join(trashDir, "info", name+".trashinfo")
+		file, err := os.OpenFile(infoPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if os.IsExist(err) {
+			name = fmt.Sprintf("%s.%d%s", stem, i, ext)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = file.WriteString(info)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+
+		dest := filepath.Join(trashDir, "files", name)
+		if err == nil {
+			err = s.renameFile(src, dest)
+		}
+		if err != nil {
+			os.Remove(infoPath)
+			return "", err
+		}
+		return dest, nil
+	}
+}
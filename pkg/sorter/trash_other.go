@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package sorter
+
+import "errors"
+
+// moveToTrash has no trash to move to on this platform
+func (s *Sorter) moveToTrash(src string) (string, error) {
+	return "", errors.ErrUnsupported
+}
@@ -0,0 +1,63 @@
+//go:build windows
+
+package sorter
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var procSHFileOperationW = syscall.NewLazyDLL("shell32.dll").NewProc("SHFileOperationW")
+
+// SHFILEOPSTRUCTW
+type shFileOpStruct struct {
+	hwnd                  uintptr
+	wFunc                 uint32
+	pFrom                 *uint16
+	pTo                   *uint16
+	fFlags                uint16
+	fAnyOperationsAborted int32
+	hNameMappings         uintptr
+	lpszProgressTitle     *uint16
+}
+
+const (
+	foDelete          = 0x3
+	fofSilent         = 0x4
+	fofNoConfirmation = 0x10
+	fofAllowUndo      = 0x40
+	fofNoErrorUI      = 0x400
+	fofNoConfirmMkdir = 0x200
+	trashFileOpFlags  = fofAllowUndo | fofNoConfirmation | fofSilent | fofNoErrorUI | fofNoConfirmMkdir
+)
+
+// moveToTrash sends a file to the Recycle Bin. Windows doesn't say where
+// it ends up, so the returned path is empty.
+func (s *Sorter) moveToTrash(src string) (string, error) {
+	// The shell doesn't take \\?\ paths, so longer ones can't be recycled
+	abs, err := filepath.Abs(shortPath(src))
+	if err != nil {
+		return "", err
+	}
+	if len(abs) >= maxPath {
+		return "", fmt.Errorf("cannot move %s to the Recycle Bin: path longer than %d characters", src, maxPath-1)
+	}
+	// pFrom is a list of names ending with an empty one
+	from, err := syscall.UTF16FromString(abs)
+	if err != nil {
+		return "", err
+	}
+	from = append(from, 0)
+
+	op := shFileOpStruct{wFunc: foDelete, pFrom: &from[0], fFlags: trashFileOpFlags}
+	ret, _, _ := procSHFileOperationW.Call(uintptr(unsafe.Pointer(&op)))
+	if ret != 0 {
+		return "", fmt.Errorf("failed to move %s to the Recycle Bin (error %#x)", src, ret)
+	}
+	if op.fAnyOperationsAborted != 0 {
+		return "", fmt.Errorf("moving %s to the Recycle Bin was aborted", src)
+	}
+	return "", nil
+}
@@ -0,0 +1,260 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// DefaultUnitCategory receives the folders a UnitPolicy moves whole
+const DefaultUnitCategory = "Folders"
+
+// UnitPolicy picks inbox folders whose files only make sense together,
+// such as albums, installed software or website copies, which are moved
+// whole into its category of the sorted directory, as they are, instead of
+// having their files sorted one by one. Folders inside a unit aren't
+// looked at on their own.
+type UnitPolicy struct {
+	Category string `json:"category,omitempty"` // DefaultUnitCategory when empty
+
+	// TopLevel makes every folder directly in an inbox a unit
+	TopLevel bool `json:"top_level,omitempty"`
+
+	// Patterns are glob patterns, as filepath.Match takes them, matched
+	// against folder names, e.g. "Album - *"
+	Patterns []string `json:"patterns,omitempty"`
+
+	// Markers are names of files or folders whose presence inside a
+	// folder makes it a unit, e.g. ".keep-together"
+	Markers []string `json:"markers,omitempty"`
+}
+
+// unitDir is an inbox folder walkDir found a unit
+type unitDir struct {
+	path     string
+	category string // Where it goes, or LeaveInInbox
+	reason   string // "unit", or "project" for a project folder
+	why      string // Which setting or marker matched, for the log and events
+}
+
+// category returns where units go
+func (u *UnitPolicy) category() string {
+	if u.Category == "" {
+		return DefaultUnitCategory
+	}
+	return u.Category
+}
+
+// validate checks the category, patterns and markers of the policy
+func (u *UnitPolicy) validate() error {
+	if !filepath.IsLocal(filepath.FromSlash(u.category())) {
+		return fmt.Errorf("invalid unit category %q: must be a relative path", u.Category)
+	}
+	for _, pattern := range u.Patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid unit pattern %q: %w", pattern, err)
+		}
+	}
+	for _, marker := range u.Markers {
+		if marker == "" || marker != filepath.Base(marker) || marker == "." || marker == ".." {
+			return fmt.Errorf("invalid unit marker %q: must be a file name", marker)
+		}
+	}
+	return nil
+}
+
+// match returns why dir, a folder of the inbox root, is a unit, or "" when
+// it isn't
+func (u *UnitPolicy) match(root, dir string) (string, error) {
+	if u.TopLevel && filepath.Dir(dir) == root {
+		return "top-level", nil
+	}
+	name := filepath.Base(dir)
+	for _, pattern := range u.Patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return "pattern " + pattern, nil
+		}
+	}
+	st := storageAt(dir)
+	for _, marker := range u.Markers {
+		_, err := st.Lstat(filepath.Join(dir, marker))
+		if err == nil {
+			return "marker " + marker, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// unitFor returns the unit dir, a folder of the inbox root, is: a
+// project folder, see ProjectMarker, or one the unit policy picks. ok is
+// false when it is neither.
+func (s *Sorter) unitFor(root, dir string) (unit unitDir, ok bool, err error) {
+	if s.opts.ProjectCategory != "" {
+		marker, err := ProjectMarker(dir)
+		if err != nil {
+			return unitDir{}, false, err
+		}
+		if marker != "" {
+			return unitDir{path: dir, category: s.opts.ProjectCategory, reason: "project", why: "marker " + marker}, true, nil
+		}
+	}
+	if s.opts.Units != nil {
+		why, err := s.opts.Units.match(root, dir)
+		if err != nil {
+			return unitDir{}, false, err
+		}
+		if why != "" {
+			return unitDir{path: dir, category: s.opts.Units.category(), reason: "unit", why: why}, true, nil
+		}
+	}
+	return unitDir{}, false, nil
+}
+
+// findUnit reports whether walkDir should leave a folder of inbox to
+// moveUnits, recording it if so, or in the inbox
+func (s *Sorter) findUnit(inbox Inbox, dir string, info os.FileInfo) bool {
+	if s.opts.Units == nil && s.opts.ProjectCategory == "" {
+		return false
+	}
+	if dir == inbox.Dir || inbox.Dir == s.opts.StagingDir {
+		return false
+	}
+	unit, ok, err := s.unitFor(inbox.Dir, dir)
+	if err != nil {
+		s.log.Warn("Failed to check folder for unit markers, sorting its files", "path", dir, "err", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if unit.category == LeaveInInbox {
+		s.log.Info("Skipping project folder", "path", dir, "why", unit.why)
+		s.emit(Event{Type: EventSkipped, Path: dir, Reason: unit.reason, Detail: unit.why})
+		return true
+	}
+	// Files are still being added to a folder modified too recently
+	if s.opts.MinAge != 0 {
+		if ready := info.ModTime().Add(s.opts.MinAge); time.Now().Before(ready) {
+			s.log.Debug("Skipping recently modified folder", "path", dir, "modified", info.ModTime())
+			s.emit(Event{Type: EventSkipped, Path: dir, Reason: "too-new"})
+			if s.nextReady.IsZero() || ready.Before(s.nextReady) {
+				s.nextReady = ready
+			}
+			return true
+		}
+	}
+	s.units = append(s.units, unit)
+	return true
+}
+
+// moveUnits moves the units the last walk found. Only errors that should
+// stop the run are returned.
+func (s *Sorter) moveUnits() error {
+	units := s.units
+	s.units = nil
+	for _, unit := range units {
+		if s.stopped() || s.ctx.Err() != nil {
+			return s.aborted()
+		}
+		err := s.moveUnit(unit)
+		if errors.Is(err, ErrAborted) || s.ctx.Err() != nil {
+			return s.aborted()
+		}
+		if err != nil {
+			s.log.Error("Failed to move folder", "path", unit.path, "err", err)
+			s.emitError(unit.path, err)
+		}
+	}
+	return nil
+}
+
+// moveUnit moves a folder into its category, named as it is, with a
+// numbered suffix when the name is taken
+func (s *Sorter) moveUnit(unit unitDir) error {
+	category := unit.category
+	name := filepath.Base(unit.path)
+	dir := filepath.Join(s.opts.SortedDir, filepath.FromSlash(category))
+	dest := filepath.Join(dir, name)
+	for i := 1; s.destExists(unit.path, dest); i++ {
+		dest = filepath.Join(dir, fmt.Sprintf("%s_%d", name, i))
+	}
+
+	s.setCurrent(unit.path)
+	s.emit(Event{Type: EventFile, Path: unit.path})
+	s.log.Info("Folder is a "+unit.reason+", moving it whole", "path", unit.path, "why", unit.why)
+	s.emit(Event{Type: EventCategory, Path: unit.path, Category: category, Reason: unit.reason, Detail: unit.why})
+	if ok, err := s.confirm(unit.path, dest, unit.reason); !ok {
+		return err
+	}
+	if s.opts.DryRun {
+		s.planMove(unit.path, dest, unit.reason, "")
+		return nil
+	}
+	if err := storageAt(dir).MkdirAll(dir); err != nil {
+		return err
+	}
+	if err := s.renameTree(unit.path, dest, unit.reason); err != nil {
+		return err
+	}
+	s.log.Info("Folder moved", "src", unit.path, "dest", dest)
+	s.emit(Event{Type: EventMoved, Path: unit.path, Dest: dest, Reason: unit.reason})
+	return nil
+}
+
+// renameTree moves the folder src to dest. Where one rename can't do it,
+// across filesystems or storages, its files are moved one by one, as
+// renameFile moves them, and the emptied folders removed.
+func (s *Sorter) renameTree(src, dest, reason string) error {
+	if storageAt(src) == local && storageAt(dest) == local && !s.separateMounts(src, dest) {
+		err := renamePath(src, dest)
+		if err == nil {
+			s.journal.record(JournalEntry{Action: "move", Src: src, Dest: dest, Reason: reason})
+			return nil
+		}
+		if !isCrossDevice(err) {
+			return err
+		}
+	}
+
+	s.log.Info("Cross-device move, moving the files of the folder one by one", "src", src)
+	var dirs []string
+	err := walk(src, func(path string, info os.FileInfo, err error) error {
+		if s.ctx.Err() != nil {
+			return s.aborted()
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return storageAt(target).MkdirAll(target)
+		}
+		if err := s.renameFile(path, target); err != nil {
+			return err
+		}
+		s.journal.record(JournalEntry{Action: "move", Src: path, Dest: target, Reason: reason})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	st := storageAt(src)
+	for _, dir := range slices.Backward(dirs) {
+		if err := st.Remove(dir); err != nil {
+			return err
+		}
+		s.journal.record(JournalEntry{Action: "rmdir", Src: dir, Reason: reason})
+	}
+	return nil
+}
@@ -0,0 +1,552 @@
+package sorter
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Problem is a mistake found in a config file by CheckCategoryConfig,
+// CheckExclusions or CheckRules
+type Problem struct {
+	File    string
+	Line    int // From 1, 0 when the file couldn't be read
+	Column  int // 0 in YAML and TOML files
+	Message string
+	Warning bool // The file loads, but doesn't do what it seems to
+}
+
+// String formats a problem the way compilers do, as file:line:column: message
+func (p Problem) String() string {
+	var b strings.Builder
+	b.WriteString(p.File)
+	if p.Line > 0 {
+		fmt.Fprintf(&b, ":%d", p.Line)
+	}
+	if p.Column > 0 {
+		fmt.Fprintf(&b, ":%d", p.Column)
+	}
+	b.WriteString(": ")
+	if p.Warning {
+		b.WriteString("warning: ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// GOOS values, the keys os_specific exclusions may use
+var knownOS = []string{"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+	"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows"}
+
+// checker collects the problems of one config file. Values are located by
+// their JSON pointer (RFC 6901), e.g. "/rules/2/glob", compared without case
+// like encoding/json matches field names. YAML and TOML files are checked
+// as the JSON they convert to, the parser telling the lines of its values.
+type checker struct {
+	file     string
+	data     []byte
+	offsets  map[string]int // Lower-case pointer to the offset of its value
+	lines    map[string]int // Lower-case pointer to its line, for YAML and TOML
+	problems []Problem
+}
+
+func newChecker(file string) *checker {
+	return &checker{file: file, offsets: make(map[string]int)}
+}
+
+// load reads the config file and locates its values. It returns false,
+// having recorded the problem, when the file is unreadable or malformed.
+func (c *checker) load() bool {
+	var err error
+	if c.data, err = os.ReadFile(c.file); err != nil {
+		c.problems = append(c.problems, Problem{File: c.file, Message: err.Error()})
+		return false
+	}
+	if format := configFormat(c.file); format != "json" {
+		value, lines, err := parseConfig(c.file, c.data)
+		var lineErr *lineError
+		if errors.As(err, &lineErr) {
+			c.problems = append(c.problems, Problem{File: c.file, Line: lineErr.line, Message: "invalid " + strings.ToUpper(format) + ": " + lineErr.msg})
+			return false
+		} else if err != nil {
+			c.problems = append(c.problems, Problem{File: c.file, Message: "invalid " + strings.ToUpper(format) + ": " + err.Error()})
+			return false
+		}
+		c.lines = make(map[string]int, len(lines))
+		for ptr, line := range lines {
+			c.lines[strings.ToLower(ptr)] = line
+		}
+		if c.data, err = json.Marshal(value); err != nil {
+			c.problems = append(c.problems, Problem{File: c.file, Message: err.Error()})
+			return false
+		}
+	}
+	var syntaxErr *json.SyntaxError
+	if err := json.Unmarshal(c.data, new(any)); errors.As(err, &syntaxErr) {
+		c.problemAt(int(syntaxErr.Offset), false, "invalid JSON: %v", err)
+		return false
+	} else if err != nil {
+		c.problemAt(0, false, "invalid JSON: %v", err)
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(c.data))
+	if err := c.locate(dec, ""); err != nil {
+		c.problemAt(int(dec.InputOffset()), false, "invalid JSON: %v", err)
+		return false
+	}
+	return true
+}
+
+// locate records the offset of the value at ptr and of everything it holds
+func (c *checker) locate(dec *json.Decoder, ptr string) error {
+	// The offset is that of the end of the previous token, before the
+	// separators leading to this value
+	start := int(dec.InputOffset())
+	for start < len(c.data) && strings.IndexByte(" \t\r\n:,", c.data[start]) >= 0 {
+		start++
+	}
+	c.offsets[strings.ToLower(ptr)] = start
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		seen := make(map[string]bool)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			child := ptr + "/" + pointerEscaper.Replace(key.(string))
+			if seen[key.(string)] {
+				defer c.warnf(child, "duplicate key %q, only the last one counts", key)
+			}
+			seen[key.(string)] = true
+			if err := c.locate(dec, child); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := c.locate(dec, ptr+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+// offset returns the offset of the value at ptr, or 0 if there is none
+func (c *checker) offset(ptr string) int {
+	return c.offsets[strings.ToLower(ptr)]
+}
+
+var (
+	pointerEscaper   = strings.NewReplacer("~", "~0", "/", "~1")
+	pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+// decode unmarshals the value at ptr into v, recording the problem, after
+// prefix, if it doesn't fit
+func (c *checker) decode(ptr string, data []byte, v any, prefix string) bool {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return true
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		// The offset is that of the end of the value
+		c.problemAt(c.offset(ptr)+int(typeErr.Offset)-1, false, "%s%s", prefix, typeError(typeErr))
+	} else {
+		c.errorf(ptr, "%s%v", prefix, err)
+	}
+	return false
+}
+
+// typeError rewords a json.UnmarshalTypeError without the Go types
+func typeError(err *json.UnmarshalTypeError) string {
+	want := err.Type.Kind().String()
+	switch want {
+	case "slice", "array":
+		want = "list"
+	case "map", "struct":
+		want = "object"
+	case "int", "int64", "float64":
+		want = "number"
+	}
+	if err.Field != "" {
+		return fmt.Sprintf("%s must be a %s, not a %s", err.Field, want, err.Value)
+	}
+	return fmt.Sprintf("must be a %s, not a %s", want, err.Value)
+}
+
+func (c *checker) errorf(ptr, format string, args ...any) {
+	c.problemAt(c.offset(ptr), false, format, args...)
+}
+
+func (c *checker) warnf(ptr, format string, args ...any) {
+	c.problemAt(c.offset(ptr), true, format, args...)
+}
+
+func (c *checker) problemAt(offset int, warning bool, format string, args ...any) {
+	line, col := c.position(offset)
+	c.problems = append(c.problems, Problem{
+		File:    c.file,
+		Line:    line,
+		Column:  col,
+		Message: fmt.Sprintf(format, args...),
+		Warning: warning,
+	})
+}
+
+// position turns a byte offset into a line and a column, counted in characters
+func (c *checker) position(offset int) (line, col int) {
+	if c.lines != nil {
+		// The JSON was generated: find the value at offset, whose line the
+		// parser knows, or else that of the closest value holding it
+		at, atOffset := "", -1
+		for ptr, o := range c.offsets {
+			if o <= offset && o > atOffset {
+				at, atOffset = ptr, o
+			}
+		}
+		for {
+			if line, ok := c.lines[at]; ok || at == "" {
+				return max(line, 1), 0
+			}
+			at = at[:strings.LastIndexByte(at, '/')]
+		}
+	}
+	offset = min(max(offset, 0), len(c.data))
+	before := c.data[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	col = len([]rune(string(before[bytes.LastIndexByte(before, '\n')+1:]))) + 1
+	return line, col
+}
+
+// line returns the line of the value at ptr, for messages pointing elsewhere
+func (c *checker) line(ptr string) int {
+	line, _ := c.position(c.offset(ptr))
+	return line
+}
+
+// unknownKeys warns of the keys of the object at ptr that aren't fields of
+// the struct v, which decoding silently ignores: they are usually typos
+func (c *checker) unknownKeys(ptr string, v any) {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		known[strings.ToLower(cmp.Or(name, t.Field(i).Name))] = true
+	}
+	prefix := strings.ToLower(ptr) + "/"
+	var unknown []string
+	for p := range c.offsets {
+		key, ok := strings.CutPrefix(p, prefix)
+		if ok && !strings.Contains(key, "/") && !known[key] {
+			unknown = append(unknown, pointerUnescaper.Replace(key))
+		}
+	}
+	for _, key := range c.inFileOrder(ptr, unknown) {
+		c.warnf(ptr+"/"+pointerEscaper.Replace(key), "unknown key %q, which is ignored", key)
+	}
+}
+
+// sorted returns the problems found in the order of their lines
+func (c *checker) sorted() []Problem {
+	slices.SortStableFunc(c.problems, func(a, b Problem) int {
+		return cmp.Or(cmp.Compare(a.Line, b.Line), cmp.Compare(a.Column, b.Column))
+	})
+	return c.problems
+}
+
+// inFileOrder sorts the keys of an object under ptr in the order they are
+// written in, so of two listings of an extension the later one is reported
+func (c *checker) inFileOrder(ptr string, keys []string) []string {
+	slices.SortFunc(keys, func(a, b string) int {
+		lineA, colA := c.position(c.offset(ptr + "/" + pointerEscaper.Replace(a)))
+		lineB, colB := c.position(c.offset(ptr + "/" + pointerEscaper.Replace(b)))
+		return cmp.Or(cmp.Compare(lineA, lineB), cmp.Compare(colA, colB), strings.Compare(a, b))
+	})
+	return keys
+}
+
+// CheckCategoryConfig looks for mistakes in an extensions.json: invalid
+// JSON, extensions listed in several categories (which one a file goes to
+// would then be left to chance), broken aliases and name patterns that
+// fail or can never match
+func CheckCategoryConfig(file string) []Problem {
+	c := newChecker(file)
+	if !c.load() {
+		return c.sorted()
+	}
+	var config CategoryConfig
+	if !c.decode("", c.data, &config, "") {
+		return c.sorted()
+	}
+
+	for name := range config {
+		c.unknownKeys("/"+pointerEscaper.Replace(name), CategoryGroup{})
+	}
+	cc := &categoryChecker{
+		checker:    c,
+		extensions: make(map[string]string),
+		categories: make(map[string]string),
+		aliases:    make(map[string]string),
+		aliasAt:    make(map[string]string),
+	}
+	for _, name := range c.inFileOrder("", slices.Collect(maps.Keys(config))) {
+		cc.group("/"+pointerEscaper.Replace(name), name, config[name])
+	}
+	for _, alias := range slices.Sorted(maps.Keys(cc.aliases)) {
+		ext := cc.aliases[alias]
+		if _, ok := cc.aliases[ext]; ok {
+			c.errorf(cc.aliasAt[alias], "extension alias %q stands for %q, which is an alias itself", alias, ext)
+		}
+		if ptr, ok := cc.extensions[alias]; ok {
+			c.errorf(cc.aliasAt[alias], "extension %q is an alias of %q and also listed at line %d", alias, ext, c.line(ptr))
+		}
+	}
+	return c.sorted()
+}
+
+// categoryChecker walks a category config
+type categoryChecker struct {
+	*checker
+	extensions map[string]string // Extension to where it is listed
+	categories map[string]string // Extension to its category
+	aliases    map[string]string // Alias to the extension it stands for
+	aliasAt    map[string]string // Alias to where it is declared
+}
+
+func (cc *categoryChecker) group(ptr, category string, group CategoryGroup) {
+	for i, ext := range group.Extensions {
+		at := ptr + "/extensions/" + strconv.Itoa(i)
+		ext = normalizeExt(ext)
+		if ext == "" {
+			cc.errorf(at, "empty extension in %s", category)
+			continue
+		}
+		if prev, ok := cc.extensions[ext]; ok {
+			switch other := cc.categories[ext]; {
+			case other == category:
+				cc.warnf(at, "extension %q is listed twice in %s, see line %d", ext, category, cc.line(prev))
+			case strings.HasPrefix(category, other+string(filepath.Separator)):
+				// Subcategories are processed after their parent, and so win
+				cc.warnf(at, "extension %q is also listed in %s (line %d), where it has no effect as this subcategory wins", ext, other, cc.line(prev))
+				cc.extensions[ext], cc.categories[ext] = at, category
+			default:
+				cc.errorf(at, "extension %q is in both %s (line %d) and %s, files would go to either one", ext, other, cc.line(prev), category)
+			}
+			continue
+		}
+		cc.extensions[ext] = at
+		cc.categories[ext] = category
+	}
+	for _, alias := range cc.inFileOrder(ptr+"/aliases", slices.Collect(maps.Keys(group.Aliases))) {
+		at := ptr + "/aliases/" + pointerEscaper.Replace(alias)
+		ext := normalizeExt(group.Aliases[alias])
+		alias := normalizeExt(alias)
+		if other, ok := cc.aliases[alias]; ok && other != ext {
+			cc.errorf(at, "extension alias %q stands for both %q (line %d) and %q", alias, other, cc.line(cc.aliasAt[alias]), ext)
+			continue
+		}
+		cc.aliases[alias] = ext
+		cc.aliasAt[alias] = at
+	}
+	for i, glob := range group.Globs {
+		at := ptr + "/globs/" + strconv.Itoa(i)
+		if _, err := filepath.Match(glob, ""); err != nil {
+			cc.errorf(at, "invalid glob %q: %v", glob, err)
+		} else if strings.ContainsAny(glob, `/\`) && filepath.Base(glob) != glob {
+			cc.warnf(at, "glob %q holds a path separator, but globs only see file names", glob)
+		}
+	}
+	for i, expr := range group.Regexes {
+		if _, err := regexp.Compile(expr); err != nil {
+			cc.errorf(ptr+"/regexes/"+strconv.Itoa(i), "invalid regex: %v", err)
+		}
+	}
+	for _, name := range cc.inFileOrder(ptr+"/subcategories", slices.Collect(maps.Keys(group.Subcategories))) {
+		cc.unknownKeys(ptr+"/subcategories/"+pointerEscaper.Replace(name), CategoryGroup{})
+		cc.group(ptr+"/subcategories/"+pointerEscaper.Replace(name), filepath.Join(category, name), group.Subcategories[name])
+	}
+}
+
+// CheckExclusions looks for mistakes in an exclusion config: invalid JSON,
+// patterns that filepath.Match rejects or that can never match a name, and
+// os_specific keys that aren't operating systems
+func CheckExclusions(file string) []Problem {
+	c := newChecker(file)
+	if !c.load() {
+		return c.sorted()
+	}
+	var config ExclusionConfig
+	if !c.decode("", c.data, &config, "") {
+		return c.sorted()
+	}
+
+	c.unknownKeys("", config)
+	check := func(ptr string, patterns []string) {
+		for i, pattern := range patterns {
+			at := ptr + "/" + strconv.Itoa(i)
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				c.errorf(at, "invalid pattern %q: %v", pattern, err)
+			} else if strings.ContainsAny(pattern, `/\`) && filepath.Base(pattern) != pattern {
+				c.warnf(at, "pattern %q holds a path separator, but exclusions only see names", pattern)
+			}
+		}
+	}
+	check("/common", config.Common)
+	for _, goos := range c.inFileOrder("/os_specific", slices.Collect(maps.Keys(config.OSSpecific))) {
+		ptr := "/os_specific/" + pointerEscaper.Replace(goos)
+		if !slices.Contains(knownOS, goos) {
+			c.warnf(ptr, "%q is not an operating system name as Go knows them (such as linux, darwin or windows), so these patterns never apply", goos)
+		}
+		check(ptr, config.OSSpecific[goos])
+	}
+	return c.sorted()
+}
+
+// CheckRules looks for mistakes in a rules.json: invalid JSON or values,
+// the errors that stop the rules from loading, and rules that can never
+// match, because their own conditions contradict each other or because a
+// rule evaluated before them matches every file they would
+func CheckRules(file string) []Problem {
+	c := newChecker(file)
+	if !c.load() {
+		return c.sorted()
+	}
+	var config struct {
+		Rules []json.RawMessage `json:"rules"`
+	}
+	if !c.decode("", c.data, &config, "") {
+		return c.sorted()
+	}
+
+	c.unknownKeys("", RuleConfig{})
+	type checked struct {
+		Rule
+		ptr string
+	}
+	var rules []checked
+	for i, raw := range config.Rules {
+		ptr := "/rules/" + strconv.Itoa(i)
+		var rule Rule
+		json.Unmarshal(raw, &struct{ Name *string }{&rule.Name}) // For the messages
+		if rule.Name == "" {
+			rule.Name = "#" + strconv.Itoa(i+1)
+		}
+		name := rule.Name
+		if !c.decode(ptr, raw, &rule, "rule "+name+": ") {
+			continue
+		}
+		c.unknownKeys(ptr, Rule{})
+		rule.Name = name
+		if _, field, err := checkRule(rule); err != nil {
+			if _, ok := c.offsets[strings.ToLower(ptr+"/"+field)]; !ok {
+				field = ""
+			}
+			c.errorf(strings.TrimSuffix(ptr+"/"+field, "/"), "rule %s: %v", rule.Name, err)
+			continue
+		}
+		switch {
+		case rule.MinSize != 0 && rule.MaxSize != 0 && rule.MinSize > rule.MaxSize:
+			c.warnf(ptr, "rule %s can never match: minsize is above maxsize", rule.Name)
+		case rule.OlderThan != 0 && rule.NewerThan != 0 && rule.OlderThan >= rule.NewerThan:
+			c.warnf(ptr, "rule %s can never match: olderthan is not below newerthan", rule.Name)
+		default:
+			rules = append(rules, checked{rule, ptr})
+		}
+	}
+
+	// In evaluation order, as compileRules puts them
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority > rules[j].Priority })
+	for j, later := range rules {
+		for _, earlier := range rules[:j] {
+			if covers(earlier.Rule, later.Rule) {
+				c.warnf(later.ptr, "rule %s can never match: rule %s (line %d) is evaluated first and matches every file it would",
+					later.Name, earlier.Name, c.line(earlier.ptr))
+				break
+			}
+		}
+	}
+	return c.sorted()
+}
+
+// covers reports whether every file matching rule b also matches rule a.
+// It only looks for the plain cases: an unset condition, the same pattern,
+// or a range containing the other.
+func covers(a, b Rule) bool {
+	switch {
+	case a.Glob != "" && !strings.EqualFold(a.Glob, b.Glob) && !literalMatches(strings.ToLower(a.Glob), strings.ToLower(b.Glob), filepath.Match):
+		return false
+	case a.Regex != "" && a.Regex != b.Regex:
+		return false
+	case a.MIME != "" && a.MIME != b.MIME && !literalMatches(a.MIME, b.MIME, path.Match):
+		return false
+	case a.MinSize != 0 && b.MinSize < a.MinSize:
+		return false
+	case a.MaxSize != 0 && (b.MaxSize == 0 || b.MaxSize > a.MaxSize):
+		return false
+	case a.OlderThan != 0 && b.OlderThan < a.OlderThan:
+		return false
+	case a.NewerThan != 0 && (b.NewerThan == 0 || b.NewerThan > a.NewerThan):
+		return false
+	}
+	return true
+}
+
+// literalMatches reports whether pattern matches value when value has no
+// pattern characters of its own, and so stands for a single name
+func literalMatches(pattern, value string, match func(pattern, name string) (bool, error)) bool {
+	if value == "" || strings.ContainsAny(value, `*?[\`) {
+		return false
+	}
+	ok, _ := match(pattern, value)
+	return ok
+}
+
+// CheckScript checks that a rules script runs and defines classify(file)
+func CheckScript(file string) []Problem {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return []Problem{{File: file, Message: err.Error()}}
+	}
+	if _, err := ParseScript(file, data); err != nil {
+		var lineErr *lineError
+		if errors.As(err, &lineErr) {
+			return []Problem{{File: file, Line: lineErr.line, Message: lineErr.msg}}
+		}
+		return []Problem{{File: file, Message: err.Error()}}
+	}
+	return nil
+}
+
+// CheckClassifierModule checks that a WebAssembly classifier module decodes
+// and exports memory, alloc and classify
+func CheckClassifierModule(file string) []Problem {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return []Problem{{File: file, Message: err.Error()}}
+	}
+	if _, err := parseClassifierModule(file, data); err != nil {
+		return []Problem{{File: file, Message: err.Error()}}
+	}
+	return nil
+}
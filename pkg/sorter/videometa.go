@@ -0,0 +1,356 @@
+package sorter
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// VideoInfo is the container metadata used by video rules
+type VideoInfo struct {
+	Duration time.Duration
+	Width    int
+	Height   int
+	Codec    string // e.g. "h264", "hevc", "vp9", "av1"
+}
+
+var errNoVideoInfo = errors.New("no video metadata")
+
+// readVideoInfo probes MP4/MOV (ISO base media) and Matroska/WebM files
+func readVideoInfo(filePath string) (*VideoInfo, error) {
+	file, err := storageAt(filePath).Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, errNoVideoInfo
+	}
+	switch {
+	case string(header[4:8]) == "ftyp" || string(header[4:8]) == "moov" ||
+		string(header[4:8]) == "wide" || string(header[4:8]) == "mdat":
+		return readMP4Info(file, stat.Size())
+	case binary.BigEndian.Uint32(header) == ebmlHeaderID:
+		return readMatroskaInfo(file, stat.Size())
+	}
+	return nil, errNoVideoInfo
+}
+
+// Codec names reported for the common MP4 sample entries and Matroska codec IDs
+var videoCodecs = map[string]string{
+	"avc1": "h264", "avc3": "h264", "hvc1": "hevc", "hev1": "hevc",
+	"av01": "av1", "vp08": "vp8", "vp09": "vp9", "mp4v": "mpeg4",
+	"apch": "prores", "apcn": "prores", "apcs": "prores", "apco": "prores", "ap4h": "prores",
+	"V_MPEG4/ISO/AVC": "h264", "V_MPEGH/ISO/HEVC": "hevc", "V_AV1": "av1",
+	"V_VP8": "vp8", "V_VP9": "vp9", "V_MPEG4/ISO/ASP": "mpeg4", "V_PRORES": "prores",
+}
+
+func normalizeCodec(codec string) string {
+	if name, ok := videoCodecs[codec]; ok {
+		return name
+	}
+	return strings.ToLower(strings.TrimSpace(codec))
+}
+
+// mp4Boxes calls fn for every box between start and end
+func mp4Boxes(r io.ReaderAt, start, end int64, fn func(boxType string, data, size int64) error) error {
+	header := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(header[:8], off); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		boxType := string(header[4:8])
+		headerLen := int64(8)
+		switch size {
+		case 0: // Box extends to the end
+			size = end - off
+		case 1: // 64-bit size follows
+			if _, err := r.ReadAt(header[8:16], off+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen || off+size > end {
+			return errNoVideoInfo
+		}
+		if err := fn(boxType, off+headerLen, size-headerLen); err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+func readMP4Info(r io.ReaderAt, fileSize int64) (*VideoInfo, error) {
+	info := &VideoInfo{}
+	found := false
+
+	err := mp4Boxes(r, 0, fileSize, func(boxType string, data, size int64) error {
+		if boxType != "moov" {
+			return nil
+		}
+		found = true
+		return mp4Boxes(r, data, data+size, func(boxType string, data, size int64) error {
+			switch boxType {
+			case "mvhd":
+				info.Duration = mp4Duration(r, data, size)
+			case "trak":
+				if info.Width == 0 {
+					readMP4Track(r, data, size, info)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil || !found {
+		return nil, errNoVideoInfo
+	}
+	return info, nil
+}
+
+// mp4Duration reads the duration from a movie header box
+func mp4Duration(r io.ReaderAt, data, size int64) time.Duration {
+	buf := make([]byte, min(size, 32))
+	if _, err := r.ReadAt(buf, data); err != nil || len(buf) < 20 {
+		return 0
+	}
+	var timescale, duration uint64
+	if buf[0] == 1 { // Version 1 uses 64-bit times
+		if len(buf) < 32 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(buf[20:24]))
+		duration = binary.BigEndian.Uint64(buf[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(buf[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+}
+
+// readMP4Track fills in the resolution and codec if the track is a video track
+func readMP4Track(r io.ReaderAt, data, size int64, info *VideoInfo) {
+	var width, height int
+	var handler, codec string
+
+	var walk func(boxType string, data, size int64) error
+	walk = func(boxType string, data, size int64) error {
+		switch boxType {
+		case "tkhd": // Width and height are 16.16 fixed point at the end
+			if size >= 8 {
+				buf := make([]byte, 8)
+				if _, err := r.ReadAt(buf, data+size-8); err == nil {
+					width = int(binary.BigEndian.Uint32(buf[:4]) >> 16)
+					height = int(binary.BigEndian.Uint32(buf[4:]) >> 16)
+				}
+			}
+		case "hdlr":
+			buf := make([]byte, 4)
+			if _, err := r.ReadAt(buf, data+8); err == nil {
+				handler = string(buf)
+			}
+		case "stsd": // Version/flags, entry count, then the first entry's size and format
+			buf := make([]byte, 4)
+			if _, err := r.ReadAt(buf, data+12); err == nil {
+				codec = string(buf)
+			}
+		case "mdia", "minf", "stbl":
+			return mp4Boxes(r, data, data+size, walk)
+		}
+		return nil
+	}
+	mp4Boxes(r, data, data+size, walk)
+
+	if handler == "vide" {
+		info.Width, info.Height, info.Codec = width, height, normalizeCodec(codec)
+	}
+}
+
+// Matroska element IDs
+const (
+	ebmlHeaderID       = 0x1A45DFA3
+	mkvSegment         = 0x18538067
+	mkvInfo            = 0x1549A966
+	mkvTimecodeScale   = 0x2AD7B1
+	mkvDuration        = 0x4489
+	mkvTracks          = 0x1654AE6B
+	mkvTrackEntry      = 0xAE
+	mkvTrackType       = 0x83
+	mkvCodecID         = 0x86
+	mkvVideo           = 0xE0
+	mkvPixelWidth      = 0xB0
+	mkvPixelHeight     = 0xBA
+	mkvCluster         = 0x1F43B675
+	mkvTrackTypeVideo  = 1
+	mkvDefaultTimecode = 1000000 // Nanoseconds per timecode tick
+)
+
+var errStopWalk = errors.New("stop")
+
+// readVint reads an EBML variable length integer. IDs keep their length
+// marker bit, sizes don't; an all-ones size means "unknown".
+func readVint(r io.ReaderAt, off int64, keepMarker bool) (value uint64, length int, unknown bool, err error) {
+	buf := make([]byte, 8)
+	if _, err := r.ReadAt(buf[:1], off); err != nil {
+		return 0, 0, false, err
+	}
+	first := buf[0]
+	length = 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		if mask == 1 {
+			return 0, 0, false, errNoVideoInfo
+		}
+		length++
+	}
+	if length > 1 {
+		if _, err := r.ReadAt(buf[1:length], off+1); err != nil {
+			return 0, 0, false, err
+		}
+	}
+
+	if keepMarker {
+		value = uint64(first)
+	} else {
+		value = uint64(first & (0xFF >> length))
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(buf[i])
+		allOnes = allOnes && buf[i] == 0xFF
+	}
+	return value, length, allOnes && !keepMarker, nil
+}
+
+// ebmlElements calls fn for every element between start and end
+func ebmlElements(r io.ReaderAt, start, end int64, fn func(id uint64, data, size int64) error) error {
+	for off := start; off < end; {
+		id, idLen, _, err := readVint(r, off, true)
+		if err != nil {
+			return err
+		}
+		size, sizeLen, unknown, err := readVint(r, off+int64(idLen), false)
+		if err != nil {
+			return err
+		}
+		data := off + int64(idLen+sizeLen)
+		if unknown || data+int64(size) > end {
+			size = uint64(end - data)
+		}
+		if err := fn(id, data, int64(size)); err != nil {
+			return err
+		}
+		off = data + int64(size)
+	}
+	return nil
+}
+
+func ebmlUint(r io.ReaderAt, data, size int64) uint64 {
+	buf := make([]byte, min(size, 8))
+	r.ReadAt(buf, data)
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(r io.ReaderAt, data, size int64) float64 {
+	switch size {
+	case 4:
+		return float64(math.Float32frombits(uint32(ebmlUint(r, data, 4))))
+	case 8:
+		return math.Float64frombits(ebmlUint(r, data, 8))
+	}
+	return 0
+}
+
+func readMatroskaInfo(r io.ReaderAt, fileSize int64) (*VideoInfo, error) {
+	info := &VideoInfo{}
+	timecodeScale := uint64(mkvDefaultTimecode)
+	var duration float64
+	found := false
+
+	err := ebmlElements(r, 0, fileSize, func(id uint64, data, size int64) error {
+		if id != mkvSegment {
+			return nil
+		}
+		found = true
+		return ebmlElements(r, data, data+size, func(id uint64, data, size int64) error {
+			switch id {
+			case mkvInfo:
+				return ebmlElements(r, data, data+size, func(id uint64, data, size int64) error {
+					switch id {
+					case mkvTimecodeScale:
+						timecodeScale = ebmlUint(r, data, size)
+					case mkvDuration:
+						duration = ebmlFloat(r, data, size)
+					}
+					return nil
+				})
+			case mkvTracks:
+				return ebmlElements(r, data, data+size, func(id uint64, data, size int64) error {
+					if id == mkvTrackEntry && info.Width == 0 {
+						readMatroskaTrack(r, data, size, info)
+					}
+					return nil
+				})
+			case mkvCluster: // Media data follows; the headers are done
+				return errStopWalk
+			}
+			return nil
+		})
+	})
+	if (err != nil && err != errStopWalk) || !found {
+		return nil, errNoVideoInfo
+	}
+
+	info.Duration = time.Duration(duration * float64(timecodeScale))
+	return info, nil
+}
+
+func readMatroskaTrack(r io.ReaderAt, data, size int64, info *VideoInfo) {
+	var trackType uint64
+	var codec string
+	var width, height int
+
+	ebmlElements(r, data, data+size, func(id uint64, data, size int64) error {
+		switch id {
+		case mkvTrackType:
+			trackType = ebmlUint(r, data, size)
+		case mkvCodecID:
+			buf := make([]byte, size)
+			r.ReadAt(buf, data)
+			codec = strings.TrimRight(string(buf), "\x00")
+		case mkvVideo:
+			ebmlElements(r, data, data+size, func(id uint64, data, size int64) error {
+				switch id {
+				case mkvPixelWidth:
+					width = int(ebmlUint(r, data, size))
+				case mkvPixelHeight:
+					height = int(ebmlUint(r, data, size))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	if trackType == mkvTrackTypeVideo {
+		info.Width, info.Height, info.Codec = width, height, normalizeCodec(codec)
+	}
+}
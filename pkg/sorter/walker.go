@@ -0,0 +1,508 @@
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Function to collect the files of the sorted directory into a duplicate
+// index. Only sizes are recorded here; hashes are computed on demand. With
+// sizes set, only files of one of these sizes are kept, so the index of a
+// sorted directory of millions of files stays as small as what it's
+// checked against.
+func (s *Sorter) collectSortedFiles(sizes map[int64]bool) (*dupIndex, error) {
+	start := time.Now()
+	index := newDupIndex(s.ctx, s.hasher, s.opts.Workers, s.opts.Stop)
+	index.same = s.sameBytes
+	var totalFiles int
+	var totalBytes int64
+
+	defer func() {
+		duration := time.Since(start)
+		s.log.Info("Indexing completed",
+			"files", totalFiles,
+			"bytes", Size(totalBytes).String(),
+			"duration", duration.Round(time.Second),
+			"files_per_sec", fmt.Sprintf("%.1f", float64(totalFiles)/duration.Seconds()),
+			"bytes_per_sec", Size(float64(totalBytes)/duration.Seconds()).String(),
+		)
+	}()
+
+	// The sorted directory may not exist yet in dry-run mode
+	if _, err := storageAt(s.opts.SortedDir).Stat(s.opts.SortedDir); s.opts.DryRun && os.IsNotExist(err) {
+		s.log.Info("No files found in sorted directory")
+		return index, nil
+	}
+
+	// A single walk; the totals of the last Index, if any, give the
+	// progress an approximate percentage
+	lastFiles, lastBytes := s.lastIndexed()
+	s.log.Info("Indexing sorted directory", "dir", s.opts.SortedDir)
+	progress := s.newEstimatedProgress("Indexing", lastFiles, lastBytes)
+
+	err := walk(s.opts.SortedDir, func(filePath string, info os.FileInfo, err error) error {
+		if s.ctx.Err() != nil {
+			return s.aborted()
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip directories
+		if info.IsDir() {
+			return nil
+		}
+
+		s.setCurrent(filePath)
+		if sizes == nil || sizes[info.Size()] {
+			index.add(&indexedFile{path: filePath, size: info.Size(), modTime: info.ModTime()})
+		}
+		totalFiles++
+		totalBytes += info.Size()
+		progress.add(info.Size())
+		return nil
+	})
+
+	progress.finish()
+	if err == nil && totalFiles == 0 {
+		s.log.Info("No files found in sorted directory")
+	}
+	return index, err
+}
+
+// walkInbox returns the files of every inbox that pass every filter, in
+// walk order
+func (s *Sorter) walkInbox() ([]*indexedFile, error) {
+	var candidates []*indexedFile
+	s.nextReady = time.Time{}
+	s.units = nil
+
+	for _, inbox := range s.inboxes() {
+		if info, err := storageAt(inbox.Dir).Stat(inbox.Dir); err != nil || !info.IsDir() {
+			switch {
+			case s.opts.ExtractArchives && inbox.Dir == s.opts.StagingDir && os.IsNotExist(err):
+				continue // Nothing was extracted yet
+			case inbox.Dir != s.opts.InboxDir:
+				s.log.Warn("Skipping unavailable inbox", "dir", inbox.Dir, "err", err)
+				continue
+			case s.opts.DryRun && os.IsNotExist(err):
+				s.log.Info("Inbox does not exist yet, nothing to sort", "dir", inbox.Dir)
+				continue
+			}
+		}
+		found, err := s.walkDir(inbox)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, found...)
+	}
+	return s.settle(candidates), nil
+}
+
+// walkDir returns the files of one inbox that pass every filter
+func (s *Sorter) walkDir(inbox Inbox) ([]*indexedFile, error) {
+	var candidates []*indexedFile
+
+	// Walking through the inbox directory and its subdirectories
+	err := walk(inbox.Dir, func(filePath string, info os.FileInfo, err error) error {
+		if s.ctx.Err() != nil {
+			return s.aborted()
+		}
+		if err != nil {
+			return err
+		}
+		s.setCurrent(filePath)
+
+		// Skip directories or hidden files (e.g., .DS_Store)
+		if info.IsDir() {
+			dirName := info.Name()
+
+			// Check exclusion patterns first
+			for _, pattern := range inbox.ExcludeDirs {
+				matched, err := filepath.Match(pattern, dirName)
+				if err != nil {
+					s.log.Warn("Invalid exclusion pattern", "pattern", pattern, "err", err)
+					continue
+				}
+				if matched {
+					s.log.Debug("Skipping excluded directory", "path", filePath, "pattern", pattern)
+					return filepath.SkipDir
+				}
+			}
+
+			// Skip hidden directories (including .git)
+			if strings.HasPrefix(dirName, ".") {
+				s.log.Debug("Skipping hidden directory", "path", filePath)
+				return filepath.SkipDir
+			}
+
+			// Folders moved whole are left to moveUnits
+			if s.findUnit(inbox, filePath, info) {
+				return filepath.SkipDir
+			}
+
+			// Important: Return here to prevent processing directories as files
+			return nil
+		}
+
+		fileName := info.Name()
+
+		// Skip hidden files and macOS extended attributes
+		if strings.HasPrefix(fileName, ".") {
+			if runtime.GOOS == "darwin" && strings.HasPrefix(fileName, "._") {
+				s.log.Debug("Skipping macOS extended attribute file", "path", filePath)
+			}
+			return nil
+		}
+
+		// Skip excluded file patterns
+		for _, pattern := range inbox.ExcludeFiles {
+			matched, err := filepath.Match(pattern, fileName)
+			if err != nil {
+				s.log.Warn("Invalid exclusion pattern", "pattern", pattern, "err", err)
+				continue
+			}
+			if matched {
+				s.log.Debug("Skipping excluded file", "path", filePath, "pattern", pattern)
+				s.emit(Event{Type: EventSkipped, Path: filePath, Reason: "excluded"})
+				return nil
+			}
+		}
+
+		// Skip files that are empty
+		if info.Size() == 0 {
+			s.log.Debug("Skipping empty file", "path", filePath)
+			s.emit(Event{Type: EventSkipped, Path: filePath, Reason: "empty"})
+			return nil
+		}
+
+		// Skip symbolic links to avoid processing unintended files or creating loops
+		if info.Mode()&os.ModeSymlink != 0 {
+			s.log.Debug("Skipping symbolic link", "path", filePath)
+			s.emit(Event{Type: EventSkipped, Path: filePath, Reason: "symlink"})
+			return nil
+		}
+
+		// Files modified too recently may still be being written
+		if s.opts.MinAge != 0 {
+			if ready := info.ModTime().Add(s.opts.MinAge); time.Now().Before(ready) {
+				s.log.Debug("Skipping recently modified file", "path", filePath, "modified", info.ModTime())
+				s.emit(Event{Type: EventSkipped, Path: filePath, Reason: "too-new"})
+				if s.nextReady.IsZero() || ready.Before(s.nextReady) {
+					s.nextReady = ready
+				}
+				return nil
+			}
+		}
+
+		// Rules come before everything else that decides a file's fate
+		rule := s.rules.match(filePath, info)
+		if rule != nil && rule.Action == ActionSkip {
+			s.log.Info("Skipping file by rule", "path", filePath, "rule", rule.Name)
+			s.emit(Event{Type: EventSkipped, Path: filePath, Rule: rule.Name, Reason: "rule"})
+			return nil
+		}
+
+		// Files outside the size limits stay unless a rule claims them
+		if rule == nil {
+			if s.opts.MinSize != 0 && info.Size() < int64(s.opts.MinSize) {
+				s.log.Debug("Skipping file below the minimum size", "path", filePath, "size", info.Size())
+				s.emit(Event{Type: EventSkipped, Path: filePath, Size: info.Size(), Reason: "too-small"})
+				return nil
+			}
+			if s.opts.MaxSize != 0 && info.Size() > int64(s.opts.MaxSize) {
+				s.log.Debug("Skipping file above the maximum size", "path", filePath, "size", info.Size())
+				s.emit(Event{Type: EventSkipped, Path: filePath, Size: info.Size(), Reason: "too-large"})
+				return nil
+			}
+		}
+
+		candidates = append(candidates, &indexedFile{path: filePath, size: info.Size(), modTime: info.ModTime(), rule: rule})
+		return nil
+	})
+	return candidates, err
+}
+
+// Sort checks the inbox for duplicates and moves every file accordingly
+func (s *Sorter) Sort() error {
+	return s.processInbox(true)
+}
+
+// Dedupe moves inbox files that duplicate a sorted file (or an earlier inbox
+// file) to the delete folder, leaving unique files where they are
+func (s *Sorter) Dedupe() error {
+	defer s.journal.close()
+	s.applyReload()
+	return s.processInbox(false)
+}
+
+// processInbox runs duplicate detection over the inbox. Duplicates always go
+// to the delete folder; unique files are only sorted when sortUnique is set.
+// A pass cut short by Options.Stop leaves a checkpoint the next pass resumes from.
+func (s *Sorter) processInbox(sortUnique bool) (err error) {
+	previous := s.loadCheckpoint(sortUnique)
+
+	name := "dedupe"
+	if sortUnique {
+		name = "sort"
+	}
+	run := s.opts.Tracer.start(name)
+	defer func() {
+		run.finish(err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.opts.Tracer.flush(ctx); err != nil {
+			s.log.Warn("Failed to send traces", "endpoint", s.opts.Tracer.Endpoint, "err", err)
+		}
+	}()
+
+	walkSpan := run.child("walk")
+	candidates, err := s.walkInbox()
+	if err == nil && sortUnique && s.opts.ExtractArchives {
+		candidates, err = s.extractArchives(candidates)
+	}
+	walkSpan.set("files", len(candidates))
+	walkSpan.finish(err)
+	if err != nil {
+		return err
+	}
+	if sortUnique {
+		if err := s.moveUnits(); err != nil {
+			return err
+		}
+	}
+
+	// Index the sorted files that could duplicate one of them
+	sizes := make(map[int64]bool, len(candidates))
+	for _, file := range candidates {
+		sizes[file.size] = true
+	}
+	indexSpan := run.child("index")
+	index, err := s.collectSortedFiles(sizes)
+	if err != nil {
+		indexSpan.finish(err)
+		return fmt.Errorf("Error collecting sorted files: %w", err)
+	}
+	if err := s.reuseIndexedHashes(index.files()); err != nil {
+		s.log.Warn("Failed to read hash index, hashing as usual", "err", err)
+	}
+	indexSpan.set("files", len(index.files()))
+	indexSpan.finish(nil)
+	s.failed = 0
+
+	// The filter of the last Index saves reading sorted files, and learns
+	// the files sorted now
+	if filter := s.loadHashFilter(); filter != nil {
+		index.filter = &sortedFilter{filter, s}
+		defer func() {
+			if filter.changed {
+				if err := s.saveHashFilter(filter); err != nil {
+					s.log.Warn("Failed to update hash filter", "err", err)
+				}
+			}
+		}()
+	}
+
+	// Files decided before the interruption only count for later duplicates
+	if previous != nil {
+		s.log.Info("Resuming interrupted run", "processed", len(previous.Processed), "checkpoint", s.opts.CheckpointFile)
+		previous.restoreHashes(index.files())
+		previous.restoreHashes(candidates)
+		done := make(map[string]bool, len(previous.Processed))
+		for _, path := range previous.Processed {
+			done[path] = true
+		}
+		remaining := make([]*indexedFile, 0, len(candidates))
+		for _, file := range candidates {
+			if done[file.path] {
+				file.inRun = true
+				index.add(file)
+			} else {
+				remaining = append(remaining, file)
+			}
+		}
+		candidates = remaining
+	}
+	candidates = s.pairSidecars(candidates)
+
+	// Shares that go away mid-pass would fail every file left
+	shared := s.sharedDirs()
+	checked := 0
+	shareLost := func(next int) error {
+		if s.failed == checked {
+			return nil
+		}
+		checked = s.failed
+		err := lostShare(shared)
+		if err != nil {
+			s.log.Error("Network share became unavailable, stopping", "err", err)
+			s.interrupt(sortUnique, previous, index, candidates, next)
+		}
+		return err
+	}
+
+	// A file cut short by Options.Context is left for the next pass
+	halt := func(err error, next int) error {
+		if s.ctx.Err() != nil {
+			return s.interrupt(sortUnique, previous, index, candidates, next)
+		}
+		return err
+	}
+
+	// Hash concurrently whatever the duplicate checks below will need
+	hashSpan := run.child("hash")
+	index.prepare(candidates, s.newProgress)
+	hashSpan.set("files", len(candidates))
+	hashSpan.finish(s.ctx.Err())
+
+	// Time spent deciding and moving files adds up on the process span;
+	// sampled files and failed ones get spans of their own
+	process := run.child("process")
+	var classifyTime, moveTime time.Duration
+	var move *span
+	var moveStart time.Time
+	var sampled bool
+	startMove := func() {
+		move, moveStart = s.fileSpan.child("move"), time.Now()
+	}
+	endFile := func(err error) {
+		if !moveStart.IsZero() {
+			moveTime += time.Since(moveStart)
+			move.finish(err)
+			moveStart = time.Time{}
+		}
+		if sampled || err != nil || s.fileSpan.failed() {
+			s.fileSpan.finish(err)
+		}
+		s.fileSpan = nil
+	}
+	defer func() {
+		endFile(err)
+		process.set("files", len(candidates))
+		process.set("failed", s.failed)
+		process.set("classify_seconds", classifyTime.Seconds())
+		process.set("move_seconds", moveTime.Seconds())
+		process.finish(err)
+	}()
+
+	// Decide and move sequentially, in walk order, so duplicates within the
+	// run are resolved deterministically
+	defer s.opts.Metrics.setQueue(0)
+	for i, file := range candidates {
+		endFile(nil)
+		s.opts.Metrics.setQueue(len(candidates) - i)
+		if s.stopped() {
+			return s.interrupt(sortUnique, previous, index, candidates, i)
+		}
+		// The file that just failed is left for the next pass
+		if err := shareLost(i - 1); err != nil {
+			return err
+		}
+		if err := s.pace(); err != nil {
+			return halt(err, i)
+		}
+		filePath := file.path
+		s.setCurrent(filePath)
+		s.fileSpan, sampled = process.child("file"), s.opts.Tracer.sampled(i)
+		s.fileSpan.hold()
+		s.fileSpan.set("path", filePath)
+		s.fileSpan.set("size", file.size)
+
+		// Log the file being processed
+		s.log.Debug("Processing file", "path", filePath)
+		s.emit(Event{Type: EventFile, Path: filePath, Size: file.size})
+
+		if file.rule != nil && file.rule.Action == ActionDelete {
+			if sortUnique {
+				s.log.Info("Rule sends file to the delete folder", "path", filePath, "rule", file.rule.Name)
+				startMove()
+				if err := s.moveToDelete(filePath, "rule", ""); err != nil {
+					return halt(err, i)
+				}
+				if err := s.deleteSidecars(file, nil, index, sortUnique); err != nil {
+					return halt(err, i)
+				}
+			}
+			continue
+		}
+
+		classify := s.fileSpan.child("classify")
+		start := time.Now()
+		duplicate, err := index.find(file)
+		classifyTime += time.Since(start)
+		classify.finish(err)
+		if err != nil && s.ctx.Err() != nil {
+			return halt(err, i)
+		}
+		if err != nil {
+			s.log.Error("Failed to hash file", "path", filePath, "err", err)
+			s.emitError(filePath, err)
+			continue
+		}
+
+		switch {
+		case duplicate != nil && duplicate.inRun:
+			// The file has already been processed in this run
+			s.log.Info("Duplicate detected within run", "path", filePath, "duplicate_of", duplicate.path)
+			s.emit(Event{Type: EventDuplicate, Path: filePath, DuplicateOf: duplicate.path, Hash: file.full})
+			startMove()
+			if err := s.moveToDelete(filePath, "duplicate", duplicate.path); err != nil {
+				return halt(err, i)
+			}
+			if err := s.deleteSidecars(file, duplicate, index, sortUnique); err != nil {
+				return halt(err, i)
+			}
+		case duplicate != nil:
+			// If a duplicate is found, move to delete folder with metadata
+			s.log.Info("Duplicate found", "path", filePath, "duplicate_of", duplicate.path)
+			s.emit(Event{Type: EventDuplicate, Path: filePath, DuplicateOf: duplicate.path, Hash: file.full})
+			startMove()
+			if err := s.moveToDelete(filePath, "duplicate", duplicate.path); err != nil {
+				return halt(err, i)
+			}
+			if err := s.deleteSidecars(file, duplicate, index, sortUnique); err != nil {
+				return halt(err, i)
+			}
+		case sortUnique:
+			// If no duplicate, move to sorted folder and add it to the index
+			s.log.Debug("File is unique, moving to sorted folder", "path", filePath)
+			startMove()
+			dest, err := s.moveFileBasedOnExtension(filePath, file.rule)
+			if err != nil {
+				return halt(err, i)
+			}
+			if dest != "" {
+				if err := s.moveSidecars(file, dest, index); err != nil {
+					return halt(err, i)
+				}
+			}
+			if !s.opts.DryRun {
+				file.movedTo = dest
+			}
+			file.inRun = true
+			index.add(file)
+			if index.filter != nil && file.movedTo != "" && nested(file.movedTo, s.opts.SortedDir) {
+				index.filter.record(index, file)
+			}
+		default:
+			// Unique files stay in the inbox but still count for later duplicates
+			file.inRun = true
+			index.add(file)
+		}
+	}
+
+	endFile(nil)
+	if err := shareLost(len(candidates) - 1); err != nil {
+		return err
+	}
+	s.clearCheckpoint()
+	if s.failed > 0 {
+		return &PartialError{Failed: s.failed}
+	}
+	return nil
+}
@@ -0,0 +1,1224 @@
+package sorter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// A WebAssembly interpreter for classifier modules (see
+// Options.ClassifierModules). It runs the 1.0 instruction set with the extensions compilers emit by default:
+// sign extension, saturating float to int conversion, multiple values and
+// bulk memory. Modules are sandboxed: they see only the memory of their
+// instance and can import nothing but the env.log and env.abort functions.
+
+// Limits of a classifier module
+const (
+	wasmPageSize = 64 << 10
+	wasmMaxPages = 1024        // Memory of an instance, 64 MiB
+	wasmMaxFuel  = 500_000_000 // Instructions run per file
+	wasmMaxDepth = 1000        // Nested calls
+	wasmMaxStack = 1 << 20     // Operands and locals of the nested calls, 8 MiB
+)
+
+// Value types
+const (
+	wasmI32 = 0x7f
+	wasmI64 = 0x7e
+	wasmF32 = 0x7d
+	wasmF64 = 0x7c
+)
+
+// Opcodes with immediates or control flow; the others are numeric
+const (
+	opUnreachable  = 0x00
+	opNop          = 0x01
+	opBlock        = 0x02
+	opLoop         = 0x03
+	opIf           = 0x04
+	opElse         = 0x05
+	opEnd          = 0x0b
+	opBr           = 0x0c
+	opBrIf         = 0x0d
+	opBrTable      = 0x0e
+	opReturn       = 0x0f
+	opCall         = 0x10
+	opCallIndirect = 0x11
+	opDrop         = 0x1a
+	opSelect       = 0x1b
+	opSelectTyped  = 0x1c
+	opLocalGet     = 0x20
+	opLocalSet     = 0x21
+	opLocalTee     = 0x22
+	opGlobalGet    = 0x23
+	opGlobalSet    = 0x24
+	opI32Load      = 0x28
+	opI64Store32   = 0x3e
+	opMemorySize   = 0x3f
+	opMemoryGrow   = 0x40
+	opI32Const     = 0x41
+	opI64Const     = 0x42
+	opF32Const     = 0x43
+	opF64Const     = 0x44
+	opPrefixFC     = 0xfc
+
+	// 0xFC-prefixed ones, stored as 0xFC00 plus their number
+	opTruncSat   = 0xfc00 // Up to 0xfc07
+	opMemoryInit = 0xfc08
+	opDataDrop   = 0xfc09
+	opMemoryCopy = 0xfc0a
+	opMemoryFill = 0xfc0b
+)
+
+type wasmFuncType struct {
+	params, results []byte
+}
+
+func (t *wasmFuncType) equal(other *wasmFuncType) bool {
+	return bytes.Equal(t.params, other.params) && bytes.Equal(t.results, other.results)
+}
+
+func (t *wasmFuncType) String() string {
+	name := func(types []byte) string {
+		s := "("
+		for i, typ := range types {
+			if i > 0 {
+				s += ", "
+			}
+			s += wasmTypeName(typ)
+		}
+		return s + ")"
+	}
+	return name(t.params) + " -> " + name(t.results)
+}
+
+// wasmInstr is a decoded instruction. Branch targets are resolved when a
+// function is decoded, so running it needs no scanning for ends.
+type wasmInstr struct {
+	op    uint16
+	a     uint64   // Index, constant or memory offset
+	b     uint32   // Parameters of a block
+	c     uint32   // Results of a block
+	end   int32    // Index of the end of a block, loop or if
+	els   int32    // Index of the else of an if, -1 without one
+	table []uint32 // Labels of br_table, the default last
+}
+
+type wasmFunc struct {
+	typ      *wasmFuncType
+	locals   []byte // Beyond the parameters
+	code     []wasmInstr
+	maxStack int                                                     // The most operands its stack holds
+	host     func(in *wasmInstance, args []uint64) ([]uint64, error) // Imported ones
+}
+
+type wasmGlobal struct {
+	typ     byte
+	mutable bool
+	init    uint64
+}
+
+type wasmElem struct {
+	offset uint32
+	funcs  []uint32
+}
+
+type wasmData struct {
+	active bool
+	offset uint32
+	data   []byte
+}
+
+type wasmExport struct {
+	kind byte // 0 function, 1 table, 2 memory, 3 global
+	idx  uint32
+}
+
+// WasmModule is a decoded WebAssembly module, instantiated afresh for each
+// file it classifies
+type WasmModule struct {
+	name      string
+	types     []*wasmFuncType
+	funcs     []*wasmFunc // Imported ones first
+	tableSize uint32
+	elems     []wasmElem
+	memory    bool
+	memMin    uint32
+	memMax    uint32
+	globals   []wasmGlobal
+	exports   map[string]wasmExport
+	data      []wasmData
+	start     int // -1 without one
+}
+
+// wasmHostFuncs are the functions modules may import from env
+var wasmHostFuncs = map[string]struct {
+	typ wasmFuncType
+	fn  func(in *wasmInstance, args []uint64) ([]uint64, error)
+}{
+	// log(ptr, len) logs a message
+	"log": {wasmFuncType{[]byte{wasmI32, wasmI32}, nil}, func(in *wasmInstance, args []uint64) ([]uint64, error) {
+		msg, err := in.read(uint32(args[0]), uint32(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		if in.log != nil {
+			in.log(string(msg))
+		}
+		return nil, nil
+	}},
+	// abort(msg, file, line, column) is how AssemblyScript modules fail
+	"abort": {wasmFuncType{[]byte{wasmI32, wasmI32, wasmI32, wasmI32}, nil}, func(in *wasmInstance, args []uint64) ([]uint64, error) {
+		return nil, fmt.Errorf("aborted at line %d, column %d", uint32(args[2]), uint32(args[3]))
+	}},
+}
+
+// The functions a classifier module exports, besides its memory
+var (
+	wasmAllocType    = wasmFuncType{[]byte{wasmI32}, []byte{wasmI32}}
+	wasmClassifyType = wasmFuncType{[]byte{wasmI32, wasmI32}, []byte{wasmI64}}
+)
+
+// LoadClassifierModule reads a WebAssembly classifier module, checking it
+// exports what classifiers must (see Options.ClassifierModules)
+func LoadClassifierModule(path string) (*WasmModule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("failed to open classifier module: %w", err)}
+	}
+	module, err := parseClassifierModule(filepath.Base(path), data)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid classifier module %s: %w", path, err)}
+	}
+	return module, nil
+}
+
+// parseClassifierModule decodes a classifier module and checks its exports
+func parseClassifierModule(name string, data []byte) (*WasmModule, error) {
+	module, err := decodeWasmModule(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if export, ok := module.exports["memory"]; !ok || export.kind != 2 {
+		return nil, errors.New("exports no memory")
+	}
+	if _, err := module.exportedFunc("alloc", wasmAllocType); err != nil {
+		return nil, err
+	}
+	if _, err := module.exportedFunc("classify", wasmClassifyType); err != nil {
+		return nil, err
+	}
+	return module, nil
+}
+
+// decodeWasmModule decodes the binary format of a WebAssembly module
+func decodeWasmModule(name string, data []byte) (*WasmModule, error) {
+	if len(data) < 8 || !bytes.Equal(data[:4], []byte("\x00asm")) {
+		return nil, errors.New("not a WebAssembly module")
+	}
+	if version := binary.LittleEndian.Uint32(data[4:8]); version != 1 {
+		return nil, fmt.Errorf("unsupported WebAssembly version %d", version)
+	}
+	m := &WasmModule{name: name, exports: make(map[string]wasmExport), start: -1}
+	r := &wasmReader{data: data, pos: 8}
+	var funcTypes []uint32 // Types of the functions the code section defines
+	hasCode := false
+	for r.pos < len(r.data) {
+		id := r.byte()
+		size := r.u32()
+		if r.err != nil || uint64(r.pos)+uint64(size) > uint64(len(r.data)) {
+			return nil, errors.New("truncated section")
+		}
+		section := &wasmReader{data: r.data[:r.pos+int(size)], pos: r.pos}
+		r.pos += int(size)
+		var err error
+		switch id {
+		case 0: // Custom sections, such as names, don't matter
+		case 1:
+			err = m.decodeTypes(section)
+		case 2:
+			err = m.decodeImports(section)
+		case 3:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				funcTypes = append(funcTypes, section.u32())
+			}
+		case 4:
+			err = m.decodeTables(section)
+		case 5:
+			err = m.decodeMemory(section)
+		case 6:
+			err = m.decodeGlobals(section)
+		case 7:
+			err = m.decodeExports(section)
+		case 8:
+			m.start = int(section.u32())
+		case 9:
+			err = m.decodeElems(section)
+		case 10:
+			err = m.decodeCode(section, funcTypes)
+			hasCode = true
+		case 11:
+			err = m.decodeData(section)
+		case 12: // Data count, only needed by validators
+			section.u32()
+		default:
+			err = fmt.Errorf("unknown section %d", id)
+		}
+		if err == nil {
+			err = section.err
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id != 0 && section.pos != len(section.data) {
+			return nil, fmt.Errorf("section %d is longer than its contents", id)
+		}
+	}
+	if len(funcTypes) != 0 && !hasCode {
+		return nil, errors.New("functions without code")
+	}
+	for _, export := range m.exports {
+		if export.kind == 0 && int(export.idx) >= len(m.funcs) {
+			return nil, fmt.Errorf("export of unknown function %d", export.idx)
+		}
+	}
+	if m.start >= len(m.funcs) {
+		return nil, fmt.Errorf("unknown start function %d", m.start)
+	}
+	if m.start >= 0 && !m.funcs[m.start].typ.equal(&wasmFuncType{}) {
+		return nil, fmt.Errorf("start function %d has type %s, want () -> ()", m.start, m.funcs[m.start].typ)
+	}
+	for _, elem := range m.elems {
+		for _, idx := range elem.funcs {
+			if int(idx) >= len(m.funcs) {
+				return nil, fmt.Errorf("table element of unknown function %d", idx)
+			}
+		}
+	}
+	return m, nil
+}
+
+// wasmReader reads the binary format, keeping the first error
+type wasmReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wasmReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (r *wasmReader) byte() byte {
+	if r.pos >= len(r.data) {
+		r.fail("unexpected end of module")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *wasmReader) bytes(n uint32) []byte {
+	if uint64(r.pos)+uint64(n) > uint64(len(r.data)) {
+		r.fail("unexpected end of module")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+func (r *wasmReader) u32() uint32 {
+	v := r.leb(32, false)
+	return uint32(v)
+}
+
+func (r *wasmReader) s32() int32 { return int32(r.leb(32, true)) }
+
+func (r *wasmReader) s64() int64 { return int64(r.leb(64, true)) }
+
+// leb reads a LEB128 number of at most bits bits
+func (r *wasmReader) leb(bits uint, signed bool) uint64 {
+	var v uint64
+	var shift uint
+	for {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		v |= uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if signed && shift < 64 && b&0x40 != 0 {
+				v |= ^uint64(0) << shift
+			}
+			return v
+		}
+		if shift >= bits {
+			r.fail("integer too long")
+			return 0
+		}
+	}
+}
+
+func (r *wasmReader) name() string { return string(r.bytes(r.u32())) }
+
+func (r *wasmReader) valType() byte {
+	t := r.byte()
+	switch t {
+	case wasmI32, wasmI64, wasmF32, wasmF64:
+	default:
+		r.fail("unsupported value type 0x%02x", t)
+	}
+	return t
+}
+
+func (r *wasmReader) limits() (min, max uint32) {
+	max = math.MaxUint32
+	switch flags := r.byte(); flags {
+	case 0:
+		min = r.u32()
+	case 1:
+		min, max = r.u32(), r.u32()
+	default:
+		r.fail("unsupported limits 0x%02x", flags)
+	}
+	return min, max
+}
+
+func (m *WasmModule) decodeTypes(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		if form := r.byte(); form != 0x60 {
+			return fmt.Errorf("unsupported type form 0x%02x", form)
+		}
+		t := &wasmFuncType{}
+		for i := r.u32(); i > 0 && r.err == nil; i-- {
+			t.params = append(t.params, r.valType())
+		}
+		for i := r.u32(); i > 0 && r.err == nil; i-- {
+			t.results = append(t.results, r.valType())
+		}
+		m.types = append(m.types, t)
+	}
+	return nil
+}
+
+func (m *WasmModule) decodeImports(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		module, name := r.name(), r.name()
+		kind := r.byte()
+		if kind != 0 {
+			return fmt.Errorf("unsupported import %s.%s: modules can only import functions", module, name)
+		}
+		typeIdx := r.u32()
+		if int(typeIdx) >= len(m.types) {
+			return fmt.Errorf("import %s.%s of unknown type %d", module, name, typeIdx)
+		}
+		host, ok := wasmHostFuncs[name]
+		if module != "env" || !ok {
+			return fmt.Errorf("unsupported import %s.%s: modules can only import env.log and env.abort", module, name)
+		}
+		if !host.typ.equal(m.types[typeIdx]) {
+			return fmt.Errorf("import %s.%s has type %s, want %s", module, name, m.types[typeIdx], &host.typ)
+		}
+		m.funcs = append(m.funcs, &wasmFunc{typ: m.types[typeIdx], host: host.fn})
+	}
+	return nil
+}
+
+func (m *WasmModule) decodeTables(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		if m.tableSize != 0 {
+			return errors.New("more than one table")
+		}
+		if typ := r.byte(); typ != 0x70 {
+			return fmt.Errorf("unsupported table type 0x%02x", typ)
+		}
+		min, _ := r.limits()
+		if min > 1<<20 {
+			return fmt.Errorf("table of %d elements is too large", min)
+		}
+		m.tableSize = min
+	}
+	return nil
+}
+
+func (m *WasmModule) decodeMemory(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		if m.memory {
+			return errors.New("more than one memory")
+		}
+		m.memory = true
+		m.memMin, m.memMax = r.limits()
+		if m.memMin > wasmMaxPages {
+			return fmt.Errorf("needs %d pages of memory, more than the %d allowed", m.memMin, wasmMaxPages)
+		}
+	}
+	return nil
+}
+
+func (m *WasmModule) decodeGlobals(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		g := wasmGlobal{typ: r.valType(), mutable: r.byte() == 1}
+		init, err := m.constExpr(r, g.typ)
+		if err != nil {
+			return err
+		}
+		g.init = init
+		m.globals = append(m.globals, g)
+	}
+	return nil
+}
+
+// constExpr reads the constant expression of a global or segment offset,
+// which must be of type want
+func (m *WasmModule) constExpr(r *wasmReader, want byte) (uint64, error) {
+	var v uint64
+	var typ byte
+	switch op := r.byte(); op {
+	case opI32Const:
+		v, typ = uint64(uint32(r.s32())), wasmI32
+	case opI64Const:
+		v, typ = uint64(r.s64()), wasmI64
+	case opF32Const:
+		v, typ = uint64(binary.LittleEndian.Uint32(r.bytes(4))), wasmF32
+	case opF64Const:
+		v, typ = binary.LittleEndian.Uint64(r.bytes(8)), wasmF64
+	case opGlobalGet:
+		idx := r.u32()
+		if int(idx) >= len(m.globals) {
+			return 0, fmt.Errorf("constant expression of unknown global %d", idx)
+		}
+		v, typ = m.globals[idx].init, m.globals[idx].typ
+	default:
+		return 0, fmt.Errorf("unsupported constant expression 0x%02x", op)
+	}
+	if end := r.byte(); end != opEnd {
+		return 0, errors.New("unsupported constant expression")
+	}
+	if r.err == nil && typ != want {
+		return 0, fmt.Errorf("constant expression of type %s, want %s", wasmTypeName(typ), wasmTypeName(want))
+	}
+	return v, r.err
+}
+
+func (m *WasmModule) decodeExports(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		name := r.name()
+		m.exports[name] = wasmExport{kind: r.byte(), idx: r.u32()}
+	}
+	return nil
+}
+
+func (m *WasmModule) decodeElems(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		if flags := r.u32(); flags != 0 {
+			return fmt.Errorf("unsupported element segment kind %d", flags)
+		}
+		offset, err := m.constExpr(r, wasmI32)
+		if err != nil {
+			return err
+		}
+		elem := wasmElem{offset: uint32(offset)}
+		for i := r.u32(); i > 0 && r.err == nil; i-- {
+			elem.funcs = append(elem.funcs, r.u32())
+		}
+		m.elems = append(m.elems, elem)
+	}
+	return nil
+}
+
+func (m *WasmModule) decodeData(r *wasmReader) error {
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		var d wasmData
+		switch flags := r.u32(); flags {
+		case 0:
+			offset, err := m.constExpr(r, wasmI32)
+			if err != nil {
+				return err
+			}
+			d.active, d.offset = true, uint32(offset)
+		case 1: // Passive, for memory.init
+		default:
+			return fmt.Errorf("unsupported data segment kind %d", flags)
+		}
+		d.data = r.bytes(r.u32())
+		m.data = append(m.data, d)
+	}
+	return nil
+}
+
+func (m *WasmModule) decodeCode(r *wasmReader, funcTypes []uint32) error {
+	n := r.u32()
+	if int(n) != len(funcTypes) {
+		return fmt.Errorf("%d function bodies for %d functions", n, len(funcTypes))
+	}
+	// Calls may refer to functions defined later, so all get their types first
+	first := len(m.funcs)
+	for _, typeIdx := range funcTypes {
+		if int(typeIdx) >= len(m.types) {
+			return fmt.Errorf("function of unknown type %d", typeIdx)
+		}
+		m.funcs = append(m.funcs, &wasmFunc{typ: m.types[typeIdx]})
+	}
+	for i := range funcTypes {
+		size := r.u32()
+		body := &wasmReader{data: r.bytes(size)}
+		if r.err != nil {
+			return r.err
+		}
+		fn := m.funcs[first+i]
+		total := uint64(0)
+		for groups := body.u32(); groups > 0 && body.err == nil; groups-- {
+			count := body.u32()
+			typ := body.valType()
+			if total += uint64(count); total > 50_000 {
+				return fmt.Errorf("function %d has too many locals", first+i)
+			}
+			for range count {
+				fn.locals = append(fn.locals, typ)
+			}
+		}
+		code, maxStack, err := m.decodeBody(body, fn)
+		if err == nil {
+			err = body.err
+		}
+		if err != nil {
+			return fmt.Errorf("function %d: %w", first+i, err)
+		}
+		fn.code, fn.maxStack = code, maxStack
+	}
+	return nil
+}
+
+// blockType reads the type of a block
+func (m *WasmModule) blockType(r *wasmReader) (*wasmFuncType, error) {
+	switch b := r.data[min(r.pos, len(r.data)-1)]; b {
+	case 0x40:
+		r.pos++
+		return &wasmFuncType{}, nil
+	case wasmI32, wasmI64, wasmF32, wasmF64:
+		r.pos++
+		return &wasmFuncType{results: []byte{b}}, nil
+	}
+	idx := r.leb(33, true)
+	if int64(idx) < 0 || idx >= uint64(len(m.types)) {
+		return nil, fmt.Errorf("block of unknown type %d", int64(idx))
+	}
+	return m.types[idx], nil
+}
+
+// decodeBody decodes the instructions of a function, checking indices,
+// matching each block with its end and validating types as it goes (see
+// wasmValidator). It returns the most operands the function's stack holds.
+func (m *WasmModule) decodeBody(r *wasmReader, fn *wasmFunc) ([]wasmInstr, int, error) {
+	var code []wasmInstr
+	var blocks []int // Open blocks, loops and ifs
+	locals := append(slices.Clone(fn.typ.params), fn.locals...)
+	v := newWasmValidator(fn)
+	for r.err == nil {
+		if r.pos >= len(r.data) {
+			return nil, 0, errors.New("missing end")
+		}
+		op := uint16(r.byte())
+		in := wasmInstr{op: op, end: -1, els: -1}
+		var err error
+		switch {
+		case op == opBlock || op == opLoop || op == opIf:
+			var typ *wasmFuncType
+			if typ, err = m.blockType(r); err != nil {
+				return nil, 0, err
+			}
+			in.b, in.c = uint32(len(typ.params)), uint32(len(typ.results))
+			blocks = append(blocks, len(code))
+			if op == opIf {
+				if _, err := v.pop(wasmI32); err != nil {
+					return nil, 0, err
+				}
+			}
+			err = v.enter(op, typ)
+		case op == opElse:
+			if len(blocks) == 0 || code[blocks[len(blocks)-1]].op != opIf || code[blocks[len(blocks)-1]].els >= 0 {
+				return nil, 0, errors.New("else without if")
+			}
+			code[blocks[len(blocks)-1]].els = int32(len(code))
+			err = v.els()
+		case op == opEnd:
+			if err := v.end(); err != nil {
+				return nil, 0, err
+			}
+			if len(blocks) == 0 {
+				code = append(code, in)
+				if r.pos != len(r.data) {
+					return nil, 0, errors.New("code after the end of the function")
+				}
+				return code, v.max, nil
+			}
+			start := blocks[len(blocks)-1]
+			blocks = blocks[:len(blocks)-1]
+			code[start].end = int32(len(code))
+			if els := code[start].els; els >= 0 {
+				code[els].end = int32(len(code))
+			}
+		case op == opBr || op == opBrIf:
+			in.a = uint64(r.u32())
+			if in.a > uint64(len(blocks)) {
+				return nil, 0, fmt.Errorf("branch to unknown label %d", in.a)
+			}
+			if op == opBr {
+				err = v.br(uint32(in.a))
+			} else {
+				err = v.brIf(uint32(in.a))
+			}
+		case op == opBrTable:
+			for n := r.u32() + 1; n > 0 && r.err == nil; n-- {
+				label := r.u32()
+				if label > uint32(len(blocks)) {
+					return nil, 0, fmt.Errorf("branch to unknown label %d", label)
+				}
+				in.table = append(in.table, label)
+			}
+			if r.err == nil {
+				err = v.brTable(in.table)
+			}
+		case op == opReturn:
+			err = v.br(uint32(len(blocks)))
+		case op == opCall:
+			in.a = uint64(r.u32())
+			if in.a >= uint64(len(m.funcs)) {
+				return nil, 0, fmt.Errorf("call of unknown function %d", in.a)
+			}
+			typ := m.funcs[in.a].typ
+			err = v.apply(typ.params, typ.results...)
+		case op == opCallIndirect:
+			in.a = uint64(r.u32())
+			if in.a >= uint64(len(m.types)) {
+				return nil, 0, fmt.Errorf("indirect call of unknown type %d", in.a)
+			}
+			if table := r.byte(); table != 0 || m.tableSize == 0 && len(m.elems) == 0 {
+				return nil, 0, errors.New("indirect call without a table")
+			}
+			typ := m.types[in.a]
+			if _, err = v.pop(wasmI32); err == nil {
+				err = v.apply(typ.params, typ.results...)
+			}
+		case op == opSelect || op == opSelectTyped:
+			var want byte = wasmUnknown
+			if op == opSelectTyped {
+				if n := r.u32(); n != 1 {
+					return nil, 0, fmt.Errorf("select of %d types", n)
+				}
+				want = r.valType()
+			}
+			in.op = opSelect
+			var typ byte
+			if _, err = v.pop(wasmI32); err == nil {
+				if typ, err = v.pop(want); err == nil {
+					typ, err = v.pop(typ)
+					v.push(typ)
+				}
+			}
+		case op == opLocalGet || op == opLocalSet || op == opLocalTee:
+			in.a = uint64(r.u32())
+			if in.a >= uint64(len(locals)) {
+				return nil, 0, fmt.Errorf("unknown local %d", in.a)
+			}
+			switch typ := locals[in.a]; op {
+			case opLocalGet:
+				v.push(typ)
+			case opLocalSet:
+				err = v.apply([]byte{typ})
+			case opLocalTee:
+				err = v.apply([]byte{typ}, typ)
+			}
+		case op == opGlobalGet || op == opGlobalSet:
+			in.a = uint64(r.u32())
+			if in.a >= uint64(len(m.globals)) {
+				return nil, 0, fmt.Errorf("unknown global %d", in.a)
+			}
+			if op == opGlobalSet && !m.globals[in.a].mutable {
+				return nil, 0, fmt.Errorf("global %d is immutable", in.a)
+			}
+			if op == opGlobalGet {
+				v.push(m.globals[in.a].typ)
+			} else {
+				err = v.apply([]byte{m.globals[in.a].typ})
+			}
+		case op >= opI32Load && op <= opI64Store32:
+			r.u32() // Alignment, a hint
+			in.a = uint64(r.u32())
+			if !m.memory {
+				return nil, 0, errors.New("memory access without a memory")
+			}
+			err = v.memory(op)
+		case op == opMemorySize || op == opMemoryGrow:
+			r.byte()
+			if !m.memory {
+				return nil, 0, errors.New("memory access without a memory")
+			}
+			if op == opMemorySize {
+				v.push(wasmI32)
+			} else {
+				err = v.apply([]byte{wasmI32}, wasmI32)
+			}
+		case op == opI32Const:
+			in.a = uint64(uint32(r.s32()))
+			v.push(wasmI32)
+		case op == opI64Const:
+			in.a = uint64(r.s64())
+			v.push(wasmI64)
+		case op == opF32Const:
+			in.a = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+			v.push(wasmF32)
+		case op == opF64Const:
+			in.a = binary.LittleEndian.Uint64(r.bytes(8))
+			v.push(wasmF64)
+		case op == opPrefixFC:
+			sub := r.u32()
+			if sub > 0x0b {
+				return nil, 0, fmt.Errorf("unsupported instruction 0xfc %d", sub)
+			}
+			in.op = opPrefixFC<<8 | uint16(sub)
+			switch in.op {
+			case opMemoryInit:
+				in.a = uint64(r.u32())
+				r.byte()
+				if in.a >= uint64(len(m.data)) {
+					return nil, 0, fmt.Errorf("unknown data segment %d", in.a)
+				}
+			case opDataDrop:
+				in.a = uint64(r.u32())
+				if in.a >= uint64(len(m.data)) {
+					return nil, 0, fmt.Errorf("unknown data segment %d", in.a)
+				}
+			case opMemoryCopy:
+				r.byte()
+				r.byte()
+			case opMemoryFill:
+				r.byte()
+			}
+			if in.op >= opMemoryInit && !m.memory {
+				return nil, 0, errors.New("memory access without a memory")
+			}
+			switch {
+			case in.op < opMemoryInit:
+				err = v.numeric(in.op)
+			case in.op != opDataDrop:
+				err = v.apply([]byte{wasmI32, wasmI32, wasmI32})
+			}
+		case op == opUnreachable:
+			v.unreachable()
+		case op == opDrop:
+			_, err = v.pop(wasmUnknown)
+		case op == opNop:
+		case op >= 0x45 && op <= 0xc4:
+			err = v.numeric(op)
+		default:
+			return nil, 0, fmt.Errorf("unsupported instruction 0x%02x", op)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		code = append(code, in)
+	}
+	return nil, 0, r.err
+}
+
+// exportedFunc returns an exported function, checking its type
+func (m *WasmModule) exportedFunc(name string, typ wasmFuncType) (*wasmFunc, error) {
+	export, ok := m.exports[name]
+	if !ok || export.kind != 0 {
+		return nil, fmt.Errorf("exports no %s function", name)
+	}
+	fn := m.funcs[export.idx]
+	if !fn.typ.equal(&typ) {
+		return nil, fmt.Errorf("exports %s with type %s, want %s", name, fn.typ, &typ)
+	}
+	return fn, nil
+}
+
+// wasmTrap is a runtime error of a module
+type wasmTrap struct{ msg string }
+
+func (t *wasmTrap) Error() string { return "trap: " + t.msg }
+
+func trap(format string, args ...any) error { return &wasmTrap{fmt.Sprintf(format, args...)} }
+
+// wasmInstance is a module with its own memory, globals and table
+type wasmInstance struct {
+	mod      *WasmModule
+	mem      []byte
+	maxPages uint32
+	globals  []uint64
+	table    []int32 // Function indices, -1 for none
+	dropped  []bool  // Data segments dropped
+	fuel     int
+	depth    int
+	stack    int // Operands and locals the running calls hold
+	log      func(msg string)
+}
+
+// instantiate sets up an instance and runs its start function
+func (m *WasmModule) instantiate(log func(msg string)) (*wasmInstance, error) {
+	in := &wasmInstance{mod: m, log: log, fuel: wasmMaxFuel, maxPages: min(m.memMax, wasmMaxPages)}
+	if m.memory {
+		in.mem = make([]byte, int(m.memMin)*wasmPageSize)
+	}
+	in.globals = make([]uint64, len(m.globals))
+	for i, g := range m.globals {
+		in.globals[i] = g.init
+	}
+	in.table = make([]int32, m.tableSize)
+	for i := range in.table {
+		in.table[i] = -1
+	}
+	for _, elem := range m.elems {
+		if uint64(elem.offset)+uint64(len(elem.funcs)) > uint64(len(in.table)) {
+			return nil, errors.New("table elements out of bounds")
+		}
+		for i, idx := range elem.funcs {
+			in.table[int(elem.offset)+i] = int32(idx)
+		}
+	}
+	in.dropped = make([]bool, len(m.data))
+	for i, d := range m.data {
+		if !d.active {
+			continue
+		}
+		if uint64(d.offset)+uint64(len(d.data)) > uint64(len(in.mem)) {
+			return nil, errors.New("data segment out of bounds")
+		}
+		copy(in.mem[d.offset:], d.data)
+		in.dropped[i] = true
+	}
+	if m.start >= 0 {
+		if _, err := in.invoke(m.funcs[m.start], nil); err != nil {
+			return nil, err
+		}
+	}
+	// Reactor modules, such as those of wasi-sdk, initialize themselves here
+	if init, err := m.exportedFunc("_initialize", wasmFuncType{}); err == nil {
+		if _, err := in.invoke(init, nil); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// invoke calls a function from outside the module, turning any panic,
+// which validating the module should rule out, into an error
+func (in *wasmInstance) invoke(fn *wasmFunc, args []uint64) (results []uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			results, err = nil, fmt.Errorf("invalid module: %v", r)
+		}
+	}()
+	return in.call(fn, args)
+}
+
+// read returns n bytes of memory at ptr
+func (in *wasmInstance) read(ptr, n uint32) ([]byte, error) {
+	if uint64(ptr)+uint64(n) > uint64(len(in.mem)) {
+		return nil, trap("out of bounds memory access")
+	}
+	return in.mem[ptr : ptr+n], nil
+}
+
+// classify passes a request to the classify function of a classifier
+// module, returning the answer it points to
+func (in *wasmInstance) classify(req []byte) ([]byte, error) {
+	alloc, _ := in.mod.exportedFunc("alloc", wasmAllocType)
+	classify, _ := in.mod.exportedFunc("classify", wasmClassifyType)
+	results, err := in.invoke(alloc, []uint64{uint64(len(req))})
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(results[0])
+	buf, err := in.read(ptr, uint32(len(req)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	copy(buf, req)
+	if results, err = in.invoke(classify, []uint64{uint64(ptr), uint64(len(req))}); err != nil {
+		return nil, err
+	}
+	answer, err := in.read(uint32(results[0]>>32), uint32(results[0]))
+	if err != nil {
+		return nil, fmt.Errorf("classify answer: %w", err)
+	}
+	return answer, nil
+}
+
+type wasmLabel struct {
+	height int // Of the operand stack under the block's parameters
+	arity  int // Values a branch to it carries
+	cont   int // Where a branch to it continues
+}
+
+func b2i(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// call runs a function
+func (in *wasmInstance) call(fn *wasmFunc, args []uint64) ([]uint64, error) {
+	if fn.host != nil {
+		return fn.host(in, args)
+	}
+	if in.depth >= wasmMaxDepth {
+		return nil, trap("call stack exhausted")
+	}
+	// Validation bounds the operand stack of each call
+	size := len(fn.typ.params) + len(fn.locals) + fn.maxStack
+	if in.stack+size > wasmMaxStack {
+		return nil, trap("value stack exhausted")
+	}
+	in.depth++
+	in.stack += size
+	defer func() { in.depth--; in.stack -= size }()
+
+	locals := make([]uint64, len(fn.typ.params)+len(fn.locals))
+	copy(locals, args)
+	stack := make([]uint64, 0, fn.maxStack)
+	var labels []wasmLabel
+	pop := func() uint64 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	// branch jumps out to the depth-th enclosing label, returning false
+	// when that is the function itself
+	branch := func(depth int) (pc int, ok bool) {
+		if depth == len(labels) {
+			return 0, false
+		}
+		l := labels[len(labels)-1-depth]
+		copy(stack[l.height:], stack[len(stack)-l.arity:])
+		stack = stack[:l.height+l.arity]
+		labels = labels[:len(labels)-1-depth]
+		return l.cont, true
+	}
+	results := func() []uint64 {
+		return slices.Clone(stack[len(stack)-len(fn.typ.results):])
+	}
+
+	code := fn.code
+	for pc := 0; pc < len(code); {
+		in.fuel--
+		if in.fuel < 0 {
+			return nil, trap("took more than %d instructions", wasmMaxFuel)
+		}
+		ins := &code[pc]
+		pc++
+		switch ins.op {
+		case opUnreachable:
+			return nil, trap("unreachable")
+		case opNop:
+		case opBlock:
+			labels = append(labels, wasmLabel{len(stack) - int(ins.b), int(ins.c), int(ins.end) + 1})
+		case opLoop:
+			labels = append(labels, wasmLabel{len(stack) - int(ins.b), int(ins.b), pc - 1})
+		case opIf:
+			cond := uint32(pop())
+			switch {
+			case cond != 0:
+				labels = append(labels, wasmLabel{len(stack) - int(ins.b), int(ins.c), int(ins.end) + 1})
+			case ins.els >= 0:
+				labels = append(labels, wasmLabel{len(stack) - int(ins.b), int(ins.c), int(ins.end) + 1})
+				pc = int(ins.els) + 1
+			default:
+				pc = int(ins.end) + 1
+			}
+		case opElse:
+			// The end of the then branch
+			labels = labels[:len(labels)-1]
+			pc = int(ins.end) + 1
+		case opEnd:
+			if len(labels) == 0 {
+				return results(), nil
+			}
+			labels = labels[:len(labels)-1]
+		case opBr:
+			next, ok := branch(int(ins.a))
+			if !ok {
+				return results(), nil
+			}
+			pc = next
+		case opBrIf:
+			if uint32(pop()) != 0 {
+				next, ok := branch(int(ins.a))
+				if !ok {
+					return results(), nil
+				}
+				pc = next
+			}
+		case opBrTable:
+			i := uint32(pop())
+			label := ins.table[len(ins.table)-1]
+			if int(i) < len(ins.table)-1 {
+				label = ins.table[i]
+			}
+			next, ok := branch(int(label))
+			if !ok {
+				return results(), nil
+			}
+			pc = next
+		case opReturn:
+			return results(), nil
+		case opCall, opCallIndirect:
+			callee := (*wasmFunc)(nil)
+			if ins.op == opCall {
+				callee = in.mod.funcs[ins.a]
+			} else {
+				i := uint32(pop())
+				if int(i) >= len(in.table) || in.table[i] < 0 {
+					return nil, trap("undefined table element %d", i)
+				}
+				callee = in.mod.funcs[in.table[i]]
+				if !callee.typ.equal(in.mod.types[ins.a]) {
+					return nil, trap("indirect call type mismatch")
+				}
+			}
+			n := len(callee.typ.params)
+			callArgs := slices.Clone(stack[len(stack)-n:])
+			stack = stack[:len(stack)-n]
+			res, err := in.call(callee, callArgs)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, res...)
+		case opDrop:
+			pop()
+		case opSelect:
+			cond := uint32(pop())
+			b := pop()
+			if cond == 0 {
+				stack[len(stack)-1] = b
+			}
+		case opLocalGet:
+			stack = append(stack, locals[ins.a])
+		case opLocalSet:
+			locals[ins.a] = pop()
+		case opLocalTee:
+			locals[ins.a] = stack[len(stack)-1]
+		case opGlobalGet:
+			stack = append(stack, in.globals[ins.a])
+		case opGlobalSet:
+			in.globals[ins.a] = pop()
+		case opMemorySize:
+			stack = append(stack, uint64(len(in.mem)/wasmPageSize))
+		case opMemoryGrow:
+			delta := uint32(pop())
+			pages := uint32(len(in.mem) / wasmPageSize)
+			if uint64(pages)+uint64(delta) > uint64(in.maxPages) {
+				stack = append(stack, uint64(math.MaxUint32)) // -1
+				break
+			}
+			in.mem = append(in.mem, make([]byte, int(delta)*wasmPageSize)...)
+			stack = append(stack, uint64(pages))
+		case opI32Const, opI64Const, opF32Const, opF64Const:
+			stack = append(stack, ins.a)
+		case opMemoryInit:
+			n, src, dst := uint32(pop()), uint32(pop()), uint32(pop())
+			var data []byte
+			if !in.dropped[ins.a] {
+				data = in.mod.data[ins.a].data
+			}
+			if uint64(src)+uint64(n) > uint64(len(data)) || uint64(dst)+uint64(n) > uint64(len(in.mem)) {
+				return nil, trap("out of bounds memory access")
+			}
+			copy(in.mem[dst:], data[src:src+n])
+		case opDataDrop:
+			in.dropped[ins.a] = true
+		case opMemoryCopy:
+			n, src, dst := uint32(pop()), uint32(pop()), uint32(pop())
+			if uint64(src)+uint64(n) > uint64(len(in.mem)) || uint64(dst)+uint64(n) > uint64(len(in.mem)) {
+				return nil, trap("out of bounds memory access")
+			}
+			copy(in.mem[dst:dst+n], in.mem[src:src+n])
+		case opMemoryFill:
+			n, val, dst := uint32(pop()), byte(pop()), uint32(pop())
+			if uint64(dst)+uint64(n) > uint64(len(in.mem)) {
+				return nil, trap("out of bounds memory access")
+			}
+			for i := range in.mem[dst : dst+n] {
+				in.mem[dst+uint32(i)] = val
+			}
+		default:
+			var err error
+			if ins.op >= opI32Load && ins.op <= opI64Store32 {
+				stack, err = in.memoryOp(ins.op, ins.a, stack)
+			} else {
+				stack, err = wasmNumeric(ins.op, stack)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results(), nil
+}
+
+// memoryOp runs a load or store at offset plus the address on the stack
+func (in *wasmInstance) memoryOp(op uint16, offset uint64, stack []uint64) ([]uint64, error) {
+	// Access size of each load and store, 0x28 to 0x3e
+	sizes := [...]uint64{4, 8, 4, 8, 1, 1, 2, 2, 1, 1, 2, 2, 4, 4, 4, 8, 4, 8, 1, 2, 1, 2, 4}
+	size := sizes[op-opI32Load]
+	store := op >= 0x36
+	var value uint64
+	if store {
+		value = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+	addr := uint64(uint32(stack[len(stack)-1])) + offset
+	stack = stack[:len(stack)-1]
+	if addr+size > uint64(len(in.mem)) {
+		return nil, trap("out of bounds memory access")
+	}
+	mem := in.mem[addr : addr+size]
+	if store {
+		switch size {
+		case 1:
+			mem[0] = byte(value)
+		case 2:
+			binary.LittleEndian.PutUint16(mem, uint16(value))
+		case 4:
+			binary.LittleEndian.PutUint32(mem, uint32(value))
+		case 8:
+			binary.LittleEndian.PutUint64(mem, value)
+		}
+		return stack, nil
+	}
+	var v uint64
+	switch op {
+	case 0x28, 0x2a, 0x35: // i32.load, f32.load, i64.load32_u
+		v = uint64(binary.LittleEndian.Uint32(mem))
+	case 0x29, 0x2b: // i64.load, f64.load
+		v = binary.LittleEndian.Uint64(mem)
+	case 0x2c: // i32.load8_s
+		v = uint64(uint32(int32(int8(mem[0]))))
+	case 0x2d, 0x31: // i32.load8_u, i64.load8_u
+		v = uint64(mem[0])
+	case 0x2e: // i32.load16_s
+		v = uint64(uint32(int32(int16(binary.LittleEndian.Uint16(mem)))))
+	case 0x2f, 0x33: // i32.load16_u, i64.load16_u
+		v = uint64(binary.LittleEndian.Uint16(mem))
+	case 0x30: // i64.load8_s
+		v = uint64(int64(int8(mem[0])))
+	case 0x32: // i64.load16_s
+		v = uint64(int64(int16(binary.LittleEndian.Uint16(mem))))
+	case 0x34: // i64.load32_s
+		v = uint64(int64(int32(binary.LittleEndian.Uint32(mem))))
+	}
+	return append(stack, v), nil
+}
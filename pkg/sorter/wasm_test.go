@@ -0,0 +1,249 @@
+package sorter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// Helpers to put modules together by hand
+
+func wasmU32(n uint32) []byte { return binary.AppendUvarint(nil, uint64(n)) }
+
+func wasmVec(items ...[]byte) []byte {
+	return append(wasmU32(uint32(len(items))), bytes.Join(items, nil)...)
+}
+
+func wasmSection(id byte, contents []byte) []byte {
+	return append(append([]byte{id}, wasmU32(uint32(len(contents)))...), contents...)
+}
+
+func wasmName(name string) []byte { return append(wasmU32(uint32(len(name))), name...) }
+
+// wasmBytes joins the header and sections of a module
+func wasmBytes(sections ...[]byte) []byte {
+	return append([]byte("\x00asm\x01\x00\x00\x00"), bytes.Join(sections, nil)...)
+}
+
+// wasmTestFunc is a function of a test module, exported by name
+type wasmTestFunc struct {
+	name   string
+	params []byte
+	result []byte
+	body   []byte // Locals and code, without the size
+}
+
+// wasmFuncModule builds a module of funcs
+func wasmFuncModule(funcs ...wasmTestFunc) []byte {
+	var types, indices, exports, bodies [][]byte
+	for i, fn := range funcs {
+		types = append(types, append(append([]byte{0x60}, wasmVec(splitBytes(fn.params)...)...), wasmVec(splitBytes(fn.result)...)...))
+		indices = append(indices, wasmU32(uint32(i)))
+		exports = append(exports, append(append(wasmName(fn.name), 0), wasmU32(uint32(i))...))
+		bodies = append(bodies, append(wasmU32(uint32(len(fn.body))), fn.body...))
+	}
+	return wasmBytes(
+		wasmSection(1, wasmVec(types...)),
+		wasmSection(3, wasmVec(indices...)),
+		wasmSection(7, wasmVec(exports...)),
+		wasmSection(10, wasmVec(bodies...)),
+	)
+}
+
+func splitBytes(b []byte) [][]byte {
+	var out [][]byte
+	for _, c := range b {
+		out = append(out, []byte{c})
+	}
+	return out
+}
+
+var wasmTestFuncs = []wasmTestFunc{
+	// add(a, b) = a + b
+	{"add", []byte{wasmI32, wasmI32}, []byte{wasmI32}, []byte{
+		0x00,
+		opLocalGet, 0, opLocalGet, 1, 0x6a, // i32.add
+		opEnd,
+	}},
+	// fact(n) multiplies in a loop
+	{"fact", []byte{wasmI64}, []byte{wasmI64}, []byte{
+		0x01, 0x01, wasmI64,
+		opI64Const, 1, opLocalSet, 1,
+		opBlock, 0x40,
+		opLoop, 0x40,
+		opLocalGet, 0, 0x50, opBrIf, 1, // i64.eqz
+		opLocalGet, 1, opLocalGet, 0, 0x7e, opLocalSet, 1, // i64.mul
+		opLocalGet, 0, opI64Const, 1, 0x7d, opLocalSet, 0, // i64.sub
+		opBr, 0,
+		opEnd,
+		opEnd,
+		opLocalGet, 1,
+		opEnd,
+	}},
+	// sign(n) picks with if and else
+	{"sign", []byte{wasmI32}, []byte{wasmI32}, []byte{
+		0x00,
+		opLocalGet, 0, opI32Const, 0, 0x48, // i32.lt_s
+		opIf, wasmI32,
+		opI32Const, 0x7f, // -1
+		opElse,
+		opLocalGet, 0, opI32Const, 0, 0x47, // i32.ne
+		opEnd,
+		opEnd,
+	}},
+	// div(a, b) traps when b is 0
+	{"div", []byte{wasmI32, wasmI32}, []byte{wasmI32}, []byte{
+		0x00,
+		opLocalGet, 0, opLocalGet, 1, 0x6d, // i32.div_s
+		opEnd,
+	}},
+	// spin() never ends
+	{"spin", nil, nil, []byte{0x00, opLoop, 0x40, opBr, 0, opEnd, opEnd}},
+	// recurse() never returns
+	{"recurse", nil, nil, []byte{0x00, opCall, 5, opEnd}},
+	{"crash", nil, nil, []byte{0x00, opUnreachable, opEnd}},
+	// dead() adds operands that never exist, which is valid after unreachable
+	{"dead", nil, []byte{wasmI32}, []byte{0x00, opUnreachable, 0x6a, opEnd}},
+	// hog() recurses with 2000 locals a call
+	{"hog", nil, nil, []byte{0x01, 0xd0, 0x0f, wasmI32, opCall, 8, opEnd}},
+}
+
+func TestWasmInvoke(t *testing.T) {
+	module, err := decodeWasmModule("test.wasm", wasmFuncModule(wasmTestFuncs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fn   string
+		args []uint64
+		want uint64
+		err  string
+	}{
+		{fn: "add", args: []uint64{2, 3}, want: 5},
+		{fn: "add", args: []uint64{0xffffffff, 2}, want: 1},
+		{fn: "fact", args: []uint64{10}, want: 3628800},
+		{fn: "sign", args: []uint64{0xfffffffb}, want: 0xffffffff},
+		{fn: "sign", args: []uint64{0}, want: 0},
+		{fn: "sign", args: []uint64{7}, want: 1},
+		{fn: "div", args: []uint64{7, 2}, want: 3},
+		{fn: "div", args: []uint64{7, 0}, err: "integer divide by zero"},
+		{fn: "div", args: []uint64{0x80000000, 0xffffffff}, err: "integer overflow"},
+		{fn: "spin", err: "trap"},
+		{fn: "recurse", err: "call stack exhausted"},
+		{fn: "crash", err: "unreachable"},
+		{fn: "dead", err: "unreachable"},
+		{fn: "hog", err: "value stack exhausted"},
+	}
+	for _, tt := range tests {
+		in, err := module.instantiate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := module.funcs[module.exports[tt.fn].idx]
+		results, err := in.invoke(fn, tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s%v error = %v, want %q", tt.fn, tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s%v: %v", tt.fn, tt.args, err)
+			continue
+		}
+		if len(results) != 1 || results[0] != tt.want {
+			t.Errorf("%s%v = %v, want %d", tt.fn, tt.args, results, tt.want)
+		}
+	}
+}
+
+func TestWasmClassifier(t *testing.T) {
+	answer := "Documents/Papers"
+	data := wasmBytes(
+		wasmSection(1, wasmVec(
+			[]byte{0x60, 1, wasmI32, 1, wasmI32},
+			[]byte{0x60, 2, wasmI32, wasmI32, 1, wasmI64},
+		)),
+		wasmSection(3, wasmVec([]byte{0}, []byte{1})),
+		wasmSection(5, wasmVec([]byte{0x00, 1})),
+		wasmSection(7, wasmVec(
+			append(wasmName("memory"), 2, 0),
+			append(wasmName("alloc"), 0, 0),
+			append(wasmName("classify"), 0, 1),
+		)),
+		wasmSection(10, wasmVec(
+			// alloc returns 1024
+			append(wasmU32(5), 0x00, opI32Const, 0x80, 0x08, opEnd),
+			// classify returns the answer at 0
+			append(wasmU32(4), 0x00, opI64Const, byte(len(answer)), opEnd),
+		)),
+		wasmSection(11, wasmVec(append([]byte{0x00, opI32Const, 0, opEnd}, wasmName(answer)...))),
+	)
+	module, err := parseClassifierModule("classify.wasm", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := module.instantiate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := in.classify([]byte(`{"path":"/in/a.pdf"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != answer {
+		t.Errorf("classify() = %q, want %q", got, answer)
+	}
+
+	if _, err := parseClassifierModule("add.wasm", wasmFuncModule(wasmTestFuncs[0])); err == nil || !strings.Contains(err.Error(), "exports no memory") {
+		t.Errorf("module without memory: error = %v", err)
+	}
+}
+
+func TestDecodeWasmModuleErrors(t *testing.T) {
+	add := wasmTestFuncs[0]
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"not wasm", []byte("\x7fELF\x02\x01\x01\x00"), "not a WebAssembly module"},
+		{"version", []byte("\x00asm\x02\x00\x00\x00"), "unsupported WebAssembly version 2"},
+		{"truncated section", wasmBytes([]byte{1, 10, 1}), "truncated section"},
+		{"unknown section", wasmBytes(wasmSection(13, nil)), "unknown section 13"},
+		{"functions without code", wasmBytes(wasmSection(1, wasmVec([]byte{0x60, 0, 0})), wasmSection(3, wasmVec([]byte{0}))), "functions without code"},
+		{"unknown type", wasmBytes(wasmSection(3, wasmVec([]byte{3})), wasmSection(10, wasmVec([]byte{2, 0, opEnd}))), "unknown type 3"},
+		{"missing end", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opNop}}), "missing end"},
+		{"unknown local", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opLocalGet, 0, opDrop, opEnd}}), "unknown local 0"},
+		{"unknown label", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opBr, 1, opEnd}}), "unknown label 1"},
+		{"unknown function", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opCall, 9, opEnd}}), "unknown function 9"},
+		{"else without if", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opElse, opEnd}}), "else without if"},
+		{"memory without memory", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opI32Const, 0, opI32Load, 2, 0, opDrop, opEnd}}), "without a memory"},
+		{"code after the end", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opEnd, opNop}}), "code after the end"},
+		{"unsupported instruction", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, 0xfd, 0, opEnd}}), "unsupported instruction"},
+		{"export of unknown function", wasmBytes(wasmSection(7, wasmVec(append(wasmName(add.name), 0, 4)))), "export of unknown function 4"},
+		{"global of the wrong type", wasmBytes(wasmSection(6, wasmVec([]byte{wasmI32, 0, opI64Const, 1, opEnd}))), "constant expression of type i64, want i32"},
+
+		// Validation
+		{"operand type mismatch", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opI64Const, 1, opI32Const, 1, 0x6a, opDrop, opEnd}}), "type mismatch: i64 on the operand stack, want i32"},
+		{"operand stack underflow", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opI32Const, 1, 0x6a, opDrop, opEnd}}), "operand stack underflow"},
+		{"missing result", wasmFuncModule(wasmTestFunc{"f", nil, []byte{wasmI32}, []byte{0x00, opEnd}}), "operand stack underflow"},
+		{"wrong result", wasmFuncModule(wasmTestFunc{"f", nil, []byte{wasmI32}, []byte{0x00, opI64Const, 1, opEnd}}), "type mismatch"},
+		{"values left over", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opI32Const, 1, opEnd}}), "values left over on the operand stack"},
+		{"block without its result", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opBlock, wasmI32, opEnd, opDrop, opEnd}}), "operand stack underflow"},
+		{"branch without its value", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opBlock, wasmI32, opBr, 0, opEnd, opDrop, opEnd}}), "operand stack underflow"},
+		{"unclosed block", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opBlock, 0x40, opEnd}}), "missing end"},
+		{"if without else", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opI32Const, 1, opIf, wasmI32, opI32Const, 1, opEnd, opDrop, opEnd}}), "if without else"},
+		{"br_table arities", wasmFuncModule(wasmTestFunc{"f", nil, nil, []byte{0x00, opBlock, wasmI32, opI32Const, 1, opI32Const, 0, opBrTable, 1, 0, 1, opEnd, opDrop, opEnd}}), "different numbers of values"},
+		{"call arguments", wasmFuncModule(add, wasmTestFunc{"f", nil, nil, []byte{0x00, opI64Const, 1, opI64Const, 2, opCall, 0, opDrop, opEnd}}), "type mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeWasmModule("test.wasm", tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("decodeWasmModule() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package sorter
+
+import (
+	"math"
+	"math/bits"
+)
+
+// The numeric instructions of WebAssembly, opcodes 0x45 to 0xc4 and the
+// saturating conversions. Values are kept in uint64s: i32s zero-extended,
+// floats as their bits.
+
+func asF32(v uint64) float32   { return math.Float32frombits(uint32(v)) }
+func asF64(v uint64) float64   { return math.Float64frombits(v) }
+func fromF32(f float32) uint64 { return uint64(math.Float32bits(f)) }
+func fromF64(f float64) uint64 { return math.Float64bits(f) }
+
+// Canonical NaNs, which arithmetic on NaNs returns
+const (
+	nanF32 = 0x7fc00000
+	nanF64 = 0x7ff8000000000000
+)
+
+func wasmNumeric(op uint16, stack []uint64) ([]uint64, error) {
+	// Unary operations and conversions
+	if wasmUnary(op) {
+		v, err := wasmUnaryOp(op, stack[len(stack)-1])
+		if err != nil {
+			return nil, err
+		}
+		stack[len(stack)-1] = v
+		return stack, nil
+	}
+	x, y := stack[len(stack)-2], stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+	v, err := wasmBinaryOp(op, x, y)
+	if err != nil {
+		return nil, err
+	}
+	stack[len(stack)-1] = v
+	return stack, nil
+}
+
+func wasmUnary(op uint16) bool {
+	switch {
+	case op == 0x45 || op == 0x50: // eqz
+		return true
+	case op >= 0x67 && op <= 0x69, op >= 0x79 && op <= 0x7b: // clz, ctz, popcnt
+		return true
+	case op >= 0x8b && op <= 0x91, op >= 0x99 && op <= 0x9f: // abs ... sqrt
+		return true
+	case op >= 0xa7 && op <= 0xc4: // Conversions and sign extension
+		return true
+	case op >= opTruncSat && op <= opTruncSat+7:
+		return true
+	}
+	return false
+}
+
+func wasmUnaryOp(op uint16, v uint64) (uint64, error) {
+	a32, a64 := uint32(v), v
+	switch op {
+	case 0x45:
+		return b2i(a32 == 0), nil
+	case 0x50:
+		return b2i(a64 == 0), nil
+	case 0x67:
+		return uint64(bits.LeadingZeros32(a32)), nil
+	case 0x68:
+		return uint64(bits.TrailingZeros32(a32)), nil
+	case 0x69:
+		return uint64(bits.OnesCount32(a32)), nil
+	case 0x79:
+		return uint64(bits.LeadingZeros64(a64)), nil
+	case 0x7a:
+		return uint64(bits.TrailingZeros64(a64)), nil
+	case 0x7b:
+		return uint64(bits.OnesCount64(a64)), nil
+
+	case 0x8b: // f32.abs
+		return uint64(a32 &^ (1 << 31)), nil
+	case 0x8c: // f32.neg
+		return uint64(a32 ^ (1 << 31)), nil
+	case 0x8d:
+		return fromF32(float32(math.Ceil(float64(asF32(v))))), nil
+	case 0x8e:
+		return fromF32(float32(math.Floor(float64(asF32(v))))), nil
+	case 0x8f:
+		return fromF32(float32(math.Trunc(float64(asF32(v))))), nil
+	case 0x90:
+		return fromF32(float32(math.RoundToEven(float64(asF32(v))))), nil
+	case 0x91:
+		return fromF32(float32(math.Sqrt(float64(asF32(v))))), nil
+	case 0x99: // f64.abs
+		return a64 &^ (1 << 63), nil
+	case 0x9a: // f64.neg
+		return a64 ^ (1 << 63), nil
+	case 0x9b:
+		return fromF64(math.Ceil(asF64(v))), nil
+	case 0x9c:
+		return fromF64(math.Floor(asF64(v))), nil
+	case 0x9d:
+		return fromF64(math.Trunc(asF64(v))), nil
+	case 0x9e:
+		return fromF64(math.RoundToEven(asF64(v))), nil
+	case 0x9f:
+		return fromF64(math.Sqrt(asF64(v))), nil
+
+	case 0xa7: // i32.wrap_i64
+		return uint64(a32), nil
+	case 0xa8: // i32.trunc_f32_s
+		return wasmTrunc(float64(asF32(v)), true, 32, false)
+	case 0xa9:
+		return wasmTrunc(float64(asF32(v)), false, 32, false)
+	case 0xaa:
+		return wasmTrunc(asF64(v), true, 32, false)
+	case 0xab:
+		return wasmTrunc(asF64(v), false, 32, false)
+	case 0xac: // i64.extend_i32_s
+		return uint64(int64(int32(a32))), nil
+	case 0xad:
+		return uint64(a32), nil
+	case 0xae:
+		return wasmTrunc(float64(asF32(v)), true, 64, false)
+	case 0xaf:
+		return wasmTrunc(float64(asF32(v)), false, 64, false)
+	case 0xb0:
+		return wasmTrunc(asF64(v), true, 64, false)
+	case 0xb1:
+		return wasmTrunc(asF64(v), false, 64, false)
+	case 0xb2: // f32.convert_i32_s
+		return fromF32(float32(int32(a32))), nil
+	case 0xb3:
+		return fromF32(float32(a32)), nil
+	case 0xb4:
+		return fromF32(float32(int64(a64))), nil
+	case 0xb5:
+		return fromF32(float32(a64)), nil
+	case 0xb6: // f32.demote_f64
+		return fromF32(float32(asF64(v))), nil
+	case 0xb7: // f64.convert_i32_s
+		return fromF64(float64(int32(a32))), nil
+	case 0xb8:
+		return fromF64(float64(a32)), nil
+	case 0xb9:
+		return fromF64(float64(int64(a64))), nil
+	case 0xba:
+		return fromF64(float64(a64)), nil
+	case 0xbb: // f64.promote_f32
+		return fromF64(float64(asF32(v))), nil
+	case 0xbc, 0xbd, 0xbe, 0xbf: // Reinterpretations keep the bits
+		return v, nil
+	case 0xc0: // i32.extend8_s
+		return uint64(uint32(int32(int8(a32)))), nil
+	case 0xc1:
+		return uint64(uint32(int32(int16(a32)))), nil
+	case 0xc2: // i64.extend8_s
+		return uint64(int64(int8(a64))), nil
+	case 0xc3:
+		return uint64(int64(int16(a64))), nil
+	case 0xc4:
+		return uint64(int64(int32(a64))), nil
+	}
+
+	// Saturating truncations: i32 from f32 (signed, unsigned), from f64,
+	// then i64 likewise
+	sat := op - opTruncSat
+	f := asF64(v)
+	if sat%4 < 2 {
+		f = float64(asF32(v))
+	}
+	size := 32
+	if sat >= 4 {
+		size = 64
+	}
+	return wasmTrunc(f, sat%2 == 0, size, true)
+}
+
+// wasmTrunc converts a float to an integer of size bits, trapping on NaN
+// and overflow unless saturating
+func wasmTrunc(f float64, signed bool, size int, saturate bool) (uint64, error) {
+	if math.IsNaN(f) {
+		if saturate {
+			return 0, nil
+		}
+		return 0, trap("invalid conversion to integer")
+	}
+	f = math.Trunc(f)
+	var lo, hi float64 // Bounds, exclusive above
+	switch {
+	case signed && size == 32:
+		lo, hi = math.MinInt32, 1<<31
+	case size == 32:
+		lo, hi = 0, 1<<32
+	case signed:
+		lo, hi = math.MinInt64, 1<<63
+	default:
+		lo, hi = 0, 1<<64
+	}
+	if f < lo || f >= hi {
+		if !saturate {
+			return 0, trap("integer overflow")
+		}
+		switch {
+		case f < lo && signed && size == 32:
+			return 1 << 31, nil
+		case f < lo && signed:
+			return 1 << 63, nil
+		case f < lo:
+			return 0, nil
+		case signed && size == 32:
+			return math.MaxInt32, nil
+		case signed:
+			return math.MaxInt64, nil
+		case size == 32:
+			return math.MaxUint32, nil
+		}
+		return math.MaxUint64, nil
+	}
+	switch {
+	case signed && size == 32:
+		return uint64(uint32(int32(f))), nil
+	case signed:
+		return uint64(int64(f)), nil
+	case f >= 1<<63:
+		return uint64(f-(1<<63)) | 1<<63, nil
+	}
+	return uint64(f), nil
+}
+
+func wasmBinaryOp(op uint16, x, y uint64) (uint64, error) {
+	switch {
+	case op >= 0x46 && op <= 0x4f:
+		return wasmCompareInt(op-0x46, uint64(uint32(x)), uint64(uint32(y)), uint64(int64(int32(x))), uint64(int64(int32(y)))), nil
+	case op >= 0x51 && op <= 0x5a:
+		return wasmCompareInt(op-0x51, x, y, x, y), nil
+	case op >= 0x5b && op <= 0x60:
+		return wasmCompareFloat(op-0x5b, float64(asF32(x)), float64(asF32(y))), nil
+	case op >= 0x61 && op <= 0x66:
+		return wasmCompareFloat(op-0x61, asF64(x), asF64(y)), nil
+	case op >= 0x6a && op <= 0x78:
+		return wasmI32Op(op, uint32(x), uint32(y))
+	case op >= 0x7c && op <= 0x8a:
+		return wasmI64Op(op, x, y)
+	case op >= 0x92 && op <= 0x98:
+		return wasmF32Op(op, x, y), nil
+	case op >= 0xa0 && op <= 0xa6:
+		return wasmF64Op(op, x, y), nil
+	}
+	return 0, trap("unsupported instruction 0x%02x", op)
+}
+
+// wasmCompareInt runs eq, ne, lt_s, lt_u, gt_s, gt_u, le_s, le_u, ge_s or
+// ge_u (which, from 0), with x and y as unsigned and as sign-extended
+func wasmCompareInt(which uint16, x, y, sx, sy uint64) uint64 {
+	switch which {
+	case 0:
+		return b2i(x == y)
+	case 1:
+		return b2i(x != y)
+	case 2:
+		return b2i(int64(sx) < int64(sy))
+	case 3:
+		return b2i(x < y)
+	case 4:
+		return b2i(int64(sx) > int64(sy))
+	case 5:
+		return b2i(x > y)
+	case 6:
+		return b2i(int64(sx) <= int64(sy))
+	case 7:
+		return b2i(x <= y)
+	case 8:
+		return b2i(int64(sx) >= int64(sy))
+	}
+	return b2i(x >= y)
+}
+
+// wasmCompareFloat runs eq, ne, lt, gt, le or ge (which, from 0)
+func wasmCompareFloat(which uint16, x, y float64) uint64 {
+	switch which {
+	case 0:
+		return b2i(x == y)
+	case 1:
+		return b2i(x != y)
+	case 2:
+		return b2i(x < y)
+	case 3:
+		return b2i(x > y)
+	case 4:
+		return b2i(x <= y)
+	}
+	return b2i(x >= y)
+}
+
+func wasmI32Op(op uint16, x, y uint32) (uint64, error) {
+	var v uint32
+	switch op {
+	case 0x6a:
+		v = x + y
+	case 0x6b:
+		v = x - y
+	case 0x6c:
+		v = x * y
+	case 0x6d, 0x6f: // div_s, rem_s
+		if y == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == 0x6d {
+			if int32(x) == math.MinInt32 && int32(y) == -1 {
+				return 0, trap("integer overflow")
+			}
+			v = uint32(int32(x) / int32(y))
+		} else if int32(y) != -1 {
+			v = uint32(int32(x) % int32(y))
+		}
+	case 0x6e, 0x70: // div_u, rem_u
+		if y == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == 0x6e {
+			v = x / y
+		} else {
+			v = x % y
+		}
+	case 0x71:
+		v = x & y
+	case 0x72:
+		v = x | y
+	case 0x73:
+		v = x ^ y
+	case 0x74:
+		v = x << (y % 32)
+	case 0x75:
+		v = uint32(int32(x) >> (y % 32))
+	case 0x76:
+		v = x >> (y % 32)
+	case 0x77:
+		v = bits.RotateLeft32(x, int(y%32))
+	case 0x78:
+		v = bits.RotateLeft32(x, -int(y%32))
+	}
+	return uint64(v), nil
+}
+
+func wasmI64Op(op uint16, x, y uint64) (uint64, error) {
+	switch op {
+	case 0x7c:
+		return x + y, nil
+	case 0x7d:
+		return x - y, nil
+	case 0x7e:
+		return x * y, nil
+	case 0x7f, 0x81: // div_s, rem_s
+		if y == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == 0x7f {
+			if int64(x) == math.MinInt64 && int64(y) == -1 {
+				return 0, trap("integer overflow")
+			}
+			return uint64(int64(x) / int64(y)), nil
+		}
+		if int64(y) == -1 {
+			return 0, nil
+		}
+		return uint64(int64(x) % int64(y)), nil
+	case 0x80, 0x82: // div_u, rem_u
+		if y == 0 {
+			return 0, trap("integer divide by zero")
+		}
+		if op == 0x80 {
+			return x / y, nil
+		}
+		return x % y, nil
+	case 0x83:
+		return x & y, nil
+	case 0x84:
+		return x | y, nil
+	case 0x85:
+		return x ^ y, nil
+	case 0x86:
+		return x << (y % 64), nil
+	case 0x87:
+		return uint64(int64(x) >> (y % 64)), nil
+	case 0x88:
+		return x >> (y % 64), nil
+	case 0x89:
+		return bits.RotateLeft64(x, int(y%64)), nil
+	}
+	return bits.RotateLeft64(x, -int(y%64)), nil
+}
+
+func wasmF32Op(op uint16, x, y uint64) uint64 {
+	a, b := asF32(x), asF32(y)
+	switch op {
+	case 0x92:
+		return fromF32(a + b)
+	case 0x93:
+		return fromF32(a - b)
+	case 0x94:
+		return fromF32(a * b)
+	case 0x95:
+		return fromF32(a / b)
+	case 0x96, 0x97:
+		if a != a || b != b {
+			return nanF32
+		}
+		return fromF32(float32(wasmMinMax(float64(a), float64(b), op == 0x97)))
+	}
+	// copysign
+	return uint64(uint32(x)&^(1<<31) | uint32(y)&(1<<31))
+}
+
+func wasmF64Op(op uint16, x, y uint64) uint64 {
+	a, b := asF64(x), asF64(y)
+	switch op {
+	case 0xa0:
+		return fromF64(a + b)
+	case 0xa1:
+		return fromF64(a - b)
+	case 0xa2:
+		return fromF64(a * b)
+	case 0xa3:
+		return fromF64(a / b)
+	case 0xa4, 0xa5:
+		if a != a || b != b {
+			return nanF64
+		}
+		return fromF64(wasmMinMax(a, b, op == 0xa5))
+	}
+	// copysign
+	return x&^(1<<63) | y&(1<<63)
+}
+
+// wasmMinMax is min or max with -0 below 0
+func wasmMinMax(a, b float64, isMax bool) float64 {
+	if a == b {
+		// Equal, unless one is -0 and the other 0
+		if isMax != math.Signbit(a) {
+			return a
+		}
+		return b
+	}
+	if (a > b) == isMax {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,267 @@
+package sorter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Validation of function bodies, following the algorithm of the
+// specification's appendix: the types on the operand stack and the blocks
+// open around each instruction are tracked as it is decoded, so that a
+// module that passes never underflows the stack, mixes up types or leaves
+// a block with the wrong results when it runs.
+
+// wasmUnknown is the type of an operand popped in unreachable code, which
+// matches any
+const wasmUnknown = 0
+
+// wasmFrame is a block, loop or if being validated, or the function itself
+type wasmFrame struct {
+	op          uint16 // opElse once an if reaches its else
+	typ         *wasmFuncType
+	height      int  // Of the operand stack under the block's parameters
+	unreachable bool // Past a branch, return or unreachable
+}
+
+type wasmValidator struct {
+	vals   []byte // Types on the operand stack
+	frames []wasmFrame
+	max    int // The most operands the stack holds
+}
+
+func newWasmValidator(fn *wasmFunc) *wasmValidator {
+	return &wasmValidator{frames: []wasmFrame{{op: opBlock, typ: &wasmFuncType{results: fn.typ.results}}}}
+}
+
+func wasmTypeName(t byte) string {
+	switch t {
+	case wasmI32:
+		return "i32"
+	case wasmI64:
+		return "i64"
+	case wasmF32:
+		return "f32"
+	case wasmF64:
+		return "f64"
+	}
+	return "unknown"
+}
+
+func (v *wasmValidator) push(types ...byte) {
+	v.vals = append(v.vals, types...)
+	v.max = max(v.max, len(v.vals))
+}
+
+// pop pops an operand of type want, or of any with wasmUnknown
+func (v *wasmValidator) pop(want byte) (byte, error) {
+	f := &v.frames[len(v.frames)-1]
+	if len(v.vals) == f.height {
+		if f.unreachable {
+			return want, nil
+		}
+		return 0, errors.New("operand stack underflow")
+	}
+	got := v.vals[len(v.vals)-1]
+	v.vals = v.vals[:len(v.vals)-1]
+	if got == wasmUnknown {
+		return want, nil
+	}
+	if want != wasmUnknown && got != want {
+		return 0, fmt.Errorf("type mismatch: %s on the operand stack, want %s", wasmTypeName(got), wasmTypeName(want))
+	}
+	return got, nil
+}
+
+func (v *wasmValidator) popAll(types []byte) error {
+	for i := len(types) - 1; i >= 0; i-- {
+		if _, err := v.pop(types[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply pops the operands of an instruction and pushes its results
+func (v *wasmValidator) apply(params []byte, results ...byte) error {
+	if err := v.popAll(params); err != nil {
+		return err
+	}
+	v.push(results...)
+	return nil
+}
+
+// unreachable drops the operands of the current block: what follows until
+// its end can't run
+func (v *wasmValidator) unreachable() {
+	f := &v.frames[len(v.frames)-1]
+	v.vals = v.vals[:f.height]
+	f.unreachable = true
+}
+
+// label returns the types a branch to the depth-th enclosing block carries
+func (v *wasmValidator) label(depth uint32) []byte {
+	f := v.frames[len(v.frames)-1-int(depth)]
+	if f.op == opLoop {
+		return f.typ.params
+	}
+	return f.typ.results
+}
+
+func (v *wasmValidator) enter(op uint16, typ *wasmFuncType) error {
+	if err := v.popAll(typ.params); err != nil {
+		return err
+	}
+	v.frames = append(v.frames, wasmFrame{op: op, typ: typ, height: len(v.vals)})
+	v.push(typ.params...)
+	return nil
+}
+
+// leave closes the current block, which must leave exactly its results
+func (v *wasmValidator) leave() (wasmFrame, error) {
+	f := v.frames[len(v.frames)-1]
+	if err := v.popAll(f.typ.results); err != nil {
+		return f, err
+	}
+	if len(v.vals) != f.height {
+		return f, errors.New("values left over on the operand stack at the end of a block")
+	}
+	v.frames = v.frames[:len(v.frames)-1]
+	return f, nil
+}
+
+func (v *wasmValidator) els() error {
+	f, err := v.leave()
+	if err != nil {
+		return err
+	}
+	f.op, f.unreachable = opElse, false
+	v.frames = append(v.frames, f)
+	v.push(f.typ.params...)
+	return nil
+}
+
+func (v *wasmValidator) end() error {
+	f, err := v.leave()
+	if err != nil {
+		return err
+	}
+	// Without an else, an if passes its parameters on when its condition fails
+	if f.op == opIf && !bytes.Equal(f.typ.params, f.typ.results) {
+		return errors.New("if without else must have the same parameters and results")
+	}
+	v.push(f.typ.results...)
+	return nil
+}
+
+func (v *wasmValidator) br(depth uint32) error {
+	if err := v.popAll(v.label(depth)); err != nil {
+		return err
+	}
+	v.unreachable()
+	return nil
+}
+
+func (v *wasmValidator) brIf(depth uint32) error {
+	if _, err := v.pop(wasmI32); err != nil {
+		return err
+	}
+	return v.apply(v.label(depth), v.label(depth)...)
+}
+
+func (v *wasmValidator) brTable(labels []uint32) error {
+	if _, err := v.pop(wasmI32); err != nil {
+		return err
+	}
+	arity := len(v.label(labels[len(labels)-1]))
+	for _, depth := range labels[:len(labels)-1] {
+		types := v.label(depth)
+		if len(types) != arity {
+			return errors.New("br_table labels carry different numbers of values")
+		}
+		if err := v.apply(types, types...); err != nil {
+			return err
+		}
+	}
+	return v.br(labels[len(labels)-1])
+}
+
+// Operand and result types of the conversions, 0xa7 to 0xc4
+var wasmConversions = [...][2]byte{
+	// i32.wrap_i64, i32.trunc
+	{wasmI64, wasmI32}, {wasmF32, wasmI32}, {wasmF32, wasmI32}, {wasmF64, wasmI32}, {wasmF64, wasmI32},
+	// i64.extend_i32, i64.trunc
+	{wasmI32, wasmI64}, {wasmI32, wasmI64}, {wasmF32, wasmI64}, {wasmF32, wasmI64}, {wasmF64, wasmI64}, {wasmF64, wasmI64},
+	// f32.convert, f32.demote_f64
+	{wasmI32, wasmF32}, {wasmI32, wasmF32}, {wasmI64, wasmF32}, {wasmI64, wasmF32}, {wasmF64, wasmF32},
+	// f64.convert, f64.promote_f32
+	{wasmI32, wasmF64}, {wasmI32, wasmF64}, {wasmI64, wasmF64}, {wasmI64, wasmF64}, {wasmF32, wasmF64},
+	// Reinterpretations
+	{wasmF32, wasmI32}, {wasmF64, wasmI64}, {wasmI32, wasmF32}, {wasmI64, wasmF64},
+	// Sign extension
+	{wasmI32, wasmI32}, {wasmI32, wasmI32}, {wasmI64, wasmI64}, {wasmI64, wasmI64}, {wasmI64, wasmI64},
+}
+
+// numeric checks a numeric instruction, 0x45 to 0xc4 or a saturating
+// conversion
+func (v *wasmValidator) numeric(op uint16) error {
+	var t, result byte
+	unary := false
+	switch {
+	case op == 0x45: // i32.eqz
+		t, result, unary = wasmI32, wasmI32, true
+	case op == 0x50: // i64.eqz
+		t, result, unary = wasmI64, wasmI32, true
+	case op <= 0x4f:
+		t, result = wasmI32, wasmI32
+	case op <= 0x5a:
+		t, result = wasmI64, wasmI32
+	case op <= 0x60:
+		t, result = wasmF32, wasmI32
+	case op <= 0x66:
+		t, result = wasmF64, wasmI32
+	case op <= 0x78:
+		t, result, unary = wasmI32, wasmI32, op <= 0x69
+	case op <= 0x8a:
+		t, result, unary = wasmI64, wasmI64, op <= 0x7b
+	case op <= 0x98:
+		t, result, unary = wasmF32, wasmF32, op <= 0x91
+	case op <= 0xa6:
+		t, result, unary = wasmF64, wasmF64, op <= 0x9f
+	case op <= 0xc4:
+		conv := wasmConversions[op-0xa7]
+		t, result, unary = conv[0], conv[1], true
+	default: // Saturating conversions, i32 from f32 and f64, then i64
+		sat := op - opTruncSat
+		t, result, unary = wasmF32, wasmI32, true
+		if sat&2 != 0 {
+			t = wasmF64
+		}
+		if sat >= 4 {
+			result = wasmI64
+		}
+	}
+	if unary {
+		return v.apply([]byte{t}, result)
+	}
+	return v.apply([]byte{t, t}, result)
+}
+
+// Types loaded and stored by the memory instructions, 0x28 to 0x3e
+var wasmMemoryTypes = [...]byte{
+	// Loads, then the narrow ones
+	wasmI32, wasmI64, wasmF32, wasmF64,
+	wasmI32, wasmI32, wasmI32, wasmI32, wasmI64, wasmI64, wasmI64, wasmI64, wasmI64, wasmI64,
+	// Stores, then the narrow ones
+	wasmI32, wasmI64, wasmF32, wasmF64,
+	wasmI32, wasmI32, wasmI64, wasmI64, wasmI64,
+}
+
+// memory checks a load or store
+func (v *wasmValidator) memory(op uint16) error {
+	t := wasmMemoryTypes[op-opI32Load]
+	if op >= 0x36 {
+		return v.apply([]byte{wasmI32, t})
+	}
+	return v.apply([]byte{wasmI32}, t)
+}
@@ -0,0 +1,105 @@
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watch keeps sorting the inboxes as files arrive until stop is closed.
+// Bursts of events are debounced into a single run, and the inboxes are
+// re-scanned periodically in case an event was missed. Inboxes missing at
+// the start, and remote ones, which send no events, are only picked up by
+// the re-scans.
+func (s *Sorter) Watch(stop <-chan struct{}) error {
+	// The watchers stop, and are waited for, when Watch returns
+	ctx, cancel := context.WithCancel(s.ctx)
+	var watchers sync.WaitGroup
+	defer watchers.Wait()
+	defer cancel()
+
+	changes := make(chan struct{}, 1)
+	for _, inbox := range s.existingInboxes() {
+		// Only a pass fills the staging directory, with files it sorts itself
+		if s.opts.ExtractArchives && inbox.Dir == s.opts.StagingDir {
+			continue
+		}
+		if isRemote(inbox.Dir) {
+			s.log.Info("Polling remote inbox", "dir", inbox.Dir, "rescan", s.opts.WatchRescan)
+			continue
+		}
+		inboxChanges, err := watchInbox(ctx, inbox, s.log)
+		if err != nil {
+			return fmt.Errorf("failed to watch inbox %s: %w", inbox.Dir, err)
+		}
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			for range inboxChanges {
+				notifyChange(changes)
+			}
+		}()
+		s.log.Info("Watching inbox", "dir", inbox.Dir)
+	}
+
+	s.log.Info("Watching for new files", "debounce", s.opts.WatchDebounce, "rescan", s.opts.WatchRescan)
+	debounce := time.NewTimer(s.opts.WatchDebounce)
+	debounce.Stop()
+	rescan := time.NewTicker(s.opts.WatchRescan)
+	defer rescan.Stop()
+
+	// Files left for being too new or still written get another run once
+	// they may be ready, without waiting for the next re-scan
+	run := func() {
+		s.Run()
+		if !s.nextReady.IsZero() {
+			debounce.Reset(max(time.Until(s.nextReady), s.opts.WatchDebounce))
+		}
+	}
+	run()
+
+	for {
+		select {
+		case <-changes:
+			debounce.Reset(s.opts.WatchDebounce)
+		case <-debounce.C:
+			run()
+		case <-rescan.C:
+			s.log.Info("Periodic re-scan of inbox")
+			run()
+		case <-stop:
+			s.log.Info("Stopping watch")
+			return nil
+		case <-s.ctx.Done():
+			s.log.Info("Stopping watch")
+			return nil
+		}
+	}
+}
+
+// unwatchedDir reports whether the walk of an inbox skips the folder named
+// name, being hidden (such as .git) or excluded (such as node_modules), so
+// nothing in it needs watching. Invalid patterns are warned about by the
+// walk.
+func unwatchedDir(inbox Inbox, name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, pattern := range inbox.ExcludeDirs {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyChange signals a change without blocking; pending signals coalesce
+func notifyChange(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,146 @@
+//go:build linux
+
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Events that mean a file finished arriving in (or a folder appeared in) the inbox
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE
+
+// watchInbox watches the inbox and all of its subdirectories but those the
+// walk skips with inotify, and signals on the returned channel whenever
+// something arrives. The inotify descriptor is closed, and the channel
+// with it, once ctx is done.
+func watchInbox(ctx context.Context, inbox Inbox, log *slog.Logger) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking, reads wait in the runtime poller, which closing the
+	// file wakes up
+	file := os.NewFile(uintptr(fd), "inotify")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w := &inotifyWatcher{file: file, conn: conn, inbox: inbox, dirs: make(map[int32]string), log: log}
+	if err := w.addTree(inbox.Dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			file.Close()
+		case <-stopped:
+		}
+	}()
+	go func() {
+		defer close(changes)
+		defer close(stopped)
+		defer file.Close()
+		w.run(ctx, changes)
+	}()
+	return changes, nil
+}
+
+type inotifyWatcher struct {
+	file  *os.File
+	conn  syscall.RawConn
+	inbox Inbox
+	dirs  map[int32]string // Watch descriptor to directory path
+	log   *slog.Logger
+}
+
+// addTree adds a watch for dir and every directory below it, but for the
+// hidden and excluded ones
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil // Directory vanished while walking
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != w.inbox.Dir && unwatchedDir(w.inbox, d.Name()) {
+			return filepath.SkipDir
+		}
+		var wd int
+		err = w.conn.Control(func(fd uintptr) {
+			wd, err = syscall.InotifyAddWatch(int(fd), path, inotifyMask)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) run(ctx context.Context, changes chan<- struct{}) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil || n <= 0 {
+			if ctx.Err() == nil {
+				w.log.Error("Inbox watcher stopped", "dir", w.inbox.Dir, "err", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, event.Wd)
+				continue
+			}
+
+			// New folders (created or moved in) need watches of their own,
+			// unless the walk skips them anyway
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				name := string(nameBytes[:clen(nameBytes)])
+				if unwatchedDir(w.inbox, name) {
+					continue
+				}
+				if dir, ok := w.dirs[event.Wd]; ok {
+					if err := w.addTree(filepath.Join(dir, name)); err != nil && ctx.Err() == nil {
+						w.log.Error("Failed to watch new folder", "err", err)
+					}
+				}
+			} else if event.Mask&syscall.IN_CREATE != 0 {
+				continue // Wait for IN_CLOSE_WRITE before sorting a new file
+			}
+			notifyChange(changes)
+		}
+	}
+}
+
+// clen returns the length of a NUL-padded inotify name
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
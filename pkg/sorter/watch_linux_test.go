@@ -0,0 +1,73 @@
+//go:build linux
+
+package sorter
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchInbox(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{".git", "node_modules", "photos"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := watchInbox(ctx, Inbox{Dir: dir, ExcludeDirs: []string{"node_modules"}}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(what string, want bool) {
+		t.Helper()
+		select {
+		case <-changes:
+			if !want {
+				t.Errorf("%s signaled a change", what)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Errorf("%s signaled no change", what)
+			}
+		}
+	}
+
+	write(".git/objects/ab")
+	write("node_modules/left-pad/index.js")
+	expect("writing into skipped folders", false)
+	write("photos/a.jpg")
+	expect("writing into a watched folder", true)
+	write("new/b.jpg")
+	expect("writing into a new folder", true)
+
+	// A pending change may come before the channel closes
+	cancel()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, open := <-changes:
+			if !open {
+				return
+			}
+		case <-deadline:
+			t.Fatal("watcher still running after its context was done")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+//go:build !linux
+
+package sorter
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// How often the inbox is polled on platforms without inotify support
+const watchPollInterval = 5 * time.Second
+
+type pollEntry struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchInbox polls the inbox and signals on the returned channel whenever
+// files are added or changed outside the folders the walk skips. Polling
+// stops, and the channel is closed, once ctx is done.
+func watchInbox(ctx context.Context, inbox Inbox, _ *slog.Logger) (<-chan struct{}, error) {
+	previous, err := snapshotInbox(inbox)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			current, err := snapshotInbox(inbox)
+			if err != nil {
+				continue
+			}
+			for path, entry := range current {
+				if old, ok := previous[path]; !ok || old != entry {
+					notifyChange(changes)
+					break
+				}
+			}
+			previous = current
+		}
+	}()
+	return changes, nil
+}
+
+func snapshotInbox(inbox Inbox) (map[string]pollEntry, error) {
+	snapshot := make(map[string]pollEntry)
+	err := filepath.WalkDir(inbox.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != inbox.Dir && unwatchedDir(inbox, d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			snapshot[path] = pollEntry{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	return snapshot, err
+}
@@ -0,0 +1,439 @@
+package sorter
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The WebDAV storage reads and writes files on a WebDAV server, such as the
+// files of a Nextcloud or ownCloud account, given as davs://user@host/path
+// URLs (dav:// for plain HTTP). Passwords (use app passwords for Nextcloud)
+// are taken from SORTER_WEBDAV_PASSWORD or ~/.netrc, never from the URL.
+
+// webdavStorage is a WebDAV server, mounted at root
+type webdavStorage struct {
+	root     string   // Mount root, e.g. /davs:me@cloud.example.com
+	base     *url.URL // Scheme and host of the server
+	user     string
+	password string
+	client   *http.Client
+}
+
+// newWebDAVStorage parses a dav:// or davs:// URL
+func newWebDAVStorage(scheme, rest string) (root string, st *webdavStorage, dir string, err error) {
+	u, err := url.Parse(scheme + "://" + rest)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if u.Host == "" {
+		return "", nil, "", errors.New("missing host")
+	}
+	if u.Path == "" || u.Path == "/" {
+		return "", nil, "", errors.New("missing directory")
+	}
+	if _, ok := u.User.Password(); ok {
+		return "", nil, "", errors.New("passwords can't be given in the URL; set SORTER_WEBDAV_PASSWORD or add the server to ~/.netrc")
+	}
+
+	st = &webdavStorage{base: &url.URL{Scheme: "https", Host: u.Host}, client: &http.Client{}}
+	if scheme == "dav" {
+		st.base.Scheme = "http"
+	}
+	root = "/" + scheme + ":" + u.Host
+	if u.User != nil {
+		st.user = u.User.Username()
+		root = "/" + scheme + ":" + st.user + "@" + u.Host
+	}
+	st.root = filepath.FromSlash(root)
+	st.password = os.Getenv("SORTER_WEBDAV_PASSWORD")
+	if st.password == "" {
+		st.user, st.password = netrcLogin(u.Hostname(), st.user)
+	}
+	return st.root, st, path.Clean(u.Path), nil
+}
+
+// netrcLogin looks up the login for host in ~/.netrc (_netrc on Windows),
+// the file curl and other HTTP tools read. A login given in the URL has to
+// match.
+func netrcLogin(host, user string) (string, string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return user, ""
+	}
+	name := ".netrc"
+	if runtime.GOOS == "windows" {
+		name = "_netrc"
+	}
+	data, err := os.ReadFile(filepath.Join(home, name))
+	if err != nil {
+		return user, ""
+	}
+
+	// Entries are "machine <host> login <user> password <secret>", or
+	// "default ..." for every other host
+	var machine, login, password string
+	match := func() bool { return machine == host && (user == "" || login == user) && password != "" }
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(fields); i++ {
+		key, value := fields[i], ""
+		if key != "default" && i+1 < len(fields) {
+			i++
+			value = fields[i]
+		}
+		switch key {
+		case "machine", "default":
+			if match() {
+				return login, password
+			}
+			machine, login, password = value, "", ""
+			if key == "default" {
+				machine = host
+			}
+		case "login":
+			login = value
+		case "password":
+			password = value
+		}
+	}
+	if match() {
+		return login, password
+	}
+	return user, ""
+}
+
+// url returns the URL of a path below the mount root
+func (st *webdavStorage) url(name string) string {
+	u := *st.base
+	u.Path = remotePath(st.root, name)
+	return u.String()
+}
+
+// do sends a request about name. Error statuses are returned as errors;
+// the caller closes the body of other responses.
+func (st *webdavStorage) do(method, name string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, st.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if st.user != "" {
+		req.SetBasicAuth(st.user, st.password)
+	}
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, webdavError(resp)
+	}
+	return resp, nil
+}
+
+// webdavError turns an error response into an error, the usual ones into
+// those of the fs package
+func webdavError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fs.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fs.ErrPermission
+	case http.StatusPreconditionFailed:
+		return fs.ErrExist
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return errors.ErrUnsupported
+	}
+	// Nextcloud and other Sabre servers explain the error
+	var e struct {
+		Message string `xml:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) == nil && e.Message != "" {
+		return fmt.Errorf("webdav: %s (%s)", e.Message, resp.Status)
+	}
+	return fmt.Errorf("webdav: %s", resp.Status)
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/></d:prop></d:propfind>`
+
+// davMultistatus is the reply to PROPFIND and PROPPATCH
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ETag          string `xml:"getetag"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// davEntry is a file or folder PROPFIND reported
+type davEntry struct {
+	path string // On the server
+	info *remoteFileInfo
+	etag string
+}
+
+// propfind lists name itself (depth 0) or also the entries in it (depth 1)
+func (st *webdavStorage) propfind(name string, depth int) ([]davEntry, error) {
+	header := http.Header{"Depth": {strconv.Itoa(depth)}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := st.do("PROPFIND", name, header, strings.NewReader(propfindBody), int64(len(propfindBody)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav: invalid PROPFIND reply: %w", err)
+	}
+
+	var entries []davEntry
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		p := path.Clean(href.Path)
+		info := &remoteFileInfo{name: path.Base(p), mode: 0o644}
+		entry := davEntry{path: p, info: info}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200") {
+				continue // Properties the server doesn't have
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				info.mode = fs.ModeDir | 0o755
+			}
+			if size, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+				info.size = size
+			}
+			if mtime, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+				info.mtime = mtime
+			}
+			entry.etag = ps.Prop.ETag
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// stat returns what PROPFIND says about name
+func (st *webdavStorage) stat(name string) (davEntry, error) {
+	entries, err := st.propfind(name, 0)
+	if err == nil && len(entries) == 0 {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return davEntry{}, err
+	}
+	entries[0].info.name = filepath.Base(name)
+	return entries[0], nil
+}
+
+func (st *webdavStorage) Open(name string) (File, error) {
+	entry, err := st.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if entry.info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	get := func(off, end int64) (io.ReadCloser, error) {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, end-1)}}
+		if entry.etag != "" && !strings.HasPrefix(entry.etag, "W/") {
+			header.Set("If-Match", entry.etag) // A changed file fails rather than mixing versions
+		}
+		resp, err := st.do(http.MethodGet, name, header, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		// Servers ignoring the range send all of the file
+		if resp.StatusCode != http.StatusPartialContent && off > 0 {
+			if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		return resp.Body, nil
+	}
+	return &rangeFile{name: name, info: entry.info, get: get}, nil
+}
+
+// Create gathers the file in a local temporary file, so it can be sent
+// with its length, which not every server manages without
+func (st *webdavStorage) Create(name string) (io.WriteCloser, error) {
+	tmp, err := os.CreateTemp("", "sorter-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &webdavWriter{st: st, name: name, tmp: tmp}, nil
+}
+
+func (st *webdavStorage) Stat(name string) (fs.FileInfo, error) {
+	entry, err := st.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return entry.info, nil
+}
+
+// Lstat is Stat, as the protocol has no links
+func (st *webdavStorage) Lstat(name string) (fs.FileInfo, error) {
+	return st.Stat(name)
+}
+
+func (st *webdavStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := st.propfind(name, 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	self := remotePath(st.root, name)
+	var dirEntries []fs.DirEntry
+	for _, entry := range entries {
+		if entry.path != self && path.Dir(entry.path) == self {
+			dirEntries = append(dirEntries, fs.FileInfoToDirEntry(entry.info))
+		}
+	}
+	slices.SortFunc(dirEntries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return dirEntries, nil
+}
+
+func (st *webdavStorage) MkdirAll(name string) error {
+	info, err := st.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(name); parent != name && parent != st.root {
+		if err := st.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	resp, err := st.do("MKCOL", name, nil, nil, 0)
+	if err != nil {
+		// Someone else may have just created it
+		if info, statErr := st.Stat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (st *webdavStorage) Rename(oldname, newname string) error {
+	header := http.Header{"Destination": {st.url(newname)}, "Overwrite": {"F"}}
+	resp, err := st.do("MOVE", oldname, header, nil, 0)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Remove deletes a file, or a folder once it is empty: DELETE alone would
+// take a folder with everything in it
+func (st *webdavStorage) Remove(name string) error {
+	info, err := st.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := st.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	resp, err := st.do(http.MethodDelete, name, nil, nil, 0)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Chtimes sets the modification time the way Nextcloud and ownCloud take
+// it; other servers usually refuse, which makes it errors.ErrUnsupported
+func (st *webdavStorage) Chtimes(name string, atime, mtime time.Time) error {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:propertyupdate xmlns:d="DAV:"><d:set><d:prop><d:lastmodified>` + strconv.FormatInt(mtime.Unix(), 10) + `</d:lastmodified></d:prop></d:set></d:propertyupdate>`
+	header := http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := st.do("PROPPATCH", name, header, strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	defer resp.Body.Close()
+	var ms davMultistatus
+	data, _ := io.ReadAll(resp.Body)
+	if xml.Unmarshal(data, &ms) != nil || len(ms.Responses) == 0 {
+		return nil // Servers answering 200 rather than 207 took it
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200") {
+				return &fs.PathError{Op: "chtimes", Path: name, Err: errors.ErrUnsupported}
+			}
+		}
+	}
+	return nil
+}
+
+// webdavWriter is a file being written, sent when it is closed
+type webdavWriter struct {
+	st   *webdavStorage
+	name string
+	tmp  *os.File
+}
+
+func (w *webdavWriter) Write(p []byte) (int, error) {
+	return w.tmp.Write(p)
+}
+
+func (w *webdavWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+	size, err := w.tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// Wrapped so the client leaves closing the file to us
+	resp, err := w.st.do(http.MethodPut, w.name, nil, io.NopCloser(w.tmp), size)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: w.name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
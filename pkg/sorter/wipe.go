@@ -0,0 +1,48 @@
+package sorter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// wipeFile overwrites a file with random data, flushes it to disk, renames it
+// to a random name so its old name doesn't linger in the folder either, and
+// only then removes it. This can't reach copies the storage keeps elsewhere:
+// SSD wear leveling, copy-on-write filesystems and snapshots.
+func wipeFile(path string, info os.FileInfo) error {
+	if links := linkCount(info); links > 1 {
+		return fmt.Errorf("%s has %d hard links, overwriting it would destroy the others", path, links)
+	}
+	if info.Mode().Perm()&0o200 == 0 {
+		if err := os.Chmod(path, info.Mode().Perm()|0o200); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(file, rand.Reader, info.Size())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to overwrite %s: %w", path, err)
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	anonymous := filepath.Join(filepath.Dir(path), hex.EncodeToString(random))
+	if err := os.Rename(path, anonymous); err != nil {
+		return err
+	}
+	return os.Remove(anonymous)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package sorter
+
+import "os"
+
+// linkCount can't tell hard links apart here, so files are assumed to have one
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
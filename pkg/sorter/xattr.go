@@ -0,0 +1,84 @@
+//go:build linux || darwin
+
+package sorter
+
+import (
+	"errors"
+	"syscall"
+)
+
+// copyXattrs copies the extended attributes of src to dst: Finder tags,
+// quarantine flags, Spotlight metadata and, on macOS, the resource fork,
+// which is exposed as the com.apple.ResourceFork attribute. Attributes
+// the destination refuses (unsupported by its filesystem, or reserved to
+// privileged users) are skipped and returned.
+func copyXattrs(src, dst string) (skipped []string, err error) {
+	names, err := listXattrs(src)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err != nil {
+			return skipped, err
+		}
+		if err := setXattr(dst, name, value); err != nil {
+			if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+				skipped = append(skipped, name)
+				continue
+			}
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// listXattrs returns the names of a file's extended attributes
+func listXattrs(path string) ([]string, error) {
+	buf, err := readXattr(func(dest []byte) (int, error) { return listxattr(path, dest) })
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	start := 0
+	for i, c := range buf {
+		if c == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of one extended attribute
+func getXattr(path, name string) ([]byte, error) {
+	return readXattr(func(dest []byte) (int, error) { return getxattr(path, name, dest) })
+}
+
+// readXattr calls read with a buffer large enough for the attribute data,
+// asking for its size first. It retries if the data grew in between.
+func readXattr(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,78 @@
+package sorter
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// The standard library doesn't wrap the xattr calls on macOS, so they are
+// made through libSystem the way golang.org/x/sys/unix does (see
+// xattr_darwin.s)
+
+//go:linkname syscall_syscall6 syscall.syscall6
+func syscall_syscall6(fn, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+var (
+	libc_listxattr_trampoline_addr uintptr
+	libc_getxattr_trampoline_addr  uintptr
+	libc_setxattr_trampoline_addr  uintptr
+)
+
+//go:cgo_import_dynamic libc_listxattr listxattr "/usr/lib/libSystem.B.dylib"
+//go:cgo_import_dynamic libc_getxattr getxattr "/usr/lib/libSystem.B.dylib"
+//go:cgo_import_dynamic libc_setxattr setxattr "/usr/lib/libSystem.B.dylib"
+
+// bufPtr returns the address of a buffer, 0 for an empty one
+func bufPtr(buf []byte) uintptr {
+	if len(buf) == 0 {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&buf[0]))
+}
+
+func listxattr(path string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	n, _, errno := syscall_syscall6(libc_listxattr_trampoline_addr,
+		uintptr(unsafe.Pointer(p)), bufPtr(dest), uintptr(len(dest)), 0, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func getxattr(path, name string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	a, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	n, _, errno := syscall_syscall6(libc_getxattr_trampoline_addr,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), bufPtr(dest), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall_syscall6(libc_setxattr_trampoline_addr,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), bufPtr(value), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package sorter
+
+import "syscall"
+
+func listxattr(path string, dest []byte) (int, error) {
+	return syscall.Listxattr(path, dest)
+}
+
+func getxattr(path, name string, dest []byte) (int, error) {
+	return syscall.Getxattr(path, name, dest)
+}
+
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
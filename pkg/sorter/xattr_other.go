@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package sorter
+
+// copyXattrs has no extended attributes to copy on this platform
+func copyXattrs(src, dst string) (skipped []string, err error) {
+	return nil, nil
+}
@@ -0,0 +1,219 @@
+package sorter
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH3, the 64-bit variant with the default secret and no seed, as
+// "xxhsum -H3" computes it. Inputs up to 240 bytes are hashed whole once
+// summed; longer ones are mixed in 1 KiB blocks as they are written.
+
+const (
+	xxhPrime32_1 = 0x9E3779B1
+	xxhPrime32_2 = 0x85EBCA77
+	xxhPrime32_3 = 0xC2B2AE3D
+	xxhPrime64_1 = 0x9E3779B185EBCA87
+	xxhPrime64_2 = 0xC2B2AE3D27D4EB4F
+	xxhPrime64_3 = 0x165667B19E3779F9
+	xxhPrime64_4 = 0x85EBCA77C2B2AE63
+	xxhPrime64_5 = 0x27D4EB2F165667C5
+	xxhPrimeMX1  = 0x165667919E3779F9
+	xxhPrimeMX2  = 0x9FB21C651E98DF25
+
+	xxh3StripeLen   = 64
+	xxh3Stripes     = (len(xxh3Secret) - xxh3StripeLen) / 8 // Per block
+	xxh3BlockLen    = xxh3StripeLen * xxh3Stripes
+	xxh3MidSizeMax  = 240
+	xxh3LastAccOff  = 7
+	xxh3MergeAccOff = 11
+)
+
+var xxh3Secret = [192]byte{
+	0xb8, 0xfe, 0x6c, 0x39, 0x23, 0xa4, 0x4b, 0xbe, 0x7c, 0x01, 0x81, 0x2c, 0xf7, 0x21, 0xad, 0x1c,
+	0xde, 0xd4, 0x6d, 0xe9, 0x83, 0x90, 0x97, 0xdb, 0x72, 0x40, 0xa4, 0xa4, 0xb7, 0xb3, 0x67, 0x1f,
+	0xcb, 0x79, 0xe6, 0x4e, 0xcc, 0xc0, 0xe5, 0x78, 0x82, 0x5a, 0xd0, 0x7d, 0xcc, 0xff, 0x72, 0x21,
+	0xb8, 0x08, 0x46, 0x74, 0xf7, 0x43, 0x24, 0x8e, 0xe0, 0x35, 0x90, 0xe6, 0x81, 0x3a, 0x26, 0x4c,
+	0x3c, 0x28, 0x52, 0xbb, 0x91, 0xc3, 0x00, 0xcb, 0x88, 0xd0, 0x65, 0x8b, 0x1b, 0x53, 0x2e, 0xa3,
+	0x71, 0x64, 0x48, 0x97, 0xa2, 0x0d, 0xf9, 0x4e, 0x38, 0x19, 0xef, 0x46, 0xa9, 0xde, 0xac, 0xd8,
+	0xa8, 0xfa, 0x76, 0x3f, 0xe3, 0x9c, 0x34, 0x3f, 0xf9, 0xdc, 0xbb, 0xc7, 0xc7, 0x0b, 0x4f, 0x1d,
+	0x8a, 0x51, 0xe0, 0x4b, 0xcd, 0xb4, 0x59, 0x31, 0xc8, 0x9f, 0x7e, 0xc9, 0xd9, 0x78, 0x73, 0x64,
+	0xea, 0xc5, 0xac, 0x83, 0x34, 0xd3, 0xeb, 0xc3, 0xc5, 0x81, 0xa0, 0xff, 0xfa, 0x13, 0x63, 0xeb,
+	0x17, 0x0d, 0xdd, 0x51, 0xb7, 0xf0, 0xda, 0x49, 0xd3, 0x16, 0x55, 0x26, 0x29, 0xd4, 0x68, 0x9e,
+	0x2b, 0x16, 0xbe, 0x58, 0x7d, 0x47, 0xa1, 0xfc, 0x8f, 0xf8, 0xb8, 0xd1, 0x7a, 0xd0, 0x31, 0xce,
+	0x45, 0xcb, 0x3a, 0x8f, 0x95, 0x16, 0x04, 0x28, 0xaf, 0xd7, 0xfb, 0xca, 0xbb, 0x4b, 0x40, 0x7e,
+}
+
+// xxh3Digest is a running XXH3 hash. buf holds the bytes not mixed in yet,
+// a block at most: a full block is only mixed in once more bytes follow, as
+// the last bytes are hashed differently.
+type xxh3Digest struct {
+	acc   [8]uint64
+	buf   []byte
+	total uint64
+	tail  [xxh3StripeLen]byte // The end of the last block mixed in
+}
+
+func newXXH3() hash.Hash64 {
+	d := &xxh3Digest{buf: make([]byte, 0, xxh3BlockLen)}
+	d.Reset()
+	return d
+}
+
+func (d *xxh3Digest) Reset() {
+	d.acc = [8]uint64{xxhPrime32_3, xxhPrime64_1, xxhPrime64_2, xxhPrime64_3, xxhPrime64_4, xxhPrime32_2, xxhPrime64_5, xxhPrime32_1}
+	d.buf = d.buf[:0]
+	d.total = 0
+}
+
+func (d *xxh3Digest) Size() int      { return 8 }
+func (d *xxh3Digest) BlockSize() int { return xxh3BlockLen }
+
+func (d *xxh3Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.total += uint64(n)
+	for len(p) > 0 {
+		if len(d.buf) == xxh3BlockLen {
+			d.block(d.buf)
+			d.buf = d.buf[:0]
+		}
+		if len(d.buf) == 0 && len(p) > xxh3BlockLen {
+			d.block(p[:xxh3BlockLen])
+			p = p[xxh3BlockLen:]
+			continue
+		}
+		k := copy(d.buf[len(d.buf):xxh3BlockLen], p)
+		d.buf = d.buf[:len(d.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// block mixes in a full block that more bytes follow
+func (d *xxh3Digest) block(b []byte) {
+	for s := range xxh3Stripes {
+		xxh3Accumulate(&d.acc, b[s*xxh3StripeLen:], xxh3Secret[s*8:])
+	}
+	xxh3Scramble(&d.acc, xxh3Secret[len(xxh3Secret)-xxh3StripeLen:])
+	copy(d.tail[:], b[xxh3BlockLen-xxh3StripeLen:])
+}
+
+func (d *xxh3Digest) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, d.Sum64())
+}
+
+func (d *xxh3Digest) Sum64() uint64 {
+	if d.total <= xxh3MidSizeMax {
+		return xxh3Short(d.buf)
+	}
+	acc := d.acc
+	stripes := (len(d.buf) - 1) / xxh3StripeLen
+	for s := range stripes {
+		xxh3Accumulate(&acc, d.buf[s*xxh3StripeLen:], xxh3Secret[s*8:])
+	}
+	// The last stripe is the last 64 bytes, which can reach back into the
+	// previous block
+	var last [xxh3StripeLen]byte
+	if n := len(d.buf); n >= xxh3StripeLen {
+		copy(last[:], d.buf[n-xxh3StripeLen:])
+	} else {
+		copy(last[copy(last[:], d.tail[n:]):], d.buf)
+	}
+	xxh3Accumulate(&acc, last[:], xxh3Secret[len(xxh3Secret)-xxh3StripeLen-xxh3LastAccOff:])
+
+	result := d.total * xxhPrime64_1
+	for i := range 4 {
+		key := xxh3Secret[xxh3MergeAccOff+16*i:]
+		result += xxh3Fold(acc[2*i]^le64(key), acc[2*i+1]^le64(key[8:]))
+	}
+	return xxh3Avalanche(result)
+}
+
+func xxh3Accumulate(acc *[8]uint64, stripe, key []byte) {
+	for i := range 8 {
+		v := le64(stripe[8*i:])
+		k := v ^ le64(key[8*i:])
+		acc[i^1] += v
+		acc[i] += uint64(uint32(k)) * (k >> 32)
+	}
+}
+
+func xxh3Scramble(acc *[8]uint64, key []byte) {
+	for i := range 8 {
+		a := acc[i]
+		a ^= a >> 47
+		a ^= le64(key[8*i:])
+		acc[i] = a * xxhPrime32_1
+	}
+}
+
+// xxh3Short hashes inputs of up to 240 bytes
+func xxh3Short(p []byte) uint64 {
+	n := uint64(len(p))
+	key := xxh3Secret[:]
+	switch {
+	case n == 0:
+		return xxh64Avalanche(le64(key[56:]) ^ le64(key[64:]))
+	case n <= 3:
+		combined := uint32(p[0])<<16 | uint32(p[n>>1])<<24 | uint32(p[n-1]) | uint32(n)<<8
+		return xxh64Avalanche(uint64(combined) ^ uint64(le32(key)^le32(key[4:])))
+	case n <= 8:
+		v := uint64(le32(p[n-4:])) | uint64(le32(p))<<32
+		h := v ^ (le64(key[8:]) ^ le64(key[16:]))
+		h ^= bits.RotateLeft64(h, 49) ^ bits.RotateLeft64(h, 24)
+		h *= xxhPrimeMX2
+		h ^= h>>35 + n
+		h *= xxhPrimeMX2
+		return h ^ h>>28
+	case n <= 16:
+		lo := le64(p) ^ (le64(key[24:]) ^ le64(key[32:]))
+		hi := le64(p[n-8:]) ^ (le64(key[40:]) ^ le64(key[48:]))
+		return xxh3Avalanche(n + bits.ReverseBytes64(lo) + hi + xxh3Fold(lo, hi))
+	case n <= 128:
+		acc := n * xxhPrime64_1
+		for i := uint64(0); i < (n-1)/32+1; i++ {
+			acc += xxh3Mix16(p[16*i:], key[32*i:])
+			acc += xxh3Mix16(p[n-16*(i+1):], key[32*i+16:])
+		}
+		return xxh3Avalanche(acc)
+	default:
+		acc := n * xxhPrime64_1
+		for i := range 8 {
+			acc += xxh3Mix16(p[16*i:], key[16*i:])
+		}
+		acc = xxh3Avalanche(acc)
+		for i := 8; i < len(p)/16; i++ {
+			acc += xxh3Mix16(p[16*i:], key[16*(i-8)+3:])
+		}
+		acc += xxh3Mix16(p[n-16:], key[136-17:])
+		return xxh3Avalanche(acc)
+	}
+}
+
+func xxh3Mix16(p, key []byte) uint64 {
+	return xxh3Fold(le64(p)^le64(key), le64(p[8:])^le64(key[8:]))
+}
+
+// xxh3Fold multiplies to 128 bits and folds the halves together
+func xxh3Fold(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+func xxh3Avalanche(h uint64) uint64 {
+	h ^= h >> 37
+	h *= xxhPrimeMX1
+	return h ^ h>>32
+}
+
+func xxh64Avalanche(h uint64) uint64 {
+	h ^= h >> 33
+	h *= xxhPrime64_2
+	h ^= h >> 29
+	h *= xxhPrime64_3
+	return h ^ h>>32
+}
+
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+func le64(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
@@ -0,0 +1,337 @@
+package sorter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by the sorter config files
+// (block mappings, block sequences, flow sequences/mappings, quoted and
+// plain scalars, comments) into the values encoding/json would produce,
+// along with the line of every value by its JSON pointer. What lies beyond
+// the subset, such as anchors or block scalars, is an error rather than
+// read as something else.
+func parseYAML(data []byte) (any, map[string]int, error) {
+	lines, err := splitYAMLLines(string(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &yamlParser{lines: lines, at: make(map[string]int)}
+	value, err := p.parseBlock(0, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, nil, lineErrorf(p.lines[p.pos].num, "unexpected indentation")
+	}
+	return value, p.at, nil
+}
+
+type yamlLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+	at    map[string]int // JSON pointer to the line of its value
+}
+
+// splitYAMLLines drops blank lines, comments and document markers and
+// records the indentation of every remaining line, which YAML only allows
+// to be spaces
+func splitYAMLLines(data string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(data, "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimSpace(stripYAMLComment(raw))
+		if text == "" || text == "---" || text == "..." {
+			continue
+		}
+		leading := raw[:len(raw)-len(strings.TrimLeft(raw, " \t"))]
+		if strings.Contains(leading, "\t") {
+			return nil, lineErrorf(i+1, "tab in indentation, indent with spaces")
+		}
+		lines = append(lines, yamlLine{indent: len(leading), text: text, num: i + 1})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes a trailing "# comment" that isn't inside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// checkYAMLSupported rejects a key or plain scalar starting with an
+// indicator of YAML the parser doesn't support
+func checkYAMLSupported(text string, num int) error {
+	if text == "" {
+		return nil
+	}
+	switch text[0] {
+	case '&', '*':
+		return lineErrorf(num, "anchors and aliases are not supported")
+	case '|', '>':
+		return lineErrorf(num, "block scalars (| and >) are not supported, write a quoted string")
+	case '!':
+		return lineErrorf(num, "tags are not supported")
+	}
+	return nil
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseBlock(minIndent int, ptr string) (any, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent < minIndent {
+		return nil, nil
+	}
+	line := p.lines[p.pos]
+	if _, ok := p.at[ptr]; !ok {
+		p.at[ptr] = line.num // Unless its key is on a line of its own
+	}
+	if isYAMLSeqItem(line.text) {
+		return p.parseSeq(line.indent, ptr)
+	}
+	if _, _, ok := splitYAMLKey(line.text); !ok {
+		// A lone scalar document
+		p.pos++
+		return p.parseScalar(line.text, line.num, ptr)
+	}
+	return p.parseMap(line.indent, ptr)
+}
+
+func (p *yamlParser) parseMap(indent int, ptr string) (any, error) {
+	m := make(map[string]any)
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, lineErrorf(line.num, "unexpected indentation")
+		}
+		if err := checkYAMLSupported(line.text, line.num); err != nil {
+			return nil, err
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, lineErrorf(line.num, "expected \"key: value\"")
+		}
+		p.pos++
+
+		value, err := p.parseValue(indent, rest, line.num, ptr+"/"+pointerEscaper.Replace(key))
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+func (p *yamlParser) parseSeq(indent int, ptr string) (any, error) {
+	seq := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || (line.indent == indent && !isYAMLSeqItem(line.text)) {
+			break
+		}
+		if line.indent > indent {
+			return nil, lineErrorf(line.num, "unexpected indentation")
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		item := ptr + "/" + strconv.Itoa(len(seq))
+
+		if _, _, ok := splitYAMLKey(rest); ok && !strings.HasPrefix(rest, "{") {
+			// "- key: value" starts a mapping nested at the item's content column
+			itemIndent := indent + len(line.text) - len(rest)
+			p.lines[p.pos] = yamlLine{indent: itemIndent, text: rest, num: line.num}
+			p.at[item] = line.num
+			value, err := p.parseMap(itemIndent, item)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, value)
+			continue
+		}
+
+		p.pos++
+		value, err := p.parseValue(indent, rest, line.num, item)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, value)
+	}
+	return seq, nil
+}
+
+// parseValue parses the value following "key:" or "-"; an empty value
+// introduces a nested block on the following lines
+func (p *yamlParser) parseValue(indent int, rest string, num int, ptr string) (any, error) {
+	p.at[ptr] = num
+	if rest != "" {
+		return p.parseScalar(rest, num, ptr)
+	}
+	if p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		if next.indent > indent || (next.indent == indent && isYAMLSeqItem(next.text)) {
+			return p.parseBlock(next.indent, ptr)
+		}
+	}
+	return nil, nil
+}
+
+// splitYAMLKey splits "key: value" at the first unquoted ": " (or trailing ":")
+func splitYAMLKey(text string) (string, string, bool) {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 {
+				quote = c
+			}
+		case c == '[' || c == '{':
+			if i == 0 {
+				return "", "", false
+			}
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' ' || text[i+1] == '\t'):
+			key := strings.TrimSpace(text[:i])
+			if unquoted, err := unquoteYAML(key); err == nil {
+				key = unquoted
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// parseScalar parses a scalar or a flow collection, which is on one line
+func (p *yamlParser) parseScalar(text string, num int, ptr string) (any, error) {
+	p.at[ptr] = num
+	switch {
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, lineErrorf(num, "unterminated flow sequence")
+		}
+		seq := []any{}
+		for _, item := range splitYAMLFlow(text[1 : len(text)-1]) {
+			value, err := p.parseScalar(item, num, ptr+"/"+strconv.Itoa(len(seq)))
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, value)
+		}
+		return seq, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, lineErrorf(num, "unterminated flow mapping")
+		}
+		m := make(map[string]any)
+		for _, item := range splitYAMLFlow(text[1 : len(text)-1]) {
+			key, rest, ok := splitYAMLKey(item)
+			if !ok {
+				return nil, lineErrorf(num, "expected \"key: value\" in flow mapping")
+			}
+			value, err := p.parseScalar(rest, num, ptr+"/"+pointerEscaper.Replace(key))
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	case strings.HasPrefix(text, `"`), strings.HasPrefix(text, "'"):
+		s, err := unquoteYAML(text)
+		if err != nil {
+			return nil, lineErrorf(num, "%v", err)
+		}
+		return s, nil
+	}
+	if err := checkYAMLSupported(text, num); err != nil {
+		return nil, err
+	}
+
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	return text, nil
+}
+
+// splitYAMLFlow splits the body of a flow collection on top-level commas
+func splitYAMLFlow(body string) []string {
+	var items []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, strings.TrimSpace(body[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(body[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// unquoteYAML handles double-quoted (escape sequences) and single-quoted
+// (a doubled single quote escapes a quote) scalars
+func unquoteYAML(text string) (string, error) {
+	if len(text) >= 2 && text[0] == '\'' && text[len(text)-1] == '\'' {
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		return strconv.Unquote(text)
+	}
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		return "", fmt.Errorf("unterminated quoted string %s", text)
+	}
+	return text, nil
+}
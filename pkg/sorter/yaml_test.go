@@ -0,0 +1,110 @@
+package sorter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+		at   map[string]int // Lines of some values by JSON pointer
+	}{
+		{
+			name: "mapping",
+			src:  "name: photos\ncount: 3\nratio: 0.5\non: true\nnothing: ~\n",
+			want: map[string]any{"name": "photos", "count": int64(3), "ratio": 0.5, "on": true, "nothing": nil},
+			at:   map[string]int{"/count": 2},
+		},
+		{
+			name: "nested mapping",
+			src:  "categories:\n  Images:\n    extensions: [jpg, png]\n",
+			want: map[string]any{"categories": map[string]any{"Images": map[string]any{"extensions": []any{"jpg", "png"}}}},
+			at:   map[string]int{"/categories/Images/extensions": 3},
+		},
+		{
+			name: "sequence of mappings",
+			src:  "rules:\n  - name: invoices\n    category: Finance\n  - name: junk\n    action: delete\n",
+			want: map[string]any{"rules": []any{
+				map[string]any{"name": "invoices", "category": "Finance"},
+				map[string]any{"name": "junk", "action": "delete"},
+			}},
+			at: map[string]int{"/rules/1": 4, "/rules/1/action": 5},
+		},
+		{
+			name: "sequence at the key's indentation",
+			src:  "exclude:\n- node_modules\n- .git\n",
+			want: map[string]any{"exclude": []any{"node_modules", ".git"}},
+		},
+		{
+			name: "comments, quotes and document markers",
+			src:  "---\n# settings\nname: \"a # b\" # comment\nother: 'it''s'\nescaped: \"tab\\there\"\n...\n",
+			want: map[string]any{"name": "a # b", "other": "it's", "escaped": "tab\there"},
+		},
+		{
+			name: "flow mapping",
+			src:  "sizes: {min: 1, max: \"10 MB\"}\n",
+			want: map[string]any{"sizes": map[string]any{"min": int64(1), "max": "10 MB"}},
+		},
+		{
+			name: "quoted key",
+			src:  "\"a: b\": c\n",
+			want: map[string]any{"a: b": "c"},
+		},
+		{
+			name: "CRLF line ends",
+			src:  "a: 1\r\nb: 2\r\n",
+			want: map[string]any{"a": int64(1), "b": int64(2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, at, err := parseYAML([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML() = %#v, want %#v", got, tt.want)
+			}
+			for ptr, line := range tt.at {
+				if at[ptr] != line {
+					t.Errorf("line of %s = %d, want %d", ptr, at[ptr], line)
+				}
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"unexpected indentation", "a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"not a mapping", "a: 1\nb\n", "line 2: expected \"key: value\""},
+		{"unterminated flow sequence", "a: [1, 2\n", "line 1: unterminated flow sequence"},
+		{"unterminated flow mapping", "a: {b: 1\n", "line 1: unterminated flow mapping"},
+		{"unterminated string", "a: \"b\n", "line 1:"},
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tab in indentation"},
+		{"tab after spaces", "a:\n  b:\n  \tc: 1\n", "line 3: tab in indentation"},
+		{"anchor", "base: &base {a: 1}\n", "line 1: anchors and aliases are not supported"},
+		{"alias", "base: {a: 1}\nother: *base\n", "line 2: anchors and aliases are not supported"},
+		{"merge key", "base: {a: 1}\nother:\n  <<: *base\n", "line 3: anchors and aliases are not supported"},
+		{"anchored sequence item", "a:\n  - &x 1\n", "line 2: anchors and aliases are not supported"},
+		{"literal block scalar", "a: |\n  text\n", "line 1: block scalars (| and >) are not supported"},
+		{"folded block scalar", "a:\n  - >-\n    text\n", "line 2: block scalars (| and >) are not supported"},
+		{"tag", "a: !!str 1\n", "line 1: tags are not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseYAML([]byte(tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseYAML() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
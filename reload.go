@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// How often watch mode and serve look for changed config files. They are
+// polled rather than watched, as editors save by replacing files and a
+// rules file may only be created later.
+const reloadPollInterval = 5 * time.Second
+
+// loadSettings reads the category, exclusion and rules files and the rules
+// script of config. It also returns the files to watch for changes, the app
+// config among them.
+func loadSettings(config *AppConfig) (sorter.Settings, []string, error) {
+	var settings sorter.Settings
+	var files []string
+	locate := func(explicit, name string) string {
+		path := config.configFile(explicit, name)
+		if explicit != "" {
+			files = append(files, path)
+		} else {
+			// One appearing ahead of it would take its place
+			files = append(files, config.configCandidates(name, sorter.ConfigExts)...)
+		}
+		return path
+	}
+	extensions := locate(config.Extensions, "extensions")
+	dirExclusions := locate(config.DirExclusions, "dir_exclusions")
+	fileExclusions := locate(config.FileExclusions, "file_exclusions")
+	rulesPath := locate(config.Rules, "rules")
+	scriptPath := config.scriptFile()
+	if config.RulesScript != "" {
+		files = append(files, scriptPath)
+	} else {
+		files = append(files, config.configCandidates("rules", scriptExts)...)
+	}
+	if appConfigFile != "" {
+		files = append(files, appConfigFile)
+	}
+
+	// Without files of their own, sorter's built-in ones apply
+	var err error
+	settings.Categories, err = sorter.LoadCategoryConfig(extensions)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && config.Extensions == "":
+		slog.Info("No extensions.json found, using the built-in categories")
+		settings.Categories, err = builtinCategories()
+	case err == nil && config.ExtendDefaults:
+		var builtin sorter.CategoryConfig
+		builtin, err = builtinCategories()
+		settings.Categories = builtin.Extend(settings.Categories)
+	}
+	if err != nil {
+		return settings, nil, fmt.Errorf("failed to load extension config: %w", err)
+	}
+	if settings.ExcludeDirs, err = loadExclusions(dirExclusions, config.DirExclusions, "dir_exclusions.json"); err != nil {
+		return settings, nil, fmt.Errorf("failed to load exclusion config: %w", err)
+	}
+	if settings.ExcludeFiles, err = loadExclusions(fileExclusions, config.FileExclusions, "file_exclusions.json"); err != nil {
+		return settings, nil, fmt.Errorf("failed to load exclusion config: %w", err)
+	}
+
+	// Rules are optional: only an explicitly configured file has to exist
+	if _, statErr := os.Stat(rulesPath); config.Rules != "" || statErr == nil {
+		if settings.Rules, err = sorter.LoadRules(rulesPath); err != nil {
+			return settings, nil, fmt.Errorf("failed to load rules: %w", err)
+		}
+	}
+	// So is the script, found like the other files
+	if scriptPath != "" {
+		if settings.Script, err = sorter.LoadScript(scriptPath); err != nil {
+			return settings, nil, fmt.Errorf("failed to load rules script: %w", err)
+		}
+	}
+	return settings, files, nil
+}
+
+// loadExclusions reads an exclusion file, or the built-in one of that name
+// when it doesn't exist and the config doesn't name it
+func loadExclusions(path, explicit, builtin string) ([]string, error) {
+	patterns, err := sorter.LoadExclusions(path)
+	if errors.Is(err, fs.ErrNotExist) && explicit == "" {
+		var exclusions sorter.ExclusionConfig
+		if err := loadBuiltin(builtin, &exclusions); err != nil {
+			return nil, err
+		}
+		return exclusions.Patterns(), nil
+	}
+	return patterns, err
+}
+
+// builtinCategories returns the categories of the extensions.json built
+// into sorter
+func builtinCategories() (sorter.CategoryConfig, error) {
+	var categories sorter.CategoryConfig
+	return categories, loadBuiltin("extensions.json", &categories)
+}
+
+// loadBuiltin decodes one of the config files built into sorter
+func loadBuiltin(name string, v any) error {
+	data, err := starterFiles.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return sorter.UnmarshalConfig(name, data, v)
+}
+
+// reloadAppConfig reads the app config again, with the profile and the
+// environment applied as at startup
+func reloadAppConfig() (*AppConfig, error) {
+	config := &AppConfig{}
+	if appConfigFile != "" {
+		loaded, err := loadAppConfig(appConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		config = loaded
+	}
+	if profile != "" {
+		selected, err := config.applyProfile(profile)
+		if err != nil {
+			return nil, err
+		}
+		config = selected
+	}
+	return config, config.applyEnv()
+}
+
+// watchConfig hands the sorter new categories, exclusions and rules when
+// their files change, until stop is closed. A config that fails to load or
+// check is logged and the sorter keeps the last good one. Only these files
+// are reloaded: other settings of the app config need a restart.
+func watchConfig(s *sorter.Sorter, stop <-chan struct{}) {
+	files := reloadFiles
+	stamps := statFiles(files)
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		current := statFiles(files)
+		if maps.Equal(current, stamps) {
+			continue
+		}
+		stamps = current
+
+		config, err := reloadAppConfig()
+		var settings sorter.Settings
+		var loaded []string
+		if err == nil {
+			settings, loaded, err = loadSettings(config)
+		}
+		if err == nil {
+			err = s.Reload(settings)
+		}
+		if err != nil {
+			slog.Error("Config change rejected, keeping the previous config", "err", err)
+			continue
+		}
+		slog.Info("Config change loaded, applied from the next run")
+		if !slices.Equal(loaded, files) {
+			files = loaded
+			stamps = statFiles(files)
+		}
+	}
+}
+
+// fileStamp tells apart versions of a config file
+type fileStamp struct {
+	size    int64
+	modTime int64
+}
+
+// statFiles returns the stamps of the files that exist
+func statFiles(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			stamps[file] = fileStamp{info.Size(), info.ModTime().UnixNano()}
+		}
+	}
+	return stamps
+}
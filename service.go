@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"sorter/pkg/sorter"
+)
+
+// serviceName names the service of the current profile, so several can
+// run side by side
+func serviceName() string {
+	if profile != "" {
+		return "sorter-" + profile
+	}
+	return "sorter"
+}
+
+// serviceFlags returns the flags a service runs sorter -watch with
+func serviceFlags(skip ...string) []string {
+	return append([]string{"-watch"}, unattendedFlags(skip...)...)
+}
+
+// unattendedFlags returns the flags of the current command line, skip and
+// the ones that make no sense unattended left out, and the config file in
+// use even if it was found in the user's config directory, which a service
+// running as another user wouldn't search
+func unattendedFlags(skip ...string) []string {
+	var flags []string
+	if appConfigFile != "" && !flagSet("config") {
+		if abs, err := filepath.Abs(appConfigFile); err == nil {
+			flags = append(flags, "-config="+abs)
+		}
+	}
+	skip = append(skip, "watch", "interactive", "output", "chdir")
+	return append(flags, commandLineFlags(skip...)...)
+}
+
+// commandLineFlags returns the flags of the command line as -name=value,
+// in order and repeats included, leaving out those of skip
+func commandLineFlags(skip ...string) []string {
+	var flags []string
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			continue // The command or its file arguments
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := flag.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && boolFlag.IsBoolFlag()) && i+1 < len(args) {
+			i++
+			value, hasValue = args[i], true
+		}
+		if slices.Contains(skip, name) {
+			continue
+		}
+		if !hasValue {
+			value = "true"
+		}
+		flags = append(flags, "-"+name+"="+value)
+	}
+	return flags
+}
+
+// serviceRun reports whether the command is the one the Windows service
+// manager starts
+func serviceRun(cmd command) bool {
+	return cmd.name == "service" && len(cmdArgs) == 1 && cmdArgs[0] == "run"
+}
+
+// runService manages the Windows service of the current profile, which
+// runs sorter -watch with the flags given to install
+func runService(s *sorter.Sorter) error {
+	if len(cmdArgs) != 1 {
+		return errors.New("service needs one of install, uninstall, start or stop")
+	}
+	switch cmdArgs[0] {
+	case "install":
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		args := append([]string{"-chdir=" + wd}, serviceFlags()...)
+		return installService(serviceName(), "Sorts files arriving in "+engine.InboxDir(), append(args, "service", "run"))
+	case "uninstall":
+		return uninstallService(serviceName())
+	case "start":
+		return startService(serviceName())
+	case "stop":
+		return stopService(serviceName())
+	default:
+		return errors.New("service needs one of install, uninstall, start or stop")
+	}
+}
+
+// runServiceWatch is sort -watch under the Windows service manager, which
+// is told when it ends; the command line it installs ends in "service run"
+func runServiceWatch(s *sorter.Sorter) error {
+	err := runSort(s)
+	if errors.Is(err, sorter.ErrAborted) {
+		serviceExited(nil)
+	} else {
+		serviceExited(err)
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNotWindows = errors.New("the service command needs Windows; install-service sets up systemd")
+
+func installService(name, description string, args []string) error {
+	return errNotWindows
+}
+
+func uninstallService(name string) error {
+	return errNotWindows
+}
+
+func startService(name string) error {
+	return errNotWindows
+}
+
+func stopService(name string) error {
+	return errNotWindows
+}
+
+// connectService fails: only Windows has a service manager to connect to
+func connectService() (<-chan struct{}, context.Context, error) {
+	return nil, nil, errNotWindows
+}
+
+func serviceExited(err error) {}
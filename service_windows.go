@@ -0,0 +1,430 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procOpenSCManagerW               = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW               = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                 = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procStartServiceW                = advapi32.NewProc("StartServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procQueryServiceStatus           = advapi32.NewProc("QueryServiceStatus")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procChangeServiceConfig2W        = advapi32.NewProc("ChangeServiceConfig2W")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW         = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                 = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW              = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW               = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW                = advapi32.NewProc("RegDeleteKeyW")
+	procRegCloseKey                  = advapi32.NewProc("RegCloseKey")
+)
+
+const (
+	scManagerConnect       = 0x1
+	scManagerCreateService = 0x2
+	serviceQueryStatus     = 0x4
+	serviceStart           = 0x10
+	serviceStop            = 0x20
+	serviceAllAccess       = 0xf01ff
+	accessDelete           = 0x10000
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+	serviceConfigDesc      = 1
+	serviceConfigFailure   = 2
+	scActionRestart        = 1
+
+	serviceControlStop     = 1
+	serviceControlShutdown = 5
+	serviceAcceptStop      = 1
+	serviceAcceptShutdown  = 4
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	errorServiceSpecific = 1066
+
+	eventlogError       = 1
+	eventlogWarning     = 2
+	eventlogInformation = 4
+
+	hkeyLocalMachine = 0x80000002
+	keySetValue      = 0x2
+	regExpandSz      = 2
+	regDword         = 4
+)
+
+// SERVICE_STATUS
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// SERVICE_FAILURE_ACTIONSW and SC_ACTION
+type serviceFailureActions struct {
+	resetPeriod uint32
+	rebootMsg   *uint16
+	command     *uint16
+	actions     uint32
+	action      *scAction
+}
+
+type scAction struct {
+	kind  uint32
+	delay uint32 // Milliseconds
+}
+
+// call calls a Win32 function that returns zero on failure. Like
+// LazyProc.Call, it keeps the pointers converted in its arguments alive.
+//
+//go:uintptrescapes
+func call(proc *syscall.LazyProc, args ...uintptr) (uintptr, error) {
+	r, _, err := proc.Call(args...)
+	if r == 0 {
+		return 0, fmt.Errorf("%s: %w", proc.Name, err)
+	}
+	return r, nil
+}
+
+// utf16Ptr converts s for a Win32 call; it is only kept alive when
+// converted to uintptr in the call expression itself
+func utf16Ptr(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
+
+// openService opens the service manager and the named service in it
+func openService(name string, access uintptr) (scm, service uintptr, err error) {
+	scm, err = call(procOpenSCManagerW, 0, 0, scManagerConnect)
+	if err != nil {
+		return 0, 0, err
+	}
+	service, err = call(procOpenServiceW, scm, uintptr(unsafe.Pointer(utf16Ptr(name))), access)
+	if err != nil {
+		procCloseServiceHandle.Call(scm)
+		return 0, 0, fmt.Errorf("service %s: %w", name, err)
+	}
+	return scm, service, nil
+}
+
+func closeService(scm, service uintptr) {
+	procCloseServiceHandle.Call(service)
+	procCloseServiceHandle.Call(scm)
+}
+
+// installService registers a service started at boot that runs this
+// executable with args as LocalSystem and is restarted when it fails, and
+// an event log source of the same name
+func installService(name, description string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	command := syscall.EscapeArg(exe)
+	for _, arg := range args {
+		command += " " + syscall.EscapeArg(arg)
+	}
+
+	scm, err := call(procOpenSCManagerW, 0, 0, scManagerConnect|scManagerCreateService)
+	if err != nil {
+		return fmt.Errorf("%w (installing a service needs an administrator prompt)", err)
+	}
+	defer procCloseServiceHandle.Call(scm)
+	service, err := call(procCreateServiceW, scm, uintptr(unsafe.Pointer(utf16Ptr(name))), uintptr(unsafe.Pointer(utf16Ptr(name))), serviceAllAccess,
+		serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal, uintptr(unsafe.Pointer(utf16Ptr(command))), 0, 0, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("installing service %s: %w", name, err)
+	}
+	defer procCloseServiceHandle.Call(service)
+
+	desc := struct{ text *uint16 }{utf16Ptr(description)}
+	procChangeServiceConfig2W.Call(service, serviceConfigDesc, uintptr(unsafe.Pointer(&desc)))
+	restart := scAction{kind: scActionRestart, delay: 30_000}
+	failure := serviceFailureActions{resetPeriod: 24 * 3600, actions: 1, action: &restart}
+	procChangeServiceConfig2W.Call(service, serviceConfigFailure, uintptr(unsafe.Pointer(&failure)))
+
+	if err := installEventSource(name); err != nil {
+		slog.Warn("Failed to register the event log source, messages will show without formatting", "err", err)
+	}
+	fmt.Printf("Installed service %s, running:\n  %s\nStart it with: sorter service start\n", name, command)
+	fmt.Printf("It runs as LocalSystem, which can't see mapped drives; to run it as you, set Log On in services.msc.\n")
+	return nil
+}
+
+// installEventSource registers name as a source of the Application log,
+// with the messages of EventCreate.exe, which are the text they are given
+func installEventSource(name string) error {
+	var key uintptr
+	path := `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + name
+	if r, _, _ := procRegCreateKeyExW.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(path))), 0, 0, 0, keySetValue, 0, uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return syscall.Errno(r)
+	}
+	defer procRegCloseKey.Call(key)
+
+	file, _ := syscall.UTF16FromString(`%SystemRoot%\System32\EventCreate.exe`)
+	if r, _, _ := procRegSetValueExW.Call(key, uintptr(unsafe.Pointer(utf16Ptr("EventMessageFile"))), 0, regExpandSz, uintptr(unsafe.Pointer(&file[0])), uintptr(2*len(file))); r != 0 {
+		return syscall.Errno(r)
+	}
+	types := uint32(eventlogError | eventlogWarning | eventlogInformation)
+	if r, _, _ := procRegSetValueExW.Call(key, uintptr(unsafe.Pointer(utf16Ptr("TypesSupported"))), 0, regDword, uintptr(unsafe.Pointer(&types)), 4); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	scm, service, err := openService(name, accessDelete)
+	if err != nil {
+		return err
+	}
+	defer closeService(scm, service)
+	if _, err := call(procDeleteService, service); err != nil {
+		return err
+	}
+	procRegDeleteKeyW.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(`SYSTEM\CurrentControlSet\Services\EventLog\Application\`+name))))
+	fmt.Printf("Uninstalled service %s\n", name)
+	return nil
+}
+
+func startService(name string) error {
+	scm, service, err := openService(name, serviceStart)
+	if err != nil {
+		return err
+	}
+	defer closeService(scm, service)
+	if _, err := call(procStartServiceW, service, 0, 0); err != nil {
+		return err
+	}
+	fmt.Printf("Started service %s\n", name)
+	return nil
+}
+
+// stopService asks the service to stop and waits for it to finish the
+// file in progress
+func stopService(name string) error {
+	scm, service, err := openService(name, serviceStop|serviceQueryStatus)
+	if err != nil {
+		return err
+	}
+	defer closeService(scm, service)
+	var status serviceStatus
+	if _, err := call(procControlService, service, serviceControlStop, uintptr(unsafe.Pointer(&status))); err != nil {
+		return err
+	}
+	fmt.Printf("Stopping service %s...\n", name)
+	for deadline := time.Now().Add(5 * time.Minute); status.currentState != serviceStopped; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s is still stopping", name)
+		}
+		time.Sleep(500 * time.Millisecond)
+		if _, err := call(procQueryServiceStatus, service, uintptr(unsafe.Pointer(&status))); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Stopped service %s\n", name)
+	return nil
+}
+
+// The service run by this process. The service manager calls serviceMain
+// and serviceHandler on threads of its own.
+var svc struct {
+	name    *uint16
+	handle  uintptr
+	started chan error
+	stop    chan struct{}
+	cancel  context.CancelFunc
+	stops   int
+	exit    chan uint32 // Exit code of watch mode
+	exited  chan struct{}
+}
+
+// connectService hands the process over to the service manager, and logs
+// to the event log unless -log-file is set. It returns the stop requests
+// of the service manager, as stopSignal does those of Ctrl-C.
+func connectService() (<-chan struct{}, context.Context, error) {
+	name, err := syscall.UTF16PtrFromString(serviceName())
+	if err != nil {
+		return nil, nil, err
+	}
+	svc.name = name
+	svc.started = make(chan error, 1)
+	svc.stop = make(chan struct{})
+	svc.exit = make(chan uint32)
+	svc.exited = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	svc.cancel = cancel
+
+	table := []serviceTableEntry{{name, syscall.NewCallback(serviceMain)}, {}}
+	go func() {
+		// The dispatcher keeps this thread until the service stops
+		runtime.LockOSThread()
+		if _, err := call(procStartServiceCtrlDispatcherW, uintptr(unsafe.Pointer(&table[0]))); err != nil {
+			svc.started <- err
+		}
+	}()
+	if err := <-svc.started; err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("%w (service run is for the service manager, try service start)", err)
+	}
+
+	if logFile == "" {
+		source, err := call(procRegisterEventSourceW, 0, uintptr(unsafe.Pointer(utf16Ptr(serviceName()))))
+		if err != nil {
+			slog.Warn("Failed to open the event log", "err", err)
+		} else {
+			slog.SetDefault(slog.New(newEventLogHandler(source)))
+		}
+	}
+	return svc.stop, ctx, nil
+}
+
+func serviceMain(argc, argv uintptr) uintptr {
+	handle, err := call(procRegisterServiceCtrlHandlerEx, uintptr(unsafe.Pointer(svc.name)), syscall.NewCallback(serviceHandler), 0)
+	if err != nil {
+		svc.started <- err
+		return 0
+	}
+	svc.handle = handle
+	setServiceStatus(serviceRunning, 0)
+	svc.started <- nil
+
+	code := <-svc.exit
+	setServiceStatus(serviceStopped, code)
+	close(svc.exited)
+	return 0
+}
+
+// serviceHandler takes the controls of the service manager: a first stop
+// ends the pass in progress after the current file, a second one at once
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStopPending, 0)
+		svc.stops++
+		if svc.stops == 1 {
+			slog.Info("Stopping", "control", "service manager")
+			close(svc.stop)
+		} else {
+			slog.Info("Stopping at once", "control", "service manager")
+			svc.cancel()
+		}
+	}
+	return 0
+}
+
+func setServiceStatus(state, code uint32) {
+	status := serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state}
+	switch state {
+	case serviceRunning:
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	case serviceStopPending:
+		status.waitHint = uint32((5 * time.Minute).Milliseconds())
+	}
+	if code != 0 {
+		status.win32ExitCode, status.serviceSpecificExitCode = errorServiceSpecific, code
+	}
+	procSetServiceStatus.Call(svc.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+// serviceExited tells the service manager the service stopped, failed if
+// err is set, once it has finished sorting
+func serviceExited(err error) {
+	if svc.exit == nil {
+		return
+	}
+	var code uint32
+	if err != nil {
+		code = 1
+	}
+	svc.exit <- code
+	<-svc.exited
+}
+
+// eventLogHandler writes log records to the event log, formatted as the
+// text handler does without the time and level, which the event log has
+type eventLogHandler struct {
+	source uintptr
+	mu     *sync.Mutex
+	buf    *bytes.Buffer
+	text   slog.Handler
+}
+
+func newEventLogHandler(source uintptr) *eventLogHandler {
+	var level slog.Level
+	level.UnmarshalText([]byte(logLevel))
+	buf := new(bytes.Buffer)
+	text := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &eventLogHandler{source: source, mu: new(sync.Mutex), buf: buf, text: text}
+}
+
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.text.Handle(ctx, r); err != nil {
+		return err
+	}
+	kind := eventlogInformation
+	switch {
+	case r.Level >= slog.LevelError:
+		kind = eventlogError
+	case r.Level >= slog.LevelWarn:
+		kind = eventlogWarning
+	}
+	text := utf16Ptr(strings.TrimSpace(h.buf.String()))
+	// Event 1 of EventCreate.exe is its only string
+	_, err := call(procReportEventW, h.source, uintptr(kind), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&text)), 0)
+	return err
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{source: h.source, mu: h.mu, buf: h.buf, text: h.text.WithAttrs(attrs)}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{source: h.source, mu: h.mu, buf: h.buf, text: h.text.WithGroup(name)}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// watchdogSec is how long systemd lets the watcher go without a sign of
+// progress before restarting it. Reads touch the status every few
+// megabytes, so only a hung mount or a stuck walk gets anywhere near.
+const watchdogSec = 5 * time.Minute
+
+// runInstallService writes a systemd unit running the current command line
+// in watch mode: a user unit, or a system one with -system
+func runInstallService(s *sorter.Sorter) error {
+	if runtime.GOOS != "linux" {
+		return errors.New("systemd units are for Linux")
+	}
+	name := "sorter.service"
+	if profile != "" {
+		name = "sorter-" + profile + ".service"
+	}
+	dir := "/etc/systemd/system"
+	if !systemUnit {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(configDir, "systemd", "user")
+	}
+	unit, err := serviceUnit()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(unit), 0o644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s. To start it now and at every boot:\n", path)
+	if systemUnit {
+		fmt.Printf("  systemctl daemon-reload\n  systemctl enable --now %s\n", name)
+	} else {
+		fmt.Printf("  systemctl --user daemon-reload\n  systemctl --user enable --now %s\n", name)
+		fmt.Printf("and, to keep it running while you're logged out:\n  loginctl enable-linger\n")
+	}
+	return nil
+}
+
+// serviceUnit returns the unit running sorter -watch with the flags given
+// now, from the current directory
+func serviceUnit() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	args := append([]string{exe}, serviceFlags("system")...)
+	for i, arg := range args {
+		args[i] = systemdQuote(arg)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by sorter install-service\n")
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=Sort files arriving in %s\n", systemdEscape(engine.InboxDir()))
+	fmt.Fprintf(&b, "Wants=network-online.target\n")
+	fmt.Fprintf(&b, "After=local-fs.target network-online.target\n\n")
+	fmt.Fprintf(&b, "[Service]\n")
+	fmt.Fprintf(&b, "Type=notify\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", systemdEscape(wd))
+	if systemUnit {
+		if name := os.Getenv("SUDO_USER"); name != "" {
+			fmt.Fprintf(&b, "User=%s\n", name)
+		} else if u, err := user.Current(); err == nil && u.Uid != "0" {
+			fmt.Fprintf(&b, "User=%s\n", u.Username)
+		}
+	}
+	fmt.Fprintf(&b, "Restart=on-failure\n")
+	fmt.Fprintf(&b, "RestartSec=30\n")
+	fmt.Fprintf(&b, "WatchdogSec=%d\n", int(watchdogSec.Seconds()))
+	fmt.Fprintf(&b, "# Leave time to finish the file in progress and write the checkpoint\n")
+	fmt.Fprintf(&b, "TimeoutStopSec=5min\n\n")
+	fmt.Fprintf(&b, "[Install]\n")
+	if systemUnit {
+		fmt.Fprintf(&b, "WantedBy=multi-user.target\n")
+	} else {
+		fmt.Fprintf(&b, "WantedBy=default.target\n")
+	}
+	return b.String(), nil
+}
+
+// systemdEscape escapes the specifiers of a unit setting
+func systemdEscape(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// systemdQuote quotes an ExecStart argument where needed, escaping
+// specifiers and variables
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// sdNotify sends a state change to systemd when it started the sorter as a
+// Type=notify service, and does nothing otherwise
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // Abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects to hear from the
+// sorter, 0 when it doesn't
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd tells systemd the watcher is ready, and keeps its status
+// line and watchdog up to date until the returned function is called. The
+// watchdog is only fed while s is waiting for files or has shown progress
+// within the interval, so a pass stuck on a hung mount gets the service
+// restarted.
+func notifySystemd(s *sorter.Sorter) (stop func()) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return func() {}
+	}
+	if err := sdNotify("READY=1\nSTATUS=Watching for new files"); err != nil {
+		slog.Warn("Failed to notify systemd", "err", err)
+	}
+	watchdog := watchdogInterval()
+	interval := 10 * time.Second
+	if watchdog > 0 {
+		interval = min(interval, watchdog/2)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			status := s.Status()
+			idle := time.Since(status.Active)
+			state := "STATUS=" + systemdStatus(status, idle)
+			if watchdog > 0 && (!status.Running || idle < watchdog) {
+				state += "\nWATCHDOG=1"
+			}
+			sdNotify(state)
+		}
+	}()
+	return func() {
+		close(done)
+		sdNotify("STOPPING=1")
+	}
+}
+
+// systemdStatus is the status line systemctl status shows
+func systemdStatus(status sorter.Status, idle time.Duration) string {
+	switch {
+	case !status.Running && engine.Schedule != "":
+		return "Waiting for the next scheduled run"
+	case !status.Running:
+		return "Watching for new files"
+	case idle > time.Minute:
+		return fmt.Sprintf("No progress for %s, at %s", idle.Round(time.Second), status.Current)
+	case status.Stage != "":
+		return fmt.Sprintf("%s, %d files done", status.Stage, status.Done)
+	default:
+		return "Sorting " + status.Current
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// makeRaw can't change the terminal mode on platforms without termios;
+// dashboard keys then have to be followed by Enter
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"sorter/pkg/sorter"
+)
+
+// Dashboard states
+const (
+	dashRunning  = "running"
+	dashPaused   = "paused"
+	dashQuitting = "quitting"
+	dashDone     = "done"
+)
+
+const (
+	dashRefresh    = 100 * time.Millisecond // Redraw interval
+	dashCategories = 10                     // Busiest categories shown
+	dashErrors     = 5                      // Most recent errors shown
+)
+
+// dashboard is the full-screen frontend of -output tui. It is fed by the
+// sorter's events and holds the run between files while paused.
+type dashboard struct {
+	mu    sync.Mutex
+	out   *os.File
+	start time.Time
+	state string
+
+	current    string // File being processed
+	files      int
+	bytes      int64
+	sorted     int
+	duplicates int
+	deleted    int // Sent to the delete folder by a rule
+	skipped    int
+	failed     int
+	errors     []sorter.Event    // Most recent last
+	categories map[string]int    // Files sorted into each category
+	pending    map[string]string // Category of files not moved yet
+
+	resume  chan struct{} // Closed when a pause ends
+	done    chan struct{}
+	stopped sync.WaitGroup
+	restore func()
+}
+
+func newDashboard(out *os.File) *dashboard {
+	return &dashboard{
+		out:        out,
+		state:      dashRunning,
+		categories: make(map[string]int),
+		pending:    make(map[string]string),
+		done:       make(chan struct{}),
+	}
+}
+
+// isTerminal reports whether f is connected to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// record updates the counters; it is chained into Options.Events
+func (d *dashboard) record(event sorter.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch event.Type {
+	case sorter.EventFile:
+		d.current = event.Path
+		d.files++
+		d.bytes += event.Size
+	case sorter.EventCategory:
+		d.pending[event.Path] = event.Category
+	case sorter.EventMoved:
+		switch event.Reason {
+		case "sorted":
+			d.sorted++
+			d.categories[d.pending[event.Path]]++
+		case "duplicate":
+			d.duplicates++
+		case "rule":
+			d.deleted++
+		}
+		delete(d.pending, event.Path)
+	case sorter.EventSkipped:
+		d.skipped++
+	case sorter.EventError:
+		d.failed++
+		d.errors = append(d.errors, event)
+		if len(d.errors) > dashErrors {
+			d.errors = d.errors[1:]
+		}
+	}
+}
+
+// confirm is used as Options.Confirm: it holds the run while paused and
+// stops it once quit was pressed
+func (d *dashboard) confirm(src, dest, reason string) (bool, error) {
+	for {
+		d.mu.Lock()
+		state, resume := d.state, d.resume
+		d.mu.Unlock()
+
+		switch state {
+		case dashPaused:
+			<-resume
+		case dashQuitting:
+			return false, sorter.ErrAborted
+		default:
+			return true, nil
+		}
+	}
+}
+
+func (d *dashboard) togglePause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch d.state {
+	case dashRunning:
+		d.state = dashPaused
+		d.resume = make(chan struct{})
+	case dashPaused:
+		d.state = dashRunning
+		close(d.resume)
+	}
+}
+
+// quit stops the run after the file in progress
+func (d *dashboard) quit() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == dashPaused {
+		close(d.resume)
+	}
+	if d.state != dashDone {
+		d.state = dashQuitting
+	}
+}
+
+// run takes over the terminal until stop is called
+func (d *dashboard) run() {
+	d.start = time.Now()
+	if restore, err := makeRaw(os.Stdin); err == nil {
+		d.restore = restore
+	}
+	fmt.Fprint(d.out, "\033[?1049h\033[?25l") // Alternate screen, hide cursor
+
+	// Ctrl-C quits cleanly instead of leaving the terminal in raw mode
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go d.readKeys(os.Stdin)
+
+	d.stopped.Add(1)
+	go func() {
+		defer d.stopped.Done()
+		defer signal.Stop(signals)
+		ticker := time.NewTicker(dashRefresh)
+		defer ticker.Stop()
+		for {
+			d.render(d.out)
+			select {
+			case <-ticker.C:
+			case <-signals:
+				d.quit()
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop gives the terminal back and prints a summary of the run
+func (d *dashboard) stop() {
+	d.mu.Lock()
+	d.state = dashDone
+	d.mu.Unlock()
+	close(d.done)
+	d.stopped.Wait()
+
+	fmt.Fprint(d.out, "\033[?25h\033[?1049l") // Show cursor, leave alternate screen
+	if d.restore != nil {
+		d.restore()
+	}
+	fmt.Fprintf(d.out, "Processed %d files (%s) in %s: %d sorted, %d duplicates, %d deleted by rule, %d skipped, %d errors\n",
+		d.files, formatBytes(d.bytes), time.Since(d.start).Round(time.Second), d.sorted, d.duplicates, d.deleted, d.skipped, d.failed)
+	for _, event := range d.errors {
+		fmt.Fprintf(d.out, "  %s: %s\n", event.Path, event.Error)
+	}
+}
+
+// readKeys handles p/space (pause, resume) and q (quit)
+func (d *dashboard) readKeys(in io.Reader) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := in.Read(buf); err != nil {
+			return
+		}
+		switch buf[0] {
+		case 'p', ' ':
+			d.togglePause()
+		case 'q':
+			d.quit()
+		}
+	}
+}
+
+// render redraws the whole screen
+func (d *dashboard) render(w io.Writer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString("\033[K\n") // Clear what's left of the previous frame
+	}
+
+	b.WriteString("\033[H")
+	elapsed := time.Since(d.start)
+	keys := "[p] pause/resume  [q] quit"
+	if d.restore == nil {
+		keys += ", then Enter" // The terminal is still line-buffered
+	}
+	line("sorter  %-8s  %s    %s", d.state, elapsed.Round(time.Second), keys)
+	if engine.DryRun {
+		line("DRY RUN: nothing is moved")
+	}
+	if len(engine.Inboxes) > 0 {
+		line("Inbox   %s (+%d more)", engine.InboxDir(), len(engine.Inboxes))
+	} else {
+		line("Inbox   %s", engine.InboxDir())
+	}
+	line("")
+	line("Files       %6d  %s, %.1f files/s", d.files, formatBytes(d.bytes), float64(d.files)/elapsed.Seconds())
+	line("Sorted      %6d", d.sorted)
+	line("Duplicates  %6d", d.duplicates)
+	line("Rule delete %6d", d.deleted)
+	line("Skipped     %6d", d.skipped)
+	line("Errors      %6d", d.failed)
+
+	if len(d.categories) > 0 {
+		names := make([]string, 0, len(d.categories))
+		for name := range d.categories {
+			names = append(names, name)
+		}
+		slices.SortFunc(names, func(a, b string) int {
+			return cmp.Or(cmp.Compare(d.categories[b], d.categories[a]), strings.Compare(a, b))
+		})
+		line("")
+		line("Categories")
+		for _, name := range names[:min(len(names), dashCategories)] {
+			line("  %6d  %s", d.categories[name], name)
+		}
+	}
+
+	if len(d.errors) > 0 {
+		line("")
+		line("Recent errors")
+		for _, event := range d.errors {
+			line("  %s: %s", event.Path, event.Error)
+		}
+	}
+
+	line("")
+	line("Now: %s", d.current)
+	b.WriteString("\033[J") // Clear below
+	io.WriteString(w, b.String())
+}
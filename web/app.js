@@ -0,0 +1,238 @@
+// The dashboard of sorter serve: it only talks to the JSON API, following
+// runs on /api/events and refreshing the tables when one ends.
+"use strict";
+
+let token = localStorage.getItem("sorter-token") || "";
+
+async function api(method, path, body) {
+  const headers = {};
+  if (token) {
+    headers["Authorization"] = "Bearer " + token;
+  }
+  if (method !== "GET") {
+    headers["Content-Type"] = "application/json";
+  }
+  const resp = await fetch(path, {method, headers, body: body === undefined ? undefined : JSON.stringify(body)});
+  if (resp.status === 401) {
+    await login();
+    return api(method, path, body);
+  }
+  const data = await resp.json();
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+function login() {
+  const dialog = document.getElementById("login");
+  dialog.showModal();
+  return new Promise(resolve => {
+    dialog.addEventListener("close", () => {
+      token = document.getElementById("token").value;
+      localStorage.setItem("sorter-token", token);
+      resolve();
+    }, {once: true});
+  });
+}
+
+function size(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return (i === 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+}
+
+function when(time) {
+  return new Date(time).toLocaleString();
+}
+
+// row appends a table row of cells, which are text or elements
+function row(tbody, ...cells) {
+  const tr = tbody.insertRow();
+  for (const cell of cells) {
+    const td = tr.insertCell();
+    if (cell instanceof Node) {
+      td.append(cell);
+    } else {
+      td.textContent = cell;
+    }
+  }
+  return tr;
+}
+
+function showError(err) {
+  document.getElementById("state").textContent = err.message;
+  document.getElementById("state").className = "error";
+}
+
+function showStatus(data) {
+  const busy = data.busy || (data.status && data.status.running ? "sort" : "");
+  document.getElementById("state").className = "";
+  document.getElementById("state").textContent = busy ? "Busy: " + busy : "Idle";
+  document.getElementById("run").disabled = !!busy;
+  document.getElementById("dedupe").disabled = !!busy;
+  if (data.last_run) {
+    showRun(data.last_run);
+  }
+  if (data.status) {
+    showProgress(data.status);
+  }
+}
+
+function showProgress(status) {
+  const bar = document.getElementById("bar");
+  if (status.stage) {
+    const files = status.total > 0 ? `${status.done}/${status.total}` : `${status.done}`;
+    document.getElementById("stage").textContent = `${status.stage}: ${files} files, ${size(status.bytes)}`;
+    bar.max = status.total || 1;
+    bar.value = status.total > 0 ? status.done : 0;
+  } else {
+    document.getElementById("stage").textContent = status.running ? "Starting…" : "Idle";
+    bar.value = 0;
+  }
+  document.getElementById("current").textContent = status.current || "";
+}
+
+function showRun(run) {
+  let text = `Last ${run.command} started ${when(run.started)}`;
+  if (run.finished) {
+    text += `, finished ${when(run.finished)}`;
+  }
+  const el = document.getElementById("last-run");
+  el.textContent = run.error ? `${text}: ${run.error}` : text;
+  el.className = run.error ? "error" : "";
+}
+
+async function refreshStats() {
+  const stats = await api("GET", "/api/stats");
+  document.getElementById("totals").textContent =
+    `Inbox ${stats.inbox.files} files (${size(stats.inbox.bytes)}), ` +
+    `sorted ${stats.sorted.files} files (${size(stats.sorted.bytes)}), ` +
+    `delete folder ${stats.delete.files} files (${size(stats.delete.bytes)})`;
+  const tbody = document.querySelector("#categories tbody");
+  tbody.replaceChildren();
+  for (const c of stats.categories || []) {
+    const tr = row(tbody, c.category, String(c.files), size(c.bytes));
+    tr.cells[1].className = tr.cells[2].className = "num";
+  }
+}
+
+async function refreshDeleted() {
+  const files = await api("GET", "/api/deleted");
+  const tbody = document.querySelector("#deleted tbody");
+  tbody.replaceChildren();
+  // Duplicates first, the newest on top
+  files.sort((a, b) => (a.reason === "duplicate" ? 0 : 1) - (b.reason === "duplicate" ? 0 : 1) || (b.since || "").localeCompare(a.since || ""));
+  for (const f of files) {
+    const restore = document.createElement("button");
+    restore.textContent = "Restore";
+    restore.onclick = async () => {
+      restore.disabled = true;
+      try {
+        await api("POST", "/api/deleted/restore", {paths: [f.path]});
+      } catch (err) {
+        showError(err);
+      }
+      refresh();
+    };
+    const name = f.path.split(/[\\/]/).pop();
+    const reason = f.reason === "duplicate" && f.duplicate_of ? `duplicate of ${f.duplicate_of}` : (f.reason || "unknown");
+    row(tbody, name, reason, f.origin || "", f.since ? when(f.since) : "unknown", restore);
+  }
+}
+
+const recentErrors = [];
+
+async function refreshErrors() {
+  const errors = await api("GET", "/api/errors");
+  recentErrors.splice(0, recentErrors.length, ...errors);
+  showErrors();
+}
+
+function showErrors() {
+  const tbody = document.querySelector("#errors tbody");
+  tbody.replaceChildren();
+  for (const e of recentErrors.slice().reverse()) {
+    row(tbody, when(e.time), e.path, e.error).className = "error";
+  }
+}
+
+function refresh() {
+  api("GET", "/api/status").then(showStatus).catch(showError);
+  refreshStats().catch(showError);
+  refreshDeleted().catch(showError);
+  refreshErrors().catch(showError);
+}
+
+// follow reads /api/events for as long as the server is up, reconnecting
+// when it goes away
+async function follow() {
+  for (;;) {
+    try {
+      const headers = token ? {"Authorization": "Bearer " + token} : {};
+      const resp = await fetch("/api/events", {headers});
+      if (resp.status === 401) {
+        await login();
+        continue;
+      }
+      const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+      let buffered = "";
+      for (;;) {
+        const {value, done} = await reader.read();
+        if (done) {
+          break;
+        }
+        buffered += value;
+        const lines = buffered.split("\n");
+        buffered = lines.pop();
+        for (const line of lines) {
+          handle(JSON.parse(line));
+        }
+      }
+    } catch (err) {
+      showError(err);
+    }
+    await new Promise(resolve => setTimeout(resolve, 3000));
+    refresh();
+  }
+}
+
+function handle(message) {
+  if (message.progress) {
+    showProgress(message.progress);
+  }
+  if (message.run) {
+    showRun(message.run);
+    if (message.run.finished) {
+      refresh();
+    } else {
+      showStatus({busy: message.run.command});
+    }
+  }
+  if (message.event) {
+    document.getElementById("current").textContent = message.event.path;
+    if (message.event.type === "error") {
+      recentErrors.push(message.event);
+      recentErrors.splice(0, recentErrors.length - 50);
+      showErrors();
+    }
+  }
+}
+
+for (const command of ["run", "dedupe"]) {
+  document.getElementById(command).onclick = async () => {
+    try {
+      const run = await api("POST", "/api/runs?command=" + (command === "run" ? "sort" : "dedupe"));
+      showStatus({busy: run.command, last_run: run});
+    } catch (err) {
+      showError(err);
+    }
+  };
+}
+
+refresh();
+follow();